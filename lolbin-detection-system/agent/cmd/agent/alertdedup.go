@@ -0,0 +1,205 @@
+// alertdedup.go
+// Deduplication of outbound alerts by fingerprint. Unlike the cooldown,
+// which throttles identical alerts in memory, the fingerprints of recent
+// alerts are persisted, so an agent that restarts or crash-loops doesn't
+// alert again on the same logical detection within the window.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AlertDedupConfig configures fingerprint deduplication of alerts
+type AlertDedupConfig struct {
+	// Fingerprint is the template identifying alerts for the same logical
+	// detection, made of text and {field} placeholders
+	Fingerprint string `yaml:"fingerprint"`
+	// Window is how long an alerted fingerprint suppresses further alerts;
+	// zero disables deduplication
+	Window Duration `yaml:"window"`
+	// StatePath is the file recently alerted fingerprints are persisted
+	// to; empty keeps them in memory only
+	StatePath string `yaml:"state_path"`
+}
+
+// fingerprintFields are the event fields a fingerprint template can use
+var fingerprintFields = map[string]func(event ProcessEvent) string{
+	"exe":      func(event ProcessEvent) string { return imageName(event.ExecutablePath) },
+	"path":     func(event ProcessEvent) string { return strings.ToLower(event.ExecutablePath) },
+	"rule":     func(event ProcessEvent) string { return event.Rule },
+	"reason":   func(event ProcessEvent) string { return event.Reason },
+	"user":     func(event ProcessEvent) string { return strings.ToLower(event.User) },
+	"host":     func(event ProcessEvent) string { return strings.ToLower(event.Host) },
+	"parent":   func(event ProcessEvent) string { return imageName(event.ParentImage) },
+	"severity": func(event ProcessEvent) string { return event.Severity.String() },
+	"cmdline":  func(event ProcessEvent) string { return event.CommandLine },
+}
+
+// fingerprintTemplate is a compiled fingerprint template: literal text
+// alternating with field placeholders
+type fingerprintTemplate []func(event ProcessEvent) string
+
+// compileFingerprint parses a template such as "{exe}|{reason}|{user}"
+func compileFingerprint(template string) (fingerprintTemplate, error) {
+	var compiled fingerprintTemplate
+	for rest := template; rest != ""; {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			literal := rest
+			compiled = append(compiled, func(ProcessEvent) string { return literal })
+			break
+		}
+		if start > 0 {
+			literal := rest[:start]
+			compiled = append(compiled, func(ProcessEvent) string { return literal })
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder in alert fingerprint %q", template)
+		}
+		name := rest[start+1 : start+end]
+		field, ok := fingerprintFields[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown alert fingerprint field {%s}", name)
+		}
+		compiled = append(compiled, field)
+		rest = rest[start+end+1:]
+	}
+	if len(compiled) == 0 {
+		return nil, fmt.Errorf("alert fingerprint must not be empty")
+	}
+	return compiled, nil
+}
+
+// render builds the fingerprint of an event
+func (t fingerprintTemplate) render(event ProcessEvent) string {
+	var b strings.Builder
+	for _, part := range t {
+		b.WriteString(part(event))
+	}
+	return b.String()
+}
+
+// alertDeduper remembers when the fingerprints of recent alerts expire.
+// Fingerprints are kept as hashes so the state file holds no command lines
+// or account names.
+type alertDeduper struct {
+	mu sync.Mutex
+	// saveMu serializes the state file writes, which share a temporary
+	// file, so the last one to finish holds the newest fingerprints
+	saveMu     sync.Mutex
+	template   fingerprintTemplate
+	window     time.Duration
+	statePath  string
+	expiries   map[string]time.Time
+	suppressed atomic.Uint64
+}
+
+// alertDedup is set up by startAlerting when deduplication is enabled
+var alertDedup *alertDeduper
+
+// openAlertDeduper compiles the fingerprint template and loads the
+// fingerprints persisted by a previous run, dropping expired ones
+func openAlertDeduper(cfg AlertDedupConfig) (*alertDeduper, error) {
+	template, err := compileFingerprint(cfg.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	d := &alertDeduper{
+		template:  template,
+		window:    time.Duration(cfg.Window),
+		statePath: cfg.StatePath,
+		expiries:  map[string]time.Time{},
+	}
+	if cfg.StatePath != "" {
+		if _, err := readStateFile(cfg.StatePath, &d.expiries); err != nil {
+			logError(4, "Starting without recently alerted fingerprints: %v", err)
+		}
+	}
+	d.prune(time.Now())
+	return d, nil
+}
+
+// prune drops expired fingerprints. The caller holds d.mu or owns d.
+func (d *alertDeduper) prune(now time.Time) {
+	for fingerprint, expiry := range d.expiries {
+		if !now.Before(expiry) {
+			delete(d.expiries, fingerprint)
+		}
+	}
+}
+
+// reserve reports whether an alert for event may fire, holding its
+// fingerprint so concurrent alerts for the same detection are suppressed.
+// The caller then either commits the fingerprint once the alert is queued
+// or releases it when the alert doesn't go out after all.
+func (d *alertDeduper) reserve(event ProcessEvent) (string, bool) {
+	fingerprint := sha256Hex([]byte(d.template.render(event)))
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if expiry, ok := d.expiries[fingerprint]; ok && now.Before(expiry) {
+		d.suppressed.Add(1)
+		return "", false
+	}
+	d.prune(now)
+	d.expiries[fingerprint] = now.Add(d.window)
+	return fingerprint, true
+}
+
+// release drops a reserved fingerprint whose alert was not sent
+func (d *alertDeduper) release(fingerprint string) {
+	d.mu.Lock()
+	delete(d.expiries, fingerprint)
+	d.mu.Unlock()
+}
+
+// commit persists the fingerprints after an alert was queued. It saves
+// right away, as a crash loop would never reach a periodic save.
+func (d *alertDeduper) commit() {
+	if d.statePath == "" {
+		return
+	}
+	d.saveMu.Lock()
+	defer d.saveMu.Unlock()
+
+	d.mu.Lock()
+	snapshot := make(map[string]time.Time, len(d.expiries))
+	for k, v := range d.expiries {
+		snapshot[k] = v
+	}
+	d.mu.Unlock()
+
+	if err := writeStateFile(d.statePath, snapshot); err != nil {
+		logError(4, "%v", err)
+	}
+}
+
+// active returns the number of fingerprints currently suppressing alerts
+func (d *alertDeduper) active() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(time.Now())
+	return len(d.expiries)
+}
+
+// startAlertDedup sets up deduplication when a window is configured
+func startAlertDedup(cfg AlertDedupConfig) {
+	if cfg.Window <= 0 {
+		return
+	}
+	d, err := openAlertDeduper(cfg)
+	if err != nil {
+		logError(4, "Alert deduplication disabled: %v", err)
+		return
+	}
+	alertDedup = d
+	log.Printf("Deduplicating alerts by %q for %v (%d fingerprints active)", cfg.Fingerprint, time.Duration(cfg.Window), d.active())
+}
@@ -0,0 +1,476 @@
+// alerts.go
+// Outbound alerting: suspicious events are queued and delivered to the
+// configured sinks (webhook, syslog, chat) by a background worker with
+// retries. Repeated alerts of a rule on a host are throttled by a per-rule
+// cooldown, and alerts sharing a fingerprint can be deduplicated across
+// restarts. The webhook can batch alerts into one request instead of
+// posting each one. Alerts are held back for a warm-up period after start,
+// when boot-time activity floods in.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	alertQueueSize   = 1000
+	alertMaxAttempts = 3
+
+	// alertFlushTimeout bounds how long shutdown waits for queued alerts
+	alertFlushTimeout = 15 * time.Second
+
+	// cooldownFlushInterval is how often ended cooldowns are swept and
+	// their suppressed alerts reported
+	cooldownFlushInterval = time.Minute
+)
+
+// alertRetryBackoff is the wait before the first retry of a failed
+// delivery; later retries wait proportionally longer
+var alertRetryBackoff = time.Second
+
+// Alert is the payload delivered to sinks
+type Alert struct {
+	Event ProcessEvent `json:"event"`
+	// Suppressed is the number of alerts of the same rule and host the
+	// cooldown dropped since one last fired
+	Suppressed int `json:"suppressed,omitempty"`
+	// Summary is set on the alert reporting what a cooldown suppressed
+	// after it ended with no further alert; Event is the last one dropped
+	Summary bool `json:"summary,omitempty"`
+}
+
+// AlertSink delivers alerts to an external system
+type AlertSink interface {
+	Name() string
+	Send(alert Alert) error
+}
+
+// BatchSink is a sink that can also deliver several alerts at once
+type BatchSink interface {
+	AlertSink
+	SendBatch(alerts []Alert) error
+}
+
+// BatchConfig configures batched delivery. A size of one or less delivers
+// every alert on its own.
+type BatchConfig struct {
+	// Size is the most alerts sent in one batch
+	Size int `yaml:"size"`
+	// Interval is the longest an alert waits for its batch to fill up
+	Interval Duration `yaml:"interval"`
+}
+
+// Enabled reports whether alerts are batched
+func (c BatchConfig) Enabled() bool {
+	return c.Size > 1
+}
+
+// WebhookSink posts alerts as JSON to an HTTP endpoint, one per request or
+// as an array of batched alerts
+type WebhookSink struct {
+	URL    string
+	client *http.Client
+}
+
+// NewWebhookSink creates a webhook sink for url
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{URL: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Name identifies the sink in logs
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+// Send posts the alert to the webhook
+func (s *WebhookSink) Send(alert Alert) error {
+	return s.post(alert)
+}
+
+// SendBatch posts the alerts to the webhook as one JSON array
+func (s *WebhookSink) SendBatch(alerts []Alert) error {
+	return s.post(alerts)
+}
+
+// post sends a JSON payload to the webhook
+func (s *WebhookSink) post(payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %v", err)
+	}
+
+	resp, err := s.client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post alert: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// SyslogSink sends each alert as an RFC 5424 message over UDP
+type SyslogSink struct {
+	Addr     string
+	hostname string
+}
+
+// NewSyslogSink creates a syslog sink sending to addr (host:port)
+func NewSyslogSink(addr string) *SyslogSink {
+	hostname := agentHostname
+	if hostname == "" {
+		hostname = "-"
+	}
+	return &SyslogSink{Addr: addr, hostname: hostname}
+}
+
+// Name identifies the sink in logs
+func (s *SyslogSink) Name() string {
+	return "syslog"
+}
+
+// Send writes the alert to the syslog collector
+func (s *SyslogSink) Send(alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %v", err)
+	}
+
+	conn, err := net.DialTimeout("udp", s.Addr, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect to syslog: %v", err)
+	}
+	defer conn.Close()
+
+	// Facility security/authorization (4), severity warning (4)
+	msg := fmt.Sprintf("<%d>1 %s %s WinLOLBinMonitor %d - - %s",
+		4*8+4, time.Now().Format(time.RFC3339), s.hostname, os.Getpid(), body)
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return fmt.Errorf("failed to send syslog message: %v", err)
+	}
+	return nil
+}
+
+// cooldownEntry tracks one rule and host under cooldown
+type cooldownEntry struct {
+	until      time.Time
+	suppressed int
+	// last is the most recent alert suppressed, for the summary
+	last ProcessEvent
+}
+
+// Global alerting state
+var (
+	alertSinks []AlertSink
+	alertQueue = make(chan Alert, alertQueueSize)
+
+	// alertStop asks the worker to deliver what is queued and exit;
+	// alertDone is closed once it has
+	alertStop     = make(chan struct{})
+	alertDone     = make(chan struct{})
+	alertStopOnce sync.Once
+
+	cooldowns      = map[string]*cooldownEntry{}
+	cooldownsMutex = &sync.Mutex{}
+
+	// warmUpEnd is when the warm-up after start ends; warmUpSuppressed
+	// counts the alerts it held back
+	warmUpEnd        time.Time
+	warmUpSuppressed atomic.Uint64
+)
+
+// buildAlertSinks creates the sinks enabled in the configuration
+func buildAlertSinks(c AlertsConfig) []AlertSink {
+	sinks := []AlertSink{}
+	if c.WebhookURL != "" {
+		sinks = append(sinks, NewWebhookSink(c.WebhookURL))
+	}
+	if c.SyslogAddr != "" {
+		sinks = append(sinks, NewSyslogSink(c.SyslogAddr))
+	}
+	if c.Chat.WebhookURL != "" {
+		sinks = append(sinks, NewChatSink(c.Chat))
+	}
+	return sinks
+}
+
+// startAlerting creates the configured sinks and starts the delivery
+// worker. It does nothing more when no sinks are configured.
+func startAlerting() {
+	alertSinks = buildAlertSinks(config.Alerts)
+	warmUpEnd = time.Now().Add(time.Duration(config.Alerts.WarmUp))
+	if len(alertSinks) == 0 {
+		close(alertDone)
+		return
+	}
+	startAlertDedup(config.Alerts.Dedup)
+	go alertWorker(config.Alerts.WebhookBatch)
+	go cooldownSweeper(alertStop)
+}
+
+// cooldownSweeper reports and drops ended cooldowns until stop is closed
+func cooldownSweeper(stop <-chan struct{}) {
+	ticker := time.NewTicker(cooldownFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			flushCooldowns(now, false)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// stopAlerting delivers the queued alerts and any pending batch, waiting
+// at most alertFlushTimeout
+func stopAlerting() {
+	alertStopOnce.Do(func() {
+		// Report what the running cooldowns held back before the queue is
+		// drained
+		flushCooldowns(time.Now(), true)
+		close(alertStop)
+	})
+	select {
+	case <-alertDone:
+	case <-time.After(alertFlushTimeout):
+		log.Printf("Timed out delivering queued alerts on shutdown")
+	}
+}
+
+// alertWorker delivers queued alerts to every sink. Sinks that support it
+// get the alerts in batches when batching is configured; a batch is sent
+// once full or when its oldest alert has waited for the interval.
+func alertWorker(batch BatchConfig) {
+	defer close(alertDone)
+
+	var pending []Alert
+	var flush <-chan time.Time
+	sendPending := func() {
+		if len(pending) > 0 {
+			deliverBatch(pending)
+		}
+		pending, flush = nil, nil
+	}
+
+	for {
+		select {
+		case alert := <-alertQueue:
+			deliverAlert(alert, batch.Enabled())
+			if !batch.Enabled() {
+				continue
+			}
+			pending = append(pending, alert)
+			if len(pending) == 1 {
+				flush = time.After(time.Duration(batch.Interval))
+			}
+			if len(pending) >= batch.Size {
+				sendPending()
+			}
+		case <-flush:
+			sendPending()
+		case <-alertStop:
+			// Deliver what is already queued, then the last batch
+			for {
+				select {
+				case alert := <-alertQueue:
+					deliverAlert(alert, batch.Enabled())
+					if batch.Enabled() {
+						pending = append(pending, alert)
+					}
+					continue
+				default:
+				}
+				break
+			}
+			sendPending()
+			return
+		}
+	}
+}
+
+// deliverAlert sends an alert to every sink, skipping the batch sinks when
+// batching
+func deliverAlert(alert Alert, batching bool) {
+	for _, sink := range alertSinks {
+		if _, ok := sink.(BatchSink); ok && batching {
+			continue
+		}
+		deliver(sink, func() error { return sink.Send(alert) })
+	}
+}
+
+// deliverBatch sends a batch of alerts to every batch sink
+func deliverBatch(alerts []Alert) {
+	for _, sink := range alertSinks {
+		if batchSink, ok := sink.(BatchSink); ok {
+			deliver(sink, func() error { return batchSink.SendBatch(alerts) })
+		}
+	}
+}
+
+// deliver runs a send, retrying failures with a short backoff so a sink
+// outage doesn't stall the queue for long
+func deliver(sink AlertSink, send func() error) {
+	var err error
+	for attempt := 1; attempt <= alertMaxAttempts; attempt++ {
+		if err = send(); err == nil {
+			return
+		}
+		if attempt < alertMaxAttempts {
+			time.Sleep(time.Duration(attempt) * alertRetryBackoff)
+		}
+	}
+	log.Printf("Failed to deliver alert to %s sink: %v", sink.Name(), err)
+}
+
+// dispatchAlert queues an alert for a suspicious event unless its
+// fingerprint alerted within the dedup window or its rule is still in
+// cooldown on the host. The event itself is always stored; only the
+// outbound alert is throttled.
+func dispatchAlert(event ProcessEvent) {
+	if len(alertSinks) == 0 {
+		return
+	}
+	if event.Severity < config.Alerts.MinSeverity || event.Confidence < config.Alerts.MinConfidence {
+		return
+	}
+	if warmingUp() && event.Severity < config.Alerts.WarmUpMinSeverity {
+		warmUpSuppressed.Add(1)
+		return
+	}
+
+	var fingerprint string
+	if alertDedup != nil {
+		var ok bool
+		if fingerprint, ok = alertDedup.reserve(event); !ok {
+			return
+		}
+	}
+	// Only an alert that goes out keeps its fingerprint
+	suppressed, ok := checkCooldown(event)
+	if ok {
+		ok = queueAlert(Alert{Event: event, Suppressed: suppressed})
+	}
+	if alertDedup == nil {
+		return
+	}
+	if ok {
+		alertDedup.commit()
+	} else {
+		alertDedup.release(fingerprint)
+	}
+}
+
+// queueAlert hands an alert to the delivery worker, dropping it when the
+// queue is full, and reports whether it was queued
+func queueAlert(alert Alert) bool {
+	select {
+	case alertQueue <- alert:
+		return true
+	default:
+		log.Printf("Alert queue full, dropping alert for %s (PID: %d)",
+			alert.Event.ExecutablePath, alert.Event.ProcessID)
+		return false
+	}
+}
+
+// warmingUp reports whether alerts are still in the warm-up after start
+func warmingUp() bool {
+	return time.Now().Before(warmUpEnd)
+}
+
+// cooldownKey identifies the alerts a cooldown applies to: those of one
+// rule on one host. Events no rule matched are keyed by their image name.
+// The reason is deliberately left out: it names the matched arguments and
+// often PIDs and paths, so a loop varying them would slip past a cooldown
+// keyed on it. Alerts of the rule for other reasons count towards the same
+// cooldown, and its summary carries the last of them.
+func cooldownKey(event ProcessEvent) string {
+	rule := event.Rule
+	if rule == "" {
+		rule = imageName(event.ExecutablePath)
+	}
+	return rule + "|" + event.Host
+}
+
+// checkCooldown reports whether an alert for event may fire now, along with
+// the number of alerts of its rule and host suppressed since the last one
+// fired
+func checkCooldown(event ProcessEvent) (int, bool) {
+	cooldown := time.Duration(config.Alerts.Cooldown)
+	if lolbin, found := currentRules().LOLBins[event.Rule]; found && lolbin.Cooldown != nil {
+		cooldown = time.Duration(*lolbin.Cooldown)
+	}
+	if cooldown <= 0 {
+		return 0, true
+	}
+
+	key := cooldownKey(event)
+	now := time.Now()
+
+	cooldownsMutex.Lock()
+	defer cooldownsMutex.Unlock()
+
+	entry, found := cooldowns[key]
+	if found && now.Before(entry.until) {
+		entry.suppressed++
+		entry.last = event
+		return 0, false
+	}
+
+	// An ended cooldown not swept yet reports its count with this alert
+	suppressed := 0
+	if found {
+		suppressed = entry.suppressed
+	}
+	cooldowns[key] = &cooldownEntry{until: now.Add(cooldown)}
+	return suppressed, true
+}
+
+// flushCooldowns drops the cooldowns that have ended by now, or all of them
+// when all is set, queueing a summary alert for each that suppressed
+// alerts. Run every cooldownFlushInterval, an entry outlives its cooldown
+// by at most one interval.
+func flushCooldowns(now time.Time, all bool) {
+	var summaries []Alert
+	cooldownsMutex.Lock()
+	for key, entry := range cooldowns {
+		if !all && now.Before(entry.until) {
+			continue
+		}
+		if entry.suppressed > 0 {
+			summaries = append(summaries, Alert{Event: entry.last, Suppressed: entry.suppressed, Summary: true})
+		}
+		delete(cooldowns, key)
+	}
+	cooldownsMutex.Unlock()
+
+	for _, summary := range summaries {
+		queueAlert(summary)
+	}
+}
+
+// cooldownSuppressed returns the number of alerts the cooldown has dropped
+// that are yet to be reported with the next alert of their kind
+func cooldownSuppressed() int {
+	cooldownsMutex.Lock()
+	defer cooldownsMutex.Unlock()
+	total := 0
+	for _, entry := range cooldowns {
+		total += entry.suppressed
+	}
+	return total
+}
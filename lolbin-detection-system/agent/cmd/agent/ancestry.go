@@ -0,0 +1,77 @@
+// ancestry.go
+// Reconstruction of a process's parent chain from stored events, falling
+// back to the live process table for the immediate parent
+
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// maxAncestryDepth bounds how far up the parent chain is followed
+const maxAncestryDepth = 8
+
+// imageName returns the lowercased file name of an executable path
+func imageName(path string) string {
+	if i := strings.LastIndexAny(path, `\/`); i >= 0 {
+		path = path[i+1:]
+	}
+	return strings.ToLower(path)
+}
+
+// lowerAll returns a lowercased copy of the strings
+func lowerAll(values []string) []string {
+	lowered := make([]string, len(values))
+	for i, v := range values {
+		lowered[i] = strings.ToLower(v)
+	}
+	return lowered
+}
+
+// findStoredProcess returns the newest stored event for pid that started no
+// later than before. PIDs are reused, so an event started after the child
+// can't be its parent.
+func findStoredProcess(pid uint32, before time.Time) (ProcessEvent, bool) {
+	eventsMutex.RLock()
+	defer eventsMutex.RUnlock()
+
+	for i := len(processEvents) - 1; i >= 0; i-- {
+		if processEvents[i].ProcessID == pid && !processEvents[i].Timestamp.After(before) {
+			return processEvents[i], true
+		}
+	}
+	return ProcessEvent{}, false
+}
+
+// resolveAncestry returns the image paths of the event's parent chain,
+// nearest first. The chain stops at the first process that is neither in
+// the event store nor, for the direct parent, still running.
+func resolveAncestry(event *ProcessEvent) []string {
+	var chain []string
+	pid, image, at := event.ParentID, event.ParentImage, event.Timestamp
+
+	for depth := 0; depth < maxAncestryDepth; depth++ {
+		var parent ProcessEvent
+		found := false
+		if pid != 0 {
+			parent, found = findStoredProcess(pid, at)
+		}
+		if image == "" && found {
+			image = parent.ExecutablePath
+		}
+		if image == "" && depth == 0 && pid != 0 {
+			image, _ = processImagePath(pid)
+		}
+		if image == "" {
+			break
+		}
+		chain = append(chain, image)
+
+		if !found || parent.ParentID == 0 || parent.ParentID == pid {
+			break
+		}
+		pid, image, at = parent.ParentID, parent.ParentImage, parent.Timestamp
+	}
+	return chain
+}
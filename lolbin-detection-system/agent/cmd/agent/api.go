@@ -0,0 +1,888 @@
+// api.go
+// REST API exposing detected events, rule management and statistics
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// startRESTServer starts the HTTP server for the REST API
+func startRESTServer() {
+	router := mux.NewRouter()
+
+	// API endpoints
+	router.HandleFunc("/api/events", getEvents).Methods("GET")
+	router.HandleFunc("/api/events/suspicious", getSuspiciousEvents).Methods("GET")
+	router.HandleFunc("/api/events/recent", getRecentEvents).Methods("GET")
+	router.HandleFunc("/api/events/ecs", getECSEvents).Methods("GET")
+	router.HandleFunc("/api/events.csv", getCSVEvents).Methods("GET")
+	router.HandleFunc("/api/events/export", exportEvents).Methods("GET")
+	router.HandleFunc("/api/events/{id:[0-9]+}", getEvent).Methods("GET")
+	router.HandleFunc("/api/incidents", getIncidents).Methods("GET")
+	router.HandleFunc("/api/timeline", getTimeline).Methods("GET")
+	router.HandleFunc("/api/lolbins", getLOLBins).Methods("GET")
+	router.HandleFunc("/api/lolbins/{name}", getLOLBin).Methods("GET")
+	router.HandleFunc("/api/evaluate", evaluateCommand).Methods("POST")
+	router.HandleFunc("/api/rules", getEffectiveRules).Methods("GET")
+	router.HandleFunc("/api/rules/reload", reloadRulesHandler).Methods("POST")
+	router.HandleFunc("/api/rules/stats", getRuleStats).Methods("GET")
+	router.HandleFunc("/api/stats", getStats).Methods("GET")
+	router.HandleFunc("/api/rules/versions", getRuleVersions).Methods("GET")
+	router.HandleFunc("/api/rules/rollback/{hash}", rollbackRulesHandler).Methods("POST")
+	router.HandleFunc("/api/version", getVersion).Methods("GET")
+	router.HandleFunc("/api/blocklist", getBlocklist).Methods("GET")
+	router.HandleFunc("/api/baselines", getBaselines).Methods("GET")
+	router.HandleFunc("/api/baselines/{user}", getBaseline).Methods("GET")
+	router.HandleFunc("/api/baselines/{user}", resetBaseline).Methods("DELETE")
+	router.HandleFunc("/api/health", getHealth).Methods("GET")
+	router.HandleFunc("/api/health", acknowledgeHealthHandler).Methods("DELETE")
+
+	// Start the server
+	router.Use(apiKeyMiddleware)
+
+	server := &http.Server{
+		Addr:    config.ListenAddr,
+		Handler: router,
+	}
+
+	if !config.TLS.Enabled() {
+		log.Printf("WARNING: serving the REST API over plain HTTP on %s; command lines may contain credentials", config.ListenAddr)
+		if err := server.ListenAndServe(); err != nil {
+			log.Printf("Error starting API server: %v", err)
+		}
+		return
+	}
+
+	tlsConfig, err := buildTLSConfig(config.TLS)
+	if err != nil {
+		log.Printf("Error starting API server: %v", err)
+		return
+	}
+	server.TLSConfig = tlsConfig
+
+	log.Printf("Starting REST API server on %s (TLS)...", config.ListenAddr)
+	if err := server.ListenAndServeTLS(config.TLS.CertFile, config.TLS.KeyFile); err != nil {
+		log.Printf("Error starting API server: %v", err)
+	}
+}
+
+// apiKeyMiddleware rejects requests without the configured API key. The
+// API is open when no key is configured.
+func apiKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.APIKey != "" {
+			key := r.Header.Get("X-API-Key")
+			if subtle.ConstantTimeCompare([]byte(key), []byte(config.APIKey)) != 1 {
+				writeError(w, http.StatusUnauthorized, "invalid or missing API key")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeError answers a request with an HTTP error status and a JSON body
+// carrying the message
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// eventFilter holds the query filters shared by the event listing endpoints
+type eventFilter struct {
+	suspiciousOnly bool
+	// exe matches events whose executable has this lowercased image name
+	exe string
+	// ioc matches events carrying an extracted IOC with this value
+	ioc string
+	tag string
+	// minSeverity and minConfidence filter independently, so analysts can
+	// ask for high-severity guesses or certain low-severity findings
+	minSeverity   Severity
+	minConfidence int
+	// offHours, when set, keeps only events on that side of business hours
+	offHours *bool
+	// integrity, when set, keeps only events at that integrity level
+	integrity string
+	// since and until, when set, bound the event timestamps: since
+	// inclusive, until exclusive
+	since, until time.Time
+}
+
+// parseEventFilter reads the filters from the request's query string
+func parseEventFilter(r *http.Request) (eventFilter, error) {
+	filter := eventFilter{
+		ioc:       r.URL.Query().Get("ioc"),
+		exe:       imageName(r.URL.Query().Get("exe")),
+		tag:       r.URL.Query().Get("tag"),
+		integrity: strings.ToLower(r.URL.Query().Get("integrity")),
+	}
+	if filter.integrity != "" && integrityRank(filter.integrity) == 0 {
+		return filter, fmt.Errorf("unknown integrity level %q", filter.integrity)
+	}
+	if v := r.URL.Query().Get("min_severity"); v != "" {
+		severity, err := ParseSeverity(v)
+		if err != nil {
+			return filter, err
+		}
+		filter.minSeverity = severity
+	}
+	if v := r.URL.Query().Get("min_confidence"); v != "" {
+		confidence, err := strconv.Atoi(v)
+		if err != nil || confidence < 0 || confidence > 100 {
+			return filter, fmt.Errorf("min_confidence must be between 0 and 100")
+		}
+		filter.minConfidence = confidence
+	}
+	if v := r.URL.Query().Get("off_hours"); v != "" {
+		offHours, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid off_hours %q", v)
+		}
+		filter.offHours = &offHours
+	}
+	for name, bound := range map[string]*time.Time{"since": &filter.since, "until": &filter.until} {
+		if v := r.URL.Query().Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+			*bound = t
+		}
+	}
+	return filter, nil
+}
+
+// matches reports whether the event passes every filter
+func (f eventFilter) matches(event *ProcessEvent) bool {
+	if f.suspiciousOnly && !event.Suspicious {
+		return false
+	}
+	if f.exe != "" && imageName(event.ExecutablePath) != f.exe {
+		return false
+	}
+	if f.ioc != "" && !hasIOC(event, f.ioc) {
+		return false
+	}
+	if f.tag != "" && !containsFold(event.Tags, f.tag) {
+		return false
+	}
+	if event.Severity < f.minSeverity || event.Confidence < f.minConfidence {
+		return false
+	}
+	if f.offHours != nil && event.OffHours != *f.offHours {
+		return false
+	}
+	if f.integrity != "" && event.IntegrityLevel != f.integrity {
+		return false
+	}
+	if !f.since.IsZero() && event.Timestamp.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !event.Timestamp.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+// Page sizes of the event listing endpoints
+const (
+	defaultEventLimit = 1000
+	maxEventLimit     = 10000
+	recentEventLimit  = 100
+)
+
+// eventPage selects a page of events: up to limit events with an ID above
+// after. Clients fetch the next page by passing the last ID they received.
+type eventPage struct {
+	after uint64
+	limit int
+}
+
+// parseEventPage reads ?after= and ?limit= from the request
+func parseEventPage(r *http.Request) (eventPage, error) {
+	page := eventPage{limit: defaultEventLimit}
+	if v := r.URL.Query().Get("after"); v != "" {
+		after, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return page, fmt.Errorf("invalid after %q", v)
+		}
+		page.after = after
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxEventLimit {
+			return page, fmt.Errorf("limit must be between 1 and %d", maxEventLimit)
+		}
+		page.limit = limit
+	}
+	return page, nil
+}
+
+// parseVerbose reads ?verbose=, which asks for the rule match details that
+// are otherwise left out of events to keep responses small
+func parseVerbose(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("verbose")
+	if v == "" {
+		return false, nil
+	}
+	verbose, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid verbose %q", v)
+	}
+	return verbose, nil
+}
+
+// renderEvent returns the event as the API returns it, without the rule
+// match details unless verbose
+func renderEvent(event ProcessEvent, verbose bool) ProcessEvent {
+	if !verbose {
+		event.MatchDetails = nil
+	}
+	return event
+}
+
+// nextEvent returns a copy of the oldest stored event with an ID above
+// after. The lock is only held for the lookup.
+func nextEvent(after uint64) (ProcessEvent, bool) {
+	eventsMutex.RLock()
+	defer eventsMutex.RUnlock()
+
+	if len(processEvents) == 0 {
+		return ProcessEvent{}, false
+	}
+	i := 0
+	if first := processEvents[0].ID; after >= first {
+		i = int(after - first + 1)
+	}
+	if i >= len(processEvents) {
+		return ProcessEvent{}, false
+	}
+	return processEvents[i], true
+}
+
+// eventByID returns a copy of the stored event with the given ID. IDs are
+// assigned consecutively, so the event's position follows from the oldest
+// stored ID.
+func eventByID(id uint64) (ProcessEvent, bool) {
+	eventsMutex.RLock()
+	defer eventsMutex.RUnlock()
+
+	event, ok := storedEvent(id)
+	if !ok {
+		return ProcessEvent{}, false
+	}
+	return *event, true
+}
+
+// streamEvents writes the page of events passing the filter as a JSON
+// array, one element at a time, so neither the whole store nor the lock is
+// held while the response is written
+func streamEvents(w http.ResponseWriter, filter eventFilter, page eventPage, verbose bool) {
+	streamEventsAs(w, filter, page, func(event ProcessEvent) interface{} { return renderEvent(event, verbose) })
+}
+
+// streamEventsAs is streamEvents with each event rendered by render
+func streamEventsAs(w http.ResponseWriter, filter eventFilter, page eventPage, render func(ProcessEvent) interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	io.WriteString(w, "[")
+	count := 0
+	err := eachEvent(filter, page, func(event ProcessEvent) error {
+		if count > 0 {
+			io.WriteString(w, ",")
+		}
+		count++
+		return encoder.Encode(render(event))
+	})
+	if err != nil {
+		// The client went away
+		return
+	}
+	io.WriteString(w, "]\n")
+}
+
+// eachEvent calls fn with each event of the page passing the filter, oldest
+// first, stopping at the first error fn returns
+func eachEvent(filter eventFilter, page eventPage, fn func(ProcessEvent) error) error {
+	count := 0
+	for cursor := page.after; count < page.limit; {
+		event, ok := nextIndexedEvent(filter, cursor)
+		if !ok {
+			break
+		}
+		cursor = event.ID
+		if !filter.matches(&event) {
+			continue
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+		count++
+	}
+	return nil
+}
+
+// lastEvents returns up to n of the newest stored events that pass the
+// filter, oldest first
+func lastEvents(filter eventFilter, n int) []ProcessEvent {
+	eventsMutex.RLock()
+	defer eventsMutex.RUnlock()
+
+	events := []ProcessEvent{}
+	if ids, indexed := storeIndex.candidates(filter); indexed {
+		for i := len(ids) - 1; i >= 0 && len(events) < n; i-- {
+			if event, ok := storedEvent(ids[i]); ok && filter.matches(event) {
+				events = append(events, *event)
+			}
+		}
+	} else {
+		for i := len(processEvents) - 1; i >= 0 && len(events) < n; i-- {
+			if filter.matches(&processEvents[i]) {
+				events = append(events, processEvents[i])
+			}
+		}
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events
+}
+
+// API handler: get all events, paged with ?after= and ?limit=
+func getEvents(w http.ResponseWriter, r *http.Request) {
+	page, err := parseEventPage(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	verbose, err := parseVerbose(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	streamEvents(w, filter, page, verbose)
+}
+
+// API handler: get events in the Elastic Common Schema, paged and filtered
+// like getEvents
+func getECSEvents(w http.ResponseWriter, r *http.Request) {
+	page, err := parseEventPage(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	streamEventsAs(w, filter, page, func(event ProcessEvent) interface{} { return toECS(event) })
+}
+
+// API handler: get events as CSV for spreadsheets, paged and filtered like
+// getEvents
+func getCSVEvents(w http.ResponseWriter, r *http.Request) {
+	page, err := parseEventPage(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	streamEventsCSV(w, filter, page)
+}
+
+// API handler: get only suspicious events, paged like getEvents
+func getSuspiciousEvents(w http.ResponseWriter, r *http.Request) {
+	page, err := parseEventPage(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	verbose, err := parseVerbose(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.suspiciousOnly = true
+	streamEvents(w, filter, page, verbose)
+}
+
+// API handler: get recent events (last 100)
+func getRecentEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	verbose, err := parseVerbose(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	events := lastEvents(filter, recentEventLimit)
+	for i := range events {
+		events[i] = renderEvent(events[i], verbose)
+	}
+	json.NewEncoder(w).Encode(events)
+}
+
+// API handler: get one event by ID. Events evicted from the store are no
+// longer found.
+func getEvent(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid event id")
+		return
+	}
+	verbose, err := parseVerbose(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	event, ok := eventByID(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("event %d not found", id))
+		return
+	}
+	json.NewEncoder(w).Encode(renderEvent(event, verbose))
+}
+
+// API handler: get suspicious events grouped into incidents. ?window=
+// overrides the configured grouping window.
+func getIncidents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	window := time.Duration(config.IncidentWindow)
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid window "+v)
+			return
+		}
+		window = d
+	}
+
+	json.NewEncoder(w).Encode(buildIncidents(window))
+}
+
+// evaluateRequest is the body accepted by /api/evaluate
+type evaluateRequest struct {
+	Executable  string `json:"executable"`
+	CommandLine string `json:"command_line"`
+	Parent      string `json:"parent"`
+	User        string `json:"user"`
+	// IntegrityLevel is the integrity level to evaluate the process at
+	IntegrityLevel string `json:"integrity_level"`
+}
+
+// API handler: run an arbitrary command line through detection and return
+// the resulting event without storing or alerting on it
+func evaluateCommand(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	verbose, err := parseVerbose(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var req evaluateRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if req.Executable == "" {
+		writeError(w, http.StatusBadRequest, "executable is required")
+		return
+	}
+
+	event := ProcessEvent{
+		Timestamp:      time.Now(),
+		CommandLine:    req.CommandLine,
+		ExecutablePath: req.Executable,
+		User:           req.User,
+		IntegrityLevel: strings.ToLower(req.IntegrityLevel),
+	}
+	if event.IntegrityLevel != "" && integrityRank(event.IntegrityLevel) == 0 {
+		writeError(w, http.StatusBadRequest, "unknown integrity_level "+req.IntegrityLevel)
+		return
+	}
+	if req.User != "" {
+		event.AccountType = accountTypeOfName(req.User)
+	}
+	// The parent may be given as a PID or as an image path
+	if pid, err := strconv.ParseUint(req.Parent, 10, 32); err == nil {
+		event.ParentID = uint32(pid)
+	} else {
+		event.ParentImage = req.Parent
+	}
+
+	stampAgent(&event)
+	json.NewEncoder(w).Encode(renderEvent(checkForLOLBin(event, false), verbose))
+}
+
+// API handler: get list of monitored LOLBins, optionally only those with
+// the ?tag= category
+func getLOLBins(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	lolbins := currentRules().LOLBins
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		tagged := make(map[string]LOLBin)
+		for name, lolbin := range lolbins {
+			if lolbin.HasTag(tag) {
+				tagged[name] = lolbin
+			}
+		}
+		lolbins = tagged
+	}
+	json.NewEncoder(w).Encode(lolbins)
+}
+
+// lolbinDetail is one LOLBin definition with how often it fired
+type lolbinDetail struct {
+	Name       string     `json:"name"`
+	Definition LOLBin     `json:"definition"`
+	Matches    uint64     `json:"matches"`
+	Suspicious uint64     `json:"suspicious"`
+	LastSeen   *time.Time `json:"last_seen,omitempty"`
+}
+
+// API handler: get one LOLBin definition, by rule name and regardless of
+// case, with its match and suspicious counts and when it last matched
+func getLOLBin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name := mux.Vars(r)["name"]
+	lolbins := currentRules().LOLBins
+	lolbin, ok := lolbins[name]
+	if !ok {
+		for candidate, definition := range lolbins {
+			if strings.EqualFold(candidate, name) {
+				name, lolbin, ok = candidate, definition, true
+				break
+			}
+		}
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown LOLBin "+name)
+		return
+	}
+
+	stats := countersFor(name).snapshot(0, time.Time{})
+	json.NewEncoder(w).Encode(lolbinDetail{
+		Name:       name,
+		Definition: lolbin,
+		Matches:    stats.Total,
+		Suspicious: stats.Suspicious,
+		LastSeen:   stats.LastHit,
+	})
+}
+
+// effectiveRules is everything the detection engine currently evaluates
+// against: the merged rule definitions and the configuration they act with
+type effectiveRules struct {
+	Version RulesVersion      `json:"version"`
+	LOLBins map[string]LOLBin `json:"lolbins"`
+	// EvaluationOrder lists the rule names in the order they're evaluated
+	EvaluationOrder []string             `json:"evaluation_order"`
+	Ignore          IgnoreList           `json:"ignore"`
+	Watchlist       Watchlist            `json:"watchlist"`
+	KnownProcesses  map[string][]string  `json:"known_processes"`
+	Rundll32Exports map[string][]string  `json:"rundll32_exports"`
+	CompositeRules  []effectiveComposite `json:"composite_rules"`
+	Allowlist       effectiveAllowlist   `json:"allowlist"`
+	Thresholds      effectiveThresholds  `json:"thresholds"`
+}
+
+// effectiveComposite describes a built-in composite rule
+type effectiveComposite struct {
+	Name       string   `json:"name"`
+	Images     []string `json:"images"`
+	Severity   Severity `json:"severity"`
+	Confidence int      `json:"confidence"`
+	Tags       []string `json:"tags,omitempty"`
+	Enabled    bool     `json:"enabled"`
+}
+
+// effectiveAllowlist holds the exceptions applying across all rules;
+// per-rule exclude patterns are part of the rule definitions
+type effectiveAllowlist struct {
+	TrustedShares          []string `json:"trusted_shares"`
+	TrustedDownloadDomains []string `json:"trusted_download_domains"`
+	TrustedPublishers      []string `json:"trusted_publishers"`
+	TrustedPublisherAction string   `json:"trusted_publisher_action"`
+}
+
+// effectiveThresholds are the global scoring and alerting thresholds
+type effectiveThresholds struct {
+	EntropyThreshold     float64  `json:"entropy_threshold"`
+	MaxCommandLineLength int      `json:"max_cmdline_length"`
+	ArgEntropyThreshold  float64  `json:"arg_entropy_threshold"`
+	MinAlertSeverity     Severity `json:"min_alert_severity"`
+	MinAlertConfidence   int      `json:"min_alert_confidence"`
+	AlertCooldown        Duration `json:"alert_cooldown"`
+}
+
+// API handler: get the complete effective rule set, after merging the
+// built-in rules with the rules file, with the allowlists, ignore list,
+// watchlist, composite rules and thresholds that go with it
+func getEffectiveRules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rules := currentRules()
+	// The rules file was validated when loaded, so merging can't fail
+	known, _ := mergeKnownProcesses(rules.knownList)
+	exports, _ := mergeRundll32Exports(rules.exportList)
+	composites := make([]effectiveComposite, 0, len(compositeRules))
+	for _, rule := range compositeRules {
+		images := make([]string, 0, len(rule.images))
+		for image := range rule.images {
+			images = append(images, image)
+		}
+		sort.Strings(images)
+		composites = append(composites, effectiveComposite{
+			Name:       rule.name,
+			Images:     images,
+			Severity:   rule.severity,
+			Confidence: rule.confidence,
+			Tags:       rule.tags,
+			Enabled:    rule.enabled(),
+		})
+	}
+
+	json.NewEncoder(w).Encode(effectiveRules{
+		Version:         rules.Version,
+		LOLBins:         rules.LOLBins,
+		EvaluationOrder: rules.order,
+		Ignore:          rules.ignoreList,
+		Watchlist:       rules.watchList,
+		KnownProcesses:  known,
+		Rundll32Exports: exports,
+		CompositeRules:  composites,
+		Allowlist: effectiveAllowlist{
+			TrustedShares:          config.TrustedShares,
+			TrustedDownloadDomains: config.TrustedDownloadDomains,
+			TrustedPublishers:      config.TrustedPublishers.Publishers,
+			TrustedPublisherAction: config.TrustedPublishers.Action,
+		},
+		Thresholds: effectiveThresholds{
+			EntropyThreshold:     config.EntropyThreshold,
+			MaxCommandLineLength: config.Heuristics.MaxCommandLineLength,
+			ArgEntropyThreshold:  config.Heuristics.ArgEntropyThreshold,
+			MinAlertSeverity:     config.Alerts.MinSeverity,
+			MinAlertConfidence:   config.Alerts.MinConfidence,
+			AlertCooldown:        config.Alerts.Cooldown,
+		},
+	})
+}
+
+// API handler: reload the rules file
+func reloadRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rules, err := reloadRules()
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  err.Error(),
+			"active": currentRules().Version,
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "reloaded",
+		"active": rules.Version,
+	})
+}
+
+// API handler: list the rule set versions that can be rolled back to
+func getRuleVersions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"active":   currentRules().Version,
+		"versions": ruleVersions(),
+	})
+}
+
+// API handler: reactivate a previously loaded rule set
+func rollbackRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rules, err := rollbackRules(mux.Vars(r)["hash"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  err.Error(),
+			"active": currentRules().Version,
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "rolled back",
+		"active": rules.Version,
+	})
+}
+
+// API handler: get per-rule hit statistics. With ?bucket=5m the hits are
+// also grouped into time buckets over the last ?window= (default 1h, max 24h).
+func getRuleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var bucket time.Duration
+	since := time.Now().Add(-time.Hour)
+	if value := r.URL.Query().Get("bucket"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Minute || d%time.Minute != 0 {
+			writeError(w, http.StatusBadRequest, "bucket must be a whole number of minutes, e.g. 5m")
+			return
+		}
+		bucket = d
+	}
+	if value := r.URL.Query().Get("window"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid window")
+			return
+		}
+		since = time.Now().Add(-d)
+	}
+
+	rules := currentRules()
+	stats := allRuleStats(rules, bucket, since)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rules_version": rules.Version,
+		"rules":         stats,
+		"tags":          tagStats(rules, stats),
+		"detectors":     allDetectorStats(),
+	})
+}
+
+// API handler: get agent-wide counters, such as the number of stored events
+// and of suppressed alerts
+func getStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	eventsMutex.RLock()
+	stored, suspicious := len(processEvents), len(storeIndex.suspicious)
+	eventsMutex.RUnlock()
+
+	alerts := map[string]interface{}{
+		"queued":              len(alertQueue),
+		"cooldown_suppressed": cooldownSuppressed(),
+		"warming_up":          warmingUp(),
+		"warm_up_suppressed":  warmUpSuppressed.Load(),
+	}
+	if alertDedup != nil {
+		alerts["dedup_suppressed"] = alertDedup.suppressed.Load()
+		alerts["dedup_fingerprints"] = alertDedup.active()
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events":            stored,
+		"suspicious_events": suspicious,
+		"alerts":            alerts,
+		"detection":         detectionStats(),
+		"health":            hostHealth().Status,
+	})
+}
+
+// API handler: get the active rules version
+func getVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rules": currentRules().Version,
+	})
+}
+
+// API handler: get blocklist entry counts and refresh status
+func getBlocklist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocklistStatus())
+}
+
+// API handler: list every user's LOLBin baseline
+func getBaselines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if baselines == nil {
+		writeError(w, http.StatusNotFound, "user baselines are disabled")
+		return
+	}
+	json.NewEncoder(w).Encode(baselines.All(config.Baseline))
+}
+
+// API handler: get one user's LOLBin baseline
+func getBaseline(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if baselines == nil {
+		writeError(w, http.StatusNotFound, "user baselines are disabled")
+		return
+	}
+	user := mux.Vars(r)["user"]
+	view, ok := baselines.Get(user, config.Baseline)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no baseline for "+user)
+		return
+	}
+	json.NewEncoder(w).Encode(view)
+}
+
+// API handler: reset a user's LOLBin baseline so it is learned afresh
+func resetBaseline(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if baselines == nil {
+		writeError(w, http.StatusNotFound, "user baselines are disabled")
+		return
+	}
+	user := mux.Vars(r)["user"]
+	if !baselines.Reset(user) {
+		writeError(w, http.StatusNotFound, "no baseline for "+user)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "reset", "user": user})
+}
+
+// API handler: get the host's telemetry health and its warnings
+func getHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hostHealth())
+}
+
+// API handler: acknowledge the health warnings, marking the host ok again
+func acknowledgeHealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "acknowledged", "warnings": acknowledgeHealth()})
+}
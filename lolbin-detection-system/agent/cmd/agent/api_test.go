@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// storeTestEvents stores n events, every third one suspicious, and returns
+// their IDs
+func storeTestEvents(t *testing.T, n int) []uint64 {
+	t.Helper()
+	ids := make([]uint64, n)
+	for i := range ids {
+		exe := `C:\Windows\System32\certutil.exe`
+		if i%2 == 1 {
+			exe = `C:\Windows\System32\rundll32.exe`
+		}
+		ids[i] = storeEvent(ProcessEvent{Timestamp: time.Now(), ProcessID: uint32(1000 + i), ExecutablePath: exe, Suspicious: i%3 == 0}).ID
+	}
+	return ids
+}
+
+// getPage calls an event listing handler and decodes the events it returns
+func getPage(t *testing.T, handler http.HandlerFunc, url string) []ProcessEvent {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", url, rec.Code, rec.Body)
+	}
+	var events []ProcessEvent
+	if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil {
+		t.Fatalf("GET %s: invalid JSON %q: %v", url, rec.Body, err)
+	}
+	return events
+}
+
+func TestGetEventsEmpty(t *testing.T) {
+	resetEvents(t)
+	for _, tt := range []struct {
+		handler http.HandlerFunc
+		url     string
+	}{
+		{getEvents, "/api/events"},
+		{getEvents, "/api/events?after=100&limit=5"},
+		{getSuspiciousEvents, "/api/events/suspicious"},
+		{getRecentEvents, "/api/events/recent"},
+		{getECSEvents, "/api/events/ecs"},
+	} {
+		rec := httptest.NewRecorder()
+		tt.handler(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "[]\n" {
+			t.Errorf("GET %s: status %d, body %q, want []", tt.url, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestGetEventsPaging(t *testing.T) {
+	resetEvents(t)
+	ids := storeTestEvents(t, 25)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		query   string
+		want    func(i int) bool
+	}{
+		{"all", getEvents, "", func(int) bool { return true }},
+		{"indexed filter", getEvents, "&exe=rundll32.exe", func(i int) bool { return i%2 == 1 }},
+		{"suspicious", getSuspiciousEvents, "", func(i int) bool { return i%3 == 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want []uint64
+			for i, id := range ids {
+				if tt.want(i) {
+					want = append(want, id)
+				}
+			}
+			// Page through with the last ID received as the cursor
+			var got []uint64
+			after := uint64(0)
+			for pages := 0; ; pages++ {
+				if pages > len(ids) {
+					t.Fatal("paging doesn't end")
+				}
+				page := getPage(t, tt.handler, fmt.Sprintf("/api/events?limit=4&after=%d%s", after, tt.query))
+				if len(page) > 4 {
+					t.Fatalf("page of %d events, limit 4", len(page))
+				}
+				if len(page) == 0 {
+					break
+				}
+				for _, event := range page {
+					got = append(got, event.ID)
+				}
+				after = page[len(page)-1].ID
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("paged IDs %v, want %v", got, want)
+			}
+		})
+	}
+
+	// Events stored while paging show up on a later page
+	first := getPage(t, getEvents, "/api/events?limit=20")
+	added := storeEvent(ProcessEvent{Timestamp: time.Now(), ExecutablePath: `C:\Windows\System32\mshta.exe`})
+	rest := getPage(t, getEvents, fmt.Sprintf("/api/events?after=%d", first[len(first)-1].ID))
+	if len(first)+len(rest) != len(ids)+1 || rest[len(rest)-1].ID != added.ID || rest[0].ID != first[len(first)-1].ID+1 {
+		t.Errorf("pages of %d and %d events, want %d continuing", len(first), len(rest), len(ids)+1)
+	}
+}
+
+func TestGetEventsInvalidPage(t *testing.T) {
+	resetEvents(t)
+	storeTestEvents(t, 3)
+	for _, query := range []string{"limit=0", "limit=-1", "limit=x", fmt.Sprintf("limit=%d", maxEventLimit+1), "after=-1", "after=x", "after=1.5"} {
+		for _, handler := range []http.HandlerFunc{getEvents, getSuspiciousEvents, getECSEvents} {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, "/api/events?"+query, nil))
+			var body map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); rec.Code != http.StatusBadRequest || err != nil || body["error"] == "" ||
+				rec.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("%s: status %d, body %q, want 400 with an error", query, rec.Code, rec.Body)
+			}
+		}
+	}
+	if page := getPage(t, getEvents, fmt.Sprintf("/api/events?limit=%d", maxEventLimit)); len(page) != 3 {
+		t.Errorf("%d events with the maximum limit, want 3", len(page))
+	}
+}
@@ -0,0 +1,428 @@
+// artifact.go
+// Inspection of the files behind certutil -decode / -decodehex detections.
+// The encoded input is usually still on disk; decoding it in memory tells
+// what was smuggled in without ever writing the decoded content anywhere.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DecodedArtifact describes the input and output of a certutil decode
+type DecodedArtifact struct {
+	// Encoding is base64 or hex
+	Encoding     string `json:"encoding"`
+	InputPath    string `json:"input_path"`
+	OutputPath   string `json:"output_path,omitempty"`
+	InputSize    int64  `json:"input_size,omitempty"`
+	InputSHA256  string `json:"input_sha256,omitempty"`
+	OutputSHA256 string `json:"output_sha256,omitempty"`
+	// DecodedSize and DecodedSHA256 describe the input decoded in memory;
+	// they match the output file unless it was altered or not written yet
+	DecodedSize   int    `json:"decoded_size,omitempty"`
+	DecodedSHA256 string `json:"decoded_sha256,omitempty"`
+	// FileType is what the decoded content's magic bytes identify, e.g. pe
+	// or zip; Magic holds its first bytes in hex
+	FileType string `json:"file_type,omitempty"`
+	Magic    string `json:"magic,omitempty"`
+	// Error explains why the input could not be inspected, e.g. because it
+	// was already deleted
+	Error string `json:"error,omitempty"`
+}
+
+// artifactMagicLength is how many leading bytes are recorded as Magic
+const artifactMagicLength = 16
+
+// fileSignatures are the magic bytes of the file types worth telling apart,
+// checked in order
+var fileSignatures = []struct {
+	magic    []byte
+	fileType string
+}{
+	{[]byte("MZ"), "pe"},
+	{[]byte("\x7fELF"), "elf"},
+	{[]byte("PK\x03\x04"), "zip"},
+	{[]byte("Rar!\x1a\x07"), "rar"},
+	{[]byte("7z\xbc\xaf\x27\x1c"), "7z"},
+	{[]byte("\x1f\x8b"), "gzip"},
+	{[]byte("MSCF"), "cab"},
+	{[]byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"), "ole"},
+	{[]byte("%PDF"), "pdf"},
+	{[]byte("#!"), "script"},
+}
+
+// scriptMarkers identify text content that is a script, by a lowercased
+// prefix of its first non-blank line
+var scriptMarkers = []struct {
+	prefix   string
+	fileType string
+}{
+	{"<?xml", "xml"},
+	{"<html", "hta"},
+	{"<hta:", "hta"},
+	{"<script", "script"},
+	{"<job", "wsf"},
+	{"<package", "wsf"},
+	{"@echo", "batch"},
+	{"function ", "script"},
+	{"$", "powershell"},
+	{"param(", "powershell"},
+	{"[cmdletbinding", "powershell"},
+	{"set ", "batch"},
+	{"dim ", "vbscript"},
+	{"on error", "vbscript"},
+	{"var ", "jscript"},
+}
+
+// executableFileTypes are decoded file types that run on their own or carry
+// code
+var executableFileTypes = map[string]bool{
+	"pe": true, "elf": true, "hta": true, "script": true, "wsf": true,
+	"batch": true, "powershell": true, "vbscript": true, "jscript": true,
+}
+
+// splitCommandLine splits a command line into arguments following the
+// Windows rules for double quotes, without backslash escapes
+func splitCommandLine(cmdLine string) []string {
+	var args []string
+	var current strings.Builder
+	inQuotes, inArg := false, false
+	for _, r := range cmdLine {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case unicode.IsSpace(r) && !inQuotes:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// quoteArg quotes an argument that contains whitespace
+func quoteArg(arg string) string {
+	if arg == "" || strings.ContainsFunc(arg, unicode.IsSpace) {
+		return `"` + arg + `"`
+	}
+	return arg
+}
+
+// joinCommandLine is the inverse of splitCommandLine
+func joinCommandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quoteArg(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// certutilDecodeArgs returns the encoding and the input and output paths of
+// a certutil -decode or -decodehex command line
+func certutilDecodeArgs(cmdLine string) (encoding, input, output string, ok bool) {
+	args := splitCommandLine(cmdLine)
+	for i := 1; i < len(args); i++ {
+		arg := strings.ToLower(args[i])
+		if !strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "/") {
+			continue
+		}
+		switch arg[1:] {
+		case "decode":
+			encoding = "base64"
+		case "decodehex":
+			encoding = "hex"
+		default:
+			continue
+		}
+
+		// The verb's operands are the next arguments that aren't options
+		var operands []string
+		for _, operand := range args[i+1:] {
+			if !strings.HasPrefix(operand, "-") && !strings.HasPrefix(operand, "/") {
+				operands = append(operands, operand)
+			}
+		}
+		if len(operands) == 0 {
+			return "", "", "", false
+		}
+		input = operands[0]
+		if len(operands) > 1 {
+			output = operands[1]
+		}
+		return encoding, input, output, true
+	}
+	return "", "", "", false
+}
+
+// readCapped reads a whole file of at most limit bytes
+func readCapped(path string, limit int64) ([]byte, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if stat.Size() > limit {
+		return nil, stat.Size(), fmt.Errorf("file is %d bytes, larger than the %d byte cap", stat.Size(), limit)
+	}
+	data, err := io.ReadAll(io.LimitReader(file, limit))
+	return data, stat.Size(), err
+}
+
+// describeFileError turns a file error into a short explanation
+func describeFileError(err error) string {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return "file no longer exists"
+	case errors.Is(err, os.ErrPermission):
+		return "file is locked or access is denied"
+	}
+	return err.Error()
+}
+
+// decodeCertutilBase64 decodes certutil -encode output: base64, optionally
+// wrapped in -----BEGIN/END----- lines
+func decodeCertutilBase64(data []byte) ([]byte, error) {
+	var encoded strings.Builder
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "-----") {
+			continue
+		}
+		encoded.WriteString(line)
+	}
+	text := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, encoded.String())
+	decoded, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		decoded, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(text, "="))
+	}
+	return decoded, err
+}
+
+// decodeCertutilHex decodes certutil -encodehex output, either plain hex or
+// a dump with offsets, hex byte columns and an ASCII column
+func decodeCertutilHex(data []byte) ([]byte, error) {
+	plain := strings.Join(strings.Fields(string(data)), "")
+	if decoded, err := hex.DecodeString(plain); err == nil {
+		return decoded, nil
+	}
+
+	var decoded []byte
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if offset, rest, ok := strings.Cut(line, " "); ok && len(offset) > 2 {
+			line = strings.TrimLeft(rest, " ")
+		}
+		// The ASCII column is set off by three spaces; the byte columns by
+		// one, or two in the middle
+		if i := strings.Index(line, "   "); i >= 0 {
+			line = line[:i]
+		}
+		for _, field := range strings.Fields(line) {
+			if len(field) != 2 {
+				break
+			}
+			b, err := hex.DecodeString(field)
+			if err != nil {
+				break
+			}
+			decoded = append(decoded, b...)
+		}
+	}
+	if len(decoded) == 0 {
+		return nil, fmt.Errorf("no hex data found")
+	}
+	return decoded, nil
+}
+
+// detectFileType identifies content by its magic bytes, or as a script or
+// plain text
+func detectFileType(data []byte) string {
+	for _, sig := range fileSignatures {
+		if bytes.HasPrefix(data, sig.magic) {
+			return sig.fileType
+		}
+	}
+	sample := data
+	if len(sample) > 4096 {
+		sample = sample[:4096]
+	}
+	valid := sample
+	if len(data) > len(sample) {
+		// The cut may have split a character
+		for i := 0; i < utf8.UTFMax-1 && !utf8.Valid(valid); i++ {
+			valid = valid[:len(valid)-1]
+		}
+	}
+	if bytes.IndexByte(sample, 0) >= 0 || !utf8.Valid(valid) {
+		return "binary"
+	}
+	for _, line := range strings.Split(string(sample), "\n") {
+		line = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(line, "\ufeff")))
+		if line == "" {
+			continue
+		}
+		for _, marker := range scriptMarkers {
+			if strings.HasPrefix(line, marker.prefix) {
+				return marker.fileType
+			}
+		}
+		break
+	}
+	return "text"
+}
+
+// sha256Hex returns the hex SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// BinaryInspection describes a DLL or executable a LOLBin loads or runs
+type BinaryInspection struct {
+	Path            string `json:"path"`
+	Size            int64  `json:"size,omitempty"`
+	SHA256          string `json:"sha256,omitempty"`
+	Signed          bool   `json:"signed"`
+	Signer          string `json:"signer,omitempty"`
+	SignatureStatus string `json:"signature_status,omitempty"`
+	// Error explains why the file could not be inspected, e.g. because it
+	// was already deleted
+	Error string `json:"error,omitempty"`
+}
+
+// inspectBinary verifies a file's signature and hashes it when it is no
+// larger than limit
+func inspectBinary(path string, limit int64) BinaryInspection {
+	inspection := BinaryInspection{Path: path}
+	info, err := fileSignature(path)
+	if err != nil {
+		inspection.Error = describeFileError(err)
+		return inspection
+	}
+	inspection.Signed = info.Signed
+	inspection.Signer = info.Signer
+	inspection.SignatureStatus = info.Status
+	if limit <= 0 {
+		return inspection
+	}
+
+	data, size, err := readCapped(path, limit)
+	inspection.Size = size
+	if err != nil {
+		inspection.Error = describeFileError(err)
+		return inspection
+	}
+	inspection.SHA256 = sha256Hex(data)
+	return inspection
+}
+
+// inspectDecodeArtifact reads and decodes the input of a certutil decode.
+// Relative paths can't be resolved, as the process's working directory is
+// not known.
+func inspectDecodeArtifact(encoding, input, output string, limit int64) *DecodedArtifact {
+	artifact := &DecodedArtifact{
+		Encoding:   encoding,
+		InputPath:  expandWindowsEnv(input),
+		OutputPath: expandWindowsEnv(output),
+	}
+	if !filepath.IsAbs(artifact.InputPath) {
+		artifact.Error = "relative input path, working directory unknown"
+		return artifact
+	}
+
+	data, size, err := readCapped(artifact.InputPath, limit)
+	artifact.InputSize = size
+	if err != nil {
+		artifact.Error = describeFileError(err)
+		return artifact
+	}
+	artifact.InputSHA256 = sha256Hex(data)
+
+	// The output may not have been written yet when the process starts
+	if filepath.IsAbs(artifact.OutputPath) {
+		if out, _, err := readCapped(artifact.OutputPath, limit); err == nil {
+			artifact.OutputSHA256 = sha256Hex(out)
+		}
+	}
+
+	var decoded []byte
+	if encoding == "hex" {
+		decoded, err = decodeCertutilHex(data)
+	} else {
+		decoded, err = decodeCertutilBase64(data)
+	}
+	if err != nil {
+		artifact.Error = fmt.Sprintf("input does not decode as %s: %v", encoding, err)
+		return artifact
+	}
+	artifact.DecodedSize = len(decoded)
+	artifact.DecodedSHA256 = sha256Hex(decoded)
+	artifact.FileType = detectFileType(decoded)
+	magic := decoded
+	if len(magic) > artifactMagicLength {
+		magic = magic[:artifactMagicLength]
+	}
+	artifact.Magic = hex.EncodeToString(magic)
+	return artifact
+}
+
+// checkDecodeArtifact inspects the input of certutil decode detections and
+// escalates decodes that produce executable content. Only called for real
+// process starts, as the files are on this host.
+func checkDecodeArtifact(event *ProcessEvent) {
+	if config.MaxArtifactSize <= 0 || !event.IsLOLBin || imageName(event.ExecutablePath) != "certutil.exe" {
+		return
+	}
+	encoding, input, output, ok := certutilDecodeArgs(event.CommandLine)
+	if !ok {
+		return
+	}
+
+	artifact := inspectDecodeArtifact(encoding, input, output, config.MaxArtifactSize)
+	event.DecodedArtifact = artifact
+	if artifact.FileType == "" {
+		return
+	}
+	event.Indicators = append(event.Indicators, Indicator{
+		Rule:  event.Rule,
+		Type:  "decoded_file_type",
+		Value: artifact.FileType,
+	})
+	if executableFileTypes[artifact.FileType] {
+		addFinding(event, SeverityHigh, ConfidenceHigh, fmt.Sprintf("certutil decoded %s content from %s (sha256 %s)",
+			artifact.FileType, artifact.InputPath, artifact.DecodedSHA256))
+	}
+}
@@ -0,0 +1,284 @@
+// baseline.go
+// Per-user baselines of LOLBin usage. Executions are counted per user and
+// rule in daily buckets over a rolling window, so a user running a binary
+// they never or rarely use stands out.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// baselineSaveInterval is how often changed baselines are written out
+const baselineSaveInterval = time.Minute
+
+// BaselineConfig configures per-user baselines
+type BaselineConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	StatePath string `yaml:"state_path"`
+	// Window is how far back executions are counted; older days expire
+	Window Duration `yaml:"window"`
+	// MinObservation is how long a user must have been observed before
+	// their baseline influences scoring
+	MinObservation Duration `yaml:"min_observation"`
+	// RareThreshold is the execution count within the window at or below
+	// which a binary counts as unusual for the user
+	RareThreshold int `yaml:"rare_threshold"`
+}
+
+// userBaseline is the persisted history of one user
+type userBaseline struct {
+	FirstSeen time.Time `json:"first_seen"`
+	// Rules maps rule name to executions per day (days since the epoch)
+	Rules map[string]map[int64]int `json:"rules"`
+}
+
+// BaselineView is a user's baseline as returned by the API
+type BaselineView struct {
+	User        string         `json:"user"`
+	FirstSeen   time.Time      `json:"first_seen"`
+	Established bool           `json:"established"`
+	Window      Duration       `json:"window"`
+	Counts      map[string]int `json:"counts"`
+}
+
+// baselineStore holds every user's baseline
+type baselineStore struct {
+	mu    sync.Mutex
+	users map[string]*userBaseline
+	dirty bool
+}
+
+// baselines is the active store; nil when the feature is disabled
+var baselines *baselineStore
+
+// dayOf returns the bucket a time falls into
+func dayOf(t time.Time) int64 {
+	return t.Unix() / int64(24*time.Hour/time.Second)
+}
+
+// windowDays returns the number of daily buckets a window covers
+func windowDays(window time.Duration) int64 {
+	return int64((window + 24*time.Hour - 1) / (24 * time.Hour))
+}
+
+// expire drops buckets that have left the window as of now
+func (u *userBaseline) expire(now time.Time, window time.Duration) {
+	oldest := dayOf(now) - windowDays(window) + 1
+	for rule, days := range u.Rules {
+		for day := range days {
+			if day < oldest {
+				delete(days, day)
+			}
+		}
+		if len(days) == 0 {
+			delete(u.Rules, rule)
+		}
+	}
+}
+
+// count returns the executions of rule within the window
+func (u *userBaseline) count(rule string) int {
+	total := 0
+	for _, n := range u.Rules[rule] {
+		total += n
+	}
+	return total
+}
+
+// observe records an execution of rule by user and returns the count
+// within the window before it, and whether the user's baseline is
+// established enough to be used
+func (s *baselineStore) observe(user, rule string, at time.Time, cfg BaselineConfig) (int, bool) {
+	key := strings.ToLower(user)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[key]
+	if !ok {
+		u = &userBaseline{FirstSeen: at, Rules: make(map[string]map[int64]int)}
+		s.users[key] = u
+	}
+	u.expire(at, time.Duration(cfg.Window))
+
+	count := u.count(rule)
+	established := at.Sub(u.FirstSeen) >= time.Duration(cfg.MinObservation)
+
+	if u.Rules[rule] == nil {
+		u.Rules[rule] = make(map[int64]int)
+	}
+	u.Rules[rule][dayOf(at)]++
+	s.dirty = true
+	return count, established
+}
+
+// prune expires old buckets and forgets users with no activity left in the
+// window, so their baseline has to be re-established
+func (s *baselineStore) prune(now time.Time, cfg BaselineConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, u := range s.users {
+		u.expire(now, time.Duration(cfg.Window))
+		if len(u.Rules) == 0 {
+			delete(s.users, key)
+			s.dirty = true
+		}
+	}
+}
+
+// view renders one user's baseline
+func (u *userBaseline) view(user string, now time.Time, cfg BaselineConfig) BaselineView {
+	counts := make(map[string]int, len(u.Rules))
+	for rule := range u.Rules {
+		counts[rule] = u.count(rule)
+	}
+	return BaselineView{
+		User:        user,
+		FirstSeen:   u.FirstSeen,
+		Established: now.Sub(u.FirstSeen) >= time.Duration(cfg.MinObservation),
+		Window:      cfg.Window,
+		Counts:      counts,
+	}
+}
+
+// Get returns a user's baseline
+func (s *baselineStore) Get(user string, cfg BaselineConfig) (BaselineView, bool) {
+	key := strings.ToLower(user)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[key]
+	if !ok {
+		return BaselineView{}, false
+	}
+	now := time.Now()
+	u.expire(now, time.Duration(cfg.Window))
+	return u.view(key, now, cfg), true
+}
+
+// All returns every user's baseline, sorted by user
+func (s *baselineStore) All(cfg BaselineConfig) []BaselineView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	views := make([]BaselineView, 0, len(s.users))
+	for key, u := range s.users {
+		u.expire(now, time.Duration(cfg.Window))
+		views = append(views, u.view(key, now, cfg))
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].User < views[j].User })
+	return views
+}
+
+// Reset forgets a user's baseline. It reports false for unknown users.
+func (s *baselineStore) Reset(user string) bool {
+	key := strings.ToLower(user)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[key]; !ok {
+		return false
+	}
+	delete(s.users, key)
+	s.dirty = true
+	return true
+}
+
+// save writes the baselines to path if they changed since the last save
+func (s *baselineStore) save(path string) error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	// Encode under the lock; the maps are mutated in place
+	err := writeStateFile(path, s.users)
+	if err == nil {
+		s.dirty = false
+	}
+	s.mu.Unlock()
+	return err
+}
+
+// startBaselines loads persisted baselines and saves them periodically
+func startBaselines(cfg BaselineConfig) {
+	if !cfg.Enabled {
+		return
+	}
+
+	store := &baselineStore{users: make(map[string]*userBaseline)}
+	if cfg.StatePath != "" {
+		if _, err := readStateFile(cfg.StatePath, &store.users); err != nil {
+			logError(5, "Starting with empty user baselines: %v", err)
+			store.users = make(map[string]*userBaseline)
+		}
+	}
+	store.prune(time.Now(), cfg)
+	baselines = store
+	log.Printf("Tracking per-user LOLBin baselines (%d users)", len(store.users))
+
+	go func() {
+		ticker := time.NewTicker(baselineSaveInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			store.prune(time.Now(), cfg)
+			if cfg.StatePath == "" {
+				continue
+			}
+			if err := store.save(cfg.StatePath); err != nil {
+				logError(5, "%v", err)
+			}
+		}
+	}()
+}
+
+// stopBaselines flushes the baselines on shutdown
+func stopBaselines(cfg BaselineConfig) {
+	if baselines == nil || cfg.StatePath == "" {
+		return
+	}
+	if err := baselines.save(cfg.StatePath); err != nil {
+		logError(5, "%v", err)
+	}
+}
+
+// formatWindow renders a window in days when it is a whole number of them
+func formatWindow(window time.Duration) string {
+	if window%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%d days", window/(24*time.Hour))
+	}
+	return window.String()
+}
+
+// checkBaseline records a LOLBin execution in the user's baseline and flags
+// it when the user has rarely or never run the binary before. Only called
+// for real process starts so evaluations don't train the baseline.
+func checkBaseline(event *ProcessEvent) {
+	if baselines == nil || !event.IsLOLBin || event.User == "" {
+		return
+	}
+	cfg := config.Baseline
+	count, established := baselines.observe(event.User, event.Rule, event.Timestamp, cfg)
+	if !established || count > cfg.RareThreshold {
+		return
+	}
+
+	window := formatWindow(time.Duration(cfg.Window))
+	event.Indicators = append(event.Indicators, Indicator{
+		Rule:  event.Rule,
+		Type:  "baseline",
+		Value: fmt.Sprintf("%d in %s", count, window),
+	})
+	addFinding(event, SeverityLow, ConfidenceLow, fmt.Sprintf("%s ran %s, which they ran %d times in the last %s",
+		event.User, event.Rule, count, window))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// testBaselineConfig learns for three days over a week-long window
+var testBaselineConfig = BaselineConfig{
+	Enabled:        true,
+	Window:         Duration(7 * 24 * time.Hour),
+	MinObservation: Duration(72 * time.Hour),
+	RareThreshold:  1,
+}
+
+func TestBaselineObserve(t *testing.T) {
+	store := &baselineStore{users: make(map[string]*userBaseline)}
+	start := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name        string
+		user        string
+		rule        string
+		at          time.Duration
+		count       int
+		established bool
+	}{
+		{"first execution", `CORP\dev`, "powershell.exe", 0, 0, false},
+		{"still learning", `corp\DEV`, "powershell.exe", day, 1, false},
+		{"established", `CORP\dev`, "powershell.exe", 3 * day, 2, true},
+		{"other rule", `CORP\dev`, "certutil.exe", 3 * day, 0, true},
+		{"other user learns separately", `CORP\svc_erp`, "powershell.exe", 3 * day, 0, false},
+		{"first days expired", `CORP\dev`, "powershell.exe", 9 * day, 1, true},
+		{"window empty", `CORP\dev`, "powershell.exe", 20 * day, 0, true},
+	}
+	for _, tt := range tests {
+		count, established := store.observe(tt.user, tt.rule, start.Add(tt.at), testBaselineConfig)
+		if count != tt.count || established != tt.established {
+			t.Errorf("%s: observe() = %d, %v, want %d, %v", tt.name, count, established, tt.count, tt.established)
+		}
+	}
+}
+
+func TestBaselinePrune(t *testing.T) {
+	store := &baselineStore{users: make(map[string]*userBaseline)}
+	start := time.Now().Add(-30 * 24 * time.Hour)
+	store.observe(`CORP\gone`, "powershell.exe", start, testBaselineConfig)
+	store.observe(`CORP\active`, "powershell.exe", time.Now(), testBaselineConfig)
+
+	store.prune(time.Now(), testBaselineConfig)
+	if _, ok := store.Get(`CORP\gone`, testBaselineConfig); ok {
+		t.Error("a user with no activity in the window was kept")
+	}
+	if _, ok := store.Get(`CORP\active`, testBaselineConfig); !ok {
+		t.Error("an active user was pruned")
+	}
+}
+
+func TestBaselinePersistence(t *testing.T) {
+	cfg := testBaselineConfig
+	cfg.StatePath = filepath.Join(t.TempDir(), "baseline.json")
+	saved := baselines
+	t.Cleanup(func() { baselines = saved })
+
+	baselines = &baselineStore{users: make(map[string]*userBaseline)}
+	baselines.observe(`CORP\dev`, "powershell.exe", time.Now(), cfg)
+	baselines.observe(`CORP\dev`, "powershell.exe", time.Now(), cfg)
+	stopBaselines(cfg)
+
+	loaded := &baselineStore{}
+	if _, err := readStateFile(cfg.StatePath, &loaded.users); err != nil {
+		t.Fatal(err)
+	}
+	view, ok := loaded.Get(`corp\dev`, cfg)
+	if !ok || view.Counts["powershell.exe"] != 2 {
+		t.Errorf("reloaded baseline = %+v, %v, want 2 powershell.exe runs", view, ok)
+	}
+}
+
+func TestCheckBaseline(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Baseline = testBaselineConfig })
+	saved := baselines
+	t.Cleanup(func() { baselines = saved })
+	baselines = &baselineStore{users: make(map[string]*userBaseline)}
+
+	now := time.Now()
+	learned := now.Add(-4 * 24 * time.Hour)
+	// The developer runs PowerShell daily; the service account only logs on
+	baselines.observe(`CORP\dev`, "powershell.exe", learned, config.Baseline)
+	baselines.observe(`CORP\dev`, "powershell.exe", learned.Add(24*time.Hour), config.Baseline)
+	baselines.observe(`CORP\dev`, "powershell.exe", learned.Add(48*time.Hour), config.Baseline)
+	baselines.observe(`CORP\svc_erp`, "cmd.exe", learned, config.Baseline)
+	baselines.observe(`CORP\new`, "cmd.exe", now.Add(-time.Hour), config.Baseline)
+
+	tests := []struct {
+		name    string
+		user    string
+		rule    string
+		flagged bool
+	}{
+		{"habitual user", `CORP\dev`, "powershell.exe", false},
+		{"service account never ran it", `CORP\svc_erp`, "powershell.exe", true},
+		{"still learning", `CORP\new`, "powershell.exe", false},
+		{"no user", "", "powershell.exe", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := ProcessEvent{IsLOLBin: true, Rule: tt.rule, User: tt.user, Timestamp: now}
+			checkBaseline(&event)
+			if flagged := hasIndicator(event, "baseline", ""); flagged != tt.flagged || event.Suspicious != tt.flagged {
+				t.Errorf("baseline indicator %v, suspicious %v, want %v (%s)", flagged, event.Suspicious, tt.flagged, event.Reason)
+			}
+		})
+	}
+
+	// A second run is still rare, and the indicator carries the count and window
+	event := ProcessEvent{IsLOLBin: true, Rule: "powershell.exe", User: `CORP\svc_erp`, Timestamp: now}
+	checkBaseline(&event)
+	if !hasIndicator(event, "baseline", "1 in 7 days") {
+		t.Errorf("indicators = %+v, want the count and window", event.Indicators)
+	}
+}
+
+func TestResetBaseline(t *testing.T) {
+	saved := baselines
+	t.Cleanup(func() { baselines = saved })
+	baselines = &baselineStore{users: make(map[string]*userBaseline)}
+	baselines.observe(`CORP\dev`, "powershell.exe", time.Now().Add(-96*time.Hour), testBaselineConfig)
+
+	reset := func(user string) int {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/api/baselines/x", nil), map[string]string{"user": user})
+		rec := httptest.NewRecorder()
+		resetBaseline(rec, req)
+		return rec.Code
+	}
+	if code := reset(`corp\DEV`); code != http.StatusOK {
+		t.Fatalf("DELETE = %d, want 200", code)
+	}
+	if code := reset(`CORP\dev`); code != http.StatusNotFound {
+		t.Errorf("second DELETE = %d, want 404", code)
+	}
+
+	// The baseline is learned afresh
+	if _, established := baselines.observe(`CORP\dev`, "powershell.exe", time.Now(), testBaselineConfig); established {
+		t.Error("a reset baseline is established straight away")
+	}
+}
@@ -0,0 +1,263 @@
+// bits.go
+// Detection of BITS job persistence. A job's notification command line
+// runs whenever the job completes or fails, and jobs survive reboots, so
+// bitsadmin /SetNotifyCmdLine, or the SetNotifyCmdLine method from
+// PowerShell, plants a command that keeps coming back. The notification
+// command is evaluated as if it had been started, and jobs flagged on
+// creation are remembered for a while so resuming them later is caught.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// bitsJobMemory is how long a flagged job is remembered
+	bitsJobMemory = time.Hour
+	// maxFlaggedBitsJobs bounds the flagged jobs remembered
+	maxFlaggedBitsJobs = 1024
+)
+
+// bitsJobVerbs are the bitsadmin verbs whose first argument is a job
+var bitsJobVerbs = map[string]bool{
+	"create": true, "transfer": true, "addfile": true, "setnotifycmdline": true, "setnotifyflags": true,
+	"resume": true, "complete": true, "setminretrydelay": true, "setnoprogresstimeout": true,
+}
+
+var (
+	// psSetNotifyCmdLinePattern matches the SetNotifyCmdLine method of a
+	// BITS COM job with its program and parameters
+	psSetNotifyCmdLinePattern = regexp.MustCompile(`(?i)\.setnotifycmdline\(\s*(` + psLiteral + `)\s*,\s*(` + psLiteral + `|\$null)\s*\)`)
+	// psAsyncBitsPattern matches Start-BitsTransfer creating a job that
+	// outlives the PowerShell process
+	psAsyncBitsPattern = regexp.MustCompile(`(?i)\bstart-bitstransfer\b[^|;\n]*-asynchronous\b[^|;\n]*`)
+	// psDisplayNamePattern matches the job name given to Start-BitsTransfer
+	psDisplayNamePattern = regexp.MustCompile(`(?i)-displayname\s+(` + psLiteral + `|[^\s'"-][^\s]*)`)
+)
+
+// BitsJob describes the BITS job a bitsadmin or PowerShell event works on
+type BitsJob struct {
+	// Operation is the bitsadmin verb, e.g. setnotifycmdline or resume
+	Operation string `json:"operation"`
+	Name      string `json:"name,omitempty"`
+	// NotifyCommand is the command line the job runs on completion or
+	// failure
+	NotifyCommand string `json:"notify_command,omitempty"`
+	NotifyFlags   string `json:"notify_flags,omitempty"`
+	// Action is the detection result of the notification command line
+	Action *NestedCommand `json:"action,omitempty"`
+	// FlaggedBefore is why an earlier event on the job was flagged
+	FlaggedBefore string `json:"flagged_before,omitempty"`
+}
+
+// flaggedBitsJob is a remembered flagged job
+type flaggedBitsJob struct {
+	reason  string
+	expires time.Time
+}
+
+var (
+	flaggedBitsJobs      = make(map[string]flaggedBitsJob)
+	flaggedBitsJobsMutex sync.Mutex
+)
+
+// rememberBitsJob records a job flagged by a live event
+func rememberBitsJob(name, reason string) {
+	flaggedBitsJobsMutex.Lock()
+	defer flaggedBitsJobsMutex.Unlock()
+	now := time.Now()
+	for job, flagged := range flaggedBitsJobs {
+		if now.After(flagged.expires) {
+			delete(flaggedBitsJobs, job)
+		}
+	}
+	if _, ok := flaggedBitsJobs[strings.ToLower(name)]; !ok && len(flaggedBitsJobs) >= maxFlaggedBitsJobs {
+		return
+	}
+	flaggedBitsJobs[strings.ToLower(name)] = flaggedBitsJob{reason: reason, expires: now.Add(bitsJobMemory)}
+}
+
+// flaggedBitsJobReason returns why a job was flagged, if it was recently
+func flaggedBitsJobReason(name string) (string, bool) {
+	flaggedBitsJobsMutex.Lock()
+	defer flaggedBitsJobsMutex.Unlock()
+	flagged, ok := flaggedBitsJobs[strings.ToLower(name)]
+	if !ok || time.Now().After(flagged.expires) {
+		return "", false
+	}
+	return flagged.reason, true
+}
+
+// parseBitsadmin extracts the job operation of a bitsadmin command line
+func parseBitsadmin(cmdLine string) (*BitsJob, bool) {
+	args := splitCommandLine(cmdLine)
+	for i := 1; i < len(args); i++ {
+		arg := strings.ToLower(args[i])
+		if !strings.HasPrefix(arg, "/") && !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		verb := arg[1:]
+		if !bitsJobVerbs[verb] {
+			// /rawreturn, /wrap and the like
+			continue
+		}
+		job := &BitsJob{Operation: verb}
+		rest := args[i+1:]
+		// /create and /transfer take options before the job name
+		for len(rest) > 0 && strings.HasPrefix(rest[0], "/") {
+			rest = rest[1:]
+		}
+		if len(rest) > 0 {
+			job.Name = rest[0]
+		}
+		switch verb {
+		case "setnotifycmdline":
+			if len(rest) > 1 {
+				var params string
+				if len(rest) > 2 {
+					params = rest[2]
+				}
+				job.NotifyCommand = bitsNotifyCommand(rest[1], params)
+			}
+		case "setnotifyflags":
+			if len(rest) > 1 {
+				job.NotifyFlags = rest[1]
+			}
+		}
+		return job, true
+	}
+	return nil, false
+}
+
+// bitsNotifyCommand returns the command line a notification runs. BITS
+// passes the parameters as the whole command line, which by convention
+// starts with the program again; NULL means no parameters.
+func bitsNotifyCommand(program, params string) string {
+	if program == "" || strings.EqualFold(program, "null") {
+		return ""
+	}
+	args := splitCommandLine(params)
+	if len(args) == 0 || strings.EqualFold(params, "null") {
+		return joinCommandLine([]string{program})
+	}
+	if sameImage(imageName(args[0]), imageName(program)) {
+		args = args[1:]
+	}
+	return joinCommandLine(append([]string{program}, args...))
+}
+
+// checkBitsJobs flags BITS notification commands, resumed jobs flagged
+// before, and asynchronous PowerShell transfers, for bitsadmin and for the
+// scripts of the PowerShell analysis pass
+func checkBitsJobs(ctx *DetectionContext, event *ProcessEvent) {
+	switch ctx.ExecName {
+	case "bitsadmin.exe":
+		job, ok := parseBitsadmin(event.CommandLine)
+		if !ok {
+			return
+		}
+		event.BitsJob = job
+		switch job.Operation {
+		case "setnotifycmdline":
+			flagNotifyCommand(event, job)
+		case "setnotifyflags":
+			event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "bits_notify_flags", Value: job.NotifyFlags, Category: "persistence"})
+			addFinding(event, SeverityMedium, ConfidenceLow, fmt.Sprintf("BITS job %s has its notification flags set to %s", job.Name, job.NotifyFlags))
+			addTags(event, []string{"persistence"})
+		}
+		checkFlaggedBitsJob(event, job)
+	case "powershell.exe", "pwsh.exe":
+		texts := []string{event.CommandLine, event.DecodedCommand}
+		if event.PowerShell != nil {
+			texts = append(texts, event.PowerShell.Deobfuscated)
+		}
+		for _, text := range texts {
+			if match := psSetNotifyCmdLinePattern.FindStringSubmatch(text); match != nil {
+				params := ""
+				if !strings.EqualFold(match[2], "$null") {
+					params = psUnquote(match[2])
+				}
+				job := &BitsJob{Operation: "setnotifycmdline", NotifyCommand: bitsNotifyCommand(psUnquote(match[1]), params)}
+				event.BitsJob = job
+				flagNotifyCommand(event, job)
+				break
+			}
+			if statement := psAsyncBitsPattern.FindString(text); statement != "" {
+				job := &BitsJob{Operation: "transfer"}
+				if name := psDisplayNamePattern.FindStringSubmatch(statement); name != nil {
+					job.Name = name[1]
+					if name[1][0] == '\'' || name[1][0] == '"' {
+						job.Name = psUnquote(name[1])
+					}
+				}
+				event.BitsJob = job
+				event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "bits_job", Value: statement, Category: "persistence"})
+				addFinding(event, SeverityMedium, ConfidenceLow, "PowerShell creates an asynchronous BITS job that outlives the process")
+				addTags(event, []string{"persistence"})
+				break
+			}
+		}
+	default:
+		return
+	}
+	if job := event.BitsJob; job != nil && job.Name != "" && ctx.Live && event.Suspicious {
+		rememberBitsJob(job.Name, event.Reason)
+	}
+}
+
+// flagNotifyCommand evaluates a job's notification command and flags the
+// event high, critical when the command is flagged itself
+func flagNotifyCommand(event *ProcessEvent, job *BitsJob) {
+	if job.NotifyCommand == "" {
+		return
+	}
+	action := &NestedCommand{CommandLine: job.NotifyCommand}
+	result, evaluated := evaluateNestedEvent(job.NotifyCommand, event)
+	flagged := evaluated && result.Suspicious
+	if flagged {
+		action.Rule, action.Severity, action.Reason = result.Rule, result.Severity, result.Reason
+	}
+	job.Action = action
+
+	event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "bits_notify_command", Value: job.NotifyCommand, Category: "persistence"})
+	addTags(event, []string{"persistence"})
+	addFinding(event, SeverityHigh, ConfidenceHigh, fmt.Sprintf("BITS job %s runs %s on completion", job.Name, job.NotifyCommand))
+	severity := SeverityHigh
+	if flagged {
+		for _, ioc := range result.IOCs {
+			if !hasIOC(event, ioc.Value) {
+				event.IOCs = append(event.IOCs, ioc)
+			}
+		}
+		addTags(event, result.Tags)
+		addFinding(event, SeverityCritical, ConfidenceHigh, fmt.Sprintf("BITS job %s notification runs a flagged command: %s", job.Name, result.Reason))
+		severity = SeverityCritical
+	}
+	if event.Severity < severity {
+		event.Severity = severity
+	}
+}
+
+// checkFlaggedBitsJob flags resuming or reconfiguring a job an earlier
+// event was flagged for
+func checkFlaggedBitsJob(event *ProcessEvent, job *BitsJob) {
+	if job.Name == "" || job.Operation == "create" || job.Operation == "transfer" {
+		return
+	}
+	reason, ok := flaggedBitsJobReason(job.Name)
+	if !ok {
+		return
+	}
+	job.FlaggedBefore = reason
+	event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "bits_flagged_job", Value: job.Name, Category: "persistence"})
+	addFinding(event, SeverityHigh, ConfidenceMedium, fmt.Sprintf("bitsadmin /%s on BITS job %s, flagged earlier: %s", job.Operation, job.Name, reason))
+	if event.Severity < SeverityHigh {
+		event.Severity = SeverityHigh
+	}
+	addTags(event, []string{"persistence"})
+}
@@ -0,0 +1,355 @@
+// blocklist.go
+// Matching of extracted IOCs against a blocklist of known-bad domains, IP
+// ranges and URL fragments loaded from a file or fetched from a feed URL.
+// The active blocklist is swapped atomically; a failed refresh keeps the
+// last good copy.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxBlocklistSize caps how much of a feed is read
+const maxBlocklistSize = 64 << 20
+
+// BlocklistConfig configures the IOC blocklist
+type BlocklistConfig struct {
+	// Path is a local file with one entry per line
+	Path string `yaml:"path"`
+	// URL is a feed in the same format, fetched periodically
+	URL string `yaml:"url"`
+	// RefreshInterval is how often the file is checked for changes and
+	// the feed is re-fetched
+	RefreshInterval Duration `yaml:"refresh_interval"`
+}
+
+// Blocklist is an immutable set of known-bad indicators
+type Blocklist struct {
+	domains     *domainTrie
+	ips         map[string]bool
+	networks    []*net.IPNet
+	urlContains []string
+
+	Source   string
+	LoadedAt time.Time
+}
+
+// BlocklistStatus is the API view of the blocklist
+type BlocklistStatus struct {
+	Source    string         `json:"source,omitempty"`
+	LoadedAt  *time.Time     `json:"loaded_at,omitempty"`
+	Entries   map[string]int `json:"entries"`
+	Total     int            `json:"total"`
+	LastError string         `json:"last_error,omitempty"`
+}
+
+var (
+	activeBlocklist   atomic.Pointer[Blocklist]
+	blocklistErrMutex = &sync.Mutex{}
+	blocklistLastErr  string
+)
+
+// domainTrie matches a domain and all of its subdomains. Labels are stored
+// from the TLD down.
+type domainTrie struct {
+	children map[string]*domainTrie
+	entry    string
+	count    int
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{children: map[string]*domainTrie{}}
+}
+
+// insert adds a domain to the trie
+func (t *domainTrie) insert(domain string) {
+	labels := strings.Split(domain, ".")
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = newDomainTrie()
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	if node.entry == "" {
+		t.count++
+	}
+	node.entry = domain
+}
+
+// lookup returns the blocklisted domain that domain equals or falls under.
+// The trailing dot of a fully qualified name is ignored.
+func (t *domainTrie) lookup(domain string) (string, bool) {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(domain), "."), ".")
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			return "", false
+		}
+		node = child
+		if node.entry != "" {
+			return node.entry, true
+		}
+	}
+	return "", false
+}
+
+// parseBlocklist reads entries, one per line. Lines may be typed with a
+// "domain:", "ip:" or "url:" prefix; untyped lines are classified as an IP
+// or CIDR range, a URL fragment (anything with a slash) or a domain.
+// Blank lines and lines starting with # are ignored.
+func parseBlocklist(r io.Reader, source string) (*Blocklist, error) {
+	b := &Blocklist{
+		domains:  newDomainTrie(),
+		ips:      map[string]bool{},
+		Source:   source,
+		LoadedAt: time.Now(),
+	}
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = refang(line)
+
+		kind := ""
+		if prefix, value, ok := strings.Cut(line, ":"); ok && (prefix == "domain" || prefix == "ip" || prefix == "url") {
+			kind, line = prefix, strings.TrimSpace(value)
+		}
+
+		switch {
+		case kind == "url" || (kind == "" && strings.Contains(line, "/") && !isIPOrCIDR(line)):
+			b.urlContains = append(b.urlContains, line)
+		case kind == "ip" || (kind == "" && isIPOrCIDR(line)):
+			if strings.Contains(line, "/") {
+				_, network, err := net.ParseCIDR(line)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid CIDR %q", lineNo, line)
+				}
+				b.networks = append(b.networks, network)
+			} else if ip := net.ParseIP(line); ip != nil {
+				b.ips[ip.String()] = true
+			} else {
+				return nil, fmt.Errorf("line %d: invalid IP %q", lineNo, line)
+			}
+		default:
+			domain := strings.TrimPrefix(strings.TrimSuffix(line, "."), "*.")
+			if !validDomain(domain) {
+				return nil, fmt.Errorf("line %d: invalid domain %q", lineNo, line)
+			}
+			b.domains.insert(domain)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read blocklist: %v", err)
+	}
+	return b, nil
+}
+
+// validDomain reports whether s is a lowercase domain name: non-empty
+// labels of letters, digits, hyphens and underscores
+func validDomain(s string) bool {
+	for _, label := range strings.Split(s, ".") {
+		if label == "" {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isIPOrCIDR reports whether s is an IP address, with a prefix length or
+// not. The prefix length is checked when the range is parsed, so a bad one
+// is reported rather than taken for a URL fragment.
+func isIPOrCIDR(s string) bool {
+	addr, _, _ := strings.Cut(s, "/")
+	return net.ParseIP(addr) != nil
+}
+
+// Match returns the blocklist entry an IOC hits, if any
+func (b *Blocklist) Match(ioc IOC) (string, bool) {
+	switch ioc.Type {
+	case IOCDomain, IOCUNCHost:
+		return b.domains.lookup(ioc.Value)
+	case IOCIPv4, IOCIPv6:
+		ip := net.ParseIP(ioc.Value)
+		if ip == nil {
+			return "", false
+		}
+		if b.ips[ip.String()] {
+			return ip.String(), true
+		}
+		for _, network := range b.networks {
+			if network.Contains(ip) {
+				return network.String(), true
+			}
+		}
+	case IOCURL:
+		for _, fragment := range b.urlContains {
+			if strings.Contains(ioc.Value, fragment) {
+				return fragment, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Status summarizes the blocklist for the API
+func (b *Blocklist) Status() BlocklistStatus {
+	status := BlocklistStatus{
+		Entries: map[string]int{
+			"domain": b.domains.count,
+			"ip":     len(b.ips) + len(b.networks),
+			"url":    len(b.urlContains),
+		},
+	}
+	status.Source = b.Source
+	loadedAt := b.LoadedAt
+	status.LoadedAt = &loadedAt
+	status.Total = status.Entries["domain"] + status.Entries["ip"] + status.Entries["url"]
+	return status
+}
+
+// loadBlocklist loads the blocklist from the configured file or feed
+func loadBlocklist(c BlocklistConfig) (*Blocklist, error) {
+	if c.URL != "" {
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Get(c.URL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch blocklist feed: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("blocklist feed returned %s", resp.Status)
+		}
+		return parseBlocklist(io.LimitReader(resp.Body, maxBlocklistSize), c.URL)
+	}
+
+	f, err := os.Open(c.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blocklist: %v", err)
+	}
+	defer f.Close()
+	return parseBlocklist(io.LimitReader(f, maxBlocklistSize), c.Path)
+}
+
+// refreshBlocklist loads the blocklist and activates it, keeping the
+// previous copy if loading fails
+func refreshBlocklist(c BlocklistConfig) {
+	b, err := loadBlocklist(c)
+
+	blocklistErrMutex.Lock()
+	defer blocklistErrMutex.Unlock()
+
+	if err != nil {
+		blocklistLastErr = err.Error()
+		logError(3, "Blocklist refresh failed, keeping last good copy: %v", err)
+		return
+	}
+	blocklistLastErr = ""
+	activeBlocklist.Store(b)
+	status := b.Status()
+	log.Printf("Blocklist loaded from %s (%d entries)", b.Source, status.Total)
+}
+
+// startBlocklist loads the blocklist and keeps it fresh in the background.
+// Local files are only re-parsed when their modification time changes.
+func startBlocklist(c BlocklistConfig) {
+	if c.Path == "" && c.URL == "" {
+		return
+	}
+
+	refreshBlocklist(c)
+	if c.RefreshInterval <= 0 {
+		return
+	}
+
+	go func() {
+		var lastMod time.Time
+		if info, err := os.Stat(c.Path); c.URL == "" && err == nil {
+			lastMod = info.ModTime()
+		}
+
+		ticker := time.NewTicker(time.Duration(c.RefreshInterval))
+		defer ticker.Stop()
+		for range ticker.C {
+			if c.URL == "" {
+				info, err := os.Stat(c.Path)
+				if err == nil && info.ModTime().Equal(lastMod) {
+					continue
+				}
+				if err == nil {
+					lastMod = info.ModTime()
+				}
+			}
+			refreshBlocklist(c)
+		}
+	}()
+}
+
+// blocklistStatus returns the current blocklist summary for the API
+func blocklistStatus() BlocklistStatus {
+	status := BlocklistStatus{Entries: map[string]int{}}
+	if b := activeBlocklist.Load(); b != nil {
+		status = b.Status()
+	}
+
+	blocklistErrMutex.Lock()
+	status.LastError = blocklistLastErr
+	blocklistErrMutex.Unlock()
+	return status
+}
+
+// checkBlocklist marks the event suspicious if any of its IOCs is blocklisted
+func checkBlocklist(event *ProcessEvent) {
+	b := activeBlocklist.Load()
+	if b == nil {
+		return
+	}
+
+	for _, ioc := range event.IOCs {
+		entry, ok := b.Match(ioc)
+		if !ok {
+			continue
+		}
+
+		event.Indicators = append(event.Indicators, Indicator{
+			Rule:  event.Rule,
+			Type:  "blocklist",
+			Value: entry,
+		})
+		reason := fmt.Sprintf("Known-bad indicator %s matched blocklist entry '%s'", ioc.Value, entry)
+		if event.Suspicious {
+			event.Reason += "; " + reason
+		} else {
+			event.Suspicious = true
+			event.Reason = reason
+		}
+		if event.Severity < SeverityHigh {
+			event.Severity = SeverityHigh
+		}
+		raiseConfidence(event, ConfidenceHigh)
+	}
+}
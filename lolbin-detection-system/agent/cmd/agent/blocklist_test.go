@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testBlocklist = `# Test feed
+evil.example
+*.wild.example
+fqdn.example.
+DOMAIN: Typed.Example
+evil[.]test
+  padded.example
+
+10.0.0.0/8
+2001:db8::/32
+ip:192.0.2.7
+fd00::1
+url:/payload.bin
+example.org/gate.php
+`
+
+func TestBlocklistMatch(t *testing.T) {
+	b, err := parseBlocklist(strings.NewReader(testBlocklist), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ioc   IOC
+		entry string
+	}{
+		// Domains match themselves and their subdomains only
+		{IOC{IOCDomain, "evil.example"}, "evil.example"},
+		{IOC{IOCDomain, "cdn.evil.example"}, "evil.example"},
+		{IOC{IOCDomain, "a.b.evil.example"}, "evil.example"},
+		{IOC{IOCDomain, "EVIL.Example"}, "evil.example"},
+		{IOC{IOCDomain, "evil.example."}, "evil.example"},
+		{IOC{IOCDomain, "cdn.evil.example."}, "evil.example"},
+		{IOC{IOCUNCHost, "evil.example"}, "evil.example"},
+		{IOC{IOCDomain, "notevil.example"}, ""},
+		{IOC{IOCDomain, "evil.example.com"}, ""},
+		{IOC{IOCDomain, "evilexample"}, ""},
+		{IOC{IOCDomain, "example"}, ""},
+		{IOC{IOCDomain, "evil.example.."}, ""},
+		{IOC{IOCDomain, ""}, ""},
+		{IOC{IOCDomain, "wild.example"}, "wild.example"},
+		{IOC{IOCDomain, "x.wild.example"}, "wild.example"},
+		{IOC{IOCDomain, "fqdn.example"}, "fqdn.example"},
+		{IOC{IOCDomain, "typed.example"}, "typed.example"},
+		{IOC{IOCDomain, "evil.test"}, "evil.test"},
+		{IOC{IOCDomain, "padded.example"}, "padded.example"},
+		// IP addresses and ranges
+		{IOC{IOCIPv4, "10.1.2.3"}, "10.0.0.0/8"},
+		{IOC{IOCIPv4, "11.0.0.1"}, ""},
+		{IOC{IOCIPv4, "192.0.2.7"}, "192.0.2.7"},
+		{IOC{IOCIPv4, "192.0.2.8"}, ""},
+		{IOC{IOCIPv6, "2001:db8::1"}, "2001:db8::/32"},
+		{IOC{IOCIPv6, "2001:db8:ffff:ffff::1"}, "2001:db8::/32"},
+		{IOC{IOCIPv6, "2001:db9::1"}, ""},
+		{IOC{IOCIPv6, "FD00:0:0::1"}, "fd00::1"},
+		{IOC{IOCIPv6, "fd00::2"}, ""},
+		{IOC{IOCIPv6, "::ffff:10.0.0.1"}, "10.0.0.0/8"},
+		{IOC{IOCIPv4, "not-an-ip"}, ""},
+		// URL fragments
+		{IOC{IOCURL, "http://203.0.113.5/payload.bin?x=1"}, "/payload.bin"},
+		{IOC{IOCURL, "https://example.org/gate.php"}, "example.org/gate.php"},
+		{IOC{IOCURL, "https://example.org/other.php"}, ""},
+		// Types only match entries of their kind
+		{IOC{IOCURL, "http://evil.example/"}, ""},
+		{IOC{IOCFile, `C:\evil.example`}, ""},
+	}
+	for _, tt := range tests {
+		entry, ok := b.Match(tt.ioc)
+		if entry != tt.entry || ok != (tt.entry != "") {
+			t.Errorf("Match(%+v) = %q, %v, want %q", tt.ioc, entry, ok, tt.entry)
+		}
+	}
+
+	status := b.Status()
+	if want := map[string]int{"domain": 6, "ip": 4, "url": 2}; fmt.Sprint(status.Entries) != fmt.Sprint(want) || status.Total != 12 {
+		t.Errorf("entries %v, total %d, want %v, 12", status.Entries, status.Total, want)
+	}
+}
+
+func TestParseBlocklistMalformed(t *testing.T) {
+	tests := []string{
+		"10.0.0.0/33",
+		"2001:db8::/129",
+		"ip:evil.example",
+		"ip:300.1.2.3",
+		"evil..example",
+		".evil.example",
+		"*.",
+		".",
+		"evil example",
+		"evil.example:8080",
+		"domain:",
+	}
+	for _, line := range tests {
+		_, err := parseBlocklist(strings.NewReader("# feed\n"+line+"\nevil.example\n"), "test")
+		if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+			t.Errorf("%q: error %v, want one for line 2", line, err)
+		}
+	}
+}
+
+func TestRefreshBlocklistKeepsLastGoodCopy(t *testing.T) {
+	previous := activeBlocklist.Load()
+	t.Cleanup(func() {
+		activeBlocklist.Store(previous)
+		blocklistLastErr = ""
+	})
+
+	var feed atomic.Value
+	feed.Store(testBlocklist)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, feed.Load())
+	}))
+	defer server.Close()
+
+	c := BlocklistConfig{URL: server.URL}
+	refreshBlocklist(c)
+	good := activeBlocklist.Load()
+	if good == nil || blocklistStatus().LastError != "" {
+		t.Fatalf("blocklist not loaded: %+v", blocklistStatus())
+	}
+
+	feed.Store("evil.example\n10.0.0.0/33\n")
+	refreshBlocklist(c)
+	if activeBlocklist.Load() != good {
+		t.Error("a malformed feed replaced the blocklist")
+	}
+	if status := blocklistStatus(); !strings.Contains(status.LastError, "line 2") || status.Total != 12 {
+		t.Errorf("status %+v, want the last good copy and the line 2 error", status)
+	}
+
+	event := ProcessEvent{IOCs: []IOC{{IOCDomain, "cdn.evil.example."}}}
+	checkBlocklist(&event)
+	if !event.Suspicious || event.Severity != SeverityHigh || !hasIndicator(event, "blocklist", "evil.example") {
+		t.Errorf("blocklisted domain not flagged: %+v", event)
+	}
+}
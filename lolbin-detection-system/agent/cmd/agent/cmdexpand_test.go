@@ -0,0 +1,193 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCmdSubstring(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+		ok   bool
+	}{
+		{"0,3", "Win", true},
+		{"3", "dows_NT", true},
+		{"-2", "NT", true},
+		{"-2,1", "N", true},
+		{"0,-3", "Windows", true},
+		{" 1 , 2 ", "in", true},
+		// Out of range values are clamped
+		{"-50,3", "Win", true},
+		{"50", "", true},
+		{"8,50", "NT", true},
+		{"2,-50", "", true},
+		{"-3,-50", "", true},
+		// Malformed modifiers aren't resolved
+		{"", "", false},
+		{"x", "", false},
+		{"1,y", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := cmdSubstring("Windows_NT", tt.spec)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("cmdSubstring(%q) = %q, %v, want %q, %v", tt.spec, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCmdSubstitute(t *testing.T) {
+	tests := []struct {
+		value, find, replace string
+		want                 string
+	}{
+		{"Windows_NT", "_NT", "", "Windows"},
+		{"Windows_NT", "windows", "X", "X_NT"},
+		{"aXbXc", "x", "", "abc"},
+		{"Windows_NT", "zzz", "y", "Windows_NT"},
+		// The replacement isn't searched again
+		{"aaa", "a", "aa", "aaaaaa"},
+		{"Windows_NT", "*_", "", "NT"},
+		{"Windows_NT", "*dow", "Sha", "Shas_NT"},
+		{"Windows_NT", "*zzz", "", "Windows_NT"},
+		// Lowercasing İ changes its length, so case matters
+		{"İx", "X", "y", "İx"},
+		{"İx", "x", "y", "İy"},
+	}
+	for _, tt := range tests {
+		if got := cmdSubstitute(tt.value, tt.find, tt.replace); got != tt.want {
+			t.Errorf("cmdSubstitute(%q, %q, %q) = %q, want %q", tt.value, tt.find, tt.replace, got, tt.want)
+		}
+	}
+}
+
+func TestReconstructCmdLine(t *testing.T) {
+	tests := []struct {
+		name       string
+		cmdLine    string
+		want       string
+		techniques []string
+	}{
+		{"substring", `cmd.exe /c %COMSPEC:~-7,3%`, `cmd.exe /c cmd`, []string{"substring"}},
+		{"substrings joined", `cmd /c %PUBLIC:~-6,1%%COMSPEC:~-7,1%%OS:~-1%%OS:~7,-2%`,
+			`cmd /c PcT_`, []string{"substring"}},
+		{"substring clamped", `cmd /c %OS:~-50,3%%OS:~50%`, `cmd /c Win`, []string{"substring"}},
+		{"substitution", `cmd /c %OS:windows=power% -nop`, `cmd /c power_NT -nop`, []string{"substitution"}},
+		{"empty replacement", `cmd /c %PROGRAMFILES:Program =%`, `cmd /c C:\Files`, []string{"substitution"}},
+		{"substitution up to a match", `cmd /c %COMSPEC:*system32\=%`, `cmd /c cmd.exe`, []string{"substitution"}},
+		{"switches and quotes", `C:\Windows\System32\cmd.exe /q /d /c "%COMSPEC:~-7,3% /c whoami"`,
+			`C:\Windows\System32\cmd.exe /q /d /c cmd /c whoami`, []string{"substring"}},
+		{"set then call", `cmd /c "set x=calc&& call %x%"`, `cmd /c set x=calc&& call calc`, []string{"variable_indirection"}},
+		{"delayed expansion", `cmd /v:on /c "set a=pow&& set b=ershell&& !a!!b! -nop"`,
+			`cmd /v:on /c set a=pow&& set b=ershell&& powershell -nop`, []string{"variable_indirection"}},
+		{"delayed expansion off", `cmd /v:off /c "set a=pow&& !a!%OS:~0,0%"`, `cmd /v:off /c set a=pow&& !a!`, []string{"substring"}},
+		{"quoted set", `cmd /c "set "s=%OS:~0,3%"&& call %s%"`, `cmd /c set "s=Win"&& call Win`, []string{"substring", "variable_indirection"}},
+		{"unset variable", `cmd /c "set x=calc& set x=& call %x%%OS:~0,0%"`, `cmd /c set x=calc& set x=& call %x%`, []string{"substring"}},
+		// call expands once per call, so nested calls resolve a
+		// variable holding another variable's name
+		{"nested call", `cmd /c "set b=calc&& set a=%b%&& call call %a%"`,
+			`cmd /c set b=calc&& set a=%b%&& call call calc`, []string{"variable_indirection"}},
+		{"single call of a nested variable", `cmd /c "set b=calc&& set a=%b%&& call %a%"`,
+			`cmd /c set b=calc&& set a=%b%&& call %b%`, []string{"variable_indirection"}},
+		{"recursive set", `cmd /c "set a=x&& call set a=%a%%a%&& call set a=%a%%a%&& call echo %a%"`,
+			`cmd /c set a=x&& call set a=xx&& call set a=xxxx&& call echo xxxx`, []string{"variable_indirection"}},
+		// Unterminated and stray %
+		{"unterminated reference", `cmd /c echo %OS:~0,3%%PATHEXT`, `cmd /c echo Win%PATHEXT`, []string{"substring"}},
+		{"stray percent", `cmd /c echo 50% off %OS:~0,3%`, `cmd /c echo 50% off Win`, []string{"substring"}},
+		{"lone percent", `cmd /c echo 100%`, "", nil},
+		// Nothing to reconstruct
+		{"invalid modifiers", `cmd /c %OS:~x,3% %OS:=x% %OS:*=x% %OS:y%`, "", nil},
+		{"plain variables", `cmd /c %SystemRoot%\System32\calc.exe`, "", nil},
+		{"undefined variable", `cmd /c %TEMP:~0,3%`, "", nil},
+		{"no command", `cmd.exe %OS:~0,3%`, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, techniques := reconstructCmdLine(tt.cmdLine)
+			if got != tt.want || !reflect.DeepEqual(techniques, tt.techniques) {
+				t.Errorf("reconstructCmdLine(%q) = %q, %q, want %q, %q", tt.cmdLine, got, techniques, tt.want, tt.techniques)
+			}
+		})
+	}
+}
+
+func TestReconstructCmdLineBounds(t *testing.T) {
+	// done fails the test if a reconstruction doesn't come back quickly
+	done := func(t *testing.T, cmdLine string) (string, []string) {
+		t.Helper()
+		type result struct {
+			command    string
+			techniques []string
+		}
+		results := make(chan result, 1)
+		go func() {
+			command, techniques := reconstructCmdLine(cmdLine)
+			results <- result{command, techniques}
+		}()
+		select {
+		case r := <-results:
+			return r.command, r.techniques
+		case <-time.After(10 * time.Second):
+			t.Fatal("reconstruction did not terminate")
+			return "", nil
+		}
+	}
+
+	t.Run("doubling", func(t *testing.T) {
+		cmdLine := `cmd /c "set a=xxxxxxxx` + strings.Repeat(`&& call set a=%a%%a%`, 40) + `&& call echo %a%"`
+		got, _ := done(t, cmdLine)
+		if len(got) > maxCmdExpansionLength {
+			t.Errorf("reconstructed %d bytes, want at most %d", len(got), maxCmdExpansionLength)
+		}
+		if !strings.Contains(got, strings.Repeat("x", 2048)) {
+			t.Error("the doubled variable was not expanded up to the bound")
+		}
+	})
+
+	t.Run("substitution growth", func(t *testing.T) {
+		cmdLine := `cmd /c "set a=aaaaaaaa` + strings.Repeat(`&& call set a=%a:a=aaaaaaaa%`, 20) + `&& call echo %a%"`
+		if got, _ := done(t, cmdLine); len(got) > maxCmdExpansionLength {
+			t.Errorf("reconstructed %d bytes, want at most %d", len(got), maxCmdExpansionLength)
+		}
+	})
+
+	t.Run("references", func(t *testing.T) {
+		cmdLine := `cmd /c ` + strings.Repeat(`%OS:~0,1%`, maxCmdExpansions+76)
+		got, _ := done(t, cmdLine)
+		if n := strings.Count(got, "W"); n != maxCmdExpansions {
+			t.Errorf("%d references resolved, want %d", n, maxCmdExpansions)
+		}
+		if n := strings.Count(got, `%OS:~0,1%`); n != 76 {
+			t.Errorf("%d references left as written, want 76", n)
+		}
+	})
+
+	t.Run("call depth", func(t *testing.T) {
+		// Each call resolves one more variable of the chain v0 -> v1 -> ...
+		var chain strings.Builder
+		chain.WriteString(`cmd /c "set v20=calc`)
+		for i := 19; i >= 0; i-- {
+			chain.WriteString(`&& set v` + strconv.Itoa(i) + `=%v` + strconv.Itoa(i+1) + `%`)
+		}
+		within := chain.String() + `&& ` + strings.Repeat("call ", maxCmdCallDepth) + `%v` + strconv.Itoa(20-maxCmdCallDepth+1) + `%"`
+		if got, _ := done(t, within); !strings.HasSuffix(got, strings.Repeat("call ", maxCmdCallDepth)+"calc") {
+			t.Errorf("%d nested calls not resolved: %q", maxCmdCallDepth, got)
+		}
+		beyond := chain.String() + `&& ` + strings.Repeat("call ", 30) + `%v0%"`
+		got, _ := done(t, beyond)
+		if !strings.HasSuffix(got, strings.Repeat("call ", 30)+"%v"+strconv.Itoa(maxCmdCallDepth)+"%") {
+			t.Errorf("calls beyond maxCmdCallDepth resolved: %q", got)
+		}
+	})
+
+	t.Run("statements", func(t *testing.T) {
+		cmdLine := `cmd /c "` + strings.Repeat(`set a=x& `, maxCmdStatements) + `set b=calc& call %b%%OS:~0,0%"`
+		got, _ := done(t, cmdLine)
+		if !strings.HasSuffix(got, `call %b%`) {
+			t.Errorf("statements beyond maxCmdStatements emulated: %q", got[len(got)-32:])
+		}
+	})
+}
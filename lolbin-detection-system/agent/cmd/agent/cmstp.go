@@ -0,0 +1,251 @@
+// cmstp.go
+// Inspection of the INF files behind cmstp.exe UAC bypasses. The profile's
+// RunPreSetupCommands and UnRegisterOCXs sections run arbitrary command
+// lines, elevated when auto-elevation is abused, so each of them is run
+// back through detection.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+// cmstpCommandKeys are the INF directives whose values name sections of
+// command lines that cmstp runs
+var cmstpCommandKeys = []string{"runpresetupcommands", "unregisterocxs"}
+
+// INFInspection describes the INF file a cmstp.exe event installs
+type INFInspection struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Commands are the command lines of the INF's RunPreSetupCommands and
+	// UnRegisterOCXs sections, with their own detection results
+	Commands []INFCommand `json:"commands,omitempty"`
+	// Error explains why the INF could not be inspected, e.g. because it
+	// was already deleted or lives on a remote share
+	Error string `json:"error,omitempty"`
+}
+
+// INFCommand is a command line embedded in an INF file
+type INFCommand struct {
+	Section string `json:"section"`
+	// Directive is the INF directive that runs the section,
+	// runpresetupcommands or unregisterocxs
+	Directive string `json:"directive"`
+	NestedCommand
+}
+
+// cmstpINFPath returns the INF file a cmstp command line installs
+func cmstpINFPath(cmdLine string) (string, bool) {
+	args := splitCommandLine(cmdLine)
+	for _, arg := range args[min(1, len(args)):] {
+		if strings.HasSuffix(strings.ToLower(arg), ".inf") {
+			return arg, true
+		}
+	}
+	return "", false
+}
+
+// decodeINF returns the text of an INF file, which is either UTF-16 with a
+// byte order mark or a single-byte encoding
+func decodeINF(data []byte) string {
+	littleEndian := bytes.HasPrefix(data, []byte{0xff, 0xfe})
+	if !littleEndian && !bytes.HasPrefix(data, []byte{0xfe, 0xff}) {
+		return strings.TrimPrefix(string(data), "\ufeff")
+	}
+	data = data[2:]
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		if littleEndian {
+			units = append(units, uint16(data[i])|uint16(data[i+1])<<8)
+		} else {
+			units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// stripINFComment removes a trailing ; comment from an INF line, leaving
+// semicolons inside double quotes alone
+func stripINFComment(line string) string {
+	inQuotes := false
+	for i, r := range line {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == ';' && !inQuotes:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseINFCommands returns the command lines of the sections referenced by
+// RunPreSetupCommands and UnRegisterOCXs directives, in file order
+func parseINFCommands(text string) []INFCommand {
+	sections := make(map[string][]string)
+	var order []string
+	var current string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 64*1024), len(text)+1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(stripINFComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if _, ok := sections[current]; !ok {
+				order = append(order, current)
+				sections[current] = []string{}
+			}
+			continue
+		}
+		sections[current] = append(sections[current], line)
+	}
+
+	// Collect the section names the directives point at
+	referenced := make(map[string]string)
+	for _, name := range order {
+		for _, line := range sections[name] {
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			key = strings.ToLower(strings.TrimSpace(key))
+			for _, directive := range cmstpCommandKeys {
+				if key != directive {
+					continue
+				}
+				for _, section := range strings.Split(value, ",") {
+					if section = strings.ToLower(strings.TrimSpace(section)); section != "" {
+						referenced[section] = directive
+					}
+				}
+			}
+		}
+	}
+
+	var commands []INFCommand
+	for _, name := range order {
+		directive, ok := referenced[name]
+		if !ok {
+			continue
+		}
+		for _, line := range sections[name] {
+			commands = append(commands, INFCommand{
+				Section:       name,
+				Directive:     directive,
+				NestedCommand: NestedCommand{CommandLine: line},
+			})
+		}
+	}
+	return commands
+}
+
+// expandINFDirs replaces the INF directory IDs commonly used in command
+// lines, %11% (System32) and %10% (Windows), then environment variables
+func expandINFDirs(cmdLine string) string {
+	windir := os.Getenv("SystemRoot")
+	if windir == "" {
+		windir = `C:\Windows`
+	}
+	cmdLine = strings.ReplaceAll(cmdLine, "%11%", filepath.Join(windir, "System32"))
+	cmdLine = strings.ReplaceAll(cmdLine, "%10%", windir)
+	return expandWindowsEnv(cmdLine)
+}
+
+// ocxCommandLine returns the regsvr32 command line equivalent to an
+// UnRegisterOCXs entry, dll[,flags[,install command line]]
+func ocxCommandLine(entry string) string {
+	fields := strings.SplitN(entry, ",", 3)
+	cmdLine := "regsvr32.exe /u /n"
+	if len(fields) == 3 && strings.TrimSpace(fields[2]) != "" {
+		cmdLine += " /i:" + strings.TrimSpace(fields[2])
+	}
+	return cmdLine + ` "` + strings.Trim(strings.TrimSpace(fields[0]), `"`) + `"`
+}
+
+// evaluateINFCommand runs an embedded command line through detection as if
+// cmstp had started it
+func evaluateINFCommand(command *INFCommand, event *ProcessEvent) {
+	cmdLine := expandINFDirs(command.CommandLine)
+	if command.Directive == "unregisterocxs" {
+		cmdLine = ocxCommandLine(cmdLine)
+	}
+	evaluated := evaluateNested(cmdLine, event)
+	command.Rule, command.Severity, command.Reason = evaluated.Rule, evaluated.Severity, evaluated.Reason
+}
+
+// inspectINF reads a cmstp INF file and evaluates its embedded commands.
+// Remote INFs are not fetched, so that inspecting one never reaches out to
+// an attacker's share.
+func inspectINF(path string, event *ProcessEvent, limit int64) *INFInspection {
+	inspection := &INFInspection{Path: expandWindowsEnv(path)}
+	switch {
+	case len(findUNCPaths(inspection.Path)) > 0:
+		inspection.Error = "INF is on a remote share and was not read"
+		return inspection
+	case !filepath.IsAbs(inspection.Path):
+		inspection.Error = "relative INF path, working directory unknown"
+		return inspection
+	}
+
+	data, size, err := readCapped(inspection.Path, limit)
+	inspection.Size = size
+	if err != nil {
+		inspection.Error = describeFileError(err)
+		return inspection
+	}
+	inspection.SHA256 = sha256Hex(data)
+	inspection.Commands = parseINFCommands(decodeINF(data))
+	for i := range inspection.Commands {
+		evaluateINFCommand(&inspection.Commands[i], event)
+	}
+	return inspection
+}
+
+// checkCMSTP inspects the INF of a cmstp.exe detection and escalates to
+// critical when the INF runs a command a LOLBin rule flags. Only called
+// for real process starts, as the INF is on this host.
+func checkCMSTP(event *ProcessEvent) {
+	if config.MaxArtifactSize <= 0 || !event.IsLOLBin || imageName(event.ExecutablePath) != "cmstp.exe" {
+		return
+	}
+	path, ok := cmstpINFPath(event.CommandLine)
+	if !ok {
+		return
+	}
+
+	inspection := inspectINF(path, event, config.MaxArtifactSize)
+	event.INFInspection = inspection
+	if inspection.Error != "" {
+		event.Indicators = append(event.Indicators, Indicator{
+			Rule:  event.Rule,
+			Type:  "inf_unreadable",
+			Value: inspection.Error,
+		})
+	}
+	for _, command := range inspection.Commands {
+		event.Indicators = append(event.Indicators, Indicator{
+			Rule:  event.Rule,
+			Type:  "inf_command",
+			Value: command.CommandLine,
+		})
+		if command.Rule == "" {
+			continue
+		}
+		addFinding(event, SeverityCritical, ConfidenceHigh, fmt.Sprintf("cmstp INF %s runs a command flagged by %s: %s",
+			inspection.Path, command.Rule, command.CommandLine))
+		if event.Severity < SeverityCritical {
+			event.Severity = SeverityCritical
+		}
+	}
+}
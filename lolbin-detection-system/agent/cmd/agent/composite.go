@@ -0,0 +1,95 @@
+// composite.go
+// Built-in composite detections that span several binaries and look at the
+// parent chain rather than a single rule's arguments
+
+package main
+
+import (
+	"fmt"
+)
+
+// compositeRule flags any of a set of images when its condition holds
+type compositeRule struct {
+	name      string
+	images    map[string]bool
+	condition conditionNode
+	severity  Severity
+	// confidence is how sure a match is, as a percentage
+	confidence int
+	reason     string
+	tags       []string
+	// enabled reports whether the detection is switched on in the config
+	enabled func() bool
+}
+
+// officeApplications are the Office processes macros run in
+var officeApplications = []string{"winword.exe", "excel.exe", "powerpnt.exe", "outlook.exe"}
+
+// compositeRules are evaluated for every event after the per-binary rules
+var compositeRules = []compositeRule{
+	{
+		// A script host started anywhere below an Office application is
+		// the classic macro dropper, whatever its arguments
+		name: "office_macro_chain",
+		images: map[string]bool{
+			"powershell.exe": true,
+			"pwsh.exe":       true,
+			"cmd.exe":        true,
+			"mshta.exe":      true,
+			"wscript.exe":    true,
+			"cscript.exe":    true,
+		},
+		condition: func() conditionNode {
+			var ancestors []conditionNode
+			for _, app := range officeApplications {
+				ancestors = append(ancestors, ancestorLeaf{value: app})
+			}
+			return anyGroup{children: ancestors}
+		}(),
+		severity:   SeverityCritical,
+		confidence: ConfidenceHigh,
+		reason:     "Script host %s launched from an Office application (%s)",
+		tags:       []string{"initial-access", "execution"},
+		enabled:    func() bool { return config.OfficeMacroChain },
+	},
+}
+
+// checkCompositeRules applies the enabled composite rules to the event. A
+// match sets the rule's severity outright rather than bumping it.
+func checkCompositeRules(event *ProcessEvent, execName string) {
+	if len(event.Ancestry) == 0 {
+		return
+	}
+	in := &evalInput{
+		path:     execName,
+		ancestry: lowerAll(event.Ancestry),
+	}
+
+	for _, rule := range compositeRules {
+		if !rule.images[execName] || !rule.enabled() {
+			continue
+		}
+		matched, indicators := rule.condition.eval(in)
+		if !matched {
+			continue
+		}
+
+		for i := range indicators {
+			indicators[i].Rule = rule.name
+		}
+		event.Indicators = append(event.Indicators, indicators...)
+		addTags(event, rule.tags)
+
+		reason := fmt.Sprintf(rule.reason, execName, describeIndicators(indicators))
+		if event.Suspicious {
+			event.Reason += "; " + reason
+		} else {
+			event.Suspicious = true
+			event.Reason = reason
+		}
+		if event.Severity < rule.severity {
+			event.Severity = rule.severity
+		}
+		raiseConfidence(event, rule.confidence)
+	}
+}
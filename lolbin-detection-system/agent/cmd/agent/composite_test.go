@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOfficeMacroChain(t *testing.T) {
+	resetEvents(t)
+	start := time.Now().Add(-time.Minute)
+	storeEvent(ProcessEvent{ProcessID: 100, ParentID: 4, Timestamp: start,
+		ExecutablePath: `C:\Program Files\Microsoft Office\root\Office16\WINWORD.EXE`})
+	storeEvent(ProcessEvent{ProcessID: 200, ParentID: 100, Timestamp: start.Add(time.Second),
+		ExecutablePath: `C:\Windows\System32\cmd.exe`, CommandLine: `cmd.exe /c powershell -w hidden`})
+	storeEvent(ProcessEvent{ProcessID: 300, ParentID: 4, Timestamp: start,
+		ExecutablePath: `C:\Windows\explorer.exe`})
+
+	tests := []struct {
+		name       string
+		executable string
+		cmdLine    string
+		parentID   uint32
+		critical   bool
+	}{
+		{"winword, cmd, powershell", `C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`, `powershell.exe -w hidden`, 200, true},
+		{"script host directly below word", `C:\Windows\System32\wscript.exe`, `wscript.exe C:\Users\alice\a.vbs`, 100, true},
+		{"benign arguments below word", `C:\Windows\System32\cmd.exe`, `cmd.exe /c dir`, 100, true},
+		{"not a script host below word", `C:\Windows\System32\splwow64.exe`, `splwow64.exe 8192`, 100, false},
+		{"script host below explorer", `C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`, `powershell.exe -w hidden`, 300, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := checkForLOLBin(ProcessEvent{
+				Timestamp:      start.Add(time.Minute),
+				ProcessID:      4242,
+				ParentID:       tt.parentID,
+				CommandLine:    tt.cmdLine,
+				ExecutablePath: tt.executable,
+			}, false)
+			chained := hasIndicator(event, "ancestor", "winword.exe")
+			if chained != tt.critical || tt.critical && event.Severity != SeverityCritical {
+				t.Errorf("ancestry %q: severity %v, office indicator %v, want critical %v", event.Ancestry, event.Severity, chained, tt.critical)
+			}
+		})
+	}
+}
+
+func TestOfficeMacroChainDisabled(t *testing.T) {
+	withConfig(t, func(c *Config) { c.OfficeMacroChain = false })
+	event := ProcessEvent{Ancestry: []string{`C:\Program Files\Microsoft Office\root\Office16\EXCEL.EXE`}}
+	checkCompositeRules(&event, "cmd.exe")
+	if event.Suspicious {
+		t.Errorf("flagged with the chain detection off: %s", event.Reason)
+	}
+}
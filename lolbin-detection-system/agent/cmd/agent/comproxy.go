@@ -0,0 +1,203 @@
+// comproxy.go
+// Detection of COM object execution through verclsid, xwizard and
+// openwith. Each instantiates the COM class named by a CLSID on its
+// command line, so the binary is harmless and the class's server is what
+// runs. The CLSID is resolved to its InprocServer32 or LocalServer32
+// server, from reg.exe writes seen earlier or from this host's registry,
+// and the server is judged by location and signature and run back through
+// detection.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// COM server key names, in the order a class is looked up
+const (
+	comInprocServer = "InprocServer32"
+	comLocalServer  = "LocalServer32"
+)
+
+// comProxyBinaries maps the binaries proxying COM execution to the verb
+// that instantiates the class
+var comProxyBinaries = map[string]string{
+	"verclsid.exe": "/c",
+	"xwizard.exe":  "runwizard",
+	"openwith.exe": "/run",
+}
+
+// guidPattern matches a GUID, braces optional
+var guidPattern = regexp.MustCompile(`\{?([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})\}?`)
+
+// COMObject describes the COM class a proxy binary instantiates
+type COMObject struct {
+	Proxy string `json:"proxy"`
+	CLSID string `json:"clsid"`
+	// ServerType is InprocServer32 for DLLs and LocalServer32 for
+	// executables; Server is the registered path or command line
+	ServerType string `json:"server_type,omitempty"`
+	Server     string `json:"server,omitempty"`
+	// Source is where the server was found: reg.exe telemetry or the
+	// registry key it was read from
+	Source string `json:"source,omitempty"`
+	// Binary describes the server DLL or executable, read for real process
+	// starts
+	Binary *BinaryInspection `json:"binary,omitempty"`
+	NestedCommand
+}
+
+// parseCOMProxy returns the CLSID a COM proxy command line instantiates,
+// which follows the proxy's verb
+func parseCOMProxy(execName, cmdLine string) (string, bool) {
+	verb, ok := comProxyBinaries[execName]
+	if !ok {
+		return "", false
+	}
+	args := splitCommandLine(cmdLine)
+	for i := 1; i < len(args); i++ {
+		if strings.ToLower(args[i]) != verb && !(verb[0] == '/' && strings.ToLower(args[i]) == "-"+verb[1:]) {
+			continue
+		}
+		for _, arg := range args[i+1:] {
+			if match := guidPattern.FindStringSubmatch(arg); match != nil {
+				return "{" + strings.ToUpper(match[1]) + "}", true
+			}
+		}
+	}
+	return "", false
+}
+
+// comServerFromTelemetry finds the newest reg.exe write still in the store
+// that registers a server for the CLSID
+func comServerFromTelemetry(clsid string) (serverType, server, source string, ok bool) {
+	eventsMutex.RLock()
+	defer eventsMutex.RUnlock()
+
+	ids := storeIndex.byExe["reg.exe"]
+	for i := len(ids) - 1; i >= 0; i-- {
+		event, found := storedEvent(ids[i])
+		if !found || event.Registry == nil {
+			continue
+		}
+		for _, write := range event.Registry.Writes {
+			key := strings.ToLower(write.Key)
+			for _, kind := range []string{comInprocServer, comLocalServer} {
+				suffix := strings.ToLower(`\CLSID\` + clsid + `\` + kind)
+				if strings.HasSuffix(key, suffix) && write.ValueName == "" && write.Data != "" {
+					return kind, write.Data, fmt.Sprintf("reg.exe event %d", event.ID), true
+				}
+			}
+		}
+	}
+	return "", "", "", false
+}
+
+// comServerFromRegistry reads the server of a CLSID from this host's
+// registry, per-user registrations first as they take precedence
+func comServerFromRegistry(clsid string) (serverType, server, source string, ok bool) {
+	roots := []struct {
+		key  registry.Key
+		name string
+	}{
+		{registry.CURRENT_USER, "HKCU"},
+		{registry.LOCAL_MACHINE, "HKLM"},
+	}
+	for _, root := range roots {
+		for _, kind := range []string{comInprocServer, comLocalServer} {
+			path := `SOFTWARE\Classes\CLSID\` + clsid + `\` + kind
+			key, err := registry.OpenKey(root.key, path, registry.QUERY_VALUE)
+			if err != nil {
+				continue
+			}
+			value, _, err := key.GetStringValue("")
+			key.Close()
+			if err == nil && value != "" {
+				return kind, value, root.name + `\` + path, true
+			}
+		}
+	}
+	return "", "", "", false
+}
+
+// checkCOMProxy flags verclsid, xwizard and openwith instantiating COM
+// classes, judged by the server the CLSID resolves to. A server in a
+// user-writable directory is the real signal; a CLSID that can't be
+// resolved is flagged at lower severity.
+func checkCOMProxy(ctx *DetectionContext, event *ProcessEvent) {
+	clsid, ok := parseCOMProxy(ctx.ExecName, event.CommandLine)
+	if !ok {
+		return
+	}
+	object := &COMObject{Proxy: ctx.ExecName, CLSID: clsid}
+	event.COMObject = object
+	event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "clsid", Value: clsid})
+
+	serverType, server, source, found := comServerFromTelemetry(clsid)
+	if !found && ctx.Live {
+		serverType, server, source, found = comServerFromRegistry(clsid)
+	}
+	if !found {
+		addFinding(event, SeverityLow, ConfidenceLow, fmt.Sprintf("%s instantiates COM class %s, which has no server registered", ctx.ExecName, clsid))
+		return
+	}
+	object.ServerType, object.Server, object.Source = serverType, expandWindowsEnv(server), source
+
+	// LocalServer32 holds a command line, InprocServer32 a DLL path
+	path := strings.Trim(object.Server, `"`)
+	if serverType == comLocalServer {
+		if args := splitCommandLine(object.Server); len(args) > 0 {
+			path = args[0]
+		}
+	}
+	event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "com_server", Value: path})
+	if ctx.Live {
+		inspection := inspectBinary(path, config.MaxArtifactSize)
+		object.Binary = &inspection
+	}
+
+	hash := ""
+	if object.Binary != nil && object.Binary.SHA256 != "" {
+		hash = fmt.Sprintf(" (sha256 %s)", object.Binary.SHA256)
+	}
+	if isUserWritableOrTempPath(path) {
+		addFinding(event, SeverityHigh, ConfidenceHigh, fmt.Sprintf("%s instantiates COM class %s served by %s in a user-writable directory%s",
+			ctx.ExecName, clsid, path, hash))
+		if event.Severity < SeverityHigh {
+			event.Severity = SeverityHigh
+		}
+	}
+	if object.Binary != nil && object.Binary.SignatureStatus != "" && !object.Binary.Signed {
+		addFinding(event, SeverityHigh, ConfidenceMedium, fmt.Sprintf("%s instantiates COM class %s served by unsigned %s%s",
+			ctx.ExecName, clsid, path, hash))
+	}
+
+	// The server runs in place of the proxy, so it goes through detection
+	// like a command line the proxy started
+	cmdLine := object.Server
+	if serverType == comInprocServer {
+		cmdLine = quoteArg(path)
+	}
+	object.CommandLine = cmdLine
+	result, ok := evaluateNestedEvent(cmdLine, event)
+	if !ok || !result.Suspicious {
+		return
+	}
+	object.Rule, object.Severity, object.Reason = result.Rule, result.Severity, result.Reason
+	prefix := fmt.Sprintf("COM server of %s via %s", clsid, ctx.ExecName)
+	for _, indicator := range result.Indicators {
+		indicator.Rule = prefix + ": " + indicator.Rule
+		event.Indicators = append(event.Indicators, indicator)
+	}
+	for _, ioc := range result.IOCs {
+		if !hasIOC(event, ioc.Value) {
+			event.IOCs = append(event.IOCs, ioc)
+		}
+	}
+	addTags(event, result.Tags)
+	addFinding(event, result.Severity, result.Confidence, prefix+": "+result.Reason)
+}
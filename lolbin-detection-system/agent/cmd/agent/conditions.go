@@ -0,0 +1,404 @@
+// conditions.go
+// Composite rule conditions: nested all-of / any-of / none-of groups over
+// argument, path, ancestry and account predicates, compiled into an
+// evaluable tree when the rule set is loaded.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Condition is a node of a rule's suspicious criteria as written in the
+// rules file. A node is either a leaf, with exactly one of Arg, Path,
+// Ancestor, Account or Integrity set, or a group. When several of All, Any
+// and None are set on one node, they must all hold.
+type Condition struct {
+	All  []Condition `json:"all,omitempty"`
+	Any  []Condition `json:"any,omitempty"`
+	None []Condition `json:"none,omitempty"`
+
+	// Arg matches when the lowercased command line contains it
+	Arg string `json:"arg,omitempty"`
+	// Path matches when the lowercased executable path contains it. A
+	// value with glob metacharacters (*, ?, **, [) must match the whole
+	// path instead, e.g. C:\Users\*\AppData\Local\Temp\**.
+	Path string `json:"path,omitempty"`
+	// Ancestor matches when a process up the parent chain has this image
+	// name, or a path containing it when it includes a backslash
+	Ancestor string `json:"ancestor,omitempty"`
+	// Account matches the account the process runs as: "system",
+	// "service" or "interactive", or otherwise a DOMAIN\user name or glob
+	Account string `json:"account,omitempty"`
+	// Integrity matches processes running at this integrity level or
+	// above: untrusted, low, medium, high, system or protected
+	Integrity string `json:"integrity,omitempty"`
+}
+
+// Indicator is one piece of evidence that contributed to a detection
+type Indicator struct {
+	Rule  string `json:"rule,omitempty"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	// Category is the rule's argument group the indicator belongs to,
+	// e.g. download or obfuscation
+	Category string `json:"category,omitempty"`
+	// Exact is set on an arg indicator whose value matched whole
+	// command-line tokens rather than part of a longer one
+	Exact bool `json:"exact,omitempty"`
+}
+
+// evalInput is what a condition is evaluated against. Strings are
+// lowercased once up front.
+type evalInput struct {
+	cmdLine string
+	path    string
+	// ancestry holds the image paths of the parent chain, nearest first
+	ancestry []string
+	user     string
+	account  string
+	// integrity is the integrityRank of the process, zero when unknown
+	integrity int
+}
+
+// conditionNode is a compiled condition
+type conditionNode interface {
+	eval(in *evalInput) (bool, []Indicator)
+}
+
+type argLeaf struct {
+	value    string
+	category string
+}
+
+func (l argLeaf) eval(in *evalInput) (bool, []Indicator) {
+	if strings.Contains(in.cmdLine, l.value) {
+		return true, []Indicator{{Type: "arg", Value: l.value, Category: l.category, Exact: matchesTokens(in.cmdLine, l.value)}}
+	}
+	return false, nil
+}
+
+// matchesTokens reports whether value occurs in the command line bounded by
+// token delimiters on both sides, e.g. -urlcache in certutil -urlcache -f
+// but not http in https://example.com
+func matchesTokens(cmdLine, value string) bool {
+	for offset := 0; ; {
+		i := strings.Index(cmdLine[offset:], value)
+		if i < 0 {
+			return false
+		}
+		start, end := offset+i, offset+i+len(value)
+		if (start == 0 || isTokenDelimiter(cmdLine[start-1])) && (end == len(cmdLine) || isTokenDelimiter(cmdLine[end])) {
+			return true
+		}
+		offset = start + 1
+	}
+}
+
+// isTokenDelimiter reports whether c separates command-line tokens
+func isTokenDelimiter(c byte) bool {
+	return c == ' ' || c == '\t' || c == '"' || c == '\''
+}
+
+type pathLeaf struct {
+	value string
+	glob  *globMatcher
+}
+
+func (l pathLeaf) eval(in *evalInput) (bool, []Indicator) {
+	if l.glob != nil && l.glob.Match(in.path) || l.glob == nil && strings.Contains(in.path, l.value) {
+		return true, []Indicator{{Type: "path", Value: l.value}}
+	}
+	return false, nil
+}
+
+type ancestorLeaf struct{ value string }
+
+func (l ancestorLeaf) eval(in *evalInput) (bool, []Indicator) {
+	for _, ancestor := range in.ancestry {
+		if imageName(ancestor) == l.value || strings.Contains(l.value, `\`) && strings.Contains(ancestor, l.value) {
+			return true, []Indicator{{Type: "ancestor", Value: l.value}}
+		}
+	}
+	return false, nil
+}
+
+type accountLeaf struct {
+	value string
+	glob  *globMatcher
+}
+
+func (l accountLeaf) eval(in *evalInput) (bool, []Indicator) {
+	var matched bool
+	switch {
+	case l.value == AccountSystem || l.value == AccountService || l.value == AccountInteractive:
+		matched = in.account == l.value
+	case l.glob != nil:
+		matched = in.user != "" && l.glob.Match(in.user)
+	default:
+		matched = in.user == l.value
+	}
+	if matched {
+		return true, []Indicator{{Type: "account", Value: l.value}}
+	}
+	return false, nil
+}
+
+type integrityLeaf struct {
+	value string
+	rank  int
+}
+
+func (l integrityLeaf) eval(in *evalInput) (bool, []Indicator) {
+	if in.integrity != 0 && in.integrity >= l.rank {
+		return true, []Indicator{{Type: "integrity", Value: l.value}}
+	}
+	return false, nil
+}
+
+// allGroup holds when every child holds; an empty group always holds
+type allGroup struct{ children []conditionNode }
+
+func (g allGroup) eval(in *evalInput) (bool, []Indicator) {
+	var indicators []Indicator
+	for _, child := range g.children {
+		ok, found := child.eval(in)
+		if !ok {
+			return false, nil
+		}
+		indicators = append(indicators, found...)
+	}
+	return true, indicators
+}
+
+// anyGroup holds when at least one child holds; an empty group never holds.
+// Every child is evaluated so all matching leaves are reported.
+type anyGroup struct{ children []conditionNode }
+
+func (g anyGroup) eval(in *evalInput) (bool, []Indicator) {
+	matched := false
+	var indicators []Indicator
+	for _, child := range g.children {
+		if ok, found := child.eval(in); ok {
+			matched = true
+			indicators = append(indicators, found...)
+		}
+	}
+	return matched, indicators
+}
+
+// thresholdGroup holds when at least min children hold. Every child is
+// evaluated so all matching leaves are reported.
+type thresholdGroup struct {
+	children []conditionNode
+	min      int
+}
+
+func (g thresholdGroup) eval(in *evalInput) (bool, []Indicator) {
+	matched := 0
+	var indicators []Indicator
+	for _, child := range g.children {
+		if ok, found := child.eval(in); ok {
+			matched++
+			indicators = append(indicators, found...)
+		}
+	}
+	if matched < g.min {
+		return false, nil
+	}
+	return true, indicators
+}
+
+// noneGroup holds when no child holds; an empty group always holds. Leaves
+// matched under a none group are never reported as indicators.
+type noneGroup struct{ children []conditionNode }
+
+func (g noneGroup) eval(in *evalInput) (bool, []Indicator) {
+	for _, child := range g.children {
+		if ok, _ := child.eval(in); ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// leafHits returns the leaves under a condition that hold whether or not
+// the condition as a whole does, so a rule that missed shows how close it
+// came. Leaves holding under a none group are returned as blockers
+// instead, as they are what kept the rule from matching.
+func leafHits(node conditionNode, in *evalInput) (hits, blockers []Indicator) {
+	var children []conditionNode
+	switch g := node.(type) {
+	case allGroup:
+		children = g.children
+	case anyGroup:
+		children = g.children
+	case thresholdGroup:
+		children = g.children
+	case noneGroup:
+		for _, child := range g.children {
+			found, _ := leafHits(child, in)
+			blockers = append(blockers, found...)
+		}
+		return nil, blockers
+	default:
+		_, found := node.eval(in)
+		return found, nil
+	}
+	for _, child := range children {
+		found, blocked := leafHits(child, in)
+		hits = append(hits, found...)
+		blockers = append(blockers, blocked...)
+	}
+	return hits, blockers
+}
+
+// compileCondition validates a condition tree and compiles it
+func compileCondition(c Condition) (conditionNode, error) {
+	leaves := 0
+	for _, v := range []string{c.Arg, c.Path, c.Ancestor, c.Account, c.Integrity} {
+		if v != "" {
+			leaves++
+		}
+	}
+	isGroup := c.All != nil || c.Any != nil || c.None != nil
+
+	switch {
+	case leaves > 0 && isGroup:
+		return nil, fmt.Errorf("condition mixes a predicate with all/any/none groups")
+	case leaves > 1:
+		return nil, fmt.Errorf("condition sets more than one of arg, path, ancestor, account and integrity")
+	case c.Arg != "":
+		return argLeaf{value: strings.ToLower(c.Arg)}, nil
+	case c.Path != "" && isGlob(c.Path):
+		glob, err := compileGlob(c.Path)
+		if err != nil {
+			return nil, err
+		}
+		return pathLeaf{value: strings.ToLower(c.Path), glob: glob}, nil
+	case c.Path != "":
+		return pathLeaf{value: strings.ToLower(c.Path)}, nil
+	case c.Ancestor != "":
+		return ancestorLeaf{value: strings.ToLower(c.Ancestor)}, nil
+	case c.Account != "" && isGlob(c.Account):
+		glob, err := compileGlob(strings.ToLower(c.Account))
+		if err != nil {
+			return nil, err
+		}
+		return accountLeaf{value: strings.ToLower(c.Account), glob: glob}, nil
+	case c.Account != "":
+		return accountLeaf{value: strings.ToLower(c.Account)}, nil
+	case c.Integrity != "":
+		level := strings.ToLower(c.Integrity)
+		rank := integrityRank(level)
+		if rank == 0 {
+			return nil, fmt.Errorf("unknown integrity level %q", c.Integrity)
+		}
+		return integrityLeaf{value: level, rank: rank}, nil
+	case !isGroup:
+		return nil, fmt.Errorf("empty condition")
+	}
+
+	var groups []conditionNode
+	compileGroup := func(name string, children []Condition) ([]conditionNode, error) {
+		nodes := make([]conditionNode, 0, len(children))
+		for i, child := range children {
+			node, err := compileCondition(child)
+			if err != nil {
+				return nil, fmt.Errorf("%s[%d]: %v", name, i, err)
+			}
+			nodes = append(nodes, node)
+		}
+		return nodes, nil
+	}
+
+	if c.All != nil {
+		children, err := compileGroup("all", c.All)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, allGroup{children: children})
+	}
+	if c.Any != nil {
+		children, err := compileGroup("any", c.Any)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, anyGroup{children: children})
+	}
+	if c.None != nil {
+		children, err := compileGroup("none", c.None)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, noneGroup{children: children})
+	}
+
+	if len(groups) == 1 {
+		return groups[0], nil
+	}
+	return allGroup{children: groups}, nil
+}
+
+// suspiciousArgLeaves returns the distinct arguments of a rule's
+// SuspiciousArgs and ArgGroups, uncategorized ones first, then by category
+// name. An argument listed twice keeps its first category.
+func suspiciousArgLeaves(lolbin LOLBin) []argLeaf {
+	var leaves []argLeaf
+	seen := make(map[string]bool)
+	add := func(args []string, category string) {
+		for _, arg := range args {
+			arg = strings.ToLower(arg)
+			if !seen[arg] {
+				seen[arg] = true
+				leaves = append(leaves, argLeaf{value: arg, category: category})
+			}
+		}
+	}
+
+	add(lolbin.SuspiciousArgs, "")
+	categories := make([]string, 0, len(lolbin.ArgGroups))
+	for category := range lolbin.ArgGroups {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		add(lolbin.ArgGroups[category], strings.ToLower(category))
+	}
+	return leaves
+}
+
+// compileLOLBin builds the evaluable condition for a rule. The suspicious
+// arguments of SuspiciousArgs and ArgGroups together need MatchThreshold
+// distinct matches (any-of by default), combined with an explicit Condition
+// (if any) as alternatives.
+func compileLOLBin(lolbin LOLBin) (conditionNode, error) {
+	var alternatives []conditionNode
+
+	if leaves := suspiciousArgLeaves(lolbin); len(leaves) > 0 {
+		args := make([]conditionNode, 0, len(leaves))
+		for _, leaf := range leaves {
+			args = append(args, leaf)
+		}
+		if lolbin.MatchThreshold > 1 {
+			alternatives = append(alternatives, thresholdGroup{children: args, min: lolbin.MatchThreshold})
+		} else {
+			alternatives = append(alternatives, anyGroup{children: args})
+		}
+	}
+
+	if lolbin.Condition != nil {
+		node, err := compileCondition(*lolbin.Condition)
+		if err != nil {
+			return nil, fmt.Errorf("%s: condition: %v", lolbin.Name, err)
+		}
+		alternatives = append(alternatives, node)
+	}
+
+	if len(alternatives) == 1 {
+		return alternatives[0], nil
+	}
+	return anyGroup{children: alternatives}, nil
+}
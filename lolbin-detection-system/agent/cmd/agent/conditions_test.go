@@ -0,0 +1,233 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// indicatorValues lists the type:value of each indicator in order
+func indicatorValues(indicators []Indicator) []string {
+	var values []string
+	for _, indicator := range indicators {
+		values = append(values, indicator.Type+":"+indicator.Value)
+	}
+	return values
+}
+
+func TestConditionEval(t *testing.T) {
+	download := Condition{Any: []Condition{{Arg: "-urlcache"}, {Arg: "-verifyctl"}}}
+	tests := []struct {
+		name       string
+		cond       Condition
+		in         evalInput
+		matched    bool
+		indicators []string
+	}{
+		{
+			name:       "leaf",
+			cond:       Condition{Arg: "-URLCache"},
+			in:         evalInput{cmdLine: "certutil -urlcache -f http://a/b"},
+			matched:    true,
+			indicators: []string{"arg:-urlcache"},
+		},
+		{
+			name:       "any reports every match",
+			cond:       Condition{Any: []Condition{{Arg: "-urlcache"}, {Arg: "-split"}, {Arg: "-decode"}}},
+			in:         evalInput{cmdLine: "certutil -urlcache -split -f http://a/b"},
+			matched:    true,
+			indicators: []string{"arg:-urlcache", "arg:-split"},
+		},
+		{
+			name:    "any without a match",
+			cond:    download,
+			in:      evalInput{cmdLine: "certutil -hashfile a.exe sha256"},
+			matched: false,
+		},
+		{
+			name:       "all",
+			cond:       Condition{All: []Condition{download, {Path: `\users\public\`}}},
+			in:         evalInput{cmdLine: "certutil -verifyctl -f", path: `c:\users\public\certutil.exe`},
+			matched:    true,
+			indicators: []string{"arg:-verifyctl", "path:\\users\\public\\"},
+		},
+		{
+			name:    "all with one child missing reports nothing",
+			cond:    Condition{All: []Condition{download, {Path: `\users\public\`}}},
+			in:      evalInput{cmdLine: "certutil -verifyctl -f", path: `c:\windows\system32\certutil.exe`},
+			matched: false,
+		},
+		{
+			name:       "none clear",
+			cond:       Condition{Any: []Condition{{Arg: "/s"}}, None: []Condition{{Ancestor: "msiexec.exe"}}},
+			in:         evalInput{cmdLine: "regsvr32 /s a.dll", ancestry: []string{`c:\windows\explorer.exe`}},
+			matched:    true,
+			indicators: []string{"arg:/s"},
+		},
+		{
+			name:    "none blocks",
+			cond:    Condition{Any: []Condition{{Arg: "/s"}}, None: []Condition{{Ancestor: "msiexec.exe"}}},
+			in:      evalInput{cmdLine: "regsvr32 /s a.dll", ancestry: []string{`c:\windows\system32\msiexec.exe`}},
+			matched: false,
+		},
+		{
+			name: "nested any of all with none",
+			cond: Condition{Any: []Condition{
+				{All: []Condition{{Arg: "/ni"}, {Arg: "/s"}}},
+				{All: []Condition{{Arg: "/i:"}, {None: []Condition{{Arg: "/u"}}}}},
+			}},
+			in:         evalInput{cmdLine: "regsvr32 /s /ni /i:http://a/b scrobj.dll"},
+			matched:    true,
+			indicators: []string{"arg:/ni", "arg:/s", "arg:/i:"},
+		},
+		{
+			name: "nested none inside all blocks only its branch",
+			cond: Condition{Any: []Condition{
+				{All: []Condition{{Arg: "/ni"}, {Arg: "/s"}}},
+				{All: []Condition{{Arg: "/i:"}, {None: []Condition{{Arg: "/u"}}}}},
+			}},
+			in:      evalInput{cmdLine: "regsvr32 /u /i:http://a/b scrobj.dll"},
+			matched: false,
+		},
+		{
+			name:    "empty all holds",
+			cond:    Condition{All: []Condition{}},
+			in:      evalInput{cmdLine: "anything"},
+			matched: true,
+		},
+		{
+			name:    "empty any never holds",
+			cond:    Condition{Any: []Condition{}},
+			in:      evalInput{cmdLine: "anything"},
+			matched: false,
+		},
+		{
+			name:    "empty none holds",
+			cond:    Condition{None: []Condition{}},
+			in:      evalInput{cmdLine: "anything"},
+			matched: true,
+		},
+		{
+			name:    "empty any alongside all",
+			cond:    Condition{All: []Condition{{Arg: "-urlcache"}}, Any: []Condition{}},
+			in:      evalInput{cmdLine: "certutil -urlcache"},
+			matched: false,
+		},
+		{
+			name:       "integrity at or above",
+			cond:       Condition{All: []Condition{{Arg: "-enc"}, {Integrity: "High"}}},
+			in:         evalInput{cmdLine: "powershell -enc aaaa", integrity: integrityRank("system")},
+			matched:    true,
+			indicators: []string{"arg:-enc", "integrity:high"},
+		},
+		{
+			name:    "unknown integrity never matches",
+			cond:    Condition{Integrity: "low"},
+			in:      evalInput{cmdLine: "powershell"},
+			matched: false,
+		},
+		{
+			name:       "account class",
+			cond:       Condition{Account: "SYSTEM"},
+			in:         evalInput{account: AccountSystem, user: `nt authority\system`},
+			matched:    true,
+			indicators: []string{"account:system"},
+		},
+		{
+			name:       "account glob",
+			cond:       Condition{Account: `CORP\svc_*`},
+			in:         evalInput{account: AccountService, user: `corp\svc_backup`},
+			matched:    true,
+			indicators: []string{`account:corp\svc_*`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := compileCondition(tt.cond)
+			if err != nil {
+				t.Fatalf("compileCondition() = %v", err)
+			}
+			matched, indicators := node.eval(&tt.in)
+			if matched != tt.matched {
+				t.Errorf("matched = %v, want %v", matched, tt.matched)
+			}
+			if got := indicatorValues(indicators); !reflect.DeepEqual(got, tt.indicators) {
+				t.Errorf("indicators = %q, want %q", got, tt.indicators)
+			}
+		})
+	}
+}
+
+func TestCompileConditionErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cond Condition
+		err  string
+	}{
+		{"empty", Condition{}, "empty condition"},
+		{"two predicates", Condition{Arg: "/s", Path: `\temp\`}, "more than one"},
+		{"predicate and group", Condition{Arg: "/s", Any: []Condition{{Arg: "/i:"}}}, "mixes a predicate"},
+		{"bad integrity", Condition{Integrity: "root"}, "unknown integrity level"},
+		{"nested error names its place", Condition{All: []Condition{{Arg: "/s"}, {Any: []Condition{{}}}}}, "all[1]: any[0]: empty condition"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileCondition(tt.cond)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("compileCondition() = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLeafHits(t *testing.T) {
+	cond := Condition{
+		All:  []Condition{{Arg: "/i:"}, {Arg: "scrobj.dll"}},
+		None: []Condition{{Arg: "/u"}, {Ancestor: "msiexec.exe"}},
+	}
+	node, err := compileCondition(cond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		in       evalInput
+		hits     []string
+		blockers []string
+	}{
+		{"near miss", evalInput{cmdLine: "regsvr32 /i:http://a/b"}, []string{"arg:/i:"}, nil},
+		{"blocked", evalInput{cmdLine: "regsvr32 /u /i:http://a/b scrobj.dll", ancestry: []string{`c:\windows\system32\msiexec.exe`}},
+			[]string{"arg:/i:", "arg:scrobj.dll"}, []string{"arg:/u", "ancestor:msiexec.exe"}},
+		{"nothing", evalInput{cmdLine: "regsvr32 a.dll"}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits, blockers := leafHits(node, &tt.in)
+			if got := indicatorValues(hits); !reflect.DeepEqual(got, tt.hits) {
+				t.Errorf("hits = %q, want %q", got, tt.hits)
+			}
+			if got := indicatorValues(blockers); !reflect.DeepEqual(got, tt.blockers) {
+				t.Errorf("blockers = %q, want %q", got, tt.blockers)
+			}
+		})
+	}
+}
+
+func TestCompileLOLBinThreshold(t *testing.T) {
+	node, err := compileLOLBin(LOLBin{
+		Name:           "tool.exe",
+		SuspiciousArgs: []string{"-a"},
+		ArgGroups:      map[string][]string{"download": {"-b", "-A"}},
+		MatchThreshold: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched, _ := node.eval(&evalInput{cmdLine: "tool -a"}); matched {
+		t.Error("one distinct argument met a threshold of 2")
+	}
+	matched, indicators := node.eval(&evalInput{cmdLine: "tool -a -b"})
+	if !matched || len(indicators) != 2 || indicators[1].Category != "download" {
+		t.Errorf("eval() = %v, %+v, want both arguments with -b in download", matched, indicators)
+	}
+}
@@ -0,0 +1,43 @@
+// confidence.go
+// Confidence of detections. Severity says how bad a detection is if it's a
+// true positive; confidence says how likely it is to be one, as a
+// percentage. An event's confidence is that of its most certain finding.
+//
+// The scoring model:
+//   - A rule match takes the rule's own confidence when it sets one.
+//     Otherwise a suspicious argument matching whole command-line tokens is
+//     high confidence, while an argument found inside a longer token, or a
+//     match on paths, ancestry or the user alone, is medium.
+//   - Each detector scores its findings: structural evidence such as a
+//     parsed persistence target or a credential store path is high,
+//     context such as locations or signatures medium, and statistical hits
+//     such as entropy, length or rarity low.
+
+package main
+
+// Default confidences of the built-in detections
+const (
+	ConfidenceLow    = 30
+	ConfidenceMedium = 60
+	ConfidenceHigh   = 90
+)
+
+// matchConfidence scores a rule match from the indicators it produced
+func matchConfidence(lolbin LOLBin, indicators []Indicator) int {
+	if lolbin.Confidence != 0 {
+		return lolbin.Confidence
+	}
+	for _, indicator := range indicators {
+		if indicator.Type == "arg" && indicator.Exact {
+			return ConfidenceHigh
+		}
+	}
+	return ConfidenceMedium
+}
+
+// raiseConfidence lifts the event's confidence to at least confidence
+func raiseConfidence(event *ProcessEvent, confidence int) {
+	if confidence > event.Confidence {
+		event.Confidence = confidence
+	}
+}
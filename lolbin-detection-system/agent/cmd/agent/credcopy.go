@@ -0,0 +1,170 @@
+// credcopy.go
+// Detection of credential store theft by file copy. The AD database
+// ntds.dit and the SAM, SYSTEM and SECURITY hives are locked while Windows
+// runs, so they are copied from a volume shadow copy, with esentutl /vss
+// or with a plain copy tool reading a HarddiskVolumeShadowCopy path.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CredentialCopy describes a copy of a credential store
+type CredentialCopy struct {
+	Tool        string `json:"tool"`
+	Source      string `json:"source"`
+	Destination string `json:"destination,omitempty"`
+	// Store names the credential store copied, e.g. ntds.dit or SAM
+	Store string `json:"store"`
+	// VSS is set when esentutl was asked to copy through a shadow copy
+	VSS bool `json:"vss,omitempty"`
+	// ShadowCopy is set when the source is a shadow copy device path
+	ShadowCopy bool `json:"shadow_copy,omitempty"`
+}
+
+// credentialStore is a file holding credentials or the keys to them
+type credentialStore struct {
+	// suffix is the lowercased end of the path, from a backslash on
+	suffix   string
+	name     string
+	severity Severity
+}
+
+// credentialStores are matched against the end of copy source paths,
+// including the RegBack copies of the hives
+var credentialStores = []credentialStore{
+	{suffix: `\ntds.dit`, name: "ntds.dit", severity: SeverityCritical},
+	{suffix: `\config\sam`, name: "SAM", severity: SeverityCritical},
+	{suffix: `\regback\sam`, name: "SAM", severity: SeverityCritical},
+	{suffix: `\config\system`, name: "SYSTEM", severity: SeverityHigh},
+	{suffix: `\regback\system`, name: "SYSTEM", severity: SeverityHigh},
+	{suffix: `\config\security`, name: "SECURITY", severity: SeverityHigh},
+	{suffix: `\regback\security`, name: "SECURITY", severity: SeverityHigh},
+}
+
+// copyTools are the executables whose source paths are checked; cmd.exe
+// stands for its built-in copy
+var copyTools = map[string]bool{"esentutl.exe": true, "xcopy.exe": true, "robocopy.exe": true, "cmd.exe": true}
+
+// matchCredentialStore returns the credential store a path points at
+func matchCredentialStore(path string) (credentialStore, bool) {
+	path = `\` + strings.TrimRight(strings.ToLower(strings.Trim(path, `"`)), `\`)
+	for _, store := range credentialStores {
+		if strings.HasSuffix(path, store.suffix) {
+			return store, true
+		}
+	}
+	return credentialStore{}, false
+}
+
+// copyOperands splits a copy command line into its non-option arguments.
+// Arguments with spaces, such as the quoted command of cmd /c "copy a b",
+// are split again.
+func copyOperands(cmdLine string) []string {
+	var operands []string
+	args := splitCommandLine(cmdLine)
+	for _, arg := range args[min(1, len(args)):] {
+		if strings.ContainsAny(arg, " \t") {
+			operands = append(operands, copyOperands("cmd "+arg)...)
+			continue
+		}
+		if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, "-") {
+			continue
+		}
+		operands = append(operands, arg)
+	}
+	return operands
+}
+
+// parseEsentutlCopy extracts the /y source, /d destination and /vss option
+// of an esentutl file copy. Options may sit between /y and its source, as
+// in esentutl /y /vss ntds.dit.
+func parseEsentutlCopy(cmdLine string) (*CredentialCopy, bool) {
+	args := splitCommandLine(cmdLine)
+	theft := &CredentialCopy{Tool: "esentutl.exe"}
+	var pending *string
+	for _, arg := range args[min(1, len(args)):] {
+		switch strings.ToLower(arg) {
+		case "/y", "-y":
+			pending = &theft.Source
+		case "/d", "-d":
+			pending = &theft.Destination
+		case "/vss", "-vss", "/vssrec", "-vssrec":
+			theft.VSS = true
+		default:
+			if pending != nil && !strings.HasPrefix(arg, "/") && !strings.HasPrefix(arg, "-") {
+				*pending = arg
+				pending = nil
+			}
+		}
+	}
+	return theft, theft.Source != ""
+}
+
+// findCredentialCopy looks for a credential store among a copy tool's
+// source paths. The destination is taken to be the next operand; robocopy
+// names a source directory, a destination directory and then the files.
+func findCredentialCopy(execName, cmdLine string) (*CredentialCopy, credentialStore, bool) {
+	if execName == "esentutl.exe" {
+		theft, ok := parseEsentutlCopy(cmdLine)
+		if !ok {
+			return nil, credentialStore{}, false
+		}
+		store, ok := matchCredentialStore(theft.Source)
+		return theft, store, ok
+	}
+
+	operands := copyOperands(cmdLine)
+	if execName == "robocopy.exe" && len(operands) > 2 {
+		for _, file := range operands[2:] {
+			source := strings.TrimRight(operands[0], `\`) + `\` + file
+			if store, ok := matchCredentialStore(source); ok {
+				return &CredentialCopy{Tool: execName, Source: source, Destination: operands[1]}, store, true
+			}
+		}
+		return nil, credentialStore{}, false
+	}
+	for i, operand := range operands {
+		store, ok := matchCredentialStore(operand)
+		if !ok {
+			continue
+		}
+		theft := &CredentialCopy{Tool: execName, Source: operand}
+		if i+1 < len(operands) {
+			theft.Destination = operands[i+1]
+		}
+		return theft, store, true
+	}
+	return nil, credentialStore{}, false
+}
+
+// checkCredentialCopy flags copy tools reading ntds.dit or the SAM, SYSTEM
+// or SECURITY hives, critical for ntds.dit and SAM
+func checkCredentialCopy(ctx *DetectionContext, event *ProcessEvent) {
+	if !copyTools[ctx.ExecName] {
+		return
+	}
+	theft, store, ok := findCredentialCopy(ctx.ExecName, event.CommandLine)
+	if !ok {
+		return
+	}
+	theft.Store = store.name
+	theft.ShadowCopy = strings.Contains(strings.ToLower(theft.Source), "harddiskvolumeshadowcopy")
+	event.CredentialCopy = theft
+
+	event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "credential_store", Value: theft.Source, Category: "credential-access"})
+	reason := fmt.Sprintf("%s copies %s from %s", ctx.ExecName, store.name, theft.Source)
+	if theft.Destination != "" {
+		reason += " to " + theft.Destination
+	}
+	if theft.VSS || theft.ShadowCopy {
+		reason += " through a volume shadow copy"
+	}
+	addFinding(event, store.severity, ConfidenceHigh, reason)
+	if event.Severity < store.severity {
+		event.Severity = store.severity
+	}
+	addTags(event, []string{"credential-access"})
+}
@@ -0,0 +1,63 @@
+// csv.go
+// Rendering of events as CSV for triage in a spreadsheet. Command lines are
+// attacker-controlled, so cells a spreadsheet would evaluate as a formula
+// are defused.
+
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvHeader names the columns of the CSV export
+var csvHeader = []string{"timestamp", "pid", "ppid", "user", "executable", "command_line", "suspicious", "severity", "reason"}
+
+// csvCell defuses a value a spreadsheet would read as a formula by
+// prefixing it with a quote
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// csvRecord renders an event as a row of the CSV export
+func csvRecord(event ProcessEvent) []string {
+	severity := ""
+	if event.Severity != SeverityNone {
+		severity = event.Severity.String()
+	}
+	return []string{
+		event.Timestamp.Format(time.RFC3339Nano),
+		strconv.FormatUint(uint64(event.ProcessID), 10),
+		strconv.FormatUint(uint64(event.ParentID), 10),
+		csvCell(event.User),
+		csvCell(event.ExecutablePath),
+		csvCell(event.CommandLine),
+		strconv.FormatBool(event.Suspicious),
+		severity,
+		csvCell(event.Reason),
+	}
+}
+
+// streamEventsCSV writes the page of events passing the filter as CSV with
+// a header row. Rows are written as they are read, so the export never
+// holds more than one event.
+func streamEventsCSV(w http.ResponseWriter, filter eventFilter, page eventPage) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="events.csv"`)
+
+	writer := csv.NewWriter(w)
+	writer.Write(csvHeader)
+	eachEvent(filter, page, func(event ProcessEvent) error {
+		writer.Write(csvRecord(event))
+		// Surfaces a write error of an earlier, flushed row, e.g. when the
+		// client went away
+		return writer.Error()
+	})
+	writer.Flush()
+}
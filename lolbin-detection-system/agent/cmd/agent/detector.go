@@ -0,0 +1,367 @@
+// detector.go
+// The detection chain: every check run on a process event is a Detector,
+// evaluated in order. The chain runs on several events at once; the
+// detectors relying on state earlier events left behind run after it, one
+// event at a time in arrival order. Builds of the agent can append their
+// own detectors with RegisterDetector from an init function in a separate
+// file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DetectionContext is shared by the detectors evaluating one event
+type DetectionContext struct {
+	// Rules is the rule set pinned for the whole evaluation
+	Rules *RuleSet
+	// ExecName is the lowercased image name of the executable
+	ExecName string
+	// Live is set for real process starts. Ad-hoc evaluations leave it
+	// unset so they don't train state such as the seen-set or baselines.
+	Live bool
+}
+
+// Detector is one stage of the detection chain. Evaluate records what it
+// finds on the event, marking it suspicious with addFinding and attaching
+// its indicators.
+type Detector interface {
+	Name() string
+	Evaluate(ctx *DetectionContext, event *ProcessEvent)
+}
+
+// detectorFunc adapts a function to the Detector interface
+type detectorFunc struct {
+	name string
+	fn   func(ctx *DetectionContext, event *ProcessEvent)
+}
+
+func (d detectorFunc) Name() string {
+	return d.name
+}
+
+func (d detectorFunc) Evaluate(ctx *DetectionContext, event *ProcessEvent) {
+	d.fn(ctx, event)
+}
+
+// lolbinOnly wraps a check that only applies to events matching a rule
+func lolbinOnly(check func(ctx *DetectionContext, event *ProcessEvent)) func(*DetectionContext, *ProcessEvent) {
+	return func(ctx *DetectionContext, event *ProcessEvent) {
+		if event.IsLOLBin {
+			check(ctx, event)
+		}
+	}
+}
+
+// liveOnly wraps a check that only applies to real process starts
+func liveOnly(check func(event *ProcessEvent)) func(*DetectionContext, *ProcessEvent) {
+	return func(ctx *DetectionContext, event *ProcessEvent) {
+		if ctx.Live {
+			check(event)
+		}
+	}
+}
+
+// detectors is the detection chain in evaluation order
+var detectors = []Detector{
+	detectorFunc{"lolbin_rules", func(ctx *DetectionContext, event *ProcessEvent) {
+		// A renamed LOLBin is also judged by the rules of its original name
+		matches, name := ctx.Rules.matching(ctx.ExecName), ctx.ExecName
+		if original := event.OriginalFilename; original != "" && !sameImage(original, ctx.ExecName) {
+			if originalMatches := ctx.Rules.matching(original); len(originalMatches) > 0 {
+				if len(matches) == 0 {
+					name = original
+				}
+				matches = mergeRuleEntries(matches, originalMatches)
+			}
+		}
+		if len(matches) > 0 {
+			applyLOLBinRules(event, ctx.Rules, name, matches)
+		}
+	}},
+	// cmd.exe commands rebuilt from environment variable substrings and
+	// set/call chains
+	detectorFunc{"cmd_obfuscation", checkCmdObfuscation},
+	// Every execution of a watchlisted binary, LOLBin or not
+	detectorFunc{"watchlist", checkWatchlist},
+	// Binaries whose version resource names another original filename
+	detectorFunc{"renamed_binary", checkRenamedBinary},
+	// Event log clearing, the Security and Sysmon logs above all
+	detectorFunc{"log_clearing", checkLogClearing},
+	// Process memory dumps through comsvcs.dll, LSASS above all
+	detectorFunc{"comsvcs_minidump", checkMiniDump},
+	// What mshta inline scripts do, and HTAs run from writable places
+	detectorFunc{"mshta_script", checkMshta},
+	// Squiblydoo scriptlet loads through regsvr32, remote ones above all
+	detectorFunc{"regsvr32_scriptlet", checkRegsvr32},
+	// The commands forfiles, pcalua and conhost start on a proxy's behalf
+	detectorFunc{"proxy_execution", checkProxyExecution},
+	// COM classes instantiated by verclsid, xwizard and openwith, judged by
+	// their server
+	detectorFunc{"com_proxy", checkCOMProxy},
+	// PowerShell download cradles, with string obfuscation folded
+	detectorFunc{"powershell_cradle", checkPowerShellCradle},
+	// BITS job notification commands and resumed flagged jobs, from
+	// bitsadmin and the deobfuscated PowerShell
+	detectorFunc{"bits_jobs", checkBitsJobs},
+	// AMSI, ETW and Defender tampering, after the cradle deobfuscation
+	detectorFunc{"defense_tampering", checkDefenseTampering},
+	// URLs and output files of curl, certreq and the other download tools
+	detectorFunc{"download", checkDownload},
+	// Payloads staged into alternate data streams and user-writable
+	// directories by findstr, expand, extrac32, replace and print
+	detectorFunc{"file_staging", checkStaging},
+	// What a created or changed scheduled task will run
+	detectorFunc{"scheduled_task", checkSchtasks},
+	// Registry autostart writes and credential hive dumps through reg.exe
+	detectorFunc{"registry", checkRegistry},
+	// netsh helper DLLs and packet captures
+	detectorFunc{"netsh", checkNetsh},
+	// DNS server plugin DLLs configured through dnscmd
+	detectorFunc{"dns_plugin", checkDNSCmd},
+	// Copies of ntds.dit and the credential hives, by esentutl or any copy
+	// tool
+	detectorFunc{"credential_copy", checkCredentialCopy},
+	// AD database dumps through ntdsutil IFM media
+	detectorFunc{"ntdsutil_ifm", checkNTDSUtil},
+	// UAC bypasses through auto-elevating binaries and planted HKCU
+	// handlers
+	detectorFunc{"uac_bypass", checkUACBypass},
+	// Help files opened from the internet, shares and download directories
+	detectorFunc{"chm_target", checkHH},
+	// rundll32 exports outside the known-good table
+	detectorFunc{"rundll32_export", checkRundll32Export},
+	// Control panel items loaded from outside System32
+	detectorFunc{"control_panel", checkControlPanel},
+	// DLLs registered through odbcconf actions and response files
+	detectorFunc{"odbcconf", checkODBCConf},
+	// Scripts judged by location, naming and mark of the web
+	detectorFunc{"script_host", checkScriptHost},
+	// An encoded blob is suspicious on its own, and makes a matched
+	// argument worse
+	detectorFunc{"high_entropy", lolbinOnly(func(ctx *DetectionContext, event *ProcessEvent) {
+		if event.HighEntropy {
+			addFinding(event, SeverityMedium, ConfidenceLow, fmt.Sprintf("High-entropy argument in %s command line (%.2f bits/char)",
+				ctx.ExecName, event.Entropy))
+		}
+	})},
+	// Generic length and argument-entropy heuristics
+	detectorFunc{"cmdline_heuristics", lolbinOnly(func(ctx *DetectionContext, event *ProcessEvent) {
+		checkCommandLineHeuristics(event, ctx.Rules.LOLBins[event.Rule])
+	})},
+	// Authenticode signature, and the rule's requirement on it
+	detectorFunc{"signature", lolbinOnly(func(ctx *DetectionContext, event *ProcessEvent) {
+		checkSignature(event, ctx.Rules.LOLBins[event.Rule])
+	})},
+	// Payloads and binaries pulled straight from remote shares
+	detectorFunc{"unc_paths", lolbinOnly(func(ctx *DetectionContext, event *ProcessEvent) {
+		checkUNCPaths(event)
+	})},
+	// Executables pretending to be something else, LOLBin or not
+	detectorFunc{"path_masquerade", checkMasquerading},
+	// Known-bad infrastructure trumps everything else
+	detectorFunc{"blocklist", lolbinOnly(func(ctx *DetectionContext, event *ProcessEvent) {
+		checkBlocklist(event)
+	})},
+	// Detections spanning several binaries and their parent chain, unless
+	// a terminal rule already settled the event
+	detectorFunc{"composite_rules", func(ctx *DetectionContext, event *ProcessEvent) {
+		if event.TerminatedBy == "" {
+			checkCompositeRules(event, ctx.ExecName)
+		}
+	}},
+	detectorFunc{"cmstp_inf", liveOnly(checkCMSTP)},
+	detectorFunc{"msbuild_project", liveOnly(checkMSBuild)},
+	detectorFunc{"assembly_uninstall", liveOnly(checkAssemblyUninstall)},
+}
+
+// orderedDetectors run after the chain, one event at a time in the order
+// events arrived, as they rely on state earlier events left behind: the
+// seen-set, the baselines and the files downloads and decodes dropped
+var orderedDetectors = []Detector{
+	detectorFunc{"first_seen", liveOnly(checkFirstSeen)},
+	detectorFunc{"baseline", liveOnly(checkBaseline)},
+	detectorFunc{"download_chain", liveOnly(checkDownloadChain)},
+	detectorFunc{"decoded_artifact", liveOnly(checkDecodeArtifact)},
+	// Weighs every detection, so it runs last
+	detectorFunc{"off_hours", func(ctx *DetectionContext, event *ProcessEvent) {
+		checkOffHours(event)
+	}},
+}
+
+// maxNestingDepth bounds how deep command lines embedded in other command
+// lines, scripts or files are evaluated
+const maxNestingDepth = 3
+
+// NestedCommand is a command line embedded in a process's command line,
+// script or files, with its own detection result
+type NestedCommand struct {
+	CommandLine string `json:"command_line"`
+	// Rule, Severity and Reason are set when the command line itself is
+	// flagged by a LOLBin rule
+	Rule     string   `json:"rule,omitempty"`
+	Severity Severity `json:"severity,omitempty"`
+	Reason   string   `json:"reason,omitempty"`
+}
+
+// evaluateEmbedded runs detection on an embedded command line. It is
+// checkForLOLBin, assigned in init as the detection chain would otherwise
+// refer to itself.
+var evaluateEmbedded func(event ProcessEvent, live bool) ProcessEvent
+
+func init() {
+	evaluateEmbedded = checkForLOLBin
+}
+
+// evaluateNested runs an embedded command line through detection as if the
+// parent event's process had started it
+func evaluateNested(cmdLine string, parent *ProcessEvent) NestedCommand {
+	command := NestedCommand{CommandLine: cmdLine}
+	if result, ok := evaluateNestedEvent(cmdLine, parent); ok && result.Suspicious {
+		command.Rule = result.Rule
+		command.Severity = result.Severity
+		command.Reason = result.Reason
+	}
+	return command
+}
+
+// evaluateNestedEvent runs an embedded command line through detection and
+// returns the full result. Nothing is evaluated beyond maxNestingDepth
+// levels, nor a command line that already appeared further up, so
+// commands embedding themselves can't loop.
+func evaluateNestedEvent(cmdLine string, parent *ProcessEvent) (ProcessEvent, bool) {
+	args := splitCommandLine(cmdLine)
+	if len(args) == 0 || parent.nestingDepth >= maxNestingDepth {
+		return ProcessEvent{}, false
+	}
+	chain := append(parent.nestingChain[:len(parent.nestingChain):len(parent.nestingChain)], normalizeCommandLine(parent.CommandLine))
+	if containsString(chain, normalizeCommandLine(cmdLine)) {
+		return ProcessEvent{}, false
+	}
+	executable := args[0]
+	if filepath.Ext(executable) == "" {
+		executable += ".exe"
+	}
+
+	result := evaluateEmbedded(ProcessEvent{
+		Timestamp:      time.Now(),
+		CommandLine:    cmdLine,
+		ExecutablePath: executable,
+		ParentID:       parent.ProcessID,
+		ParentImage:    parent.ExecutablePath,
+		User:           parent.User,
+		AccountType:    parent.AccountType,
+		IntegrityLevel: parent.IntegrityLevel,
+		nestingDepth:   parent.nestingDepth + 1,
+		nestingChain:   chain,
+	}, false)
+	return result, true
+}
+
+// normalizeCommandLine brings a command line into a form that compares
+// equal however it was quoted, spaced or cased
+func normalizeCommandLine(cmdLine string) string {
+	return strings.ToLower(joinCommandLine(splitCommandLine(cmdLine)))
+}
+
+// RegisterDetector appends a detector to the chain, which evaluates several
+// events at once. It must be called before the agent starts processing
+// events, e.g. from an init function.
+func RegisterDetector(d Detector) {
+	detectors = append(detectors, d)
+}
+
+// detectorCounters accumulates the evaluation statistics of one detector
+type detectorCounters struct {
+	evaluations atomic.Uint64
+	nanos       atomic.Int64
+	maxNanos    atomic.Int64
+	panics      atomic.Uint64
+}
+
+// DetectorStats is the API representation of a detector's counters
+type DetectorStats struct {
+	Evaluations uint64  `json:"evaluations"`
+	TotalMillis float64 `json:"total_ms"`
+	AvgMicros   float64 `json:"avg_us"`
+	MaxMicros   float64 `json:"max_us"`
+	Panics      uint64  `json:"panics"`
+}
+
+// detectorStats maps a detector name to its *detectorCounters
+var detectorStats sync.Map
+
+// detectorCountersFor returns the counters of a detector, creating them on
+// first use
+func detectorCountersFor(name string) *detectorCounters {
+	if c, ok := detectorStats.Load(name); ok {
+		return c.(*detectorCounters)
+	}
+	c, _ := detectorStats.LoadOrStore(name, &detectorCounters{})
+	return c.(*detectorCounters)
+}
+
+// record adds one evaluation that took d
+func (c *detectorCounters) record(d time.Duration) {
+	c.evaluations.Add(1)
+	c.nanos.Add(int64(d))
+	for {
+		max := c.maxNanos.Load()
+		if int64(d) <= max || c.maxNanos.CompareAndSwap(max, int64(d)) {
+			return
+		}
+	}
+}
+
+// allDetectorStats returns the counters of every detector that has run
+func allDetectorStats() map[string]DetectorStats {
+	result := make(map[string]DetectorStats)
+	detectorStats.Range(func(key, value interface{}) bool {
+		c := value.(*detectorCounters)
+		stats := DetectorStats{
+			Evaluations: c.evaluations.Load(),
+			TotalMillis: float64(c.nanos.Load()) / float64(time.Millisecond),
+			MaxMicros:   float64(c.maxNanos.Load()) / float64(time.Microsecond),
+			Panics:      c.panics.Load(),
+		}
+		if stats.Evaluations > 0 {
+			stats.AvgMicros = float64(c.nanos.Load()) / float64(stats.Evaluations) / float64(time.Microsecond)
+		}
+		result[key.(string)] = stats
+		return true
+	})
+	return result
+}
+
+// runDetectors evaluates a list of detectors on an event
+func runDetectors(ctx *DetectionContext, event *ProcessEvent, chain []Detector) {
+	for _, d := range chain {
+		runDetector(d, ctx, event)
+	}
+}
+
+// runDetector evaluates one detector, timing it. A panicking detector is
+// logged and its partial changes to the event are discarded, so one broken
+// detector can't take down the pipeline.
+func runDetector(d Detector, ctx *DetectionContext, event *ProcessEvent) {
+	counters := detectorCountersFor(d.Name())
+	saved := *event
+	start := time.Now()
+	defer func() {
+		counters.record(time.Since(start))
+		if r := recover(); r != nil {
+			counters.panics.Add(1)
+			*event = saved
+			logError(1, "Detector %s panicked on %s: %v\n%s", d.Name(), event.ExecutablePath, r, debug.Stack())
+		}
+	}()
+
+	d.Evaluate(ctx, event)
+}
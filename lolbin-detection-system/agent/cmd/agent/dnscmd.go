@@ -0,0 +1,144 @@
+// dnscmd.go
+// Detection of DNS server plugin DLL persistence. dnscmd /config
+// /serverlevelplugindll makes the DNS Server service load a DLL, as SYSTEM
+// and on every service start, from any local or UNC path. The DLL is
+// inspected when readable, and the event notes whether this host runs the
+// DNS Server service at all, as the setting only takes effect there.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/windows"
+)
+
+// dnsServerService is the service name of the Windows DNS Server
+const dnsServerService = "DNS"
+
+// DNSPluginDLL describes the plugin DLL a dnscmd event configures
+type DNSPluginDLL struct {
+	BinaryInspection
+	// Remote is set for DLLs on a share
+	Remote bool `json:"remote,omitempty"`
+	// Reachable is whether the DLL could be found, for real process starts
+	Reachable *bool `json:"reachable,omitempty"`
+	// DNSServer is whether the DNS Server service exists on this host
+	DNSServer *bool `json:"dns_server,omitempty"`
+}
+
+var (
+	dnsServerOnce      sync.Once
+	dnsServerInstalled bool
+)
+
+// hasDNSServerService reports whether the DNS Server service is installed.
+// Roles rarely change while the agent runs, so the answer is cached.
+func hasDNSServerService() bool {
+	dnsServerOnce.Do(func() {
+		manager, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_CONNECT)
+		if err != nil {
+			return
+		}
+		defer windows.CloseServiceHandle(manager)
+		name, _ := windows.UTF16PtrFromString(dnsServerService)
+		service, err := windows.OpenService(manager, name, windows.SERVICE_QUERY_STATUS)
+		if err != nil {
+			return
+		}
+		windows.CloseServiceHandle(service)
+		dnsServerInstalled = true
+	})
+	return dnsServerInstalled
+}
+
+// parseDNSPlugin returns the value of dnscmd's /serverlevelplugindll
+// option, which may be given with a slash or dash anywhere on the command
+// line. An empty value removes the plugin.
+func parseDNSPlugin(cmdLine string) (string, bool) {
+	args := splitCommandLine(cmdLine)
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "/") && !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if !strings.EqualFold(arg[1:], "serverlevelplugindll") {
+			continue
+		}
+		if i+1 < len(args) && !strings.HasPrefix(args[i+1], "/") {
+			return args[i+1], true
+		}
+		return "", true
+	}
+	return "", false
+}
+
+// checkDNSCmd flags dnscmd configuring a DNS server plugin DLL as critical,
+// inspecting the DLL and noting whether this host is a DNS server. Files
+// and services are only looked at for real process starts.
+func checkDNSCmd(ctx *DetectionContext, event *ProcessEvent) {
+	if ctx.ExecName != "dnscmd.exe" {
+		return
+	}
+	dll, ok := parseDNSPlugin(event.CommandLine)
+	if !ok {
+		return
+	}
+	if dll == "" {
+		addFinding(event, SeverityMedium, ConfidenceMedium, "dnscmd removes the DNS server plugin DLL")
+		return
+	}
+
+	path := expandWindowsEnv(strings.Trim(dll, `"`))
+	plugin := &DNSPluginDLL{
+		BinaryInspection: BinaryInspection{Path: path},
+		Remote:           strings.HasPrefix(path, `\\`),
+	}
+	if ctx.Live {
+		_, err := os.Stat(path)
+		reachable := err == nil
+		plugin.Reachable = &reachable
+		if reachable {
+			plugin.BinaryInspection = inspectBinary(path, config.MaxArtifactSize)
+		}
+		installed := hasDNSServerService()
+		plugin.DNSServer = &installed
+	}
+	event.DNSPlugin = plugin
+
+	event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "dns_plugin_dll", Value: path, Category: "persistence"})
+	if plugin.Remote {
+		for _, ioc := range extractIOCs(path) {
+			if !hasIOC(event, ioc.Value) {
+				event.IOCs = append(event.IOCs, ioc)
+			}
+		}
+	}
+	for _, ioc := range []IOC{{Type: IOCFile, Value: path}, {Type: IOCSHA256, Value: plugin.SHA256}} {
+		if ioc.Value != "" && !hasIOC(event, ioc.Value) {
+			event.IOCs = append(event.IOCs, ioc)
+		}
+	}
+
+	reason := fmt.Sprintf("dnscmd sets %s as DNS server plugin DLL, loaded as SYSTEM by the DNS Server service", path)
+	if plugin.Remote {
+		reason += " from a share"
+	}
+	if plugin.SHA256 != "" {
+		reason += fmt.Sprintf(" (sha256 %s)", plugin.SHA256)
+	}
+	if plugin.DNSServer != nil && !*plugin.DNSServer {
+		reason += "; the DNS Server service isn't installed here"
+	}
+	addFinding(event, SeverityCritical, ConfidenceHigh, reason)
+	if event.Severity < SeverityCritical {
+		event.Severity = SeverityCritical
+	}
+	if plugin.SignatureStatus != "" && !plugin.Signed {
+		addFinding(event, SeverityCritical, ConfidenceHigh, fmt.Sprintf("DNS server plugin DLL %s is unsigned", path))
+	}
+	addTags(event, []string{"persistence", "privilege-escalation"})
+}
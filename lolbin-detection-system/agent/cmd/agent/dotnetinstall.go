@@ -0,0 +1,134 @@
+// dotnetinstall.go
+// Detection of code execution through the .NET installer tools.
+// InstallUtil, RegAsm and RegSvcs are signed Microsoft binaries that load
+// an assembly and call its installer or unregistration methods, so
+// installutil.exe /logfile= /LogToConsole=false /U payload.dll runs
+// attacker code without the assembly ever being started itself.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dotnetInstallTools are the image names of the .NET installer tools
+var dotnetInstallTools = map[string]bool{"installutil.exe": true, "regasm.exe": true, "regsvcs.exe": true}
+
+// uninstallOptions are the options that make the tools run an assembly's
+// uninstall or unregistration code
+var uninstallOptions = map[string]bool{"u": true, "uninstall": true, "unregister": true}
+
+// dotnetUninstallCondition matches the installer tools' uninstall options
+// (/u, /uninstall, /unregister) together with a DLL assembly
+var dotnetUninstallCondition = &Condition{All: []Condition{
+	{Any: []Condition{{Arg: "/u"}, {Arg: "-u"}}},
+	{Arg: ".dll"},
+}}
+
+// trustedAssemblyDirs are the environment variables of the directories
+// legitimate assemblies are installed from
+var trustedAssemblyDirs = []string{"ProgramFiles", "ProgramFiles(x86)", "SystemRoot"}
+
+// AssemblyInspection describes the assembly a .NET installer tool
+// uninstalls
+type AssemblyInspection struct {
+	BinaryInspection
+	// Trusted is set when the assembly is under Program Files or Windows
+	Trusted bool `json:"trusted"`
+}
+
+// uninstallAssemblyArg returns the assembly argument of an installer tool
+// command line that asks for the uninstall methods to run
+func uninstallAssemblyArg(cmdLine string) (string, bool) {
+	args := splitCommandLine(cmdLine)
+	uninstall := false
+	assembly := ""
+	for _, arg := range args[min(1, len(args)):] {
+		if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, "-") {
+			option, _, _ := strings.Cut(strings.ToLower(arg[1:]), "=")
+			option, _, _ = strings.Cut(option, ":")
+			if uninstallOptions[option] {
+				uninstall = true
+			}
+			continue
+		}
+		if assembly == "" {
+			assembly = arg
+		}
+	}
+	return assembly, uninstall && assembly != ""
+}
+
+// isTrustedAssemblyPath reports whether path is under Program Files or the
+// Windows directory
+func isTrustedAssemblyPath(path string) bool {
+	path = normalizeDropPath(path)
+	for _, variable := range trustedAssemblyDirs {
+		dir := os.Getenv(variable)
+		if dir == "" {
+			continue
+		}
+		if strings.HasPrefix(path, normalizeDropPath(dir)+`\`) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAssemblyUninstall flags .NET installer tools running an assembly's
+// uninstall methods, weighing assemblies from outside Program Files and
+// Windows and unsigned ones heavier. Only called for real process starts,
+// as the assembly is on this host.
+func checkAssemblyUninstall(event *ProcessEvent) {
+	name := imageName(event.ExecutablePath)
+	if !dotnetInstallTools[name] {
+		return
+	}
+	assembly, ok := uninstallAssemblyArg(event.CommandLine)
+	if !ok {
+		return
+	}
+	path := expandWindowsEnv(assembly)
+	if !filepath.IsAbs(path) {
+		if dir, err := processWorkingDirectory(event.ProcessID); err == nil {
+			path = filepath.Join(dir, path)
+		}
+	}
+
+	inspection := &AssemblyInspection{
+		BinaryInspection: inspectBinary(path, config.MaxArtifactSize),
+		Trusted:          isTrustedAssemblyPath(path),
+	}
+	event.Assembly = inspection
+	event.Indicators = append(event.Indicators, Indicator{
+		Rule:  event.Rule,
+		Type:  "uninstall_assembly",
+		Value: path,
+	})
+	if event.Rule != name {
+		// The rule only sees .dll assemblies; executables are caught here
+		addFinding(event, SeverityMedium, ConfidenceMedium, fmt.Sprintf("%s runs the uninstall methods of %s", name, path))
+	}
+	if !inspection.Trusted {
+		addFinding(event, SeverityHigh, ConfidenceMedium, fmt.Sprintf("%s uninstalls assembly %s from outside Program Files and Windows", name, path))
+		if event.Severity < SeverityHigh {
+			event.Severity = SeverityHigh
+		}
+	}
+	if inspection.SignatureStatus != "" && !inspection.Signed {
+		reason := fmt.Sprintf("%s uninstalls unsigned assembly %s", name, path)
+		if inspection.SignatureStatus != signatureUnsigned {
+			reason = fmt.Sprintf("%s uninstalls assembly %s (signature %s)", name, path, inspection.SignatureStatus)
+		}
+		if inspection.SHA256 != "" {
+			reason += fmt.Sprintf(" (sha256 %s)", inspection.SHA256)
+		}
+		addFinding(event, SeverityHigh, ConfidenceHigh, reason)
+		if event.Severity < SeverityHigh {
+			event.Severity = SeverityHigh
+		}
+	}
+}
@@ -0,0 +1,316 @@
+// download.go
+// Detection of downloads by curl, certreq, desktopimgdownldr and
+// GfxDownloadWrapper. Their command lines are parsed for the remote URL and
+// the file written, which feeds the IOCs and the dropped-file tracking of
+// chain.go, and the download is weighted by where the file lands.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// Download describes a file transfer by a download-capable binary
+type Download struct {
+	Tool string   `json:"tool"`
+	URLs []string `json:"urls"`
+	// Output is the file written, or the directory for tools that pick
+	// the file name themselves
+	Output string `json:"output,omitempty"`
+	// TrustedDomain is the trusted download domain that downgraded the
+	// detection
+	TrustedDomain string `json:"trusted_domain,omitempty"`
+}
+
+// curlValueOptions are the curl short options taking a value; o is the
+// output file
+const curlValueOptions = "oAbcdDeEFHKmQrtTuUwxXyYz"
+
+// curlLongValueOptions are the curl long options taking a value that are
+// not otherwise handled
+var curlLongValueOptions = map[string]bool{
+	"--data": true, "--data-raw": true, "--data-binary": true, "--data-urlencode": true,
+	"--header": true, "--user-agent": true, "--user": true, "--proxy": true, "--referer": true,
+	"--request": true, "--cookie": true, "--cookie-jar": true, "--config": true, "--form": true,
+	"--upload-file": true, "--max-time": true, "--connect-timeout": true, "--retry": true,
+	"--cacert": true, "--cert": true, "--key": true, "--resolve": true, "--dump-header": true,
+	"--write-out": true, "--range": true, "--limit-rate": true, "--interface": true,
+}
+
+// parseCurl extracts the URLs and output of a curl command line. URLs may
+// come anywhere among the options, with or without a scheme or via --url;
+// the output is -o/--output, or the URL's file name with -O/--remote-name.
+func parseCurl(args []string) *Download {
+	download := &Download{Tool: "curl.exe"}
+	var output, outputDir string
+	remoteName := false
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		next := func() string {
+			if i+1 < len(args) {
+				i++
+				return args[i]
+			}
+			return ""
+		}
+		switch {
+		case arg == "--url":
+			download.URLs = append(download.URLs, next())
+		case arg == "--output":
+			output = next()
+		case arg == "--output-dir":
+			outputDir = next()
+		case arg == "--remote-name" || arg == "--remote-name-all":
+			remoteName = true
+		case strings.HasPrefix(arg, "--"):
+			if curlLongValueOptions[arg] {
+				next()
+			}
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			// A cluster of short options such as -sSLo; an option taking
+			// a value uses the rest of the cluster or the next argument
+			for j := 1; j < len(arg); j++ {
+				option := arg[j]
+				if option == 'O' {
+					remoteName = true
+					continue
+				}
+				if !strings.ContainsRune(curlValueOptions, rune(option)) {
+					continue
+				}
+				value := arg[j+1:]
+				if value == "" {
+					value = next()
+				}
+				if option == 'o' {
+					output = value
+				}
+				break
+			}
+		default:
+			download.URLs = append(download.URLs, arg)
+		}
+	}
+
+	if output == "" && remoteName && len(download.URLs) > 0 {
+		if u, err := url.Parse(withScheme(download.URLs[0])); err == nil {
+			if name := path.Base(u.Path); name != "." && name != "/" {
+				output = name
+			}
+		}
+	}
+	if output != "" && outputDir != "" && !filepath.IsAbs(output) {
+		output = filepath.Join(outputDir, output)
+	}
+	download.Output = output
+	return download
+}
+
+// parseCertreq extracts the -config URL and the response file of certreq
+// -Post, which writes the server's response to its second file argument
+func parseCertreq(args []string) (*Download, bool) {
+	download := &Download{Tool: "certreq.exe"}
+	post := false
+	var files []string
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "/") {
+			files = append(files, arg)
+			continue
+		}
+		switch strings.ToLower(arg[1:]) {
+		case "post":
+			post = true
+		case "config", "attrib", "policyserver", "cert", "credential":
+			if i+1 < len(args) {
+				i++
+				if strings.EqualFold(arg[1:], "config") {
+					download.URLs = append(download.URLs, args[i])
+				}
+			}
+		}
+	}
+	if len(files) > 1 {
+		download.Output = files[1]
+	}
+	return download, post && len(download.URLs) > 0
+}
+
+// lockScreenImagePath returns the path desktopimgdownldr last wrote the
+// lock screen image to, which it records under PersonalizationCSP
+func lockScreenImagePath() string {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\Windows\CurrentVersion\PersonalizationCSP`, registry.QUERY_VALUE)
+	if err != nil {
+		return ""
+	}
+	defer key.Close()
+	value, _, err := key.GetStringValue("LockScreenImagePath")
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+// parseDesktopImgDownldr extracts the /lockscreenurl: of desktopimgdownldr.
+// The image lands under %SystemRoot%\Personalization\LockScreenImage, with
+// SystemRoot often redirected by the caller, so the path recorded in the
+// registry is preferred when it can be read.
+func parseDesktopImgDownldr(args []string, live bool) (*Download, bool) {
+	download := &Download{Tool: "desktopimgdownldr.exe"}
+	for _, arg := range args[min(1, len(args)):] {
+		if name, value, ok := strings.Cut(arg, ":"); ok && strings.EqualFold(name, "/lockscreenurl") {
+			download.URLs = append(download.URLs, value)
+		}
+	}
+	if len(download.URLs) == 0 {
+		return nil, false
+	}
+	if live {
+		download.Output = lockScreenImagePath()
+	}
+	if download.Output == "" {
+		download.Output = expandWindowsEnv(`%SystemRoot%\Personalization\LockScreenImage\`)
+	}
+	return download, true
+}
+
+// parseGfxDownloadWrapper extracts the URL and destination file, its two
+// positional arguments
+func parseGfxDownloadWrapper(args []string) (*Download, bool) {
+	download := &Download{Tool: "gfxdownloadwrapper.exe"}
+	var positional []string
+	for _, arg := range args[min(1, len(args)):] {
+		if !strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "/") {
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) == 0 {
+		return nil, false
+	}
+	download.URLs = positional[:1]
+	if len(positional) > 1 {
+		download.Output = positional[1]
+	}
+	return download, true
+}
+
+// parseDownload dispatches to the parser of a download tool
+func parseDownload(execName string, args []string, live bool) (*Download, bool) {
+	switch execName {
+	case "curl.exe":
+		download := parseCurl(args)
+		return download, len(download.URLs) > 0
+	case "certreq.exe":
+		return parseCertreq(args)
+	case "desktopimgdownldr.exe":
+		return parseDesktopImgDownldr(args, live)
+	case "gfxdownloadwrapper.exe":
+		return parseGfxDownloadWrapper(args)
+	}
+	return nil, false
+}
+
+// withScheme prefixes a URL given without a scheme, as curl accepts
+func withScheme(raw string) string {
+	if strings.Contains(raw, "://") {
+		return raw
+	}
+	return "http://" + raw
+}
+
+// trustedDownloadDomain returns the configured trusted domain every URL of
+// a download is under, or "" if any URL is elsewhere
+func trustedDownloadDomain(urls []string) string {
+	matched := ""
+	for _, raw := range urls {
+		u, err := url.Parse(withScheme(raw))
+		if err != nil || u.Hostname() == "" {
+			return ""
+		}
+		host := strings.ToLower(u.Hostname())
+		found := ""
+		for _, domain := range config.TrustedDownloadDomains {
+			domain = strings.ToLower(strings.Trim(domain, ". "))
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				found = domain
+				break
+			}
+		}
+		if found == "" {
+			return ""
+		}
+		matched = found
+	}
+	return matched
+}
+
+// downloadLocationSeverity weighs where a downloaded file lands: the
+// Startup folder runs it at the next logon, temp and profile directories
+// are staging areas, and anything else, Downloads included, is ordinary
+func downloadLocationSeverity(output string) (Severity, string) {
+	lower := strings.ToLower(output)
+	switch {
+	case strings.Contains(lower, `\start menu\programs\startup\`):
+		return SeverityCritical, "the Startup folder"
+	case strings.Contains(lower, `\downloads\`):
+		return SeverityNone, ""
+	case isUserWritableOrTempPath(output):
+		return SeverityHigh, "a temp or profile directory"
+	}
+	return SeverityNone, ""
+}
+
+// checkDownload records what a download tool fetches and where it writes
+// it, and raises downloads into staging or autostart directories. Downloads
+// from trusted domains only are downgraded to info.
+func checkDownload(ctx *DetectionContext, event *ProcessEvent) {
+	download, ok := parseDownload(ctx.ExecName, splitCommandLine(event.CommandLine), ctx.Live)
+	if !ok {
+		return
+	}
+	if download.Output != "" {
+		download.Output = expandWindowsEnv(strings.Trim(download.Output, `"`))
+		if !filepath.IsAbs(download.Output) && ctx.Live {
+			if dir, err := processWorkingDirectory(event.ProcessID); err == nil {
+				download.Output = filepath.Join(dir, download.Output)
+			}
+		}
+	}
+	event.Download = download
+
+	for _, raw := range download.URLs {
+		for _, ioc := range extractIOCs(withScheme(raw)) {
+			if !hasIOC(event, ioc.Value) {
+				event.IOCs = append(event.IOCs, ioc)
+			}
+		}
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "download_url", Value: raw, Category: "download"})
+	}
+	addTags(event, []string{"download"})
+
+	if domain := trustedDownloadDomain(download.URLs); domain != "" {
+		download.TrustedDomain = domain
+		if event.Suspicious {
+			event.SuppressedBy = "trusted download domain " + domain
+			event.Severity = SeverityInfo
+		}
+		return
+	}
+
+	if download.Output == "" {
+		return
+	}
+	event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "download_output", Value: download.Output})
+	if severity, where := downloadLocationSeverity(download.Output); severity != SeverityNone {
+		addFinding(event, severity, ConfidenceMedium, fmt.Sprintf("%s downloads %s to %s", ctx.ExecName, download.Output, where))
+		if event.Severity < severity {
+			event.Severity = severity
+		}
+	}
+}
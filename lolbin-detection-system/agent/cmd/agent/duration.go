@@ -0,0 +1,27 @@
+// duration.go
+// Duration type that reads and writes human-friendly strings such as "5m"
+
+package main
+
+import (
+	"time"
+)
+
+// Duration wraps time.Duration so it can be written as "30s" or "5m" in
+// rules and configuration files
+type Duration time.Duration
+
+// MarshalText encodes the duration as a Go duration string
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText parses a Go duration string
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
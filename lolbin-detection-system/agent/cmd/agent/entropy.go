@@ -0,0 +1,131 @@
+// entropy.go
+// Shannon-entropy scoring of command lines to spot obfuscated or encoded
+// arguments that no specific suspicious-args pattern covers.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+const (
+	// minEntropyTokenLength is the shortest token worth scoring. Short
+	// tokens can't reach a meaningful entropy and would only add noise.
+	minEntropyTokenLength = 32
+
+	// minArgEntropyLength is the shortest argument portion the
+	// argument-entropy heuristic applies to, for the same reason
+	minArgEntropyLength = 64
+)
+
+// Tokens scoring above Config.EntropyThreshold bits per character are
+// considered high entropy. Base64 and hex blobs typically score 4.5-6.
+
+// shannonEntropy returns the Shannon entropy of s in bits per character
+func shannonEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+
+	counts := make(map[rune]int)
+	total := 0
+	for _, r := range s {
+		counts[r]++
+		total++
+	}
+
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// hexEntropyScale brings the entropy of hex tokens to the scale of base64
+// ones. Hex spends two characters on a byte where base64 spends 4/3, so the
+// same random bytes score at most 4 bits per character as hex against 6 as
+// base64, below any threshold that leaves ordinary text alone.
+const hexEntropyScale = 1.5
+
+// commandLineEntropy returns the highest entropy of any long token in the
+// command line. Scoring individual tokens keeps a single encoded blob from
+// being diluted by the ordinary text around it.
+func commandLineEntropy(cmdLine string) float64 {
+	tokens := strings.FieldsFunc(cmdLine, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '"' || r == '\''
+	})
+
+	highest := 0.0
+	for _, token := range tokens {
+		if len(token) < minEntropyTokenLength {
+			continue
+		}
+		e := shannonEntropy(token)
+		if isHexString(token) {
+			e *= hexEntropyScale
+		}
+		if e > highest {
+			highest = e
+		}
+	}
+	return highest
+}
+
+// isHexString reports whether s consists of hex digits only
+func isHexString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// commandLineArgs returns the command line without the leading executable,
+// which may be quoted
+func commandLineArgs(cmdLine string) string {
+	cmdLine = strings.TrimSpace(cmdLine)
+	if strings.HasPrefix(cmdLine, `"`) {
+		if end := strings.Index(cmdLine[1:], `"`); end >= 0 {
+			return strings.TrimSpace(cmdLine[end+2:])
+		}
+		return ""
+	}
+	if i := strings.IndexFunc(cmdLine, unicode.IsSpace); i >= 0 {
+		return strings.TrimSpace(cmdLine[i:])
+	}
+	return ""
+}
+
+// checkCommandLineHeuristics flags LOLBin command lines that are unusually
+// long or whose arguments as a whole look encoded. Rules can override the
+// configured thresholds, e.g. for powershell which legitimately sees long
+// lines.
+func checkCommandLineHeuristics(event *ProcessEvent, lolbin LOLBin) {
+	maxLength := config.Heuristics.MaxCommandLineLength
+	if lolbin.MaxCommandLineLength > 0 {
+		maxLength = lolbin.MaxCommandLineLength
+	}
+	entropyThreshold := config.Heuristics.ArgEntropyThreshold
+	if lolbin.ArgEntropyThreshold > 0 {
+		entropyThreshold = lolbin.ArgEntropyThreshold
+	}
+
+	if maxLength > 0 && event.CmdLineLength > maxLength {
+		value := fmt.Sprintf("%d chars (threshold %d)", event.CmdLineLength, maxLength)
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "cmdline_length", Value: value})
+		addFinding(event, SeverityMedium, ConfidenceLow, fmt.Sprintf("Unusually long %s command line: %s", event.Rule, value))
+	}
+
+	args := commandLineArgs(event.CommandLine)
+	if entropyThreshold > 0 && len(args) >= minArgEntropyLength && event.CmdLineEntropy > entropyThreshold {
+		value := fmt.Sprintf("%.2f bits/char (threshold %.2f)", event.CmdLineEntropy, entropyThreshold)
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "arg_entropy", Value: value})
+		addFinding(event, SeverityMedium, ConfidenceLow, fmt.Sprintf("High-entropy %s arguments: %s", event.Rule, value))
+	}
+}
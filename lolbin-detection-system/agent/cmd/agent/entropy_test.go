@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// randomBytes returns n reproducible pseudo-random bytes
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
+
+func TestShannonEntropy(t *testing.T) {
+	tests := []struct {
+		s    string
+		want float64
+	}{
+		{"", 0},
+		{"aaaaaaaa", 0},
+		{"abababab", 1},
+		{"0123456789abcdef", 4},
+	}
+	for _, tt := range tests {
+		if got := shannonEntropy(tt.s); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("shannonEntropy(%q) = %f, want %f", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestCommandLineEntropy(t *testing.T) {
+	payload := randomBytes(48)
+	threshold := defaultConfig().EntropyThreshold
+	tests := []struct {
+		name    string
+		cmdLine string
+		high    bool
+	}{
+		{"service host", `C:\Windows\System32\svchost.exe -k netsvcs -p -s Schedule`, false},
+		{"office document", `"C:\Program Files\Microsoft Office\root\Office16\WINWORD.EXE" /n "C:\Users\alice\Documents\Quarterly Report.docx"`, false},
+		{"long path", `C:\Users\alice\AppData\Local\Microsoft\Teams\current\Teams.exe --process-start-args "--profile=AAD"`, false},
+		{"script file", `powershell.exe -NoProfile -ExecutionPolicy Bypass -File C:\ProgramData\Scripts\inventory-collection.ps1`, false},
+		{"base64 argument", `rundll32.exe C:\Users\Public\x.dll,Run ` + base64.StdEncoding.EncodeToString(payload), true},
+		{"quoted base64 argument", `mshta.exe "` + base64.StdEncoding.EncodeToString(payload) + `"`, true},
+		{"hex argument", `cmd.exe /c echo ` + hex.EncodeToString(payload) + ` > C:\Users\Public\a.hex`, true},
+		{"low-entropy hex", `cmd.exe /c echo 4d5a90000300000004000000ffff0000b800000000000000 > C:\Users\Public\a.hex`, false},
+		{"short token", `certutil.exe -decode ` + base64.StdEncoding.EncodeToString(payload[:12]) + ` out.bin`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entropy := commandLineEntropy(tt.cmdLine)
+			if high := entropy > threshold; high != tt.high {
+				t.Errorf("commandLineEntropy() = %.2f, high entropy %v, want %v (threshold %.2f)", entropy, high, tt.high, threshold)
+			}
+		})
+	}
+}
+
+func TestHighEntropyFlag(t *testing.T) {
+	event := evaluate(`C:\Windows\System32\rundll32.exe`, `rundll32.exe C:\Users\Public\x.dll,Run `+hex.EncodeToString(randomBytes(48)))
+	if !event.HighEntropy || event.Entropy <= config.EntropyThreshold {
+		t.Errorf("hex argument: HighEntropy = %v, Entropy = %.2f", event.HighEntropy, event.Entropy)
+	}
+	event = evaluate(`C:\Windows\System32\svchost.exe`, `C:\Windows\System32\svchost.exe -k netsvcs -p -s Schedule`)
+	if event.HighEntropy {
+		t.Errorf("service host: HighEntropy set, Entropy = %.2f", event.Entropy)
+	}
+}
+
+func BenchmarkCommandLineEntropy(b *testing.B) {
+	// A 32 KiB command line of ordinary words around an encoded blob
+	var sb strings.Builder
+	sb.WriteString(`powershell.exe -NoProfile -Command `)
+	blob := base64.StdEncoding.EncodeToString(randomBytes(3 << 10))
+	for sb.Len() < 32<<10-len(blob) {
+		sb.WriteString(`Get-ChildItem -Path C:\ProgramData\Scripts -Recurse | `)
+	}
+	sb.WriteString(blob)
+	cmdLine := sb.String()[:32<<10]
+
+	b.SetBytes(int64(len(cmdLine)))
+	b.ReportAllocs()
+	for b.Loop() {
+		commandLineEntropy(cmdLine)
+	}
+}
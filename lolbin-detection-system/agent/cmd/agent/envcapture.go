@@ -0,0 +1,181 @@
+// envcapture.go
+// Capture of the environment of suspicious processes. Payloads are hidden
+// in environment variables and expanded on the command line, e.g.
+// cmd /c %x%, so the variables a flagged command line references are read
+// from the process's environment block together with a few standard ones.
+// Reading another process's memory needs privileges and takes time, so
+// capture is opt-in, limited to suspicious events and best-effort.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// maxEnvironmentSize caps the environment block read from a process
+const maxEnvironmentSize = 1 << 20
+
+// EnvCaptureConfig configures environment capture for suspicious events
+type EnvCaptureConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Allow names variables captured besides the built-in standard ones
+	// and those the command line references
+	Allow []string `yaml:"allow"`
+	// Redact are name fragments, besides the built-in ones such as
+	// password, whose variables are captured without their value
+	Redact []string `yaml:"redact"`
+	// MaxValueLength truncates captured values
+	MaxValueLength int `yaml:"max_value_length"`
+}
+
+// Validate checks the environment capture settings
+func (c EnvCaptureConfig) Validate() error {
+	if c.MaxValueLength <= 0 {
+		return fmt.Errorf("env_capture.max_value_length must be positive")
+	}
+	for _, name := range append(append([]string{}, c.Allow...), c.Redact...) {
+		if strings.TrimSpace(name) == "" || strings.Contains(name, "=") {
+			return fmt.Errorf("invalid env_capture variable name %q", name)
+		}
+	}
+	return nil
+}
+
+// EnvVariable is a captured environment variable
+type EnvVariable struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+	// Length is the length of the full value, before truncation or
+	// redaction
+	Length int `json:"length"`
+	// Referenced is set when the command line expands the variable
+	Referenced bool `json:"referenced,omitempty"`
+	Redacted   bool `json:"redacted,omitempty"`
+	Truncated  bool `json:"truncated,omitempty"`
+}
+
+// defaultEnvAllow are standard variables always captured; changes to them
+// redirect where LOLBins look for their files
+var defaultEnvAllow = []string{
+	"ComSpec", "PATH", "PATHEXT", "SystemRoot", "windir", "TEMP", "TMP",
+	"APPDATA", "LOCALAPPDATA", "USERPROFILE", "PSModulePath", "__COMPAT_LAYER",
+	"COR_ENABLE_PROFILING", "COR_PROFILER", "COR_PROFILER_PATH",
+}
+
+// defaultEnvRedact are name fragments of variables holding secrets
+var defaultEnvRedact = []string{"password", "passwd", "pwd", "secret", "token", "credential", "apikey", "api_key", "connectionstring"}
+
+// envReferencePattern matches variable references on a command line: cmd's
+// %NAME% with optional substring or substitution, !NAME! with delayed
+// expansion, and PowerShell's $env:NAME
+var envReferencePattern = regexp.MustCompile(`(?i)%([^%\s:=]+)(?::[^%]*)?%|!([^!\s:=]+)(?::[^!]*)?!|\$env:([a-z0-9_]+)|\$\{env:([^}]+)\}`)
+
+// referencedVariables returns the lowercased names of the variables a
+// command line references
+func referencedVariables(cmdLine string) map[string]bool {
+	names := map[string]bool{}
+	for _, match := range envReferencePattern.FindAllStringSubmatch(cmdLine, -1) {
+		for _, name := range match[1:] {
+			if name != "" {
+				names[strings.ToLower(name)] = true
+			}
+		}
+	}
+	return names
+}
+
+// processEnvironment reads the environment block of a running process
+func processEnvironment(pid uint32) ([]string, error) {
+	var block []uint16
+	err := withProcessParameters(pid, func(process windows.Handle, params *windows.RTL_USER_PROCESS_PARAMETERS) error {
+		size := params.EnvironmentSize
+		if params.Environment == nil || size == 0 {
+			return errors.New("no environment block")
+		}
+		size = min(size, maxEnvironmentSize)
+		block = make([]uint16, size/2)
+		if err := windows.ReadProcessMemory(process, uintptr(params.Environment),
+			(*byte)(unsafe.Pointer(&block[0])), uintptr(len(block)*2), nil); err != nil {
+			return fmt.Errorf("failed to read environment: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// NAME=VALUE entries, each NUL-terminated, up to an empty one
+	var entries []string
+	for len(block) > 0 {
+		end := 0
+		for end < len(block) && block[end] != 0 {
+			end++
+		}
+		if end == 0 {
+			break
+		}
+		entries = append(entries, windows.UTF16ToString(block[:end]))
+		block = block[min(end+1, len(block)):]
+	}
+	return entries, nil
+}
+
+// selectEnvironment picks the captured variables from environment entries:
+// the allowed ones and those the command line references, redacting
+// secret-looking names and truncating long values
+func selectEnvironment(entries []string, cmdLine string, cfg EnvCaptureConfig) []EnvVariable {
+	allowed := map[string]bool{}
+	for _, name := range append(append([]string{}, defaultEnvAllow...), cfg.Allow...) {
+		allowed[strings.ToLower(name)] = true
+	}
+	redact := append(append([]string{}, defaultEnvRedact...), lowerAll(cfg.Redact)...)
+	referenced := referencedVariables(cmdLine)
+
+	var captured []EnvVariable
+	for _, entry := range entries {
+		// Entries such as =C:=C:\Windows hold per-drive directories
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			continue
+		}
+		lower := strings.ToLower(name)
+		if !allowed[lower] && !referenced[lower] {
+			continue
+		}
+		variable := EnvVariable{Name: name, Value: value, Length: len(value), Referenced: referenced[lower]}
+		for _, fragment := range redact {
+			if strings.Contains(lower, fragment) {
+				variable.Value = ""
+				variable.Redacted = true
+				break
+			}
+		}
+		if len(variable.Value) > cfg.MaxValueLength {
+			variable.Value = strings.ToValidUTF8(variable.Value[:cfg.MaxValueLength], "")
+			variable.Truncated = true
+		}
+		captured = append(captured, variable)
+	}
+	return captured
+}
+
+// captureEnvironment attaches the environment subset of a suspicious
+// process to its event. Failures, e.g. because the process already exited
+// or is protected, leave the event as it is.
+func captureEnvironment(event *ProcessEvent) {
+	cfg := config.EnvCapture
+	if !cfg.Enabled || !event.Suspicious || event.ProcessID == 0 {
+		return
+	}
+	entries, err := processEnvironment(event.ProcessID)
+	if err != nil {
+		return
+	}
+	event.Environment = selectEnvironment(entries, event.CommandLine, cfg)
+}
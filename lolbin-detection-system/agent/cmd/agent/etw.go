@@ -0,0 +1,365 @@
+// etw.go
+// ETW event source. A real-time trace session subscribed to the
+// Microsoft-Windows-Kernel-Process provider receives every process start
+// as it happens. The event carries the PID, parent PID and image; the
+// command line is read from the new process while it is still running.
+// With file correlation on, the session also subscribes to new file
+// creations from Microsoft-Windows-Kernel-File.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// etwSessionName is the name of the agent's trace session
+	etwSessionName = "LOLBinMonitor"
+
+	wnodeFlagTracedGUID          = 0x00020000
+	eventTraceRealTimeMode       = 0x00000100
+	eventTraceControlStop        = 1
+	eventControlCodeEnable       = 1
+	traceLevelInformation        = 4
+	processTraceModeRealTime     = 0x00000100
+	processTraceModeEventRecord  = 0x10000000
+	invalidProcessTraceHandle    = ^uint64(0)
+	kernelProcessKeywordProcess  = 0x10
+	kernelProcessEventStart      = 1
+	kernelProcessStartImageStart = 24
+	kernelFileKeywordCreateNew   = 0x1000
+	kernelFileEventCreateNew     = 30
+	eventHeaderFlag32BitHeader   = 0x0020
+)
+
+// kernelProcessProvider is Microsoft-Windows-Kernel-Process
+var kernelProcessProvider = windows.GUID{Data1: 0x22fb2cd6, Data2: 0x0e7b, Data3: 0x422b,
+	Data4: [8]byte{0xa0, 0xc7, 0x2f, 0xad, 0x1f, 0xd0, 0xe7, 0x16}}
+
+// kernelFileProvider is Microsoft-Windows-Kernel-File
+var kernelFileProvider = windows.GUID{Data1: 0xedd08927, Data2: 0x9cc4, Data3: 0x4e65,
+	Data4: [8]byte{0xb9, 0x70, 0xc2, 0x56, 0x0f, 0xb5, 0xc2, 0x89}}
+
+var (
+	advapi32           = windows.NewLazySystemDLL("advapi32.dll")
+	procStartTraceW    = advapi32.NewProc("StartTraceW")
+	procControlTraceW  = advapi32.NewProc("ControlTraceW")
+	procEnableTraceEx2 = advapi32.NewProc("EnableTraceEx2")
+	procOpenTraceW     = advapi32.NewProc("OpenTraceW")
+	procProcessTrace   = advapi32.NewProc("ProcessTrace")
+	procCloseTrace     = advapi32.NewProc("CloseTrace")
+)
+
+// wnodeHeader is WNODE_HEADER
+type wnodeHeader struct {
+	BufferSize        uint32
+	ProviderID        uint32
+	HistoricalContext uint64
+	TimeStamp         int64
+	GUID              windows.GUID
+	ClientContext     uint32
+	Flags             uint32
+}
+
+// eventTraceProperties is EVENT_TRACE_PROPERTIES
+type eventTraceProperties struct {
+	Wnode               wnodeHeader
+	BufferSize          uint32
+	MinimumBuffers      uint32
+	MaximumBuffers      uint32
+	MaximumFileSize     uint32
+	LogFileMode         uint32
+	FlushTimer          uint32
+	EnableFlags         uint32
+	AgeLimit            int32
+	NumberOfBuffers     uint32
+	FreeBuffers         uint32
+	EventsLost          uint32
+	BuffersWritten      uint32
+	LogBuffersLost      uint32
+	RealTimeBuffersLost uint32
+	LoggerThreadID      windows.Handle
+	LogFileNameOffset   uint32
+	LoggerNameOffset    uint32
+}
+
+// eventTraceHeader is EVENT_TRACE_HEADER
+type eventTraceHeader struct {
+	Size          uint16
+	FieldType     uint16
+	Version       uint32
+	ThreadID      uint32
+	ProcessID     uint32
+	TimeStamp     int64
+	GUID          windows.GUID
+	ProcessorTime uint64
+}
+
+// eventTrace is EVENT_TRACE
+type eventTrace struct {
+	Header           eventTraceHeader
+	InstanceID       uint32
+	ParentInstanceID uint32
+	ParentGUID       windows.GUID
+	MofData          uintptr
+	MofLength        uint32
+	BufferContext    uint32
+}
+
+// traceLogfileHeader is TRACE_LOGFILE_HEADER
+type traceLogfileHeader struct {
+	BufferSize         uint32
+	Version            uint32
+	ProviderVersion    uint32
+	NumberOfProcessors uint32
+	EndTime            int64
+	TimerResolution    uint32
+	MaximumFileSize    uint32
+	LogFileMode        uint32
+	BuffersWritten     uint32
+	LogInstanceGUID    windows.GUID
+	LoggerName         *uint16
+	LogFileName        *uint16
+	TimeZone           windows.Timezoneinformation
+	BootTime           int64
+	PerfFreq           int64
+	StartTime          int64
+	ReservedFlags      uint32
+	BuffersLost        uint32
+}
+
+// eventTraceLogfile is EVENT_TRACE_LOGFILEW
+type eventTraceLogfile struct {
+	LogFileName         *uint16
+	LoggerName          *uint16
+	CurrentTime         int64
+	BuffersRead         uint32
+	ProcessTraceMode    uint32
+	CurrentEvent        eventTrace
+	LogfileHeader       traceLogfileHeader
+	BufferCallback      uintptr
+	BufferSize          uint32
+	Filled              uint32
+	EventsLost          uint32
+	EventRecordCallback uintptr
+	IsKernelTrace       uint32
+	Context             uintptr
+}
+
+// eventDescriptor is EVENT_DESCRIPTOR
+type eventDescriptor struct {
+	ID      uint16
+	Version uint8
+	Channel uint8
+	Level   uint8
+	Opcode  uint8
+	Task    uint16
+	Keyword uint64
+}
+
+// eventRecord is EVENT_RECORD
+type eventRecord struct {
+	EventHeader struct {
+		Size            uint16
+		HeaderType      uint16
+		Flags           uint16
+		EventProperty   uint16
+		ThreadID        uint32
+		ProcessID       uint32
+		TimeStamp       int64
+		ProviderID      windows.GUID
+		EventDescriptor eventDescriptor
+		ProcessorTime   uint64
+		ActivityID      windows.GUID
+	}
+	BufferContext     uint32
+	ExtendedDataCount uint16
+	UserDataLength    uint16
+	ExtendedData      uintptr
+	UserData          *byte
+	UserContext       uintptr
+}
+
+// etwSource reads process starts from a real-time ETW session
+type etwSource struct{}
+
+// newETWSource creates the ETW source
+func newETWSource() (EventSource, error) {
+	return &etwSource{}, nil
+}
+
+// Name identifies the ETW source
+func (s *etwSource) Name() string {
+	return "etw"
+}
+
+// newTraceProperties allocates session properties with room for the
+// session name behind them, as StartTrace and ControlTrace expect
+func newTraceProperties() *eventTraceProperties {
+	size := unsafe.Sizeof(eventTraceProperties{})
+	buf := make([]byte, size+2*uintptr(len(etwSessionName)+1))
+	props := (*eventTraceProperties)(unsafe.Pointer(&buf[0]))
+	props.Wnode.BufferSize = uint32(len(buf))
+	props.Wnode.Flags = wnodeFlagTracedGUID
+	// Query performance counter timestamps
+	props.Wnode.ClientContext = 1
+	props.LogFileMode = eventTraceRealTimeMode
+	props.LoggerNameOffset = uint32(size)
+	return props
+}
+
+// stopTraceSession stops the named session, e.g. one left behind by an
+// agent that didn't shut down cleanly
+func stopTraceSession(name *uint16) {
+	procControlTraceW.Call(0, uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(newTraceProperties())), eventTraceControlStop)
+}
+
+// Start runs the trace session until ctx is cancelled
+func (s *etwSource) Start(ctx context.Context, events chan<- ProcessEvent) error {
+	name, _ := syscall.UTF16PtrFromString(etwSessionName)
+
+	var session uint64
+	ret, _, _ := procStartTraceW.Call(uintptr(unsafe.Pointer(&session)), uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(newTraceProperties())))
+	if syscall.Errno(ret) == windows.ERROR_ALREADY_EXISTS {
+		stopTraceSession(name)
+		ret, _, _ = procStartTraceW.Call(uintptr(unsafe.Pointer(&session)), uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(newTraceProperties())))
+	}
+	if ret != 0 {
+		return fmt.Errorf("failed to start trace session: %v", syscall.Errno(ret))
+	}
+	defer stopTraceSession(name)
+
+	ret, _, _ = procEnableTraceEx2.Call(uintptr(session), uintptr(unsafe.Pointer(&kernelProcessProvider)), eventControlCodeEnable,
+		traceLevelInformation, kernelProcessKeywordProcess, 0, 0, 0)
+	if ret != 0 {
+		return fmt.Errorf("failed to enable the kernel process provider: %v", syscall.Errno(ret))
+	}
+	if config.FileCorrelation.Enabled {
+		ret, _, _ = procEnableTraceEx2.Call(uintptr(session), uintptr(unsafe.Pointer(&kernelFileProvider)), eventControlCodeEnable,
+			traceLevelInformation, kernelFileKeywordCreateNew, 0, 0, 0)
+		if ret != 0 {
+			// Process starts are still worth reading without the files
+			log.Printf("Failed to enable the kernel file provider, file correlation is off: %v", syscall.Errno(ret))
+		}
+	}
+
+	logfile := eventTraceLogfile{
+		LoggerName:       name,
+		ProcessTraceMode: processTraceModeRealTime | processTraceModeEventRecord,
+		EventRecordCallback: syscall.NewCallback(func(record *eventRecord) uintptr {
+			if record.EventHeader.ProviderID == kernelFileProvider {
+				if pid, path, ok := parseFileCreate(record); ok {
+					recordFileCreation(pid, path, time.Now())
+				}
+				return 0
+			}
+			if event, ok := parseProcessStart(record); ok {
+				sendEvent(ctx, events, event)
+			}
+			return 0
+		}),
+	}
+	trace, _, err := procOpenTraceW.Call(uintptr(unsafe.Pointer(&logfile)))
+	if uint64(trace) == invalidProcessTraceHandle {
+		return fmt.Errorf("failed to open trace session: %v", err)
+	}
+
+	// ProcessTrace delivers events until the trace is closed
+	done := make(chan error, 1)
+	go func() {
+		ret, _, _ := procProcessTrace.Call(uintptr(unsafe.Pointer(&trace)), 1, 0, 0)
+		if ret != 0 && syscall.Errno(ret) != windows.ERROR_CANCELLED {
+			done <- fmt.Errorf("failed to process trace: %v", syscall.Errno(ret))
+			return
+		}
+		done <- nil
+	}()
+	select {
+	case <-ctx.Done():
+		procCloseTrace.Call(trace)
+		<-done
+		return nil
+	case err := <-done:
+		procCloseTrace.Call(trace)
+		return err
+	}
+}
+
+// parseProcessStart builds a process event from a kernel process start
+// record. The record's image is an NT device path, so the Win32 path is
+// looked up while the process runs, as is its command line.
+func parseProcessStart(record *eventRecord) (ProcessEvent, bool) {
+	header := record.EventHeader
+	if header.ProviderID != kernelProcessProvider || header.EventDescriptor.ID != kernelProcessEventStart {
+		return ProcessEvent{}, false
+	}
+	data := unsafe.Slice(record.UserData, record.UserDataLength)
+	if len(data) < kernelProcessStartImageStart {
+		return ProcessEvent{}, false
+	}
+	// ProcessID, CreateTime, ParentProcessID, SessionID, Flags, ImageName
+	pid := binary.LittleEndian.Uint32(data[0:])
+	created := binary.LittleEndian.Uint64(data[4:])
+	event := ProcessEvent{
+		Timestamp: time.Unix(0, (&windows.Filetime{LowDateTime: uint32(created), HighDateTime: uint32(created >> 32)}).Nanoseconds()),
+		ProcessID: pid,
+		ParentID:  binary.LittleEndian.Uint32(data[12:]),
+	}
+
+	image := data[kernelProcessStartImageStart:]
+	chars := make([]uint16, 0, len(image)/2)
+	for i := 0; i+1 < len(image); i += 2 {
+		c := binary.LittleEndian.Uint16(image[i:])
+		if c == 0 {
+			break
+		}
+		chars = append(chars, c)
+	}
+	event.ExecutablePath = windows.UTF16ToString(chars)
+	if path, err := processImagePath(pid); err == nil {
+		event.ExecutablePath = path
+	}
+	event.CommandLine, _ = processCommandLine(pid)
+	return event, true
+}
+
+// parseFileCreate returns the creating process and the Win32 path of a
+// kernel file CreateNewFile record
+func parseFileCreate(record *eventRecord) (uint32, string, bool) {
+	header := record.EventHeader
+	if header.EventDescriptor.ID != kernelFileEventCreateNew {
+		return 0, "", false
+	}
+	// Irp, FileObject, IssuingThreadId, CreateOptions, CreateAttributes,
+	// ShareAccess, FileName
+	pointer := 8
+	if header.Flags&eventHeaderFlag32BitHeader != 0 {
+		pointer = 4
+	}
+	start := 2*pointer + 16
+	data := unsafe.Slice(record.UserData, record.UserDataLength)
+	if len(data) <= start {
+		return 0, "", false
+	}
+	name := data[start:]
+	chars := make([]uint16, 0, len(name)/2)
+	for i := 0; i+1 < len(name); i += 2 {
+		c := binary.LittleEndian.Uint16(name[i:])
+		if c == 0 {
+			break
+		}
+		chars = append(chars, c)
+	}
+	if len(chars) == 0 {
+		return 0, "", false
+	}
+	return header.ProcessID, win32Path(windows.UTF16ToString(chars)), true
+}
@@ -0,0 +1,107 @@
+// eventindex.go
+// Secondary indexes over the event store, so queries filtered by
+// executable or restricted to suspicious events only visit the events they
+// return. The indexes hold event IDs in ascending order; as IDs are
+// consecutive, an ID leads straight to the event's position in the store.
+// They are guarded by eventsMutex like the store itself.
+
+package main
+
+import "sort"
+
+// eventIndex lists the IDs of the stored events by executable image name
+// and of the suspicious ones
+type eventIndex struct {
+	byExe      map[string][]uint64
+	suspicious []uint64
+}
+
+var storeIndex = eventIndex{byExe: make(map[string][]uint64)}
+
+// add indexes a newly stored event, which has the highest ID so far
+func (x *eventIndex) add(event *ProcessEvent) {
+	name := imageName(event.ExecutablePath)
+	x.byExe[name] = append(x.byExe[name], event.ID)
+	if event.Suspicious {
+		x.suspicious = append(x.suspicious, event.ID)
+	}
+}
+
+// evict drops an event evicted from the store, which is always the oldest
+// one and so the first of its lists
+func (x *eventIndex) evict(event *ProcessEvent) {
+	name := imageName(event.ExecutablePath)
+	if ids := x.byExe[name]; len(ids) > 0 && ids[0] == event.ID {
+		if len(ids) == 1 {
+			delete(x.byExe, name)
+		} else {
+			x.byExe[name] = ids[1:]
+		}
+	}
+	if len(x.suspicious) > 0 && x.suspicious[0] == event.ID {
+		x.suspicious = x.suspicious[1:]
+	}
+}
+
+// update keeps the suspicious list in step with a stored event whose
+// detection changed after it was stored
+func (x *eventIndex) update(event *ProcessEvent) {
+	i := sort.Search(len(x.suspicious), func(i int) bool { return x.suspicious[i] >= event.ID })
+	listed := i < len(x.suspicious) && x.suspicious[i] == event.ID
+	switch {
+	case event.Suspicious && !listed:
+		x.suspicious = append(x.suspicious, 0)
+		copy(x.suspicious[i+1:], x.suspicious[i:])
+		x.suspicious[i] = event.ID
+	case !event.Suspicious && listed:
+		x.suspicious = append(x.suspicious[:i], x.suspicious[i+1:]...)
+	}
+}
+
+// candidates returns the ID list covering every event that can pass the
+// filter, or false when no index narrows the filter down
+func (x *eventIndex) candidates(filter eventFilter) ([]uint64, bool) {
+	switch {
+	case filter.exe != "":
+		return x.byExe[filter.exe], true
+	case filter.suspiciousOnly:
+		return x.suspicious, true
+	}
+	return nil, false
+}
+
+// storedEvent returns the stored event with the given ID. The caller holds
+// eventsMutex.
+func storedEvent(id uint64) (*ProcessEvent, bool) {
+	if len(processEvents) == 0 || id < processEvents[0].ID {
+		return nil, false
+	}
+	i := id - processEvents[0].ID
+	if i >= uint64(len(processEvents)) {
+		return nil, false
+	}
+	return &processEvents[i], true
+}
+
+// nextIndexedEvent returns a copy of the oldest stored event with an ID
+// above after that the filter's index lists, falling back to the next
+// event of the whole store when no index applies
+func nextIndexedEvent(filter eventFilter, after uint64) (ProcessEvent, bool) {
+	eventsMutex.RLock()
+	ids, indexed := storeIndex.candidates(filter)
+	if !indexed {
+		eventsMutex.RUnlock()
+		return nextEvent(after)
+	}
+	defer eventsMutex.RUnlock()
+
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] > after })
+	if i >= len(ids) {
+		return ProcessEvent{}, false
+	}
+	event, ok := storedEvent(ids[i])
+	if !ok {
+		return ProcessEvent{}, false
+	}
+	return *event, true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// indexedImages are the executables of the generated events, certutil.exe
+// the rarest
+var indexedImages = []string{
+	`C:\Windows\System32\svchost.exe`, `C:\Windows\System32\svchost.exe`, `C:\Windows\System32\svchost.exe`,
+	`C:\Windows\System32\conhost.exe`, `C:\Windows\System32\cmd.exe`, `C:\Windows\System32\certutil.exe`,
+}
+
+// storeGeneratedEvents stores n events with images from indexedImages, the
+// given share of them suspicious
+func storeGeneratedEvents(rng *rand.Rand, n int, suspicious float64) {
+	for i := 0; i < n; i++ {
+		storeEvent(ProcessEvent{
+			ProcessID:      uint32(rng.Intn(math.MaxUint16)),
+			Timestamp:      time.Now(),
+			ExecutablePath: indexedImages[rng.Intn(len(indexedImages))],
+			Suspicious:     rng.Float64() < suspicious,
+		})
+	}
+}
+
+// checkStoreIndex compares the index with one rebuilt from the store
+func checkStoreIndex(t *testing.T, step string) {
+	t.Helper()
+	eventsMutex.RLock()
+	defer eventsMutex.RUnlock()
+	want := eventIndex{byExe: make(map[string][]uint64)}
+	for i := range processEvents {
+		want.add(&processEvents[i])
+	}
+	if !reflect.DeepEqual(storeIndex.byExe, want.byExe) || !slices.Equal(storeIndex.suspicious, want.suspicious) {
+		t.Fatalf("after %s the index is %+v, want %+v", step, storeIndex, want)
+	}
+}
+
+// filteredIDs lists the IDs of the stored events passing the filter,
+// through the index or by scanning the whole store
+func filteredIDs(filter eventFilter, indexed bool) []uint64 {
+	var ids []uint64
+	for cursor := uint64(0); ; {
+		next := nextEvent
+		if indexed {
+			next = func(after uint64) (ProcessEvent, bool) { return nextIndexedEvent(filter, after) }
+		}
+		event, ok := next(cursor)
+		if !ok {
+			return ids
+		}
+		cursor = event.ID
+		if filter.matches(&event) {
+			ids = append(ids, event.ID)
+		}
+	}
+}
+
+func TestEventIndexConsistency(t *testing.T) {
+	withConfig(t, func(c *Config) { c.MaxEvents = 50 })
+	resetEvents(t)
+	rng := rand.New(rand.NewSource(1))
+
+	for round := 0; round < 20; round++ {
+		// Stored events push the oldest out
+		storeGeneratedEvents(rng, 1+rng.Intn(30), 0.2)
+		checkStoreIndex(t, fmt.Sprintf("storing in round %d", round))
+
+		// Detection results arriving late flip stored events either way
+		for i := 0; i < 5; i++ {
+			eventsMutex.RLock()
+			target := processEvents[rng.Intn(len(processEvents))]
+			eventsMutex.RUnlock()
+			if _, ok := updateEvent(target.ProcessID, target.Timestamp, func(e *ProcessEvent) { e.Suspicious = !e.Suspicious }); !ok {
+				t.Fatalf("updateEvent() did not find event %d", target.ID)
+			}
+		}
+		checkStoreIndex(t, fmt.Sprintf("updating in round %d", round))
+
+		for _, filter := range []eventFilter{
+			{exe: "certutil.exe"},
+			{exe: "svchost.exe", suspiciousOnly: true},
+			{suspiciousOnly: true},
+			{exe: "notepad.exe"},
+		} {
+			if indexed, linear := filteredIDs(filter, true), filteredIDs(filter, false); !slices.Equal(indexed, linear) {
+				t.Fatalf("round %d, %+v: indexed query gives %v, full scan %v", round, filter, indexed, linear)
+			}
+		}
+	}
+}
+
+func TestEventIndexEmptiesOnEviction(t *testing.T) {
+	withConfig(t, func(c *Config) { c.MaxEvents = 3 })
+	resetEvents(t)
+	storeEvent(ProcessEvent{ExecutablePath: `C:\Windows\System32\certutil.exe`, Suspicious: true})
+	for i := 0; i < 3; i++ {
+		storeEvent(ProcessEvent{ExecutablePath: `C:\Windows\System32\svchost.exe`})
+	}
+	if _, ok := storeIndex.byExe["certutil.exe"]; ok || len(storeIndex.suspicious) > 0 {
+		t.Errorf("the evicted event is still indexed: %+v", storeIndex)
+	}
+	if _, ok := nextIndexedEvent(eventFilter{exe: "certutil.exe"}, 0); ok {
+		t.Error("an indexed query returned the evicted event")
+	}
+}
+
+func BenchmarkFilteredQuery(b *testing.B) {
+	saved := config.MaxEvents
+	config.MaxEvents = 10000
+	b.Cleanup(func() { config.MaxEvents = saved })
+	resetEvents(b)
+	storeGeneratedEvents(rand.New(rand.NewSource(1)), config.MaxEvents, 0.02)
+
+	filters := map[string]eventFilter{
+		"exe":        {exe: "certutil.exe"},
+		"suspicious": {suspiciousOnly: true},
+	}
+	for name, filter := range filters {
+		for _, indexed := range []bool{true, false} {
+			mode := "linear"
+			if indexed {
+				mode = "indexed"
+			}
+			b.Run(name+"/"+mode, func(b *testing.B) {
+				for b.Loop() {
+					filteredIDs(filter, indexed)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// exittrack.go
+// Tracking of process exits. A handle is held on every stored process and
+// polled until it exits; the open handle keeps the PID from being reused,
+// and the creation time is checked when the handle is opened so an exit is
+// never attributed to an unrelated process that got the same PID.
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// maxTrackedProcesses bounds the process handles held open at once
+	maxTrackedProcesses = 4096
+
+	// startTimeTolerance is how far a process's creation time may be from
+	// its event's timestamp for the two to be the same process
+	startTimeTolerance = 2 * time.Second
+)
+
+// trackedProcess is a process whose exit is awaited
+type trackedProcess struct {
+	pid       uint32
+	timestamp time.Time
+	handle    windows.Handle
+}
+
+var (
+	trackedProcesses []trackedProcess
+	trackedMutex     sync.Mutex
+	exitPollerOnce   sync.Once
+)
+
+// filetimeToTime converts a FILETIME to a time
+func filetimeToTime(ft windows.Filetime) time.Time {
+	return time.Unix(0, ft.Nanoseconds())
+}
+
+// trackExit starts tracking the exit of the event's process. Processes that
+// already exited or whose creation time doesn't match the event are not
+// tracked.
+func trackExit(event ProcessEvent) {
+	interval := time.Duration(config.ExitPollInterval)
+	if interval <= 0 || event.ProcessID == 0 {
+		return
+	}
+
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION|windows.SYNCHRONIZE, false, event.ProcessID)
+	if err != nil {
+		return
+	}
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(handle, &creation, &exit, &kernel, &user); err != nil {
+		windows.CloseHandle(handle)
+		return
+	}
+	if diff := filetimeToTime(creation).Sub(event.Timestamp); diff > startTimeTolerance || diff < -startTimeTolerance {
+		// The PID was reused by a later process
+		windows.CloseHandle(handle)
+		return
+	}
+
+	trackedMutex.Lock()
+	if len(trackedProcesses) >= maxTrackedProcesses {
+		trackedMutex.Unlock()
+		windows.CloseHandle(handle)
+		return
+	}
+	trackedProcesses = append(trackedProcesses, trackedProcess{pid: event.ProcessID, timestamp: event.Timestamp, handle: handle})
+	trackedMutex.Unlock()
+
+	exitPollerOnce.Do(func() {
+		go pollExits(interval)
+	})
+}
+
+// pollExits checks the tracked processes for exits at every interval
+func pollExits(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var exited []trackedProcess
+		trackedMutex.Lock()
+		running := trackedProcesses[:0]
+		for _, process := range trackedProcesses {
+			if event, err := windows.WaitForSingleObject(process.handle, 0); err == nil && event == windows.WAIT_OBJECT_0 {
+				exited = append(exited, process)
+			} else {
+				running = append(running, process)
+			}
+		}
+		trackedProcesses = running
+		trackedMutex.Unlock()
+
+		for _, process := range exited {
+			recordExit(process)
+		}
+	}
+}
+
+// recordExit attaches the exit time and code of an exited process to its
+// stored event and releases the handle
+func recordExit(process trackedProcess) {
+	defer windows.CloseHandle(process.handle)
+
+	var code uint32
+	if err := windows.GetExitCodeProcess(process.handle, &code); err != nil {
+		log.Printf("Exit code lookup for PID %d failed: %v", process.pid, err)
+		return
+	}
+	var creation, exit, kernel, user windows.Filetime
+	exitTime := time.Now()
+	if err := windows.GetProcessTimes(process.handle, &creation, &exit, &kernel, &user); err == nil {
+		exitTime = filetimeToTime(exit)
+	}
+
+	updateEvent(process.pid, process.timestamp, func(e *ProcessEvent) {
+		e.ExitTime = &exitTime
+		e.ExitCode = &code
+		e.Lifetime = Duration(exitTime.Sub(e.Timestamp))
+	})
+}
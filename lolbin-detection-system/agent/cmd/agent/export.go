@@ -0,0 +1,136 @@
+// export.go
+// Bulk export of stored events as newline-delimited JSON, for feeding event
+// history into a pipeline. Events are read a page at a time and written as
+// they are read, so the export holds at most one page however many events
+// it covers. A cursor lets an interrupted export resume where it stopped.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// exportPageSize is the number of events read from the store at once
+const exportPageSize = 500
+
+// exportCursorTrailer is the trailer carrying the cursor to resume from
+const exportCursorTrailer = "X-Next-Cursor"
+
+// encodeExportCursor returns the cursor resuming after an event ID
+func encodeExportCursor(id uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(id, 10)))
+}
+
+// decodeExportCursor returns the event ID a cursor resumes after
+func decodeExportCursor(cursor string) (uint64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	id, err := strconv.ParseUint(string(raw), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	return id, nil
+}
+
+// eventsPage returns up to n events passing the filter with an ID above
+// after, oldest first, and the ID of the last event looked at, which the
+// next page starts after. The lock is held for one page.
+func eventsPage(filter eventFilter, after uint64, n int) ([]ProcessEvent, uint64) {
+	eventsMutex.RLock()
+	defer eventsMutex.RUnlock()
+
+	var events []ProcessEvent
+	last := after
+	visit := func(event *ProcessEvent) bool {
+		last = event.ID
+		if filter.matches(event) {
+			events = append(events, *event)
+		}
+		return len(events) < n
+	}
+	if ids, indexed := storeIndex.candidates(filter); indexed {
+		for i := sort.Search(len(ids), func(i int) bool { return ids[i] > after }); i < len(ids); i++ {
+			event, ok := storedEvent(ids[i])
+			if ok && !visit(event) {
+				break
+			}
+		}
+		return events, last
+	}
+	if len(processEvents) == 0 {
+		return nil, last
+	}
+	start := 0
+	if first := processEvents[0].ID; after >= first {
+		start = int(min(after-first+1, uint64(len(processEvents))))
+	}
+	for i := start; i < len(processEvents); i++ {
+		if !visit(&processEvents[i]) {
+			break
+		}
+	}
+	return events, last
+}
+
+// API handler: export events passing the filters as NDJSON, one event per
+// line. ?cursor= resumes an earlier export and ?limit= caps the events
+// written; the cursor to continue from is sent in the X-Next-Cursor
+// trailer.
+func exportEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseEventFilter(r)
+	var verbose bool
+	if err == nil {
+		verbose, err = parseVerbose(r)
+	}
+	var after uint64
+	if err == nil && r.URL.Query().Get("cursor") != "" {
+		after, err = decodeExportCursor(r.URL.Query().Get("cursor"))
+	}
+	limit := 0
+	if v := r.URL.Query().Get("limit"); err == nil && v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			err = fmt.Errorf("limit must be positive")
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Trailer", exportCursorTrailer)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	written := 0
+	for limit == 0 || written < limit {
+		size := exportPageSize
+		if limit > 0 {
+			size = min(size, limit-written)
+		}
+		events, last := eventsPage(filter, after, size)
+		for _, event := range events {
+			if err := encoder.Encode(renderEvent(event, verbose)); err != nil {
+				// The client went away
+				return
+			}
+			after = event.ID
+		}
+		written += len(events)
+		if len(events) < size {
+			// The store is exhausted; everything up to last was looked at
+			after = last
+			break
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	w.Header().Set(exportCursorTrailer, encodeExportCursor(after))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// exportPage runs an export and returns the IDs of the events written and
+// the cursor to resume from
+func exportPage(t *testing.T, query string) ([]uint64, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	exportEvents(rec, httptest.NewRequest(http.MethodGet, "/api/events/export?"+query, nil))
+	resp := rec.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("export %s: status %d: %s", query, resp.StatusCode, rec.Body)
+	}
+	var ids []uint64
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var event ProcessEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("export %s: invalid line %q: %v", query, scanner.Text(), err)
+		}
+		ids = append(ids, event.ID)
+	}
+	cursor := resp.Trailer.Get(exportCursorTrailer)
+	if cursor == "" {
+		t.Fatalf("export %s: no %s trailer", query, exportCursorTrailer)
+	}
+	return ids, cursor
+}
+
+func TestExportEventsEmpty(t *testing.T) {
+	resetEvents(t)
+	ids, cursor := exportPage(t, "")
+	if len(ids) != 0 {
+		t.Errorf("exported %v from an empty store", ids)
+	}
+	if after, err := decodeExportCursor(cursor); err != nil || after != 0 {
+		t.Errorf("cursor %q resumes after %d, %v, want 0", cursor, after, err)
+	}
+}
+
+func TestExportEventsResume(t *testing.T) {
+	resetEvents(t)
+	ids := storeTestEvents(t, 2*exportPageSize+7)
+
+	tests := []struct {
+		name  string
+		query string
+		want  func(i int) bool
+	}{
+		{"all", "", func(int) bool { return true }},
+		{"indexed filter", "&exe=rundll32.exe", func(i int) bool { return i%2 == 1 }},
+		{"unindexed filter", "&min_severity=none&off_hours=false", func(int) bool { return true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want []uint64
+			for i, id := range ids {
+				if tt.want(i) {
+					want = append(want, id)
+				}
+			}
+			// Resume with the cursor until a page comes back short
+			var got []uint64
+			cursor := ""
+			for pages := 0; ; pages++ {
+				if pages > len(ids) {
+					t.Fatal("the export doesn't end")
+				}
+				page, next := exportPage(t, fmt.Sprintf("limit=300&cursor=%s%s", cursor, tt.query))
+				if len(page) > 300 {
+					t.Fatalf("%d events exported, limit 300", len(page))
+				}
+				got = append(got, page...)
+				cursor = next
+				if len(page) < 300 {
+					break
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("exported %d events, want %d in order", len(got), len(want))
+			}
+
+			// The final cursor resumes after everything looked at
+			if page, _ := exportPage(t, "cursor="+cursor+tt.query); len(page) != 0 {
+				t.Errorf("%d events after the final cursor", len(page))
+			}
+			added := storeEvent(ProcessEvent{Timestamp: time.Now(), ExecutablePath: `C:\Windows\System32\rundll32.exe`})
+			if page, _ := exportPage(t, "cursor="+cursor+tt.query); fmt.Sprint(page) != fmt.Sprint([]uint64{added.ID}) {
+				t.Errorf("exported %v after storing %d", page, added.ID)
+			}
+			ids = append(ids, added.ID)
+		})
+	}
+}
+
+func TestExportEventsInvalid(t *testing.T) {
+	resetEvents(t)
+	for _, query := range []string{"limit=0", "limit=-5", "limit=x", "cursor=***", "cursor=" + encodeExportCursor(1) + "x", "cursor=eA", "since=yesterday"} {
+		rec := httptest.NewRecorder()
+		exportEvents(rec, httptest.NewRequest(http.MethodGet, "/api/events/export?"+query, nil))
+		var body map[string]string
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); rec.Code != http.StatusBadRequest || err != nil || body["error"] == "" {
+			t.Errorf("%s: status %d, body %q, want 400 with an error", query, rec.Code, rec.Body)
+		}
+	}
+}
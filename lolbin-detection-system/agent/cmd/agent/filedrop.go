@@ -0,0 +1,246 @@
+// filedrop.go
+// Correlation of file creations with the suspicious LOLBin that made them.
+// certutil, bitsadmin and the other download tools write what they fetch
+// to disk, so files a suspicious LOLBin creates in the moments after it
+// starts are attached to its event, and executables among them are flagged
+// and remembered for the download chain. File creations come from the ETW
+// Kernel-File provider, which is high-volume and only enabled on request.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// pendingFileCreations bounds the file creations kept for events still
+	// in detection when their process writes
+	pendingFileCreations = 1024
+)
+
+// droppedExecutableExts are the extensions of files that run or load code
+var droppedExecutableExts = map[string]bool{
+	".exe": true, ".dll": true, ".scr": true, ".cpl": true, ".sys": true,
+	".msi": true, ".hta": true, ".ps1": true, ".vbs": true, ".vbe": true,
+	".js": true, ".jse": true, ".wsf": true, ".bat": true, ".cmd": true,
+}
+
+// FileCorrelationConfig configures the correlation of file creations with
+// suspicious LOLBins
+type FileCorrelationConfig struct {
+	// Enabled subscribes to file creations; only the etw source has them
+	Enabled bool `yaml:"enabled"`
+	// Window is how long after a suspicious LOLBin starts the files it
+	// creates are attached to its event
+	Window Duration `yaml:"window"`
+	// MaxFiles caps the files attached to one event
+	MaxFiles int `yaml:"max_files"`
+}
+
+// Validate checks the file correlation settings
+func (c FileCorrelationConfig) Validate() error {
+	if c.Window <= 0 {
+		return fmt.Errorf("file_correlation.window must be positive")
+	}
+	if c.Window > Duration(time.Minute) {
+		return fmt.Errorf("file_correlation.window must not exceed 1m")
+	}
+	if c.MaxFiles <= 0 {
+		return fmt.Errorf("file_correlation.max_files must be positive")
+	}
+	return nil
+}
+
+// DroppedFile is a file a process created shortly after it started
+type DroppedFile struct {
+	Path      string    `json:"path"`
+	Timestamp time.Time `json:"timestamp"`
+	// Executable is set for files that run or load code
+	Executable bool `json:"executable,omitempty"`
+}
+
+// fileWatch is a suspicious event whose file creations are attached to it
+type fileWatch struct {
+	timestamp time.Time
+	rule      string
+	expires   time.Time
+	files     int
+}
+
+// fileCreation is a file creation not yet tied to an event
+type fileCreation struct {
+	processID uint32
+	path      string
+	timestamp time.Time
+}
+
+var (
+	fileWatches      = map[uint32]*fileWatch{}
+	pendingCreations []fileCreation
+	fileWatchesMutex sync.Mutex
+	dosDevicesOnce   sync.Once
+	dosDevices       map[string]string
+)
+
+// watchFileCreations attaches the files a suspicious LOLBin creates within
+// the window to its event, including those it created while the event was
+// still in detection
+func watchFileCreations(event ProcessEvent) {
+	if !config.FileCorrelation.Enabled || !event.IsLOLBin || !event.Suspicious {
+		return
+	}
+	window := time.Duration(config.FileCorrelation.Window)
+	watch := &fileWatch{timestamp: event.Timestamp, rule: event.Rule, expires: event.Timestamp.Add(window)}
+
+	fileWatchesMutex.Lock()
+	now := time.Now()
+	for pid, w := range fileWatches {
+		if now.After(w.expires) {
+			delete(fileWatches, pid)
+		}
+	}
+	var early []fileCreation
+	kept := pendingCreations[:0]
+	for _, created := range pendingCreations {
+		if created.processID == event.ProcessID {
+			early = append(early, created)
+			continue
+		}
+		kept = append(kept, created)
+	}
+	pendingCreations = kept
+	if now.Before(watch.expires) {
+		fileWatches[event.ProcessID] = watch
+	}
+	fileWatchesMutex.Unlock()
+
+	for _, created := range early {
+		attachDroppedFile(event.ProcessID, watch, created.path, created.timestamp)
+	}
+}
+
+// recordFileCreation ties a file creation to the watched event of its
+// process, or keeps it briefly for an event still in detection
+func recordFileCreation(pid uint32, path string, at time.Time) {
+	fileWatchesMutex.Lock()
+	watch, ok := fileWatches[pid]
+	if ok && at.After(watch.expires) {
+		delete(fileWatches, pid)
+		ok = false
+	}
+	if !ok {
+		if len(pendingCreations) >= pendingFileCreations {
+			n := copy(pendingCreations, pendingCreations[1:])
+			pendingCreations = pendingCreations[:n]
+		}
+		pendingCreations = append(pendingCreations, fileCreation{processID: pid, path: path, timestamp: at})
+		fileWatchesMutex.Unlock()
+		return
+	}
+	fileWatchesMutex.Unlock()
+	attachDroppedFile(pid, watch, path, at)
+}
+
+// attachDroppedFile adds a created file to the watched event, flagging
+// executables and remembering them for the download chain. The event is
+// alerted again when the file raised its severity.
+func attachDroppedFile(pid uint32, watch *fileWatch, path string, at time.Time) {
+	if at.Before(watch.timestamp) || at.After(watch.expires) {
+		return
+	}
+	fileWatchesMutex.Lock()
+	if watch.files >= config.FileCorrelation.MaxFiles {
+		fileWatchesMutex.Unlock()
+		return
+	}
+	watch.files++
+	fileWatchesMutex.Unlock()
+
+	dropped := DroppedFile{
+		Path:       path,
+		Timestamp:  at,
+		Executable: droppedExecutableExts[strings.ToLower(filepath.Ext(path))],
+	}
+	var before Severity
+	updated, ok := updateEvent(pid, watch.timestamp, func(e *ProcessEvent) {
+		before = e.Severity
+		e.DroppedFiles = append(e.DroppedFiles, dropped)
+		if !dropped.Executable {
+			return
+		}
+		e.Indicators = append(e.Indicators, Indicator{Rule: e.Rule, Type: "dropped_file", Value: path})
+		if !hasIOC(e, path) {
+			e.IOCs = append(e.IOCs, IOC{Type: IOCFile, Value: path})
+		}
+		addFinding(e, SeverityHigh, ConfidenceHigh, fmt.Sprintf("%s created executable file %s", e.Rule, path))
+		if e.Severity < SeverityHigh {
+			e.Severity = SeverityHigh
+		}
+		addTags(e, []string{"download"})
+	})
+	if !ok {
+		return
+	}
+	if dropped.Executable {
+		rememberCreatedFile(pid, watch, path)
+	}
+	if updated.Severity > before {
+		dispatchAlert(updated)
+	}
+}
+
+// rememberCreatedFile records an executable a suspicious LOLBin created so
+// that running it later chains back to the event
+func rememberCreatedFile(pid uint32, watch *fileWatch, path string) {
+	window := time.Duration(config.ChainWindow)
+	if window <= 0 {
+		return
+	}
+	droppedFilesMutex.Lock()
+	defer droppedFilesMutex.Unlock()
+	key := normalizeDropPath(path)
+	if _, ok := droppedFiles[key]; ok {
+		// The command line already named it
+		return
+	}
+	if len(droppedFiles) >= maxDroppedFiles {
+		return
+	}
+	droppedFiles[key] = droppedFile{
+		processID: pid,
+		timestamp: watch.timestamp,
+		rule:      watch.rule,
+		how:       "created",
+		expires:   time.Now().Add(window),
+	}
+}
+
+// win32Path converts an NT device path such as
+// \Device\HarddiskVolume3\Users\x.exe to its drive letter form, leaving
+// paths on unmapped devices as they are
+func win32Path(path string) string {
+	dosDevicesOnce.Do(func() {
+		dosDevices = map[string]string{}
+		buf := make([]uint16, windows.MAX_PATH)
+		for drive := 'A'; drive <= 'Z'; drive++ {
+			name, _ := windows.UTF16PtrFromString(string(drive) + ":")
+			if _, err := windows.QueryDosDevice(name, &buf[0], uint32(len(buf))); err != nil {
+				continue
+			}
+			dosDevices[strings.ToLower(windows.UTF16ToString(buf))] = string(drive) + ":"
+		}
+	})
+	lower := strings.ToLower(path)
+	for device, drive := range dosDevices {
+		if strings.HasPrefix(lower, device+`\`) {
+			return drive + path[len(device):]
+		}
+	}
+	return path
+}
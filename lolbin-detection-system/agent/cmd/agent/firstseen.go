@@ -0,0 +1,330 @@
+// firstseen.go
+// Tracking of the executables observed on the host, so a binary running for
+// the first time can be called out. The set is bounded with LRU eviction
+// and persisted to a JSON state file.
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// seenSaveInterval is how often a changed seen-set is written out
+	seenSaveInterval = time.Minute
+
+	// maxHashFileSize caps the size of executables that are hashed
+	maxHashFileSize = 64 << 20
+)
+
+// FirstSeenConfig configures first-seen executable tracking
+type FirstSeenConfig struct {
+	// StatePath is the file the seen-set is persisted to; empty keeps it in
+	// memory only
+	StatePath  string `yaml:"state_path"`
+	MaxEntries int    `yaml:"max_entries"`
+	// DetectUserWritable raises an info-severity detection when a
+	// first-seen executable runs from a user-writable directory
+	DetectUserWritable bool `yaml:"detect_user_writable"`
+}
+
+// seenEntry is one observed executable. Hash is empty when the file could
+// not be read.
+type seenEntry struct {
+	Path     string    `json:"path"`
+	Hash     string    `json:"hash,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// seenKey identifies an executable; a binary replaced in place counts as
+// new
+type seenKey struct {
+	path string
+	hash string
+}
+
+// seenSet is an LRU set of observed executables
+type seenSet struct {
+	mu      sync.Mutex
+	max     int
+	order   *list.List // of *seenEntry, most recently seen first
+	entries map[seenKey]*list.Element
+	dirty   bool
+}
+
+func newSeenSet(max int) *seenSet {
+	return &seenSet{
+		max:     max,
+		order:   list.New(),
+		entries: make(map[seenKey]*list.Element),
+	}
+}
+
+// observe records an execution and reports whether the executable had not
+// been seen before
+func (s *seenSet) observe(path, hash string, at time.Time) bool {
+	key := seenKey{path: strings.ToLower(path), hash: hash}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dirty = true
+	if elem, ok := s.entries[key]; ok {
+		elem.Value.(*seenEntry).LastSeen = at
+		s.order.MoveToFront(elem)
+		return false
+	}
+
+	s.entries[key] = s.order.PushFront(&seenEntry{Path: key.path, Hash: hash, LastSeen: at})
+	for s.order.Len() > s.max {
+		oldest := s.order.Back()
+		entry := oldest.Value.(*seenEntry)
+		delete(s.entries, seenKey{path: entry.Path, hash: entry.Hash})
+		s.order.Remove(oldest)
+	}
+	return true
+}
+
+// Len returns the number of tracked executables
+func (s *seenSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+// load reads a state file written by save. A missing file is an empty set.
+func (s *seenSet) load(path string) error {
+	var entries []seenEntry
+	if _, err := readStateFile(path, &entries); err != nil {
+		return err
+	}
+
+	// The file is ordered most recent first; replay oldest first so the
+	// LRU order survives the round trip
+	for i := len(entries) - 1; i >= 0; i-- {
+		s.observe(entries[i].Path, entries[i].Hash, entries[i].LastSeen)
+	}
+	s.mu.Lock()
+	s.dirty = false
+	s.mu.Unlock()
+	return nil
+}
+
+// save writes the set to path if it changed since the last save
+func (s *seenSet) save(path string) error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	entries := make([]seenEntry, 0, s.order.Len())
+	for elem := s.order.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, *elem.Value.(*seenEntry))
+	}
+	s.dirty = false
+	s.mu.Unlock()
+
+	return writeStateFile(path, entries)
+}
+
+// seenExecutables is the host's seen-set, set up by startFirstSeen
+var seenExecutables *seenSet
+
+// openSeenSet creates the seen-set and loads any persisted state
+func openSeenSet(cfg FirstSeenConfig) *seenSet {
+	set := newSeenSet(cfg.MaxEntries)
+	if cfg.StatePath != "" {
+		if err := set.load(cfg.StatePath); err != nil {
+			logError(4, "Starting with an empty seen-set: %v", err)
+		}
+	}
+	return set
+}
+
+// startFirstSeen loads the seen-set and saves it periodically
+func startFirstSeen(cfg FirstSeenConfig) {
+	seenExecutables = openSeenSet(cfg)
+	log.Printf("Tracking first-seen executables (%d known)", seenExecutables.Len())
+
+	if cfg.StatePath == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(seenSaveInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := seenExecutables.save(cfg.StatePath); err != nil {
+				logError(4, "%v", err)
+			}
+		}
+	}()
+}
+
+// stopFirstSeen flushes the seen-set on shutdown
+func stopFirstSeen(cfg FirstSeenConfig) {
+	if seenExecutables == nil || cfg.StatePath == "" {
+		return
+	}
+	if err := seenExecutables.save(cfg.StatePath); err != nil {
+		logError(4, "%v", err)
+	}
+}
+
+// hashCacheEntry remembers a file hash with the attributes it was taken at
+type hashCacheEntry struct {
+	hash    string
+	modTime time.Time
+	size    int64
+}
+
+var (
+	hashCache      = map[string]hashCacheEntry{}
+	hashCacheMutex sync.Mutex
+)
+
+// executableHash returns the SHA-256 of a file, or "" when the file can't
+// be read or is too large to hash on every start
+func executableHash(path string) string {
+	stat, err := os.Stat(path)
+	if err != nil || stat.Size() > maxHashFileSize {
+		return ""
+	}
+	key := strings.ToLower(path)
+
+	hashCacheMutex.Lock()
+	entry, ok := hashCache[key]
+	hashCacheMutex.Unlock()
+	if ok && entry.modTime.Equal(stat.ModTime()) && entry.size == stat.Size() {
+		return entry.hash
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return ""
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	hashCacheMutex.Lock()
+	hashCache[key] = hashCacheEntry{hash: hash, modTime: stat.ModTime(), size: stat.Size()}
+	hashCacheMutex.Unlock()
+	return hash
+}
+
+// userWritableDirs are path fragments of directories ordinary users can
+// drop binaries into
+var userWritableDirs = []string{
+	`\users\`,
+	`\windows\temp\`,
+	`\programdata\`,
+	`\$recycle.bin\`,
+}
+
+// isUserWritablePath reports whether path is in a user-writable directory
+func isUserWritablePath(path string) bool {
+	path = strings.ToLower(path)
+	for _, dir := range userWritableDirs {
+		if strings.Contains(path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUserWritableOrTempPath reports whether path is in a user-writable or
+// temporary directory, such as C:\Temp, that payloads are staged in
+func isUserWritableOrTempPath(path string) bool {
+	lower := strings.ToLower(path)
+	return isUserWritablePath(lower) || strings.Contains(lower, `\temp\`) || strings.Contains(lower, `\tmp\`)
+}
+
+// checkFirstSeen marks events for executables the host has never run
+// before. Only called for real process starts, never for ad-hoc
+// evaluations, so the seen-set reflects actual activity.
+func checkFirstSeen(event *ProcessEvent) {
+	if seenExecutables == nil || event.ExecutablePath == "" {
+		return
+	}
+	hash := executableHash(event.ExecutablePath)
+	event.FirstSeen = seenExecutables.observe(event.ExecutablePath, hash, event.Timestamp)
+	if !event.FirstSeen || !config.FirstSeen.DetectUserWritable || !isUserWritablePath(event.ExecutablePath) {
+		return
+	}
+
+	event.Indicators = append(event.Indicators, Indicator{
+		Rule:  event.Rule,
+		Type:  "first_seen",
+		Value: event.ExecutablePath,
+	})
+	// Informational only: it never raises a detection that already fired
+	reason := fmt.Sprintf("First execution of %s from a user-writable directory", event.ExecutablePath)
+	raiseConfidence(event, ConfidenceLow)
+	if event.Suspicious {
+		event.Reason += "; " + reason
+		return
+	}
+	event.Suspicious = true
+	event.Severity = SeverityInfo
+	event.Reason = reason
+}
+
+// prewarmSeen records every currently running executable as seen, so the
+// first day after installation doesn't report the host's normal workload
+func prewarmSeen(cfg FirstSeenConfig) error {
+	if cfg.StatePath == "" {
+		return nil
+	}
+	set := openSeenSet(cfg)
+
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot processes: %v", err)
+	}
+	defer windows.CloseHandle(snapshot)
+
+	now := time.Now()
+	entry := windows.ProcessEntry32{Size: uint32(unsafe.Sizeof(windows.ProcessEntry32{}))}
+	for err = windows.Process32First(snapshot, &entry); err == nil; err = windows.Process32Next(snapshot, &entry) {
+		path, err := processImagePath(entry.ProcessID)
+		if err != nil {
+			// System and protected processes can't be opened
+			continue
+		}
+		set.observe(path, executableHash(path), now)
+	}
+
+	log.Printf("Pre-warmed seen-set with %d executables", set.Len())
+	return set.save(cfg.StatePath)
+}
+
+// processImagePath returns the full executable path of a running process
+func processImagePath(pid uint32) (string, error) {
+	process, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return "", err
+	}
+	defer windows.CloseHandle(process)
+
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	if err := windows.QueryFullProcessImageName(process, 0, &buf[0], &size); err != nil {
+		return "", err
+	}
+	return windows.UTF16ToString(buf[:size]), nil
+}
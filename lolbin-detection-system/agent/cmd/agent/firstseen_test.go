@@ -0,0 +1,127 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSeenSetEviction(t *testing.T) {
+	set := newSeenSet(3)
+	at := time.Now()
+	for _, path := range []string{`C:\a.exe`, `C:\b.exe`, `C:\c.exe`} {
+		if !set.observe(path, "h", at) {
+			t.Fatalf("%s reported as seen on its first run", path)
+		}
+	}
+	// a becomes the most recent, so d evicts b
+	if set.observe(`C:\A.EXE`, "h", at) {
+		t.Error(`C:\A.EXE not matched case-insensitively`)
+	}
+	set.observe(`C:\d.exe`, "h", at)
+
+	tests := []struct {
+		path string
+		hash string
+		new  bool
+	}{
+		{`C:\a.exe`, "h", false},
+		{`C:\d.exe`, "h", false},
+		{`C:\b.exe`, "h", true},
+		{`C:\d.exe`, "replaced", true},
+	}
+	for _, tt := range tests {
+		if got := set.observe(tt.path, tt.hash, at); got != tt.new {
+			t.Errorf("observe(%s, %s) = %v, want %v", tt.path, tt.hash, got, tt.new)
+		}
+	}
+	if set.Len() != 3 {
+		t.Errorf("Len() = %d, want the bound of 3", set.Len())
+	}
+}
+
+func TestSeenSetPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seen.json")
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	set := newSeenSet(3)
+	set.observe(`C:\a.exe`, "ha", at)
+	set.observe(`C:\b.exe`, "", at.Add(time.Minute))
+	set.observe(`C:\c.exe`, "hc", at.Add(2*time.Minute))
+	set.observe(`C:\a.exe`, "ha", at.Add(3*time.Minute))
+	if err := set.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newSeenSet(3)
+	if err := loaded.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len() != 3 || loaded.dirty {
+		t.Fatalf("loaded %d entries, dirty %v, want 3 clean", loaded.Len(), loaded.dirty)
+	}
+	front := loaded.order.Front().Value.(*seenEntry)
+	if front.Path != `c:\a.exe` || front.Hash != "ha" || !front.LastSeen.Equal(at.Add(3*time.Minute)) {
+		t.Errorf("most recent entry = %+v", front)
+	}
+
+	// The LRU order survived: a new executable evicts b, the oldest
+	loaded.observe(`C:\d.exe`, "hd", at)
+	if !loaded.observe(`C:\b.exe`, "", at) {
+		t.Error(`C:\b.exe not evicted first after reloading`)
+	}
+	if loaded.observe(`C:\a.exe`, "ha", at) {
+		t.Error(`C:\a.exe lost after reloading`)
+	}
+}
+
+func TestSeenSetLoadMissing(t *testing.T) {
+	set := newSeenSet(3)
+	if err := set.load(filepath.Join(t.TempDir(), "missing.json")); err != nil || set.Len() != 0 {
+		t.Errorf("load() = %v with %d entries, want an empty set", err, set.Len())
+	}
+}
+
+func TestStopFirstSeenSaves(t *testing.T) {
+	cfg := FirstSeenConfig{StatePath: filepath.Join(t.TempDir(), "seen.json"), MaxEntries: 10}
+	saved := seenExecutables
+	t.Cleanup(func() { seenExecutables = saved })
+
+	seenExecutables = newSeenSet(cfg.MaxEntries)
+	seenExecutables.observe(`C:\Users\alice\tool.exe`, "", time.Now())
+	stopFirstSeen(cfg)
+
+	if set := openSeenSet(cfg); set.Len() != 1 {
+		t.Errorf("%d entries persisted on shutdown, want 1", set.Len())
+	}
+}
+
+func TestCheckFirstSeen(t *testing.T) {
+	withConfig(t, func(c *Config) { c.FirstSeen.DetectUserWritable = true })
+	saved := seenExecutables
+	t.Cleanup(func() { seenExecutables = saved })
+	seenExecutables = newSeenSet(10)
+
+	tests := []struct {
+		name       string
+		path       string
+		firstSeen  bool
+		suspicious bool
+	}{
+		{"user-writable", `C:\Users\alice\Downloads\tool.exe`, true, true},
+		{"user-writable again", `C:\Users\alice\Downloads\tool.exe`, false, false},
+		{"system directory", `C:\Windows\System32\whoami.exe`, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := ProcessEvent{ExecutablePath: tt.path, Timestamp: time.Now()}
+			checkFirstSeen(&event)
+			if event.FirstSeen != tt.firstSeen || event.Suspicious != tt.suspicious {
+				t.Errorf("first seen %v, suspicious %v, want %v, %v", event.FirstSeen, event.Suspicious, tt.firstSeen, tt.suspicious)
+			}
+			if tt.suspicious && (event.Severity != SeverityInfo || !hasIndicator(event, "first_seen", tt.path)) {
+				t.Errorf("severity %v, indicators %+v, want an info first_seen detection", event.Severity, event.Indicators)
+			}
+		})
+	}
+}
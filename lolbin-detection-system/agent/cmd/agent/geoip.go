@@ -0,0 +1,166 @@
+// geoip.go
+// Offline GeoIP enrichment of connection addresses with country and ASN
+// from MaxMind databases. Without the databases connections are simply not
+// enriched.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// GeoIPConfig configures connection enrichment
+type GeoIPConfig struct {
+	// CountryDB and ASNDB are GeoLite2/GeoIP2 Country (or City) and ASN
+	// database files
+	CountryDB string `yaml:"country_db"`
+	ASNDB     string `yaml:"asn_db"`
+	// ExpectedCountries are the ISO codes LOLBins normally connect to;
+	// connections elsewhere are flagged. Empty disables the check.
+	ExpectedCountries []string `yaml:"expected_countries"`
+	// BadASNs are autonomous system numbers, e.g. AS64496, whose
+	// addresses are flagged
+	BadASNs []string `yaml:"bad_asns"`
+}
+
+// geoIP holds the open databases and the parsed settings
+type geoIP struct {
+	country  *geoip2.Reader
+	asn      *geoip2.Reader
+	expected map[string]bool
+	badASNs  map[uint]bool
+}
+
+// geo is the active enrichment; nil when no database could be opened
+var geo *geoIP
+
+// parseASN reads an AS number with or without its AS prefix
+func parseASN(s string) (uint, error) {
+	s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "AS")
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid ASN %q", s)
+	}
+	return uint(n), nil
+}
+
+// Validate checks the GeoIP settings
+func (c GeoIPConfig) Validate() error {
+	for _, code := range c.ExpectedCountries {
+		if len(strings.TrimSpace(code)) != 2 {
+			return fmt.Errorf("invalid geoip.expected_countries entry %q: want an ISO 3166 code", code)
+		}
+	}
+	for _, asn := range c.BadASNs {
+		if _, err := parseASN(asn); err != nil {
+			return fmt.Errorf("invalid geoip.bad_asns entry: %v", err)
+		}
+	}
+	return nil
+}
+
+// startGeoIP opens the configured databases. A database that can't be
+// opened is logged and skipped.
+func startGeoIP(cfg GeoIPConfig) {
+	g := &geoIP{expected: make(map[string]bool), badASNs: make(map[uint]bool)}
+	for _, code := range cfg.ExpectedCountries {
+		g.expected[strings.ToUpper(strings.TrimSpace(code))] = true
+	}
+	for _, s := range cfg.BadASNs {
+		// Validated with the config
+		asn, _ := parseASN(s)
+		g.badASNs[asn] = true
+	}
+
+	var err error
+	if cfg.CountryDB != "" {
+		if g.country, err = geoip2.Open(cfg.CountryDB); err != nil {
+			logError(1, "GeoIP country database unavailable, connections won't be enriched with countries: %v", err)
+		}
+	}
+	if cfg.ASNDB != "" {
+		if g.asn, err = geoip2.Open(cfg.ASNDB); err != nil {
+			logError(1, "GeoIP ASN database unavailable, connections won't be enriched with ASNs: %v", err)
+		}
+	}
+	if g.country == nil && g.asn == nil {
+		return
+	}
+	geo = g
+	log.Printf("Enriching connections with GeoIP data")
+}
+
+// enrich fills in the country and ASN of a connection's remote address
+func (g *geoIP) enrich(conn *Connection) {
+	host, _, err := net.SplitHostPort(conn.Remote)
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return
+	}
+	if g.country != nil {
+		if record, err := g.country.Country(ip); err == nil {
+			conn.Country = record.Country.IsoCode
+		}
+	}
+	if g.asn != nil {
+		if record, err := g.asn.ASN(ip); err == nil {
+			conn.ASN = record.AutonomousSystemNumber
+			conn.ASOrg = record.AutonomousSystemOrganization
+		}
+	}
+}
+
+// enrichConnections looks up the external connections in the databases.
+// The lookups touch no event, so they run before the store is locked.
+func enrichConnections(conns []Connection) {
+	if geo == nil {
+		return
+	}
+	for i := range conns {
+		if conns[i].External {
+			geo.enrich(&conns[i])
+		}
+	}
+}
+
+// checkGeoIP flags an event's enriched connections to unexpected countries
+// or known-bad networks
+func checkGeoIP(event *ProcessEvent) {
+	if geo == nil {
+		return
+	}
+	for i := range event.Connections {
+		conn := &event.Connections[i]
+		if !conn.External {
+			continue
+		}
+
+		if conn.ASN != 0 && geo.badASNs[conn.ASN] {
+			event.Indicators = append(event.Indicators, Indicator{
+				Rule:  event.Rule,
+				Type:  "bad_asn",
+				Value: fmt.Sprintf("AS%d", conn.ASN),
+			})
+			addFinding(event, SeverityHigh, ConfidenceHigh, fmt.Sprintf("%s connected to %s in known-bad network AS%d (%s)",
+				event.Rule, conn.Remote, conn.ASN, conn.ASOrg))
+		}
+		if conn.Country != "" && len(geo.expected) > 0 && !geo.expected[conn.Country] {
+			event.Indicators = append(event.Indicators, Indicator{
+				Rule:  event.Rule,
+				Type:  "unexpected_country",
+				Value: conn.Country,
+			})
+			addFinding(event, SeverityHigh, ConfidenceMedium, fmt.Sprintf("%s connected to %s in unexpected country %s",
+				event.Rule, conn.Remote, conn.Country))
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// glob.go
+// Glob patterns for rule names and paths, compiled to regular expressions
+// when the rule set is loaded. Matching is case-insensitive as on Windows
+// file systems.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// globMatcher is a compiled glob. A single * matches within one path
+// segment, ** matches any number of segments (including none), ? matches
+// one non-separator character and [a-z] / [!a-z] are character classes.
+// Both \ and / separate segments, as they do for Windows paths.
+type globMatcher struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// isGlob reports whether a pattern uses glob metacharacters
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// compileGlob translates a glob into an anchored regular expression
+func compileGlob(pattern string) (*globMatcher, error) {
+	var expr strings.Builder
+	expr.WriteString(`(?i)^`)
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && isPathSeparator(pattern[i+1]) {
+					// **\ also matches no directory at all
+					i++
+					expr.WriteString(`(?:.*[\\/])?`)
+				} else {
+					expr.WriteString(`.*`)
+				}
+				continue
+			}
+			expr.WriteString(`[^\\/]*`)
+		case '?':
+			expr.WriteString(`[^\\/]`)
+		case '\\', '/':
+			expr.WriteString(`[\\/]`)
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid glob %q: unterminated character class", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			i += end + 1
+			if class == "" || class == "!" {
+				return nil, fmt.Errorf("invalid glob %q: empty character class", pattern)
+			}
+			expr.WriteByte('[')
+			if class[0] == '!' || class[0] == '^' {
+				expr.WriteByte('^')
+				class = class[1:]
+			}
+			for j := 0; j < len(class); j++ {
+				if class[j] == '-' && j > 0 && j < len(class)-1 {
+					expr.WriteByte('-')
+					continue
+				}
+				expr.WriteString(regexp.QuoteMeta(class[j : j+1]))
+			}
+			expr.WriteByte(']')
+		default:
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	expr.WriteByte('$')
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %v", pattern, err)
+	}
+	return &globMatcher{pattern: pattern, re: re}, nil
+}
+
+// isPathSeparator reports whether c separates path segments
+func isPathSeparator(c byte) bool {
+	return c == '\\' || c == '/'
+}
+
+// Match reports whether the whole of s matches the glob
+func (g *globMatcher) Match(s string) bool {
+	return g.re.MatchString(s)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		subject string
+		match   bool
+	}{
+		// * stays within one segment
+		{`C:\Windows\*\certutil.exe`, `C:\Windows\System32\certutil.exe`, true},
+		{`C:\Windows\*\certutil.exe`, `C:\Windows\System32\en-US\certutil.exe`, false},
+		{`C:\Windows\*\certutil.exe`, `C:\Windows\certutil.exe`, false},
+		{`*.exe`, `tool.exe`, true},
+		{`*.exe`, `tool.exe.config`, false},
+		{`C:\Program Files\*\tool.exe`, `C:\Program Files\Vendor\tool.exe`, true},
+		// ** spans any number of segments, none included
+		{`C:\Users\*\AppData\Local\Temp\**`, `C:\Users\alice\AppData\Local\Temp\a\b\x.exe`, true},
+		{`C:\Users\*\AppData\Local\Temp\**`, `C:\Users\alice\AppData\Local\Temp\x.exe`, true},
+		{`C:\Users\*\AppData\Local\Temp\**`, `C:\Users\alice\AppData\Roaming\x.exe`, false},
+		{`C:\Windows\**\certutil.exe`, `C:\Windows\certutil.exe`, true},
+		{`C:\Windows\**\certutil.exe`, `C:\Windows\WinSxS\amd64_x\certutil.exe`, true},
+		{`C:\Windows\**\certutil.exe`, `C:\Windows\WinSxS\amd64_x\certutil.exe.bak`, false},
+		{`**\temp\*.exe`, `D:\build\temp\x.exe`, true},
+		// ? is one character, never a separator
+		{`pwsh?.exe`, `pwsh7.exe`, true},
+		{`pwsh?.exe`, `pwsh.exe`, false},
+		{`C:\a?b\x.exe`, `C:\a\b\x.exe`, false},
+		// Character classes
+		{`[!c]*.exe`, `certutil.exe`, false},
+		{`[a-c]*.exe`, `certutil.exe`, true},
+		{`office1[5-6]\winword.exe`, `office16\winword.exe`, true},
+		// Case folding
+		{`C:\WINDOWS\system32\*.EXE`, `c:\windows\System32\CertUtil.exe`, true},
+		{`powershell*.exe`, `PowerShell_ISE.exe`, true},
+		// Either separator, in the pattern or the path
+		{`C:/Windows/*/certutil.exe`, `C:\Windows\System32\certutil.exe`, true},
+		{`C:\Windows\*\certutil.exe`, `C:/Windows/System32/certutil.exe`, true},
+		{`C:\Windows\*\certutil.exe`, `C:\Windows/System32\certutil.exe`, true},
+		{`C:\Windows\*.exe`, `C:\Windows/System32/certutil.exe`, false},
+		{`C:/Users/**/x.exe`, `C:\Users\alice\Desktop\x.exe`, true},
+		// Metacharacters of regular expressions are literal
+		{`C:\a+b\(x).exe`, `C:\a+b\(x).exe`, true},
+		{`C:\a+b\(x).exe`, `C:\aab\(x).exe`, false},
+	}
+	for _, tt := range tests {
+		glob, err := compileGlob(tt.pattern)
+		if err != nil {
+			t.Fatalf("compileGlob(%q) = %v", tt.pattern, err)
+		}
+		if got := glob.Match(tt.subject); got != tt.match {
+			t.Errorf("%q matching %q = %v, want %v", tt.pattern, tt.subject, got, tt.match)
+		}
+	}
+}
+
+func TestCompileGlobErrors(t *testing.T) {
+	for _, pattern := range []string{`C:\[abc`, `[]x.exe`, `[!]x.exe`} {
+		if _, err := compileGlob(pattern); err == nil || !strings.Contains(err.Error(), "character class") {
+			t.Errorf("compileGlob(%q) = %v, want a character class error", pattern, err)
+		}
+	}
+}
+
+func TestGlobExclusions(t *testing.T) {
+	exclusions, err := compileExclusions([]string{`glob:C:\Program Files\*\tool.exe`, "re:-f\\s+\\S+\\.corp\\b", "-verifyctl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		cmdLine string
+		path    string
+		matched string
+	}{
+		{"path glob", "tool.exe -run", `c:\program files\vendor\tool.exe`, `glob:C:\Program Files\*\tool.exe`},
+		{"path glob, other directory", "tool.exe -run", `c:\users\public\tool.exe`, ""},
+		{"regex", "certutil -urlcache -f pkg.corp", `c:\windows\system32\certutil.exe`, "re:-f\\s+\\S+\\.corp\\b"},
+		{"substring", "certutil -verifyctl -f", `c:\windows\system32\certutil.exe`, "-verifyctl"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matched := ""
+			for _, e := range exclusions {
+				if e.matches(tt.cmdLine, tt.path) {
+					matched = e.pattern
+					break
+				}
+			}
+			if matched != tt.matched {
+				t.Errorf("matched %q, want %q", matched, tt.matched)
+			}
+		})
+	}
+}
+
+func TestBinaryPatterns(t *testing.T) {
+	patterns, err := compileBinaryPatterns([]string{"MsMpEng.exe", `C:\Program Files\*\agent*.exe`, "C:/Tools/**/scan?.exe"}, "ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path  string
+		match string
+	}{
+		{`C:\ProgramData\Microsoft\Windows Defender\Platform\4.18\MsMpEng.exe`, "msmpeng.exe"},
+		{`C:\Program Files\Vendor\agent64.exe`, `c:\program files\*\agent*.exe`},
+		{`C:\Program Files\Vendor\bin\agent64.exe`, ""},
+		{`C:\Tools\x64\release\scan2.exe`, "c:/tools/**/scan?.exe"},
+		{`C:\Users\Public\agent.exe`, ""},
+	}
+	for _, tt := range tests {
+		if got := patterns.match(tt.path, imageName(tt.path)); got != tt.match {
+			t.Errorf("match(%s) = %q, want %q", tt.path, got, tt.match)
+		}
+	}
+}
+
+func BenchmarkGlobMatch(b *testing.B) {
+	patterns := map[string]string{
+		"star":       `c:\windows\*\certutil.exe`,
+		"doublestar": `c:\users\*\appdata\local\temp\**`,
+		"name":       `powershell*.exe`,
+	}
+	path := `C:\Users\alice\AppData\Local\Temp\7zS4A2B\setup\bin\x64\installer.exe`
+	for name, pattern := range patterns {
+		glob, err := compileGlob(pattern)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				glob.Match(path)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+// ignore.go
+// Ignore list of the rules file: binaries, by executable name or full path,
+// that are never treated as LOLBins. Coarser than per-rule exclusions, it
+// quiets a noisy host during rollout with a rules reload.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Ignore list actions
+const (
+	// ignoreRecord stores ignored processes as plain non-LOLBin events
+	ignoreRecord = "record"
+	// ignoreSkip drops ignored processes without storing them
+	ignoreSkip = "skip"
+)
+
+// IgnoreList is the ignore section of a rules file
+type IgnoreList struct {
+	// Action is record (default) or skip
+	Action string `json:"action,omitempty"`
+	// Binaries are executable names such as tool.exe, or full paths such
+	// as C:\Tools\tool.exe when they contain a backslash. Both may be
+	// globs.
+	Binaries []string `json:"binaries,omitempty"`
+}
+
+// binaryPattern is one compiled executable name or path pattern, as used by
+// the ignore list and the watchlist
+type binaryPattern struct {
+	pattern string
+	// fullPath entries match the whole executable path rather than the name
+	fullPath bool
+	glob     *globMatcher
+}
+
+// binaryPatterns is a list of executable patterns
+type binaryPatterns []binaryPattern
+
+// compiledIgnoreList is an ignore list prepared for matching
+type compiledIgnoreList struct {
+	skip    bool
+	entries binaryPatterns
+}
+
+// compileBinaryPatterns compiles executable names and full paths, either
+// of which may be globs. section names the list in errors.
+func compileBinaryPatterns(binaries []string, section string) (binaryPatterns, error) {
+	var patterns binaryPatterns
+	for _, binary := range binaries {
+		pattern := strings.ToLower(strings.TrimSpace(binary))
+		if pattern == "" {
+			return nil, fmt.Errorf("empty %s entry", section)
+		}
+		entry := binaryPattern{pattern: pattern, fullPath: strings.ContainsAny(pattern, `\/`)}
+		if isGlob(pattern) {
+			glob, err := compileGlob(pattern)
+			if err != nil {
+				return nil, err
+			}
+			entry.glob = glob
+		}
+		patterns = append(patterns, entry)
+	}
+	return patterns, nil
+}
+
+// match returns the pattern matching the executable, or "" if none does.
+// execName is the lowercased image name.
+func (p binaryPatterns) match(path, execName string) string {
+	lowerPath := strings.ToLower(path)
+	for _, entry := range p {
+		subject := execName
+		if entry.fullPath {
+			subject = lowerPath
+		}
+		if entry.glob != nil {
+			if entry.glob.Match(subject) {
+				return entry.pattern
+			}
+		} else if subject == entry.pattern {
+			return entry.pattern
+		}
+	}
+	return ""
+}
+
+// compileIgnoreList validates and compiles an ignore list
+func compileIgnoreList(list IgnoreList) (*compiledIgnoreList, error) {
+	compiled := &compiledIgnoreList{}
+	switch list.Action {
+	case "", ignoreRecord:
+	case ignoreSkip:
+		compiled.skip = true
+	default:
+		return nil, fmt.Errorf("unknown ignore action %q", list.Action)
+	}
+
+	entries, err := compileBinaryPatterns(list.Binaries, "ignore")
+	if err != nil {
+		return nil, err
+	}
+	compiled.entries = entries
+	return compiled, nil
+}
+
+// match returns the entry ignoring the executable, or "" if none does.
+// execName is the lowercased image name.
+func (l *compiledIgnoreList) match(path, execName string) string {
+	return l.entries.match(path, execName)
+}
+
+// skipIgnored reports whether ignored processes are dropped rather than
+// recorded
+func (rs *RuleSet) skipIgnored() bool {
+	return rs.ignore.skip
+}
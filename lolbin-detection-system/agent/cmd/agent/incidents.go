@@ -0,0 +1,163 @@
+// incidents.go
+// Grouping of suspicious events into incidents: detections descending from
+// the same process-tree root within a time window of each other.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Incident is a cluster of related suspicious events
+type Incident struct {
+	ID string `json:"id"`
+	// Root is the image of the topmost known process of the tree
+	Root     string    `json:"root"`
+	RootPID  uint32    `json:"root_pid"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Severity Severity  `json:"severity"`
+	// Confidence is that of the most certain event
+	Confidence int `json:"confidence"`
+	// Binaries are the distinct executables involved
+	Binaries []string `json:"binaries"`
+	// Rules and Indicators summarize what fired
+	Rules      []string `json:"rules"`
+	Indicators []string `json:"indicators"`
+	EventIDs   []uint64 `json:"event_ids"`
+}
+
+// treeRoot identifies the root of an event's process tree. When the root's
+// own event is stored, started is its start time; otherwise the root is
+// the oldest known ancestor's parent and only its PID is known.
+type treeRoot struct {
+	pid     uint32
+	started time.Time
+}
+
+// findRoot walks an event's ancestry through the stored events
+func findRoot(event *ProcessEvent, byPID map[uint32][]*ProcessEvent) (treeRoot, string) {
+	current := event
+	for depth := 0; depth < maxAncestryDepth; depth++ {
+		parent := storedParent(current, byPID)
+		if parent == nil {
+			return treeRoot{pid: current.ParentID}, current.ParentImage
+		}
+		current = parent
+	}
+	return treeRoot{pid: current.ProcessID, started: current.Timestamp}, current.ExecutablePath
+}
+
+// storedParent returns the newest stored event for the event's parent PID
+// that started no later than the event
+func storedParent(event *ProcessEvent, byPID map[uint32][]*ProcessEvent) *ProcessEvent {
+	if event.ParentID == 0 || event.ParentID == event.ProcessID {
+		return nil
+	}
+	candidates := byPID[event.ParentID]
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if !candidates[i].Timestamp.After(event.Timestamp) {
+			return candidates[i]
+		}
+	}
+	return nil
+}
+
+// buildIncidents groups the stored suspicious events. Events under the same
+// root belong to one incident as long as each follows the previous within
+// window.
+func buildIncidents(window time.Duration) []Incident {
+	eventsMutex.RLock()
+	events := make([]ProcessEvent, len(processEvents))
+	copy(events, processEvents)
+	eventsMutex.RUnlock()
+
+	byPID := make(map[uint32][]*ProcessEvent)
+	for i := range events {
+		byPID[events[i].ProcessID] = append(byPID[events[i].ProcessID], &events[i])
+	}
+
+	type group struct {
+		incident *Incident
+		last     time.Time
+	}
+	open := make(map[treeRoot]*group)
+	var incidents []*Incident
+
+	// Events are stored in arrival order, so each root's groups are built
+	// oldest first
+	for i := range events {
+		event := &events[i]
+		if !event.Suspicious {
+			continue
+		}
+		root, rootImage := findRoot(event, byPID)
+
+		g := open[root]
+		if g == nil || event.Timestamp.Sub(g.last) > window {
+			g = &group{incident: &Incident{
+				ID:      fmt.Sprintf("inc-%d", event.ID),
+				Root:    rootImage,
+				RootPID: root.pid,
+				Start:   event.Timestamp,
+			}}
+			open[root] = g
+			incidents = append(incidents, g.incident)
+		}
+		g.last = event.Timestamp
+		g.incident.add(event)
+	}
+
+	result := make([]Incident, 0, len(incidents))
+	for _, incident := range incidents {
+		incident.finish()
+		result = append(result, *incident)
+	}
+	// Newest activity first
+	sort.SliceStable(result, func(i, j int) bool { return result[i].End.After(result[j].End) })
+	return result
+}
+
+// add folds an event into the incident
+func (inc *Incident) add(event *ProcessEvent) {
+	inc.EventIDs = append(inc.EventIDs, event.ID)
+	if event.Timestamp.After(inc.End) {
+		inc.End = event.Timestamp
+	}
+	if event.Severity > inc.Severity {
+		inc.Severity = event.Severity
+	}
+	if event.Confidence > inc.Confidence {
+		inc.Confidence = event.Confidence
+	}
+	inc.Binaries = append(inc.Binaries, imageName(event.ExecutablePath))
+	if event.Rule != "" {
+		inc.Rules = append(inc.Rules, event.Rule)
+	}
+	for _, indicator := range event.Indicators {
+		inc.Indicators = append(inc.Indicators, indicator.Type)
+	}
+}
+
+// finish deduplicates and sorts the incident's summaries
+func (inc *Incident) finish() {
+	inc.Binaries = uniqueSorted(inc.Binaries)
+	inc.Rules = uniqueSorted(inc.Rules)
+	inc.Indicators = uniqueSorted(inc.Indicators)
+}
+
+// uniqueSorted returns the distinct values in sorted order, never nil
+func uniqueSorted(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := []string{}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
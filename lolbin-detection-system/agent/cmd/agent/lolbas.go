@@ -0,0 +1,244 @@
+// lolbas.go
+// Import of the LOLBAS project's YAML definitions into a rules file. The
+// import-lolbas subcommand walks a checkout of the project's yml directory
+// and turns every executable's documented commands into argument groups by
+// category, with the ATT&CK techniques they map to. The result is a
+// starting point to tune, not a finished rule set: LOLBAS documents what a
+// binary can do, not what is unusual on a given network.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// lolbasEntry is the part of a LOLBAS definition that is imported. Every
+// field is optional as far as the importer is concerned.
+type lolbasEntry struct {
+	Name     string `yaml:"Name"`
+	Commands []struct {
+		Command  string `yaml:"Command"`
+		Category string `yaml:"Category"`
+		MitreID  string `yaml:"MitreID"`
+	} `yaml:"Commands"`
+}
+
+// lolbasCategories maps LOLBAS command categories to the tags the built-in
+// rules use; the others are lowercased and hyphenated
+var lolbasCategories = map[string]string{
+	"execute":     "execution",
+	"awl bypass":  "defense-evasion",
+	"ads":         "defense-evasion",
+	"conceal":     "defense-evasion",
+	"tamper":      "defense-evasion",
+	"uac bypass":  "privilege-escalation",
+	"encode":      "obfuscation",
+	"decode":      "obfuscation",
+	"dump":        "credential-access",
+	"credentials": "credential-access",
+}
+
+// mitreTechniquePattern matches an ATT&CK technique or sub-technique ID
+var mitreTechniquePattern = regexp.MustCompile(`^T\d{4}(?:\.\d{3})?$`)
+
+// minImportedSwitchLength drops switches such as /s or -f, which as
+// substrings match nearly every command line
+const minImportedSwitchLength = 3
+
+// lolbasCategory returns the tag of a LOLBAS command category
+func lolbasCategory(category string) string {
+	category = strings.ToLower(strings.TrimSpace(category))
+	if category == "" {
+		return "uncategorized"
+	}
+	if tag, ok := lolbasCategories[category]; ok {
+		return tag
+	}
+	return strings.Join(strings.Fields(category), "-")
+}
+
+// lolbasArgs returns the suspicious arguments a documented command
+// demonstrates: its switches, cut before any inline value, and the URL
+// schemes it is fed
+func lolbasArgs(command string) []string {
+	var args []string
+	tokens := splitCommandLine(command)
+	for i, token := range tokens {
+		token = strings.ToLower(strings.Trim(token, `"'`))
+		if i == 0 || token == "" {
+			// The binary itself
+			continue
+		}
+		for _, scheme := range []string{"javascript:", "vbscript:"} {
+			if strings.HasPrefix(token, scheme) && !containsString(args, scheme) {
+				args = append(args, scheme)
+			}
+		}
+		if strings.Contains(token, "http://") || strings.Contains(token, "https://") || strings.Contains(token, "{remoteurl") {
+			for _, scheme := range []string{"http://", "https://"} {
+				if !containsString(args, scheme) {
+					args = append(args, scheme)
+				}
+			}
+		}
+		if token[0] != '-' && token[0] != '/' {
+			continue
+		}
+		if end := strings.IndexAny(token, ":="); end > 0 {
+			token = token[:end+1]
+		}
+		// Skip paths and placeholders passed where a switch could be
+		if len(token) < minImportedSwitchLength || strings.ContainsAny(token[1:], `/\{`) {
+			continue
+		}
+		if !containsString(args, token) {
+			args = append(args, token)
+		}
+	}
+	return args
+}
+
+// convertLOLBAS converts a LOLBAS definition into a rule. It reports false
+// for definitions that aren't executables or document no arguments to
+// match.
+func convertLOLBAS(entry lolbasEntry) (LOLBin, bool) {
+	name := strings.ToLower(strings.TrimSpace(entry.Name))
+	if filepath.Ext(name) != ".exe" {
+		return LOLBin{}, false
+	}
+	lolbin := LOLBin{Name: name, ArgGroups: map[string][]string{}}
+	for _, command := range entry.Commands {
+		category := lolbasCategory(command.Category)
+		args := lolbasArgs(command.Command)
+		for _, arg := range args {
+			if !containsString(lolbin.ArgGroups[category], arg) {
+				lolbin.ArgGroups[category] = append(lolbin.ArgGroups[category], arg)
+			}
+		}
+		if len(args) > 0 && !containsString(lolbin.Tags, category) {
+			lolbin.Tags = append(lolbin.Tags, category)
+		}
+		id := strings.ToUpper(strings.TrimSpace(command.MitreID))
+		if mitreTechniquePattern.MatchString(id) && !containsString(lolbin.MITRE, id) {
+			lolbin.MITRE = append(lolbin.MITRE, id)
+		}
+	}
+	if len(lolbin.ArgGroups) == 0 {
+		return LOLBin{}, false
+	}
+	for _, args := range lolbin.ArgGroups {
+		sort.Strings(args)
+	}
+	sort.Strings(lolbin.Tags)
+	sort.Strings(lolbin.MITRE)
+	return lolbin, true
+}
+
+// importLOLBAS converts the LOLBAS definitions under dir into a rules file.
+// Files that don't parse and definitions that can't be converted are
+// reported through skip and left out.
+func importLOLBAS(dir string, skip func(path, reason string)) (RulesFile, error) {
+	rules := map[string]LOLBin{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ext := strings.ToLower(filepath.Ext(path)); d.IsDir() || (ext != ".yml" && ext != ".yaml") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var entry lolbasEntry
+		if err := yaml.Unmarshal(data, &entry); err != nil {
+			skip(path, fmt.Sprintf("failed to parse: %v", err))
+			return nil
+		}
+		lolbin, ok := convertLOLBAS(entry)
+		if !ok {
+			skip(path, "not an executable with documented arguments")
+			return nil
+		}
+		if existing, ok := rules[lolbin.Name]; ok {
+			lolbin = mergeImportedLOLBins(existing, lolbin)
+		}
+		if err := validateLOLBin(lolbin); err != nil {
+			skip(path, err.Error())
+			return nil
+		}
+		rules[lolbin.Name] = lolbin
+		return nil
+	})
+	if err != nil {
+		return RulesFile{}, err
+	}
+
+	file := RulesFile{LOLBins: make([]LOLBin, 0, len(rules))}
+	for _, lolbin := range rules {
+		file.LOLBins = append(file.LOLBins, lolbin)
+	}
+	sort.Slice(file.LOLBins, func(i, j int) bool { return file.LOLBins[i].Name < file.LOLBins[j].Name })
+	return file, nil
+}
+
+// mergeImportedLOLBins combines two definitions of the same executable
+func mergeImportedLOLBins(a, b LOLBin) LOLBin {
+	for category, args := range b.ArgGroups {
+		for _, arg := range args {
+			if !containsString(a.ArgGroups[category], arg) {
+				a.ArgGroups[category] = append(a.ArgGroups[category], arg)
+			}
+		}
+		sort.Strings(a.ArgGroups[category])
+	}
+	for _, tag := range b.Tags {
+		if !containsString(a.Tags, tag) {
+			a.Tags = append(a.Tags, tag)
+		}
+	}
+	for _, id := range b.MITRE {
+		if !containsString(a.MITRE, id) {
+			a.MITRE = append(a.MITRE, id)
+		}
+	}
+	sort.Strings(a.Tags)
+	sort.Strings(a.MITRE)
+	return a
+}
+
+// runImportLOLBAS runs the import-lolbas subcommand, writing the rules file
+// to stdout, and returns the exit code
+func runImportLOLBAS(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: import-lolbas <dir>")
+		fmt.Fprintln(os.Stderr, "Converts the LOLBAS YAML definitions under dir into a rules file on stdout.")
+		fmt.Fprintln(os.Stderr, "Imported rules replace the built-in rules of the same name.")
+		return 2
+	}
+	file, err := importLOLBAS(args[0], func(path, reason string) {
+		fmt.Fprintf(os.Stderr, "Skipping %s: %s\n", path, reason)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to import LOLBAS definitions: %v\n", err)
+		return 1
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(file); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write rules: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d rules\n", len(file.LOLBins))
+	return 0
+}
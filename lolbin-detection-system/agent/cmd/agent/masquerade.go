@@ -0,0 +1,260 @@
+// masquerade.go
+// Path sanity checks for executables pretending to be something else:
+// well-known Windows process names outside their home directories,
+// trailing spaces and dots, double extensions, unusual whitespace and
+// binaries planted to exploit unquoted paths.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// KnownProcess is an entry of the rules file's well-known process table:
+// an executable name and the directories it legitimately runs from
+type KnownProcess struct {
+	Name string `json:"name"`
+	// Directories may reference environment variables such as
+	// %SystemRoot% and may be globs
+	Directories []string `json:"directories"`
+}
+
+// builtinKnownProcesses are the well-known process locations compiled into
+// the agent. Entries of the rules file override these by name.
+var builtinKnownProcesses = []KnownProcess{
+	{Name: "svchost.exe", Directories: []string{`%SystemRoot%\System32`, `%SystemRoot%\SysWOW64`}},
+	{Name: "lsass.exe", Directories: []string{`%SystemRoot%\System32`}},
+	{Name: "lsaiso.exe", Directories: []string{`%SystemRoot%\System32`}},
+	{Name: "csrss.exe", Directories: []string{`%SystemRoot%\System32`}},
+	{Name: "smss.exe", Directories: []string{`%SystemRoot%\System32`}},
+	{Name: "wininit.exe", Directories: []string{`%SystemRoot%\System32`}},
+	{Name: "winlogon.exe", Directories: []string{`%SystemRoot%\System32`}},
+	{Name: "services.exe", Directories: []string{`%SystemRoot%\System32`}},
+	{Name: "spoolsv.exe", Directories: []string{`%SystemRoot%\System32`}},
+	{Name: "taskhostw.exe", Directories: []string{`%SystemRoot%\System32`}},
+	{Name: "sihost.exe", Directories: []string{`%SystemRoot%\System32`}},
+	{Name: "dwm.exe", Directories: []string{`%SystemRoot%\System32`}},
+	{Name: "fontdrvhost.exe", Directories: []string{`%SystemRoot%\System32`}},
+	{Name: "runtimebroker.exe", Directories: []string{`%SystemRoot%\System32`}},
+	{Name: "searchindexer.exe", Directories: []string{`%SystemRoot%\System32`}},
+	{Name: "conhost.exe", Directories: []string{`%SystemRoot%\System32`}},
+	{Name: "dllhost.exe", Directories: []string{`%SystemRoot%\System32`, `%SystemRoot%\SysWOW64`}},
+	{Name: "ctfmon.exe", Directories: []string{`%SystemRoot%\System32`, `%SystemRoot%\SysWOW64`}},
+	{Name: "wmiprvse.exe", Directories: []string{`%SystemRoot%\System32\wbem`, `%SystemRoot%\SysWOW64\wbem`}},
+	{Name: "explorer.exe", Directories: []string{`%SystemRoot%`, `%SystemRoot%\SysWOW64`}},
+	{Name: "cmd.exe", Directories: []string{`%SystemRoot%\System32`, `%SystemRoot%\SysWOW64`}},
+	{Name: "rundll32.exe", Directories: []string{`%SystemRoot%\System32`, `%SystemRoot%\SysWOW64`}},
+	{Name: "regsvr32.exe", Directories: []string{`%SystemRoot%\System32`, `%SystemRoot%\SysWOW64`}},
+	{Name: "installutil.exe", Directories: dotnetFrameworkDirs},
+	{Name: "regasm.exe", Directories: dotnetFrameworkDirs},
+	{Name: "regsvcs.exe", Directories: dotnetFrameworkDirs},
+	{Name: "powershell.exe", Directories: []string{`%SystemRoot%\System32\WindowsPowerShell\v1.0`, `%SystemRoot%\SysWOW64\WindowsPowerShell\v1.0`}},
+}
+
+// dotnetFrameworkDirs are the versioned .NET Framework directories, such as
+// Framework64\v4.0.30319, that ship the framework tools
+var dotnetFrameworkDirs = []string{`%SystemRoot%\Microsoft.NET\Framework\v*`, `%SystemRoot%\Microsoft.NET\Framework64\v*`}
+
+// knownLocation is a compiled directory of a well-known process
+type knownLocation struct {
+	dir  string
+	glob *globMatcher
+}
+
+// mergeKnownProcesses merges the rules file's well-known process table into
+// the built-in one, keyed by lowercased executable name
+func mergeKnownProcesses(entries []KnownProcess) (map[string][]string, error) {
+	merged := make(map[string][]string)
+	for _, known := range builtinKnownProcesses {
+		merged[known.Name] = known.Directories
+	}
+	seen := make(map[string]bool)
+	for i, known := range entries {
+		name := strings.ToLower(strings.TrimSpace(known.Name))
+		if name == "" || strings.ContainsAny(name, `\/`) {
+			return nil, fmt.Errorf("known_processes[%d]: invalid name %q", i, known.Name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("known_processes[%d]: duplicate entry for %s", i, name)
+		}
+		if len(known.Directories) == 0 {
+			return nil, fmt.Errorf("known_processes[%d]: %s has no directories", i, name)
+		}
+		seen[name] = true
+		merged[name] = known.Directories
+	}
+	return merged, nil
+}
+
+// compileKnownProcesses merges and compiles the well-known process table
+func compileKnownProcesses(entries []KnownProcess) (map[string][]knownLocation, error) {
+	merged, err := mergeKnownProcesses(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	compiled := make(map[string][]knownLocation, len(merged))
+	for name, dirs := range merged {
+		for _, dir := range dirs {
+			location := knownLocation{dir: normalizeDropPath(dir)}
+			if isGlob(location.dir) {
+				glob, err := compileGlob(location.dir)
+				if err != nil {
+					return nil, fmt.Errorf("known_processes: %s: %v", name, err)
+				}
+				location.glob = glob
+			}
+			compiled[name] = append(compiled[name], location)
+		}
+	}
+	return compiled, nil
+}
+
+// matches reports whether a normalized directory is the location
+func (l knownLocation) matches(dir string) bool {
+	if l.glob != nil {
+		return l.glob.Match(dir)
+	}
+	return dir == l.dir
+}
+
+// documentExtensions are extensions a double-extension trick shows the user
+var documentExtensions = map[string]bool{
+	"pdf": true, "doc": true, "docx": true, "xls": true, "xlsx": true, "ppt": true,
+	"pptx": true, "rtf": true, "txt": true, "csv": true, "jpg": true, "jpeg": true,
+	"png": true, "gif": true, "mp3": true, "mp4": true, "zip": true, "rar": true,
+}
+
+// executableExtensions are extensions Windows runs when the file is opened
+var executableExtensions = map[string]bool{
+	"exe": true, "scr": true, "com": true, "pif": true, "bat": true, "cmd": true,
+	"hta": true, "js": true, "jse": true, "vbs": true, "vbe": true, "wsf": true,
+	"cpl": true, "msi": true, "lnk": true,
+}
+
+// stripWin32Prefix removes the \\?\ prefix that lets paths keep trailing
+// spaces and dots
+func stripWin32Prefix(path string) string {
+	return strings.TrimPrefix(path, `\\?\`)
+}
+
+// trailingCharComponent returns the first path component ending with a
+// space or a dot, which Win32 normally strips
+func trailingCharComponent(path string) string {
+	for _, component := range strings.Split(stripWin32Prefix(path), `\`) {
+		if component == "" || component == "." || component == ".." {
+			continue
+		}
+		if strings.HasSuffix(component, " ") || strings.HasSuffix(component, ".") {
+			return component
+		}
+	}
+	return ""
+}
+
+// doubleExtension returns a name's document and executable extensions when
+// it hides the executable one behind a document one, as in invoice.pdf.exe
+func doubleExtension(name string) (string, string, bool) {
+	parts := strings.Split(strings.ToLower(strings.TrimRight(name, " .")), ".")
+	if len(parts) < 3 {
+		return "", "", false
+	}
+	outer := parts[len(parts)-1]
+	inner := strings.TrimSpace(parts[len(parts)-2])
+	if documentExtensions[inner] && executableExtensions[outer] {
+		return inner, outer, true
+	}
+	return "", "", false
+}
+
+// unusualWhitespace returns a description of whitespace in a path that
+// hides its real shape: runs of spaces, or whitespace other than a plain
+// space
+func unusualWhitespace(path string) string {
+	if strings.Contains(path, "  ") {
+		return "run of spaces"
+	}
+	for _, r := range path {
+		switch {
+		case r == ' ':
+		case unicode.IsSpace(r), r == '\u200b', r == '\u200c', r == '\u200d', r == '\ufeff':
+			return fmt.Sprintf("whitespace character %U", r)
+		}
+	}
+	return ""
+}
+
+// unquotedPathTarget returns the directory an executable would shadow
+// through an unquoted path, like C:\Program.exe for C:\Program Files\...
+// Only drive roots and their top-level directories are searched, where
+// such plants have to live and listing them is cheap.
+func unquotedPathTarget(path string) string {
+	path = stripWin32Prefix(path)
+	dir := filepath.Dir(path)
+	if depth := strings.Count(strings.TrimRight(dir, `\`), `\`); depth > 1 {
+		return ""
+	}
+	stem := strings.ToLower(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(strings.ToLower(entry.Name()), stem+" ") {
+			return filepath.Join(dir, entry.Name())
+		}
+	}
+	return ""
+}
+
+// checkMasquerading runs the path sanity checks on any process, LOLBin or
+// not. The unquoted path check lists directories and so only runs for real
+// process starts.
+func checkMasquerading(ctx *DetectionContext, event *ProcessEvent) {
+	path := event.ExecutablePath
+	if path == "" {
+		return
+	}
+	name := strings.TrimRight(imageName(path), " .")
+
+	if locations, ok := ctx.Rules.knownProcesses[name]; ok {
+		dir := normalizeDropPath(filepath.Dir(stripWin32Prefix(path)))
+		expected := false
+		for _, location := range locations {
+			if location.matches(strings.TrimRight(dir, " .")) {
+				expected = true
+				break
+			}
+		}
+		if !expected {
+			event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "masquerade_location", Value: path})
+			addFinding(event, SeverityHigh, ConfidenceHigh, fmt.Sprintf("%s running outside its usual location: %s", name, path))
+		}
+	}
+
+	if component := trailingCharComponent(path); component != "" {
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "path_trailing_char", Value: component})
+		addFinding(event, SeverityMedium, ConfidenceMedium, fmt.Sprintf("Executable path component %q ends with a space or dot", component))
+	}
+
+	if inner, outer, ok := doubleExtension(filepath.Base(path)); ok {
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "double_extension", Value: "." + inner + "." + outer})
+		addFinding(event, SeverityHigh, ConfidenceMedium, fmt.Sprintf("Executable disguised as a .%s file: %s", inner, path))
+	}
+
+	if whitespace := unusualWhitespace(path); whitespace != "" {
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "path_whitespace", Value: whitespace})
+		addFinding(event, SeverityMedium, ConfidenceLow, fmt.Sprintf("Unusual whitespace in executable path (%s): %q", whitespace, path))
+	}
+
+	if ctx.Live {
+		if target := unquotedPathTarget(path); target != "" {
+			event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "unquoted_path", Value: target})
+			addFinding(event, SeverityHigh, ConfidenceMedium, fmt.Sprintf("%s shadows %s through unquoted paths", path, target))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckMasquerading(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		indicators []string
+	}{
+		// Well-known names outside their home directories
+		{"svchost in ProgramData", `C:\ProgramData\svchost.exe`, []string{"masquerade_location"}},
+		{"lsass in the user profile", `C:\Users\alice\AppData\Roaming\lsass.exe`, []string{"masquerade_location"}},
+		{"explorer in System32", `C:\Windows\System32\explorer.exe`, []string{"masquerade_location"}},
+		{"svchost in System32", `C:\Windows\System32\svchost.exe`, nil},
+		{"svchost in SysWOW64", `C:\Windows\SysWOW64\SVCHOST.EXE`, nil},
+		{"explorer in the Windows directory", `C:\Windows\explorer.exe`, nil},
+		{"versioned framework tool", `C:\Windows\Microsoft.NET\Framework64\v4.0.30319\InstallUtil.exe`, nil},
+		{"framework tool copied out", `C:\Users\Public\InstallUtil.exe`, []string{"masquerade_location"}},
+		// Trailing spaces and dots
+		{"trailing space directory", `\\?\C:\Users\Public\Documents \tool.exe`, []string{"path_trailing_char"}},
+		{"mock Windows directory", `\\?\C:\Windows \System32\svchost.exe`, []string{"masquerade_location", "path_trailing_char"}},
+		{"trailing dot name", `\\?\C:\Users\Public\update.exe.`, []string{"path_trailing_char"}},
+		{"dots in the middle", `C:\Program Files\Vendor 1.2\tool.exe`, nil},
+		// Double extensions
+		{"invoice.pdf.exe", `C:\Users\alice\Downloads\invoice.pdf.exe`, []string{"double_extension"}},
+		{"report.docx.scr", `C:\Users\alice\Downloads\report.docx.scr`, []string{"double_extension"}},
+		{"version in the name", `C:\Users\alice\Downloads\setup.1.2.exe`, nil},
+		{"archive tool", `C:\Program Files\7-Zip\7z.exe`, nil},
+		// Unusual whitespace
+		{"run of spaces", `C:\Users\Public\Documents\invoice      .exe`, []string{"path_whitespace"}},
+		{"no-break space", "C:\\Program\u00a0Files\\Vendor\\tool.exe", []string{"path_whitespace"}},
+		{"zero-width space", "C:\\Windows\\System32\\svc\u200bhost.exe", []string{"path_whitespace"}},
+		{"single spaces", `C:\Program Files (x86)\Common Files\tool.exe`, nil},
+	}
+	masqueradeTypes := []string{"masquerade_location", "path_trailing_char", "double_extension", "path_whitespace", "unquoted_path"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := ProcessEvent{ExecutablePath: tt.path}
+			checkMasquerading(&DetectionContext{Rules: currentRules()}, &event)
+			for _, typ := range masqueradeTypes {
+				want := slices.Contains(tt.indicators, typ)
+				if got := hasIndicator(event, typ, ""); got != want {
+					t.Errorf("%s indicator %v, want %v (%s)", typ, got, want, event.Reason)
+				}
+			}
+			if event.Suspicious != (len(tt.indicators) > 0) {
+				t.Errorf("suspicious %v, want %v", event.Suspicious, len(tt.indicators) > 0)
+			}
+		})
+	}
+}
+
+func TestKnownProcessesFromRules(t *testing.T) {
+	rules, err := loadRuleSet(writeRulesFile(t, RulesFile{KnownProcesses: []KnownProcess{
+		{Name: "Agent.exe", Directories: []string{`%ProgramFiles%\Vendor\*`}},
+		{Name: "svchost.exe", Directories: []string{`%SystemRoot%\System32`}},
+	}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		flagged bool
+	}{
+		{`C:\Program Files\Vendor\bin\agent.exe`, false},
+		{`C:\Users\Public\agent.exe`, true},
+		// The rules file's entry replaces the built-in directories
+		{`C:\Windows\SysWOW64\svchost.exe`, true},
+		// Built-in entries the file doesn't name are kept
+		{`C:\Temp\lsass.exe`, true},
+	}
+	for _, tt := range tests {
+		event := ProcessEvent{ExecutablePath: tt.path}
+		checkMasquerading(&DetectionContext{Rules: rules}, &event)
+		if flagged := hasIndicator(event, "masquerade_location", tt.path); flagged != tt.flagged {
+			t.Errorf("%s: flagged %v, want %v", tt.path, flagged, tt.flagged)
+		}
+	}
+}
+
+func TestKnownProcessesErrors(t *testing.T) {
+	tests := []struct {
+		entries []KnownProcess
+		err     string
+	}{
+		{[]KnownProcess{{Name: `C:\x\svchost.exe`, Directories: []string{`C:\x`}}}, "invalid name"},
+		{[]KnownProcess{{Name: "svchost.exe", Directories: []string{`C:\x`}}, {Name: "SVCHOST.EXE", Directories: []string{`C:\y`}}}, "duplicate entry"},
+		{[]KnownProcess{{Name: "agent.exe"}}, "no directories"},
+	}
+	for _, tt := range tests {
+		if _, err := compileKnownProcesses(tt.entries); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("compileKnownProcesses(%+v) = %v, want %q", tt.entries, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// msbuild.go
+// Inspection of the project files behind msbuild.exe detections. Inline
+// tasks compile and run arbitrary C# from a project file, a well-known
+// application allowlisting bypass, so project files from user-writable
+// locations are read and checked for them.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// projectSnippetLength caps the project file excerpt kept on the event
+const projectSnippetLength = 512
+
+// inlineTaskMarkers are lowercased fragments of inline task definitions.
+// The task factories and the Code element mean code is compiled from the
+// project itself; UsingTask alone may just reference a task assembly.
+var inlineTaskMarkers = []string{"codetaskfactory", "roslyncodetaskfactory", "<code ", "<code>"}
+
+// ProjectInspection describes the project file an msbuild event builds
+type ProjectInspection struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Markers are the inline task fragments found in the project
+	Markers []string `json:"markers,omitempty"`
+	// Snippet is an excerpt of the project around the inline task
+	Snippet string `json:"snippet,omitempty"`
+	// Error explains why the project could not be inspected, e.g. because
+	// it was already deleted
+	Error string `json:"error,omitempty"`
+}
+
+// msbuildProjectArg returns the project file argument of an msbuild
+// command line, skipping switches such as /p:Configuration=Release
+func msbuildProjectArg(cmdLine string) (string, bool) {
+	args := splitCommandLine(cmdLine)
+	for _, arg := range args[min(1, len(args)):] {
+		if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, "-") || strings.HasPrefix(arg, "@") {
+			// Switches, and response files of further switches
+			continue
+		}
+		return arg, true
+	}
+	return "", false
+}
+
+// processWorkingDirectory reads the current directory of a running process
+// from its process parameters
+func processWorkingDirectory(pid uint32) (string, error) {
+	return readProcessParameter(pid, "current directory", func(params *windows.RTL_USER_PROCESS_PARAMETERS) windows.NTUnicodeString {
+		return params.CurrentDirectory.DosPath
+	})
+}
+
+// processCommandLine reads the command line of a running process from its
+// process parameters
+func processCommandLine(pid uint32) (string, error) {
+	return readProcessParameter(pid, "command line", func(params *windows.RTL_USER_PROCESS_PARAMETERS) windows.NTUnicodeString {
+		return params.CommandLine
+	})
+}
+
+// readProcessParameter reads a string of a running process's parameters,
+// named by what for errors
+func readProcessParameter(pid uint32, what string, field func(*windows.RTL_USER_PROCESS_PARAMETERS) windows.NTUnicodeString) (string, error) {
+	var result string
+	err := withProcessParameters(pid, func(process windows.Handle, params *windows.RTL_USER_PROCESS_PARAMETERS) error {
+		value := field(params)
+		if value.Length == 0 {
+			return errors.New("empty " + what)
+		}
+		buf := make([]uint16, value.Length/2)
+		if err := windows.ReadProcessMemory(process, uintptr(unsafe.Pointer(value.Buffer)),
+			(*byte)(unsafe.Pointer(&buf[0])), uintptr(value.Length), nil); err != nil {
+			return fmt.Errorf("failed to read %s: %v", what, err)
+		}
+		result = windows.UTF16ToString(buf)
+		return nil
+	})
+	return result, err
+}
+
+// withProcessParameters reads the process parameters of a running process
+// and passes them to fn together with a handle that can read its memory
+func withProcessParameters(pid uint32, fn func(process windows.Handle, params *windows.RTL_USER_PROCESS_PARAMETERS) error) error {
+	process, err := windows.OpenProcess(windows.PROCESS_QUERY_INFORMATION|windows.PROCESS_VM_READ, false, pid)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(process)
+
+	var info windows.PROCESS_BASIC_INFORMATION
+	if err := windows.NtQueryInformationProcess(process, windows.ProcessBasicInformation,
+		unsafe.Pointer(&info), uint32(unsafe.Sizeof(info)), nil); err != nil {
+		return fmt.Errorf("failed to query process information: %v", err)
+	}
+	var peb windows.PEB
+	if err := windows.ReadProcessMemory(process, uintptr(unsafe.Pointer(info.PebBaseAddress)),
+		(*byte)(unsafe.Pointer(&peb)), unsafe.Sizeof(peb), nil); err != nil {
+		return fmt.Errorf("failed to read process environment block: %v", err)
+	}
+	var params windows.RTL_USER_PROCESS_PARAMETERS
+	if err := windows.ReadProcessMemory(process, uintptr(unsafe.Pointer(peb.ProcessParameters)),
+		(*byte)(unsafe.Pointer(&params)), unsafe.Sizeof(params), nil); err != nil {
+		return fmt.Errorf("failed to read process parameters: %v", err)
+	}
+	return fn(process, &params)
+}
+
+// resolveProjectPath makes the project path absolute. Without a project
+// argument msbuild builds the only project or solution file in its working
+// directory.
+func resolveProjectPath(project string, pid uint32) (string, error) {
+	project = expandWindowsEnv(project)
+	if project != "" && filepath.IsAbs(project) {
+		return project, nil
+	}
+	dir, err := processWorkingDirectory(pid)
+	if err != nil {
+		return "", fmt.Errorf("relative project path, working directory unknown: %v", err)
+	}
+	if project != "" {
+		return filepath.Join(dir, project), nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if !entry.IsDir() && (strings.HasSuffix(ext, "proj") || ext == ".sln") {
+			found = append(found, filepath.Join(dir, entry.Name()))
+		}
+	}
+	if len(found) != 1 {
+		return "", fmt.Errorf("no single project file in working directory %s", dir)
+	}
+	return found[0], nil
+}
+
+// projectSnippet returns an excerpt of the project starting shortly before
+// the first inline task marker
+func projectSnippet(text string, lowered string) string {
+	start := len(text)
+	for _, marker := range inlineTaskMarkers {
+		if i := strings.Index(lowered, marker); i >= 0 && i < start {
+			start = i
+		}
+	}
+	if i := strings.LastIndex(lowered[:start], "<usingtask"); i >= 0 {
+		start = i
+	}
+	end := min(start+projectSnippetLength, len(text))
+	return strings.ToValidUTF8(text[start:end], "")
+}
+
+// inspectProject reads a project file and looks for inline tasks
+func inspectProject(path string, limit int64) *ProjectInspection {
+	inspection := &ProjectInspection{Path: path}
+	data, size, err := readCapped(path, limit)
+	inspection.Size = size
+	if err != nil {
+		inspection.Error = describeFileError(err)
+		return inspection
+	}
+	inspection.SHA256 = sha256Hex(data)
+
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	lowered := strings.ToLower(text)
+	for _, marker := range inlineTaskMarkers {
+		if strings.Contains(lowered, marker) {
+			inspection.Markers = append(inspection.Markers, strings.TrimSpace(marker))
+		}
+	}
+	if len(inspection.Markers) > 0 {
+		inspection.Snippet = projectSnippet(text, lowered)
+	}
+	return inspection
+}
+
+// checkMSBuild inspects the project file of msbuild builds from
+// user-writable locations and escalates inline tasks to critical. Builds
+// are inspected whether or not the msbuild rule matched, as a relative
+// project path gives its location away only once resolved. Only called for
+// real process starts, as the project is on this host.
+func checkMSBuild(event *ProcessEvent) {
+	if config.MaxArtifactSize <= 0 || imageName(event.ExecutablePath) != "msbuild.exe" {
+		return
+	}
+	project, _ := msbuildProjectArg(event.CommandLine)
+	path, err := resolveProjectPath(project, event.ProcessID)
+	if err != nil {
+		event.ProjectFile = &ProjectInspection{Path: project, Error: err.Error()}
+		return
+	}
+	if !isUserWritableOrTempPath(path) {
+		return
+	}
+
+	inspection := inspectProject(path, config.MaxArtifactSize)
+	event.ProjectFile = inspection
+	if len(inspection.Markers) == 0 {
+		return
+	}
+	event.Indicators = append(event.Indicators, Indicator{
+		Rule:  event.Rule,
+		Type:  "inline_task",
+		Value: path,
+	})
+	addFinding(event, SeverityCritical, ConfidenceHigh, fmt.Sprintf("msbuild runs inline task code from %s (sha256 %s)",
+		path, inspection.SHA256))
+	if event.Severity < SeverityCritical {
+		event.Severity = SeverityCritical
+	}
+}
@@ -0,0 +1,449 @@
+// mshta.go
+// Analysis of the inline javascript: / vbscript: payloads mshta.exe runs.
+// The one-liners are heavily quoted, escaped and concatenated, so string
+// expressions are evaluated before the script is scanned for the objects
+// and calls that reach out to the shell, and any command line a script
+// runs is evaluated in turn.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// inlineSchemePattern matches the scheme of an mshta inline script
+var inlineSchemePattern = regexp.MustCompile(`(?i)\b(javascript|vbscript):`)
+
+// scriptAssignmentPattern matches the left-hand side of an assignment
+var scriptAssignmentPattern = regexp.MustCompile(`(?i)\b([a-z_$][\w$]*)\s*=`)
+
+// scriptRunPattern matches calls running a command line; the argument
+// starts at the end of the match
+var scriptRunPattern = regexp.MustCompile(`(?i)\.(run|exec|shellexecute)\b\s*`)
+
+// scriptEvalPattern matches calls evaluating a string as script
+var scriptEvalPattern = regexp.MustCompile(`(?i)\b(eval|executeglobal|execute)\b\s*`)
+
+// scriptGetObjectPattern matches GetObject calls, which load a remote
+// scriptlet when given a script: moniker
+var scriptGetObjectPattern = regexp.MustCompile(`(?i)\bgetobject\s*`)
+
+// scriptPrimitives are the constructs of an inline script that execute,
+// download or obfuscate, matched against the lowercased raw and
+// normalized script
+var scriptPrimitives = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	{"wscript.shell", regexp.MustCompile(`(?:activexobject|createobject)\s*\(\s*"wscript\.shell"`)},
+	{"shell.application", regexp.MustCompile(`(?:activexobject|createobject)\s*\(\s*"shell\.application"`)},
+	{"xmlhttp", regexp.MustCompile(`(?:activexobject|createobject)\s*\(\s*"(?:msxml2\.(?:server)?xmlhttp|microsoft\.xmlhttp|winhttp\.winhttprequest)[\d.]*"`)},
+	{"adodb.stream", regexp.MustCompile(`(?:activexobject|createobject)\s*\(\s*"adodb\.stream"`)},
+	{"run", regexp.MustCompile(`\.run\b`)},
+	{"exec", regexp.MustCompile(`\.exec\b`)},
+	{"shellexecute", regexp.MustCompile(`\.shellexecute\b`)},
+	{"getobject_script", regexp.MustCompile(`getobject\s*\(\s*"script:`)},
+	{"eval", regexp.MustCompile(`\b(?:eval|executeglobal|execute)\b`)},
+	{"unescape", regexp.MustCompile(`\bunescape\s*\(`)},
+	{"char_codes", regexp.MustCompile(`fromcharcode|\bchr[wb]?\s*\(`)},
+}
+
+// InlineScript is the analysis of an mshta inline script
+type InlineScript struct {
+	// Language is javascript or vbscript
+	Language string `json:"language"`
+	// Script is the unescaped script with its string expressions
+	// evaluated
+	Script     string   `json:"script"`
+	Primitives []string `json:"primitives,omitempty"`
+	// Scriptlets are the remote scriptlets loaded with GetObject
+	Scriptlets []string `json:"scriptlets,omitempty"`
+	// Commands are the command lines the script runs
+	Commands []NestedCommand `json:"commands,omitempty"`
+}
+
+// mshtaInlineScript returns the language and body of an inline script on
+// an mshta command line
+func mshtaInlineScript(cmdLine string) (string, string, bool) {
+	loc := inlineSchemePattern.FindStringSubmatchIndex(cmdLine)
+	if loc == nil {
+		return "", "", false
+	}
+	language := strings.ToLower(cmdLine[loc[2]:loc[3]])
+	body := strings.TrimSpace(cmdLine[loc[1]:])
+	if loc[0] > 0 && cmdLine[loc[0]-1] == '"' {
+		// A quoted argument: drop the closing quote and the backslash
+		// escaping of inner quotes
+		body = strings.TrimSuffix(body, `"`)
+		body = strings.ReplaceAll(body, `\"`, `"`)
+	}
+	return language, body, true
+}
+
+// percentDecode decodes %XX escapes, and %uXXXX escapes as well when
+// unicode is set, leaving malformed escapes alone
+func percentDecode(s string, unicode bool) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var decoded strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' {
+			if unicode && i+5 < len(s) && (s[i+1] == 'u' || s[i+1] == 'U') {
+				if r, err := strconv.ParseUint(s[i+2:i+6], 16, 32); err == nil {
+					decoded.WriteRune(rune(r))
+					i += 5
+					continue
+				}
+			}
+			if i+2 < len(s) {
+				if b, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+					decoded.WriteByte(byte(b))
+					i += 2
+					continue
+				}
+			}
+		}
+		decoded.WriteByte(s[i])
+	}
+	return decoded.String()
+}
+
+// scriptParser evaluates the string expressions of an inline script:
+// literals, concatenation with + or &, character codes, unescape and
+// variables assigned a string earlier on
+type scriptParser struct {
+	vbscript bool
+	vars     map[string]string
+}
+
+func skipSpace(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c == '.' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// expr evaluates the string expression starting at i and returns its value
+// and end
+func (p *scriptParser) expr(s string, i int) (string, int, bool) {
+	value, i, ok := p.term(s, i)
+	if !ok {
+		return "", 0, false
+	}
+	for {
+		j := skipSpace(s, i)
+		if j < len(s) && (s[j] == '+' || s[j] == '&') {
+			if next, k, ok := p.term(s, j+1); ok {
+				value += next
+				i = k
+				continue
+			}
+		}
+		return value, i, true
+	}
+}
+
+// term evaluates one operand of a string expression
+func (p *scriptParser) term(s string, i int) (string, int, bool) {
+	i = skipSpace(s, i)
+	if i >= len(s) {
+		return "", 0, false
+	}
+	switch c := s[i]; {
+	case c == '"' || c == '\'' && !p.vbscript:
+		return p.literal(s, i)
+	case c == '(':
+		value, j, ok := p.expr(s, i+1)
+		if j = skipSpace(s, j); !ok || j >= len(s) || s[j] != ')' {
+			return "", 0, false
+		}
+		return value, j + 1, true
+	case !isIdentByte(c) || i > 0 && isIdentByte(s[i-1]):
+		return "", 0, false
+	}
+
+	j := i
+	for j < len(s) && isIdentByte(s[j]) {
+		j++
+	}
+	ident := strings.ToLower(s[i:j])
+	open := skipSpace(s, j)
+	hasArgs := open < len(s) && s[open] == '('
+	switch {
+	case hasArgs && (ident == "string.fromcharcode" || ident == "chr" || ident == "chrw" || ident == "chrb"):
+		end := strings.IndexByte(s[open:], ')')
+		if end < 0 {
+			return "", 0, false
+		}
+		var value strings.Builder
+		for _, field := range strings.Split(s[open+1:open+end], ",") {
+			field = strings.ToLower(strings.TrimSpace(field))
+			field = strings.Replace(field, "&h", "0x", 1)
+			code, err := strconv.ParseInt(field, 0, 32)
+			if err != nil || !utf8.ValidRune(rune(code)) {
+				return "", 0, false
+			}
+			value.WriteRune(rune(code))
+		}
+		return value.String(), open + end + 1, true
+	case hasArgs && ident == "unescape":
+		value, k, ok := p.expr(s, open+1)
+		if k = skipSpace(s, k); !ok || k >= len(s) || s[k] != ')' {
+			return "", 0, false
+		}
+		return percentDecode(value, true), k + 1, true
+	case !hasArgs:
+		if value, ok := p.vars[ident]; ok {
+			return value, j, true
+		}
+	}
+	return "", 0, false
+}
+
+// literal reads the string literal opening at i. VBScript doubles quotes
+// inside strings; JavaScript escapes with backslashes.
+func (p *scriptParser) literal(s string, i int) (string, int, bool) {
+	quote := s[i]
+	var value strings.Builder
+	for j := i + 1; j < len(s); j++ {
+		c := s[j]
+		switch {
+		case c == quote && p.vbscript && j+1 < len(s) && s[j+1] == quote:
+			value.WriteByte(quote)
+			j++
+		case c == quote:
+			return value.String(), j + 1, true
+		case c == '\\' && !p.vbscript && j+1 < len(s):
+			j++
+			switch s[j] {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case 'r':
+				value.WriteByte('\r')
+			case 'x', 'u':
+				digits := 2
+				if s[j] == 'u' {
+					digits = 4
+				}
+				if j+digits < len(s) {
+					if r, err := strconv.ParseUint(s[j+1:j+1+digits], 16, 32); err == nil {
+						value.WriteRune(rune(r))
+						j += digits
+						continue
+					}
+				}
+				value.WriteByte(s[j])
+			default:
+				value.WriteByte(s[j])
+			}
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", 0, false
+}
+
+// collectVars records the variables assigned a string expression, in
+// script order so later assignments may use earlier ones
+func (p *scriptParser) collectVars(script string) {
+	for _, loc := range scriptAssignmentPattern.FindAllStringSubmatchIndex(script, -1) {
+		if loc[1] < len(script) && script[loc[1]] == '=' ||
+			loc[2] > 0 && strings.IndexByte("=!<>.", script[loc[2]-1]) >= 0 {
+			// A comparison or a property, not a variable assignment
+			continue
+		}
+		if value, _, ok := p.expr(script, loc[1]); ok {
+			p.vars[strings.ToLower(script[loc[2]:loc[3]])] = value
+		}
+	}
+}
+
+// normalize replaces every string expression of the script with the
+// double-quoted string it evaluates to. Call parentheses are kept.
+func (p *scriptParser) normalize(script string) string {
+	var normalized strings.Builder
+	for i := 0; i < len(script); {
+		if script[i] == '(' || script[i] == ' ' {
+			normalized.WriteByte(script[i])
+			i++
+			continue
+		}
+		if value, end, ok := p.expr(script, i); ok && end > i {
+			normalized.WriteString(`"` + value + `"`)
+			i = end
+			continue
+		}
+		normalized.WriteByte(script[i])
+		i++
+	}
+	return normalized.String()
+}
+
+// callArgs evaluates the first one or two string arguments of a call
+// starting at i, with or without parentheses
+func (p *scriptParser) callArgs(s string, i int, two bool) (string, string, bool) {
+	i = skipSpace(s, i)
+	if i < len(s) && s[i] == '(' {
+		i++
+	}
+	first, end, ok := p.expr(s, i)
+	if !ok {
+		return "", "", false
+	}
+	if !two {
+		return first, "", true
+	}
+	end = skipSpace(s, end)
+	if end < len(s) && s[end] == ',' {
+		if second, _, ok := p.expr(s, end+1); ok {
+			return first, second, true
+		}
+	}
+	return first, "", true
+}
+
+// analyzeScript scans a script for execution primitives, remote scriptlets
+// and the command lines it runs. Strings passed to eval or Execute are
+// analyzed as script in turn, up to maxNestingDepth levels.
+func analyzeScript(analysis *InlineScript, script string, depth int, event *ProcessEvent) {
+	p := &scriptParser{vbscript: analysis.Language == "vbscript", vars: make(map[string]string)}
+	p.collectVars(script)
+	normalized := p.normalize(script)
+	if depth == 0 {
+		analysis.Script = normalized
+	}
+
+	lowered := strings.ToLower(script) + "\n" + strings.ToLower(normalized)
+	for _, primitive := range scriptPrimitives {
+		if primitive.pattern.MatchString(lowered) && !containsString(analysis.Primitives, primitive.name) {
+			analysis.Primitives = append(analysis.Primitives, primitive.name)
+		}
+	}
+
+	for _, loc := range scriptGetObjectPattern.FindAllStringIndex(script, -1) {
+		if moniker, _, ok := p.callArgs(script, loc[1], false); ok && strings.HasPrefix(strings.ToLower(moniker), "script:") {
+			analysis.Scriptlets = append(analysis.Scriptlets, moniker[len("script:"):])
+		}
+	}
+
+	for _, loc := range scriptRunPattern.FindAllStringSubmatchIndex(script, -1) {
+		shellExecute := strings.EqualFold(script[loc[2]:loc[3]], "shellexecute")
+		file, args, ok := p.callArgs(script, loc[1], shellExecute)
+		if !ok || strings.TrimSpace(file) == "" {
+			continue
+		}
+		cmdLine := strings.TrimSpace(file)
+		if args != "" {
+			cmdLine += " " + args
+		}
+		// The same call is found again when the string holding it is
+		// analyzed after eval
+		if !containsCommand(analysis.Commands, cmdLine) {
+			analysis.Commands = append(analysis.Commands, evaluateNested(cmdLine, event))
+		}
+	}
+
+	if depth+1 >= maxNestingDepth {
+		return
+	}
+	for _, loc := range scriptEvalPattern.FindAllStringIndex(script, -1) {
+		if nested, _, ok := p.callArgs(script, loc[1], false); ok && nested != "" {
+			analyzeScript(analysis, nested, depth+1, event)
+		}
+	}
+}
+
+// containsString reports whether values contains value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// containsCommand reports whether commands contains a command line
+func containsCommand(commands []NestedCommand, cmdLine string) bool {
+	for _, command := range commands {
+		if command.CommandLine == cmdLine {
+			return true
+		}
+	}
+	return false
+}
+
+// mshtaHTAPath returns the local .hta file an mshta command line runs
+func mshtaHTAPath(cmdLine string) (string, bool) {
+	args := splitCommandLine(cmdLine)
+	for _, arg := range args[min(1, len(args)):] {
+		lower := strings.ToLower(arg)
+		if strings.HasSuffix(lower, ".hta") && !strings.Contains(lower, "://") {
+			return expandWindowsEnv(arg), true
+		}
+	}
+	return "", false
+}
+
+// checkMshta analyzes mshta inline scripts, escalating scripts that reach
+// the shell or run a flagged command, and flags HTA files run from
+// user-writable or temporary directories
+func checkMshta(ctx *DetectionContext, event *ProcessEvent) {
+	if ctx.ExecName != "mshta.exe" {
+		return
+	}
+
+	if path, ok := mshtaHTAPath(event.CommandLine); ok {
+		if isUserWritableOrTempPath(path) {
+			event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "hta_path", Value: path})
+			addFinding(event, SeverityMedium, ConfidenceMedium, fmt.Sprintf("mshta running %s from a user-writable directory", path))
+		}
+	}
+
+	language, body, ok := mshtaInlineScript(event.CommandLine)
+	if !ok {
+		return
+	}
+	if language == "javascript" {
+		// mshta decodes javascript: URLs like a browser would
+		body = percentDecode(body, false)
+	}
+	analysis := &InlineScript{Language: language}
+	analyzeScript(analysis, body, 0, event)
+	event.InlineScript = analysis
+
+	for _, primitive := range analysis.Primitives {
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "script_primitive", Value: primitive})
+	}
+	if shell := containsString(analysis.Primitives, "wscript.shell") || containsString(analysis.Primitives, "shell.application"); shell {
+		addFinding(event, SeverityHigh, ConfidenceMedium, fmt.Sprintf("mshta inline %s creates a shell object (%s)",
+			language, strings.Join(analysis.Primitives, ", ")))
+	}
+	for _, url := range analysis.Scriptlets {
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "remote_scriptlet", Value: url})
+		addFinding(event, SeverityHigh, ConfidenceHigh, fmt.Sprintf("mshta inline %s loads a remote scriptlet from %s", language, url))
+	}
+	for _, command := range analysis.Commands {
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "embedded_command", Value: command.CommandLine})
+		if command.Rule == "" {
+			continue
+		}
+		severity := max(SeverityHigh, command.Severity)
+		addFinding(event, severity, ConfidenceHigh, fmt.Sprintf("mshta inline %s runs a command flagged by %s: %s",
+			language, command.Rule, command.CommandLine))
+		if event.Severity < severity {
+			event.Severity = severity
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// netconn.go
+// Best-effort correlation of processes with their outbound TCP connections
+// using the IP Helper API's owner-PID TCP tables
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	tcpTableOwnerPIDAll = 5
+	afInet              = 2
+	afInet6             = 23
+
+	tcp4RowSize = 24
+	tcp6RowSize = 56
+
+	// connectionPollInterval is how often the TCP table is sampled while
+	// correlating a new process
+	connectionPollInterval = 500 * time.Millisecond
+)
+
+var (
+	iphlpapi                = windows.NewLazySystemDLL("iphlpapi.dll")
+	procGetExtendedTcpTable = iphlpapi.NewProc("GetExtendedTcpTable")
+)
+
+// Connection is an outbound TCP connection owned by a process
+type Connection struct {
+	Remote   string `json:"remote"`
+	External bool   `json:"external"`
+	// Country, ASN and ASOrg are filled in from the GeoIP databases
+	Country string `json:"country,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// getTCPTable returns the raw owner-PID TCP table for an address family
+func getTCPTable(family uint32) ([]byte, error) {
+	size := uint32(0)
+	for attempt := 0; attempt < 3; attempt++ {
+		var buf []byte
+		var ptr uintptr
+		if size > 0 {
+			buf = make([]byte, size)
+			ptr = uintptr(unsafe.Pointer(&buf[0]))
+		}
+		ret, _, _ := procGetExtendedTcpTable.Call(ptr, uintptr(unsafe.Pointer(&size)), 0,
+			uintptr(family), tcpTableOwnerPIDAll, 0)
+		switch windows.Errno(ret) {
+		case windows.ERROR_SUCCESS:
+			if buf == nil {
+				return nil, nil
+			}
+			return buf[:size], nil
+		case windows.ERROR_INSUFFICIENT_BUFFER:
+			// The table can grow between calls; retry with the new size
+			continue
+		default:
+			return nil, fmt.Errorf("GetExtendedTcpTable failed: %v", windows.Errno(ret))
+		}
+	}
+	return nil, fmt.Errorf("GetExtendedTcpTable: table kept growing")
+}
+
+// processConnections returns the connections with a remote endpoint owned
+// by pid
+func processConnections(pid uint32) ([]Connection, error) {
+	var conns []Connection
+
+	table, err := getTCPTable(afInet)
+	if err != nil {
+		return nil, err
+	}
+	if len(table) >= 4 {
+		count := binary.LittleEndian.Uint32(table)
+		for i := uint32(0); i < count; i++ {
+			row := table[4+i*tcp4RowSize:]
+			if len(row) < tcp4RowSize || binary.LittleEndian.Uint32(row[20:]) != pid {
+				continue
+			}
+			ip := net.IP(row[12:16])
+			port := binary.BigEndian.Uint16(row[16:18])
+			if ip.IsUnspecified() {
+				continue
+			}
+			conns = append(conns, newConnection(ip, port))
+		}
+	}
+
+	table, err = getTCPTable(afInet6)
+	if err != nil {
+		return conns, err
+	}
+	if len(table) >= 4 {
+		count := binary.LittleEndian.Uint32(table)
+		for i := uint32(0); i < count; i++ {
+			row := table[4+i*tcp6RowSize:]
+			if len(row) < tcp6RowSize || binary.LittleEndian.Uint32(row[52:]) != pid {
+				continue
+			}
+			ip := net.IP(row[24:40])
+			port := binary.BigEndian.Uint16(row[44:46])
+			if ip.IsUnspecified() {
+				continue
+			}
+			conns = append(conns, newConnection(ip, port))
+		}
+	}
+
+	return conns, nil
+}
+
+// newConnection builds a Connection, classifying the remote address
+func newConnection(ip net.IP, port uint16) Connection {
+	ip = append(net.IP(nil), ip...)
+	return Connection{
+		Remote:   net.JoinHostPort(ip.String(), fmt.Sprint(port)),
+		External: isExternalIP(ip),
+	}
+}
+
+// isExternalIP reports whether ip is a routable public address
+func isExternalIP(ip net.IP) bool {
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// correlateConnections samples the TCP table for the event's process until
+// the configured window elapses, then attaches any connections seen to the
+// stored event. It runs in the background and never blocks detection.
+func correlateConnections(event ProcessEvent) {
+	window := time.Duration(config.ConnectionWindow)
+	if window <= 0 {
+		return
+	}
+
+	go func() {
+		seen := make(map[string]bool)
+		var conns []Connection
+		deadline := time.Now().Add(window)
+
+		for time.Now().Before(deadline) {
+			found, err := processConnections(event.ProcessID)
+			if err != nil {
+				log.Printf("Connection lookup for PID %d failed: %v", event.ProcessID, err)
+				return
+			}
+			for _, conn := range found {
+				if !seen[conn.Remote] {
+					seen[conn.Remote] = true
+					conns = append(conns, conn)
+				}
+			}
+			time.Sleep(connectionPollInterval)
+		}
+
+		if len(conns) == 0 {
+			return
+		}
+		enrichConnections(conns)
+
+		var raised bool
+		updated, ok := updateEvent(event.ProcessID, event.Timestamp, func(e *ProcessEvent) {
+			raised = attachConnections(e, conns)
+		})
+
+		// A connection that made the event suspicious, or more severe,
+		// deserves an alert
+		if ok && raised {
+			dispatchAlert(updated)
+		}
+	}()
+}
+
+// attachConnections records enriched connections on an event and flags
+// the external ones. It reports whether they made the event suspicious or
+// raised its severity.
+func attachConnections(e *ProcessEvent, conns []Connection) bool {
+	wasSuspicious, severity := e.Suspicious, e.Severity
+
+	e.Connections = conns
+	for _, conn := range conns {
+		if !conn.External {
+			continue
+		}
+		e.Indicators = append(e.Indicators, Indicator{
+			Rule:  e.Rule,
+			Type:  "external_connection",
+			Value: conn.Remote,
+		})
+		addFinding(e, SeverityMedium, ConfidenceMedium, fmt.Sprintf("%s connected to external address %s", e.Rule, conn.Remote))
+		break
+	}
+	checkGeoIP(e)
+
+	return e.Suspicious && (!wasSuspicious || e.Severity > severity)
+}
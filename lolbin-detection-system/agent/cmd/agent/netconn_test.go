@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAttachConnections(t *testing.T) {
+	saved := geo
+	geo = &geoIP{expected: map[string]bool{"US": true}, badASNs: map[uint]bool{64496: true}}
+	t.Cleanup(func() { geo = saved })
+
+	internal := newConnection(net.ParseIP("10.0.0.5"), 445)
+	external := newConnection(net.ParseIP("203.0.113.7"), 443)
+	expected := external
+	expected.Country, expected.ASN = "US", 64500
+	badASN := external
+	badASN.Country, badASN.ASN = "US", 64496
+
+	tests := []struct {
+		name     string
+		event    ProcessEvent
+		conns    []Connection
+		raised   bool
+		severity Severity
+	}{
+		{"internal only", ProcessEvent{Rule: "certutil.exe"}, []Connection{internal}, false, 0},
+		{"external makes suspicious", ProcessEvent{Rule: "certutil.exe"}, []Connection{internal, expected}, true, SeverityMedium},
+		{"external raises severity", ProcessEvent{Rule: "certutil.exe", Suspicious: true, Severity: SeverityMedium}, []Connection{expected}, true, SeverityHigh},
+		{"already critical", ProcessEvent{Rule: "certutil.exe", Suspicious: true, Severity: SeverityCritical}, []Connection{expected}, false, SeverityCritical},
+		{"known-bad network", ProcessEvent{Rule: "certutil.exe"}, []Connection{badASN}, true, SeverityHigh},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := tt.event
+			raised := attachConnections(&event, tt.conns)
+			if raised != tt.raised || event.Severity != tt.severity {
+				t.Errorf("attachConnections() = %v, severity %v, want %v, %v", raised, event.Severity, tt.raised, tt.severity)
+			}
+			if len(event.Connections) != len(tt.conns) {
+				t.Errorf("%d connections recorded, want %d", len(event.Connections), len(tt.conns))
+			}
+		})
+	}
+}
+
+func TestIsExternalIP(t *testing.T) {
+	tests := []struct {
+		ip       string
+		external bool
+	}{
+		{"203.0.113.7", true},
+		{"2001:db8::1", true},
+		{"10.1.2.3", false},
+		{"192.168.0.1", false},
+		{"127.0.0.1", false},
+		{"169.254.10.1", false},
+		{"fe80::1", false},
+		{"::", false},
+	}
+	for _, tt := range tests {
+		if got := isExternalIP(net.ParseIP(tt.ip)); got != tt.external {
+			t.Errorf("isExternalIP(%s) = %v, want %v", tt.ip, got, tt.external)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// netsh.go
+// Detection of netsh helper DLL persistence and packet capture. netsh add
+// helper registers a DLL under HKLM\SOFTWARE\Microsoft\NetSh that is loaded
+// every time netsh runs, which is quiet persistence in a signed binary.
+// netsh trace start capture=yes records the host's traffic, credentials
+// in cleartext protocols included.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NetshHelper describes the helper DLL a netsh add helper event registers
+type NetshHelper struct {
+	BinaryInspection
+	// InSystem32 is set when the DLL is in System32, where the helpers
+	// shipped with Windows live
+	InSystem32 bool `json:"in_system32"`
+}
+
+// NetshTrace describes a netsh trace start event
+type NetshTrace struct {
+	Capture    bool   `json:"capture"`
+	TraceFile  string `json:"trace_file,omitempty"`
+	Persistent bool   `json:"persistent,omitempty"`
+}
+
+// registeredHelper is a helper DLL registered by a recent netsh event
+type registeredHelper struct {
+	processID uint32
+	timestamp time.Time
+	expires   time.Time
+}
+
+var (
+	registeredHelpers      = map[string]registeredHelper{}
+	registeredHelpersMutex sync.Mutex
+)
+
+// system32Dir returns the System32 directory
+func system32Dir() string {
+	root := os.Getenv("SystemRoot")
+	if root == "" {
+		root = `C:\Windows`
+	}
+	return filepath.Join(root, "System32")
+}
+
+// resolveHelperPath resolves a helper DLL argument the way netsh loads it:
+// a bare name is found in System32
+func resolveHelperPath(dll string) string {
+	path := expandWindowsEnv(strings.Trim(dll, `"`))
+	if !filepath.IsAbs(path) && !strings.HasPrefix(path, `\\`) {
+		path = filepath.Join(system32Dir(), path)
+	}
+	return path
+}
+
+// parseNetshHelper returns the DLL argument of netsh add helper
+func parseNetshHelper(args []string) (string, bool) {
+	for i := 1; i+2 < len(args); i++ {
+		if strings.EqualFold(args[i], "add") && strings.EqualFold(args[i+1], "helper") {
+			dll := args[i+2]
+			if name, value, ok := strings.Cut(dll, "="); ok && strings.EqualFold(name, "dllname") {
+				dll = value
+			}
+			return dll, dll != ""
+		}
+	}
+	return "", false
+}
+
+// parseNetshTrace returns the options of netsh trace start
+func parseNetshTrace(args []string) (*NetshTrace, bool) {
+	for i := 1; i+1 < len(args); i++ {
+		if !strings.EqualFold(args[i], "trace") || !strings.EqualFold(args[i+1], "start") {
+			continue
+		}
+		trace := &NetshTrace{}
+		for _, arg := range args[i+2:] {
+			name, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				continue
+			}
+			switch strings.ToLower(name) {
+			case "capture":
+				trace.Capture = strings.EqualFold(value, "yes")
+			case "tracefile":
+				trace.TraceFile = expandWindowsEnv(value)
+			case "persistent":
+				trace.Persistent = strings.EqualFold(value, "yes")
+			}
+		}
+		return trace, true
+	}
+	return nil, false
+}
+
+// unusualTraceFile reports whether a capture file is written somewhere
+// other than the default NetTraces directory: a share, a staging
+// directory, or a file not named like a trace
+func unusualTraceFile(path string) bool {
+	lower := strings.ToLower(path)
+	if strings.Contains(lower, `\nettraces\`) {
+		return false
+	}
+	return strings.HasPrefix(lower, `\\`) || isUserWritableOrTempPath(path) || filepath.Ext(lower) != ".etl"
+}
+
+// checkNetsh flags netsh registering helper DLLs from outside System32 or
+// unsigned ones, and packet captures written to unusual locations. The DLL
+// is only inspected for real process starts, as it is on this host.
+func checkNetsh(ctx *DetectionContext, event *ProcessEvent) {
+	if ctx.ExecName != "netsh.exe" {
+		return
+	}
+	args := splitCommandLine(event.CommandLine)
+
+	if dll, ok := parseNetshHelper(args); ok {
+		path := resolveHelperPath(dll)
+		helper := &NetshHelper{
+			BinaryInspection: BinaryInspection{Path: path},
+			InSystem32:       strings.HasPrefix(normalizeDropPath(path), normalizeDropPath(system32Dir())+`\`),
+		}
+		if ctx.Live {
+			helper.BinaryInspection = inspectBinary(path, config.MaxArtifactSize)
+			rememberNetshHelper(event, path)
+		}
+		event.NetshHelper = helper
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "netsh_helper", Value: path})
+
+		hash := ""
+		if helper.SHA256 != "" {
+			hash = fmt.Sprintf(" (sha256 %s)", helper.SHA256)
+		}
+		if !helper.InSystem32 {
+			addFinding(event, SeverityHigh, ConfidenceHigh, fmt.Sprintf("netsh registers helper DLL %s from outside System32%s", path, hash))
+		}
+		if helper.SignatureStatus != "" && !helper.Signed {
+			reason := fmt.Sprintf("netsh registers unsigned helper DLL %s%s", path, hash)
+			if helper.SignatureStatus != signatureUnsigned {
+				reason = fmt.Sprintf("netsh registers helper DLL %s (signature %s)%s", path, helper.SignatureStatus, hash)
+			}
+			addFinding(event, SeverityHigh, ConfidenceHigh, reason)
+		}
+		if event.Suspicious && event.Severity < SeverityHigh {
+			event.Severity = SeverityHigh
+		}
+		addTags(event, []string{"persistence"})
+	}
+
+	if trace, ok := parseNetshTrace(args); ok {
+		event.NetshTrace = trace
+		if trace.Capture && trace.TraceFile != "" && unusualTraceFile(trace.TraceFile) {
+			event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "trace_file", Value: trace.TraceFile})
+			addFinding(event, SeverityMedium, ConfidenceMedium, fmt.Sprintf("netsh captures packets to %s", trace.TraceFile))
+			addTags(event, []string{"collection"})
+		}
+	}
+}
+
+// rememberNetshHelper remembers a registered helper DLL for ChainWindow, so
+// a following registry write naming it can be linked to the netsh event
+func rememberNetshHelper(event *ProcessEvent, path string) {
+	window := time.Duration(config.ChainWindow)
+	if window <= 0 {
+		return
+	}
+	now := time.Now()
+	registeredHelpersMutex.Lock()
+	defer registeredHelpersMutex.Unlock()
+	for key, helper := range registeredHelpers {
+		if now.After(helper.expires) {
+			delete(registeredHelpers, key)
+		}
+	}
+	registeredHelpers[normalizeDropPath(path)] = registeredHelper{
+		processID: event.ProcessID,
+		timestamp: event.Timestamp,
+		expires:   now.Add(window),
+	}
+}
+
+// correlateNetshHelper links a registry write to the NetSh key with the
+// netsh add helper event that registered the same DLL, raising both
+func correlateNetshHelper(event *ProcessEvent, write RegistryWrite) {
+	path := normalizeDropPath(resolveHelperPath(write.Data))
+	registeredHelpersMutex.Lock()
+	helper, ok := registeredHelpers[path]
+	if ok && time.Now().After(helper.expires) {
+		delete(registeredHelpers, path)
+		ok = false
+	}
+	registeredHelpersMutex.Unlock()
+	if !ok {
+		return
+	}
+
+	event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "netsh_helper", Value: path})
+	addFinding(event, SeverityHigh, ConfidenceHigh, fmt.Sprintf("Registry write confirms helper DLL %s registered by netsh (PID %d)", path, helper.processID))
+	updateEvent(helper.processID, helper.timestamp, func(netsh *ProcessEvent) {
+		addFinding(netsh, SeverityHigh, ConfidenceHigh, fmt.Sprintf("Helper DLL %s was written to the NetSh key (PID %d)", path, event.ProcessID))
+	})
+}
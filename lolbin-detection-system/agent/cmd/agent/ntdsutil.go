@@ -0,0 +1,171 @@
+// ntdsutil.go
+// Detection of Install From Media creation with ntdsutil. ntdsutil ifm
+// "create full <dir>" writes a copy of ntds.dit and the SYSTEM hive, which
+// is the whole AD credential database. Domain controller backups do the
+// same, so configured backup parents and destinations are exempted, with
+// the exemption recorded on the event.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// NTDSBackupConfig describes the legitimate IFM backups of the domain
+// controllers. When both lists are set, an IFM creation is only exempt if
+// it matches both.
+type NTDSBackupConfig struct {
+	// Parents are backup agent executable names or full paths, possibly
+	// globs, that start ntdsutil
+	Parents []string `yaml:"parents"`
+	// PathPrefixes are the directories backups write their media to
+	PathPrefixes []string `yaml:"path_prefixes"`
+}
+
+// Validate checks the backup parents and path prefixes
+func (c NTDSBackupConfig) Validate() error {
+	if _, err := compileBinaryPatterns(c.Parents, "ntds_backups.parents"); err != nil {
+		return err
+	}
+	for _, prefix := range c.PathPrefixes {
+		if strings.Trim(prefix, `\/ `) == "" {
+			return fmt.Errorf("empty ntds_backups.path_prefixes entry")
+		}
+	}
+	return nil
+}
+
+// ntdsBackupParents is compiled from the configuration at startup
+var ntdsBackupParents binaryPatterns
+
+// IFMMedia describes the Install From Media set an ntdsutil event creates
+type IFMMedia struct {
+	// Mode is full or rodc, prefixed by "sysvol " when SYSVOL is included
+	Mode      string `json:"mode"`
+	OutputDir string `json:"output_dir,omitempty"`
+	// Exception is the backup exemption that kept the event from being
+	// flagged
+	Exception string `json:"exception,omitempty"`
+}
+
+// abbreviates reports whether word is an ntdsutil abbreviation of command
+// at least min characters long. ntdsutil accepts any prefix that is unique
+// in its menu.
+func abbreviates(word, command string, min int) bool {
+	return len(word) >= min && strings.HasPrefix(command, strings.ToLower(word))
+}
+
+// parseNTDSUtilIFM finds the ifm and create commands in an ntdsutil command
+// line. Each argument is one or more menu commands, so the words of all
+// arguments are scanned in order; the output directory is the rest of the
+// create command's argument, or the next argument.
+func parseNTDSUtilIFM(cmdLine string) (*IFMMedia, bool) {
+	args := splitCommandLine(cmdLine)
+	var groups [][]string
+	for _, arg := range args[min(1, len(args)):] {
+		groups = append(groups, strings.Fields(arg))
+	}
+
+	inIFM := false
+	for g, words := range groups {
+		for i := 0; i < len(words); i++ {
+			// ifm is always the first word of its command
+			if i == 0 && abbreviates(words[i], "ifm", 1) {
+				inIFM = true
+				continue
+			}
+			if !inIFM || !abbreviates(words[i], "create", 2) {
+				continue
+			}
+			rest := words[i+1:]
+			media := &IFMMedia{}
+			if len(rest) > 0 && abbreviates(rest[0], "sysvol", 2) {
+				media.Mode = "sysvol "
+				rest = rest[1:]
+			}
+			switch {
+			case len(rest) > 0 && abbreviates(rest[0], "full", 1):
+				media.Mode += "full"
+			case len(rest) > 0 && abbreviates(rest[0], "rodc", 1):
+				media.Mode += "rodc"
+			default:
+				continue
+			}
+			dir := strings.Join(rest[1:], " ")
+			if dir == "" && g+1 < len(groups) {
+				dir = strings.Join(groups[g+1], " ")
+			}
+			media.OutputDir = expandWindowsEnv(strings.Trim(dir, `"'`))
+			return media, true
+		}
+	}
+	return nil, false
+}
+
+// ntdsBackupException returns the configured backup exemption covering an
+// IFM creation, if any
+func ntdsBackupException(event *ProcessEvent, dir string) (string, bool) {
+	backups := config.NTDSBackups
+	if len(backups.Parents) == 0 && len(backups.PathPrefixes) == 0 {
+		return "", false
+	}
+	var parts []string
+	if len(backups.Parents) > 0 {
+		match := ntdsBackupParents.match(event.ParentImage, imageName(event.ParentImage))
+		if match == "" {
+			return "", false
+		}
+		parts = append(parts, "parent "+match)
+	}
+	if len(backups.PathPrefixes) > 0 {
+		target := normalizeDropPath(dir)
+		if dir == "" || strings.Contains(target+`\`, `\..\`) {
+			return "", false
+		}
+		matched := ""
+		for _, prefix := range backups.PathPrefixes {
+			if p := normalizeDropPath(prefix); target == p || strings.HasPrefix(target, strings.TrimSuffix(p, `\`)+`\`) {
+				matched = prefix
+				break
+			}
+		}
+		if matched == "" {
+			return "", false
+		}
+		parts = append(parts, "path prefix "+matched)
+	}
+	return "ntds_backups: " + strings.Join(parts, ", "), true
+}
+
+// checkNTDSUtil flags ntdsutil creating IFM media as critical credential
+// access, unless a configured backup exemption covers it
+func checkNTDSUtil(ctx *DetectionContext, event *ProcessEvent) {
+	if ctx.ExecName != "ntdsutil.exe" {
+		return
+	}
+	media, ok := parseNTDSUtilIFM(event.CommandLine)
+	if !ok {
+		return
+	}
+	event.IFMMedia = media
+	event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "ifm_output", Value: media.OutputDir, Category: "credential-access"})
+
+	if exception, ok := ntdsBackupException(event, media.OutputDir); ok {
+		media.Exception = exception
+		if event.ExcludedBy == "" {
+			event.ExcludedBy = exception
+		}
+		log.Printf("ntdsutil IFM creation in %s (PID %d, parent %s) exempted by %s",
+			media.OutputDir, event.ProcessID, filepath.Base(event.ParentImage), exception)
+		return
+	}
+
+	addFinding(event, SeverityCritical, ConfidenceHigh, fmt.Sprintf("ntdsutil creates %s IFM media of the AD database in %s", media.Mode, media.OutputDir))
+	if event.Severity < SeverityCritical {
+		event.Severity = SeverityCritical
+	}
+	addTags(event, []string{"credential-access"})
+}
@@ -0,0 +1,208 @@
+// odbcconf.go
+// Detection of DLL registration through odbcconf. The REGSVR action calls
+// a DLL's DllRegisterServer and INSTALLDRIVER loads the driver's setup
+// DLL, both from a signed Windows binary. Actions come from /a {...} blocks
+// on the command line or, with /f, from a response file, which is read so
+// the DLLs it names are seen too.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxResponseFileSize caps the odbcconf response file read
+const maxResponseFileSize = 64 << 10
+
+// odbcconfActionBlock matches the {action} blocks on a command line
+var odbcconfActionBlock = regexp.MustCompile(`\{([^}]*)\}`)
+
+// odbcconfDriverKeys are the keys of an INSTALLDRIVER specification naming
+// DLLs the driver install loads
+var odbcconfDriverKeys = map[string]bool{"driver": true, "setup": true}
+
+// ODBCConf describes the DLLs an odbcconf event registers
+type ODBCConf struct {
+	// ResponseFile is the /f file actions were read from, hashed when it
+	// could be read
+	ResponseFile   string        `json:"response_file,omitempty"`
+	ResponseSHA256 string        `json:"response_sha256,omitempty"`
+	ResponseError  string        `json:"response_error,omitempty"`
+	DLLs           []ODBCConfDLL `json:"dlls,omitempty"`
+}
+
+// ODBCConfDLL is a DLL loaded by an odbcconf action
+type ODBCConfDLL struct {
+	BinaryInspection
+	// Verb is the action loading the DLL, REGSVR or INSTALLDRIVER
+	Verb string `json:"verb"`
+	// FromResponseFile is set when the action came from the response file
+	FromResponseFile bool `json:"from_response_file,omitempty"`
+	// Trusted is set when the DLL is under Program Files or Windows
+	Trusted bool `json:"trusted"`
+}
+
+// odbcconfDLLs returns the verb and DLL paths of an odbcconf action such as
+// REGSVR c:\temp\evil.dll or INSTALLDRIVER "name|Driver=c:\x.dll|Setup=..."
+func odbcconfDLLs(action string) (string, []string) {
+	action = strings.TrimSpace(strings.Trim(strings.TrimSpace(action), "{}"))
+	verb, rest, _ := strings.Cut(action, " ")
+	verb = strings.ToUpper(verb)
+	rest = strings.Trim(strings.TrimSpace(rest), `"`)
+	switch verb {
+	case "REGSVR":
+		if rest != "" {
+			return verb, []string{rest}
+		}
+	case "INSTALLDRIVER":
+		var dlls []string
+		for _, field := range strings.Split(rest, "|") {
+			key, value, ok := strings.Cut(field, "=")
+			if ok && odbcconfDriverKeys[strings.ToLower(strings.TrimSpace(key))] && strings.TrimSpace(value) != "" {
+				dlls = append(dlls, strings.TrimSpace(value))
+			}
+		}
+		return verb, dlls
+	}
+	return verb, nil
+}
+
+// parseODBCConf returns the action blocks and the response file of an
+// odbcconf command line
+func parseODBCConf(cmdLine string) ([]string, string) {
+	var actions []string
+	args := splitCommandLine(cmdLine)
+	responseFile := ""
+	hasActions := false
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "/a", "-a":
+			hasActions = true
+		case "/f", "-f":
+			if i+1 < len(args) {
+				i++
+				responseFile = args[i]
+			}
+		}
+	}
+	if hasActions {
+		for _, match := range odbcconfActionBlock.FindAllStringSubmatch(cmdLine, -1) {
+			actions = append(actions, match[1])
+		}
+	}
+	return actions, responseFile
+}
+
+// responseFileActions returns the actions of a response file, one per line
+func responseFileActions(data []byte) []string {
+	var actions []string
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			actions = append(actions, line)
+		}
+	}
+	return actions
+}
+
+// resolveODBCConfPath makes a path from an odbcconf event absolute against
+// the process's working directory when it is on this host
+func resolveODBCConfPath(ctx *DetectionContext, event *ProcessEvent, path string) string {
+	path = expandWindowsEnv(strings.Trim(path, `"`))
+	if !filepath.IsAbs(path) && !strings.HasPrefix(path, `\\`) && ctx.Live {
+		if dir, err := processWorkingDirectory(event.ProcessID); err == nil {
+			path = filepath.Join(dir, path)
+		}
+	}
+	return path
+}
+
+// checkODBCConf flags odbcconf loading DLLs through REGSVR and
+// INSTALLDRIVER actions, weighing DLLs from outside Program Files and
+// Windows and unsigned ones heavier. The response file and DLLs are only
+// read for real process starts, as they are on this host.
+func checkODBCConf(ctx *DetectionContext, event *ProcessEvent) {
+	if ctx.ExecName != "odbcconf.exe" {
+		return
+	}
+	actions, responseFile := parseODBCConf(event.CommandLine)
+	odbcconf := &ODBCConf{}
+	fromResponse := len(actions)
+	if responseFile != "" {
+		odbcconf.ResponseFile = resolveODBCConfPath(ctx, event, responseFile)
+		if ctx.Live {
+			data, _, err := readCapped(odbcconf.ResponseFile, maxResponseFileSize)
+			if err != nil {
+				odbcconf.ResponseError = describeFileError(err)
+			} else {
+				odbcconf.ResponseSHA256 = sha256Hex(data)
+				actions = append(actions, responseFileActions(data)...)
+			}
+		}
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "response_file", Value: odbcconf.ResponseFile})
+	}
+
+	for i, action := range actions {
+		verb, dlls := odbcconfDLLs(action)
+		for _, dll := range dlls {
+			path := resolveODBCConfPath(ctx, event, dll)
+			loaded := ODBCConfDLL{
+				BinaryInspection: BinaryInspection{Path: path},
+				Verb:             verb,
+				FromResponseFile: i >= fromResponse,
+				Trusted:          isTrustedAssemblyPath(path),
+			}
+			if ctx.Live {
+				loaded.BinaryInspection = inspectBinary(path, config.MaxArtifactSize)
+			}
+			odbcconf.DLLs = append(odbcconf.DLLs, loaded)
+		}
+	}
+	if odbcconf.ResponseFile == "" && len(odbcconf.DLLs) == 0 {
+		return
+	}
+	event.ODBCConf = odbcconf
+
+	for _, dll := range odbcconf.DLLs {
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "odbcconf_dll", Value: dll.Path})
+		detail := ""
+		if dll.FromResponseFile {
+			detail = fmt.Sprintf(" from response file %s", odbcconf.ResponseFile)
+			if odbcconf.ResponseSHA256 != "" {
+				detail += fmt.Sprintf(" (sha256 %s)", odbcconf.ResponseSHA256)
+			}
+		}
+		if dll.Verb == "REGSVR" {
+			// Installers register drivers, but rarely anything through REGSVR
+			addFinding(event, SeverityMedium, ConfidenceMedium, fmt.Sprintf("odbcconf registers DLL %s through REGSVR%s", dll.Path, detail))
+		}
+
+		hash := ""
+		if dll.SHA256 != "" {
+			hash = fmt.Sprintf(" (sha256 %s)", dll.SHA256)
+		}
+		if !dll.Trusted {
+			addFinding(event, SeverityHigh, ConfidenceHigh, fmt.Sprintf("odbcconf loads DLL %s from outside Program Files and Windows through %s%s%s", dll.Path, dll.Verb, hash, detail))
+		}
+		if dll.SignatureStatus != "" && !dll.Signed {
+			reason := fmt.Sprintf("odbcconf loads unsigned DLL %s%s", dll.Path, hash)
+			if dll.SignatureStatus != signatureUnsigned {
+				reason = fmt.Sprintf("odbcconf loads DLL %s (signature %s)%s", dll.Path, dll.SignatureStatus, hash)
+			}
+			addFinding(event, SeverityHigh, ConfidenceHigh, reason)
+		}
+		if (!dll.Trusted || (dll.SignatureStatus != "" && !dll.Signed)) && event.Severity < SeverityHigh {
+			event.Severity = SeverityHigh
+		}
+	}
+	if len(odbcconf.DLLs) == 0 && odbcconf.ResponseSHA256 == "" {
+		// The response file couldn't be read; its use alone is worth a look
+		addFinding(event, SeverityMedium, ConfidenceLow, fmt.Sprintf("odbcconf runs actions from response file %s", odbcconf.ResponseFile))
+	}
+	if len(odbcconf.DLLs) > 0 {
+		addTags(event, []string{"defense-evasion"})
+	}
+}
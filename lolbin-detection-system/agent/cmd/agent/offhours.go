@@ -0,0 +1,186 @@
+// offhours.go
+// Business-hours weighting: detections outside the configured working
+// hours get a severity bump and an off-hours indicator. Without any
+// windows configured the check does nothing.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // Windows hosts have no zoneinfo database for time_zone
+)
+
+// BusinessHoursConfig configures off-hours weighting. The agent runs on one
+// host, so the windows are that host's working hours.
+type BusinessHoursConfig struct {
+	// Windows are working-hour ranges such as "mon-fri 08:00-18:00" or
+	// "sat 09:00-12:00". A range ending before it starts runs past
+	// midnight into the next day.
+	Windows []string `yaml:"windows"`
+	// TimeZone is an IANA zone such as Europe/Berlin; empty uses the
+	// host's local zone
+	TimeZone string `yaml:"time_zone"`
+	// SeverityBump is how many levels off-hours detections are raised
+	SeverityBump int `yaml:"severity_bump"`
+}
+
+// businessWindow is one parsed working-hours range
+type businessWindow struct {
+	days       [7]bool
+	start, end int // minutes since midnight
+}
+
+// businessSchedule is the compiled business-hours configuration
+type businessSchedule struct {
+	windows  []businessWindow
+	location *time.Location
+	bump     int
+}
+
+// businessHours is the active schedule; nil when off-hours weighting is
+// not configured
+var businessHours *businessSchedule
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseDays reads a day list such as mon-fri or sat,sun
+func parseDays(spec string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(strings.ToLower(spec), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, ok := weekdays[first]
+		if !ok {
+			return days, fmt.Errorf("unknown day %q", first)
+		}
+		to := from
+		if isRange {
+			if to, ok = weekdays[last]; !ok {
+				return days, fmt.Errorf("unknown day %q", last)
+			}
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock reads an HH:MM time of day as minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseBusinessWindow reads a window such as "mon-fri 08:00-18:00"
+func parseBusinessWindow(spec string) (businessWindow, error) {
+	var w businessWindow
+	dayPart, timePart, ok := strings.Cut(strings.TrimSpace(spec), " ")
+	if !ok {
+		return w, fmt.Errorf("invalid business hours %q, want e.g. \"mon-fri 08:00-18:00\"", spec)
+	}
+	days, err := parseDays(dayPart)
+	if err != nil {
+		return w, fmt.Errorf("invalid business hours %q: %v", spec, err)
+	}
+	startPart, endPart, ok := strings.Cut(strings.TrimSpace(timePart), "-")
+	if !ok {
+		return w, fmt.Errorf("invalid business hours %q, want e.g. \"mon-fri 08:00-18:00\"", spec)
+	}
+	start, err := parseClock(startPart)
+	if err != nil {
+		return w, fmt.Errorf("invalid business hours %q: %v", spec, err)
+	}
+	end, err := parseClock(endPart)
+	if err != nil {
+		return w, fmt.Errorf("invalid business hours %q: %v", spec, err)
+	}
+	if start == end {
+		return w, fmt.Errorf("invalid business hours %q: empty time range", spec)
+	}
+	return businessWindow{days: days, start: start, end: end}, nil
+}
+
+// compileBusinessHours parses the configuration. It returns nil when no
+// windows are configured.
+func compileBusinessHours(c BusinessHoursConfig) (*businessSchedule, error) {
+	if len(c.Windows) == 0 {
+		return nil, nil
+	}
+	if c.SeverityBump < 0 {
+		return nil, fmt.Errorf("business_hours.severity_bump must not be negative")
+	}
+	schedule := &businessSchedule{location: time.Local, bump: c.SeverityBump}
+	if c.TimeZone != "" {
+		location, err := time.LoadLocation(c.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid business_hours.time_zone: %v", err)
+		}
+		schedule.location = location
+	}
+	for _, spec := range c.Windows {
+		w, err := parseBusinessWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		schedule.windows = append(schedule.windows, w)
+	}
+	return schedule, nil
+}
+
+// contains reports whether a local time falls within the window
+func (w businessWindow) contains(t time.Time) bool {
+	day := t.Weekday()
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	// Overnight: the evening of a listed day or the morning after it
+	return (w.days[day] && minute >= w.start) || (w.days[(day+6)%7] && minute < w.end)
+}
+
+// offHours reports whether t is outside every window, and returns t in the
+// schedule's zone
+func (s *businessSchedule) offHours(t time.Time) (bool, time.Time) {
+	local := t.In(s.location)
+	for _, w := range s.windows {
+		if w.contains(local) {
+			return false, local
+		}
+	}
+	return true, local
+}
+
+// checkOffHours marks events outside business hours and raises the
+// severity of detections among them
+func checkOffHours(event *ProcessEvent) {
+	if businessHours == nil {
+		return
+	}
+	off, local := businessHours.offHours(event.Timestamp)
+	event.OffHours = off
+	if !off || !event.Suspicious {
+		return
+	}
+
+	at := local.Format("Mon 15:04 MST")
+	event.Indicators = append(event.Indicators, Indicator{
+		Rule:  event.Rule,
+		Type:  "off_hours",
+		Value: at,
+	})
+	for i := 0; i < businessHours.bump; i++ {
+		event.Severity = event.Severity.Bump()
+	}
+	event.Reason += "; off-hours execution at " + at
+}
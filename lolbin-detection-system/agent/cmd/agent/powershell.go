@@ -0,0 +1,321 @@
+// powershell.go
+// Detection of PowerShell download cradles: WebClient downloads,
+// Invoke-WebRequest piped to Invoke-Expression, Start-BitsTransfer and the
+// COM and .NET variants. Cradles are commonly split into concatenated
+// strings, character codes and format strings to get past substring
+// matching, so the command line and decoded -EncodedCommand script are
+// folded back into plain strings before the cradle patterns are matched.
+// Folding runs a bounded number of linear passes over a capped script.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxDeobfuscateInput caps the script length that is folded
+	maxDeobfuscateInput = 64 << 10
+	// maxDeobfuscatePasses bounds the folding passes; each pass is linear
+	// in the script
+	maxDeobfuscatePasses = 8
+	// maxCradleForm caps the length of a recorded cradle statement
+	maxCradleForm = 512
+)
+
+// psLiteral matches a single-quoted string, or a double-quoted one without
+// variables to expand
+const psLiteral = `'(?:[^']|'')*'|"[^"$]*"`
+
+var (
+	psLiteralPattern = regexp.MustCompile(psLiteral)
+	// [char]73 and [char](0x49); the parentheses only come in pairs, or
+	// ([char]88) would lose its closing one
+	psCharCastPattern = regexp.MustCompile(`(?i)\[char\]\s*(?:\(\s*(0x[0-9a-f]+|\d+)\s*\)|(0x[0-9a-f]+|\d+))`)
+	// [char[]](73,69,88)
+	psCharArrayPattern = regexp.MustCompile(`(?i)\[char\[\]\]\s*\(\s*((?:0x[0-9a-f]+|\d+)(?:\s*,\s*(?:0x[0-9a-f]+|\d+))*)\s*\)`)
+	// -join ('I','E','X')
+	psJoinPrefixPattern = regexp.MustCompile(`(?i)-join\s*\(\s*((?:` + psLiteral + `)(?:\s*,\s*(?:` + psLiteral + `))*)\s*\)`)
+	// ('I','E','X') -join ''
+	psJoinSuffixPattern = regexp.MustCompile(`(?i)\(\s*((?:` + psLiteral + `)(?:\s*,\s*(?:` + psLiteral + `))*)\s*\)\s*-join\s*(` + psLiteral + `)`)
+	// ('{1}{0}' -f 'String','Download')
+	psFormatPattern = regexp.MustCompile(`(?i)\(\s*(` + psLiteral + `)\s*-f\s*((?:` + psLiteral + `)(?:\s*,\s*(?:` + psLiteral + `))*)\s*\)`)
+	psFormatItem    = regexp.MustCompile(`\{(\d+)\}`)
+	// 'Down'+'load'+'String'
+	psConcatPattern = regexp.MustCompile(`(?:` + psLiteral + `)(?:\s*\+\s*(?:` + psLiteral + `))+`)
+	// ('DownloadString') outside a call's argument list
+	psParenLiteralPattern = regexp.MustCompile(`(^|[^\w)\]'"])\(\s*(` + psLiteral + `)\s*\)`)
+	// .'DownloadString'
+	psQuotedMemberPattern = regexp.MustCompile(`\.\s*(` + psLiteral + `)`)
+	psIdentPattern        = regexp.MustCompile(`^[A-Za-z_]\w*$`)
+
+	// psExecutionPattern matches the ways a cradle runs what it fetched
+	psExecutionPattern = regexp.MustCompile(`(?i)\b(?:iex|invoke-expression)\b|\[scriptblock\]::create|\.invokescript\b`)
+)
+
+// psCradleArg matches the first argument of a call, quoted or not
+const psCradleArg = `\(\s*(?:'[^']*'|"[^"]*"|[^\s)'"]+)`
+
+// psCradles are the download cradle patterns, matched against the folded
+// script. A cradle with requires set only counts when that also matches,
+// as the object is usually created in an earlier statement.
+var psCradles = []struct {
+	kind     string
+	pattern  *regexp.Regexp
+	requires *regexp.Regexp
+}{
+	{"webclient", regexp.MustCompile(`(?i)\.(download(?:string|file|data)(?:async|taskasync)?|openread(?:async)?)\s*(?:\.invoke\s*)?` + psCradleArg),
+		regexp.MustCompile(`(?i)net\.webclient`)},
+	{"invoke-webrequest", regexp.MustCompile(`(?i)\b(?:invoke-webrequest|iwr|invoke-restmethod|irm|curl|wget)\b[^|;\n]*?https?://`), nil},
+	{"start-bitstransfer", regexp.MustCompile(`(?i)\bstart-bitstransfer\b[^|;\n]*?https?://`), nil},
+	{"xmlhttp", regexp.MustCompile(`(?i)\.open\s*\(\s*['"]?get['"]?\s*,\s*['"]?https?://`),
+		regexp.MustCompile(`(?i)msxml2\.(?:server)?xmlhttp|microsoft\.xmlhttp|winhttp\.winhttprequest`)},
+	{"webrequest", regexp.MustCompile(`(?i)\[(?:system\.)?net\.(?:http)?webrequest\]::create\s*` + psCradleArg), nil},
+	{"httpclient", regexp.MustCompile(`(?i)\.get(?:string|bytearray|stream)async\s*` + psCradleArg),
+		regexp.MustCompile(`(?i)net\.http\.httpclient`)},
+}
+
+// PowerShellAnalysis is the analysis of a PowerShell command line and its
+// decoded script
+type PowerShellAnalysis struct {
+	// Deobfuscated is the folded script, set when folding changed it
+	Deobfuscated string             `json:"deobfuscated,omitempty"`
+	Cradles      []PowerShellCradle `json:"cradles,omitempty"`
+}
+
+// PowerShellCradle is a download cradle found in a PowerShell script
+type PowerShellCradle struct {
+	// Kind is webclient.<method>, invoke-webrequest, start-bitstransfer,
+	// xmlhttp, webrequest or httpclient
+	Kind string `json:"kind"`
+	// Form is the reconstructed statement holding the cradle
+	Form string `json:"form"`
+	URL  string `json:"url,omitempty"`
+	// Executes is set when the script runs what it downloads
+	Executes bool `json:"executes,omitempty"`
+}
+
+// psUnquote returns the value of a PowerShell string literal
+func psUnquote(literal string) string {
+	value := literal[1 : len(literal)-1]
+	if literal[0] == '\'' {
+		value = strings.ReplaceAll(value, "''", "'")
+	}
+	return value
+}
+
+// psQuote returns a single-quoted PowerShell literal holding value
+func psQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// psLiterals returns the values of the literals in a comma-separated list
+func psLiterals(list string) []string {
+	var values []string
+	for _, literal := range psLiteralPattern.FindAllString(list, -1) {
+		values = append(values, psUnquote(literal))
+	}
+	return values
+}
+
+// psCharCode returns the character a [char] cast of a number yields
+func psCharCode(number string) (string, bool) {
+	code, err := strconv.ParseInt(strings.ToLower(number), 0, 32)
+	if err != nil || code <= 0 || code > 0x10ffff {
+		return "", false
+	}
+	return string(rune(code)), true
+}
+
+// deobfuscatePowerShell folds the string obfuscation of a script: backtick
+// escapes are dropped, and character codes, -join of character arrays,
+// format strings and concatenations of literals become single literals,
+// which are unwrapped where used as member names. Passes repeat until
+// nothing changes, up to maxDeobfuscatePasses, and the script is capped at
+// maxDeobfuscateInput before and after folding.
+func deobfuscatePowerShell(script string) string {
+	if len(script) > maxDeobfuscateInput {
+		script = script[:maxDeobfuscateInput]
+	}
+	script = strings.ReplaceAll(script, "`", "")
+
+	for pass := 0; pass < maxDeobfuscatePasses; pass++ {
+		folded := psCharArrayPattern.ReplaceAllStringFunc(script, func(match string) string {
+			numbers := psCharArrayPattern.FindStringSubmatch(match)[1]
+			var chars []string
+			for _, number := range strings.Split(numbers, ",") {
+				char, ok := psCharCode(strings.TrimSpace(number))
+				if !ok {
+					return match
+				}
+				chars = append(chars, psQuote(char))
+			}
+			return "(" + strings.Join(chars, ",") + ")"
+		})
+		folded = psCharCastPattern.ReplaceAllStringFunc(folded, func(match string) string {
+			groups := psCharCastPattern.FindStringSubmatch(match)
+			if char, ok := psCharCode(groups[1] + groups[2]); ok {
+				return psQuote(char)
+			}
+			return match
+		})
+		folded = psJoinPrefixPattern.ReplaceAllStringFunc(folded, func(match string) string {
+			return psQuote(strings.Join(psLiterals(psJoinPrefixPattern.FindStringSubmatch(match)[1]), ""))
+		})
+		folded = psJoinSuffixPattern.ReplaceAllStringFunc(folded, func(match string) string {
+			groups := psJoinSuffixPattern.FindStringSubmatch(match)
+			return psQuote(strings.Join(psLiterals(groups[1]), psUnquote(groups[2])))
+		})
+		folded = psFormatPattern.ReplaceAllStringFunc(folded, func(match string) string {
+			groups := psFormatPattern.FindStringSubmatch(match)
+			args := psLiterals(groups[2])
+			return psQuote(psFormatItem.ReplaceAllStringFunc(psUnquote(groups[1]), func(item string) string {
+				if i, err := strconv.Atoi(item[1 : len(item)-1]); err == nil && i < len(args) {
+					return args[i]
+				}
+				return item
+			}))
+		})
+		folded = psConcatPattern.ReplaceAllStringFunc(folded, func(match string) string {
+			return psQuote(strings.Join(psLiterals(match), ""))
+		})
+		folded = psParenLiteralPattern.ReplaceAllString(folded, "$1$2")
+		folded = psQuotedMemberPattern.ReplaceAllStringFunc(folded, func(match string) string {
+			name := psUnquote(psQuotedMemberPattern.FindStringSubmatch(match)[1])
+			if psIdentPattern.MatchString(name) {
+				return "." + name
+			}
+			return match
+		})
+
+		if folded == script || len(folded) > maxDeobfuscateInput {
+			break
+		}
+		script = folded
+	}
+	return script
+}
+
+// cradleStatement returns the statement around a match, cut at semicolons
+// and line breaks
+func cradleStatement(script string, start, end int) string {
+	start = strings.LastIndexAny(script[:start], ";\n") + 1
+	if i := strings.IndexAny(script[end:], ";\n"); i >= 0 {
+		end += i
+	} else {
+		end = len(script)
+	}
+	form := strings.TrimSpace(script[start:end])
+	if len(form) > maxCradleForm {
+		form = strings.ToValidUTF8(form[:maxCradleForm], "")
+	}
+	return form
+}
+
+// findCradles returns the download cradles in a folded script
+func findCradles(script string) []PowerShellCradle {
+	executes := psExecutionPattern.MatchString(script)
+	var cradles []PowerShellCradle
+	for _, cradle := range psCradles {
+		if cradle.requires != nil && !cradle.requires.MatchString(script) {
+			continue
+		}
+		for _, loc := range cradle.pattern.FindAllStringSubmatchIndex(script, -1) {
+			kind := cradle.kind
+			if len(loc) > 2 && loc[2] >= 0 {
+				kind += "." + strings.ToLower(script[loc[2]:loc[3]])
+			}
+			found := PowerShellCradle{
+				Kind:     kind,
+				Form:     cradleStatement(script, loc[0], loc[1]),
+				Executes: executes,
+			}
+			if url := urlPattern.FindString(found.Form); url != "" {
+				found.URL = strings.TrimRight(url, `.,;)]}'"`)
+			}
+			duplicate := false
+			for _, seen := range cradles {
+				if seen.Kind == found.Kind && seen.URL == found.URL && seen.Form == found.Form {
+					duplicate = true
+					break
+				}
+			}
+			if !duplicate {
+				cradles = append(cradles, found)
+			}
+		}
+	}
+	return cradles
+}
+
+// checkPowerShellCradle folds the obfuscation of a PowerShell command line
+// and its decoded script and flags the download cradles they hold, high
+// when the download is run as well
+func checkPowerShellCradle(ctx *DetectionContext, event *ProcessEvent) {
+	if ctx.ExecName != "powershell.exe" && ctx.ExecName != "pwsh.exe" {
+		return
+	}
+	analysis := &PowerShellAnalysis{}
+	obfuscated := false
+	for _, script := range []string{event.CommandLine, event.DecodedCommand} {
+		if script == "" {
+			continue
+		}
+		folded := deobfuscatePowerShell(script)
+		if folded != script {
+			obfuscated = true
+			if analysis.Deobfuscated != "" {
+				analysis.Deobfuscated += "\n"
+			}
+			analysis.Deobfuscated += folded
+		}
+		analysis.Cradles = append(analysis.Cradles, findCradles(folded)...)
+	}
+	if analysis.Deobfuscated == "" && len(analysis.Cradles) == 0 {
+		return
+	}
+	event.PowerShell = analysis
+	if len(analysis.Cradles) == 0 {
+		return
+	}
+
+	var kinds, urls []string
+	executes := false
+	for _, cradle := range analysis.Cradles {
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "download_cradle", Value: cradle.Kind, Category: "download"})
+		if !containsString(kinds, cradle.Kind) {
+			kinds = append(kinds, cradle.Kind)
+		}
+		if cradle.URL != "" && !containsString(urls, cradle.URL) {
+			urls = append(urls, cradle.URL)
+		}
+		for _, ioc := range extractIOCs(cradle.Form) {
+			if !hasIOC(event, ioc.Value) {
+				event.IOCs = append(event.IOCs, ioc)
+			}
+		}
+		executes = executes || cradle.Executes
+	}
+
+	severity, confidence := SeverityMedium, ConfidenceMedium
+	reason := fmt.Sprintf("PowerShell download cradle (%s)", strings.Join(kinds, ", "))
+	if executes {
+		severity, confidence = SeverityHigh, ConfidenceHigh
+		reason = fmt.Sprintf("PowerShell download cradle (%s) runs the downloaded content", strings.Join(kinds, ", "))
+	}
+	if len(urls) > 0 {
+		reason += " from " + strings.Join(urls, ", ")
+	}
+	if obfuscated {
+		reason += ", hidden by string obfuscation"
+		addTags(event, []string{"obfuscation"})
+	}
+	addFinding(event, severity, confidence, reason)
+	if event.Severity < severity {
+		event.Severity = severity
+	}
+	addTags(event, []string{"download", "execution"})
+}
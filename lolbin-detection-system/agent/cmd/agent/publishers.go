@@ -0,0 +1,112 @@
+// publishers.go
+// Trusted publishers: binaries validly signed by a listed publisher have
+// their detections downgraded to info or suppressed, for in-house and
+// vendor tooling that keeps tripping generic rules.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Actions applied to detections of trusted publishers' binaries
+const (
+	trustDowngrade = "downgrade"
+	trustSuppress  = "suppress"
+)
+
+// TrustedPublishersConfig lists the publishers whose binaries are trusted
+type TrustedPublishersConfig struct {
+	// Action is downgrade (to info severity) or suppress
+	Action string `yaml:"action"`
+	// Publishers are signer names (certificate subject CN) or SHA-1
+	// certificate thumbprints
+	Publishers []string `yaml:"publishers"`
+}
+
+// thumbprintPattern matches a SHA-1 thumbprint once separators are removed
+var thumbprintPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// identityIndicators are indicator types about a binary not being what it
+// claims to be. Those detections stand whoever signed the binary, as
+// signed system binaries are exactly what LOLBin abuse relies on.
+var identityIndicators = map[string]bool{
+	"signature":           true,
+	"masquerade_location": true,
+	"double_extension":    true,
+	"path_trailing_char":  true,
+}
+
+// normalizeThumbprint lowercases a thumbprint and strips the spaces and
+// colons certificate viewers display it with
+func normalizeThumbprint(s string) string {
+	return strings.NewReplacer(" ", "", ":", "").Replace(strings.ToLower(strings.TrimSpace(s)))
+}
+
+// Validate checks the trusted publisher settings
+func (c TrustedPublishersConfig) Validate() error {
+	switch c.Action {
+	case trustDowngrade, trustSuppress:
+	default:
+		return fmt.Errorf("trusted_publishers.action must be %s or %s", trustDowngrade, trustSuppress)
+	}
+	for _, publisher := range c.Publishers {
+		if strings.TrimSpace(publisher) == "" {
+			return fmt.Errorf("empty trusted_publishers entry")
+		}
+	}
+	return nil
+}
+
+// trustedPublisher returns the signer name or thumbprint that a trusted
+// publisher entry matched, or "" when the publisher isn't trusted. Only
+// valid signatures count; expired, revoked and unverifiable ones never do.
+func trustedPublisher(info SignatureInfo, publishers []string) string {
+	if !info.Signed || info.Status != signatureValid {
+		return ""
+	}
+	for _, publisher := range publishers {
+		if thumbprint := normalizeThumbprint(publisher); thumbprintPattern.MatchString(thumbprint) {
+			if thumbprint == info.Thumbprint {
+				return info.Thumbprint
+			}
+		} else if info.Signer != "" && strings.EqualFold(strings.TrimSpace(publisher), info.Signer) {
+			return info.Signer
+		}
+	}
+	return ""
+}
+
+// applyTrustedPublishers downgrades or suppresses the detections of an
+// event whose executable is validly signed by a trusted publisher
+func applyTrustedPublishers(event *ProcessEvent) {
+	cfg := config.TrustedPublishers
+	if !event.Suspicious || len(cfg.Publishers) == 0 {
+		return
+	}
+	for _, indicator := range event.Indicators {
+		if identityIndicators[indicator.Type] {
+			return
+		}
+	}
+
+	info, err := fileSignature(event.ExecutablePath)
+	if err != nil {
+		return
+	}
+	recordSignature(event, info)
+	publisher := trustedPublisher(info, cfg.Publishers)
+	if publisher == "" {
+		return
+	}
+
+	event.SuppressedBy = publisher
+	if cfg.Action == trustSuppress {
+		event.Suspicious = false
+		event.Severity = SeverityNone
+		return
+	}
+	event.Severity = SeverityInfo
+}
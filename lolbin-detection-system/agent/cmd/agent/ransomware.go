@@ -0,0 +1,160 @@
+// ransomware.go
+// Correlation of recovery tampering: deleting shadow copies, disabling boot
+// recovery and deleting the backup catalog are each a medium finding, but
+// several of them on one host within a short window is ransomware staging
+// and is raised as one critical composite event.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recovery tampering techniques
+const (
+	techniqueShadowCopyDeletion = "shadow_copy_deletion"
+	techniqueRecoveryDisabled   = "recovery_disabled"
+	techniqueBackupDeletion     = "backup_catalog_deletion"
+)
+
+const (
+	// eventKindComposite marks events raised by correlating other events
+	// rather than by a process start
+	eventKindComposite = "composite"
+
+	// maxTamperingEvents bounds the recovery tampering events tracked
+	// while waiting for a second technique
+	maxTamperingEvents = 100
+
+	ransomwareRule = "ransomware_preparation"
+)
+
+// tamperingEvent is a stored event using a recovery tampering technique
+type tamperingEvent struct {
+	technique string
+	eventID   uint64
+	timestamp time.Time
+}
+
+var (
+	tamperingEvents      []tamperingEvent
+	tamperingEventsMutex sync.Mutex
+)
+
+// recoveryTechnique returns the recovery tampering technique a command
+// line uses, if any. vssadmin and wmic deleting shadow copies are the same
+// technique.
+func recoveryTechnique(execName, cmdLine string) string {
+	cmdLine = strings.Join(strings.Fields(strings.ToLower(cmdLine)), " ")
+	switch execName {
+	case "vssadmin.exe":
+		if strings.Contains(cmdLine, "delete shadows") || strings.Contains(cmdLine, "resize shadowstorage") {
+			return techniqueShadowCopyDeletion
+		}
+	case "wmic.exe":
+		if strings.Contains(cmdLine, "shadowcopy delete") {
+			return techniqueShadowCopyDeletion
+		}
+	case "bcdedit.exe":
+		if strings.Contains(cmdLine, "recoveryenabled no") || strings.Contains(cmdLine, "bootstatuspolicy ignoreallfailures") {
+			return techniqueRecoveryDisabled
+		}
+	case "wbadmin.exe":
+		if strings.Contains(cmdLine, "delete catalog") || strings.Contains(cmdLine, "delete systemstatebackup") ||
+			strings.Contains(cmdLine, "delete backup") {
+			return techniqueBackupDeletion
+		}
+	}
+	return ""
+}
+
+// correlateRecoveryTampering tracks stored events that tamper with
+// recovery and raises a composite detection once two distinct techniques
+// fall within the configured window. The tracked events are cleared when
+// it fires, so the next composite needs fresh evidence.
+func correlateRecoveryTampering(event ProcessEvent) {
+	window := time.Duration(config.RansomwareWindow)
+	if window <= 0 || !event.Suspicious {
+		return
+	}
+	technique := recoveryTechnique(imageName(event.ExecutablePath), event.CommandLine)
+	if technique == "" {
+		return
+	}
+
+	tamperingEventsMutex.Lock()
+	cutoff := event.Timestamp.Add(-window)
+	kept := tamperingEvents[:0]
+	for _, tampering := range tamperingEvents {
+		if tampering.timestamp.After(cutoff) {
+			kept = append(kept, tampering)
+		}
+	}
+	kept = append(kept, tamperingEvent{technique: technique, eventID: event.ID, timestamp: event.Timestamp})
+	if over := len(kept) - maxTamperingEvents; over > 0 {
+		kept = kept[over:]
+	}
+	tamperingEvents = kept
+
+	techniques := make(map[string]bool)
+	for _, tampering := range kept {
+		techniques[tampering.technique] = true
+	}
+	if len(techniques) < 2 {
+		tamperingEventsMutex.Unlock()
+		return
+	}
+	contributing := append([]tamperingEvent(nil), kept...)
+	tamperingEvents = nil
+	tamperingEventsMutex.Unlock()
+
+	composite := ransomwareComposite(contributing, window)
+	composite = storeEvent(composite)
+	log.Printf("SUSPICIOUS: %s (events %v)", composite.Reason, composite.RelatedEventIDs)
+	dispatchAlert(composite)
+}
+
+// ransomwareComposite builds the composite event for the contributing
+// recovery tampering events
+func ransomwareComposite(contributing []tamperingEvent, window time.Duration) ProcessEvent {
+	event := ProcessEvent{
+		Timestamp:  time.Now(),
+		Kind:       eventKindComposite,
+		Rule:       ransomwareRule,
+		Suspicious: true,
+		Severity:   SeverityCritical,
+		Confidence: ConfidenceHigh,
+		Tags:       []string{"impact", "ransomware"},
+	}
+
+	seen := make(map[string]bool)
+	var techniques []string
+	for _, tampering := range contributing {
+		event.RelatedEventIDs = append(event.RelatedEventIDs, tampering.eventID)
+		if !seen[tampering.technique] {
+			seen[tampering.technique] = true
+			techniques = append(techniques, tampering.technique)
+		}
+	}
+	sort.Strings(techniques)
+	for _, technique := range techniques {
+		event.Indicators = append(event.Indicators, Indicator{Rule: ransomwareRule, Type: "technique", Value: technique})
+	}
+	event.Reason = fmt.Sprintf("Ransomware preparation: %s within %s (events %s)",
+		strings.Join(techniques, ", "), window, joinEventIDs(event.RelatedEventIDs))
+	return event
+}
+
+// joinEventIDs formats event IDs as a comma-separated list
+func joinEventIDs(ids []uint64) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = fmt.Sprint(id)
+	}
+	return strings.Join(parts, ", ")
+}
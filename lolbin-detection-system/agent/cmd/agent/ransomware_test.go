@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// resetTampering forgets the tracked recovery tampering events for the test
+// and again afterwards
+func resetTampering(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		tamperingEventsMutex.Lock()
+		tamperingEvents = nil
+		tamperingEventsMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// tamper stores and correlates a suspicious event running cmdLine
+func tamper(exe, cmdLine string, at time.Time) ProcessEvent {
+	event := storeEvent(ProcessEvent{Timestamp: at, ExecutablePath: exe, CommandLine: cmdLine, Suspicious: true})
+	correlateRecoveryTampering(event)
+	return event
+}
+
+// storedComposites returns the composite events stored so far
+func storedComposites() []ProcessEvent {
+	eventsMutex.RLock()
+	defer eventsMutex.RUnlock()
+	var composites []ProcessEvent
+	for _, event := range processEvents {
+		if event.Kind == eventKindComposite {
+			composites = append(composites, event)
+		}
+	}
+	return composites
+}
+
+const (
+	vssadmin = `C:\Windows\System32\vssadmin.exe`
+	wmic     = `C:\Windows\System32\wbem\wmic.exe`
+	bcdedit  = `C:\Windows\System32\bcdedit.exe`
+	wbadmin  = `C:\Windows\System32\wbadmin.exe`
+)
+
+func TestCorrelateRecoveryTampering(t *testing.T) {
+	withConfig(t, func(c *Config) { c.RansomwareWindow = Duration(30 * time.Minute) })
+	resetEvents(t)
+	resetTampering(t)
+	now := time.Now()
+
+	// One technique, however often and by whichever tool, isn't enough
+	tamper(vssadmin, "vssadmin delete shadows /all /quiet", now)
+	tamper(wmic, "wmic shadowcopy delete", now.Add(time.Second))
+	if composites := storedComposites(); len(composites) != 0 {
+		t.Fatalf("composite raised for one technique: %s", composites[0].Reason)
+	}
+
+	recovery := tamper(bcdedit, "bcdedit /set {default} recoveryenabled No", now.Add(2*time.Second))
+	composites := storedComposites()
+	if len(composites) != 1 {
+		t.Fatalf("%d composites, want 1", len(composites))
+	}
+	composite := composites[0]
+	if composite.Severity != SeverityCritical || composite.Rule != ransomwareRule || len(composite.RelatedEventIDs) != 3 ||
+		composite.RelatedEventIDs[2] != recovery.ID || !hasIndicator(composite, "technique", techniqueRecoveryDisabled) {
+		t.Errorf("composite %+v", composite)
+	}
+	if len(tamperingEvents) != 0 {
+		t.Errorf("%d tampering events kept after firing, want none", len(tamperingEvents))
+	}
+
+	// After firing, a composite needs two fresh techniques again
+	tamper(wbadmin, "wbadmin delete catalog -quiet", now.Add(3*time.Second))
+	if n := len(storedComposites()); n != 1 {
+		t.Fatalf("%d composites after one more technique, want still 1", n)
+	}
+	tamper(vssadmin, "vssadmin resize shadowstorage /for=c: /on=c: /maxsize=401MB", now.Add(4*time.Second))
+	if n := len(storedComposites()); n != 2 {
+		t.Errorf("%d composites after a second fresh technique, want 2", n)
+	}
+}
+
+func TestCorrelateRecoveryTamperingWindow(t *testing.T) {
+	withConfig(t, func(c *Config) { c.RansomwareWindow = Duration(time.Minute) })
+	resetEvents(t)
+	resetTampering(t)
+	now := time.Now()
+
+	tamper(vssadmin, "vssadmin delete shadows /all", now)
+	tamper(bcdedit, "bcdedit /set recoveryenabled no", now.Add(2*time.Minute))
+	if n := len(storedComposites()); n != 0 {
+		t.Errorf("%d composites for techniques further apart than the window", n)
+	}
+	if len(tamperingEvents) != 1 {
+		t.Errorf("%d tampering events tracked, want only the one within the window", len(tamperingEvents))
+	}
+
+	// Not suspicious, or correlation disabled
+	event := storeEvent(ProcessEvent{Timestamp: now.Add(2 * time.Minute), ExecutablePath: wbadmin, CommandLine: "wbadmin delete catalog"})
+	correlateRecoveryTampering(event)
+	config.RansomwareWindow = 0
+	tamper(wbadmin, "wbadmin delete catalog", now.Add(2*time.Minute))
+	if n := len(storedComposites()); n != 0 {
+		t.Errorf("%d composites for events that aren't correlated", n)
+	}
+}
+
+func TestCorrelateRecoveryTamperingBounded(t *testing.T) {
+	withConfig(t, func(c *Config) { c.RansomwareWindow = Duration(time.Hour) })
+	resetEvents(t)
+	resetTampering(t)
+	now := time.Now()
+
+	for i := 0; i < 5*maxTamperingEvents; i++ {
+		tamper(vssadmin, "vssadmin delete shadows /all", now.Add(time.Duration(i)*time.Millisecond))
+		if len(tamperingEvents) > maxTamperingEvents {
+			t.Fatalf("%d tampering events tracked, cap %d", len(tamperingEvents), maxTamperingEvents)
+		}
+	}
+	last := tamper(bcdedit, "bcdedit /set recoveryenabled no", now.Add(time.Second))
+	composites := storedComposites()
+	if len(composites) != 1 {
+		t.Fatalf("%d composites, want 1", len(composites))
+	}
+	// The oldest tracked events were dropped for the newest
+	related := composites[0].RelatedEventIDs
+	if len(related) != maxTamperingEvents || related[len(related)-1] != last.ID || related[0] != last.ID-uint64(maxTamperingEvents)+1 {
+		t.Errorf("composite references %d events from %d to %d, want the %d up to %d",
+			len(related), related[0], related[len(related)-1], maxTamperingEvents, last.ID)
+	}
+	if len(tamperingEvents) != 0 {
+		t.Errorf("%d tampering events kept after firing, want none", len(tamperingEvents))
+	}
+}
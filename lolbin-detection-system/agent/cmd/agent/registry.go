@@ -0,0 +1,268 @@
+// registry.go
+// Detection of registry persistence and hive dumping through reg.exe. The
+// subcommand and key path are taken apart so writes to autostart locations
+// such as the Run keys, Winlogon or Image File Execution Options can be
+// told from the countless harmless reg add calls of installers.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+// RegistryOperation describes what a reg.exe event does
+type RegistryOperation struct {
+	// Operation is the reg subcommand, e.g. add, import or save
+	Operation string `json:"operation"`
+	// Key is the key path with its hive abbreviated, e.g. HKLM\SAM
+	Key string `json:"key,omitempty"`
+	// File is the file imported from, or saved or exported to
+	File string `json:"file,omitempty"`
+	// Writes are the values written by add, or found in an imported file
+	Writes []RegistryWrite `json:"writes,omitempty"`
+	// Error explains why an imported file could not be inspected
+	Error string `json:"error,omitempty"`
+}
+
+// RegistryWrite is one value written to the registry
+type RegistryWrite struct {
+	Key       string `json:"key"`
+	ValueName string `json:"value_name,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	// Persistence names the autostart location the value is in, e.g.
+	// run_key or ifeo_debugger
+	Persistence string `json:"persistence,omitempty"`
+}
+
+// registryHives maps hive names and their abbreviations to the abbreviation
+var registryHives = map[string]string{
+	"hklm": "HKLM", "hkey_local_machine": "HKLM",
+	"hkcu": "HKCU", "hkey_current_user": "HKCU",
+	"hkcr": "HKCR", "hkey_classes_root": "HKCR",
+	"hku": "HKU", "hkey_users": "HKU",
+	"hkcc": "HKCC", "hkey_current_config": "HKCC",
+}
+
+// credentialHives are the HKLM hives whose saved copies yield password
+// hashes and the secrets needed to decrypt them
+var credentialHives = map[string]bool{`HKLM\SAM`: true, `HKLM\SYSTEM`: true, `HKLM\SECURITY`: true}
+
+// persistenceLocation is an autostart location in the registry
+type persistenceLocation struct {
+	name string
+	// key is a fragment of the lowercased key path
+	key string
+	// values are the lowercased value names that matter; any value counts
+	// when empty
+	values   []string
+	severity Severity
+	// description completes "reg.exe writes ... to"
+	description string
+}
+
+// persistenceLocations are checked in order; the first match wins
+var persistenceLocations = []persistenceLocation{
+	{name: "ifeo_debugger", key: `\image file execution options\`, values: []string{"debugger"}, severity: SeverityCritical, description: "an Image File Execution Options debugger"},
+	{name: "winlogon", key: `\windows nt\currentversion\winlogon`, values: []string{"shell", "userinit"}, severity: SeverityHigh, description: "the Winlogon logon programs"},
+	{name: "appinit_dlls", key: `\windows nt\currentversion\windows`, values: []string{"appinit_dlls", "loadappinit_dlls"}, severity: SeverityHigh, description: "AppInit_DLLs"},
+	{name: "run_key", key: `\currentversion\run`, severity: SeverityHigh, description: "a Run key"},
+	{name: "run_key", key: `\policies\explorer\run`, severity: SeverityHigh, description: "a policy Run key"},
+	{name: "netsh_helper", key: `\microsoft\netsh\`, severity: SeverityHigh, description: "a netsh helper DLL"},
+	{name: "service", key: `\services\`, severity: SeverityHigh, description: "a service definition"},
+}
+
+// normalizeRegistryKey abbreviates the hive of a key path and strips
+// surrounding backslashes
+func normalizeRegistryKey(key string) string {
+	key = strings.Trim(strings.TrimSpace(key), `\`)
+	hive, rest, _ := strings.Cut(key, `\`)
+	if abbreviation, ok := registryHives[strings.ToLower(hive)]; ok {
+		hive = abbreviation
+	}
+	if rest == "" {
+		return hive
+	}
+	return hive + `\` + rest
+}
+
+// classifyRegistryWrite returns the autostart location a value is in
+func classifyRegistryWrite(key, valueName string) (persistenceLocation, bool) {
+	key = strings.ToLower(key) + `\`
+	valueName = strings.ToLower(valueName)
+	for _, location := range persistenceLocations {
+		if !strings.Contains(key, location.key) {
+			continue
+		}
+		if len(location.values) == 0 || containsString(location.values, valueName) {
+			return location, true
+		}
+	}
+	return persistenceLocation{}, false
+}
+
+// parseReg takes a reg.exe command line apart. Options may come in any
+// order; /v, /t, /d and /s take the next argument as their value.
+func parseReg(cmdLine string) (*RegistryOperation, bool) {
+	args := splitCommandLine(strings.ReplaceAll(cmdLine, `\"`, escapedQuote))
+	var operands []string
+	write := RegistryWrite{}
+	hasValue := false
+	for i := 1; i < len(args); i++ {
+		arg := strings.ReplaceAll(args[i], escapedQuote, `"`)
+		if !strings.HasPrefix(arg, "/") && !strings.HasPrefix(arg, "-") {
+			operands = append(operands, arg)
+			continue
+		}
+		option := strings.ToLower(arg[1:])
+		if option == "ve" {
+			hasValue = true
+			continue
+		}
+		if option != "v" && option != "t" && option != "d" && option != "s" || i+1 >= len(args) {
+			// Flags such as /f, /y and /reg:64
+			continue
+		}
+		i++
+		value := strings.ReplaceAll(args[i], escapedQuote, `"`)
+		switch option {
+		case "v":
+			write.ValueName = value
+			hasValue = true
+		case "t":
+			write.Type = strings.ToUpper(value)
+		case "d":
+			write.Data = value
+		}
+	}
+	if len(operands) == 0 {
+		return nil, false
+	}
+
+	operation := &RegistryOperation{Operation: strings.ToLower(operands[0])}
+	switch operation.Operation {
+	case "add":
+		if len(operands) < 2 {
+			return operation, true
+		}
+		operation.Key = normalizeRegistryKey(operands[1])
+		write.Key = operation.Key
+		if hasValue || write.Data != "" {
+			if location, ok := classifyRegistryWrite(write.Key, write.ValueName); ok {
+				write.Persistence = location.name
+			}
+			operation.Writes = []RegistryWrite{write}
+		}
+	case "save", "export":
+		if len(operands) > 1 {
+			operation.Key = normalizeRegistryKey(operands[1])
+		}
+		if len(operands) > 2 {
+			operation.File = expandWindowsEnv(operands[2])
+		}
+	case "import":
+		if len(operands) > 1 {
+			operation.File = expandWindowsEnv(operands[1])
+		}
+	default:
+		if len(operands) > 1 {
+			operation.Key = normalizeRegistryKey(operands[1])
+		}
+	}
+	return operation, true
+}
+
+// parseRegFile returns the values a .reg file writes
+func parseRegFile(text string) []RegistryWrite {
+	var writes []RegistryWrite
+	var key string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "[-"):
+			// Key deletion
+			key = ""
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			key = normalizeRegistryKey(line[1 : len(line)-1])
+		case key != "" && (strings.HasPrefix(line, `"`) || strings.HasPrefix(line, "@=")):
+			name, data := "", ""
+			if strings.HasPrefix(line, "@=") {
+				data = line[2:]
+			} else if end := strings.Index(line[1:], `"=`); end >= 0 {
+				name, data = line[1:end+1], line[end+3:]
+			} else {
+				continue
+			}
+			write := RegistryWrite{Key: key, ValueName: name, Data: strings.Trim(data, `"`)}
+			if location, ok := classifyRegistryWrite(key, name); ok {
+				write.Persistence = location.name
+			}
+			writes = append(writes, write)
+		}
+	}
+	return writes
+}
+
+// inspectRegFile reads the file of a reg import
+func inspectRegFile(operation *RegistryOperation, limit int64) {
+	data, _, err := readCapped(operation.File, limit)
+	if err != nil {
+		operation.Error = describeFileError(err)
+		return
+	}
+	// .reg files exported by regedit are UTF-16 with a byte order mark,
+	// like INF files
+	operation.Writes = parseRegFile(decodeINF(data))
+}
+
+// checkRegistry flags reg.exe writing to autostart locations, whether by
+// reg add or in the file of a reg import, and saving the credential hives
+func checkRegistry(ctx *DetectionContext, event *ProcessEvent) {
+	if ctx.ExecName != "reg.exe" {
+		return
+	}
+	operation, ok := parseReg(event.CommandLine)
+	if !ok {
+		return
+	}
+	event.Registry = operation
+	if operation.Operation == "import" && operation.File != "" && ctx.Live && config.MaxArtifactSize > 0 {
+		inspectRegFile(operation, config.MaxArtifactSize)
+	}
+
+	for _, write := range operation.Writes {
+		if write.Persistence == "" {
+			continue
+		}
+		location, _ := classifyRegistryWrite(write.Key, write.ValueName)
+		value := write.Key
+		if write.ValueName != "" {
+			value += `\` + write.ValueName
+		}
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "registry_" + write.Persistence, Value: value})
+		reason := fmt.Sprintf("reg.exe %s writes %s to %s", operation.Operation, location.description, value)
+		if write.Data != "" {
+			reason += fmt.Sprintf(" (%s)", write.Data)
+		}
+		addFinding(event, location.severity, ConfidenceHigh, reason)
+		if event.Severity < location.severity {
+			event.Severity = location.severity
+		}
+		addTags(event, []string{"persistence"})
+		if write.Persistence == "netsh_helper" && ctx.Live {
+			correlateNetshHelper(event, write)
+		}
+	}
+
+	if operation.Operation == "save" && credentialHives[strings.ToUpper(operation.Key)] {
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "hive_dump", Value: operation.File, Category: "credential-access"})
+		addFinding(event, SeverityCritical, ConfidenceHigh, fmt.Sprintf("reg.exe saves the %s hive to %s", operation.Key, operation.File))
+		if event.Severity < SeverityCritical {
+			event.Severity = SeverityCritical
+		}
+		addTags(event, []string{"credential-access"})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckRegistry(t *testing.T) {
+	tests := []struct {
+		name      string
+		cmdLine   string
+		operation string
+		key       string
+		write     *RegistryWrite
+		indicator string
+		severity  Severity
+	}{
+		// Autostart writes
+		{"Run key", `reg add HKCU\Software\Microsoft\Windows\CurrentVersion\Run /v Updater /t REG_SZ /d "C:\Users\alice\AppData\Roaming\upd.exe" /f`,
+			"add", `HKCU\Software\Microsoft\Windows\CurrentVersion\Run`,
+			&RegistryWrite{ValueName: "Updater", Type: "REG_SZ", Data: `C:\Users\alice\AppData\Roaming\upd.exe`, Persistence: "run_key"},
+			"registry_run_key", SeverityHigh},
+		{"RunOnce, options first, long hive name", `reg.exe add /f /d C:\ProgramData\x.exe /v x "HKEY_LOCAL_MACHINE\SOFTWARE\Microsoft\Windows\CurrentVersion\RunOnce"`,
+			"add", `HKLM\SOFTWARE\Microsoft\Windows\CurrentVersion\RunOnce`,
+			&RegistryWrite{ValueName: "x", Data: `C:\ProgramData\x.exe`, Persistence: "run_key"},
+			"registry_run_key", SeverityHigh},
+		{"IFEO debugger on sethc", `reg add "HKLM\SOFTWARE\Microsoft\Windows NT\CurrentVersion\Image File Execution Options\sethc.exe" /v Debugger /t REG_SZ /d "C:\windows\system32\cmd.exe" /f`,
+			"add", `HKLM\SOFTWARE\Microsoft\Windows NT\CurrentVersion\Image File Execution Options\sethc.exe`,
+			&RegistryWrite{ValueName: "Debugger", Type: "REG_SZ", Data: `C:\windows\system32\cmd.exe`, Persistence: "ifeo_debugger"},
+			"registry_ifeo_debugger", SeverityCritical},
+		{"Winlogon Userinit", `reg add "HKLM\Software\Microsoft\Windows NT\CurrentVersion\Winlogon" /v Userinit /d "C:\Windows\system32\userinit.exe,C:\Users\Public\b.exe" /f`,
+			"add", `HKLM\Software\Microsoft\Windows NT\CurrentVersion\Winlogon`,
+			&RegistryWrite{ValueName: "Userinit", Data: `C:\Windows\system32\userinit.exe,C:\Users\Public\b.exe`, Persistence: "winlogon"},
+			"registry_winlogon", SeverityHigh},
+		{"AppInit_DLLs", `reg add "HKLM\SOFTWARE\Microsoft\Windows NT\CurrentVersion\Windows" /v AppInit_DLLs /t REG_SZ /d C:\Users\Public\hook.dll /f`,
+			"add", `HKLM\SOFTWARE\Microsoft\Windows NT\CurrentVersion\Windows`,
+			&RegistryWrite{ValueName: "AppInit_DLLs", Type: "REG_SZ", Data: `C:\Users\Public\hook.dll`, Persistence: "appinit_dlls"},
+			"registry_appinit_dlls", SeverityHigh},
+		{"service ImagePath", `reg add HKLM\SYSTEM\CurrentControlSet\Services\updsvc /v ImagePath /t REG_EXPAND_SZ /d "%ProgramData%\svc.exe" /f`,
+			"add", `HKLM\SYSTEM\CurrentControlSet\Services\updsvc`,
+			&RegistryWrite{ValueName: "ImagePath", Type: "REG_EXPAND_SZ", Data: `%ProgramData%\svc.exe`, Persistence: "service"},
+			"registry_service", SeverityHigh},
+		{"escaped quotes in the data", `reg add HKCU\Software\Microsoft\Windows\CurrentVersion\Run /v ps /d "powershell -w hidden -c \"iex(gc C:\x.txt)\"" /f`,
+			"add", `HKCU\Software\Microsoft\Windows\CurrentVersion\Run`,
+			&RegistryWrite{ValueName: "ps", Data: `powershell -w hidden -c "iex(gc C:\x.txt)"`, Persistence: "run_key"},
+			"registry_run_key", SeverityHigh},
+		// Credential hives
+		{"save SAM", `reg save hklm\sam C:\Users\Public\sam.save`, "save", `HKLM\sam`, nil, "hive_dump", SeverityCritical},
+		{"save SYSTEM, quoted path", `reg.exe save HKEY_LOCAL_MACHINE\SYSTEM "C:\Temp\my files\system.hiv" /y`, "save", `HKLM\SYSTEM`, nil, "hive_dump", SeverityCritical},
+		// Installers and administrators
+		{"installer setting", `reg add "HKLM\SOFTWARE\Vendor\Product" /v InstallDir /t REG_SZ /d "C:\Program Files\Vendor" /f`,
+			"add", `HKLM\SOFTWARE\Vendor\Product`,
+			&RegistryWrite{ValueName: "InstallDir", Type: "REG_SZ", Data: `C:\Program Files\Vendor`}, "", 0},
+		{"querying the Run key", `reg query HKLM\Software\Microsoft\Windows\CurrentVersion\Run`, "query", `HKLM\Software\Microsoft\Windows\CurrentVersion\Run`, nil, "", 0},
+		{"creating an empty Run key", `reg add HKCU\Software\Microsoft\Windows\CurrentVersion\Run /f`, "add", `HKCU\Software\Microsoft\Windows\CurrentVersion\Run`, nil, "", 0},
+		{"saving a software hive", `reg save HKLM\SOFTWARE C:\Backup\software.hiv`, "save", `HKLM\SOFTWARE`, nil, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := evaluate(`C:\Windows\System32\reg.exe`, tt.cmdLine)
+			operation := event.Registry
+			if operation == nil {
+				t.Fatal("the command line was not parsed")
+			}
+			if operation.Operation != tt.operation || operation.Key != tt.key {
+				t.Errorf("operation %q on %q, want %q on %q", operation.Operation, operation.Key, tt.operation, tt.key)
+			}
+			var want []RegistryWrite
+			if tt.write != nil {
+				write := *tt.write
+				write.Key = tt.key
+				want = []RegistryWrite{write}
+			}
+			if !reflect.DeepEqual(operation.Writes, want) {
+				t.Errorf("writes = %+v, want %+v", operation.Writes, want)
+			}
+
+			flagged := false
+			for _, indicator := range event.Indicators {
+				if indicator.Type == "hive_dump" || strings.HasPrefix(indicator.Type, "registry_") {
+					flagged = true
+					if indicator.Type != tt.indicator {
+						t.Errorf("indicator %s, want %q", indicator.Type, tt.indicator)
+					}
+				}
+			}
+			if flagged != (tt.indicator != "") || event.Severity < tt.severity {
+				t.Errorf("flagged %v at %v, want %q at %v or above (%s)", flagged, event.Severity, tt.indicator, tt.severity, event.Reason)
+			}
+		})
+	}
+}
+
+func TestParseRegFile(t *testing.T) {
+	text := `Windows Registry Editor Version 5.00
+
+[HKEY_CURRENT_USER\Software\Microsoft\Windows\CurrentVersion\Run]
+"OneDrive"="C:\\Program Files\\Microsoft OneDrive\\OneDrive.exe"
+
+[-HKEY_CURRENT_USER\Software\Old]
+"Ignored"="x"
+
+[HKEY_LOCAL_MACHINE\SOFTWARE\Vendor]
+@="default"
+`
+	want := []RegistryWrite{
+		{Key: `HKCU\Software\Microsoft\Windows\CurrentVersion\Run`, ValueName: "OneDrive", Data: `C:\\Program Files\\Microsoft OneDrive\\OneDrive.exe`, Persistence: "run_key"},
+		{Key: `HKLM\SOFTWARE\Vendor`, Data: "default"},
+	}
+	if got := parseRegFile(text); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseRegFile() = %+v, want %+v", got, want)
+	}
+}
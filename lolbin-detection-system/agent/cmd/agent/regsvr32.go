@@ -0,0 +1,133 @@
+// regsvr32.go
+// Detection of regsvr32 "squiblydoo": scriptlets run through scrobj.dll's
+// DllInstall, typically fetched straight from a remote server with
+// /s /n /u /i:http://host/file.sct scrobj.dll
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Regsvr32Invocation describes the arguments of a regsvr32 command line
+type Regsvr32Invocation struct {
+	// Flags are the recognized options in order of appearance, e.g.
+	// ["s", "n", "u", "i"], whether given with a slash or a dash
+	Flags []string `json:"flags,omitempty"`
+	// Payload is the value of /i:, passed to the DLL's DllInstall
+	Payload string `json:"payload,omitempty"`
+	// DLL is the last non-option argument
+	DLL string `json:"dll,omitempty"`
+	// Scriptlet is the remote URL or local .sct file the invocation loads
+	Scriptlet string `json:"scriptlet,omitempty"`
+	// RemoteHost is the host a remote scriptlet is fetched from
+	RemoteHost string `json:"remote_host,omitempty"`
+}
+
+// regsvr32Flags are the options regsvr32 accepts
+var regsvr32Flags = map[string]bool{"s": true, "n": true, "u": true, "i": true, "e": true, "c": true}
+
+// parseRegsvr32 tokenizes a regsvr32 command line
+func parseRegsvr32(cmdLine string) *Regsvr32Invocation {
+	invocation := &Regsvr32Invocation{}
+	args := splitCommandLine(cmdLine)
+	var operands []string
+	for _, arg := range args[min(1, len(args)):] {
+		if !strings.HasPrefix(arg, "/") && !strings.HasPrefix(arg, "-") || strings.HasPrefix(arg, "//") {
+			operands = append(operands, arg)
+			continue
+		}
+		option, value, hasValue := strings.Cut(arg[1:], ":")
+		option = strings.ToLower(option)
+		if !regsvr32Flags[option] {
+			continue
+		}
+		invocation.Flags = append(invocation.Flags, option)
+		if option == "i" && hasValue {
+			invocation.Payload = strings.Trim(value, `"'`)
+		}
+	}
+	if len(operands) > 0 {
+		invocation.DLL = operands[len(operands)-1]
+	}
+
+	// A remote location anywhere wins over a local scriptlet
+	for _, candidate := range append([]string{invocation.Payload}, operands...) {
+		if host, ok := remoteHost(candidate); ok {
+			invocation.Scriptlet = candidate
+			invocation.RemoteHost = host
+			return invocation
+		}
+	}
+	for _, candidate := range append([]string{invocation.Payload}, operands...) {
+		if strings.HasSuffix(strings.ToLower(candidate), ".sct") {
+			invocation.Scriptlet = expandWindowsEnv(candidate)
+			break
+		}
+	}
+	return invocation
+}
+
+// remoteHost returns the host of a URL or UNC path
+func remoteHost(location string) (string, bool) {
+	lower := strings.ToLower(refang(location))
+	if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "ftp://") {
+		if u, err := url.Parse(lower); err == nil && u.Hostname() != "" {
+			return u.Hostname(), true
+		}
+		return "", false
+	}
+	if paths := findUNCPaths(location); len(paths) > 0 {
+		return paths[0].Host, true
+	}
+	return "", false
+}
+
+// checkRegsvr32 flags scriptlet loads through regsvr32: critical when the
+// scriptlet is remote, high for a local .sct in a user-writable directory
+// or any scriptlet run through scrobj.dll
+func checkRegsvr32(ctx *DetectionContext, event *ProcessEvent) {
+	if ctx.ExecName != "regsvr32.exe" {
+		return
+	}
+	invocation := parseRegsvr32(event.CommandLine)
+	scrobj := imageName(invocation.DLL) == "scrobj.dll" || imageName(invocation.DLL) == "scrobj"
+	if invocation.Scriptlet == "" && !(scrobj && invocation.Payload != "") {
+		return
+	}
+	event.Regsvr32 = invocation
+
+	switch {
+	case invocation.RemoteHost != "":
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "remote_scriptlet", Value: invocation.Scriptlet})
+		// Quoting or an unusual position may have hidden the location from
+		// the command-line IOC extraction
+		for _, ioc := range extractIOCs(invocation.Scriptlet) {
+			if !hasIOC(event, ioc.Value) {
+				event.IOCs = append(event.IOCs, ioc)
+			}
+		}
+		addFinding(event, SeverityCritical, ConfidenceHigh, fmt.Sprintf("Squiblydoo: regsvr32 loads a remote scriptlet from %s", invocation.Scriptlet))
+		if event.Severity < SeverityCritical {
+			event.Severity = SeverityCritical
+		}
+	case invocation.Scriptlet != "" && isUserWritableOrTempPath(invocation.Scriptlet):
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "scriptlet_path", Value: invocation.Scriptlet})
+		addFinding(event, SeverityHigh, ConfidenceMedium, fmt.Sprintf("regsvr32 runs scriptlet %s from a user-writable directory", invocation.Scriptlet))
+		if event.Severity < SeverityHigh {
+			event.Severity = SeverityHigh
+		}
+	case scrobj:
+		scriptlet := invocation.Scriptlet
+		if scriptlet == "" {
+			scriptlet = invocation.Payload
+		}
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "scriptlet_path", Value: scriptlet})
+		addFinding(event, SeverityHigh, ConfidenceMedium, fmt.Sprintf("regsvr32 runs scriptlet %s through scrobj.dll", scriptlet))
+		if event.Severity < SeverityHigh {
+			event.Severity = SeverityHigh
+		}
+	}
+}
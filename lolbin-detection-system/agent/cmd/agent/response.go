@@ -0,0 +1,123 @@
+// response.go
+// Active response to critical detections. A rule may ask for the offending
+// process to be terminated, which only happens when response actions are
+// switched on with -enable-response and never while simulated events are
+// read, as their PIDs belong to unrelated processes. Every action is
+// logged and its outcome recorded on the event. Processes that can't be
+// killed without taking the host down, and the agent itself, are refused.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// responseKill is the rule response terminating the offending process
+const responseKill = "kill"
+
+// responseExitCode is the exit code terminated processes get
+const responseExitCode = 1
+
+// responseProtected are the processes terminating which crashes or locks
+// up Windows
+var responseProtected = map[string]bool{
+	"system":       true,
+	"smss.exe":     true,
+	"csrss.exe":    true,
+	"wininit.exe":  true,
+	"winlogon.exe": true,
+	"services.exe": true,
+	"lsass.exe":    true,
+	"svchost.exe":  true,
+}
+
+// ResponseConfig configures active response
+type ResponseConfig struct {
+	// Enabled allows response actions; rules still opt in one by one with
+	// their response setting
+	Enabled bool `yaml:"enabled"`
+}
+
+// Validate checks the response settings against the event sources
+func (c ResponseConfig) Validate(sources []string) error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("response actions can't be enabled with the simulated event source")
+	}
+	for _, source := range sources {
+		if strings.EqualFold(source, "simulate") {
+			return fmt.Errorf("response actions can't be enabled with the simulated event source")
+		}
+	}
+	return nil
+}
+
+// ResponseAction is the outcome of a response action taken on an event
+type ResponseAction struct {
+	Action    string    `json:"action"`
+	Time      time.Time `json:"time"`
+	Succeeded bool      `json:"succeeded"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// respond takes the response action the event's rule asks for when the
+// event is critical and response actions are enabled, recording the
+// outcome on the event. Only called for real process starts.
+func respond(event *ProcessEvent) {
+	if !config.Response.Enabled || event.Severity < SeverityCritical || event.Rule == "" {
+		return
+	}
+	lolbin, ok := currentRules().LOLBins[event.Rule]
+	if !ok || lolbin.Response != responseKill {
+		return
+	}
+
+	action := &ResponseAction{Action: responseKill, Time: time.Now()}
+	if err := terminateEventProcess(event); err != nil {
+		action.Error = err.Error()
+		log.Printf("RESPONSE: failed to terminate %s (PID: %d) for rule %s: %v",
+			event.ExecutablePath, event.ProcessID, event.Rule, err)
+	} else {
+		action.Succeeded = true
+		log.Printf("RESPONSE: terminated %s (PID: %d) for rule %s - %s",
+			event.ExecutablePath, event.ProcessID, event.Rule, event.Reason)
+	}
+	event.Response = action
+}
+
+// terminateEventProcess terminates the event's process, refusing the agent
+// and the processes Windows can't run without, and checking the creation
+// time so a reused PID is never hit
+func terminateEventProcess(event *ProcessEvent) error {
+	if event.ProcessID == 0 || event.ProcessID == 4 || event.ProcessID == selfPID {
+		return fmt.Errorf("refusing to terminate PID %d", event.ProcessID)
+	}
+	if name := imageName(event.ExecutablePath); responseProtected[name] {
+		return fmt.Errorf("refusing to terminate %s", name)
+	}
+
+	handle, err := windows.OpenProcess(windows.PROCESS_TERMINATE|windows.PROCESS_QUERY_LIMITED_INFORMATION, false, event.ProcessID)
+	if err != nil {
+		return fmt.Errorf("failed to open process: %v", err)
+	}
+	defer windows.CloseHandle(handle)
+
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(handle, &creation, &exit, &kernel, &user); err != nil {
+		return fmt.Errorf("failed to read process times: %v", err)
+	}
+	if diff := filetimeToTime(creation).Sub(event.Timestamp); diff > startTimeTolerance || diff < -startTimeTolerance {
+		return fmt.Errorf("PID %d now belongs to another process", event.ProcessID)
+	}
+	if err := windows.TerminateProcess(handle, responseExitCode); err != nil {
+		return fmt.Errorf("failed to terminate process: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestResponseHelperProcess is the process the response tests terminate
+func TestResponseHelperProcess(t *testing.T) {
+	if os.Getenv("LOLBIN_RESPONSE_HELPER") != "1" {
+		t.Skip("only run as a response target")
+	}
+	time.Sleep(time.Minute)
+	os.Exit(0)
+}
+
+// startResponseTarget starts a process to respond to, returning its start
+// time and a channel closed when it exits
+func startResponseTarget(t *testing.T) (*exec.Cmd, time.Time, <-chan struct{}) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestResponseHelperProcess$")
+	cmd.Env = append(os.Environ(), "LOLBIN_RESPONSE_HELPER=1")
+	started := time.Now()
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		<-exited
+	})
+	return cmd, started, exited
+}
+
+func TestResponseConfigValidate(t *testing.T) {
+	tests := []struct {
+		config  ResponseConfig
+		sources []string
+		valid   bool
+	}{
+		{ResponseConfig{}, nil, true},
+		{ResponseConfig{Enabled: true}, []string{"etw"}, true},
+		{ResponseConfig{Enabled: true}, nil, false},
+		{ResponseConfig{Enabled: true}, []string{"etw", "Simulate"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.config.Validate(tt.sources); (err == nil) != tt.valid {
+			t.Errorf("%+v with sources %q: Validate() = %v, want valid %v", tt.config, tt.sources, err, tt.valid)
+		}
+	}
+	if err := validateLOLBin(LOLBin{Name: "tool.exe", Response: "suspend"}); err == nil {
+		t.Error("unknown response accepted")
+	}
+}
+
+func TestRespond(t *testing.T) {
+	activateRulesFile(t, RulesFile{LOLBins: []LOLBin{
+		{Name: "killing.exe", SuspiciousArgs: []string{"-run"}, Severity: SeverityCritical, Response: responseKill},
+		{Name: "alerting.exe", SuspiciousArgs: []string{"-run"}, Severity: SeverityCritical},
+	}})
+	withConfig(t, func(c *Config) { c.Response.Enabled = true })
+	cmd, started, exited := startResponseTarget(t)
+	target := func(set func(e *ProcessEvent)) ProcessEvent {
+		event := ProcessEvent{
+			ProcessID:      uint32(cmd.Process.Pid),
+			Timestamp:      started,
+			ExecutablePath: `C:\Tools\killing.exe`,
+			Rule:           "killing.exe",
+			Severity:       SeverityCritical,
+		}
+		if set != nil {
+			set(&event)
+		}
+		return event
+	}
+	alive := func(name string) {
+		t.Helper()
+		select {
+		case <-exited:
+			t.Fatalf("%s: the process was terminated", name)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// Events the engine leaves alone
+	skipped := []struct {
+		name    string
+		enabled bool
+		set     func(e *ProcessEvent)
+	}{
+		{"response disabled", false, nil},
+		{"high severity", true, func(e *ProcessEvent) { e.Severity = SeverityHigh }},
+		{"rule without a response", true, func(e *ProcessEvent) { e.Rule = "alerting.exe" }},
+		{"unknown rule", true, func(e *ProcessEvent) { e.Rule = "gone.exe" }},
+		{"no rule", true, func(e *ProcessEvent) { e.Rule = "" }},
+	}
+	for _, tt := range skipped {
+		config.Response.Enabled = tt.enabled
+		event := target(tt.set)
+		respond(&event)
+		if event.Response != nil {
+			t.Errorf("%s: action taken: %+v", tt.name, event.Response)
+		}
+		alive(tt.name)
+	}
+	config.Response.Enabled = true
+
+	// Actions refused, recorded as failures
+	refused := []struct {
+		name  string
+		set   func(e *ProcessEvent)
+		error string
+	}{
+		{"the agent", func(e *ProcessEvent) { e.ProcessID = selfPID }, "refusing to terminate PID"},
+		{"System", func(e *ProcessEvent) { e.ProcessID = 4 }, "refusing to terminate PID 4"},
+		{"protected image", func(e *ProcessEvent) { e.ExecutablePath = `C:\Windows\System32\lsass.exe` }, "refusing to terminate lsass.exe"},
+		{"reused PID", func(e *ProcessEvent) { e.Timestamp = started.Add(-time.Hour) }, "now belongs to another process"},
+	}
+	for _, tt := range refused {
+		event := target(tt.set)
+		respond(&event)
+		if action := event.Response; action == nil || action.Action != responseKill || action.Succeeded || !strings.Contains(action.Error, tt.error) {
+			t.Errorf("%s: action %+v, want a failed kill with %q", tt.name, action, tt.error)
+		}
+		alive(tt.name)
+	}
+
+	event := target(nil)
+	respond(&event)
+	if action := event.Response; action == nil || !action.Succeeded || action.Error != "" || action.Time.IsZero() {
+		t.Fatalf("action %+v, want a successful kill", action)
+	}
+	select {
+	case <-exited:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the process is still running")
+	}
+}
@@ -0,0 +1,886 @@
+// rules.go
+// Rule set management: built-in LOLBin definitions, loading of an external
+// rules file and atomic hot reload of the active rule set.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LOLBin contains information about a Living off the Land binary
+type LOLBin struct {
+	// Name identifies the rule. It is also the executable file name the
+	// rule applies to unless Image is set.
+	Name string `json:"name"`
+	// Image is the executable file name the rule applies to, or a glob
+	// such as powershell*.exe. Several rules may share an image.
+	Image string `json:"image,omitempty"`
+	// Priority orders evaluation when several rules apply to an event:
+	// higher priorities run first. Within one priority exact images run
+	// before globs, longer globs before shorter ones, then by name.
+	Priority int `json:"priority,omitempty"`
+	// Terminal stops the evaluation of any further rules for an event once
+	// this rule marks it suspicious
+	Terminal       bool     `json:"terminal,omitempty"`
+	SuspiciousArgs []string `json:"suspicious_args,omitempty"`
+	// ArgGroups are suspicious arguments by category, such as download,
+	// execution or obfuscation. They match like SuspiciousArgs, and the
+	// category of a matching argument is recorded on its indicator.
+	ArgGroups map[string][]string `json:"arg_groups,omitempty"`
+	// MatchThreshold is how many distinct suspicious arguments, from
+	// SuspiciousArgs and ArgGroups together, must appear on the command line
+	// before they mark the event suspicious; zero means one
+	MatchThreshold int `json:"match_threshold,omitempty"`
+	// Condition expresses criteria that need all/any/none combinations.
+	// It is an alternative to SuspiciousArgs: either one matching marks
+	// the event suspicious.
+	Condition *Condition `json:"condition,omitempty"`
+	// ExcludePatterns stop this rule from marking an event suspicious when
+	// one of them matches the command line, even if the rule's criteria hit.
+	// Entries are case-insensitive substrings, or regular expressions when
+	// prefixed with "re:". Entries prefixed with "glob:" instead match the
+	// executable path, e.g. glob:C:\Program Files\*\tool.exe. They are
+	// scoped to this rule only, unlike global allowlist exceptions which
+	// apply to every rule.
+	ExcludePatterns []string `json:"exclude_patterns,omitempty"`
+	// MaxCommandLineLength and ArgEntropyThreshold override the configured
+	// heuristic thresholds for this binary
+	MaxCommandLineLength int     `json:"max_cmdline_length,omitempty"`
+	ArgEntropyThreshold  float64 `json:"arg_entropy_threshold,omitempty"`
+	// Cooldown overrides the default alert cooldown for this rule; zero
+	// disables throttling
+	Cooldown *Duration `json:"cooldown,omitempty"`
+	// RequireSignature escalates events whose executable is not validly
+	// signed ("any") or not signed by Microsoft ("microsoft")
+	RequireSignature string `json:"require_signature,omitempty"`
+	// Severity is the severity of the rule's matches; zero uses medium
+	Severity Severity `json:"severity,omitempty"`
+	// Confidence is how sure a match of this rule is to be malicious, as a
+	// percentage; zero scores each match with matchConfidence
+	Confidence int `json:"confidence,omitempty"`
+	// Tags are free-form categories such as download or persistence,
+	// copied onto the events the rule flags
+	Tags []string `json:"tags,omitempty"`
+	// MITRE are the ATT&CK technique IDs of the abuse the rule detects,
+	// such as T1105, reported with its events in ECS output
+	MITRE []string `json:"mitre,omitempty"`
+	// Response is the action taken on critical events the rule flags when
+	// response actions are enabled: kill terminates the process
+	Response string `json:"response,omitempty"`
+}
+
+// SeverityOrDefault returns the severity of the rule's matches
+func (l LOLBin) SeverityOrDefault() Severity {
+	if l.Severity == SeverityNone {
+		return SeverityMedium
+	}
+	return l.Severity
+}
+
+// HasTag reports whether the rule carries a tag, ignoring case
+func (l LOLBin) HasTag(tag string) bool {
+	return containsFold(l.Tags, tag)
+}
+
+// containsFold reports whether values contains s, ignoring case
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// RulesFile is the on-disk format of an external rules file
+type RulesFile struct {
+	LOLBins []LOLBin   `json:"lolbins"`
+	Ignore  IgnoreList `json:"ignore,omitempty"`
+	// Watchlist names binaries whose every execution is reported
+	Watchlist Watchlist `json:"watchlist,omitempty"`
+	// KnownProcesses extends and overrides the built-in table of
+	// well-known process locations
+	KnownProcesses []KnownProcess `json:"known_processes,omitempty"`
+	// Rundll32Exports extends the built-in table of known-good rundll32
+	// DLL and export pairs
+	Rundll32Exports []Rundll32Export `json:"rundll32_exports,omitempty"`
+}
+
+// RulesVersion identifies a loaded rule set
+type RulesVersion struct {
+	Hash     string    `json:"hash"`
+	LoadedAt time.Time `json:"loaded_at"`
+	Source   string    `json:"source"`
+}
+
+// RuleSet is an immutable, validated set of rules. A new RuleSet is built on
+// every reload and swapped in atomically, so a detection that grabbed the
+// current set keeps evaluating against it until it finishes.
+type RuleSet struct {
+	LOLBins map[string]LOLBin
+	Version RulesVersion
+
+	// compiled holds each rule's evaluable form by name
+	compiled map[string]*compiledRule
+	// byImage indexes the rules with an exact image; globs holds the rest
+	byImage map[string][]*ruleEntry
+	globs   []*ruleEntry
+	// ignore lists the binaries never treated as LOLBins
+	ignore *compiledIgnoreList
+	// watchlist lists the binaries reported on every execution
+	watchlist *compiledWatchlist
+	// knownProcesses maps well-known executable names to their locations
+	knownProcesses map[string][]knownLocation
+	// rundll32Exports maps DLL names to the known-good exports called on
+	// them through rundll32
+	rundll32Exports map[string]map[string]bool
+
+	// order lists the rule names in evaluation order; ignoreList,
+	// watchList, knownList and exportList are the definitions ignore,
+	// watchlist, knownProcesses and rundll32Exports were compiled from
+	order      []string
+	ignoreList IgnoreList
+	watchList  Watchlist
+	knownList  []KnownProcess
+	exportList []Rundll32Export
+}
+
+// ruleEntry places a compiled rule in the evaluation order
+type ruleEntry struct {
+	name     string
+	image    string
+	matcher  *globMatcher
+	terminal bool
+	rule     *compiledRule
+	// order is the entry's position in the overall evaluation order
+	order int
+}
+
+// ImageName returns the executable name or glob the rule applies to
+func (l LOLBin) ImageName() string {
+	if l.Image != "" {
+		return strings.ToLower(l.Image)
+	}
+	return strings.ToLower(l.Name)
+}
+
+// matching returns the rules applying to a lowercased executable name in
+// evaluation order. Exact images are a map hit; only the glob rules are
+// scanned.
+func (rs *RuleSet) matching(execName string) []*ruleEntry {
+	exact := rs.byImage[execName]
+	var matches []*ruleEntry
+	for _, entry := range rs.globs {
+		if entry.matcher.Match(execName) {
+			matches = append(matches, entry)
+		}
+	}
+	if len(matches) == 0 {
+		return exact
+	}
+	matches = append(matches, exact...)
+	sort.Slice(matches, func(i, j int) bool { return matches[i].order < matches[j].order })
+	return matches
+}
+
+// mergeRuleEntries merges two lists of matching rule entries into one in
+// evaluation order, without duplicates
+func mergeRuleEntries(a, b []*ruleEntry) []*ruleEntry {
+	merged := append([]*ruleEntry{}, a...)
+	for _, entry := range b {
+		if !slices.Contains(merged, entry) {
+			merged = append(merged, entry)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].order < merged[j].order })
+	return merged
+}
+
+// orderRules sorts rule entries into evaluation order and numbers them
+func orderRules(entries []*ruleEntry, lolbins map[string]LOLBin) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if pa, pb := lolbins[a.name].Priority, lolbins[b.name].Priority; pa != pb {
+			return pa > pb
+		}
+		if (a.matcher == nil) != (b.matcher == nil) {
+			return a.matcher == nil
+		}
+		if len(a.image) != len(b.image) {
+			return len(a.image) > len(b.image)
+		}
+		return a.name < b.name
+	})
+	for i, entry := range entries {
+		entry.order = i
+	}
+}
+
+// compiledRule is a rule prepared for evaluation at load time
+type compiledRule struct {
+	condition  conditionNode
+	exclusions []exclusion
+}
+
+// builtinLOLBins are the definitions compiled into the agent. Entries in an
+// external rules file override these by name.
+var builtinLOLBins = map[string]LOLBin{
+	"certutil.exe": {
+		Name:           "certutil.exe",
+		Tags:           []string{"download", "defense-evasion"},
+		SuspiciousArgs: []string{"-urlcache", "-decode", "-encode", "-decodehex"},
+	},
+	"regsvr32.exe": {
+		Name:           "regsvr32.exe",
+		Tags:           []string{"execution-proxy", "defense-evasion"},
+		SuspiciousArgs: []string{"/i:http", "-i:http", "/u", "-u", "scrobj", ".sct"},
+	},
+	"bitsadmin.exe": {
+		Name:           "bitsadmin.exe",
+		Tags:           []string{"download", "persistence"},
+		SuspiciousArgs: []string{"/transfer", "/addfile", "/setnotifycmdline", "/setnotifyflags"},
+	},
+	"wmic.exe": {
+		Name:           "wmic.exe",
+		Tags:           []string{"execution-proxy"},
+		SuspiciousArgs: []string{"process", "call", "create", "shadowcopy delete"},
+	},
+	"mshta.exe": {
+		Name:           "mshta.exe",
+		Tags:           []string{"execution-proxy"},
+		SuspiciousArgs: []string{"javascript:", "vbscript:", "http://", "https://"},
+	},
+	"powershell.exe": {
+		Name: "powershell.exe",
+		Tags: []string{"execution", "download", "defense-evasion"},
+		ArgGroups: map[string][]string{
+			"download": {"net.webclient", "downloadstring", "downloadfile", "downloaddata", "invoke-webrequest", "iwr ",
+				"invoke-restmethod", "irm ", "start-bitstransfer", "curl ", "wget ", "system.net.http", "msxml2.xmlhttp",
+				"winhttp.winhttprequest", "bitsadmin"},
+			"execution":       {"iex", "invoke-expression", "[scriptblock]::create", "invoke-command", "start-process"},
+			"obfuscation":     {"-e", "-enc", "-encodedcommand", "frombase64string", "-nop", "-noprofile", "-w", "hidden", "[char]", "-bxor", "gzipstream", "deflatestream"},
+			"defense-evasion": {"clear-eventlog", "remove-eventlog"},
+		},
+		// Admin scripts routinely pass long inline commands
+		MaxCommandLineLength: 4096,
+	},
+	"cmd.exe": {
+		Name: "cmd.exe",
+		Tags: []string{"execution"},
+		ArgGroups: map[string][]string{
+			"download": {"downloadstring", "net.webclient", "invoke-webrequest", "iwr ", "curl ", "curl.exe", "wget ",
+				"bitsadmin", "/transfer", "-urlcache", "start-bitstransfer"},
+			"execution":   {"/c", "iex", "invoke-expression", "mshta", "regsvr32", "rundll32", "wscript", "cscript"},
+			"obfuscation": {"^", "%comspec", "call set", "enabledelayedexpansion"},
+		},
+	},
+	"rundll32.exe": {
+		Name:           "rundll32.exe",
+		Tags:           []string{"execution-proxy", "defense-evasion"},
+		SuspiciousArgs: []string{"javascript:", "http://", "https://", ".dll,"},
+	},
+	"msiexec.exe": {
+		Name:           "msiexec.exe",
+		Tags:           []string{"execution-proxy", "download"},
+		SuspiciousArgs: []string{"/q", "http://", "https://"},
+	},
+	"wevtutil.exe": {
+		Name:           "wevtutil.exe",
+		Tags:           []string{"defense-evasion"},
+		SuspiciousArgs: []string{" cl ", " clear-log "},
+	},
+	"vssadmin.exe": {
+		Name:           "vssadmin.exe",
+		Tags:           []string{"impact"},
+		SuspiciousArgs: []string{"delete shadows", "resize shadowstorage"},
+	},
+	"bcdedit.exe": {
+		Name:           "bcdedit.exe",
+		Tags:           []string{"impact"},
+		SuspiciousArgs: []string{"recoveryenabled no", "bootstatuspolicy ignoreallfailures"},
+	},
+	"wbadmin.exe": {
+		Name:           "wbadmin.exe",
+		Tags:           []string{"impact"},
+		SuspiciousArgs: []string{"delete catalog", "delete systemstatebackup", "delete backup"},
+	},
+	// msbuild compiling inline tasks from a project outside the usual
+	// source trees; the image matches the Visual Studio and .NET
+	// Framework copies alike
+	"msbuild.exe": {
+		Name: "msbuild.exe",
+		Tags: []string{"execution-proxy", "defense-evasion"},
+		Condition: &Condition{Any: []Condition{
+			{Arg: `\appdata\`}, {Arg: `\temp\`}, {Arg: `\programdata\`}, {Arg: `\users\public\`},
+			{Arg: `\downloads\`}, {Arg: ".xml"}, {Arg: ".txt"},
+		}},
+	},
+	// cmstp installing a profile silently (/s) without a desktop icon
+	// (/ni), or for all users (/au), is the known UAC bypass
+	"cmstp.exe": {
+		Name: "cmstp.exe",
+		Tags: []string{"execution-proxy", "defense-evasion", "privilege-escalation"},
+		Condition: &Condition{Any: []Condition{
+			{All: []Condition{{Arg: "/ni"}, {Arg: "/s"}}},
+			{Arg: "/au"},
+		}},
+	},
+	// The .NET installer tools running an assembly's uninstall or
+	// unregistration methods, which execute code from the assembly
+	"installutil.exe": {
+		Name:      "installutil.exe",
+		Tags:      []string{"execution-proxy", "defense-evasion"},
+		Condition: dotnetUninstallCondition,
+	},
+	"regasm.exe": {
+		Name:      "regasm.exe",
+		Tags:      []string{"execution-proxy", "defense-evasion"},
+		Condition: dotnetUninstallCondition,
+	},
+	"regsvcs.exe": {
+		Name:      "regsvcs.exe",
+		Tags:      []string{"execution-proxy", "defense-evasion"},
+		Condition: dotnetUninstallCondition,
+	},
+	// Proxies starting the command given as an argument: forfiles /c,
+	// pcalua -a and conhost --headless, which also hides its window
+	"forfiles.exe": {
+		Name:      "forfiles.exe",
+		Tags:      []string{"execution-proxy", "defense-evasion"},
+		Condition: &Condition{Any: []Condition{{Arg: "/c"}, {Arg: "-c"}}},
+	},
+	"pcalua.exe": {
+		Name:      "pcalua.exe",
+		Tags:      []string{"execution-proxy", "defense-evasion"},
+		Condition: &Condition{Any: []Condition{{Arg: "-a"}, {Arg: "/a"}}},
+	},
+	"conhost.exe": {
+		Name:      "conhost.exe",
+		Tags:      []string{"execution-proxy", "defense-evasion"},
+		Condition: &Condition{Arg: "--headless"},
+	},
+	// Scheduled tasks: creating one is persistence, and checkSchtasks
+	// judges what it runs; deleting tasks or swapping their action is
+	// cleanup or hijacking of existing ones
+	"schtasks.exe": {
+		Name:      "schtasks.exe",
+		Tags:      []string{"persistence", "execution"},
+		Condition: &Condition{Any: []Condition{{Arg: "/create"}, {Arg: "-create"}}},
+	},
+	"schtasks-delete": {
+		Name:      "schtasks-delete",
+		Image:     "schtasks.exe",
+		Severity:  SeverityLow,
+		Tags:      []string{"defense-evasion"},
+		Condition: &Condition{Any: []Condition{{Arg: "/delete"}, {Arg: "-delete"}}},
+	},
+	"schtasks-change": {
+		Name:     "schtasks-change",
+		Image:    "schtasks.exe",
+		Severity: SeverityLow,
+		Tags:     []string{"persistence"},
+		Condition: &Condition{All: []Condition{
+			{Any: []Condition{{Arg: "/change"}, {Arg: "-change"}}},
+			{Any: []Condition{{Arg: "/tr"}, {Arg: "-tr"}}},
+		}},
+	},
+	// reg.exe: writes to autostart keys are persistence, and checkRegistry
+	// tells which location a write targets; saving the SAM, SYSTEM or
+	// SECURITY hive hands over the local password hashes
+	"reg.exe": {
+		Name: "reg.exe",
+		Tags: []string{"persistence"},
+		Condition: &Condition{All: []Condition{
+			{Any: []Condition{{Arg: " add "}, {Arg: " import "}}},
+			{Any: []Condition{
+				{Arg: `\currentversion\run`},
+				{Arg: `\policies\explorer\run`},
+				{Arg: `\winlogon`},
+				{Arg: `image file execution options`},
+				{Arg: `appinit_dlls`},
+				{Arg: `\microsoft\netsh`},
+				{Arg: `\services\`},
+				{Arg: ".reg"},
+			}},
+		}},
+	},
+	"reg-save-hive": {
+		Name:     "reg-save-hive",
+		Image:    "reg.exe",
+		Severity: SeverityHigh,
+		Tags:     []string{"credential-access"},
+		Condition: &Condition{All: []Condition{
+			{Arg: " save "},
+			{Any: []Condition{{Arg: `\sam`}, {Arg: `\system`}, {Arg: `\security`}}},
+		}},
+	},
+	// netsh: helper DLLs load into every netsh run, and checkNetsh weighs
+	// where the DLL lives and who signed it; packet captures can harvest
+	// cleartext credentials
+	"netsh.exe": {
+		Name:      "netsh.exe",
+		Severity:  SeverityHigh,
+		Tags:      []string{"persistence"},
+		Condition: &Condition{Arg: "add helper"},
+	},
+	"netsh-trace": {
+		Name:     "netsh-trace",
+		Image:    "netsh.exe",
+		Severity: SeverityLow,
+		Tags:     []string{"collection"},
+		Condition: &Condition{All: []Condition{
+			{Arg: "trace start"},
+			{Arg: "capture=yes"},
+		}},
+	},
+	// dnscmd: a server level plugin DLL is loaded as SYSTEM by the DNS
+	// Server service
+	"dnscmd.exe": {
+		Name:     "dnscmd.exe",
+		Severity: SeverityCritical,
+		Tags:     []string{"persistence", "privilege-escalation"},
+		Condition: &Condition{Any: []Condition{
+			{Arg: "/serverlevelplugindll"},
+			{Arg: "-serverlevelplugindll"},
+		}},
+	},
+	// esentutl: /y copies any file, locked ones too with /vss, and
+	// checkCredentialCopy tells which copies are of credential stores
+	"esentutl.exe": {
+		Name: "esentutl.exe",
+		Tags: []string{"credential-access", "collection"},
+		Condition: &Condition{All: []Condition{
+			{Any: []Condition{{Arg: "/y"}, {Arg: "-y"}}},
+			{Any: []Condition{
+				{Arg: "/vss"},
+				{Arg: "-vss"},
+				{Arg: "harddiskvolumeshadowcopy"},
+				{Arg: "ntds.dit"},
+				{Arg: `\config\sam`},
+				{Arg: `\config\system`},
+				{Arg: `\config\security`},
+			}},
+		}},
+	},
+	// ntdsutil: IFM media holds the whole AD database; the menu commands
+	// can be abbreviated and split across arguments, so checkNTDSUtil
+	// parses them rather than the rule matching substrings
+	"ntdsutil.exe": {
+		Name: "ntdsutil.exe",
+		Tags: []string{"credential-access"},
+	},
+	"curl.exe": {
+		Name:           "curl.exe",
+		Tags:           []string{"download"},
+		SuspiciousArgs: []string{"://", "-o", "--output"},
+	},
+	"certreq.exe": {
+		Name: "certreq.exe",
+		Tags: []string{"download", "exfiltration"},
+		Condition: &Condition{All: []Condition{
+			{Any: []Condition{{Arg: "-post"}, {Arg: "/post"}}},
+			{Any: []Condition{{Arg: "-config"}, {Arg: "/config"}}},
+		}},
+	},
+	"desktopimgdownldr.exe": {
+		Name:           "desktopimgdownldr.exe",
+		Tags:           []string{"download"},
+		SuspiciousArgs: []string{"/lockscreenurl:"},
+	},
+	"gfxdownloadwrapper.exe": {
+		Name:           "gfxdownloadwrapper.exe",
+		Tags:           []string{"download"},
+		SuspiciousArgs: []string{"://"},
+	},
+	"hh.exe": {
+		Name: "hh.exe",
+		Tags: []string{"execution", "defense-evasion"},
+	},
+	// odbcconf: REGSVR and INSTALLDRIVER actions load DLLs, from /a blocks
+	// or a /f response file, so checkODBCConf parses them
+	"odbcconf.exe": {
+		Name: "odbcconf.exe",
+		Tags: []string{"execution", "defense-evasion"},
+	},
+	// verclsid, xwizard and openwith instantiate the COM class named on
+	// their command line; checkCOMProxy resolves its server
+	"verclsid.exe": {
+		Name:      "verclsid.exe",
+		Tags:      []string{"execution-proxy", "defense-evasion"},
+		Condition: &Condition{Any: []Condition{{Arg: "/c"}, {Arg: "-c"}}},
+	},
+	"xwizard.exe": {
+		Name:           "xwizard.exe",
+		Tags:           []string{"execution-proxy", "defense-evasion"},
+		SuspiciousArgs: []string{"runwizard"},
+	},
+	"openwith.exe": {
+		Name:      "openwith.exe",
+		Tags:      []string{"execution-proxy", "defense-evasion"},
+		Condition: &Condition{Any: []Condition{{Arg: "/run"}, {Arg: "-run"}}},
+	},
+	// control.exe loads any DLL named as a control panel item;
+	// checkControlPanel judges where it comes from
+	"control.exe": {
+		Name: "control.exe",
+		Tags: []string{"execution-proxy"},
+	},
+	// Auto-elevating binaries abused for UAC bypasses; checkUACBypass
+	// judges their launcher and planted HKCU handlers
+	"fodhelper.exe": {
+		Name: "fodhelper.exe",
+		Tags: []string{"privilege-escalation"},
+	},
+	"computerdefaults.exe": {
+		Name: "computerdefaults.exe",
+		Tags: []string{"privilege-escalation"},
+	},
+	"wsreset.exe": {
+		Name: "wsreset.exe",
+		Tags: []string{"privilege-escalation"},
+	},
+	"sdclt.exe": {
+		Name: "sdclt.exe",
+		Tags: []string{"privilege-escalation"},
+	},
+	"findstr.exe": {
+		Name: "findstr.exe",
+		Tags: []string{"staging"},
+	},
+	"expand.exe": {
+		Name: "expand.exe",
+		Tags: []string{"staging"},
+	},
+	"extrac32.exe": {
+		Name: "extrac32.exe",
+		Tags: []string{"staging"},
+	},
+	"replace.exe": {
+		Name: "replace.exe",
+		Tags: []string{"staging"},
+	},
+	"print.exe": {
+		Name: "print.exe",
+		Tags: []string{"staging"},
+	},
+	"sc.exe": {
+		Name:           "sc.exe",
+		Tags:           []string{"persistence"},
+		SuspiciousArgs: []string{"create", "config", "failure"},
+	},
+}
+
+var (
+	activeRules atomic.Pointer[RuleSet]
+	reloadMutex = &sync.Mutex{}
+)
+
+// currentRules returns the active rule set
+func currentRules() *RuleSet {
+	return activeRules.Load()
+}
+
+// loadRuleSet builds a rule set from the built-in definitions merged with the
+// rules file at path (if any). Nothing is activated here.
+func loadRuleSet(path string) (*RuleSet, error) {
+	merged := make(map[string]LOLBin, len(builtinLOLBins))
+	for name, lolbin := range builtinLOLBins {
+		merged[name] = lolbin
+	}
+
+	source := "builtin"
+	var ignoreList IgnoreList
+	var watchList Watchlist
+	var knownList []KnownProcess
+	var exportList []Rundll32Export
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rules file: %v", err)
+		}
+
+		var file RulesFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse rules file: %v", err)
+		}
+
+		seen := make(map[string]bool)
+		for i, lolbin := range file.LOLBins {
+			if err := validateLOLBin(lolbin); err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i, err)
+			}
+			name := strings.ToLower(lolbin.Name)
+			if seen[name] {
+				return nil, fmt.Errorf("rule %d: duplicate definition for %s", i, name)
+			}
+			seen[name] = true
+			lolbin.Name = name
+			lolbin.Tags = lowerAll(lolbin.Tags)
+			merged[name] = lolbin
+		}
+		ignoreList = file.Ignore
+		watchList = file.Watchlist
+		knownList = file.KnownProcesses
+		exportList = file.Rundll32Exports
+		source = path
+	}
+
+	ignore, err := compileIgnoreList(ignoreList)
+	if err != nil {
+		return nil, err
+	}
+	watchlist, err := compileWatchlist(watchList)
+	if err != nil {
+		return nil, err
+	}
+	knownProcesses, err := compileKnownProcesses(knownList)
+	if err != nil {
+		return nil, err
+	}
+	rundll32Exports, err := compileRundll32Exports(exportList)
+	if err != nil {
+		return nil, err
+	}
+
+	compiled := make(map[string]*compiledRule, len(merged))
+	entries := make([]*ruleEntry, 0, len(merged))
+	for name, lolbin := range merged {
+		node, err := compileLOLBin(lolbin)
+		if err != nil {
+			return nil, err
+		}
+		exclusions, err := compileExclusions(lolbin.ExcludePatterns)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		rule := &compiledRule{condition: node, exclusions: exclusions}
+		compiled[name] = rule
+
+		entry := &ruleEntry{name: name, image: lolbin.ImageName(), terminal: lolbin.Terminal, rule: rule}
+		if isGlob(entry.image) {
+			if entry.matcher, err = compileGlob(entry.image); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	// Sort by priority with a total order so a reload of the same rules
+	// always evaluates them in the same sequence
+	orderRules(entries, merged)
+	byImage := make(map[string][]*ruleEntry)
+	var globs []*ruleEntry
+	order := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		order = append(order, entry.name)
+		if entry.matcher != nil {
+			globs = append(globs, entry)
+		} else {
+			byImage[entry.image] = append(byImage[entry.image], entry)
+		}
+	}
+
+	// Hash the effective rules rather than the raw file so formatting-only
+	// edits keep the same version.
+	encoded, err := json.Marshal(merged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash rules: %v", err)
+	}
+	if len(ignoreList.Binaries) > 0 {
+		// Only hashed when used, so rule sets without one keep their version
+		encodedIgnore, err := json.Marshal(ignoreList)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash rules: %v", err)
+		}
+		encoded = append(encoded, encodedIgnore...)
+	}
+	if len(watchList.Binaries) > 0 {
+		encodedWatch, err := json.Marshal(watchList)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash rules: %v", err)
+		}
+		encoded = append(encoded, encodedWatch...)
+	}
+	if len(knownList) > 0 {
+		encodedKnown, err := json.Marshal(knownList)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash rules: %v", err)
+		}
+		encoded = append(encoded, encodedKnown...)
+	}
+	if len(exportList) > 0 {
+		encodedExports, err := json.Marshal(exportList)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash rules: %v", err)
+		}
+		encoded = append(encoded, encodedExports...)
+	}
+	sum := sha256.Sum256(encoded)
+
+	return &RuleSet{
+		LOLBins:         merged,
+		compiled:        compiled,
+		byImage:         byImage,
+		globs:           globs,
+		ignore:          ignore,
+		watchlist:       watchlist,
+		knownProcesses:  knownProcesses,
+		rundll32Exports: rundll32Exports,
+		order:           order,
+		ignoreList:      ignoreList,
+		watchList:       watchList,
+		knownList:       knownList,
+		exportList:      exportList,
+		Version: RulesVersion{
+			Hash:     hex.EncodeToString(sum[:]),
+			LoadedAt: time.Now(),
+			Source:   source,
+		},
+	}, nil
+}
+
+// validateLOLBin checks a single rule definition for obvious mistakes
+func validateLOLBin(lolbin LOLBin) error {
+	if strings.TrimSpace(lolbin.Name) == "" {
+		return fmt.Errorf("missing name")
+	}
+	if image := lolbin.ImageName(); isGlob(image) {
+		if _, err := compileGlob(image); err != nil {
+			return fmt.Errorf("%s: %v", lolbin.Name, err)
+		}
+	}
+	// A rule without suspicious_args, arg_groups or a condition is valid:
+	// like several built-ins, it marks the binary as a LOLBin so that its
+	// dedicated detectors and IOC extraction apply
+	for _, arg := range lolbin.SuspiciousArgs {
+		if strings.TrimSpace(arg) == "" {
+			return fmt.Errorf("%s: empty suspicious argument", lolbin.Name)
+		}
+	}
+	for category, args := range lolbin.ArgGroups {
+		if strings.TrimSpace(category) == "" {
+			return fmt.Errorf("%s: empty argument group name", lolbin.Name)
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("%s: argument group %s is empty", lolbin.Name, category)
+		}
+		for _, arg := range args {
+			if strings.TrimSpace(arg) == "" {
+				return fmt.Errorf("%s: empty suspicious argument in group %s", lolbin.Name, category)
+			}
+		}
+	}
+	if distinct := len(suspiciousArgLeaves(lolbin)); lolbin.MatchThreshold < 0 || lolbin.MatchThreshold > distinct {
+		return fmt.Errorf("%s: match_threshold must be between 0 and the %d distinct suspicious arguments", lolbin.Name, distinct)
+	}
+	if lolbin.MaxCommandLineLength < 0 || lolbin.ArgEntropyThreshold < 0 {
+		return fmt.Errorf("%s: negative heuristic threshold", lolbin.Name)
+	}
+	if lolbin.Cooldown != nil && *lolbin.Cooldown < 0 {
+		return fmt.Errorf("%s: negative cooldown", lolbin.Name)
+	}
+	if lolbin.Confidence < 0 || lolbin.Confidence > 100 {
+		return fmt.Errorf("%s: confidence must be between 0 and 100", lolbin.Name)
+	}
+	for _, tag := range lolbin.Tags {
+		if strings.TrimSpace(tag) == "" {
+			return fmt.Errorf("%s: empty tag", lolbin.Name)
+		}
+	}
+	for _, id := range lolbin.MITRE {
+		if !mitreTechniquePattern.MatchString(id) {
+			return fmt.Errorf("%s: invalid ATT&CK technique ID %q", lolbin.Name, id)
+		}
+	}
+	switch lolbin.RequireSignature {
+	case "", signatureAny, signatureMicrosoft:
+	default:
+		return fmt.Errorf("%s: unknown require_signature %q", lolbin.Name, lolbin.RequireSignature)
+	}
+	switch lolbin.Response {
+	case "", responseKill:
+	default:
+		return fmt.Errorf("%s: unknown response %q", lolbin.Name, lolbin.Response)
+	}
+	return nil
+}
+
+// reloadRules re-reads the rules file and swaps the new rule set in only if it
+// parsed and validated. On failure the previous rules stay active.
+func reloadRules() (*RuleSet, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	rules, err := loadRuleSet(config.RulesPath)
+	if err != nil {
+		logError(2, "Rules reload failed, keeping version %s: %v", currentRules().Version.Hash, err)
+		return nil, err
+	}
+
+	// An explicit reload ends any pause a rollback put on the watcher
+	pausedRulesFile = nil
+	activateRules(rules)
+	logInfo(2, "Rules reloaded from %s (version %s)", rules.Version.Source, rules.Version.Hash)
+	return rules, nil
+}
+
+// exclusion is a compiled per-rule exclude pattern
+type exclusion struct {
+	pattern   string
+	substring string
+	regex     *regexp.Regexp
+	// pathGlob matches the executable path rather than the command line
+	pathGlob *globMatcher
+}
+
+// matches reports whether the lowercased command line or executable path
+// hits the exclusion
+func (e exclusion) matches(cmdLine, path string) bool {
+	if e.pathGlob != nil {
+		return e.pathGlob.Match(path)
+	}
+	if e.regex != nil {
+		return e.regex.MatchString(cmdLine)
+	}
+	return strings.Contains(cmdLine, e.substring)
+}
+
+// compileExclusions parses a rule's exclude patterns
+func compileExclusions(patterns []string) ([]exclusion, error) {
+	exclusions := make([]exclusion, 0, len(patterns))
+	for _, pattern := range patterns {
+		if expr, ok := strings.CutPrefix(pattern, "re:"); ok {
+			regex, err := regexp.Compile("(?i)" + expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exclude pattern %q: %v", pattern, err)
+			}
+			exclusions = append(exclusions, exclusion{pattern: pattern, regex: regex})
+			continue
+		}
+		if glob, ok := strings.CutPrefix(pattern, "glob:"); ok {
+			compiled, err := compileGlob(glob)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exclude pattern %q: %v", pattern, err)
+			}
+			exclusions = append(exclusions, exclusion{pattern: pattern, pathGlob: compiled})
+			continue
+		}
+		if strings.TrimSpace(pattern) == "" {
+			return nil, fmt.Errorf("empty exclude pattern")
+		}
+		exclusions = append(exclusions, exclusion{pattern: pattern, substring: strings.ToLower(pattern)})
+	}
+	return exclusions, nil
+}
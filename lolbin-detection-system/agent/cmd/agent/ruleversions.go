@@ -0,0 +1,105 @@
+// ruleversions.go
+// History of the rule sets loaded since startup, so a bad rules push can be
+// rolled back to a previous version without touching the rules file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+)
+
+var (
+	// rulesHistory holds the most recently activated rule sets, newest
+	// first, one per version. Guarded by reloadMutex.
+	rulesHistory []*RuleSet
+
+	// pausedRulesFile is the checksum of the rules file at the time of a
+	// rollback. While it is set the file watcher ignores the file until its
+	// content changes, so the rolled back rules aren't re-loaded right away.
+	// Guarded by reloadMutex.
+	pausedRulesFile *[sha256.Size]byte
+)
+
+// activateRules makes a rule set the active one and records it in the
+// history. The caller holds reloadMutex.
+func activateRules(rules *RuleSet) {
+	activeRules.Store(rules)
+	syncRuleStats(rules)
+
+	history := []*RuleSet{rules}
+	for _, previous := range rulesHistory {
+		if previous.Version.Hash != rules.Version.Hash && len(history) < config.RulesHistory {
+			history = append(history, previous)
+		}
+	}
+	rulesHistory = history
+}
+
+// ruleVersions returns the versions in the history, newest first
+func ruleVersions() []RulesVersion {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	versions := make([]RulesVersion, 0, len(rulesHistory))
+	for _, rules := range rulesHistory {
+		versions = append(versions, rules.Version)
+	}
+	return versions
+}
+
+// rollbackRules reactivates the rule set with the given version hash and
+// pauses the rules file watcher until the file changes
+func rollbackRules(hash string) (*RuleSet, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	var target *RuleSet
+	for _, rules := range rulesHistory {
+		if rules.Version.Hash == hash {
+			target = rules
+			break
+		}
+	}
+	if target == nil {
+		return nil, fmt.Errorf("unknown rules version %s", hash)
+	}
+
+	previous := currentRules().Version.Hash
+	activateRules(target)
+	if config.RulesPath != "" {
+		sum := rulesFileChecksum(config.RulesPath)
+		pausedRulesFile = &sum
+	}
+	logInfo(2, "Rules rolled back from version %s to %s (loaded %s)",
+		previous, target.Version.Hash, target.Version.LoadedAt.Format("2006-01-02 15:04:05"))
+	return target, nil
+}
+
+// rulesFileChecksum returns the checksum of the rules file's content. An
+// unreadable file yields the zero checksum.
+func rulesFileChecksum(path string) [sha256.Size]byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}
+	}
+	return sha256.Sum256(data)
+}
+
+// rulesFileChanged is called by the watcher when the rules file may have
+// changed. It reloads unless a rollback paused reloading and the file
+// content is still the one that was rolled back from.
+func rulesFileChanged(path string) {
+	reloadMutex.Lock()
+	paused := pausedRulesFile != nil && *pausedRulesFile == rulesFileChecksum(path)
+	reloadMutex.Unlock()
+
+	if paused {
+		logInfo(2, "Rules file unchanged since rollback, not reloading")
+		return
+	}
+	// reloadRules validates before swapping and logs failures, keeping the
+	// previous rules active
+	reloadRules()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// resetRulesHistory keeps the rule set history, the watcher pause and the
+// active rules from leaking out of the test
+func resetRulesHistory(t *testing.T) {
+	t.Helper()
+	savedRules, savedHistory, savedPause := currentRules(), rulesHistory, pausedRulesFile
+	rulesHistory, pausedRulesFile = nil, nil
+	t.Cleanup(func() {
+		activeRules.Store(savedRules)
+		rulesHistory, pausedRulesFile = savedHistory, savedPause
+	})
+}
+
+// rewriteRulesFile replaces the content of the rules file at path
+func rewriteRulesFile(t *testing.T, path string, file RulesFile) {
+	t.Helper()
+	data, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rollback calls the rollback endpoint for hash and decodes its response
+func rollback(t *testing.T, hash string) (int, RulesVersion) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/api/rules/rollback/"+hash, nil), map[string]string{"hash": hash})
+	rollbackRulesHandler(rec, req)
+	var body struct {
+		Active RulesVersion `json:"active"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("rollback %s: invalid JSON %q: %v", hash, rec.Body, err)
+	}
+	return rec.Code, body.Active
+}
+
+func TestRollbackRules(t *testing.T) {
+	resetRulesHistory(t)
+	good := RulesFile{LOLBins: []LOLBin{{Name: "tool.exe", SuspiciousArgs: []string{"-get"}}}}
+	bad := RulesFile{LOLBins: []LOLBin{{Name: "tool.exe", SuspiciousArgs: []string{"-other"}}}}
+	path := writeRulesFile(t, good)
+	withConfig(t, func(c *Config) { c.RulesPath = path })
+
+	first, err := reloadRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewriteRulesFile(t, path, bad)
+	second, err := reloadRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Version.Hash == second.Version.Hash {
+		t.Fatal("both rules files have the same version")
+	}
+
+	code, active := rollback(t, first.Version.Hash)
+	if code != http.StatusOK || active.Hash != first.Version.Hash {
+		t.Fatalf("rollback: status %d, active %s, want %s", code, active.Hash, first.Version.Hash)
+	}
+	if currentRules() != first || !evaluate(`C:\Tools\tool.exe`, "tool.exe -get x").Suspicious {
+		t.Error("the rolled back rules aren't the ones in effect")
+	}
+
+	// The watcher leaves the rolled back rules alone while the file still
+	// holds the rules rolled back from, even when it is written again
+	rulesFileChanged(path)
+	rewriteRulesFile(t, path, bad)
+	rulesFileChanged(path)
+	if got := currentRules().Version.Hash; got != first.Version.Hash {
+		t.Errorf("the watcher reloaded version %s over the rollback", got)
+	}
+
+	// New content ends the pause
+	rewriteRulesFile(t, path, RulesFile{LOLBins: []LOLBin{{Name: "tool.exe", SuspiciousArgs: []string{"-new"}}}})
+	rulesFileChanged(path)
+	if got := currentRules().Version.Hash; got == first.Version.Hash || got == second.Version.Hash || pausedRulesFile != nil {
+		t.Errorf("version %s active after the rules file changed, want the new one", got)
+	}
+	versions := ruleVersions()
+	if len(versions) != 3 || versions[1].Hash != first.Version.Hash || versions[2].Hash != second.Version.Hash {
+		t.Errorf("versions %+v, want the new one, then the rolled back one and the one rolled back from", versions)
+	}
+}
+
+func TestRollbackRulesUnknown(t *testing.T) {
+	resetRulesHistory(t)
+	withConfig(t, func(c *Config) { c.RulesPath = writeRulesFile(t, RulesFile{}) })
+	rules, err := reloadRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, active := rollback(t, "0123")
+	if code != http.StatusNotFound || active.Hash != rules.Version.Hash || currentRules() != rules {
+		t.Errorf("rollback to an unknown version: status %d, active %s, want 404 keeping %s", code, active.Hash, rules.Version.Hash)
+	}
+	if pausedRulesFile != nil {
+		t.Error("a failed rollback paused the watcher")
+	}
+}
@@ -0,0 +1,247 @@
+// rundll32.go
+// Export-name heuristics for rundll32. Legitimate use sticks to a small set
+// of well-known DLL and export pairs, such as shell32 Control_RunDLL or
+// user32 LockWorkStation, while abuse calls whatever export the payload
+// author picked. Pairs outside the known-good table are flagged, the more
+// so when the DLL isn't in System32 or the export looks generated or is a
+// default name like DllMain or StartW.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Rundll32Export is an entry of the rules file's known-good rundll32
+// table: a DLL and the exports legitimately called on it
+type Rundll32Export struct {
+	// DLL is the file name, e.g. shell32.dll; .dll is assumed when it has
+	// no extension
+	DLL     string   `json:"dll"`
+	Exports []string `json:"exports"`
+}
+
+// builtinRundll32Exports are the known-good pairs compiled into the agent.
+// Entries of the rules file add to these.
+var builtinRundll32Exports = []Rundll32Export{
+	{DLL: "shell32.dll", Exports: []string{"Control_RunDLL", "Control_RunDLLAsUser", "OpenAs_RunDLL", "Options_RunDLL", "SHHelpShortcuts_RunDLL", "SHCreateLocalServerRunDll"}},
+	{DLL: "user32.dll", Exports: []string{"LockWorkStation", "UpdatePerUserSystemParameters"}},
+	{DLL: "printui.dll", Exports: []string{"PrintUIEntry"}},
+	{DLL: "keymgr.dll", Exports: []string{"KRShowKeyMgr", "PRShowSaveWizardExW"}},
+	{DLL: "inetcpl.cpl", Exports: []string{"ClearMyTracksByProcess"}},
+	{DLL: "sysdm.cpl", Exports: []string{"EditEnvironmentVariables"}},
+	{DLL: "powrprof.dll", Exports: []string{"SetSuspendState"}},
+	{DLL: "ndfapi.dll", Exports: []string{"NdfRunDllDiagnoseIncident"}},
+	{DLL: "devmgr.dll", Exports: []string{"DeviceProperties_RunDLL"}},
+	{DLL: "dfshim.dll", Exports: []string{"ShOpenVerbApplication", "ShOpenVerbShortcut"}},
+	{DLL: "davclnt.dll", Exports: []string{"DavSetCookie"}},
+	{DLL: "cryptext.dll", Exports: []string{"CryptExtOpenCER", "CryptExtOpenCRL", "CryptExtOpenCTL", "CryptExtOpenPKCS7", "CryptExtAddPFX"}},
+	{DLL: "themecpl.dll", Exports: []string{"OpenThemeAction"}},
+	{DLL: "mshtml.dll", Exports: []string{"PrintHTML"}},
+	{DLL: "tsworkspace.dll", Exports: []string{"TaskUpdateWorkspaces"}},
+	{DLL: "acproxy.dll", Exports: []string{"PerformAutochkOperations"}},
+	{DLL: "aepdu.dll", Exports: []string{"AePduRunUpdate"}},
+	{DLL: "pla.dll", Exports: []string{"PlaHost"}},
+	{DLL: "werconcpl.dll", Exports: []string{"LaunchErcApp"}},
+	{DLL: "migautoplay.dll", Exports: []string{"ClearMigAutoPlay"}},
+}
+
+// defaultExportNames are exports payload frameworks and DLL templates ship
+// with, which no Windows component is called through
+var defaultExportNames = map[string]bool{
+	"dllmain": true, "start": true, "startw": true, "run": true, "runw": true, "main": true,
+	"entry": true, "entrypoint": true, "execute": true, "exec": true, "test": true,
+	"dllregisterserver": true, "dllunregisterserver": true, "dllinstall": true, "dllgetclassobject": true,
+}
+
+// Rundll32Call is the DLL export an event calls through rundll32
+type Rundll32Call struct {
+	DLL    string `json:"dll"`
+	Export string `json:"export"`
+	// Known is set for pairs in the known-good table
+	Known bool `json:"known"`
+	// OutsideSystem32 is set when the DLL isn't in System32 or SysWOW64
+	OutsideSystem32 bool `json:"outside_system32,omitempty"`
+	// UnusualExport is set for ordinals and for short, random-looking or
+	// default export names
+	UnusualExport bool `json:"unusual_export,omitempty"`
+}
+
+// normalizeRundll32DLL returns the lowercased file name of a DLL as
+// rundll32 loads it, with .dll added when there is no extension
+func normalizeRundll32DLL(dll string) string {
+	name := strings.ToLower(filepath.Base(strings.ReplaceAll(dll, "/", `\`)))
+	if filepath.Ext(name) == "" {
+		name += ".dll"
+	}
+	return name
+}
+
+// mergeRundll32Exports merges the rules file's known-good rundll32 table
+// into the built-in one, keyed by normalized DLL name with the exports
+// lowercased and sorted
+func mergeRundll32Exports(entries []Rundll32Export) (map[string][]string, error) {
+	merged := make(map[string][]string)
+	add := func(dll string, exports []string) {
+		for _, export := range exports {
+			if export = strings.ToLower(strings.TrimSpace(export)); !containsString(merged[dll], export) {
+				merged[dll] = append(merged[dll], export)
+			}
+		}
+	}
+	for _, known := range builtinRundll32Exports {
+		add(normalizeRundll32DLL(known.DLL), known.Exports)
+	}
+	for i, known := range entries {
+		dll := strings.TrimSpace(known.DLL)
+		if dll == "" || strings.ContainsAny(dll, `\/`) {
+			return nil, fmt.Errorf("rundll32_exports[%d]: invalid dll %q", i, known.DLL)
+		}
+		if len(known.Exports) == 0 {
+			return nil, fmt.Errorf("rundll32_exports[%d]: %s has no exports", i, dll)
+		}
+		for _, export := range known.Exports {
+			if strings.TrimSpace(export) == "" {
+				return nil, fmt.Errorf("rundll32_exports[%d]: %s has an empty export", i, dll)
+			}
+		}
+		add(normalizeRundll32DLL(dll), known.Exports)
+	}
+	for _, exports := range merged {
+		sort.Strings(exports)
+	}
+	return merged, nil
+}
+
+// compileRundll32Exports merges the known-good rundll32 table into sets
+func compileRundll32Exports(entries []Rundll32Export) (map[string]map[string]bool, error) {
+	merged, err := mergeRundll32Exports(entries)
+	if err != nil {
+		return nil, err
+	}
+	compiled := make(map[string]map[string]bool, len(merged))
+	for dll, exports := range merged {
+		compiled[dll] = make(map[string]bool, len(exports))
+		for _, export := range exports {
+			compiled[dll][export] = true
+		}
+	}
+	return compiled, nil
+}
+
+// parseRundll32 returns the DLL and export a rundll32 command line calls.
+// rundll32 takes the export after a comma, a space or both, and the DLL
+// may be quoted. Script URLs and the -sta and -localserver COM forms have
+// no export and are left to other detectors.
+func parseRundll32(cmdLine string) (dll, export string, ok bool) {
+	rest := strings.TrimLeft(cmdLine, " \t")
+	// Skip the image
+	if strings.HasPrefix(rest, `"`) {
+		end := strings.IndexByte(rest[1:], '"')
+		if end < 0 {
+			return "", "", false
+		}
+		rest = rest[end+2:]
+	} else if end := strings.IndexAny(rest, " \t"); end >= 0 {
+		rest = rest[end:]
+	} else {
+		return "", "", false
+	}
+	rest = strings.TrimLeft(rest, " \t")
+	if strings.HasPrefix(rest, "-") || strings.HasPrefix(strings.ToLower(rest), "javascript:") {
+		return "", "", false
+	}
+
+	if strings.HasPrefix(rest, `"`) {
+		end := strings.IndexByte(rest[1:], '"')
+		if end < 0 {
+			return "", "", false
+		}
+		dll, rest = rest[1:end+1], rest[end+2:]
+	} else {
+		end := strings.IndexAny(rest, ", \t")
+		if end < 0 {
+			return "", "", false
+		}
+		dll, rest = rest[:end], rest[end:]
+	}
+	rest = strings.TrimLeft(rest, " \t")
+	rest = strings.TrimPrefix(rest, ",")
+	rest = strings.TrimLeft(rest, " \t")
+	if end := strings.IndexAny(rest, ", \t"); end >= 0 {
+		rest = rest[:end]
+	}
+	export = strings.Trim(rest, `"`)
+	return dll, export, dll != "" && export != ""
+}
+
+// unusualExport reports whether an export is an ordinal, very short, a
+// default name or looks randomly generated: long, nearly every character
+// distinct, and hardly any vowels
+func unusualExport(export string) bool {
+	lower := strings.ToLower(export)
+	if strings.HasPrefix(lower, "#") || len(lower) <= 3 || defaultExportNames[lower] {
+		return true
+	}
+	if len(lower) < 8 {
+		return false
+	}
+	vowels := 0
+	for _, c := range lower {
+		if strings.ContainsRune("aeiou", c) {
+			vowels++
+		}
+	}
+	return shannonEntropy(export) >= math.Log2(float64(len(export)))-0.5 && float64(vowels)/float64(len(lower)) < 0.2
+}
+
+// checkRundll32Export flags rundll32 calling a DLL export outside the
+// known-good table, raising the severity when the DLL lives outside
+// System32 and when the export looks generated
+func checkRundll32Export(ctx *DetectionContext, event *ProcessEvent) {
+	if ctx.ExecName != "rundll32.exe" {
+		return
+	}
+	dll, export, ok := parseRundll32(event.CommandLine)
+	if !ok {
+		return
+	}
+	call := &Rundll32Call{DLL: dll, Export: export}
+	event.Rundll32 = call
+	if event.DumpTarget != nil {
+		// The memory dump detection has already judged this call
+		return
+	}
+	if exports, ok := ctx.Rules.rundll32Exports[normalizeRundll32DLL(dll)]; ok && exports[strings.ToLower(export)] {
+		call.Known = true
+		return
+	}
+
+	path := expandWindowsEnv(dll)
+	if !strings.ContainsAny(path, `\/`) {
+		// Bare names are loaded from System32
+		path = filepath.Join(system32Dir(), path)
+	}
+	call.OutsideSystem32 = !inWindowsSystemDir(path)
+	call.UnusualExport = unusualExport(export)
+
+	severity, confidence := SeverityLow, ConfidenceLow
+	reason := fmt.Sprintf("rundll32 calls unknown export %s of %s", export, dll)
+	if call.OutsideSystem32 {
+		severity++
+		confidence += 20
+		reason += ", a DLL outside System32"
+	}
+	if call.UnusualExport {
+		severity++
+		confidence += 20
+		reason += ", with an unusual export name"
+	}
+	event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "rundll32_export", Value: normalizeRundll32DLL(dll) + "," + export, Category: "execution-proxy"})
+	addFinding(event, severity, confidence, "Unknown rundll32 export: "+reason)
+	addTags(event, []string{"execution-proxy"})
+}
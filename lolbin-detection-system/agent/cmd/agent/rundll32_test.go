@@ -0,0 +1,94 @@
+package main
+
+import "testing"
+
+func TestParseRundll32(t *testing.T) {
+	tests := []struct {
+		cmdLine     string
+		dll, export string
+	}{
+		// The export after a comma, a space or both
+		{`rundll32.exe shell32.dll,Control_RunDLL desk.cpl`, "shell32.dll", "Control_RunDLL"},
+		{`rundll32 shell32.dll Control_RunDLL`, "shell32.dll", "Control_RunDLL"},
+		{`rundll32.exe shell32.dll , Control_RunDLL`, "shell32.dll", "Control_RunDLL"},
+		{`rundll32.exe shell32.dll ,Control_RunDLL`, "shell32.dll", "Control_RunDLL"},
+		{`rundll32.exe shell32.dll,  Control_RunDLL`, "shell32.dll", "Control_RunDLL"},
+		{"rundll32.exe\tuser32.dll,LockWorkStation", "user32.dll", "LockWorkStation"},
+		// Quoted image, DLL and export
+		{`"C:\Windows\System32\rundll32.exe" "C:\Users\Public\my evil.dll",StartW`, `C:\Users\Public\my evil.dll`, "StartW"},
+		{`"C:\Windows\System32\rundll32.exe" "C:\Users\Public\my evil.dll" StartW`, `C:\Users\Public\my evil.dll`, "StartW"},
+		{`rundll32.exe evil.dll,"Entry"`, "evil.dll", "Entry"},
+		// Ordinals, and arguments after the export
+		{`rundll32.exe C:\Users\Public\evil.dll,#1`, `C:\Users\Public\evil.dll`, "#1"},
+		{`rundll32.exe advpack.dll,LaunchINFSection C:\x.inf,DefaultInstall_SingleUser,1,`, "advpack.dll", "LaunchINFSection"},
+		{`rundll32.exe shell32.dll,Control_RunDLL,desk.cpl`, "shell32.dll", "Control_RunDLL"},
+		// No export to judge
+		{`rundll32.exe`, "", ""},
+		{`rundll32.exe evil`, "", ""},
+		{`rundll32.exe evil.dll,`, "", ""},
+		{`rundll32.exe -sta {00000000-0000-0000-0000-000000000000}`, "", ""},
+		{`rundll32.exe javascript:"\..\mshtml,RunHTMLApplication ";alert(1)`, "", ""},
+		{`rundll32.exe "C:\Users\Public\evil.dll,Start`, "", ""},
+		{`"rundll32.exe shell32.dll,Control_RunDLL`, "", ""},
+	}
+	for _, tt := range tests {
+		dll, export, ok := parseRundll32(tt.cmdLine)
+		if ok != (tt.dll != "") || ok && (dll != tt.dll || export != tt.export) {
+			t.Errorf("parseRundll32(%q) = %q, %q, %v; want %q, %q", tt.cmdLine, dll, export, ok, tt.dll, tt.export)
+		}
+	}
+}
+
+func TestUnusualExport(t *testing.T) {
+	for export, want := range map[string]bool{
+		"Control_RunDLL":   false,
+		"LaunchINFSection": false,
+		"PrintUIEntry":     false,
+		"Update":           false,
+		"#1":               true,
+		"abc":              true,
+		"StartW":           true,
+		"DllMain":          true,
+		"EntryPoint":       true,
+		"xqzkvbnm":         true,
+	} {
+		if got := unusualExport(export); got != want {
+			t.Errorf("unusualExport(%q) = %v, want %v", export, got, want)
+		}
+	}
+}
+
+func TestCheckRundll32Export(t *testing.T) {
+	activateRulesFile(t, RulesFile{Rundll32Exports: []Rundll32Export{{DLL: "Vendor", Exports: []string{"Refresh"}}}})
+	tests := []struct {
+		name     string
+		cmdLine  string
+		known    bool
+		outside  bool
+		unusual  bool
+		severity Severity
+	}{
+		{"built-in pair", `rundll32.exe Shell32.dll,control_rundll desk.cpl`, true, false, false, 0},
+		{"pair from the rules file", `rundll32.exe "C:\Program Files\Vendor\vendor.dll",Refresh`, true, false, false, 0},
+		{"unknown export in System32", `rundll32.exe shell32.dll,ShellAbout`, false, false, false, SeverityLow},
+		{"default export in System32", `rundll32.exe C:\Windows\System32\shell32.dll,DllMain`, false, false, true, SeverityLow + 1},
+		{"DLL outside System32", `rundll32.exe C:\Users\Public\update.dll,Update`, false, true, false, SeverityLow + 1},
+		{"both", `rundll32.exe %PUBLIC%\update.dll StartW`, false, true, true, SeverityLow + 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := ProcessEvent{ExecutablePath: `C:\Windows\System32\rundll32.exe`, CommandLine: tt.cmdLine}
+			checkRundll32Export(&DetectionContext{Rules: currentRules(), ExecName: "rundll32.exe"}, &event)
+			call := event.Rundll32
+			if call == nil {
+				t.Fatal("no rundll32 call recorded")
+			}
+			if call.Known != tt.known || call.OutsideSystem32 != tt.outside || call.UnusualExport != tt.unusual {
+				t.Errorf("call %+v, want known %v, outside System32 %v, unusual export %v", call, tt.known, tt.outside, tt.unusual)
+			}
+			if flagged := hasIndicator(event, "rundll32_export", ""); flagged == tt.known || event.Severity != tt.severity {
+				t.Errorf("indicator %v, severity %v; want %v", flagged, event.Severity, tt.severity)
+			}
+		})
+	}
+}
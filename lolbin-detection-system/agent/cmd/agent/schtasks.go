@@ -0,0 +1,138 @@
+// schtasks.go
+// Detection of scheduled task persistence. What matters about a task is
+// what it will run, so the /tr action of schtasks /create and /change is
+// taken apart and evaluated as if it had been started.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ScheduledTask describes the task a schtasks event creates, changes or
+// deletes
+type ScheduledTask struct {
+	// Operation is create, change or delete
+	Operation string `json:"operation"`
+	Name      string `json:"name,omitempty"`
+	// Target is the /tr command line the task runs
+	Target   string `json:"target,omitempty"`
+	Schedule string `json:"schedule,omitempty"`
+	RunAs    string `json:"run_as,omitempty"`
+	// Action is the detection result of the target command line
+	Action *NestedCommand `json:"action,omitempty"`
+}
+
+// schtasksOperations are the schtasks verbs that alter tasks
+var schtasksOperations = map[string]bool{"create": true, "change": true, "delete": true}
+
+// systemAccounts are the /ru values that run a task as the local system
+var systemAccounts = map[string]bool{"system": true, "nt authority\\system": true, "localsystem": true}
+
+// escapedQuote stands in for \" while a schtasks command line is split, so
+// quotes escaped inside the /tr value survive
+const escapedQuote = "\x00"
+
+// parseSchtasks extracts the task options of a schtasks command line
+func parseSchtasks(cmdLine string) (*ScheduledTask, bool) {
+	task := &ScheduledTask{}
+	args := splitCommandLine(strings.ReplaceAll(cmdLine, `\"`, escapedQuote))
+	for i := 1; i < len(args); i++ {
+		arg := strings.ToLower(args[i])
+		if !strings.HasPrefix(arg, "/") && !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		option := arg[1:]
+		if schtasksOperations[option] {
+			task.Operation = option
+			continue
+		}
+		if i+1 >= len(args) {
+			break
+		}
+		value := strings.ReplaceAll(args[i+1], escapedQuote, `"`)
+		switch option {
+		case "tn":
+			task.Name = value
+		case "tr":
+			task.Target = normalizeTaskTarget(value)
+		case "sc":
+			task.Schedule = strings.ToLower(value)
+		case "ru":
+			task.RunAs = value
+		default:
+			continue
+		}
+		i++
+	}
+	return task, task.Operation != ""
+}
+
+// normalizeTaskTarget turns the single quotes schtasks accepts around a
+// target path with spaces into double quotes, so the target splits into
+// its executable and arguments like any command line
+func normalizeTaskTarget(target string) string {
+	target = strings.TrimSpace(target)
+	if strings.HasPrefix(target, "'") {
+		if end := strings.Index(target[1:], "'"); end >= 0 {
+			target = `"` + target[1:end+1] + `"` + target[end+2:]
+		}
+	}
+	return target
+}
+
+// checkSchtasks evaluates the action of a created or changed scheduled
+// task. A task running a flagged command or a binary from a user-writable
+// directory is critical, all the more when it runs as SYSTEM.
+func checkSchtasks(ctx *DetectionContext, event *ProcessEvent) {
+	if ctx.ExecName != "schtasks.exe" {
+		return
+	}
+	task, ok := parseSchtasks(event.CommandLine)
+	if !ok {
+		return
+	}
+	event.ScheduledTask = task
+	if task.Target == "" {
+		return
+	}
+
+	result, evaluated := evaluateNestedEvent(task.Target, event)
+	flagged := evaluated && result.Suspicious
+	action := &NestedCommand{CommandLine: task.Target}
+	if flagged {
+		action.Rule, action.Severity, action.Reason = result.Rule, result.Severity, result.Reason
+	}
+	task.Action = action
+
+	var executable string
+	if args := splitCommandLine(task.Target); len(args) > 0 {
+		executable = expandWindowsEnv(args[0])
+	}
+	writable := executable != "" && isUserWritableOrTempPath(executable)
+	if !flagged && !writable {
+		return
+	}
+
+	event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "task_action", Value: task.Target})
+	if flagged {
+		for _, ioc := range result.IOCs {
+			if !hasIOC(event, ioc.Value) {
+				event.IOCs = append(event.IOCs, ioc)
+			}
+		}
+		addTags(event, result.Tags)
+		addFinding(event, SeverityCritical, ConfidenceHigh, fmt.Sprintf("Scheduled task %s runs a flagged command: %s", task.Name, result.Reason))
+	}
+	if writable {
+		addFinding(event, SeverityCritical, ConfidenceMedium, fmt.Sprintf("Scheduled task %s runs %s from a user-writable directory", task.Name, executable))
+		if systemAccounts[strings.ToLower(task.RunAs)] {
+			event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "task_run_as", Value: task.RunAs})
+			addFinding(event, SeverityCritical, ConfidenceHigh, fmt.Sprintf("Scheduled task %s runs a user-writable binary as SYSTEM", task.Name))
+		}
+	}
+	if event.Severity < SeverityCritical {
+		event.Severity = SeverityCritical
+	}
+}
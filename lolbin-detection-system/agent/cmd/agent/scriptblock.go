@@ -0,0 +1,173 @@
+// scriptblock.go
+// Correlation of PowerShell script block logging (event 4104 in the
+// PowerShell Operational log) with PowerShell process events. The blocks a
+// process logs hold the scripts it really ran, including those loaded from
+// files or the network after start, so they are scanned for defense
+// tampering the command line doesn't show.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// scriptBlockLoggedID is the PowerShell event logging a script block
+	scriptBlockLoggedID = 4104
+	// scriptBlockChannel is the log script blocks are written to
+	scriptBlockChannel = "Microsoft-Windows-PowerShell/Operational"
+	// scriptBlockPollInterval is how often the log is queried while a
+	// process is watched
+	scriptBlockPollInterval = 2 * time.Second
+)
+
+// ScriptBlock is a logged script block of a PowerShell process that
+// tampers with the defenses
+type ScriptBlock struct {
+	ID       string    `json:"id"`
+	RecordID uint64    `json:"record_id"`
+	Time     time.Time `json:"time"`
+	// Tampering are the tampering indicators the block matched
+	Tampering []string `json:"tampering"`
+}
+
+// scriptBlockXML is the part of a rendered 4104 record that is used
+type scriptBlockXML struct {
+	System struct {
+		EventRecordID uint64 `xml:"EventRecordID"`
+		TimeCreated   struct {
+			SystemTime string `xml:"SystemTime,attr"`
+		} `xml:"TimeCreated"`
+	} `xml:"System"`
+	EventData struct {
+		Data []struct {
+			Name  string `xml:"Name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"Data"`
+	} `xml:"EventData"`
+}
+
+// data returns the value of a named EventData field
+func (x *scriptBlockXML) data(name string) string {
+	for _, d := range x.EventData.Data {
+		if d.Name == name {
+			return d.Value
+		}
+	}
+	return ""
+}
+
+// scriptBlockRecord is a parsed 4104 record
+type scriptBlockRecord struct {
+	block ScriptBlock
+	text  string
+}
+
+// findScriptBlocks returns the script blocks a process logged at or after
+// since, oldest first, skipping the records already seen
+func findScriptBlocks(pid uint32, since time.Time, seen map[uint64]bool) ([]scriptBlockRecord, error) {
+	query := fmt.Sprintf("*[System[EventID=%d and Execution[@ProcessID=%d] and TimeCreated[@SystemTime>='%s']]]",
+		scriptBlockLoggedID, pid, since.UTC().Format("2006-01-02T15:04:05.000Z"))
+	channel, _ := syscall.UTF16PtrFromString(scriptBlockChannel)
+	xpath, _ := syscall.UTF16PtrFromString(query)
+
+	results, _, err := procEvtQuery.Call(0, uintptr(unsafe.Pointer(channel)), uintptr(unsafe.Pointer(xpath)), evtQueryChannelPath)
+	if results == 0 {
+		return nil, fmt.Errorf("failed to query the PowerShell log: %v", err)
+	}
+	defer procEvtClose.Call(results)
+
+	var records []scriptBlockRecord
+	for {
+		var event uintptr
+		var returned uint32
+		ret, _, _ := procEvtNext.Call(results, 1, uintptr(unsafe.Pointer(&event)), 0, 0, uintptr(unsafe.Pointer(&returned)))
+		if ret == 0 || returned == 0 {
+			return records, nil
+		}
+		rendered, err := renderEventXML(event)
+		procEvtClose.Call(event)
+		if err != nil {
+			return records, err
+		}
+		var parsed scriptBlockXML
+		if err := xml.Unmarshal([]byte(rendered), &parsed); err != nil {
+			return records, fmt.Errorf("failed to parse event: %v", err)
+		}
+		if seen[parsed.System.EventRecordID] {
+			continue
+		}
+		seen[parsed.System.EventRecordID] = true
+		record := scriptBlockRecord{
+			block: ScriptBlock{ID: parsed.data("ScriptBlockId"), RecordID: parsed.System.EventRecordID},
+			text:  parsed.data("ScriptBlockText"),
+		}
+		record.block.Time, _ = time.Parse(time.RFC3339Nano, parsed.System.TimeCreated.SystemTime)
+		records = append(records, record)
+	}
+}
+
+// correlateScriptBlocks watches the PowerShell log for the script blocks a
+// PowerShell process logs and flags the event when one tampers with AMSI,
+// ETW or Defender. It runs in the background until the configured window
+// elapses.
+func correlateScriptBlocks(event ProcessEvent) {
+	window := time.Duration(config.ScriptBlockWindow)
+	if window <= 0 {
+		return
+	}
+	if name := imageName(event.ExecutablePath); name != "powershell.exe" && name != "pwsh.exe" {
+		return
+	}
+
+	go func() {
+		// Allow for the clock skew between the process start and the log
+		since := event.Timestamp.Add(-time.Second)
+		deadline := time.Now().Add(window)
+		seen := make(map[uint64]bool)
+		for time.Now().Before(deadline) {
+			records, err := findScriptBlocks(event.ProcessID, since, seen)
+			if err != nil {
+				log.Printf("Script block correlation for PID %d failed: %v", event.ProcessID, err)
+				return
+			}
+			for _, record := range records {
+				found := tamperingIndicators(record.text)
+				if folded := deobfuscatePowerShell(record.text); folded != record.text {
+					for _, name := range tamperingIndicators(folded) {
+						if !containsString(found, name) {
+							found = append(found, name)
+						}
+					}
+				}
+				if len(found) == 0 {
+					continue
+				}
+				record.block.Tampering = found
+				flagScriptBlock(event, record.block)
+			}
+			time.Sleep(scriptBlockPollInterval)
+		}
+	}()
+}
+
+// flagScriptBlock attaches a tampering script block to the stored event,
+// marks the host degraded and alerts when the block raised the event
+func flagScriptBlock(event ProcessEvent, block ScriptBlock) {
+	var before Severity
+	var wasSuspicious bool
+	updated, ok := updateEvent(event.ProcessID, event.Timestamp, func(e *ProcessEvent) {
+		before, wasSuspicious = e.Severity, e.Suspicious
+		e.ScriptBlocks = append(e.ScriptBlocks, block)
+		addTampering(e, block.Tampering, fmt.Sprintf("script block %s", block.ID))
+	})
+	raiseHealthWarning(&event, block.Tampering)
+	if ok && (!wasSuspicious || updated.Severity > before) {
+		dispatchAlert(updated)
+	}
+}
@@ -0,0 +1,290 @@
+// scripthost.go
+// Detection of scripts run through wscript.exe and cscript.exe. Logon
+// scripts run through them everywhere, so rather than matching the command
+// line the script path is taken apart and judged by where the script lives,
+// how it is named and how it was delivered.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ScriptHostConfig configures the wscript and cscript detections
+type ScriptHostConfig struct {
+	// ApprovedDirs are directories, or globs matching directories, that
+	// .js, .jse, .vbe and .wsf scripts may run from in addition to the
+	// Windows and Program Files directories
+	ApprovedDirs []string `yaml:"approved_dirs"`
+	// LogonScriptShares are UNC prefixes such as \\corp.example\netlogon
+	// whose scripts are exempt from the script host detections
+	LogonScriptShares []string `yaml:"logon_script_shares"`
+}
+
+// Validate checks the approved directories and logon script shares
+func (c ScriptHostConfig) Validate() error {
+	if _, err := compileScriptDirs(c.ApprovedDirs); err != nil {
+		return err
+	}
+	for _, share := range c.LogonScriptShares {
+		if strings.Trim(share, `\/ `) == "" {
+			return fmt.Errorf("empty script_hosts.logon_script_shares entry")
+		}
+	}
+	return nil
+}
+
+// scriptHosts are the image names of the Windows Script Host
+var scriptHosts = map[string]bool{"wscript.exe": true, "cscript.exe": true}
+
+// scriptExtensions are the extensions the script host runs natively
+var scriptExtensions = map[string]bool{"js": true, "jse": true, "vbs": true, "vbe": true, "wsf": true, "wsh": true}
+
+// deliveredScriptExtensions are script types rarely used by administrators
+// but common in phishing attachments, so they are only expected in
+// approved directories
+var deliveredScriptExtensions = map[string]bool{"js": true, "jse": true, "vbe": true, "wsf": true}
+
+// scriptStagingDirs are path fragments of directories downloaded and
+// dropped scripts land in
+var scriptStagingDirs = []string{`\appdata\`, `\downloads\`, `\temp\`, `\tmp\`, `\programdata\`, `\users\public\`}
+
+// builtinApprovedScriptDirs are always approved for delivered script types
+var builtinApprovedScriptDirs = []string{`%SystemRoot%`, `%ProgramFiles%`, `%ProgramFiles(x86)%`}
+
+// internetZone is the first security zone considered remote: 3 is the
+// Internet and 4 restricted sites
+const internetZone = 3
+
+// ScriptInvocation describes the script a script host event runs
+type ScriptInvocation struct {
+	Path string `json:"path"`
+	// Engine is the engine forced with //E:, e.g. jscript
+	Engine string `json:"engine,omitempty"`
+	// Options are the script host's own // options, lowercased
+	Options []string `json:"options,omitempty"`
+	Size    int64    `json:"size,omitempty"`
+	SHA256  string   `json:"sha256,omitempty"`
+	// ZoneID is the security zone of the script's mark of the web; nil
+	// when it carries none
+	ZoneID      *int   `json:"zone_id,omitempty"`
+	HostURL     string `json:"host_url,omitempty"`
+	ReferrerURL string `json:"referrer_url,omitempty"`
+	// LogonShare is the configured logon script share the script runs
+	// from, exempting it from detection
+	LogonShare string `json:"logon_share,omitempty"`
+	// Error explains why the script could not be inspected
+	Error string `json:"error,omitempty"`
+}
+
+// scriptDir is a compiled approved script directory
+type scriptDir struct {
+	prefix string
+	glob   *globMatcher
+}
+
+// approvedScriptDirs is the compiled list of approved directories, the
+// built-in ones included
+var approvedScriptDirs []scriptDir
+
+// compileScriptDirs compiles the configured approved directories together
+// with the built-in ones. Variables that aren't set drop their entry.
+func compileScriptDirs(dirs []string) ([]scriptDir, error) {
+	var compiled []scriptDir
+	for _, dir := range append(append([]string{}, builtinApprovedScriptDirs...), dirs...) {
+		dir = normalizeDropPath(dir)
+		if strings.Contains(dir, "%") {
+			continue
+		}
+		if isGlob(dir) {
+			glob, err := compileGlob(dir)
+			if err != nil {
+				return nil, fmt.Errorf("script_hosts.approved_dirs: %v", err)
+			}
+			compiled = append(compiled, scriptDir{glob: glob})
+			continue
+		}
+		compiled = append(compiled, scriptDir{prefix: strings.TrimRight(dir, `\`) + `\`})
+	}
+	return compiled, nil
+}
+
+// isApprovedScriptPath reports whether a script is in an approved directory
+func isApprovedScriptPath(path string) bool {
+	path = normalizeDropPath(path)
+	for _, dir := range approvedScriptDirs {
+		if dir.glob != nil && dir.glob.Match(filepath.Dir(path)) || dir.glob == nil && strings.HasPrefix(path, dir.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// logonScriptShare returns the configured logon script share covering a
+// UNC path, if any
+func logonScriptShare(path string) (string, bool) {
+	if strings.Contains(path+`\`, `\..\`) {
+		return "", false
+	}
+	for _, prefix := range config.ScriptHosts.LogonScriptShares {
+		if strings.HasPrefix(path+`\`, normalizeSharePrefix(prefix)) {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// parseScriptHost tokenizes a wscript or cscript command line. Options
+// start with a double slash; the first other argument is the script and
+// the rest are passed to it.
+func parseScriptHost(cmdLine string) (*ScriptInvocation, bool) {
+	invocation := &ScriptInvocation{}
+	args := splitCommandLine(cmdLine)
+	for _, arg := range args[min(1, len(args)):] {
+		if strings.HasPrefix(arg, "//") {
+			option := strings.ToLower(arg[2:])
+			invocation.Options = append(invocation.Options, option)
+			if engine, ok := strings.CutPrefix(option, "e:"); ok {
+				invocation.Engine = engine
+			}
+			continue
+		}
+		if invocation.Path == "" {
+			invocation.Path = arg
+		}
+	}
+	return invocation, invocation.Path != ""
+}
+
+// readMarkOfTheWeb reads the Zone.Identifier stream Windows attaches to
+// downloaded files
+func readMarkOfTheWeb(path string) (zone int, hostURL, referrerURL string, ok bool) {
+	data, err := os.ReadFile(path + ":Zone.Identifier")
+	if err != nil {
+		return 0, "", "", false
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "zoneid":
+			zone, err = strconv.Atoi(value)
+			ok = err == nil
+		case "hosturl":
+			hostURL = value
+		case "referrerurl":
+			referrerURL = value
+		}
+	}
+	return zone, hostURL, referrerURL, ok
+}
+
+// inspectScript hashes a script and reads its mark of the web
+func inspectScript(invocation *ScriptInvocation, limit int64) {
+	if zone, hostURL, referrerURL, ok := readMarkOfTheWeb(invocation.Path); ok {
+		invocation.ZoneID = &zone
+		invocation.HostURL = hostURL
+		invocation.ReferrerURL = referrerURL
+	}
+	if limit <= 0 {
+		return
+	}
+	data, size, err := readCapped(invocation.Path, limit)
+	invocation.Size = size
+	if err != nil {
+		invocation.Error = describeFileError(err)
+		return
+	}
+	invocation.SHA256 = sha256Hex(data)
+}
+
+// checkScriptHost flags wscript and cscript running scripts from staging
+// directories or remote shares, scripts hiding behind a document
+// extension, delivered script types outside approved directories and
+// engine overrides, and escalates scripts carrying the mark of the web.
+// Scripts on the configured logon script shares are exempt. The script is
+// only read for real process starts, and only from local disk.
+func checkScriptHost(ctx *DetectionContext, event *ProcessEvent) {
+	if !scriptHosts[ctx.ExecName] {
+		return
+	}
+	invocation, ok := parseScriptHost(event.CommandLine)
+	if !ok {
+		return
+	}
+	invocation.Path = expandWindowsEnv(invocation.Path)
+	remote := findUNCPaths(invocation.Path)
+	if len(remote) > 0 {
+		if share, ok := logonScriptShare(remote[0].Path); ok {
+			invocation.LogonShare = share
+			event.Script = invocation
+			return
+		}
+	} else if !filepath.IsAbs(invocation.Path) && ctx.Live {
+		if dir, err := processWorkingDirectory(event.ProcessID); err == nil {
+			invocation.Path = filepath.Join(dir, invocation.Path)
+		}
+	}
+	if ctx.Live && len(remote) == 0 {
+		// Remote scripts are not fetched from the attacker's server
+		inspectScript(invocation, config.MaxArtifactSize)
+	}
+	event.Script = invocation
+
+	name := filepath.Base(invocation.Path)
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")
+	lower := strings.ToLower(invocation.Path)
+	report := func(indicatorType string, severity Severity, confidence int, reason string) {
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: indicatorType, Value: invocation.Path})
+		addFinding(event, severity, confidence, reason)
+	}
+
+	if len(remote) > 0 {
+		if _, trusted := trustedShare(remote[0].Path); !trusted {
+			report("script_path", SeverityHigh, ConfidenceMedium, fmt.Sprintf("%s runs script %s from a remote share", ctx.ExecName, invocation.Path))
+		}
+	} else {
+		for _, dir := range scriptStagingDirs {
+			if strings.Contains(lower, dir) {
+				report("script_path", SeverityMedium, ConfidenceMedium, fmt.Sprintf("%s runs script %s from %s", ctx.ExecName, invocation.Path, strings.Trim(dir, `\`)))
+				break
+			}
+		}
+	}
+	if document, executable, ok := doubleExtension(name); ok {
+		report("double_extension", SeverityHigh, ConfidenceHigh, fmt.Sprintf("%s runs script %s disguised as a .%s file (real extension .%s)",
+			ctx.ExecName, name, document, executable))
+	}
+	if deliveredScriptExtensions[ext] && !isApprovedScriptPath(invocation.Path) {
+		report("script_extension", SeverityMedium, ConfidenceMedium, fmt.Sprintf("%s runs .%s script %s outside the approved script directories",
+			ctx.ExecName, ext, invocation.Path))
+	}
+	if invocation.Engine != "" {
+		if scriptExtensions[ext] {
+			report("engine_override", SeverityMedium, ConfidenceLow, fmt.Sprintf("%s forces the %s engine on %s", ctx.ExecName, invocation.Engine, name))
+		} else {
+			report("engine_override", SeverityHigh, ConfidenceHigh, fmt.Sprintf("%s runs non-script file %s as %s", ctx.ExecName, name, invocation.Engine))
+		}
+	}
+
+	if invocation.ZoneID != nil && *invocation.ZoneID >= internetZone {
+		source := invocation.HostURL
+		if source == "" {
+			source = fmt.Sprintf("zone %d", *invocation.ZoneID)
+		}
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "mark_of_the_web", Value: source})
+		addFinding(event, SeverityHigh, ConfidenceHigh, fmt.Sprintf("%s runs script %s downloaded from %s", ctx.ExecName, name, source))
+		if event.Severity < SeverityHigh {
+			event.Severity = SeverityHigh
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// selfevents.go
+// Recognition of processes the agent starts itself. Enrichment and the
+// installer may run monitored LOLBins such as sc.exe, which would otherwise
+// be flagged and alerted on by the agent that started them. Children of
+// this process, or of another run of the agent executable such as an
+// install, are recorded as self-generated without detection, or dropped.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// selfPID is the agent's own process ID
+var selfPID = uint32(os.Getpid())
+
+// selfExecutable is the agent's executable path, empty if unknown
+var selfExecutable = func() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	return filepath.Clean(exe)
+}()
+
+// validateSelfEvents checks the self_events action, which takes the
+// ignore list's actions
+func validateSelfEvents(action string) error {
+	switch action {
+	case ignoreRecord, ignoreSkip:
+		return nil
+	}
+	return fmt.Errorf("self_events must be %s or %s", ignoreRecord, ignoreSkip)
+}
+
+// isSelfGenerated reports whether the agent started the event's process:
+// this instance, or another process running the agent executable
+func isSelfGenerated(event *ProcessEvent) bool {
+	if event.ParentID == selfPID {
+		return true
+	}
+	if selfExecutable == "" {
+		return false
+	}
+	parent := event.ParentImage
+	if parent == "" && event.ParentID != 0 {
+		parent, _ = processImagePath(event.ParentID)
+	}
+	return parent != "" && strings.EqualFold(filepath.Clean(parent), selfExecutable)
+}
@@ -0,0 +1,72 @@
+// severity.go
+// Severity levels attached to detections
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity ranks how bad a detection is if it's a true positive
+type Severity int
+
+const (
+	SeverityNone Severity = iota
+	SeverityInfo
+	SeverityLow
+	SeverityMedium
+	SeverityHigh
+	SeverityCritical
+)
+
+var severityNames = map[Severity]string{
+	SeverityNone:     "none",
+	SeverityInfo:     "info",
+	SeverityLow:      "low",
+	SeverityMedium:   "medium",
+	SeverityHigh:     "high",
+	SeverityCritical: "critical",
+}
+
+// String returns the lowercase name of the severity
+func (s Severity) String() string {
+	if name, ok := severityNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+// Bump raises the severity by one level, capped at critical
+func (s Severity) Bump() Severity {
+	if s >= SeverityCritical {
+		return SeverityCritical
+	}
+	return s + 1
+}
+
+// MarshalText encodes the severity by name
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a severity name
+func (s *Severity) UnmarshalText(text []byte) error {
+	parsed, err := ParseSeverity(string(text))
+	if err != nil {
+		return err
+	}
+	*s = parsed
+	return nil
+}
+
+// ParseSeverity converts a severity name to its level
+func ParseSeverity(name string) (Severity, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for level, levelName := range severityNames {
+		if levelName == name {
+			return level, nil
+		}
+	}
+	return SeverityNone, fmt.Errorf("unknown severity %q", name)
+}
@@ -0,0 +1,388 @@
+// signature.go
+// Authenticode verification of executables with WinVerifyTrust. Files signed
+// through a system catalog rather than an embedded signature are looked up
+// with the CryptCATAdmin API. Results are cached by file hash.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Values accepted for a rule's require_signature
+const (
+	signatureAny       = "any"
+	signatureMicrosoft = "microsoft"
+)
+
+// Outcomes of a signature verification
+const (
+	signatureValid     = "valid"
+	signatureUnsigned  = "unsigned"
+	signatureExpired   = "expired"
+	signatureRevoked   = "revoked"
+	signatureUntrusted = "untrusted"
+	signatureInvalid   = "invalid"
+)
+
+var (
+	wintrust                                 = windows.NewLazySystemDLL("wintrust.dll")
+	procCryptCATAdminAcquireContext2         = wintrust.NewProc("CryptCATAdminAcquireContext2")
+	procCryptCATAdminReleaseContext          = wintrust.NewProc("CryptCATAdminReleaseContext")
+	procCryptCATAdminCalcHashFromFileHandle2 = wintrust.NewProc("CryptCATAdminCalcHashFromFileHandle2")
+	procCryptCATAdminEnumCatalogFromHash     = wintrust.NewProc("CryptCATAdminEnumCatalogFromHash")
+	procCryptCATAdminReleaseCatalogContext   = wintrust.NewProc("CryptCATAdminReleaseCatalogContext")
+	procCryptCATCatalogInfoFromContext       = wintrust.NewProc("CryptCATCatalogInfoFromContext")
+	procWTHelperProvDataFromStateData        = wintrust.NewProc("WTHelperProvDataFromStateData")
+	procWTHelperGetProvSignerFromChain       = wintrust.NewProc("WTHelperGetProvSignerFromChain")
+	procWTHelperGetProvCertFromChain         = wintrust.NewProc("WTHelperGetProvCertFromChain")
+)
+
+// microsoftSigners are the certificate subjects Windows components are
+// signed with
+var microsoftSigners = map[string]bool{
+	"Microsoft Windows":           true,
+	"Microsoft Windows Publisher": true,
+	"Microsoft Corporation":       true,
+}
+
+// wintrustCatalogInfo mirrors WINTRUST_CATALOG_INFO
+type wintrustCatalogInfo struct {
+	Size                 uint32
+	CatalogVersion       uint32
+	CatalogFilePath      *uint16
+	MemberTag            *uint16
+	MemberFilePath       *uint16
+	MemberFile           windows.Handle
+	CalculatedFileHash   *byte
+	CalculatedFileHashSz uint32
+	CatalogContext       uintptr
+	CatAdmin             windows.Handle
+}
+
+// catalogInfo mirrors CATALOG_INFO
+type catalogInfo struct {
+	Size        uint32
+	CatalogFile [windows.MAX_PATH]uint16
+}
+
+// cryptProviderCert is the leading part of CRYPT_PROVIDER_CERT
+type cryptProviderCert struct {
+	Size uint32
+	Cert *windows.CertContext
+}
+
+// SignatureInfo is the result of verifying a file's signature. Signer and
+// Thumbprint are only set for valid signatures.
+type SignatureInfo struct {
+	Signed bool
+	// Status tells valid signatures from missing, expired, revoked,
+	// untrusted and otherwise invalid ones
+	Status string
+	Signer string
+	// Thumbprint is the hex SHA-1 of the signing certificate
+	Thumbprint string
+	// Catalog is set when the signature came from a system catalog
+	Catalog bool
+}
+
+// signerCert identifies the certificate a file was signed with
+type signerCert struct {
+	name       string
+	thumbprint string
+}
+
+// Microsoft reports whether the file carries a valid Microsoft signature
+func (s SignatureInfo) Microsoft() bool {
+	return s.Signed && microsoftSigners[s.Signer]
+}
+
+// signatureCacheEntry remembers a verification together with the file
+// attributes it was made against. Entries keyed by content hash stay valid
+// whatever the path; entries of files too large to hash are keyed by path
+// and re-checked when the file changes.
+type signatureCacheEntry struct {
+	info    SignatureInfo
+	modTime time.Time
+	size    int64
+}
+
+var (
+	signatureCache      = map[string]signatureCacheEntry{}
+	signatureCacheMutex sync.Mutex
+)
+
+// fileSignature returns the signature of a file, verifying it only if no
+// file with the same content was verified before
+func fileSignature(path string) (SignatureInfo, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return SignatureInfo{}, err
+	}
+	key := executableHash(path)
+	byPath := key == ""
+	if byPath {
+		key = "path:" + strings.ToLower(path)
+	}
+
+	signatureCacheMutex.Lock()
+	entry, ok := signatureCache[key]
+	signatureCacheMutex.Unlock()
+	if ok && (!byPath || entry.modTime.Equal(stat.ModTime()) && entry.size == stat.Size()) {
+		return entry.info, nil
+	}
+
+	info, err := verifySignature(path)
+	if err != nil {
+		return SignatureInfo{}, err
+	}
+
+	signatureCacheMutex.Lock()
+	signatureCache[key] = signatureCacheEntry{info: info, modTime: stat.ModTime(), size: stat.Size()}
+	signatureCacheMutex.Unlock()
+	return info, nil
+}
+
+// verifySignature checks the embedded signature of a file and falls back to
+// the system catalogs when there is none
+func verifySignature(path string) (SignatureInfo, error) {
+	path16, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return SignatureInfo{}, err
+	}
+
+	fileInfo := &windows.WinTrustFileInfo{
+		Size:     uint32(unsafe.Sizeof(windows.WinTrustFileInfo{})),
+		FilePath: path16,
+	}
+	signer, err := winVerifyTrust(windows.WTD_CHOICE_FILE, unsafe.Pointer(fileInfo))
+	if err == nil {
+		return SignatureInfo{Signed: true, Status: signatureValid, Signer: signer.name, Thumbprint: signer.thumbprint}, nil
+	}
+	if err != windows.Errno(windows.TRUST_E_NOSIGNATURE) {
+		// Signed, but the signature is bad
+		return SignatureInfo{Status: signatureStatus(err)}, nil
+	}
+
+	signer, err = verifyCatalogSignature(path)
+	if err != nil {
+		return SignatureInfo{Status: signatureUnsigned}, nil
+	}
+	return SignatureInfo{Signed: true, Status: signatureValid, Signer: signer.name, Thumbprint: signer.thumbprint, Catalog: true}, nil
+}
+
+// signatureStatus classifies a failed verification
+func signatureStatus(err error) string {
+	switch err {
+	case windows.Errno(windows.TRUST_E_NOSIGNATURE):
+		return signatureUnsigned
+	case windows.Errno(windows.CERT_E_EXPIRED):
+		return signatureExpired
+	case windows.Errno(windows.CERT_E_REVOKED):
+		return signatureRevoked
+	case windows.Errno(windows.CERT_E_UNTRUSTEDROOT), windows.Errno(windows.CERT_E_CHAINING),
+		windows.Errno(windows.TRUST_E_EXPLICIT_DISTRUST):
+		return signatureUntrusted
+	}
+	return signatureInvalid
+}
+
+// winVerifyTrust runs the generic Authenticode policy and returns the
+// signing certificate on success. Revocation of the whole chain is checked
+// against cached data only, so verification never blocks on the network;
+// when no revocation data is cached the signature is verified without it.
+func winVerifyTrust(choice uint32, object unsafe.Pointer) (signerCert, error) {
+	var signer signerCert
+	var verifyErr error
+	for _, revocation := range []uint32{windows.WTD_REVOKE_WHOLECHAIN, windows.WTD_REVOKE_NONE} {
+		data := &windows.WinTrustData{
+			Size:                            uint32(unsafe.Sizeof(windows.WinTrustData{})),
+			UIChoice:                        windows.WTD_UI_NONE,
+			RevocationChecks:                revocation,
+			UnionChoice:                     choice,
+			StateAction:                     windows.WTD_STATEACTION_VERIFY,
+			FileOrCatalogOrBlobOrSgnrOrCert: object,
+			ProvFlags:                       windows.WTD_CACHE_ONLY_URL_RETRIEVAL,
+		}
+		verifyErr = windows.WinVerifyTrustEx(windows.InvalidHWND, &windows.WINTRUST_ACTION_GENERIC_VERIFY_V2, data)
+		if verifyErr == nil {
+			signer = signerCertificate(data.StateData)
+		}
+
+		data.StateAction = windows.WTD_STATEACTION_CLOSE
+		windows.WinVerifyTrustEx(windows.InvalidHWND, &windows.WINTRUST_ACTION_GENERIC_VERIFY_V2, data)
+
+		if verifyErr != windows.Errno(windows.CRYPT_E_REVOCATION_OFFLINE) &&
+			verifyErr != windows.Errno(windows.CRYPT_E_NO_REVOCATION_CHECK) {
+			break
+		}
+	}
+	return signer, verifyErr
+}
+
+// signerCertificate reads the leaf certificate of the primary signer out
+// of a verification's state data
+func signerCertificate(state windows.Handle) signerCert {
+	provData, _, _ := procWTHelperProvDataFromStateData.Call(uintptr(state))
+	if provData == 0 {
+		return signerCert{}
+	}
+	signer, _, _ := procWTHelperGetProvSignerFromChain.Call(provData, 0, 0, 0)
+	if signer == 0 {
+		return signerCert{}
+	}
+	provCert, _, _ := procWTHelperGetProvCertFromChain.Call(signer, 0)
+	if provCert == 0 {
+		return signerCert{}
+	}
+	// The pointer comes from wintrust's own memory, not the Go heap
+	cert := (*(**cryptProviderCert)(unsafe.Pointer(&provCert))).Cert
+	if cert == nil {
+		return signerCert{}
+	}
+
+	thumbprint := sha1.Sum(unsafe.Slice(cert.EncodedCert, cert.Length))
+	result := signerCert{thumbprint: hex.EncodeToString(thumbprint[:])}
+
+	n := windows.CertGetNameString(cert, windows.CERT_NAME_SIMPLE_DISPLAY_TYPE, 0, nil, nil, 0)
+	if n <= 1 {
+		return result
+	}
+	buf := make([]uint16, n)
+	windows.CertGetNameString(cert, windows.CERT_NAME_SIMPLE_DISPLAY_TYPE, 0, nil, &buf[0], n)
+	result.name = windows.UTF16ToString(buf)
+	return result
+}
+
+// verifyCatalogSignature finds a system catalog containing the file's hash
+// and verifies the file as a member of it
+func verifyCatalogSignature(path string) (signerCert, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return signerCert{}, err
+	}
+	defer file.Close()
+
+	// Newer catalogs use SHA256 member hashes, older ones SHA1
+	for _, algorithm := range []string{"SHA256", "SHA1"} {
+		signer, err := verifyCatalogMember(path, windows.Handle(file.Fd()), algorithm)
+		if err == nil {
+			return signer, nil
+		}
+		if _, err := file.Seek(0, 0); err != nil {
+			return signerCert{}, err
+		}
+	}
+	return signerCert{}, fmt.Errorf("no valid catalog signature for %s", path)
+}
+
+// verifyCatalogMember looks the file up in the catalogs using one hash
+// algorithm
+func verifyCatalogMember(path string, file windows.Handle, algorithm string) (signerCert, error) {
+	algorithm16, _ := windows.UTF16PtrFromString(algorithm)
+	var catAdmin windows.Handle
+	ret, _, err := procCryptCATAdminAcquireContext2.Call(uintptr(unsafe.Pointer(&catAdmin)), 0,
+		uintptr(unsafe.Pointer(algorithm16)), 0, 0)
+	if ret == 0 {
+		return signerCert{}, fmt.Errorf("failed to acquire catalog context: %v", err)
+	}
+	defer procCryptCATAdminReleaseContext.Call(uintptr(catAdmin), 0)
+
+	var hashSize uint32
+	procCryptCATAdminCalcHashFromFileHandle2.Call(uintptr(catAdmin), uintptr(file),
+		uintptr(unsafe.Pointer(&hashSize)), 0, 0)
+	if hashSize == 0 {
+		return signerCert{}, fmt.Errorf("failed to size file hash")
+	}
+	hash := make([]byte, hashSize)
+	ret, _, err = procCryptCATAdminCalcHashFromFileHandle2.Call(uintptr(catAdmin), uintptr(file),
+		uintptr(unsafe.Pointer(&hashSize)), uintptr(unsafe.Pointer(&hash[0])), 0)
+	if ret == 0 {
+		return signerCert{}, fmt.Errorf("failed to hash file: %v", err)
+	}
+
+	catInfo, _, _ := procCryptCATAdminEnumCatalogFromHash.Call(uintptr(catAdmin),
+		uintptr(unsafe.Pointer(&hash[0])), uintptr(hashSize), 0, 0)
+	if catInfo == 0 {
+		return signerCert{}, fmt.Errorf("file is not in any catalog")
+	}
+	defer procCryptCATAdminReleaseCatalogContext.Call(uintptr(catAdmin), catInfo, 0)
+
+	info := catalogInfo{Size: uint32(unsafe.Sizeof(catalogInfo{}))}
+	ret, _, err = procCryptCATCatalogInfoFromContext.Call(catInfo, uintptr(unsafe.Pointer(&info)), 0)
+	if ret == 0 {
+		return signerCert{}, fmt.Errorf("failed to read catalog info: %v", err)
+	}
+
+	path16, _ := windows.UTF16PtrFromString(path)
+	tag16, _ := windows.UTF16PtrFromString(strings.ToUpper(hex.EncodeToString(hash)))
+	member := &wintrustCatalogInfo{
+		Size:                 uint32(unsafe.Sizeof(wintrustCatalogInfo{})),
+		CatalogFilePath:      &info.CatalogFile[0],
+		MemberTag:            tag16,
+		MemberFilePath:       path16,
+		MemberFile:           file,
+		CalculatedFileHash:   &hash[0],
+		CalculatedFileHashSz: hashSize,
+		CatAdmin:             catAdmin,
+	}
+	return winVerifyTrust(windows.WTD_CHOICE_CATALOG, unsafe.Pointer(member))
+}
+
+// checkSignature records the signature of a LOLBin event's executable and
+// applies the rule's signature requirement. A LOLBin that should be a
+// Windows component but isn't signed like one has likely been swapped or
+// copied from elsewhere.
+func checkSignature(event *ProcessEvent, lolbin LOLBin) {
+	info, err := fileSignature(event.ExecutablePath)
+	if err != nil {
+		// The file may already be gone; don't guess
+		return
+	}
+	recordSignature(event, info)
+
+	var reason string
+	confidence := ConfidenceHigh
+	switch lolbin.RequireSignature {
+	case signatureAny:
+		if !info.Signed {
+			reason = fmt.Sprintf("Unsigned %s", event.Rule)
+		}
+	case signatureMicrosoft:
+		if !info.Signed {
+			reason = fmt.Sprintf("Unsigned %s", event.Rule)
+		} else if !info.Microsoft() {
+			reason = fmt.Sprintf("%s signed by %q instead of Microsoft", event.Rule, info.Signer)
+			confidence = ConfidenceMedium
+		}
+	}
+	if reason == "" {
+		return
+	}
+	if info.Status != signatureUnsigned && info.Status != signatureValid {
+		reason += fmt.Sprintf(" (signature %s)", info.Status)
+	}
+
+	event.Indicators = append(event.Indicators, Indicator{
+		Rule:  event.Rule,
+		Type:  "signature",
+		Value: info.Status,
+	})
+	addFinding(event, SeverityHigh, confidence, reason)
+}
+
+// recordSignature copies a verification result onto the event
+func recordSignature(event *ProcessEvent, info SignatureInfo) {
+	event.Signed = info.Signed
+	event.Signer = info.Signer
+	event.SignatureStatus = info.Status
+}
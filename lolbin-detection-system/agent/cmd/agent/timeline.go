@@ -0,0 +1,114 @@
+// timeline.go
+// Event counts over time for activity charts: the stored events passing
+// the usual filters, counted into fixed time buckets so dashboards can spot
+// bursts without fetching the events themselves.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// defaultTimelineBucket and defaultTimelineSpan apply when the
+	// request doesn't set ?bucket= or ?since=
+	defaultTimelineBucket = time.Minute
+	defaultTimelineSpan   = time.Hour
+	// maxTimelineBuckets caps the buckets one request returns
+	maxTimelineBuckets = 1440
+)
+
+// Timeline is the event counts between Since and Until in buckets
+type Timeline struct {
+	Bucket  string        `json:"bucket"`
+	Since   time.Time     `json:"since"`
+	Until   time.Time     `json:"until"`
+	Buckets []StatsBucket `json:"buckets"`
+}
+
+// parseTimelineBucket reads ?bucket=, a whole number of seconds
+func parseTimelineBucket(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("bucket")
+	if value == "" {
+		return defaultTimelineBucket, nil
+	}
+	bucket, err := time.ParseDuration(value)
+	if err != nil || bucket < time.Second || bucket%time.Second != 0 {
+		return 0, fmt.Errorf("bucket must be a whole number of seconds, e.g. 1m")
+	}
+	return bucket, nil
+}
+
+// buildTimeline counts the stored events passing the filter into buckets
+// aligned to the bucket size, covering since up to until. Empty buckets
+// are included so charts have no gaps.
+func buildTimeline(filter eventFilter, bucket time.Duration) Timeline {
+	since, until := filter.since.Truncate(bucket), filter.until
+	buckets := make([]StatsBucket, 0, int((until.Sub(since)+bucket-1)/bucket))
+	for start := since; start.Before(until); start = start.Add(bucket) {
+		buckets = append(buckets, StatsBucket{Start: start})
+	}
+	count := func(event *ProcessEvent) {
+		if !filter.matches(event) {
+			return
+		}
+		b := &buckets[int(event.Timestamp.Sub(since)/bucket)]
+		b.Total++
+		if event.Suspicious {
+			b.Suspicious++
+		}
+	}
+
+	eventsMutex.RLock()
+	if ids, indexed := storeIndex.candidates(filter); indexed {
+		for _, id := range ids {
+			if event, ok := storedEvent(id); ok {
+				count(event)
+			}
+		}
+	} else {
+		for i := range processEvents {
+			count(&processEvents[i])
+		}
+	}
+	eventsMutex.RUnlock()
+
+	return Timeline{Bucket: bucket.String(), Since: since, Until: until, Buckets: buckets}
+}
+
+// API handler: get event counts, total and suspicious, in ?bucket= sized
+// buckets (default 1m) from ?since= (default an hour ago) to ?until=
+// (default now). The other event filters apply as for /api/events.
+func getTimeline(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	bucket, err := parseTimelineBucket(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.until.IsZero() {
+		filter.until = time.Now()
+	}
+	if filter.since.IsZero() {
+		filter.since = filter.until.Add(-defaultTimelineSpan)
+	}
+	if !filter.since.Before(filter.until) {
+		writeError(w, http.StatusBadRequest, "since must be before until")
+		return
+	}
+	if n := (filter.until.Sub(filter.since.Truncate(bucket)) + bucket - 1) / bucket; n > maxTimelineBuckets {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%d buckets requested, at most %d are returned; use a larger bucket or a shorter range", n, maxTimelineBuckets))
+		return
+	}
+
+	json.NewEncoder(w).Encode(buildTimeline(filter, bucket))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// getTimelineQuery calls GET /api/timeline, decoding the timeline when the
+// request succeeds
+func getTimelineQuery(t *testing.T, query string) (int, Timeline) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	getTimeline(rec, httptest.NewRequest(http.MethodGet, "/api/timeline?"+query, nil))
+	var timeline Timeline
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &timeline); err != nil {
+			t.Fatalf("%s: invalid JSON %q: %v", query, rec.Body, err)
+		}
+	}
+	return rec.Code, timeline
+}
+
+func TestTimelineBucketCap(t *testing.T) {
+	resetEvents(t)
+	since := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	rangeQuery := func(since time.Time, span time.Duration, bucket string) string {
+		return fmt.Sprintf("since=%s&until=%s&bucket=%s", since.Format(time.RFC3339), since.Add(span).Format(time.RFC3339), bucket)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"at the cap", rangeQuery(since, maxTimelineBuckets*time.Minute, "1m"), http.StatusOK},
+		{"one over", rangeQuery(since, (maxTimelineBuckets+1)*time.Minute, "1m"), http.StatusBadRequest},
+		// Aligning since to the bucket adds a partial bucket at the start
+		{"unaligned since", rangeQuery(since.Add(30*time.Second), maxTimelineBuckets*time.Minute, "1m"), http.StatusBadRequest},
+		{"larger buckets", rangeQuery(since, maxTimelineBuckets*time.Hour, "1h"), http.StatusOK},
+		{"a year in minutes", rangeQuery(since, 365*24*time.Hour, "1m"), http.StatusBadRequest},
+		{"default range and bucket", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		code, timeline := getTimelineQuery(t, tt.query)
+		if code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.want)
+		}
+		if len(timeline.Buckets) > maxTimelineBuckets {
+			t.Errorf("%s: %d buckets, cap %d", tt.name, len(timeline.Buckets), maxTimelineBuckets)
+		}
+	}
+	if _, timeline := getTimelineQuery(t, tests[0].query); len(timeline.Buckets) != maxTimelineBuckets {
+		t.Errorf("%d buckets at the cap, want %d", len(timeline.Buckets), maxTimelineBuckets)
+	}
+}
+
+func TestTimelineUnderLoad(t *testing.T) {
+	const kept, stored = 500, 3000
+	withConfig(t, func(c *Config) { c.MaxEvents = kept })
+	resetEvents(t)
+	start := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	query := fmt.Sprintf("since=%s&until=%s&bucket=1m", start.Format(time.RFC3339), start.Add(stored*time.Second).Format(time.RFC3339))
+
+	// Timelines built while events are stored and the oldest evicted never
+	// count more events than the store holds
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(time.Millisecond):
+				}
+				code, timeline := getTimelineQuery(t, query)
+				var total uint64
+				for _, b := range timeline.Buckets {
+					total += b.Total
+				}
+				if code != http.StatusOK || total > kept {
+					t.Errorf("status %d, %d events counted, at most %d stored", code, total, kept)
+					return
+				}
+			}
+		}()
+	}
+	for i := range stored {
+		storeEvent(ProcessEvent{Timestamp: start.Add(time.Duration(i) * time.Second), Suspicious: i%3 == 0})
+	}
+	close(done)
+	wg.Wait()
+
+	// Only the newest events are left to count
+	_, timeline := getTimelineQuery(t, query)
+	want := make([]StatsBucket, len(timeline.Buckets))
+	for i := stored - kept; i < stored; i++ {
+		b := &want[i/60]
+		b.Total++
+		if i%3 == 0 {
+			b.Suspicious++
+		}
+	}
+	for i, b := range timeline.Buckets {
+		if !b.Start.Equal(start.Add(time.Duration(i)*time.Minute)) || b.Total != want[i].Total || b.Suspicious != want[i].Suspicious {
+			t.Errorf("bucket %d from %v: %d events, %d suspicious; want %d, %d", i, b.Start, b.Total, b.Suspicious, want[i].Total, want[i].Suspicious)
+		}
+	}
+	if len(timeline.Buckets) != (stored+59)/60 {
+		t.Errorf("%d buckets, want %d", len(timeline.Buckets), (stored+59)/60)
+	}
+}
@@ -0,0 +1,75 @@
+// tls.go
+// TLS settings for the REST API, including optional client certificate
+// verification (mutual TLS)
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSConfig configures HTTPS for the REST API
+type TLSConfig struct {
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	MinVersion string `yaml:"min_version"`
+	// ClientCAFile enables mutual TLS: clients must present a certificate
+	// signed by one of these CAs
+	ClientCAFile string `yaml:"client_ca_file"`
+	// AllowInsecureHTTP permits serving the API over plain HTTP when no
+	// certificate is configured
+	AllowInsecureHTTP bool `yaml:"allow_insecure_http"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Enabled reports whether a certificate is configured
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// Validate checks the TLS settings for invalid combinations
+func (c TLSConfig) Validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if _, ok := tlsVersions[c.MinVersion]; !ok {
+		return fmt.Errorf("tls.min_version must be 1.2 or 1.3, got %q", c.MinVersion)
+	}
+	if c.ClientCAFile != "" && !c.Enabled() {
+		return fmt.Errorf("tls.client_ca_file requires tls.cert_file and tls.key_file")
+	}
+	if !c.Enabled() && !c.AllowInsecureHTTP {
+		return fmt.Errorf("no TLS certificate configured; set tls.cert_file/tls.key_file or explicitly allow plain HTTP with -insecure-http")
+	}
+	return nil
+}
+
+// buildTLSConfig creates the server TLS configuration. The certificate
+// itself is loaded by ListenAndServeTLS.
+func buildTLSConfig(c TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tlsVersions[c.MinVersion],
+	}
+
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", c.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,272 @@
+// uacbypass.go
+// Detection of UAC bypasses through auto-elevating binaries. fodhelper,
+// computerdefaults, wsreset and sdclt elevate without a prompt and then
+// look up a handler the user controls under HKCU, so planting a command
+// there and starting the binary runs it elevated. The binaries are flagged
+// when started from a shell or script host instead of explorer, and a
+// launch shortly after reg.exe planted a handler under one of the bypass
+// keys by the same user is raised to critical together with the planted
+// command.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// autoElevatingBinaries are the binaries whose HKCU handler lookups are
+// abused to bypass UAC
+var autoElevatingBinaries = map[string]bool{
+	"fodhelper.exe":        true,
+	"computerdefaults.exe": true,
+	"wsreset.exe":          true,
+	"sdclt.exe":            true,
+}
+
+// bypassLaunchers are parents that start auto-elevating binaries in a
+// bypass, where users would start them from explorer
+var bypassLaunchers = map[string]bool{
+	"cmd.exe":        true,
+	"powershell.exe": true,
+	"pwsh.exe":       true,
+	"wscript.exe":    true,
+	"cscript.exe":    true,
+	"mshta.exe":      true,
+}
+
+// defaultUACBypassKeys are the HKCU keys, relative to the hive, the
+// auto-elevating binaries read handlers from
+var defaultUACBypassKeys = []string{
+	// fodhelper and computerdefaults open ms-settings
+	`Software\Classes\ms-settings\Shell\Open\command`,
+	`Software\Classes\ms-settings\CurVer`,
+	// wsreset activates the Store app through its ActivatableClassId
+	`Software\Classes\AppX82a6gwre4fdg3bt635tn5ctqjf8msdd2\Shell\open\command`,
+	// sdclt starts control.exe and opens folders
+	`Software\Microsoft\Windows\CurrentVersion\App Paths\control.exe`,
+	`Software\Classes\Folder\shell\open\command`,
+	`Software\Classes\exefile\shell\runas\command`,
+}
+
+// UACBypassConfig configures the correlation of planted handlers with
+// auto-elevating binary launches
+type UACBypassConfig struct {
+	// Window is how long after a handler is planted the launch of an
+	// auto-elevating binary is tied to it; zero disables the correlation
+	Window Duration `yaml:"window"`
+	// Keys are HKCU keys, relative to the hive, watched besides the
+	// built-in ones
+	Keys []string `yaml:"keys"`
+}
+
+// Validate checks the UAC bypass settings
+func (c UACBypassConfig) Validate() error {
+	if c.Window < 0 {
+		return fmt.Errorf("uac_bypass.window must not be negative")
+	}
+	for _, key := range c.Keys {
+		if strings.Trim(strings.TrimSpace(key), `\`) == "" {
+			return fmt.Errorf("empty uac_bypass.keys entry")
+		}
+	}
+	return nil
+}
+
+// UACBypass describes a planted handler tied to an auto-elevating binary
+// launch
+type UACBypass struct {
+	// Key and Command are the planted handler key and the command written
+	Key     string `json:"key"`
+	Command string `json:"command,omitempty"`
+	// WriterPID is the reg.exe process that planted the handler
+	WriterPID uint32    `json:"writer_pid"`
+	PlantedAt time.Time `json:"planted_at"`
+	NestedCommand
+}
+
+// plantedHandler is a handler written to a bypass key by a recent event
+type plantedHandler struct {
+	user      string
+	key       string
+	command   string
+	processID uint32
+	timestamp time.Time
+	expires   time.Time
+}
+
+var (
+	plantedHandlers      []plantedHandler
+	plantedHandlersMutex sync.Mutex
+)
+
+// uacBypassKey returns the watched bypass key a registry key is or is
+// under, as configured
+func uacBypassKey(key string) (string, bool) {
+	lower := strings.ToLower(normalizeRegistryKey(key))
+	for _, watched := range append(append([]string{}, defaultUACBypassKeys...), config.UACBypass.Keys...) {
+		watched = `HKCU\` + strings.Trim(strings.TrimSpace(watched), `\`)
+		if lower == strings.ToLower(watched) || strings.HasPrefix(lower, strings.ToLower(watched)+`\`) {
+			return watched, true
+		}
+	}
+	return "", false
+}
+
+// launcherOf returns the image name of the process that started the event's
+// process
+func launcherOf(event *ProcessEvent) string {
+	if len(event.Ancestry) > 0 {
+		return imageName(event.Ancestry[0])
+	}
+	return imageName(event.ParentImage)
+}
+
+// checkUACBypass flags reg.exe planting handlers under the bypass keys and
+// auto-elevating binaries started from shells, and ties a launch to a
+// handler the same user planted shortly before
+func checkUACBypass(ctx *DetectionContext, event *ProcessEvent) {
+	if ctx.ExecName == "reg.exe" && event.Registry != nil {
+		checkPlantedHandlers(ctx, event)
+		return
+	}
+	if !autoElevatingBinaries[ctx.ExecName] {
+		return
+	}
+
+	launcher := launcherOf(event)
+	if bypassLaunchers[launcher] {
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "elevation_launcher", Value: launcher})
+		addFinding(event, SeverityHigh, ConfidenceMedium, fmt.Sprintf("auto-elevating %s started by %s rather than explorer", ctx.ExecName, launcher))
+		addTags(event, []string{"privilege-escalation", "defense-evasion"})
+	}
+
+	if !ctx.Live {
+		return
+	}
+	handler, ok := recentPlantedHandler(event.User)
+	if !ok {
+		return
+	}
+	bypass := &UACBypass{
+		Key:       handler.key,
+		Command:   handler.command,
+		WriterPID: handler.processID,
+		PlantedAt: handler.timestamp,
+	}
+	event.UACBypass = bypass
+	event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "uac_bypass_key", Value: handler.key, Category: "privilege-escalation"})
+	reason := fmt.Sprintf("UAC bypass: %s started after reg.exe (PID %d) planted a handler under %s",
+		ctx.ExecName, handler.processID, handler.key)
+	if handler.command != "" {
+		reason += fmt.Sprintf(" running %s", handler.command)
+	}
+	chainID := newChainID()
+	escalateChain(event, chainID, reason)
+	addTags(event, []string{"privilege-escalation", "defense-evasion"})
+	// The write is usually still in the store; link it to the launch
+	updateEvent(handler.processID, handler.timestamp, func(writer *ProcessEvent) {
+		escalateChain(writer, chainID, fmt.Sprintf("Handler planted under %s was used by %s (PID %d) to bypass UAC",
+			handler.key, ctx.ExecName, event.ProcessID))
+	})
+
+	// The planted command is what runs elevated
+	bypass.CommandLine = handler.command
+	result, ok := evaluateNestedEvent(handler.command, event)
+	if !ok || !result.Suspicious {
+		return
+	}
+	bypass.Rule, bypass.Severity, bypass.Reason = result.Rule, result.Severity, result.Reason
+	prefix := fmt.Sprintf("planted command of %s", ctx.ExecName)
+	for _, indicator := range result.Indicators {
+		indicator.Rule = prefix + ": " + indicator.Rule
+		event.Indicators = append(event.Indicators, indicator)
+	}
+	for _, ioc := range result.IOCs {
+		if !hasIOC(event, ioc.Value) {
+			event.IOCs = append(event.IOCs, ioc)
+		}
+	}
+	addTags(event, result.Tags)
+	addFinding(event, result.Severity, result.Confidence, prefix+": "+result.Reason)
+}
+
+// checkPlantedHandlers flags reg.exe writes to the bypass keys and, for real
+// process starts, remembers them for the launch that follows
+func checkPlantedHandlers(ctx *DetectionContext, event *ProcessEvent) {
+	for _, write := range event.Registry.Writes {
+		key, ok := uacBypassKey(write.Key)
+		if !ok {
+			continue
+		}
+		event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "uac_bypass_key", Value: key, Category: "privilege-escalation"})
+		reason := fmt.Sprintf("reg.exe plants a handler for auto-elevating binaries under %s", key)
+		if write.Data != "" {
+			reason += fmt.Sprintf(" (%s)", write.Data)
+		}
+		addFinding(event, SeverityHigh, ConfidenceMedium, reason)
+		if event.Severity < SeverityHigh {
+			event.Severity = SeverityHigh
+		}
+		addTags(event, []string{"privilege-escalation"})
+		// DelegateExecute is written empty next to the command
+		if ctx.Live && (write.ValueName == "" || write.Data != "") {
+			rememberPlantedHandler(event, key, write.Data)
+		}
+	}
+}
+
+// rememberPlantedHandler records a handler written to a bypass key for
+// correlation with a later launch
+func rememberPlantedHandler(event *ProcessEvent, key, command string) {
+	window := time.Duration(config.UACBypass.Window)
+	if window <= 0 {
+		return
+	}
+	now := time.Now()
+	plantedHandlersMutex.Lock()
+	defer plantedHandlersMutex.Unlock()
+	kept := plantedHandlers[:0]
+	for _, handler := range plantedHandlers {
+		if now.Before(handler.expires) {
+			kept = append(kept, handler)
+		}
+	}
+	plantedHandlers = append(kept, plantedHandler{
+		user:      event.User,
+		key:       key,
+		command:   strings.TrimSpace(command),
+		processID: event.ProcessID,
+		timestamp: event.Timestamp,
+		expires:   now.Add(window),
+	})
+}
+
+// recentPlantedHandler returns the newest unexpired handler planted by the
+// user, preferring one whose command is known. A handler planted by an
+// unknown user matches any user.
+func recentPlantedHandler(user string) (plantedHandler, bool) {
+	plantedHandlersMutex.Lock()
+	defer plantedHandlersMutex.Unlock()
+	now := time.Now()
+	var found plantedHandler
+	ok := false
+	for i := len(plantedHandlers) - 1; i >= 0; i-- {
+		handler := plantedHandlers[i]
+		if now.After(handler.expires) {
+			continue
+		}
+		if user != "" && handler.user != "" && !strings.EqualFold(user, handler.user) {
+			continue
+		}
+		if !ok || (found.command == "" && handler.command != "") {
+			found, ok = handler, true
+		}
+		if found.command != "" {
+			break
+		}
+	}
+	return found, ok
+}
@@ -0,0 +1,116 @@
+// unc.go
+// Detection of LOLBins run from, or pointed at, remote UNC and WebDAV paths
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// uncPathPattern matches \\host\share style paths, tolerating forward and
+// mixed slashes and the WebDAV @SSL / @port host suffixes
+var uncPathPattern = regexp.MustCompile(`(?i)(?:^|[\s"'=,:(])[\\/]{2}([a-z0-9][a-z0-9.-]*)((?:@ssl)?(?:@\d+)?)[\\/]([^\s"'|<>,]*)`)
+
+// uncPath is a remote path found on a command line
+type uncPath struct {
+	Host   string
+	WebDAV bool
+	// Path is the normalized form: lowercase, backslashes only and without
+	// the WebDAV host suffix
+	Path string
+}
+
+// findUNCPaths returns the UNC and WebDAV paths referenced in text. URLs are
+// blanked out first so their "//" isn't mistaken for a UNC prefix.
+func findUNCPaths(text string) []uncPath {
+	text = urlPattern.ReplaceAllString(text, " ")
+
+	var paths []uncPath
+	for _, loc := range uncPathPattern.FindAllStringSubmatchIndex(text, -1) {
+		if isDriveColon(text, loc[0]) {
+			// C:\\Windows in an escaped path, not a share
+			continue
+		}
+		host := strings.ToLower(text[loc[2]:loc[3]])
+		rest := strings.ToLower(strings.ReplaceAll(text[loc[6]:loc[7]], "/", `\`))
+		paths = append(paths, uncPath{
+			Host:   host,
+			WebDAV: loc[5] > loc[4],
+			Path:   strings.TrimRight(`\\`+host+`\`+rest, `\`),
+		})
+	}
+	return paths
+}
+
+// isDriveColon reports whether the character at i is the colon of a drive
+// letter such as "C:"
+func isDriveColon(text string, i int) bool {
+	if i < 1 || text[i] != ':' {
+		return false
+	}
+	c := text[i-1]
+	if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+		return false
+	}
+	return i == 1 || strings.ContainsRune(" \t\"'=,(", rune(text[i-2]))
+}
+
+// normalizeSharePrefix brings a configured trusted share into the form of
+// uncPath.Path, with a trailing separator so \\srv\dep doesn't trust
+// \\srv\deploy
+func normalizeSharePrefix(prefix string) string {
+	prefix = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(prefix), "/", `\`))
+	prefix = `\\` + strings.TrimLeft(prefix, `\`)
+	return strings.TrimRight(prefix, `\`) + `\`
+}
+
+// trustedShare returns the configured share prefix covering path, if any.
+// Paths with ".." segments are never trusted.
+func trustedShare(path string) (string, bool) {
+	if strings.Contains(path+`\`, `\..\`) {
+		return "", false
+	}
+	for _, prefix := range config.TrustedShares {
+		if strings.HasPrefix(path+`\`, normalizeSharePrefix(prefix)) {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// checkUNCPaths flags a LOLBin event whose executable or arguments reference
+// a remote share outside the trusted prefixes. Loading a DLL, script or
+// payload straight from an attacker's share leaves nothing on local disk.
+func checkUNCPaths(event *ProcessEvent) {
+	seen := make(map[string]bool)
+	var remote []string
+	for _, text := range []string{event.ExecutablePath, event.CommandLine, event.DecodedCommand} {
+		for _, p := range findUNCPaths(text) {
+			if seen[p.Path] {
+				continue
+			}
+			seen[p.Path] = true
+			if _, ok := trustedShare(p.Path); ok {
+				continue
+			}
+
+			indicatorType := "unc_path"
+			if p.WebDAV {
+				indicatorType = "webdav_path"
+			}
+			event.Indicators = append(event.Indicators, Indicator{
+				Rule:  event.Rule,
+				Type:  indicatorType,
+				Value: p.Path,
+			})
+			remote = append(remote, p.Path)
+		}
+	}
+
+	if len(remote) > 0 {
+		addFinding(event, SeverityHigh, ConfidenceMedium, fmt.Sprintf("%s references remote path %s",
+			event.Rule, strings.Join(remote, ", ")))
+	}
+}
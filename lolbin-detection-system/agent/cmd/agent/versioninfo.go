@@ -0,0 +1,154 @@
+// versioninfo.go
+// Detection of renamed binaries through the OriginalFilename of their PE
+// version resource. Renaming certutil.exe to svchost.exe defeats matching
+// on the image name, but the name it was built under stays in the file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Renamed binary detection modes
+const (
+	renamedOff     = "off"
+	renamedLOLBins = "lolbins"
+	renamedAll     = "all"
+)
+
+// versionLanguages are the language and code page blocks tried when the
+// version resource doesn't list its translations: US English in Unicode,
+// in Windows-1252 and language neutral
+var versionLanguages = []string{"040904b0", "040904e4", "04090000", "000004b0"}
+
+// originalNameEntry remembers a file's original filename together with the
+// file attributes it was read from
+type originalNameEntry struct {
+	name    string
+	modTime time.Time
+	size    int64
+}
+
+var (
+	originalNameCache      = map[string]originalNameEntry{}
+	originalNameCacheMutex sync.Mutex
+)
+
+// readOriginalFilename returns the OriginalFilename of a file's version
+// resource, or "" when it has no version resource or no such entry
+func readOriginalFilename(path string) (string, error) {
+	size, err := windows.GetFileVersionInfoSize(path, nil)
+	if err == windows.ERROR_RESOURCE_TYPE_NOT_FOUND || err == windows.ERROR_RESOURCE_DATA_NOT_FOUND {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	info := make([]byte, size)
+	if err := windows.GetFileVersionInfo(path, 0, size, unsafe.Pointer(&info[0])); err != nil {
+		return "", err
+	}
+	block := unsafe.Pointer(&info[0])
+
+	var languages []string
+	var translations unsafe.Pointer
+	var length uint32
+	if err := windows.VerQueryValue(block, `\VarFileInfo\Translation`, unsafe.Pointer(&translations), &length); err == nil {
+		for _, pair := range unsafe.Slice((*[2]uint16)(translations), length/4) {
+			languages = append(languages, fmt.Sprintf("%04x%04x", pair[0], pair[1]))
+		}
+	}
+	for _, language := range append(languages, versionLanguages...) {
+		var value unsafe.Pointer
+		if err := windows.VerQueryValue(block, `\StringFileInfo\`+language+`\OriginalFilename`, unsafe.Pointer(&value), &length); err != nil || length == 0 {
+			continue
+		}
+		return windows.UTF16PtrToString((*uint16)(value)), nil
+	}
+	return "", nil
+}
+
+// originalFilename returns the lowercased original image name of an
+// executable, without the .mui suffix Windows components carry, reading
+// the version resource only when the file changed since the last read
+func originalFilename(path string) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	key := strings.ToLower(path)
+
+	originalNameCacheMutex.Lock()
+	entry, ok := originalNameCache[key]
+	originalNameCacheMutex.Unlock()
+	if ok && entry.modTime.Equal(stat.ModTime()) && entry.size == stat.Size() {
+		return entry.name, nil
+	}
+
+	name, err := readOriginalFilename(path)
+	if err != nil {
+		return "", err
+	}
+	name = strings.TrimSuffix(imageName(strings.TrimSpace(name)), ".mui")
+
+	originalNameCacheMutex.Lock()
+	originalNameCache[key] = originalNameEntry{name: name, modTime: stat.ModTime(), size: stat.Size()}
+	originalNameCacheMutex.Unlock()
+	return name, nil
+}
+
+// recordOriginalFilename stores the executable's on-disk and original names
+// on the event. Binaries without a version resource, or that can't be read,
+// only get their on-disk name.
+func recordOriginalFilename(event *ProcessEvent, execName string) {
+	if config.RenamedBinaries == renamedOff || event.ExecutablePath == "" {
+		return
+	}
+	event.OnDiskName = execName
+	if name, err := originalFilename(event.ExecutablePath); err == nil {
+		event.OriginalFilename = name
+	}
+}
+
+// sameImage reports whether an original filename names the on-disk image.
+// The extension is ignored, as e.g. pwsh.exe is built as pwsh.dll.
+func sameImage(original, onDisk string) bool {
+	return strings.TrimSuffix(original, filepath.Ext(original)) == strings.TrimSuffix(onDisk, filepath.Ext(onDisk))
+}
+
+// checkRenamedBinary flags executables whose original filename differs from
+// their on-disk name: with high severity when the original is a LOLBin or
+// a well-known process, and in "all" mode with low severity otherwise
+func checkRenamedBinary(ctx *DetectionContext, event *ProcessEvent) {
+	original := event.OriginalFilename
+	if original == "" || sameImage(original, ctx.ExecName) {
+		return
+	}
+	_, known := ctx.Rules.knownProcesses[original]
+	known = known || len(ctx.Rules.matching(original)) > 0
+	if !known && config.RenamedBinaries != renamedAll {
+		return
+	}
+
+	event.Indicators = append(event.Indicators, Indicator{
+		Rule:  event.Rule,
+		Type:  "original_filename",
+		Value: original,
+	})
+	if !known {
+		addFinding(event, SeverityLow, ConfidenceLow, fmt.Sprintf("%s was built as %s", ctx.ExecName, original))
+		return
+	}
+	addFinding(event, SeverityHigh, ConfidenceHigh, fmt.Sprintf("%s is %s renamed", event.ExecutablePath, original))
+	if event.Severity < SeverityHigh {
+		event.Severity = SeverityHigh
+	}
+}
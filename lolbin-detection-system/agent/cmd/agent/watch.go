@@ -0,0 +1,70 @@
+// watch.go
+// Automatic rules reload when the rules file changes on disk
+
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// rulesWatchDebounce is how long the rules file must stay quiet before it
+// is reloaded. Editors often write a file in several steps.
+const rulesWatchDebounce = 500 * time.Millisecond
+
+// watchRules reloads the rules whenever the file at path changes. The
+// directory is watched rather than the file itself so editors that save by
+// writing a temporary file and renaming it over the original are noticed.
+func watchRules(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var debounce *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !strings.EqualFold(filepath.Clean(event.Name), path) {
+					continue
+				}
+				if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) {
+					continue
+				}
+				if debounce != nil {
+					debounce.Stop()
+				}
+				debounce = time.AfterFunc(rulesWatchDebounce, func() {
+					rulesFileChanged(path)
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Rules watcher error: %v", err)
+			}
+		}
+	}()
+
+	log.Printf("Watching %s for rule changes", path)
+	return nil
+}
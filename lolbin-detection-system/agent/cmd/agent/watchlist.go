@@ -0,0 +1,50 @@
+// watchlist.go
+// Watchlist of the rules file: binaries, by executable name or full path,
+// whose every execution is reported whether or not they are LOLBins, e.g.
+// an in-house admin tool a team wants to keep an eye on.
+
+package main
+
+import "fmt"
+
+// Watchlist is the watchlist section of a rules file
+type Watchlist struct {
+	// Binaries are executable names or full paths, possibly globs, like
+	// the ignore list's
+	Binaries []string `json:"binaries,omitempty"`
+	// Severity of watched executions; low by default
+	Severity Severity `json:"severity,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// compiledWatchlist is a watchlist prepared for matching
+type compiledWatchlist struct {
+	entries  binaryPatterns
+	severity Severity
+	tags     []string
+}
+
+// compileWatchlist validates and compiles a watchlist
+func compileWatchlist(list Watchlist) (*compiledWatchlist, error) {
+	entries, err := compileBinaryPatterns(list.Binaries, "watchlist")
+	if err != nil {
+		return nil, err
+	}
+	severity := list.Severity
+	if severity == SeverityNone {
+		severity = SeverityLow
+	}
+	return &compiledWatchlist{entries: entries, severity: severity, tags: lowerAll(list.Tags)}, nil
+}
+
+// checkWatchlist reports every execution of a watched binary
+func checkWatchlist(ctx *DetectionContext, event *ProcessEvent) {
+	match := ctx.Rules.watchlist.entries.match(event.ExecutablePath, ctx.ExecName)
+	if match == "" {
+		return
+	}
+	event.WatchedBy = match
+	event.Indicators = append(event.Indicators, Indicator{Rule: event.Rule, Type: "watched", Value: match})
+	addFinding(event, ctx.Rules.watchlist.severity, ConfidenceHigh, fmt.Sprintf("watched: %s matches watchlist entry %s", ctx.ExecName, match))
+	addTags(event, append([]string{"watched"}, ctx.Rules.watchlist.tags...))
+}
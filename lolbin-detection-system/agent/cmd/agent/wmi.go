@@ -0,0 +1,253 @@
+// wmi.go
+// WMI event source. An __InstanceCreationEvent subscription on
+// Win32_Process reports process starts without an ETW session, at the cost
+// of WMI's polling latency; processes living shorter than the polling
+// interval can be missed.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// wmiProcessQuery asks for every new Win32_Process, polled each second
+	wmiProcessQuery = "SELECT * FROM __InstanceCreationEvent WITHIN 1 WHERE TargetInstance ISA 'Win32_Process'"
+	// wmiNextTimeout bounds each wait for an event, in milliseconds, so
+	// cancellation is noticed
+	wmiNextTimeout = 1000
+
+	rpcCAuthnLevelDefault   = 0
+	rpcCAuthnLevelCall      = 3
+	rpcCImpLevelImpersonate = 3
+	rpcCAuthnWinNT          = 10
+	rpcCAuthzNone           = 0
+	eoacNone                = 0
+	rpcETooLate             = 0x80010119
+	clsctxInprocServer      = 0x1
+	wbemFlagForwardOnly     = 0x20
+	wbemFlagReturnImmediate = 0x10
+	wbemSTimedOut           = 0x40004
+	vtI4                    = 3
+	vtBSTR                  = 8
+	vtUnknown               = 13
+	vtUI4                   = 19
+)
+
+var (
+	clsidWbemLocator         = windows.GUID{Data1: 0x4590f811, Data2: 0x1d3a, Data3: 0x11d0, Data4: [8]byte{0x89, 0x1f, 0x00, 0xaa, 0x00, 0x4b, 0x2e, 0x24}}
+	iidIWbemLocator          = windows.GUID{Data1: 0xdc12a687, Data2: 0x737f, Data3: 0x11cf, Data4: [8]byte{0x88, 0x4d, 0x00, 0xaa, 0x00, 0x4b, 0x2e, 0x24}}
+	iidIWbemClassObject      = windows.GUID{Data1: 0xdc12a681, Data2: 0x737f, Data3: 0x11cf, Data4: [8]byte{0x88, 0x4d, 0x00, 0xaa, 0x00, 0x4b, 0x2e, 0x24}}
+	ole32                    = windows.NewLazySystemDLL("ole32.dll")
+	oleaut32                 = windows.NewLazySystemDLL("oleaut32.dll")
+	procCoInitializeSecurity = ole32.NewProc("CoInitializeSecurity")
+	procCoCreateInstance     = ole32.NewProc("CoCreateInstance")
+	procCoSetProxyBlanket    = ole32.NewProc("CoSetProxyBlanket")
+	procSysAllocString       = oleaut32.NewProc("SysAllocString")
+	procSysFreeString        = oleaut32.NewProc("SysFreeString")
+	procVariantClear         = oleaut32.NewProc("VariantClear")
+)
+
+// COM vtable slots of the WMI interfaces used
+const (
+	unknownQueryInterface         = 0
+	unknownRelease                = 2
+	locatorConnectServer          = 3
+	servicesExecNotificationQuery = 22
+	enumNext                      = 4
+	classObjectGet                = 4
+)
+
+// comObject is a COM interface pointer; the first word of every COM object
+// points at its method table
+type comObject struct {
+	vtable *[servicesExecNotificationQuery + 1]uintptr
+}
+
+// call invokes the method in the given vtable slot, returning its HRESULT
+func (o *comObject) call(slot int, args ...uintptr) uint32 {
+	ret, _, _ := syscall.SyscallN(o.vtable[slot], append([]uintptr{uintptr(unsafe.Pointer(o))}, args...)...)
+	return uint32(ret)
+}
+
+// release drops the reference held on the object
+func (o *comObject) release() {
+	o.call(unknownRelease)
+}
+
+// variant is VARIANT; the value union is read according to vt
+type variant struct {
+	vt    uint16
+	_     [3]uint16
+	value [2]uintptr
+}
+
+// bstr allocates a BSTR, to be freed with freeBSTR
+func bstr(s string) *uint16 {
+	p, _ := syscall.UTF16PtrFromString(s)
+	ret, _, _ := procSysAllocString.Call(uintptr(unsafe.Pointer(p)))
+	return *(**uint16)(unsafe.Pointer(&ret))
+}
+
+// freeBSTR frees a BSTR allocated by bstr
+func freeBSTR(s *uint16) {
+	procSysFreeString.Call(uintptr(unsafe.Pointer(s)))
+}
+
+// hresultError describes a failed COM call
+func hresultError(what string, hr uint32) error {
+	return fmt.Errorf("%s failed: HRESULT 0x%08x", what, hr)
+}
+
+// wmiSource reads process starts from a WMI event subscription
+type wmiSource struct{}
+
+// newWMISource creates the WMI source
+func newWMISource() (EventSource, error) {
+	return &wmiSource{}, nil
+}
+
+// Name identifies the WMI source
+func (s *wmiSource) Name() string {
+	return "wmi"
+}
+
+// Start subscribes to process creation and delivers events until ctx is
+// cancelled. COM objects belong to the thread that created them, so the
+// whole subscription runs on one locked OS thread.
+func (s *wmiSource) Start(ctx context.Context, events chan<- ProcessEvent) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	// S_FALSE means COM was already initialized on the thread
+	if err := windows.CoInitializeEx(0, windows.COINIT_MULTITHREADED); err != nil && err != syscall.Errno(1) {
+		return fmt.Errorf("failed to initialize COM: %v", err)
+	}
+	defer windows.CoUninitialize()
+
+	// Process-wide; a host component may already have set it
+	hr, _, _ := procCoInitializeSecurity.Call(0, ^uintptr(0), 0, 0, rpcCAuthnLevelDefault, rpcCImpLevelImpersonate, 0, eoacNone, 0)
+	if uint32(hr) != 0 && uint32(hr) != rpcETooLate {
+		return hresultError("CoInitializeSecurity", uint32(hr))
+	}
+
+	var locator *comObject
+	hr, _, _ = procCoCreateInstance.Call(uintptr(unsafe.Pointer(&clsidWbemLocator)), 0, clsctxInprocServer,
+		uintptr(unsafe.Pointer(&iidIWbemLocator)), uintptr(unsafe.Pointer(&locator)))
+	if uint32(hr) != 0 {
+		return hresultError("creating the WMI locator", uint32(hr))
+	}
+	defer locator.release()
+
+	namespace := bstr(`ROOT\CIMV2`)
+	defer freeBSTR(namespace)
+	var services *comObject
+	if hr := locator.call(locatorConnectServer, uintptr(unsafe.Pointer(namespace)), 0, 0, 0, 0, 0, 0, uintptr(unsafe.Pointer(&services))); hr != 0 {
+		return hresultError("connecting to ROOT\\CIMV2", hr)
+	}
+	defer services.release()
+
+	hr, _, _ = procCoSetProxyBlanket.Call(uintptr(unsafe.Pointer(services)), rpcCAuthnWinNT, rpcCAuthzNone, 0,
+		rpcCAuthnLevelCall, rpcCImpLevelImpersonate, 0, eoacNone)
+	if uint32(hr) != 0 {
+		return hresultError("CoSetProxyBlanket", uint32(hr))
+	}
+
+	language, query := bstr("WQL"), bstr(wmiProcessQuery)
+	defer freeBSTR(language)
+	defer freeBSTR(query)
+	var enum *comObject
+	if hr := services.call(servicesExecNotificationQuery, uintptr(unsafe.Pointer(language)), uintptr(unsafe.Pointer(query)),
+		wbemFlagForwardOnly|wbemFlagReturnImmediate, 0, uintptr(unsafe.Pointer(&enum))); hr != 0 {
+		return hresultError("subscribing to process creation", hr)
+	}
+	defer enum.release()
+
+	for ctx.Err() == nil {
+		var object *comObject
+		var returned uint32
+		hr := enum.call(enumNext, wmiNextTimeout, 1, uintptr(unsafe.Pointer(&object)), uintptr(unsafe.Pointer(&returned)))
+		if hr == wbemSTimedOut || returned == 0 {
+			if hr != 0 && hr != wbemSTimedOut {
+				return hresultError("waiting for process creation events", hr)
+			}
+			continue
+		}
+		event, ok := wmiProcessEvent(object)
+		object.release()
+		if ok && !sendEvent(ctx, events, event) {
+			break
+		}
+	}
+	return nil
+}
+
+// wmiProcessEvent builds a process event from an __InstanceCreationEvent
+func wmiProcessEvent(creation *comObject) (ProcessEvent, bool) {
+	var target variant
+	if hr := wmiGet(creation, "TargetInstance", &target); hr != 0 || target.vt != vtUnknown {
+		return ProcessEvent{}, false
+	}
+	defer procVariantClear.Call(uintptr(unsafe.Pointer(&target)))
+
+	unknown := *(**comObject)(unsafe.Pointer(&target.value[0]))
+	var process *comObject
+	if hr := unknown.call(unknownQueryInterface, uintptr(unsafe.Pointer(&iidIWbemClassObject)), uintptr(unsafe.Pointer(&process))); hr != 0 {
+		return ProcessEvent{}, false
+	}
+	defer process.release()
+
+	event := ProcessEvent{
+		Timestamp:      time.Now(),
+		ProcessID:      wmiGetUint32(process, "ProcessId"),
+		ParentID:       wmiGetUint32(process, "ParentProcessId"),
+		ExecutablePath: wmiGetString(process, "ExecutablePath"),
+		CommandLine:    wmiGetString(process, "CommandLine"),
+	}
+	// ExecutablePath is null for processes WMI can't open; the bare name
+	// is still better than nothing
+	if event.ExecutablePath == "" {
+		event.ExecutablePath = wmiGetString(process, "Name")
+	}
+	return event, event.ProcessID != 0
+}
+
+// wmiGet reads a property of a WMI object into value, which the caller
+// clears
+func wmiGet(object *comObject, name string, value *variant) uint32 {
+	p, _ := syscall.UTF16PtrFromString(name)
+	return object.call(classObjectGet, uintptr(unsafe.Pointer(p)), 0, uintptr(unsafe.Pointer(value)), 0, 0)
+}
+
+// wmiGetString reads a string property, empty when it is null
+func wmiGetString(object *comObject, name string) string {
+	var value variant
+	if hr := wmiGet(object, name, &value); hr != 0 {
+		return ""
+	}
+	defer procVariantClear.Call(uintptr(unsafe.Pointer(&value)))
+	if value.vt != vtBSTR {
+		return ""
+	}
+	return windows.UTF16PtrToString(*(**uint16)(unsafe.Pointer(&value.value[0])))
+}
+
+// wmiGetUint32 reads a 32-bit integer property, zero when it is null
+func wmiGetUint32(object *comObject, name string) uint32 {
+	var value variant
+	if hr := wmiGet(object, name, &value); hr != 0 {
+		return 0
+	}
+	defer procVariantClear.Call(uintptr(unsafe.Pointer(&value)))
+	if value.vt != vtI4 && value.vt != vtUI4 {
+		return 0
+	}
+	return *(*uint32)(unsafe.Pointer(&value.value[0]))
+}
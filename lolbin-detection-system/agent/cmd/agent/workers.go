@@ -0,0 +1,122 @@
+// workers.go
+// Detection worker pool. Detection reads files, verifies signatures and
+// queries processes, so a burst of process starts such as a software
+// install would back up behind a single goroutine. Events are run through
+// detection by a bounded pool of workers and then recorded one at a time in
+// the order they arrived, so the ordered detectors, the event store,
+// correlation and alerts see each source's events in timestamp order
+// however long each one took.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// detectionJob is an event numbered in arrival order
+type detectionJob struct {
+	seq   uint64
+	event ProcessEvent
+}
+
+// detectionPool runs detection on events concurrently
+type detectionPool struct {
+	workers int
+	jobs    chan detectionJob
+	results chan detectionJob
+	// slots bounds the events between arrival and recording, including
+	// those held back until earlier events finish detection
+	slots     chan struct{}
+	processed atomic.Uint64
+}
+
+// DetectionPoolStats describes the load of the detection worker pool
+type DetectionPoolStats struct {
+	Workers int `json:"workers"`
+	// QueueDepth is the number of events waiting for a worker
+	QueueDepth int `json:"queue_depth"`
+	// InFlight is the number of events received but not yet recorded
+	InFlight  int    `json:"in_flight"`
+	Capacity  int    `json:"capacity"`
+	Processed uint64 `json:"processed"`
+}
+
+// activePool is the running detection pool, nil before monitoring starts
+var activePool atomic.Pointer[detectionPool]
+
+// newDetectionPool creates a pool of workers holding at most queue events
+func newDetectionPool(workers, queue int) *detectionPool {
+	return &detectionPool{
+		workers: workers,
+		jobs:    make(chan detectionJob, queue),
+		results: make(chan detectionJob, queue),
+		slots:   make(chan struct{}, queue),
+	}
+}
+
+// stats returns the current load of the pool
+func (p *detectionPool) stats() DetectionPoolStats {
+	return DetectionPoolStats{
+		Workers:    p.workers,
+		QueueDepth: len(p.jobs),
+		InFlight:   len(p.slots),
+		Capacity:   cap(p.slots),
+		Processed:  p.processed.Load(),
+	}
+}
+
+// run detects and records events until the channel is closed. Sources
+// block once the pool is full rather than events being dropped.
+func (p *detectionPool) run(events <-chan ProcessEvent) {
+	var wg sync.WaitGroup
+	for range p.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range p.jobs {
+				job.event = detectEvent(job.event)
+				p.results <- job
+			}
+		}()
+	}
+	go func() {
+		var seq uint64
+		for event := range events {
+			p.slots <- struct{}{}
+			p.jobs <- detectionJob{seq: seq, event: event}
+			seq++
+		}
+		close(p.jobs)
+		wg.Wait()
+		close(p.results)
+	}()
+
+	// Results finishing early wait for the events that arrived before them
+	pending := make(map[uint64]ProcessEvent)
+	var next uint64
+	for job := range p.results {
+		pending[job.seq] = job.event
+		for {
+			event, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			recordEvent(event)
+			p.processed.Add(1)
+			<-p.slots
+		}
+	}
+}
+
+// detectionStats returns the load of the running detection pool
+func detectionStats() *DetectionPoolStats {
+	pool := activePool.Load()
+	if pool == nil {
+		return nil
+	}
+	stats := pool.stats()
+	return &stats
+}
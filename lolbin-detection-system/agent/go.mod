@@ -2,13 +2,20 @@ module lolbin-detection-system/agent
 
 go 1.24.2
 
+require (
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/gorilla/mux v1.8.1
+	github.com/oschwald/geoip2-golang v1.9.0
+	golang.org/x/sys v0.32.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
 require (
 	github.com/bi-zone/go-ole v1.2.5 // indirect
 	github.com/bi-zone/wmi v1.1.4 // indirect
 	github.com/go-ole/go-ole v1.2.4 // indirect
-	github.com/gorilla/mux v1.8.1 // indirect
 	github.com/hashicorp/errwrap v1.0.0 // indirect
 	github.com/hashicorp/go-multierror v1.0.0 // indirect
+	github.com/oschwald/maxminddb-golang v1.13.1 // indirect
 	github.com/scjalliance/comshim v0.0.0-20190308082608-cf06d2532c4e // indirect
-	golang.org/x/sys v0.32.0 // indirect
 )